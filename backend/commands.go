@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/services"
+	"gorm.io/gorm"
+)
+
+// runCommand runs a one-off maintenance command instead of the server
+func runCommand(cfg *config.Config, db *gorm.DB, name string, args []string) error {
+	switch name {
+	case "migrate-bucket":
+		return migrateBucket(cfg, db, args)
+	default:
+		return fmt.Errorf("unknown command %q; available: migrate-bucket", name)
+	}
+}
+
+// migrateBucket moves the objects of a bucket to another storage backend:
+//
+//	main migrate-bucket -project 12 -bucket photos -to s3
+func migrateBucket(cfg *config.Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("migrate-bucket", flag.ContinueOnError)
+	projectID := flags.Uint("project", 0, "ID of the project owning the bucket")
+	bucket := flags.String("bucket", "", "name of the bucket")
+	target := flags.String("to", "", "storage backend to move the bucket to (local or s3)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *projectID == 0 || *bucket == "" || *target == "" {
+		flags.Usage()
+		return fmt.Errorf("-project, -bucket and -to are required")
+	}
+
+	// Interrupting stops after the file being moved; running the command again resumes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("Moving bucket '%s' of project %d to the %s storage backend", *bucket, *projectID, *target)
+	moved, err := services.MigrateBucket(ctx, db, services.NewStorageBackends(cfg), *projectID, *bucket, *target)
+	if err != nil {
+		return fmt.Errorf("moved %d files before failing: %w", moved, err)
+	}
+	log.Printf("Moved %d files; bucket '%s' is stored in %s", moved, *bucket, *target)
+	return nil
+}
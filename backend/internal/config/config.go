@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
@@ -19,6 +20,10 @@ type Config struct {
 	RedisURL    string
 	BaseURL     string
 	MasterKey   string // Master key for encrypting sensitive data
+	APIKeySecret string // HMAC key for API key hashes; defaults to the JWT secret
+	APIKeyRotationGrace time.Duration // How long a rotated key keeps working by default
+	APIKeyInactiveDays  int           // Keys unused this long are deactivated; 0 disables
+	APIKeyWarningDays   int           // Owners are warned this long before deactivation
 	
 	// CORS settings
 	AllowedOrigins []string
@@ -26,19 +31,56 @@ type Config struct {
 	AllowedHeaders []string
 	
 	// Rate limiting
-	RateLimitRequests int
+	RateLimitRequests int    // Per client of a project, and per IP before authentication
 	RateLimitWindow   string
+	RateLimitStore    string // memory, or redis to share limits between instances
+	
+	// Server default usage quotas of each project; 0 is unlimited
+	QuotaStorageBytes      int64
+	QuotaDocuments         int64
+	QuotaAppUsers          int64
+	QuotaAPICalls          int64   // Per calendar month
+	QuotaFunctionGBSeconds float64 // Per calendar month
 	
 	// File upload
-	MaxFileSize   int64
-	UploadPath    string
-	AllowedTypes  []string
+	MaxFileSize     int64
+	UploadPath      string // Root of the local storage backend
+	AllowedTypes    []string
+	UploadExpiry    time.Duration // Resumable uploads without a new part for this long are discarded
+	SignedURLSecret string        // HMAC key for signed file URLs; defaults to the JWT secret
+	
+	// Storage backends; buckets are created in StorageBackend unless they choose another
+	StorageBackend    string // local or s3
+	S3Endpoint        string // Empty for AWS, or the URL of an S3-compatible server such as MinIO
+	S3Region          string
+	S3Bucket          string // Enables the s3 backend
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3PathStyle       bool // Address the bucket in the path instead of the host name
+	
+	// Image transformations
+	ImageCachePath string        // Generated variants of images
+	ImageCacheTTL  time.Duration // Variants not served for this long are deleted
 	
 	// Backup settings
 	BackupDir     string
 	
+	// Background jobs: deployments, backups and function builds
+	JobWorkers int // Jobs run at once by each instance
+	
 	// GitHub integration
 	GitHubToken   string
+	
+	// Mail delivery for app user emails; projects may configure their own SMTP server
+	MailDriver   string // smtp, file or log
+	MailDir      string // Directory of the file driver
+	MailFrom     string
+	MailFromName string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPSecurity string // starttls, tls or none
 }
 
 // Load reads configuration from environment variables and config files
@@ -59,16 +101,40 @@ func Load() (*Config, error) {
 	viper.SetDefault("ALLOWED_HEADERS", []string{"*"})
 	
 	// Rate limiting defaults
-	viper.SetDefault("RATE_LIMIT_REQUESTS", 100)
-	viper.SetDefault("RATE_LIMIT_WINDOW", "1h")
+	viper.SetDefault("RATE_LIMIT_REQUESTS", 600)
+	viper.SetDefault("RATE_LIMIT_WINDOW", "1m")
+	viper.SetDefault("RATE_LIMIT_STORE", "memory")
 	
 	// File upload defaults
 	viper.SetDefault("MAX_FILE_SIZE", 10<<20) // 10MB
 	viper.SetDefault("UPLOAD_PATH", "./uploads")
+	viper.SetDefault("UPLOAD_EXPIRY", "24h")
 	viper.SetDefault("ALLOWED_TYPES", []string{"image/jpeg", "image/png", "image/gif", "text/html", "text/css", "application/javascript"})
 	
+	// Storage backend defaults
+	viper.SetDefault("STORAGE_BACKEND", "local")
+	viper.SetDefault("S3_REGION", "us-east-1")
+	
+	// Image transformation defaults
+	viper.SetDefault("IMAGE_CACHE_PATH", "./cache/images")
+	viper.SetDefault("IMAGE_CACHE_TTL", "720h")
+	
 	// Backup defaults
 	viper.SetDefault("BACKUP_DIR", "/var/lib/cloudbox/backups")
+	
+	// Background job defaults
+	viper.SetDefault("JOB_WORKERS", 4)
+	
+	// API key lifecycle defaults
+	viper.SetDefault("API_KEY_ROTATION_GRACE", "24h")
+	viper.SetDefault("API_KEY_INACTIVE_DAYS", 90)
+	viper.SetDefault("API_KEY_WARNING_DAYS", 7)
+	
+	// Mail defaults
+	viper.SetDefault("MAIL_DRIVER", "log")
+	viper.SetDefault("MAIL_FROM", "noreply@cloudbox.local")
+	viper.SetDefault("SMTP_PORT", 587)
+	viper.SetDefault("SMTP_SECURITY", "starttls")
 
 	// Bind environment variables
 	viper.AutomaticEnv()
@@ -86,6 +152,10 @@ func Load() (*Config, error) {
 		RedisURL:    getEnvOrDefault("REDIS_URL", "redis://localhost:6379"),
 		BaseURL:     getEnvOrDefault("BASE_URL", "http://localhost:8080"),
 		MasterKey:   getEnvOrDefault("MASTER_KEY", ""),
+		APIKeySecret: getEnvOrDefault("API_KEY_SECRET", ""),
+		APIKeyRotationGrace: viper.GetDuration("API_KEY_ROTATION_GRACE"),
+		APIKeyInactiveDays:  viper.GetInt("API_KEY_INACTIVE_DAYS"),
+		APIKeyWarningDays:   viper.GetInt("API_KEY_WARNING_DAYS"),
 		
 		AllowedOrigins: getCORSOrigins(),
 		AllowedMethods: allowedMethods,
@@ -93,13 +163,45 @@ func Load() (*Config, error) {
 		
 		RateLimitRequests: viper.GetInt("RATE_LIMIT_REQUESTS"),
 		RateLimitWindow:   viper.GetString("RATE_LIMIT_WINDOW"),
+		RateLimitStore:    viper.GetString("RATE_LIMIT_STORE"),
+		
+		QuotaStorageBytes:      viper.GetInt64("QUOTA_STORAGE_BYTES"),
+		QuotaDocuments:         viper.GetInt64("QUOTA_DOCUMENTS"),
+		QuotaAppUsers:          viper.GetInt64("QUOTA_APP_USERS"),
+		QuotaAPICalls:          viper.GetInt64("QUOTA_API_CALLS"),
+		QuotaFunctionGBSeconds: viper.GetFloat64("QUOTA_FUNCTION_GB_SECONDS"),
+		
+		MaxFileSize:     maxFileSize,
+		UploadPath:      getEnvOrDefault("UPLOAD_PATH", "./uploads"),
+		AllowedTypes:    viper.GetStringSlice("ALLOWED_TYPES"),
+		UploadExpiry:    viper.GetDuration("UPLOAD_EXPIRY"),
+		SignedURLSecret: getEnvOrDefault("SIGNED_URL_SECRET", ""),
 		
-		MaxFileSize:  maxFileSize,
-		UploadPath:   getEnvOrDefault("UPLOAD_PATH", "./uploads"),
-		AllowedTypes: viper.GetStringSlice("ALLOWED_TYPES"),
+		StorageBackend:    viper.GetString("STORAGE_BACKEND"),
+		S3Endpoint:        getEnvOrDefault("S3_ENDPOINT", ""),
+		S3Region:          viper.GetString("S3_REGION"),
+		S3Bucket:          getEnvOrDefault("S3_BUCKET", ""),
+		S3AccessKeyID:     getEnvOrDefault("S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey: getEnvOrDefault("S3_SECRET_ACCESS_KEY", ""),
+		S3PathStyle:       viper.GetBool("S3_PATH_STYLE"),
+		
+		ImageCachePath: viper.GetString("IMAGE_CACHE_PATH"),
+		ImageCacheTTL:  viper.GetDuration("IMAGE_CACHE_TTL"),
 		
 		BackupDir:    getEnvOrDefault("BACKUP_DIR", "/var/lib/cloudbox/backups"),
 		GitHubToken:  getEnvOrDefault("GITHUB_TOKEN", ""),
+		
+		JobWorkers: viper.GetInt("JOB_WORKERS"),
+		
+		MailDriver:   getEnvOrDefault("MAIL_DRIVER", "log"),
+		MailDir:      getEnvOrDefault("MAIL_DIR", "./mail"),
+		MailFrom:     getEnvOrDefault("MAIL_FROM", "noreply@cloudbox.local"),
+		MailFromName: getEnvOrDefault("MAIL_FROM_NAME", "CloudBox"),
+		SMTPHost:     getEnvOrDefault("SMTP_HOST", ""),
+		SMTPPort:     viper.GetInt("SMTP_PORT"),
+		SMTPUsername: getEnvOrDefault("SMTP_USERNAME", ""),
+		SMTPPassword: getEnvOrDefault("SMTP_PASSWORD", ""),
+		SMTPSecurity: getEnvOrDefault("SMTP_SECURITY", "starttls"),
 	}
 
 	return config, nil
@@ -51,20 +51,37 @@ func Migrate(db *gorm.DB) error {
 	// because we use a partial unique index (migration 010)
 	if err := db.AutoMigrate(
 		&models.Project{},
+		&models.ProjectUsage{},
 		&models.ProjectGitHubConfig{},
 		&models.APIKey{},
 		&models.CORSConfig{},
 		&models.SSHKey{},
 		&models.WebServer{},
 		&models.GitHubRepository{},
+		&models.WebhookDelivery{},
 		&models.Deployment{},
 		&models.Backup{},
+		&models.BackupDestination{},
+		&models.BackupSchedule{},
+		&models.Job{},
 		&models.Collection{},
 		&models.Document{},
+		&models.CollectionIndex{},
+		&models.DocumentRevision{},
+		&models.DocumentChange{},
 		&models.Bucket{},
 		&models.File{},
+		&models.FileUpload{},
+		&models.FileUploadPart{},
+		&models.SignedURLGrant{},
 		&models.AppUser{},
 		&models.AppSession{},
+		&models.ProjectAuthSettings{},
+		&models.AuthProvider{},
+		&models.AppUserIdentity{},
+		&models.OAuthState{},
+		&models.ProjectMailSettings{},
+		&models.EmailTemplate{},
 		&models.Channel{},
 		&models.ChannelMember{},
 		&models.Message{},
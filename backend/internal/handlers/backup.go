@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
 	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -20,13 +22,7 @@ type BackupHandler struct {
 
 // NewBackupHandler creates a new backup handler
 func NewBackupHandler(db *gorm.DB, cfg *config.Config) *BackupHandler {
-	// Create backup directory if not specified in config
-	backupDir := "/var/lib/cloudbox/backups"
-	if cfg.BackupDir != "" {
-		backupDir = cfg.BackupDir
-	}
-	
-	backupService := services.NewBackupService(db, backupDir)
+	backupService := services.NewBackupService(db, cfg)
 	
 	return &BackupHandler{
 		db:            db,
@@ -40,11 +36,21 @@ type CreateBackupRequest struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	Type        string `json:"type"` // manual, automatic
+	Mode        string `json:"mode" binding:"omitempty,oneof=full incremental"`
+	ParentID    uint   `json:"parent_id"` // Backup an incremental backup builds on; the latest by default
+	DestinationID uint `json:"destination_id"` // Where the archive is stored; the backup directory by default
+	Encrypt     bool   `json:"encrypt"` // Encrypt the archive with the master key
 }
 
 // RestoreBackupRequest represents a request to restore from backup
 type RestoreBackupRequest struct {
-	TargetProjectID uint `json:"target_project_id"`
+	TargetProjectID uint     `json:"target_project_id"`
+	NewProjectName  string   `json:"new_project_name"` // Restore into a new project of this name instead
+	Mode            string   `json:"mode" binding:"omitempty,oneof=replace merge"`
+	Collections     []string `json:"collections"` // Restore only these collections, buckets and functions
+	Buckets         []string `json:"buckets"`
+	Functions       []string `json:"functions"`
+	DryRun          bool     `json:"dry_run"` // Only report what the restore would change
 }
 
 // ListBackups returns all backups for a project
@@ -84,7 +90,19 @@ func (h *BackupHandler) CreateBackup(c *gin.Context) {
 	}
 
 	// Create backup using service
-	backup, err := h.backupService.CreateBackup(uint(projectID), req.Type)
+	backup, err := h.backupService.CreateBackup(uint(projectID), services.BackupOptions{
+		Name:        req.Name,
+		Description: req.Description,
+		Type:        req.Type,
+		Mode:        req.Mode,
+		ParentID:    req.ParentID,
+		DestinationID: req.DestinationID,
+		Encrypt:     req.Encrypt,
+	})
+	if errors.Is(err, services.ErrInvalidBackupParent) || errors.Is(err, services.ErrBackupDestinationNotFound) || errors.Is(err, services.ErrBackupEncryptionUnavailable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create backup: %v", err)})
 		return
@@ -95,30 +113,38 @@ func (h *BackupHandler) CreateBackup(c *gin.Context) {
 
 // GetBackup returns a specific backup
 func (h *BackupHandler) GetBackup(c *gin.Context) {
-	backupID, err := strconv.ParseUint(c.Param("backup_id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup ID"})
+	projectID, backupID, ok := parseBackupConfigIDs(c, "backup_id")
+	if !ok {
 		return
 	}
 
-	backup, err := h.backupService.GetBackup(uint(backupID))
-	if err != nil {
+	backup, err := h.backupService.GetBackup(projectID, backupID)
+	if errors.Is(err, services.ErrBackupNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch backup"})
+		return
+	}
 
 	c.JSON(http.StatusOK, backup)
 }
 
 // DeleteBackup deletes a backup
 func (h *BackupHandler) DeleteBackup(c *gin.Context) {
-	backupID, err := strconv.ParseUint(c.Param("backup_id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup ID"})
+	projectID, backupID, ok := parseBackupConfigIDs(c, "backup_id")
+	if !ok {
 		return
 	}
 
-	if err := h.backupService.DeleteBackup(uint(backupID)); err != nil {
+	if err := h.backupService.DeleteBackup(projectID, backupID); errors.Is(err, services.ErrBackupNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+		return
+	} else if errors.Is(err, services.ErrBackupInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Incremental backups build on this backup; delete them first"})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete backup: %v", err)})
 		return
 	}
@@ -126,11 +152,38 @@ func (h *BackupHandler) DeleteBackup(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Backup deleted successfully"})
 }
 
+// GetManifest returns the manifest of a backup, after checking the archive against it
+func (h *BackupHandler) GetManifest(c *gin.Context) {
+	projectID, backupID, ok := parseBackupConfigIDs(c, "backup_id")
+	if !ok {
+		return
+	}
+
+	manifest, err := h.backupService.GetManifest(projectID, backupID)
+	if errors.Is(err, services.ErrBackupNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+		return
+	}
+	if errors.Is(err, services.ErrBackupCorrupt) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to read backup: %v", err)})
+		return
+	}
+	if manifest == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backups made before format 2.0 have no manifest"})
+		return
+	}
+
+	c.JSON(http.StatusOK, manifest)
+}
+
 // RestoreBackup restores from a backup
 func (h *BackupHandler) RestoreBackup(c *gin.Context) {
-	backupID, err := strconv.ParseUint(c.Param("backup_id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup ID"})
+	projectID, backupID, ok := parseBackupConfigIDs(c, "backup_id")
+	if !ok {
 		return
 	}
 
@@ -140,24 +193,83 @@ func (h *BackupHandler) RestoreBackup(c *gin.Context) {
 		return
 	}
 
-	// If no target project specified, restore to original project
-	if req.TargetProjectID == 0 {
-		// Get backup to find original project ID
-		backup, err := h.backupService.GetBackup(uint(backupID))
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+	backup, err := h.backupService.GetBackup(projectID, backupID)
+	if errors.Is(err, services.ErrBackupNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backup not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch backup"})
+		return
+	}
+	if req.NewProjectName != "" && req.TargetProjectID != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either target_project_id or new_project_name can be given"})
+		return
+	}
+	// Restores overwrite the target, so it has to be a project the caller can access
+	if req.TargetProjectID != 0 && req.TargetProjectID != projectID {
+		if _, canAccess := accessibleProject(h.db, c, req.TargetProjectID); !canAccess {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Target project not found"})
+			return
+		}
+	}
+
+	options := services.RestoreOptions{
+		TargetProjectID: req.TargetProjectID,
+		NewProject:      req.NewProjectName != "",
+		Mode:            req.Mode,
+		Collections:     req.Collections,
+		Buckets:         req.Buckets,
+		Functions:       req.Functions,
+		DryRun:          req.DryRun,
+	}
+
+	// Clones go to a new project in the organization of the backed up one
+	var clone *models.Project
+	if options.NewProject && !req.DryRun {
+		var source models.Project
+		if err := h.db.First(&source, backup.ProjectID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project of the backup not found"})
 			return
 		}
-		req.TargetProjectID = backup.ProjectID
+		clone = &models.Project{
+			Name:           req.NewProjectName,
+			Description:    source.Description,
+			Slug:           uniqueProjectSlug(h.db, req.NewProjectName),
+			UserID:         c.GetUint("user_id"),
+			OrganizationID: source.OrganizationID,
+			IsActive:       true,
+		}
+		if err := h.db.Create(clone).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create project"})
+			return
+		}
+		options.TargetProjectID = clone.ID
 	}
 
-	if err := h.backupService.RestoreBackup(uint(backupID), req.TargetProjectID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to restore backup: %v", err)})
+	result, err := h.backupService.RestoreBackup(projectID, backup.ID, options)
+	if err != nil {
+		if clone != nil {
+			h.db.Unscoped().Delete(clone)
+		}
+		switch {
+		case errors.Is(err, services.ErrInvalidRestore):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrBackupFormatUnsupported):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to restore backup: %v", err)})
+		}
 		return
 	}
 
+	message := "Backup restore completed successfully"
+	if result.DryRun {
+		message = "Backup restore dry run completed, nothing was changed"
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"message":           "Backup restore completed successfully",
-		"target_project_id": req.TargetProjectID,
+		"message":           message,
+		"target_project_id": result.TargetProjectID,
+		"result":            result,
 	})
 }
\ No newline at end of file
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// BackupDestinationRequest represents a request to create or update a backup destination
+type BackupDestinationRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Type        string `json:"type" binding:"required,oneof=local sftp s3"`
+	Path        string `json:"path"`          // Directory for local and sftp, key prefix for s3
+	WebServerID *uint  `json:"web_server_id"` // Web server an sftp destination is reached through
+
+	S3Endpoint        string `json:"s3_endpoint"`
+	S3Region          string `json:"s3_region"`
+	S3Bucket          string `json:"s3_bucket"`
+	S3AccessKeyID     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"` // Kept when empty on updates
+	S3PathStyle       bool   `json:"s3_path_style"`
+}
+
+// apply sets the fields of a destination from the request
+func (req BackupDestinationRequest) apply(destination *models.BackupDestination) {
+	destination.Name = req.Name
+	destination.Type = req.Type
+	destination.Path = req.Path
+	destination.WebServerID = req.WebServerID
+	destination.S3Endpoint = req.S3Endpoint
+	destination.S3Region = req.S3Region
+	destination.S3Bucket = req.S3Bucket
+	destination.S3AccessKeyID = req.S3AccessKeyID
+	destination.S3PathStyle = req.S3PathStyle
+}
+
+// BackupScheduleRequest represents a request to create or update a backup schedule; omitted
+// numbers and flags keep their current values, or the defaults for new schedules
+type BackupScheduleRequest struct {
+	Name           string `json:"name" binding:"required"`
+	CronExpression string `json:"cron_expression" binding:"required"`
+	Timezone       string `json:"timezone"`
+	Enabled        *bool  `json:"enabled"`
+	Mode           string `json:"mode" binding:"omitempty,oneof=full incremental"`
+	FullEvery      *int   `json:"full_every"`
+	DestinationID  *uint  `json:"destination_id"`
+	Encrypt        *bool  `json:"encrypt"`
+	KeepDaily      *int   `json:"keep_daily"`
+	KeepWeekly     *int   `json:"keep_weekly"`
+	KeepMonthly    *int   `json:"keep_monthly"`
+}
+
+// apply sets the fields of a schedule from the request
+func (req BackupScheduleRequest) apply(schedule *models.BackupSchedule) {
+	schedule.Name = req.Name
+	schedule.CronExpression = req.CronExpression
+	schedule.Timezone = req.Timezone
+	schedule.Mode = req.Mode
+	schedule.DestinationID = req.DestinationID
+	if req.Enabled != nil {
+		schedule.Enabled = *req.Enabled
+	}
+	if req.FullEvery != nil {
+		schedule.FullEvery = *req.FullEvery
+	}
+	if req.Encrypt != nil {
+		schedule.Encrypt = *req.Encrypt
+	}
+	if req.KeepDaily != nil {
+		schedule.KeepDaily = *req.KeepDaily
+	}
+	if req.KeepWeekly != nil {
+		schedule.KeepWeekly = *req.KeepWeekly
+	}
+	if req.KeepMonthly != nil {
+		schedule.KeepMonthly = *req.KeepMonthly
+	}
+}
+
+// backupConfigError responds to an error of a destination or schedule operation
+func backupConfigError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrBackupDestinationNotFound), errors.Is(err, services.ErrBackupScheduleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidBackupDestination), errors.Is(err, services.ErrInvalidBackupSchedule),
+		errors.Is(err, services.ErrBackupEncryptionUnavailable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrBackupDestinationInUse), errors.Is(err, services.ErrBackupScheduleBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// parseBackupConfigIDs parses the project ID and the ID of a destination or schedule
+func parseBackupConfigIDs(c *gin.Context, param string) (uint, uint, bool) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return 0, 0, false
+	}
+	if param == "" {
+		return uint(projectID), 0, true
+	}
+	id, err := strconv.ParseUint(c.Param(param), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s", param)})
+		return 0, 0, false
+	}
+	return uint(projectID), uint(id), true
+}
+
+// ListDestinations returns the backup destinations of a project
+func (h *BackupHandler) ListDestinations(c *gin.Context) {
+	projectID, _, ok := parseBackupConfigIDs(c, "")
+	if !ok {
+		return
+	}
+
+	destinations, err := h.backupService.ListDestinations(projectID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch backup destinations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, destinations)
+}
+
+// CreateDestination creates a backup destination
+func (h *BackupHandler) CreateDestination(c *gin.Context) {
+	projectID, _, ok := parseBackupConfigIDs(c, "")
+	if !ok {
+		return
+	}
+
+	var req BackupDestinationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	destination := models.BackupDestination{ProjectID: projectID}
+	req.apply(&destination)
+	if err := h.backupService.SaveDestination(&destination, req.S3SecretAccessKey); err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, destination)
+}
+
+// GetDestination returns a backup destination
+func (h *BackupHandler) GetDestination(c *gin.Context) {
+	projectID, destinationID, ok := parseBackupConfigIDs(c, "destination_id")
+	if !ok {
+		return
+	}
+
+	destination, err := h.backupService.GetDestination(projectID, destinationID)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, destination)
+}
+
+// UpdateDestination updates a backup destination
+func (h *BackupHandler) UpdateDestination(c *gin.Context) {
+	projectID, destinationID, ok := parseBackupConfigIDs(c, "destination_id")
+	if !ok {
+		return
+	}
+
+	var req BackupDestinationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	destination, err := h.backupService.GetDestination(projectID, destinationID)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+	req.apply(destination)
+	if err := h.backupService.SaveDestination(destination, req.S3SecretAccessKey); err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, destination)
+}
+
+// DeleteDestination deletes a backup destination no backup or schedule uses
+func (h *BackupHandler) DeleteDestination(c *gin.Context) {
+	projectID, destinationID, ok := parseBackupConfigIDs(c, "destination_id")
+	if !ok {
+		return
+	}
+
+	if err := h.backupService.DeleteDestination(projectID, destinationID); err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Backup destination deleted successfully"})
+}
+
+// TestDestination writes, reads back and deletes a small object in a backup destination
+func (h *BackupHandler) TestDestination(c *gin.Context) {
+	projectID, destinationID, ok := parseBackupConfigIDs(c, "destination_id")
+	if !ok {
+		return
+	}
+
+	destination, err := h.backupService.GetDestination(projectID, destinationID)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+	if err := h.backupService.TestDestination(c.Request.Context(), *destination); err != nil {
+		c.JSON(http.StatusOK, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Backup destination is reachable and writable"})
+}
+
+// ListSchedules returns the backup schedules of a project
+func (h *BackupHandler) ListSchedules(c *gin.Context) {
+	projectID, _, ok := parseBackupConfigIDs(c, "")
+	if !ok {
+		return
+	}
+
+	schedules, err := h.backupService.ListSchedules(projectID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch backup schedules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, schedules)
+}
+
+// CreateSchedule creates a backup schedule
+func (h *BackupHandler) CreateSchedule(c *gin.Context) {
+	projectID, _, ok := parseBackupConfigIDs(c, "")
+	if !ok {
+		return
+	}
+
+	var req BackupScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Defaults: enabled, a full backup a week, and a week of dailies, a month of weeklies and
+	// half a year of monthlies
+	schedule := models.BackupSchedule{
+		ProjectID:   projectID,
+		Enabled:     true,
+		FullEvery:   7,
+		KeepDaily:   7,
+		KeepWeekly:  4,
+		KeepMonthly: 6,
+	}
+	req.apply(&schedule)
+	if err := h.backupService.SaveSchedule(&schedule); err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, schedule)
+}
+
+// GetSchedule returns a backup schedule
+func (h *BackupHandler) GetSchedule(c *gin.Context) {
+	projectID, scheduleID, ok := parseBackupConfigIDs(c, "schedule_id")
+	if !ok {
+		return
+	}
+
+	schedule, err := h.backupService.GetSchedule(projectID, scheduleID)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+// UpdateSchedule updates a backup schedule, planning its next run anew
+func (h *BackupHandler) UpdateSchedule(c *gin.Context) {
+	projectID, scheduleID, ok := parseBackupConfigIDs(c, "schedule_id")
+	if !ok {
+		return
+	}
+
+	var req BackupScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	schedule, err := h.backupService.GetSchedule(projectID, scheduleID)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+	req.apply(schedule)
+	if err := h.backupService.SaveSchedule(schedule); err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteSchedule deletes a backup schedule; its backups are kept
+func (h *BackupHandler) DeleteSchedule(c *gin.Context) {
+	projectID, scheduleID, ok := parseBackupConfigIDs(c, "schedule_id")
+	if !ok {
+		return
+	}
+
+	if err := h.backupService.DeleteSchedule(projectID, scheduleID); err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Backup schedule deleted successfully"})
+}
+
+// RunSchedule takes a backup for a schedule now, leaving its next run as planned
+func (h *BackupHandler) RunSchedule(c *gin.Context) {
+	projectID, scheduleID, ok := parseBackupConfigIDs(c, "schedule_id")
+	if !ok {
+		return
+	}
+
+	schedule, err := h.backupService.GetSchedule(projectID, scheduleID)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+	backup, err := h.backupService.RunSchedule(*schedule)
+	if err != nil {
+		backupConfigError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, backup)
+}
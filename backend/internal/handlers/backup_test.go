@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testSQLiteDriver is SQLite with stand-ins for the Postgres functions queries call
+const testSQLiteDriver = "sqlite3_postgres_functions"
+
+func init() {
+	sql.Register(testSQLiteDriver, &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		// Notifications have no listeners in tests
+		if err := conn.RegisterFunc("pg_notify", func(channel, payload string) string { return "" }, false); err != nil {
+			return err
+		}
+		// DATE() already renders days as YYYY-MM-DD
+		return conn.RegisterFunc("to_char", func(value, format string) string { return value }, true)
+	}})
+}
+
+// openTestDB opens an in-memory database with the tables of the given models
+func openTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Dialector{DriverName: testSQLiteDriver, DSN: "file::memory:"}, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	return db
+}
+
+func TestRestoreBackupTargetProject(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.Backup{}, &models.Job{})
+	handler := NewBackupHandler(db, &config.Config{BackupDir: t.TempDir()})
+
+	owned := models.Project{Name: "owned", Slug: "owned", UserID: 1}
+	foreign := models.Project{Name: "foreign", Slug: "foreign", UserID: 2}
+	db.Create(&owned)
+	db.Create(&foreign)
+	backup := models.Backup{Name: "nightly", ProjectID: owned.ID, Status: "completed"}
+	db.Create(&backup)
+
+	restore := func(role string, target uint) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.POST("/projects/:id/backups/:backup_id/restore", func(c *gin.Context) {
+			c.Set("user_id", uint(1))
+			c.Set("user_role", role)
+		}, handler.RestoreBackup)
+
+		body := fmt.Sprintf(`{"target_project_id": %d, "mode": "merge", "dry_run": true}`, target)
+		request := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/projects/%d/backups/%d/restore", owned.ID, backup.ID), strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if recorder := restore("admin", foreign.ID); recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), "Target project not found") {
+		t.Errorf("restoring into a project of another admin: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := restore("admin", 999); recorder.Code != http.StatusNotFound {
+		t.Errorf("restoring into a missing project: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Own projects and, for superadmins, every project pass the check; the restore itself then
+	// fails because the backup has no archive
+	for _, attempt := range []struct {
+		role   string
+		target uint
+	}{{"admin", owned.ID}, {"superadmin", foreign.ID}} {
+		if recorder := restore(attempt.role, attempt.target); strings.Contains(recorder.Body.String(), "Target project not found") {
+			t.Errorf("%s restoring into project %d was rejected: %s", attempt.role, attempt.target, recorder.Body.String())
+		}
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"log"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/middleware"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -19,13 +22,17 @@ import (
 
 // DataHandler handles data API requests (collections and documents)
 type DataHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db         *gorm.DB
+	cfg        *config.Config
+	changeFeed *services.ChangeFeed
+	quotas     *services.QuotaService
 }
 
 // NewDataHandler creates a new data handler
 func NewDataHandler(db *gorm.DB, cfg *config.Config) *DataHandler {
-	return &DataHandler{db: db, cfg: cfg}
+	changeFeed := services.NewChangeFeed(db)
+	changeFeed.Start(cfg.DatabaseURL)
+	return &DataHandler{db: db, cfg: cfg, changeFeed: changeFeed, quotas: services.NewQuotaService(db, cfg)}
 }
 
 // Collection Management
@@ -52,6 +59,7 @@ func (h *DataHandler) CreateCollection(c *gin.Context) {
 		Description string                 `json:"description"`
 		Schema      map[string]interface{} `json:"schema"`
 		Indexes     []string               `json:"indexes"`
+		revisionSettings
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -65,6 +73,21 @@ func (h *DataHandler) CreateCollection(c *gin.Context) {
 		return
 	}
 	
+	// Reject JSON Schemas that do not compile
+	if isJSONSchema(req.Schema) {
+		if _, err := compileJSONSchema(req.Schema); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Schema", "details": err.Error()})
+			return
+		}
+	}
+	
+	// Validate index declarations
+	indexes, err := parseIndexSpecs(req.Indexes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
 	// Check if collection already exists
 	var existingCollection models.Collection
 	if err := h.db.Where("project_id = ? AND name = ?", project.ID, req.Name).First(&existingCollection).Error; err == nil {
@@ -77,17 +100,26 @@ func (h *DataHandler) CreateCollection(c *gin.Context) {
 		Name:          req.Name,
 		Description:   req.Description,
 		Schema:        req.Schema,
-		Indexes:       req.Indexes,
+		Indexes:       indexes,
 		ProjectID:     project.ID,
 		DocumentCount: 0,
 		LastModified:  time.Now(),
 	}
+	if err := req.revisionSettings.apply(&collection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	
 	if err := h.db.Create(&collection).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create collection"})
 		return
 	}
 	
+	// Materialize declared indexes (built in the background)
+	if err := syncCollectionIndexes(h.db, project.ID, collection.Name, collection.Indexes); err != nil {
+		log.Printf("Failed to create indexes for collection %s: %v", collection.Name, err)
+	}
+	
 	c.JSON(http.StatusCreated, collection)
 }
 
@@ -125,6 +157,13 @@ func (h *DataHandler) DeleteCollection(c *gin.Context) {
 		return
 	}
 	
+	// Revision history goes with the collection
+	if err := tx.Where("project_id = ? AND collection_name = ?", project.ID, collectionName).Delete(&models.DocumentRevision{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete document revisions"})
+		return
+	}
+	
 	// Delete collection
 	result := tx.Where("project_id = ? AND name = ?", project.ID, collectionName).Delete(&models.Collection{})
 	if result.Error != nil {
@@ -140,6 +179,12 @@ func (h *DataHandler) DeleteCollection(c *gin.Context) {
 	}
 	
 	tx.Commit()
+	
+	// Drop materialized indexes of the collection
+	if err := syncCollectionIndexes(h.db, project.ID, collectionName, nil); err != nil {
+		log.Printf("Failed to drop indexes for collection %s: %v", collectionName, err)
+	}
+	
 	c.JSON(http.StatusOK, gin.H{"message": "Collection deleted successfully"})
 }
 
@@ -159,7 +204,7 @@ func (h *DataHandler) ListDocuments(c *gin.Context) {
 	// Parse query parameters
 	limit := 25 // Default limit
 	offset := 0
-	orderBy := "created_at DESC"
+	sort := querySort{Field: "created_at", Direction: "DESC"}
 	
 	if l := c.Query("limit"); l != "" {
 		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
@@ -177,15 +222,27 @@ func (h *DataHandler) ListDocuments(c *gin.Context) {
 		// Strict validation for order by to prevent SQL injection
 		validOrderPattern := regexp.MustCompile(`^(created_at|updated_at)\s+(ASC|DESC)$|^(created_at|updated_at)$`)
 		if validOrderPattern.MatchString(strings.TrimSpace(order)) {
-			orderBy = strings.TrimSpace(order)
+			fields := strings.Fields(order)
+			sort = querySort{Field: fields[0], Direction: "ASC"}
+			if len(fields) == 2 {
+				sort.Direction = fields[1]
+			}
 		}
 	}
 	
-	var documents []models.Document
-	query := h.db.Where("project_id = ? AND collection_name = ?", project.ID, collectionName).
-		Limit(limit).
-		Offset(offset).
-		Order(orderBy)
+	sortKeys, err := compileSortKeys([]querySort{sort})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	page, err := newKeysetPage(sortKeys, c.Query("cursor"), limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor", "details": err.Error()})
+		return
+	}
+	
+	query := collectionDocuments(h.db, project.ID, collectionName)
 	
 	// Add secure JSON filtering if provided
 	if filter := c.Query("filter"); filter != "" {
@@ -200,35 +257,33 @@ func (h *DataHandler) ListDocuments(c *gin.Context) {
 			query = query.Where("data::text ILIKE ?", "%"+safeFilter+"%")
 		}
 	}
+	query = query.Session(&gorm.Session{})
 	
-	if err := query.Find(&documents).Error; err != nil {
+	documents, nextCursor, prevCursor, err := h.findDocumentPage(query, page, offset)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch documents"})
 		return
 	}
 	
-	// Get total count efficiently in single query
-	var total int64
-	countQuery := h.db.Model(&models.Document{}).Where("project_id = ? AND collection_name = ?", project.ID, collectionName)
+	response := gin.H{
+		"documents":   documents,
+		"limit":       limit,
+		"offset":      offset,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	}
 	
-	// Apply same filter to count query
-	if filter := c.Query("filter"); filter != "" {
-		var filterJSON map[string]interface{}
-		if err := json.Unmarshal([]byte(filter), &filterJSON); err == nil {
-			countQuery = countQuery.Where("data @> ?", filter)
-		} else {
-			safeFilter := strings.ReplaceAll(filter, "'", "''")
-			countQuery = countQuery.Where("data::text ILIKE ?", "%"+safeFilter+"%")
+	// Get total count with the same filter unless the client opted out
+	if c.Query("skip_total") != "true" {
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count documents"})
+			return
 		}
+		response["total"] = total
 	}
 	
-	countQuery.Count(&total)
-	
-	c.JSON(http.StatusOK, gin.H{
-		"documents": documents,
-		"total":     total,
-		"limit":     limit,
-		"offset":    offset,
-	})
+	c.JSON(http.StatusOK, response)
 }
 
 // CreateDocument creates a new document in a collection
@@ -275,6 +330,15 @@ func (h *DataHandler) CreateDocument(c *gin.Context) {
 	apiKey := c.MustGet("api_key").(models.APIKey)
 	author := fmt.Sprintf("api_key:%s", apiKey.Name)
 	
+	// Validate against the collection JSON Schema
+	if respondDocumentValidation(c, validateCollectionDocument(h.db, project.ID, collectionName, data)) {
+		return
+	}
+	
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaDocuments, 1)) {
+		return
+	}
+	
 	// Create document
 	document := models.Document{
 		ID:             docID,
@@ -296,6 +360,9 @@ func (h *DataHandler) CreateDocument(c *gin.Context) {
 	
 	if err := tx.Create(&document).Error; err != nil {
 		tx.Rollback()
+		if respondUniqueIndexViolation(c, h.db, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "duplicate key") {
 			c.JSON(http.StatusConflict, gin.H{"error": "Document with this ID already exists"})
 			return
@@ -304,6 +371,13 @@ func (h *DataHandler) CreateDocument(c *gin.Context) {
 		return
 	}
 	
+	// Record the new document in its revision history
+	if err := recordDocumentRevision(tx, document, revisionCreate, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
+	
 	// Update collection stats in same transaction
 	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
 		tx.Rollback()
@@ -329,10 +403,18 @@ func (h *DataHandler) GetDocument(c *gin.Context) {
 		return
 	}
 	
+	etag := documentETag(document.Version)
+	c.Header("ETag", etag)
+	if match := c.GetHeader("If-None-Match"); match != "" && etagListMatches(match, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	
 	c.JSON(http.StatusOK, document)
 }
 
-// UpdateDocument updates a document
+// UpdateDocument replaces the data of a document.
+// An If-Match header or expected_version parameter makes the update conditional on the current version.
 func (h *DataHandler) UpdateDocument(c *gin.Context) {
 	project := c.MustGet("project").(models.Project)
 	collectionName := c.Param("collection")
@@ -345,55 +427,57 @@ func (h *DataHandler) UpdateDocument(c *gin.Context) {
 		return
 	}
 	
-	// Validate document size
-	if len(data) > 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Document too large (max 100 fields)"})
-		return
-	}
-	
-	// Sanitize document data
-	delete(data, "id")
-	delete(data, "_sql")
-	delete(data, "__proto__")
-	delete(data, "constructor")
-	
 	// Get API key info for author
 	apiKey := c.MustGet("api_key").(models.APIKey)
 	author := fmt.Sprintf("api_key:%s", apiKey.Name)
 	
-	// Update document with transaction
+	h.writeDocumentVersion(c, project.ID, collectionName, documentID, author,
+		func(current map[string]interface{}) (map[string]interface{}, error) {
+			return data, nil
+		})
+}
+
+// DeleteDocument deletes a document.
+// An If-Match header or expected_version parameter makes the delete conditional on the current version.
+func (h *DataHandler) DeleteDocument(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+	documentID := c.Param("id")
+	
+	expected, err := documentPrecondition(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
 	tx := h.db.Begin()
 	defer func() {
 		if r := recover(); r != nil {
 			tx.Rollback()
-			log.Printf("Panic in UpdateDocument: %v", r)
+			log.Printf("Panic in DeleteDocument: %v", r)
 		}
 	}()
 	
-	result := tx.Model(&models.Document{}).
-		Where("project_id = ? AND collection_name = ? AND id = ?", project.ID, collectionName, documentID).
-		Updates(models.Document{
-			Data:   data,
-			Author: author,
-		}).
-		Update("version", gorm.Expr("version + 1"))
-	
-	if result.Error != nil {
+	document, err := lockDocument(tx, project.ID, collectionName, documentID, expected)
+	if err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update document"})
+		respondDocumentLockError(c, document, err)
 		return
 	}
 	
-	if result.RowsAffected == 0 {
+	if err := tx.Delete(&document).Error; err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete document"})
 		return
 	}
 	
-	// Get updated document
-	var document models.Document
-	tx.Where("project_id = ? AND collection_name = ? AND id = ?", 
-		project.ID, collectionName, documentID).First(&document)
+	// Keep the deleted data in the revision history so the document can be restored
+	document.Author = requestAuthor(c)
+	if err := recordDocumentRevision(tx, document, revisionDelete, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
 	
 	// Update collection stats in same transaction
 	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
@@ -404,31 +488,6 @@ func (h *DataHandler) UpdateDocument(c *gin.Context) {
 	
 	tx.Commit()
 	
-	c.JSON(http.StatusOK, document)
-}
-
-// DeleteDocument deletes a document
-func (h *DataHandler) DeleteDocument(c *gin.Context) {
-	project := c.MustGet("project").(models.Project)
-	collectionName := c.Param("collection")
-	documentID := c.Param("id")
-	
-	result := h.db.Where("project_id = ? AND collection_name = ? AND id = ?", 
-		project.ID, collectionName, documentID).Delete(&models.Document{})
-	
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete document"})
-		return
-	}
-	
-	if result.RowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
-		return
-	}
-	
-	// Update collection stats
-	h.updateCollectionStats(project.ID, collectionName)
-	
 	c.JSON(http.StatusOK, gin.H{"message": "Document deleted successfully"})
 }
 
@@ -444,13 +503,7 @@ func (h *DataHandler) QueryDocuments(c *gin.Context) {
 	}
 	
 	// Parse request body for query options
-	var queryReq struct {
-		Limit     int                      `json:"limit"`
-		Offset    int                      `json:"offset"`
-		Select    []string                 `json:"select"`
-		Filters   []map[string]interface{} `json:"filters"`
-		Sort      []map[string]string      `json:"sort"`
-	}
+	var queryReq documentQuery
 	
 	if err := c.ShouldBindJSON(&queryReq); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query parameters"})
@@ -465,57 +518,58 @@ func (h *DataHandler) QueryDocuments(c *gin.Context) {
 		queryReq.Offset = 0
 	}
 	
-	// Build base query
-	query := h.db.Where("project_id = ? AND collection_name = ?", project.ID, collectionName)
-	
-	// Apply filters (simplified for security)
-	for _, filter := range queryReq.Filters {
-		if field, exists := filter["field"].(string); exists {
-			if operator, exists := filter["operator"].(string); exists {
-				if value, exists := filter["value"]; exists {
-					switch operator {
-					case "eq", "=":
-						// Use JSON containment for safe filtering
-						filterJSON := fmt.Sprintf(`{"%s": %s}`, field, fmt.Sprintf("%v", value))
-						query = query.Where("data @> ?", filterJSON)
-					case "like":
-						// Safe text search
-						query = query.Where("data->>? ILIKE ?", field, "%"+fmt.Sprintf("%v", value)+"%")
-					}
-				}
-			}
-		}
+	// Compile filters and sorting to parameterized JSONB SQL
+	compiler := &documentQueryCompiler{}
+	whereSQL, whereArgs, err := compiler.compileFilters(queryReq.Filters, queryReq.Where)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query filter", "details": err.Error()})
+		return
 	}
 	
-	// Apply sorting
-	orderBy := "created_at DESC"
-	for _, sort := range queryReq.Sort {
-		if field, exists := sort["field"]; exists {
-			if direction, exists := sort["direction"]; exists && (direction == "ASC" || direction == "DESC") {
-				if field == "created_at" || field == "updated_at" {
-					orderBy = fmt.Sprintf("%s %s", field, direction)
-					break
-				}
-			}
-		}
+	sortKeys, err := compileSortKeys(queryReq.Sort)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query sort", "details": err.Error()})
+		return
 	}
 	
-	var documents []models.Document
-	if err := query.Order(orderBy).Limit(queryReq.Limit).Offset(queryReq.Offset).Find(&documents).Error; err != nil {
+	page, err := newKeysetPage(sortKeys, queryReq.Cursor, queryReq.Limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor", "details": err.Error()})
+		return
+	}
+	
+	// Build base query (session so the count and the page query don't share clauses)
+	query := collectionDocuments(h.db, project.ID, collectionName)
+	if whereSQL != "" {
+		query = query.Where(whereSQL, whereArgs...)
+	}
+	query = query.Session(&gorm.Session{})
+	
+	documents, nextCursor, prevCursor, err := h.findDocumentPage(query, page, queryReq.Offset)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Query failed"})
 		return
 	}
 	
-	// Get total count
-	var total int64
-	query.Model(&models.Document{}).Count(&total)
+	response := gin.H{
+		"data":        documents,
+		"limit":       queryReq.Limit,
+		"offset":      queryReq.Offset,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	}
 	
-	c.JSON(http.StatusOK, gin.H{
-		"data":     documents,
-		"total":    total,
-		"limit":    queryReq.Limit,
-		"offset":   queryReq.Offset,
-	})
+	// Get total count unless the client opted out
+	if !queryReq.SkipTotal {
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Query failed"})
+			return
+		}
+		response["total"] = total
+	}
+	
+	c.JSON(http.StatusOK, response)
 }
 
 // CountDocuments returns document count for a collection
@@ -573,9 +627,22 @@ func (h *DataHandler) BatchCreateDocuments(c *gin.Context) {
 	apiKey := c.MustGet("api_key").(models.APIKey)
 	author := fmt.Sprintf("api_key:%s", apiKey.Name)
 	
+	// Load the collection JSON Schema once for the whole batch
+	var collection models.Collection
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, collectionName).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	schema, err := collectionJSONSchema(collection)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load collection schema", "details": err.Error()})
+		return
+	}
+	
 	// Prepare documents for batch insert
 	var documents []models.Document
-	for _, data := range batchReq.Documents {
+	var violations []schemaViolation
+	for i, data := range batchReq.Documents {
 		// Sanitize document data
 		delete(data, "id")
 		delete(data, "_sql")
@@ -591,6 +658,19 @@ func (h *DataHandler) BatchCreateDocuments(c *gin.Context) {
 		}
 		delete(data, "id")
 		
+		if schema != nil {
+			found, err := validateAgainstSchema(schema, data)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate document", "details": err.Error()})
+				return
+			}
+			for _, violation := range found {
+				index := i
+				violation.Index = &index
+				violations = append(violations, violation)
+			}
+		}
+		
 		documents = append(documents, models.Document{
 			ID:             docID,
 			CollectionName: collectionName,
@@ -601,6 +681,18 @@ func (h *DataHandler) BatchCreateDocuments(c *gin.Context) {
 		})
 	}
 	
+	if len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "Documents do not match collection schema",
+			"violations": violations,
+		})
+		return
+	}
+	
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaDocuments, float64(len(documents)))) {
+		return
+	}
+	
 	// Use transaction for batch creation
 	tx := h.db.Begin()
 	defer func() {
@@ -611,10 +703,20 @@ func (h *DataHandler) BatchCreateDocuments(c *gin.Context) {
 	
 	if err := tx.CreateInBatches(documents, 50).Error; err != nil {
 		tx.Rollback()
+		if respondUniqueIndexViolation(c, h.db, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Batch creation failed"})
 		return
 	}
 	
+	// Record the new documents in their revision history
+	if err := recordDocumentRevisions(tx, documents, revisionCreate, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revisions"})
+		return
+	}
+	
 	// Update collection stats
 	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
 		tx.Rollback()
@@ -661,16 +763,48 @@ func (h *DataHandler) BatchDeleteDocuments(c *gin.Context) {
 		return
 	}
 	
+	tx := h.db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+	
+	// Load the documents first so their data is kept in the revision history
+	var documents []models.Document
+	if err := tx.Where("project_id = ? AND collection_name = ? AND id IN ?", project.ID, collectionName, batchReq.IDs).
+		Find(&documents).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Batch deletion failed"})
+		return
+	}
+	
 	// Delete documents
-	result := h.db.Where("project_id = ? AND collection_name = ? AND id IN ?", project.ID, collectionName, batchReq.IDs).Delete(&models.Document{})
+	result := tx.Where("project_id = ? AND collection_name = ? AND id IN ?", project.ID, collectionName, batchReq.IDs).Delete(&models.Document{})
 	
 	if result.Error != nil {
+		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Batch deletion failed"})
 		return
 	}
 	
+	for i := range documents {
+		documents[i].Author = requestAuthor(c)
+	}
+	if err := recordDocumentRevisions(tx, documents, revisionDelete, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revisions"})
+		return
+	}
+	
 	// Update collection stats
-	h.updateCollectionStats(project.ID, collectionName)
+	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collection stats"})
+		return
+	}
+	
+	tx.Commit()
 	
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Documents deleted successfully",
@@ -687,6 +821,66 @@ func (h *DataHandler) collectionExists(projectID uint, collectionName string) bo
 	return err == nil
 }
 
+// findDocumentPage fetches one keyset page of documents and builds its cursors.
+// offset only applies to the first page; once a cursor is given it takes over.
+func (h *DataHandler) findDocumentPage(query *gorm.DB, page *keysetPage, offset int) ([]models.Document, string, string, error) {
+	pageQuery := page.apply(query)
+	if page.after == nil && offset > 0 {
+		pageQuery = pageQuery.Offset(offset)
+	}
+	
+	var documents []models.Document
+	if err := pageQuery.Find(&documents).Error; err != nil {
+		return nil, "", "", err
+	}
+	
+	size, more := page.window(len(documents))
+	documents = documents[:size]
+	if page.backward {
+		slices.Reverse(documents)
+	}
+	
+	var nextCursor, prevCursor string
+	if len(documents) > 0 {
+		first, last := documents[0], documents[len(documents)-1]
+		data, err := h.boundaryData(page.keys, first.ID, last.ID)
+		if err != nil {
+			return nil, "", "", err
+		}
+		nextCursor, prevCursor = page.cursors(
+			documentKeyValues(first, data[first.ID], page.keys),
+			documentKeyValues(last, data[last.ID], page.keys),
+			more, page.after == nil && offset > 0)
+	}
+	return documents, nextCursor, prevCursor, nil
+}
+
+// boundaryData loads the stored JSON of the first and last document of a page when the sort
+// order reads data paths. Cursor values are taken from it rather than from the decoded
+// documents, whose numbers have been rounded to float64.
+func (h *DataHandler) boundaryData(keys []keysetKey, ids ...string) (map[string][]byte, error) {
+	dataKeys := false
+	for _, key := range keys {
+		dataKeys = dataKeys || key.kind == keysetJSON
+	}
+	if !dataKeys {
+		return nil, nil
+	}
+
+	var rows []struct {
+		ID   string
+		Data string
+	}
+	if err := h.db.Model(&models.Document{}).Select("id, data::text AS data").Where("id IN ?", ids).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte, len(rows))
+	for _, row := range rows {
+		data[row.ID] = []byte(row.Data)
+	}
+	return data, nil
+}
+
 // updateCollectionStats updates collection statistics
 func (h *DataHandler) updateCollectionStats(projectID uint, collectionName string) {
 	var count int64
@@ -768,6 +962,7 @@ func (h *DataHandler) AdminCreateCollection(c *gin.Context) {
 		Description string                 `json:"description"`
 		Schema      map[string]interface{} `json:"schema"`
 		Indexes     []string               `json:"indexes"`
+		revisionSettings
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -781,6 +976,21 @@ func (h *DataHandler) AdminCreateCollection(c *gin.Context) {
 		return
 	}
 	
+	// Reject JSON Schemas that do not compile
+	if isJSONSchema(req.Schema) {
+		if _, err := compileJSONSchema(req.Schema); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Schema", "details": err.Error()})
+			return
+		}
+	}
+	
+	// Validate index declarations
+	indexes, err := parseIndexSpecs(req.Indexes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
 	// Check if collection already exists
 	var existingCollection models.Collection
 	if err := h.db.Where("project_id = ? AND name = ?", project.ID, req.Name).First(&existingCollection).Error; err == nil {
@@ -793,17 +1003,26 @@ func (h *DataHandler) AdminCreateCollection(c *gin.Context) {
 		Name:          req.Name,
 		Description:   req.Description,
 		Schema:        req.Schema,
-		Indexes:       req.Indexes,
+		Indexes:       indexes,
 		ProjectID:     project.ID,
 		DocumentCount: 0,
 		LastModified:  time.Now(),
 	}
+	if err := req.revisionSettings.apply(&collection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	
 	if err := h.db.Create(&collection).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create collection"})
 		return
 	}
 	
+	// Materialize declared indexes (built in the background)
+	if err := syncCollectionIndexes(h.db, project.ID, collection.Name, collection.Indexes); err != nil {
+		log.Printf("Failed to create indexes for collection %s: %v", collection.Name, err)
+	}
+	
 	c.JSON(http.StatusCreated, collection)
 }
 
@@ -844,7 +1063,6 @@ func (h *DataHandler) AdminDeleteCollection(c *gin.Context) {
 // AdminListDocuments lists documents via admin interface (JWT authenticated)
 func (h *DataHandler) AdminListDocuments(c *gin.Context) {
 	projectID := c.Param("id")
-	collectionName := c.Param("collection")
 	
 	var project models.Project
 	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
@@ -852,85 +1070,11 @@ func (h *DataHandler) AdminListDocuments(c *gin.Context) {
 		return
 	}
 	
-	// Verify collection exists
-	if !h.collectionExists(project.ID, collectionName) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
-		return
-	}
-	
-	// Parse query parameters
-	limit := 25 // Default limit
-	offset := 0
-	orderBy := "created_at DESC"
-	
-	if l := c.Query("limit"); l != "" {
-		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
-			limit = parsed
-		}
-	}
-	
-	if o := c.Query("offset"); o != "" {
-		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
-			offset = parsed
-		}
-	}
-	
-	if order := c.Query("orderBy"); order != "" {
-		// Strict validation for order by to prevent SQL injection
-		validOrderPattern := regexp.MustCompile(`^(created_at|updated_at)\s+(ASC|DESC)$|^(created_at|updated_at)$`)
-		if validOrderPattern.MatchString(strings.TrimSpace(order)) {
-			orderBy = strings.TrimSpace(order)
-		}
-	}
-	
-	var documents []models.Document
-	query := h.db.Where("project_id = ? AND collection_name = ?", project.ID, collectionName).
-		Limit(limit).
-		Offset(offset).
-		Order(orderBy)
-	
-	// Add secure JSON filtering if provided
-	if filter := c.Query("filter"); filter != "" {
-		// Validate filter is valid JSON to prevent injection
-		var filterJSON map[string]interface{}
-		if err := json.Unmarshal([]byte(filter), &filterJSON); err == nil {
-			// Use parameterized query with JSON containment operator
-			query = query.Where("data @> ?", filter)
-		} else {
-			// Fallback to safe text search with proper escaping
-			safeFilter := strings.ReplaceAll(filter, "'", "''")
-			query = query.Where("data::text ILIKE ?", "%"+safeFilter+"%")
-		}
-	}
-	
-	if err := query.Find(&documents).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch documents"})
-		return
-	}
-	
-	// Get total count efficiently in single query
-	var total int64
-	countQuery := h.db.Model(&models.Document{}).Where("project_id = ? AND collection_name = ?", project.ID, collectionName)
-	
-	// Apply same filter to count query
-	if filter := c.Query("filter"); filter != "" {
-		var filterJSON map[string]interface{}
-		if err := json.Unmarshal([]byte(filter), &filterJSON); err == nil {
-			countQuery = countQuery.Where("data @> ?", filter)
-		} else {
-			safeFilter := strings.ReplaceAll(filter, "'", "''")
-			countQuery = countQuery.Where("data::text ILIKE ?", "%"+safeFilter+"%")
-		}
-	}
-	
-	countQuery.Count(&total)
+	// Set the project in context for the regular handler
+	c.Set("project", project)
 	
-	c.JSON(http.StatusOK, gin.H{
-		"documents": documents,
-		"total":     total,
-		"limit":     limit,
-		"offset":    offset,
-	})
+	// Call the regular ListDocuments method
+	h.ListDocuments(c)
 }
 
 // AdminCreateDocument creates a document via admin interface (JWT authenticated)
@@ -982,6 +1126,15 @@ func (h *DataHandler) AdminCreateDocument(c *gin.Context) {
 	// For admin interface, use admin as author
 	author := "admin:jwt"
 	
+	// Validate against the collection JSON Schema
+	if respondDocumentValidation(c, validateCollectionDocument(h.db, project.ID, collectionName, data)) {
+		return
+	}
+	
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaDocuments, 1)) {
+		return
+	}
+	
 	// Create document
 	document := models.Document{
 		ID:             docID,
@@ -1002,6 +1155,9 @@ func (h *DataHandler) AdminCreateDocument(c *gin.Context) {
 	
 	if err := tx.Create(&document).Error; err != nil {
 		tx.Rollback()
+		if respondUniqueIndexViolation(c, h.db, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "duplicate key") {
 			c.JSON(http.StatusConflict, gin.H{"error": "Document with this ID already exists"})
 			return
@@ -1010,6 +1166,13 @@ func (h *DataHandler) AdminCreateDocument(c *gin.Context) {
 		return
 	}
 	
+	// Record the new document in its revision history
+	if err := recordDocumentRevision(tx, document, revisionCreate, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
+	
 	// Update collection stats in same transaction
 	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
 		tx.Rollback()
@@ -1058,64 +1221,11 @@ func (h *DataHandler) AdminUpdateDocument(c *gin.Context) {
 		return
 	}
 	
-	// Validate document size
-	if len(data) > 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Document too large (max 100 fields)"})
-		return
-	}
-	
-	// Sanitize document data
-	delete(data, "id")
-	delete(data, "_sql")
-	delete(data, "__proto__")
-	delete(data, "constructor")
-	
 	// For admin interface, use admin as author
-	author := "admin:jwt"
-	
-	// Update document with transaction
-	tx := h.db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-	
-	result := tx.Model(&models.Document{}).
-		Where("project_id = ? AND collection_name = ? AND id = ?", project.ID, collectionName, documentID).
-		Updates(models.Document{
-			Data:   data,
-			Author: author,
-		}).
-		Update("version", gorm.Expr("version + 1"))
-	
-	if result.Error != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update document"})
-		return
-	}
-	
-	if result.RowsAffected == 0 {
-		tx.Rollback()
-		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
-		return
-	}
-	
-	// Get updated document
-	var document models.Document
-	tx.Where("project_id = ? AND collection_name = ? AND id = ?", 
-		project.ID, collectionName, documentID).First(&document)
-	
-	// Update collection stats in same transaction
-	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collection stats"})
-		return
-	}
-	
-	tx.Commit()
-	
-	c.JSON(http.StatusOK, document)
+	h.writeDocumentVersion(c, project.ID, collectionName, documentID, "admin:jwt",
+		func(current map[string]interface{}) (map[string]interface{}, error) {
+			return data, nil
+		})
 }
 
 // AdminDeleteDocument deletes a document via admin interface (JWT authenticated)
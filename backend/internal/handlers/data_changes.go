@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// Change feed operations
+const (
+	changeInsert = "insert"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// Realtime stream tuning
+const (
+	changeCatchUpBatch    = 500
+	changeKeepAlive       = 25 * time.Second
+	changeWriteTimeout    = 10 * time.Second
+	changeFilterMaxLength = 8192
+)
+
+// revisionChangeOperations maps revision operations onto change feed operations
+var revisionChangeOperations = map[string]string{
+	revisionCreate: changeInsert,
+	revisionUpdate: changeUpdate,
+	revisionDelete: changeDelete,
+}
+
+// recordDocumentChanges appends documents of one collection written in tx to the change feed
+// and announces them; subscribers are notified when tx commits
+func recordDocumentChanges(tx *gorm.DB, documents []models.Document, operation string) error {
+	if len(documents) == 0 {
+		return nil
+	}
+
+	changes := make([]models.DocumentChange, len(documents))
+	for i, document := range documents {
+		changes[i] = models.DocumentChange{
+			ProjectID:      document.ProjectID,
+			CollectionName: document.CollectionName,
+			DocumentID:     document.ID,
+			Operation:      operation,
+			Version:        document.Version,
+			Author:         document.Author,
+			Data:           document.Data,
+		}
+	}
+	if err := tx.CreateInBatches(changes, 100).Error; err != nil {
+		return err
+	}
+
+	sequences := make([]int64, len(changes))
+	for i, change := range changes {
+		sequences[i] = change.Sequence
+	}
+	return services.NotifyDocumentChanges(tx, documents[0].ProjectID, documents[0].CollectionName, sequences)
+}
+
+// changeStream delivers the filtered changes of one collection to a single client
+type changeStream struct {
+	db           *gorm.DB
+	subscription *services.ChangeSubscription
+	filter       *queryCondition
+	position     services.ChangePosition // Last change passed in feed order (the resume token)
+	send         func(models.DocumentChange) error
+}
+
+// deliver sends a change unless it is not after the stream position or does not match the filter
+func (s *changeStream) deliver(change models.DocumentChange) error {
+	position := services.ChangePositionOf(change)
+	if !position.After(s.position) {
+		return nil
+	}
+	s.position = position
+
+	if s.filter != nil {
+		matched, err := matchDocumentCondition(*s.filter, models.Document{
+			ID:      change.DocumentID,
+			Version: change.Version,
+			Author:  change.Author,
+			Data:    change.Data,
+		})
+		if err != nil || !matched {
+			return err
+		}
+	}
+	return s.send(change)
+}
+
+// catchUp delivers stored changes after the stream position. Changes running transactions
+// still hold back are published by the feed once readable.
+func (s *changeStream) catchUp() error {
+	for {
+		changes, pending, err := services.ReadStableChanges(s.db, s.subscription.ProjectID,
+			s.subscription.Collection, s.position, changeCatchUpBatch)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err := s.deliver(change); err != nil {
+				return err
+			}
+		}
+		if pending || len(changes) < changeCatchUpBatch {
+			return nil
+		}
+	}
+}
+
+// recover delivers the events buffered before the subscription lagged, then catches up on
+// the dropped ones from the table
+func (s *changeStream) recover() error {
+	for {
+		select {
+		case change := <-s.subscription.Events:
+			if err := s.deliver(change); err != nil {
+				return err
+			}
+		default:
+			s.subscription.Recover()
+			return s.catchUp()
+		}
+	}
+}
+
+// run delivers changes until done is closed or sending fails; keepAlive is called when idle
+func (s *changeStream) run(done <-chan struct{}, keepAlive func() error) error {
+	ticker := time.NewTicker(changeKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case change := <-s.subscription.Events:
+			if err := s.deliver(change); err != nil {
+				return err
+			}
+		case <-s.subscription.Lagged:
+			if err := s.recover(); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := keepAlive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseChangeFilter parses and validates the where query parameter of a subscription
+func parseChangeFilter(raw string) (*queryCondition, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if len(raw) > changeFilterMaxLength {
+		return nil, fmt.Errorf("filter too large (max %d bytes)", changeFilterMaxLength)
+	}
+
+	var filter queryCondition
+	if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+		return nil, fmt.Errorf("where must be a JSON query condition")
+	}
+
+	// Validate exactly like QueryDocuments, then reject columns a change event does not carry
+	compiler := &documentQueryCompiler{}
+	if _, _, err := compiler.compileFilters(nil, &filter); err != nil {
+		return nil, err
+	}
+	if err := matchableCondition(filter); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
+// parseChangePosition parses a resume token. Plain sequences handed out before positions
+// existed resume at the position of that change.
+func (h *DataHandler) parseChangePosition(projectID uint, token string) (services.ChangePosition, error) {
+	if !strings.Contains(token, ".") {
+		sequence, err := strconv.ParseInt(token, 10, 64)
+		if err != nil || sequence < 0 {
+			return services.ChangePosition{}, errors.New("since must be a change position")
+		}
+		var change models.DocumentChange
+		if err := h.db.Select("xid", "sequence").Where("project_id = ? AND sequence = ?", projectID, sequence).
+			First(&change).Error; err != nil {
+			return services.ChangePosition{}, errors.New("since is no longer in the change feed")
+		}
+		return services.ChangePositionOf(change), nil
+	}
+
+	position, err := services.ParseChangePosition(token)
+	if err != nil {
+		return position, errors.New("since must be a change position")
+	}
+	return position, nil
+}
+
+// SubscribeCollection streams insert, update and delete events of a collection.
+// Clients upgrade to a WebSocket or receive Server-Sent Events otherwise; browsers
+// authenticate with the ticket query parameter. An optional where query parameter filters
+// events with the QueryDocuments condition language, and since (or the SSE Last-Event-ID
+// header) resumes after a previously received position.
+func (h *DataHandler) SubscribeCollection(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+
+	if !h.collectionExists(project.ID, collectionName) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	filter, err := parseChangeFilter(c.Query("where"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter", "details": err.Error()})
+		return
+	}
+
+	since := c.Query("since")
+	if since == "" {
+		since = c.GetHeader("Last-Event-ID")
+	}
+	var resumeFrom services.ChangePosition
+	if since != "" {
+		if resumeFrom, err = h.parseChangePosition(project.ID, since); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	subscription, err := h.changeFeed.Subscribe(project.ID, collectionName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read change feed"})
+		return
+	}
+	defer h.changeFeed.Unsubscribe(subscription)
+
+	// Events already published to the subscription at or before a resume position are skipped
+	stream := &changeStream{
+		db:           h.db,
+		subscription: subscription,
+		filter:       filter,
+		position:     subscription.Start,
+	}
+	if since != "" {
+		stream.position = resumeFrom
+	}
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		h.streamChangesWebSocket(c, stream, since != "")
+		return
+	}
+	h.streamChangesSSE(c, stream, since != "")
+}
+
+// streamChangesSSE serves a change stream as Server-Sent Events
+func (h *DataHandler) streamChangesSSE(c *gin.Context, stream *changeStream, resume bool) {
+	// Streams outlive the server write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Change stream cannot clear write deadline: %v", err)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	write := func(event string, id services.ChangePosition, payload interface{}) error {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", id, event, data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	stream.send = func(change models.DocumentChange) error {
+		return write(change.Operation, services.ChangePositionOf(change), change)
+	}
+
+	if err := write("ready", stream.position, gin.H{"position": stream.position.String()}); err != nil {
+		return
+	}
+	if resume {
+		if err := stream.catchUp(); err != nil {
+			write("error", stream.position, gin.H{"error": "Failed to resume change feed"})
+			return
+		}
+	}
+
+	err := stream.run(c.Request.Context().Done(), func() error {
+		if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil && c.Request.Context().Err() == nil {
+		log.Printf("Change stream for collection %s ended: %v", stream.subscription.Collection, err)
+	}
+}
+
+// changeMessage is a WebSocket frame of a change stream
+type changeMessage struct {
+	Type     string                 `json:"type"`     // ready, change, error
+	Position string                 `json:"position"` // Resume token
+	Change   *models.DocumentChange `json:"change,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// streamChangesWebSocket serves a change stream over a WebSocket
+func (h *DataHandler) streamChangesWebSocket(c *gin.Context, stream *changeStream, resume bool) {
+	project := c.MustGet("project").(models.Project)
+	conn, err := realtimeUpgrader(h.cfg, h.db, project.ID).Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade already wrote the error response
+		return
+	}
+	defer conn.Close()
+
+	write := func(message changeMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(changeWriteTimeout))
+		return conn.WriteJSON(message)
+	}
+	stream.send = func(change models.DocumentChange) error {
+		return write(changeMessage{Type: "change", Position: services.ChangePositionOf(change).String(), Change: &change})
+	}
+
+	// The client only sends control frames; reading processes them and detects disconnects
+	done := make(chan struct{})
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(2 * changeKeepAlive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * changeKeepAlive))
+	})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := write(changeMessage{Type: "ready", Position: stream.position.String()}); err != nil {
+		return
+	}
+	if resume {
+		if err := stream.catchUp(); err != nil {
+			write(changeMessage{Type: "error", Position: stream.position.String(), Error: "Failed to resume change feed"})
+			return
+		}
+	}
+
+	err = stream.run(done, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(changeWriteTimeout))
+	})
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		log.Printf("Change stream for collection %s ended: %v", stream.subscription.Collection, err)
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+)
+
+func TestChangeStreamDeliverInFeedOrder(t *testing.T) {
+	var sent []int64
+	stream := &changeStream{
+		filter:   &queryCondition{Field: "status", Operator: "eq", Value: "open"},
+		position: services.ChangePosition{XID: 100},
+		send: func(change models.DocumentChange) error {
+			sent = append(sent, change.Sequence)
+			return nil
+		},
+	}
+
+	open := map[string]interface{}{"status": "open"}
+	changes := []models.DocumentChange{
+		{XID: 99, Sequence: 20, Data: open},  // Before the start position
+		{XID: 100, Sequence: 11, Data: open}, // Committed late, but first in feed order
+		{XID: 101, Sequence: 10, Data: open}, // Lower sequence from a later transaction
+		{XID: 101, Sequence: 12, Data: map[string]interface{}{"status": "closed"}},
+		{XID: 100, Sequence: 11, Data: open}, // Redelivered after a catch-up
+		{XID: 102, Sequence: 13, Data: open},
+	}
+	for _, change := range changes {
+		if err := stream.deliver(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []int64{11, 10, 13}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent = %v, want %v", sent, want)
+	}
+	if want := (services.ChangePosition{XID: 102, Sequence: 13}); stream.position != want {
+		t.Errorf("position = %v, want %v", stream.position, want)
+	}
+}
@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Collection index limits and naming
+const (
+	maxCollectionIndexes   = 16
+	collectionIndexPrefix  = "cbx_doc_"
+	uniqueViolationSQLCode = "23505"
+)
+
+// collectionIndexDef is a parsed Collection.Indexes entry
+type collectionIndexDef struct {
+	field  string
+	path   []string
+	method string // btree, gin
+	unique bool
+}
+
+// parseIndexSpec parses an index declaration: "field", "unique:field" or "gin:field"
+func parseIndexSpec(spec string) (collectionIndexDef, error) {
+	def := collectionIndexDef{method: "btree"}
+
+	field := strings.TrimSpace(spec)
+	if prefix, rest, found := strings.Cut(field, ":"); found {
+		switch strings.ToLower(prefix) {
+		case "unique":
+			def.unique = true
+		case "gin":
+			def.method = "gin"
+		default:
+			return def, fmt.Errorf("invalid index %q: unknown modifier %q (use unique: or gin:)", spec, prefix)
+		}
+		field = rest
+	}
+
+	path, err := parseFieldPath(field)
+	if err != nil {
+		return def, fmt.Errorf("invalid index %q: %v", spec, err)
+	}
+	def.field = field
+	def.path = path
+	return def, nil
+}
+
+// spec returns the canonical declaration stored in Collection.Indexes
+func (d collectionIndexDef) spec() string {
+	switch {
+	case d.unique:
+		return "unique:" + d.field
+	case d.method == "gin":
+		return "gin:" + d.field
+	default:
+		return d.field
+	}
+}
+
+// collectionIndexName returns a stable PostgreSQL index name (max 63 chars) for a declaration
+func collectionIndexName(projectID uint, collectionName, spec string) string {
+	sum := sha256.Sum256([]byte(collectionName + "|" + spec))
+	return fmt.Sprintf("%s%d_%s", collectionIndexPrefix, projectID, hex.EncodeToString(sum[:8]))
+}
+
+// collectionScopeSQL returns the condition selecting the documents of one collection, with the
+// project and collection inlined. It is the partial predicate of collection indexes, and
+// queries that use the same text let the planner prove the predicate holds and use those
+// indexes even when the statement is planned without its parameters. The values are
+// validated (numeric project ID, collection name checked by isValidCollectionName).
+func collectionScopeSQL(projectID uint, collectionName string) (string, error) {
+	if !isValidCollectionName(collectionName) {
+		return "", fmt.Errorf("invalid collection name %q", collectionName)
+	}
+	return fmt.Sprintf("project_id = %d AND collection_name = '%s'", projectID, collectionName), nil
+}
+
+// collectionDocuments scopes a document query to one collection with collectionScopeSQL, so
+// filters compiled by documentQueryCompiler can use the collection indexes
+func collectionDocuments(db *gorm.DB, projectID uint, collectionName string) *gorm.DB {
+	query := db.Model(&models.Document{})
+	scope, err := collectionScopeSQL(projectID, collectionName)
+	if err != nil {
+		// Such a collection cannot exist; bind the values so the query matches nothing
+		return query.Where("project_id = ? AND collection_name = ?", projectID, collectionName)
+	}
+	return query.Where(scope)
+}
+
+// collectionIndexSQL builds the CREATE INDEX statement for an index. The indexed expression
+// is the one documentQueryCompiler emits for the field (jsonPathExpr); the partial
+// predicate cannot be bound as parameters and is inlined by collectionScopeSQL.
+func collectionIndexSQL(index models.CollectionIndex) (string, error) {
+	def, err := parseIndexSpec(index.Spec)
+	if err != nil {
+		return "", err
+	}
+	scope, err := collectionScopeSQL(index.ProjectID, index.CollectionName)
+	if err != nil {
+		return "", err
+	}
+
+	unique := ""
+	if def.unique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf(
+		"CREATE %sINDEX CONCURRENTLY IF NOT EXISTS %s ON documents USING %s ((%s)) WHERE %s AND deleted_at IS NULL",
+		unique, index.IndexName, def.method, jsonPathExpr(def.path, false), scope,
+	), nil
+}
+
+// parseIndexSpecs validates a list of declarations and returns them in canonical form
+func parseIndexSpecs(specs []string) ([]string, error) {
+	if len(specs) > maxCollectionIndexes {
+		return nil, fmt.Errorf("too many indexes (max %d)", maxCollectionIndexes)
+	}
+
+	var canonical []string
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		def, err := parseIndexSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[def.spec()] {
+			seen[def.spec()] = true
+			canonical = append(canonical, def.spec())
+		}
+	}
+	return canonical, nil
+}
+
+// syncCollectionIndexes makes the materialized indexes of a collection match specs:
+// missing indexes are created (built in the background) and undeclared ones dropped.
+func syncCollectionIndexes(db *gorm.DB, projectID uint, collectionName string, specs []string) error {
+	canonical, err := parseIndexSpecs(specs)
+	if err != nil {
+		return err
+	}
+
+	var existing []models.CollectionIndex
+	if err := db.Where("project_id = ? AND collection_name = ?", projectID, collectionName).Find(&existing).Error; err != nil {
+		return err
+	}
+
+	declared := map[string]bool{}
+	for _, spec := range canonical {
+		declared[spec] = true
+	}
+
+	materialized := map[string]bool{}
+	for _, index := range existing {
+		if declared[index.Spec] {
+			materialized[index.Spec] = true
+			continue
+		}
+		if err := dropCollectionIndex(db, index); err != nil {
+			return err
+		}
+	}
+
+	for _, spec := range canonical {
+		if materialized[spec] {
+			continue
+		}
+		if _, err := createCollectionIndex(db, projectID, collectionName, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCollectionIndex records an index and starts building it in the background
+func createCollectionIndex(db *gorm.DB, projectID uint, collectionName, spec string) (*models.CollectionIndex, error) {
+	index, created, err := recordCollectionIndex(db, projectID, collectionName, spec)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		go buildCollectionIndex(db, *index)
+	}
+	return index, nil
+}
+
+// recordCollectionIndex records an index as pending without building it. Recording the same
+// declaration twice returns the existing index and created false.
+func recordCollectionIndex(db *gorm.DB, projectID uint, collectionName, spec string) (*models.CollectionIndex, bool, error) {
+	def, err := parseIndexSpec(spec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	index := models.CollectionIndex{
+		ProjectID:      projectID,
+		CollectionName: collectionName,
+		Spec:           def.spec(),
+		Field:          def.field,
+		Method:         def.method,
+		Unique:         def.unique,
+		IndexName:      collectionIndexName(projectID, collectionName, def.spec()),
+		Status:         "pending",
+	}
+
+	var current models.CollectionIndex
+	if err := db.Where("index_name = ?", index.IndexName).First(&current).Error; err == nil {
+		return &current, false, nil
+	}
+
+	if err := db.Create(&index).Error; err != nil {
+		return nil, false, err
+	}
+	return &index, true, nil
+}
+
+// buildCollectionIndex runs CREATE INDEX CONCURRENTLY and records the outcome.
+// A failed concurrent build leaves an invalid index behind, so it is dropped again.
+func buildCollectionIndex(db *gorm.DB, index models.CollectionIndex) {
+	db.Model(&index).Updates(map[string]interface{}{"status": "building", "error": ""})
+
+	sql, err := collectionIndexSQL(index)
+	if err == nil {
+		err = db.Exec(sql).Error
+	}
+
+	if err != nil {
+		log.Printf("Failed to build collection index %s: %v", index.IndexName, err)
+		db.Exec(fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", index.IndexName))
+		db.Model(&index).Updates(map[string]interface{}{"status": "failed", "error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	db.Model(&index).Updates(map[string]interface{}{"status": "ready", "error": "", "built_at": &now})
+}
+
+// dropCollectionIndex drops the PostgreSQL index and forgets it
+func dropCollectionIndex(db *gorm.DB, index models.CollectionIndex) error {
+	if !strings.HasPrefix(index.IndexName, collectionIndexPrefix) {
+		return fmt.Errorf("refusing to drop unmanaged index %q", index.IndexName)
+	}
+	if err := db.Exec(fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", index.IndexName)).Error; err != nil {
+		return err
+	}
+	return db.Delete(&index).Error
+}
+
+// uniqueIndexViolation reports whether err is a duplicate on a collection unique index,
+// returning the indexed field
+func uniqueIndexViolation(db *gorm.DB, err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolationSQLCode {
+		return "", false
+	}
+	if !strings.HasPrefix(pgErr.ConstraintName, collectionIndexPrefix) {
+		return "", false
+	}
+
+	var index models.CollectionIndex
+	if err := db.Where("index_name = ?", pgErr.ConstraintName).First(&index).Error; err != nil {
+		return "", true
+	}
+	return index.Field, true
+}
+
+// respondUniqueIndexViolation writes a 409 when err is a unique index violation.
+// It returns false when err is something else.
+func respondUniqueIndexViolation(c *gin.Context, db *gorm.DB, err error) bool {
+	field, ok := uniqueIndexViolation(db, err)
+	if !ok {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "A document with this value already exists",
+		"field": field,
+	})
+	return true
+}
+
+// collectionIndexStatus is an index with its live PostgreSQL state
+type collectionIndexStatus struct {
+	models.CollectionIndex
+	Valid    bool   `json:"valid"`              // pg_index.indisvalid
+	Phase    string `json:"phase,omitempty"`    // pg_stat_progress_create_index phase while building
+	Progress string `json:"progress,omitempty"` // Blocks or tuples done/total while building
+}
+
+// ListCollectionIndexes returns the indexes of a collection with their build status
+func (h *DataHandler) ListCollectionIndexes(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+
+	if !h.collectionExists(project.ID, collectionName) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	var indexes []models.CollectionIndex
+	if err := h.db.Where("project_id = ? AND collection_name = ?", project.ID, collectionName).
+		Order("id ASC").Find(&indexes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch indexes"})
+		return
+	}
+
+	statuses := make([]collectionIndexStatus, 0, len(indexes))
+	for _, index := range indexes {
+		status := collectionIndexStatus{CollectionIndex: index}
+
+		h.db.Raw(`SELECT i.indisvalid FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid WHERE c.relname = ?`,
+			index.IndexName).Scan(&status.Valid)
+
+		if index.Status == "building" {
+			var progress struct {
+				Phase       string
+				BlocksDone  int64
+				BlocksTotal int64
+				TuplesDone  int64
+				TuplesTotal int64
+			}
+			h.db.Raw(`SELECT p.phase, p.blocks_done, p.blocks_total, p.tuples_done, p.tuples_total
+				FROM pg_stat_progress_create_index p JOIN pg_class c ON c.oid = p.index_relid
+				WHERE c.relname = ?`, index.IndexName).Scan(&progress)
+			status.Phase = progress.Phase
+			if progress.BlocksTotal > 0 {
+				status.Progress = fmt.Sprintf("%d/%d blocks", progress.BlocksDone, progress.BlocksTotal)
+			} else if progress.TuplesTotal > 0 {
+				status.Progress = fmt.Sprintf("%d/%d tuples", progress.TuplesDone, progress.TuplesTotal)
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"indexes": statuses})
+}
+
+// CreateCollectionIndex declares an index on a collection and starts building it
+func (h *DataHandler) CreateCollectionIndex(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+
+	var collection models.Collection
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, collectionName).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	var req struct {
+		Field  string `json:"field" binding:"required"`
+		Method string `json:"method"` // btree (default) or gin
+		Unique bool   `json:"unique"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	spec := req.Field
+	switch strings.ToLower(req.Method) {
+	case "", "btree":
+		if req.Unique {
+			spec = "unique:" + req.Field
+		}
+	case "gin":
+		if req.Unique {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "GIN indexes cannot be unique"})
+			return
+		}
+		spec = "gin:" + req.Field
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid index method (use btree or gin)"})
+		return
+	}
+
+	specs, err := parseIndexSpecs(append(append([]string{}, collection.Indexes...), spec))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The declaration and the index record are saved together, and the build only starts
+	// once both are, so a failed save cannot leave an undeclared index behind
+	var index *models.CollectionIndex
+	var created bool
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		collection.Indexes = specs
+		if err := tx.Model(&collection).Select("indexes").Updates(&collection).Error; err != nil {
+			return err
+		}
+		index, created, err = recordCollectionIndex(tx, project.ID, collectionName, spec)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create index"})
+		return
+	}
+	if created {
+		go buildCollectionIndex(h.db, *index)
+	}
+
+	c.JSON(http.StatusAccepted, index)
+}
+
+// DeleteCollectionIndex drops an index from a collection
+func (h *DataHandler) DeleteCollectionIndex(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+
+	var collection models.Collection
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, collectionName).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	var index models.CollectionIndex
+	if err := h.db.Where("id = ? AND project_id = ? AND collection_name = ?", c.Param("index_id"), project.ID, collectionName).
+		First(&index).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Index not found"})
+		return
+	}
+
+	if err := dropCollectionIndex(h.db, index); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to drop index"})
+		return
+	}
+
+	var specs []string
+	for _, spec := range collection.Indexes {
+		if def, err := parseIndexSpec(spec); err == nil && def.spec() == index.Spec {
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	collection.Indexes = specs
+	if err := h.db.Model(&collection).Select("indexes").Updates(&collection).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collection indexes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Index dropped successfully"})
+}
+
+// AdminListCollectionIndexes lists collection indexes via admin interface (JWT authenticated)
+func (h *DataHandler) AdminListCollectionIndexes(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.ListCollectionIndexes(c)
+	}
+}
+
+// AdminCreateCollectionIndex creates a collection index via admin interface (JWT authenticated)
+func (h *DataHandler) AdminCreateCollectionIndex(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.CreateCollectionIndex(c)
+	}
+}
+
+// AdminDeleteCollectionIndex drops a collection index via admin interface (JWT authenticated)
+func (h *DataHandler) AdminDeleteCollectionIndex(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.DeleteCollectionIndex(c)
+	}
+}
+
+// setAdminProject loads the project from the admin route and sets it in context for the regular handler
+func (h *DataHandler) setAdminProject(c *gin.Context) bool {
+	var project models.Project
+	if err := h.db.Where("id = ?", c.Param("id")).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return false
+	}
+	c.Set("project", project)
+	return true
+}
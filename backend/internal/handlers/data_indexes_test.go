@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestCollectionIndexSQLMatchesCompiledQueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		filter   queryCondition
+		sql      string
+		indexSQL string
+	}{
+		{
+			name:     "btree serves eq",
+			spec:     "profile.email",
+			filter:   queryCondition{Field: "profile.email", Operator: "eq", Value: "a@example.com"},
+			sql:      "(data #> '{profile,email}') = ?::jsonb",
+			indexSQL: "CREATE INDEX CONCURRENTLY IF NOT EXISTS cbx_doc_7_x ON documents USING btree (((data #> '{profile,email}'))) WHERE project_id = 7 AND collection_name = 'users' AND deleted_at IS NULL",
+		},
+		{
+			name:     "unique btree",
+			spec:     "unique:sku",
+			filter:   queryCondition{Field: "sku", Operator: "in", Value: []interface{}{"a"}},
+			sql:      "(data #> '{sku}') IN (?::jsonb)",
+			indexSQL: "CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS cbx_doc_7_x ON documents USING btree (((data #> '{sku}'))) WHERE project_id = 7 AND collection_name = 'users' AND deleted_at IS NULL",
+		},
+		{
+			name:     "gin serves contains",
+			spec:     "gin:tags",
+			filter:   queryCondition{Field: "tags", Operator: "contains", Value: "red"},
+			sql:      "(data #> '{tags}') @> ?::jsonb",
+			indexSQL: "CREATE INDEX CONCURRENTLY IF NOT EXISTS cbx_doc_7_x ON documents USING gin (((data #> '{tags}'))) WHERE project_id = 7 AND collection_name = 'users' AND deleted_at IS NULL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indexSQL, err := collectionIndexSQL(models.CollectionIndex{
+				ProjectID:      7,
+				CollectionName: "users",
+				Spec:           tt.spec,
+				IndexName:      "cbx_doc_7_x",
+			})
+			if err != nil {
+				t.Fatalf("collectionIndexSQL() error = %v", err)
+			}
+			if indexSQL != tt.indexSQL {
+				t.Errorf("index sql = %s\nwant        %s", indexSQL, tt.indexSQL)
+			}
+
+			sql, _, err := (&documentQueryCompiler{}).compileFilters([]queryCondition{tt.filter}, nil)
+			if err != nil {
+				t.Fatalf("compileFilters() error = %v", err)
+			}
+			if sql != tt.sql {
+				t.Errorf("query sql = %s, want %s", sql, tt.sql)
+			}
+
+			// The query must compare the indexed expression and carry the index predicate
+			def, _ := parseIndexSpec(tt.spec)
+			if !strings.HasPrefix(sql, jsonPathExpr(def.path, false)) {
+				t.Errorf("query %s does not start with the indexed expression", sql)
+			}
+			scope, err := collectionScopeSQL(7, "users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(indexSQL, "WHERE "+scope+" AND deleted_at IS NULL") {
+				t.Errorf("index predicate differs from the query scope %q", scope)
+			}
+		})
+	}
+}
+
+func TestCollectionScopeSQLRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "users'; DROP TABLE documents; --", "a b", strings.Repeat("a", 51)} {
+		if _, err := collectionScopeSQL(1, name); err == nil {
+			t.Errorf("collectionScopeSQL(%q) should fail", name)
+		}
+	}
+}
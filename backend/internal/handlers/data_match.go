@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+// matchDocumentCondition evaluates a query condition against a document in memory.
+// It mirrors the SQL generated by documentQueryCompiler so realtime subscriptions filter
+// exactly like QueryDocuments; conditions must have been validated by compileFilters first.
+func matchDocumentCondition(cond queryCondition, document models.Document) (bool, error) {
+	if cond.And != nil || cond.Or != nil {
+		if cond.Or != nil {
+			for _, child := range cond.Or {
+				matched, err := matchDocumentCondition(child, document)
+				if err != nil || matched {
+					return matched, err
+				}
+			}
+			return false, nil
+		}
+		for _, child := range cond.And {
+			matched, err := matchDocumentCondition(child, document)
+			if err != nil || !matched {
+				return matched, err
+			}
+		}
+		return true, nil
+	}
+
+	operator := normalizeQueryOperator(cond.Operator)
+	if column, ok := documentColumns[cond.Field]; ok {
+		return matchColumnCondition(column, operator, cond.Value, document)
+	}
+
+	path, err := parseFieldPath(cond.Field)
+	if err != nil {
+		return false, err
+	}
+	value, present := dataPathValue(document.Data, path)
+	return matchDataCondition(operator, value, present, cond.Value)
+}
+
+// matchableCondition checks that every leaf of a condition can be evaluated in memory
+func matchableCondition(cond queryCondition) error {
+	for _, children := range [][]queryCondition{cond.And, cond.Or} {
+		for _, child := range children {
+			if err := matchableCondition(child); err != nil {
+				return err
+			}
+		}
+	}
+	if column, ok := documentColumns[cond.Field]; ok {
+		switch column {
+		case "id", "author", "version":
+		default:
+			return fmt.Errorf("field %q cannot be used in subscription filters", column)
+		}
+	}
+	return nil
+}
+
+// matchDataCondition mirrors compileDataCondition for a value found (or not) at a data path
+func matchDataCondition(operator string, value interface{}, present bool, expected interface{}) (bool, error) {
+	switch operator {
+	case "eq":
+		return present && jsonEqual(value, expected), nil
+	case "ne":
+		return !present || !jsonEqual(value, expected), nil
+	case "gt", "gte", "lt", "lte":
+		if !present {
+			return false, nil
+		}
+		order, ok := compareJSONScalars(value, expected)
+		return ok && matchOrder(operator, order), nil
+	case "in", "nin":
+		values, _ := expected.([]interface{})
+		found := false
+		for _, candidate := range values {
+			if present && jsonEqual(value, candidate) {
+				found = true
+				break
+			}
+		}
+		if operator == "in" {
+			return found, nil
+		}
+		return !found, nil
+	case "exists":
+		want := true
+		if b, ok := expected.(bool); ok {
+			want = b
+		}
+		return present == want, nil
+	case "contains":
+		return present && jsonContains(value, expected, true), nil
+	case "like":
+		if !present || value == nil {
+			return false, nil
+		}
+		return likeMatch(jsonText(value), fmt.Sprintf("%v", expected)), nil
+	default:
+		return false, fmt.Errorf("unsupported operator %q", operator)
+	}
+}
+
+// matchColumnCondition mirrors compileColumnCondition for the columns known to a change event
+func matchColumnCondition(column, operator string, expected interface{}, document models.Document) (bool, error) {
+	var value interface{}
+	switch column {
+	case "id":
+		value = document.ID
+	case "author":
+		value = document.Author
+	case "version":
+		value = float64(document.Version)
+	default:
+		return false, fmt.Errorf("field %q cannot be used in subscription filters", column)
+	}
+
+	switch operator {
+	case "eq", "ne":
+		return jsonEqual(value, expected) == (operator == "eq"), nil
+	case "gt", "gte", "lt", "lte":
+		order, ok := compareJSONScalars(value, expected)
+		return ok && matchOrder(operator, order), nil
+	case "in", "nin":
+		values, _ := expected.([]interface{})
+		found := false
+		for _, candidate := range values {
+			if jsonEqual(value, candidate) {
+				found = true
+				break
+			}
+		}
+		return found == (operator == "in"), nil
+	case "like":
+		return likeMatch(jsonText(value), fmt.Sprintf("%v", expected)), nil
+	default:
+		return false, fmt.Errorf("operator %q is not supported on field %q", operator, column)
+	}
+}
+
+// dataPathValue resolves a path like the #> operator, including array indexes
+func dataPathValue(data map[string]interface{}, path []string) (interface{}, bool) {
+	var current interface{} = data
+	for _, segment := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil {
+				return nil, false
+			}
+			if index < 0 {
+				index += len(node)
+			}
+			if index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// jsonContains implements jsonb containment (@>); top enables the rule that an array at the
+// top level contains a matching scalar
+func jsonContains(container, contained interface{}, top bool) bool {
+	switch want := contained.(type) {
+	case map[string]interface{}:
+		have, ok := container.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, wantValue := range want {
+			haveValue, ok := have[key]
+			if !ok || !jsonContains(haveValue, wantValue, false) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		have, ok := container.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, wantItem := range want {
+			found := false
+			for _, haveItem := range have {
+				if jsonContains(haveItem, wantItem, false) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		if have, ok := container.([]interface{}); ok && top {
+			for _, haveItem := range have {
+				if jsonEqual(haveItem, contained) {
+					return true
+				}
+			}
+			return false
+		}
+		return jsonEqual(container, contained)
+	}
+}
+
+// jsonEqual compares two JSON values, treating all numbers as float64
+func jsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeJSON(a), normalizeJSON(b))
+}
+
+// compareJSONScalars orders two scalars of the same JSON type
+func compareJSONScalars(a, b interface{}) (int, bool) {
+	a, b = normalizeJSON(a), normalizeJSON(b)
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x == y:
+			return 0, true
+		case !x:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func matchOrder(operator string, order int) bool {
+	switch operator {
+	case "gt":
+		return order > 0
+	case "gte":
+		return order >= 0
+	case "lt":
+		return order < 0
+	default:
+		return order <= 0
+	}
+}
+
+// normalizeJSON converts Go numeric types to float64 the way encoding/json decodes them
+func normalizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}, []interface{}, float64, string, bool, nil:
+		return value
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return value
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return value
+		}
+		return decoded
+	}
+}
+
+// jsonText renders a value like the #>> operator: strings unquoted, everything else as JSON
+func jsonText(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	raw, _ := json.Marshal(value)
+	return string(raw)
+}
+
+// likeMatch reports whether text contains pattern, case-insensitively, honouring % and _
+// wildcards the way ILIKE '%pattern%' does
+func likeMatch(text, pattern string) bool {
+	var expr strings.Builder
+	expr.WriteString("(?is)")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	matched, err := regexp.MatchString(expr.String(), text)
+	return err == nil && matched
+}
@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+// Query limits to keep compiled SQL bounded
+const (
+	maxQueryDepth      = 5
+	maxQueryConditions = 50
+	maxQueryInValues   = 100
+	maxQuerySortFields = 5
+	maxFieldPathDepth  = 8
+)
+
+// fieldSegmentPattern restricts JSON path segments so they can be inlined safely as a text[] literal
+var fieldSegmentPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+// documentColumns maps query field names to real document columns (everything else addresses data)
+var documentColumns = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+	"version":    "version",
+	"author":     "author",
+}
+
+// documentQuery is the request body accepted by QueryDocuments
+type documentQuery struct {
+	Limit   int              `json:"limit"`
+	Offset  int              `json:"offset"`
+	Select  []string         `json:"select"`
+	Filters []queryCondition `json:"filters"` // Combined with AND
+	Where   *queryCondition  `json:"where"`   // Optional boolean tree
+	Sort    []querySort      `json:"sort"`
+
+	// Keyset pagination: an opaque next_cursor/prev_cursor token replaces offset
+	Cursor    string `json:"cursor"`
+	SkipTotal bool   `json:"skip_total"`
+}
+
+// queryCondition is either a leaf comparison (field/operator/value) or an and/or group
+type queryCondition struct {
+	Field    string           `json:"field"`
+	Operator string           `json:"operator"`
+	Value    interface{}      `json:"value"`
+	And      []queryCondition `json:"and"`
+	Or       []queryCondition `json:"or"`
+}
+
+// querySort describes a single sort key
+type querySort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+}
+
+// documentQueryCompiler turns query conditions into parameterized JSONB SQL
+type documentQueryCompiler struct {
+	conditions int
+}
+
+// compileFilters compiles the filters list and optional where tree into a single WHERE fragment
+func (qc *documentQueryCompiler) compileFilters(filters []queryCondition, where *queryCondition) (string, []interface{}, error) {
+	var parts []string
+	var args []interface{}
+
+	for _, filter := range filters {
+		sql, filterArgs, err := qc.compile(filter, 1)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, sql)
+		args = append(args, filterArgs...)
+	}
+
+	if where != nil {
+		sql, whereArgs, err := qc.compile(*where, 1)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, sql)
+		args = append(args, whereArgs...)
+	}
+
+	if len(parts) == 0 {
+		return "", nil, nil
+	}
+	return strings.Join(parts, " AND "), args, nil
+}
+
+// compile compiles a single condition (leaf or group)
+func (qc *documentQueryCompiler) compile(cond queryCondition, depth int) (string, []interface{}, error) {
+	if depth > maxQueryDepth {
+		return "", nil, fmt.Errorf("query nesting too deep (max %d levels)", maxQueryDepth)
+	}
+
+	isGroup := cond.And != nil || cond.Or != nil
+	if isGroup {
+		if cond.Field != "" || cond.Operator != "" {
+			return "", nil, fmt.Errorf("a condition cannot combine field/operator with and/or")
+		}
+		if cond.And != nil && cond.Or != nil {
+			return "", nil, fmt.Errorf("a group must use either and or or, not both")
+		}
+
+		children, joiner := cond.And, " AND "
+		if cond.Or != nil {
+			children, joiner = cond.Or, " OR "
+		}
+		if len(children) == 0 {
+			return "", nil, fmt.Errorf("empty and/or group")
+		}
+
+		var parts []string
+		var args []interface{}
+		for _, child := range children {
+			sql, childArgs, err := qc.compile(child, depth+1)
+			if err != nil {
+				return "", nil, err
+			}
+			parts = append(parts, sql)
+			args = append(args, childArgs...)
+		}
+		return "(" + strings.Join(parts, joiner) + ")", args, nil
+	}
+
+	qc.conditions++
+	if qc.conditions > maxQueryConditions {
+		return "", nil, fmt.Errorf("too many conditions (max %d)", maxQueryConditions)
+	}
+
+	if cond.Field == "" {
+		return "", nil, fmt.Errorf("condition is missing a field")
+	}
+
+	operator := normalizeQueryOperator(cond.Operator)
+	if column, ok := documentColumns[cond.Field]; ok {
+		return compileColumnCondition(column, operator, cond.Value)
+	}
+
+	path, err := parseFieldPath(cond.Field)
+	if err != nil {
+		return "", nil, err
+	}
+	return compileDataCondition(path, operator, cond.Value)
+}
+
+// normalizeQueryOperator maps symbolic aliases onto operator names
+func normalizeQueryOperator(operator string) string {
+	switch strings.ToLower(strings.TrimSpace(operator)) {
+	case "=", "==", "eq":
+		return "eq"
+	case "!=", "<>", "ne":
+		return "ne"
+	case ">", "gt":
+		return "gt"
+	case ">=", "gte":
+		return "gte"
+	case "<", "lt":
+		return "lt"
+	case "<=", "lte":
+		return "lte"
+	default:
+		return strings.ToLower(strings.TrimSpace(operator))
+	}
+}
+
+// comparisonOperators maps range operators onto SQL
+var comparisonOperators = map[string]string{
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+// compileDataCondition compiles a condition against a path inside the document data
+func compileDataCondition(path []string, operator string, value interface{}) (string, []interface{}, error) {
+	field := strings.Join(path, ".")
+	valueExpr := jsonPathExpr(path, false)
+
+	switch operator {
+	case "eq", "ne":
+		// Whole-value equality on the same expression as the collection indexes, so an
+		// expression index on the field serves the filter
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value for field %q", field)
+		}
+		if operator == "eq" {
+			return valueExpr + " = ?::jsonb", []interface{}{string(encoded)}, nil
+		}
+		return fmt.Sprintf("(%s IS NULL OR %s <> ?::jsonb)", valueExpr, valueExpr), []interface{}{string(encoded)}, nil
+
+	case "gt", "gte", "lt", "lte":
+		valueType, ok := jsonScalarType(value)
+		if !ok {
+			return "", nil, fmt.Errorf("operator %q on field %q requires a number, string or boolean value", operator, field)
+		}
+		encoded, _ := json.Marshal(value)
+		// Only compare values of the same JSON type; jsonb ordering across types is not meaningful
+		sql := fmt.Sprintf("(jsonb_typeof(%s) = ? AND %s %s ?::jsonb)", valueExpr, valueExpr, comparisonOperators[operator])
+		return sql, []interface{}{valueType, string(encoded)}, nil
+
+	case "in", "nin":
+		values, ok := value.([]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("operator %q on field %q requires an array value", operator, field)
+		}
+		if len(values) == 0 {
+			if operator == "in" {
+				return "FALSE", nil, nil
+			}
+			return "TRUE", nil, nil
+		}
+		if len(values) > maxQueryInValues {
+			return "", nil, fmt.Errorf("too many values for %q on field %q (max %d)", operator, field, maxQueryInValues)
+		}
+
+		placeholders := make([]string, len(values))
+		args := make([]interface{}, len(values))
+		for i, v := range values {
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid value for field %q", field)
+			}
+			placeholders[i] = "?::jsonb"
+			args[i] = string(encoded)
+		}
+		list := strings.Join(placeholders, ", ")
+		if operator == "in" {
+			return fmt.Sprintf("%s IN (%s)", valueExpr, list), args, nil
+		}
+		return fmt.Sprintf("(%s IS NULL OR %s NOT IN (%s))", valueExpr, valueExpr, list), args, nil
+
+	case "exists":
+		exists := true
+		if value != nil {
+			b, ok := value.(bool)
+			if !ok {
+				return "", nil, fmt.Errorf("operator \"exists\" on field %q requires a boolean value", field)
+			}
+			exists = b
+		}
+		if exists {
+			return valueExpr + " IS NOT NULL", nil, nil
+		}
+		return valueExpr + " IS NULL", nil, nil
+
+	case "contains":
+		if value == nil {
+			return "", nil, fmt.Errorf("operator \"contains\" on field %q requires a value", field)
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value for field %q", field)
+		}
+		return valueExpr + " @> ?::jsonb", []interface{}{string(encoded)}, nil
+
+	case "like":
+		return jsonPathExpr(path, true) + " ILIKE ?", []interface{}{"%" + fmt.Sprintf("%v", value) + "%"}, nil
+
+	default:
+		return "", nil, fmt.Errorf("unsupported operator %q", operator)
+	}
+}
+
+// compileColumnCondition compiles a condition against a document column
+func compileColumnCondition(column, operator string, value interface{}) (string, []interface{}, error) {
+	switch operator {
+	case "eq":
+		return column + " = ?", []interface{}{value}, nil
+	case "ne":
+		return column + " <> ?", []interface{}{value}, nil
+	case "gt", "gte", "lt", "lte":
+		if _, ok := jsonScalarType(value); !ok {
+			return "", nil, fmt.Errorf("operator %q on field %q requires a scalar value", operator, column)
+		}
+		return fmt.Sprintf("%s %s ?", column, comparisonOperators[operator]), []interface{}{value}, nil
+	case "in", "nin":
+		values, ok := value.([]interface{})
+		if !ok {
+			return "", nil, fmt.Errorf("operator %q on field %q requires an array value", operator, column)
+		}
+		if len(values) > maxQueryInValues {
+			return "", nil, fmt.Errorf("too many values for %q on field %q (max %d)", operator, column, maxQueryInValues)
+		}
+		if len(values) == 0 {
+			if operator == "in" {
+				return "FALSE", nil, nil
+			}
+			return "TRUE", nil, nil
+		}
+		if operator == "in" {
+			return column + " IN ?", []interface{}{values}, nil
+		}
+		return column + " NOT IN ?", []interface{}{values}, nil
+	case "like":
+		return column + "::text ILIKE ?", []interface{}{"%" + fmt.Sprintf("%v", value) + "%"}, nil
+	default:
+		return "", nil, fmt.Errorf("operator %q is not supported on field %q", operator, column)
+	}
+}
+
+// compileSortKeys compiles sort fields into keyset sort keys, always ending with id for a stable order
+func compileSortKeys(sorts []querySort) ([]keysetKey, error) {
+	if len(sorts) > maxQuerySortFields {
+		return nil, fmt.Errorf("too many sort fields (max %d)", maxQuerySortFields)
+	}
+
+	var keys []keysetKey
+	for _, sort := range sorts {
+		if sort.Field == "" {
+			return nil, fmt.Errorf("sort is missing a field")
+		}
+
+		direction := strings.ToUpper(strings.TrimSpace(sort.Direction))
+		if direction == "" {
+			direction = "ASC"
+		}
+		if direction != "ASC" && direction != "DESC" {
+			return nil, fmt.Errorf("invalid sort direction %q (use ASC or DESC)", sort.Direction)
+		}
+		desc := direction == "DESC"
+
+		if column, ok := documentColumns[sort.Field]; ok {
+			keys = append(keys, documentColumnKey(column, desc))
+			if column == "id" {
+				// id is unique, later keys can never break a tie
+				return keys, nil
+			}
+			continue
+		}
+
+		path, err := parseFieldPath(sort.Field)
+		if err != nil {
+			return nil, err
+		}
+		// Missing fields sort as JSON null so cursors can compare against them
+		keys = append(keys, keysetKey{
+			expr: fmt.Sprintf("COALESCE(%s, 'null'::jsonb)", jsonPathExpr(path, false)),
+			desc: desc,
+			kind: keysetJSON,
+			path: path,
+		})
+	}
+
+	if len(keys) == 0 {
+		return []keysetKey{documentColumnKey("created_at", true), documentColumnKey("id", true)}, nil
+	}
+	return append(keys, documentColumnKey("id", false)), nil
+}
+
+// documentColumnKey returns the sort key for a document column
+func documentColumnKey(column string, desc bool) keysetKey {
+	key := keysetKey{expr: column, desc: desc, kind: keysetString, column: column}
+	switch column {
+	case "created_at", "updated_at":
+		key.kind = keysetTime
+	case "version":
+		key.kind = keysetInt
+	case "author":
+		key.expr = "COALESCE(author, '')"
+	}
+	return key
+}
+
+// documentKeyValues reads the sort key values of a document for building cursors; data holds
+// the stored JSON of the document when the keys read data paths
+func documentKeyValues(document models.Document, data []byte, keys []keysetKey) []interface{} {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		switch key.column {
+		case "id":
+			values[i] = document.ID
+		case "created_at":
+			values[i] = document.CreatedAt
+		case "updated_at":
+			values[i] = document.UpdatedAt
+		case "version":
+			values[i] = document.Version
+		case "author":
+			values[i] = document.Author
+		default:
+			values[i] = lookupDataPath(data, key.path)
+		}
+	}
+	return values
+}
+
+// parseFieldPath splits a dotted field name into validated path segments
+func parseFieldPath(field string) ([]string, error) {
+	segments := strings.Split(field, ".")
+	if len(segments) > maxFieldPathDepth {
+		return nil, fmt.Errorf("field %q is nested too deep (max %d levels)", field, maxFieldPathDepth)
+	}
+	for _, segment := range segments {
+		if !fieldSegmentPattern.MatchString(segment) {
+			return nil, fmt.Errorf("invalid field %q: use letters, numbers, underscores and dashes separated by dots", field)
+		}
+	}
+	return segments, nil
+}
+
+// jsonPathExpr returns the SQL expression addressing path inside data, as jsonb or as text.
+// Segments are validated by parseFieldPath so they can be inlined as a text[] literal.
+func jsonPathExpr(path []string, asText bool) string {
+	operator := "#>"
+	if asText {
+		operator = "#>>"
+	}
+	return fmt.Sprintf("(data %s '{%s}')", operator, strings.Join(path, ","))
+}
+
+// jsonScalarType returns the jsonb_typeof name for scalar values usable in range comparisons
+func jsonScalarType(value interface{}) (string, bool) {
+	switch value.(type) {
+	case float64, float32, int, int64, json.Number:
+		return "number", true
+	case string:
+		return "string", true
+	case bool:
+		return "boolean", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestCompileFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []queryCondition
+		where   *queryCondition
+		sql     string
+		args    []interface{}
+		err     string
+	}{
+		{
+			name:    "eq on a field",
+			filters: []queryCondition{{Field: "status", Operator: "=", Value: "active"}},
+			sql:     `(data #> '{status}') = ?::jsonb`,
+			args:    []interface{}{`"active"`},
+		},
+		{
+			name:    "eq on an array element",
+			filters: []queryCondition{{Field: "tags.0", Operator: "eq", Value: "red"}},
+			sql:     `(data #> '{tags,0}') = ?::jsonb`,
+			args:    []interface{}{`"red"`},
+		},
+		{
+			name:    "eq on an object compares the whole value",
+			filters: []queryCondition{{Field: "address", Operator: "eq", Value: map[string]interface{}{"city": "Oslo"}}},
+			sql:     `(data #> '{address}') = ?::jsonb`,
+			args:    []interface{}{`{"city":"Oslo"}`},
+		},
+		{
+			name:    "ne includes missing fields",
+			filters: []queryCondition{{Field: "profile.age", Operator: "!=", Value: 30.0}},
+			sql:     `((data #> '{profile,age}') IS NULL OR (data #> '{profile,age}') <> ?::jsonb)`,
+			args:    []interface{}{`30`},
+		},
+		{
+			name:    "range compares values of the same type",
+			filters: []queryCondition{{Field: "score", Operator: ">=", Value: 10.0}},
+			sql:     `(jsonb_typeof((data #> '{score}')) = ? AND (data #> '{score}') >= ?::jsonb)`,
+			args:    []interface{}{"number", `10`},
+		},
+		{
+			name:    "range requires a scalar",
+			filters: []queryCondition{{Field: "score", Operator: "gt", Value: []interface{}{1.0}}},
+			err:     "requires a number, string or boolean value",
+		},
+		{
+			name:    "in",
+			filters: []queryCondition{{Field: "status", Operator: "in", Value: []interface{}{"a", "b"}}},
+			sql:     `(data #> '{status}') IN (?::jsonb, ?::jsonb)`,
+			args:    []interface{}{`"a"`, `"b"`},
+		},
+		{
+			name:    "empty nin matches everything",
+			filters: []queryCondition{{Field: "status", Operator: "nin", Value: []interface{}{}}},
+			sql:     `TRUE`,
+		},
+		{
+			name:    "exists false",
+			filters: []queryCondition{{Field: "deleted", Operator: "exists", Value: false}},
+			sql:     `(data #> '{deleted}') IS NULL`,
+		},
+		{
+			name:    "contains",
+			filters: []queryCondition{{Field: "tags", Operator: "contains", Value: "red"}},
+			sql:     `(data #> '{tags}') @> ?::jsonb`,
+			args:    []interface{}{`"red"`},
+		},
+		{
+			name:    "like",
+			filters: []queryCondition{{Field: "name", Operator: "like", Value: "ann"}},
+			sql:     `(data #>> '{name}') ILIKE ?`,
+			args:    []interface{}{"%ann%"},
+		},
+		{
+			name:    "document column",
+			filters: []queryCondition{{Field: "author", Operator: "eq", Value: "alice"}},
+			sql:     `author = ?`,
+			args:    []interface{}{"alice"},
+		},
+		{
+			name: "filters and where tree",
+			filters: []queryCondition{
+				{Field: "a", Operator: "eq", Value: 1.0},
+			},
+			where: &queryCondition{Or: []queryCondition{
+				{Field: "b", Operator: "eq", Value: true},
+				{Field: "c", Operator: "exists"},
+			}},
+			sql:  `(data #> '{a}') = ?::jsonb AND ((data #> '{b}') = ?::jsonb OR (data #> '{c}') IS NOT NULL)`,
+			args: []interface{}{`1`, `true`},
+		},
+		{
+			name:    "invalid field segment",
+			filters: []queryCondition{{Field: "a'b", Operator: "eq", Value: 1.0}},
+			err:     "invalid field",
+		},
+		{
+			name:  "group with a field",
+			where: &queryCondition{Field: "a", And: []queryCondition{{Field: "b", Operator: "eq"}}},
+			err:   "cannot combine",
+		},
+		{
+			name:    "unknown operator",
+			filters: []queryCondition{{Field: "a", Operator: "regex", Value: "x"}},
+			err:     "unsupported operator",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compiler := &documentQueryCompiler{}
+			sql, args, err := compiler.compileFilters(tt.filters, tt.where)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if sql != tt.sql {
+				t.Errorf("sql = %s\nwant  %s", sql, tt.sql)
+			}
+			if len(args) != 0 || len(tt.args) != 0 {
+				if !reflect.DeepEqual(args, tt.args) {
+					t.Errorf("args = %#v, want %#v", args, tt.args)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileFiltersLimits(t *testing.T) {
+	deep := queryCondition{Field: "a", Operator: "eq", Value: 1.0}
+	for i := 0; i < maxQueryDepth; i++ {
+		deep = queryCondition{And: []queryCondition{deep}}
+	}
+	if _, _, err := (&documentQueryCompiler{}).compileFilters(nil, &deep); err == nil {
+		t.Error("expected an error for a tree deeper than the limit")
+	}
+
+	many := make([]queryCondition, maxQueryConditions+1)
+	for i := range many {
+		many[i] = queryCondition{Field: "a", Operator: "exists"}
+	}
+	if _, _, err := (&documentQueryCompiler{}).compileFilters(many, nil); err == nil {
+		t.Error("expected an error for more conditions than the limit")
+	}
+}
+
+func TestMatchDocumentCondition(t *testing.T) {
+	document := models.Document{
+		ID:     "doc1",
+		Author: "alice",
+		Data: map[string]interface{}{
+			"status":  "active",
+			"score":   12.0,
+			"tags":    []interface{}{"red", "blue"},
+			"address": map[string]interface{}{"city": "Oslo", "zip": "0150"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		cond queryCondition
+		want bool
+	}{
+		{"eq scalar", queryCondition{Field: "status", Operator: "eq", Value: "active"}, true},
+		{"eq int against float", queryCondition{Field: "score", Operator: "eq", Value: 12}, true},
+		{"eq does not match a superset object", queryCondition{Field: "address", Operator: "eq", Value: map[string]interface{}{"city": "Oslo"}}, false},
+		{"eq does not match an array member", queryCondition{Field: "tags", Operator: "eq", Value: "red"}, false},
+		{"eq on an array index", queryCondition{Field: "tags.1", Operator: "eq", Value: "blue"}, true},
+		{"eq on a missing field", queryCondition{Field: "missing", Operator: "eq", Value: nil}, false},
+		{"ne on a missing field", queryCondition{Field: "missing", Operator: "ne", Value: "x"}, true},
+		{"ne on an equal value", queryCondition{Field: "status", Operator: "ne", Value: "active"}, false},
+		{"contains an array member", queryCondition{Field: "tags", Operator: "contains", Value: "red"}, true},
+		{"contains a sub-object", queryCondition{Field: "address", Operator: "contains", Value: map[string]interface{}{"city": "Oslo"}}, true},
+		{"gt across types", queryCondition{Field: "status", Operator: "gt", Value: 1.0}, false},
+		{"lte", queryCondition{Field: "score", Operator: "lte", Value: 12.0}, true},
+		{"nin", queryCondition{Field: "status", Operator: "nin", Value: []interface{}{"deleted"}}, true},
+		{"like", queryCondition{Field: "address.city", Operator: "like", Value: "os_o"}, true},
+		{"column", queryCondition{Field: "author", Operator: "eq", Value: "alice"}, true},
+		{"or group", queryCondition{Or: []queryCondition{
+			{Field: "status", Operator: "eq", Value: "deleted"},
+			{Field: "score", Operator: "gt", Value: 10.0},
+		}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchDocumentCondition(tt.cond, document)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("matchDocumentCondition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/middleware"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Revision operations
+const (
+	revisionCreate  = "create"
+	revisionUpdate  = "update"
+	revisionDelete  = "delete"
+	revisionRestore = "restore"
+)
+
+// Revision retention and listing limits
+const (
+	defaultRevisionLimit = 50 // Used when a document has no collection record
+	maxRevisionPageSize  = 100
+)
+
+// revisionKeys is the keyset order of revision listings (newest first)
+var revisionKeys = []keysetKey{{expr: "id", desc: true, kind: keysetInt, column: "id"}}
+
+// revisionSettings are the retention settings accepted when creating a collection or updating
+// its retention; omitted settings are left unchanged
+type revisionSettings struct {
+	RevisionLimit         *int `json:"revision_limit"`          // 0 = unlimited
+	RevisionRetentionDays *int `json:"revision_retention_days"` // 0 = forever
+}
+
+// apply validates the settings and sets them on collection
+func (s revisionSettings) apply(collection *models.Collection) error {
+	if s.RevisionLimit != nil {
+		if *s.RevisionLimit < 0 {
+			return fmt.Errorf("revision_limit must be 0 (unlimited) or greater")
+		}
+		limit := *s.RevisionLimit
+		collection.RevisionLimit = &limit
+	}
+	if s.RevisionRetentionDays != nil {
+		if *s.RevisionRetentionDays < 0 {
+			return fmt.Errorf("revision_retention_days must be 0 (forever) or greater")
+		}
+		collection.RevisionRetentionDays = *s.RevisionRetentionDays
+	}
+	return nil
+}
+
+// requestAPIKeyID returns the ID of the API key that authenticated the request, if any
+func requestAPIKeyID(c *gin.Context) *uint {
+	if c == nil {
+		return nil
+	}
+	if value, exists := c.Get("api_key"); exists {
+		if apiKey, ok := value.(models.APIKey); ok {
+			id := apiKey.ID
+			return &id
+		}
+	}
+	return nil
+}
+
+// requestAuthor returns the author recorded for a write made by the request: its API key, or
+// the signed-in admin on admin routes
+func requestAuthor(c *gin.Context) string {
+	if value, exists := c.Get("api_key"); exists {
+		if apiKey, ok := value.(models.APIKey); ok {
+			return "api_key:" + apiKey.Name
+		}
+	}
+	return "admin:jwt"
+}
+
+// documentRouteID returns the document ID of a project API route (:id) or admin route (:document_id)
+func documentRouteID(c *gin.Context) string {
+	if documentID := c.Param("document_id"); documentID != "" {
+		return documentID
+	}
+	return c.Param("id")
+}
+
+// newDocumentRevision snapshots the current state of a document. Callers set document.Author
+// to the acting author first, also for deletes, where the stored author is the last writer.
+func newDocumentRevision(document models.Document, operation string, apiKeyID *uint) models.DocumentRevision {
+	return models.DocumentRevision{
+		ProjectID:      document.ProjectID,
+		CollectionName: document.CollectionName,
+		DocumentID:     document.ID,
+		Version:        document.Version,
+		Operation:      operation,
+		Data:           document.Data,
+		Author:         document.Author,
+		APIKeyID:       apiKeyID,
+	}
+}
+
+// recordDocumentRevision appends a revision for a document written in tx
+func recordDocumentRevision(tx *gorm.DB, document models.Document, operation string, apiKeyID *uint) error {
+	return recordDocumentRevisions(tx, []models.Document{document}, operation, apiKeyID)
+}
+
+// recordDocumentRevisions appends revisions for documents of one collection written in tx
+// and prunes their history according to the collection retention settings. The write is also
+// published on the realtime change feed.
+func recordDocumentRevisions(tx *gorm.DB, documents []models.Document, operation string, apiKeyID *uint) error {
+	if len(documents) == 0 {
+		return nil
+	}
+	if err := recordDocumentChanges(tx, documents, revisionChangeOperations[operation]); err != nil {
+		return err
+	}
+
+	revisions := make([]models.DocumentRevision, len(documents))
+	documentIDs := make([]string, len(documents))
+	for i, document := range documents {
+		revisions[i] = newDocumentRevision(document, operation, apiKeyID)
+		documentIDs[i] = document.ID
+	}
+	if err := tx.CreateInBatches(revisions, 100).Error; err != nil {
+		return err
+	}
+
+	// A newly created document only has the revision just written
+	if operation == revisionCreate {
+		return nil
+	}
+	return pruneDocumentRevisions(tx, documents[0].ProjectID, documents[0].CollectionName, documentIDs)
+}
+
+// pruneDocumentRevisions deletes revisions beyond the collection revision limit or older than
+// its retention period. The latest revision of a document is always kept. A nil documentIDs
+// prunes the whole collection.
+func pruneDocumentRevisions(tx *gorm.DB, projectID uint, collectionName string, documentIDs []string) error {
+	limit, days := defaultRevisionLimit, 0
+	var collection models.Collection
+	err := tx.Select("revision_limit", "revision_retention_days").
+		Where("project_id = ? AND name = ?", projectID, collectionName).First(&collection).Error
+	if err == nil {
+		days = collection.RevisionRetentionDays
+		if collection.RevisionLimit != nil {
+			limit = *collection.RevisionLimit
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	var expired []string
+	var args []interface{}
+	if limit > 0 {
+		expired = append(expired, "position > ?")
+		args = append(args, limit)
+	}
+	if days > 0 {
+		expired = append(expired, "created_at < ?")
+		args = append(args, time.Now().AddDate(0, 0, -days))
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	scope := "project_id = ? AND collection_name = ?"
+	scopeArgs := []interface{}{projectID, collectionName}
+	if documentIDs != nil {
+		scope += " AND document_id IN ?"
+		scopeArgs = append(scopeArgs, documentIDs)
+	}
+
+	sql := `DELETE FROM document_revisions WHERE id IN (
+		SELECT id FROM (
+			SELECT id, created_at, ROW_NUMBER() OVER (PARTITION BY document_id ORDER BY id DESC) AS position
+			FROM document_revisions WHERE ` + scope + `
+		) ranked WHERE position > 1 AND (` + strings.Join(expired, " OR ") + `)
+	)`
+	return tx.Exec(sql, append(scopeArgs, args...)...).Error
+}
+
+// findDocumentRevision returns the latest revision of a document with the given version
+func findDocumentRevision(db *gorm.DB, projectID uint, collectionName, documentID string, version int) (models.DocumentRevision, error) {
+	var revision models.DocumentRevision
+	err := db.Where("project_id = ? AND collection_name = ? AND document_id = ? AND version = ?",
+		projectID, collectionName, documentID, version).
+		Order("id DESC").First(&revision).Error
+	return revision, err
+}
+
+// respondRevisionLookup writes the response for a failed findDocumentRevision call
+func respondRevisionLookup(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load revision"})
+}
+
+// parseRevisionVersion parses a revision version from a path or query parameter
+func parseRevisionVersion(value string) (int, bool) {
+	version, err := strconv.Atoi(value)
+	return version, err == nil && version > 0
+}
+
+// ListDocumentRevisions returns the revision history of a document, newest first.
+// History stays available after the document is deleted.
+func (h *DataHandler) ListDocumentRevisions(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+	documentID := documentRouteID(c)
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > maxRevisionPageSize {
+		limit = 20
+	}
+
+	page, err := newKeysetPage(revisionKeys, c.Query("cursor"), limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := h.db.Model(&models.DocumentRevision{}).
+		Where("project_id = ? AND collection_name = ? AND document_id = ?", project.ID, collectionName, documentID)
+
+	var revisions []models.DocumentRevision
+	if err := page.apply(query).Find(&revisions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch revisions"})
+		return
+	}
+
+	size, more := page.window(len(revisions))
+	revisions = revisions[:size]
+	if page.backward {
+		slices.Reverse(revisions)
+	}
+
+	var next, prev string
+	if len(revisions) > 0 {
+		first := []interface{}{revisions[0].ID}
+		last := []interface{}{revisions[len(revisions)-1].ID}
+		next, prev = page.cursors(first, last, more, false)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"revisions":   revisions,
+		"limit":       limit,
+		"next_cursor": next,
+		"prev_cursor": prev,
+	})
+}
+
+// GetDocumentRevision returns a single revision of a document
+func (h *DataHandler) GetDocumentRevision(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	version, ok := parseRevisionVersion(c.Param("version"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	revision, err := findDocumentRevision(h.db, project.ID, c.Param("collection"), documentRouteID(c), version)
+	if err != nil {
+		respondRevisionLookup(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, revision)
+}
+
+// DiffDocumentRevisions returns the JSON Patch that turns revision from into revision to.
+// to defaults to the latest revision.
+func (h *DataHandler) DiffDocumentRevisions(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+	documentID := documentRouteID(c)
+
+	fromVersion, ok := parseRevisionVersion(c.Query("from"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a revision version"})
+		return
+	}
+
+	from, err := findDocumentRevision(h.db, project.ID, collectionName, documentID, fromVersion)
+	if err != nil {
+		respondRevisionLookup(c, err)
+		return
+	}
+
+	var to models.DocumentRevision
+	if value := c.Query("to"); value != "" {
+		toVersion, ok := parseRevisionVersion(value)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a revision version"})
+			return
+		}
+		to, err = findDocumentRevision(h.db, project.ID, collectionName, documentID, toVersion)
+	} else {
+		err = h.db.Where("project_id = ? AND collection_name = ? AND document_id = ?", project.ID, collectionName, documentID).
+			Order("id DESC").First(&to).Error
+	}
+	if err != nil {
+		respondRevisionLookup(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":       from.Version,
+		"to":         to.Version,
+		"operations": utils.DiffJSON(from.Data, to.Data),
+	})
+}
+
+// RestoreDocumentRevision writes the data of a past revision back to the document as a new
+// version, undeleting the document if needed. If-Match or expected_version make the
+// restore conditional on the current version.
+func (h *DataHandler) RestoreDocumentRevision(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+	documentID := documentRouteID(c)
+
+	version, ok := parseRevisionVersion(c.Param("version"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	expected, err := documentPrecondition(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revision, err := findDocumentRevision(h.db, project.ID, collectionName, documentID, version)
+	if err != nil {
+		respondRevisionLookup(c, err)
+		return
+	}
+
+	author := requestAuthor(c)
+
+	// Validate the restored data against the current collection JSON Schema
+	if respondDocumentValidation(c, validateCollectionDocument(h.db, project.ID, collectionName, revision.Data)) {
+		return
+	}
+
+	tx := h.db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			log.Printf("Panic in RestoreDocumentRevision: %v", r)
+		}
+	}()
+
+	// Deleted documents are restored in place, so look beyond the soft-delete scope. Each
+	// statement starts from tx: a shared Unscoped() chain would carry the lock query's clauses
+	// into the update.
+	document, err := lockDocument(tx.Unscoped(), project.ID, collectionName, documentID, expected)
+	if err != nil {
+		tx.Rollback()
+		respondDocumentLockError(c, document, err)
+		return
+	}
+
+	// Undeleting a document reads as an insert on the change feed
+	changeOperation := changeUpdate
+	if document.DeletedAt.Valid {
+		changeOperation = changeInsert
+		if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaDocuments, 1)) {
+			tx.Rollback()
+			return
+		}
+	}
+
+	document.Data = revision.Data
+	document.Author = author
+	document.Version++
+	document.DeletedAt = gorm.DeletedAt{}
+	if err := tx.Unscoped().Model(&document).Select("data", "author", "version", "deleted_at", "updated_at").Updates(&document).Error; err != nil {
+		tx.Rollback()
+		if respondUniqueIndexViolation(c, h.db, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore document"})
+		return
+	}
+
+	restored := newDocumentRevision(document, revisionRestore, requestAPIKeyID(c))
+	restored.RestoredFrom = &revision.Version
+	if err := tx.Create(&restored).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
+	if err := pruneDocumentRevisions(tx, project.ID, collectionName, []string{documentID}); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune document revisions"})
+		return
+	}
+	if err := recordDocumentChanges(tx, []models.Document{document}, changeOperation); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document change"})
+		return
+	}
+
+	// Update collection stats in same transaction
+	if err := h.updateCollectionStatsInTx(tx, project.ID, collectionName); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collection stats"})
+		return
+	}
+
+	tx.Commit()
+
+	c.Header("ETag", documentETag(document.Version))
+	c.JSON(http.StatusOK, document)
+}
+
+// UpdateCollectionRetention changes how long document revisions of a collection are kept
+// and prunes existing history to match
+func (h *DataHandler) UpdateCollectionRetention(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+
+	var collection models.Collection
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, collectionName).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	var req revisionSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.apply(&collection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := h.db.Begin()
+	if err := tx.Model(&collection).Select("revision_limit", "revision_retention_days").Updates(&collection).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention settings"})
+		return
+	}
+	if err := pruneDocumentRevisions(tx, project.ID, collectionName, nil); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune document revisions"})
+		return
+	}
+	tx.Commit()
+
+	c.JSON(http.StatusOK, collection)
+}
+
+// AdminListDocumentRevisions lists document revisions via admin interface (JWT authenticated)
+func (h *DataHandler) AdminListDocumentRevisions(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.ListDocumentRevisions(c)
+	}
+}
+
+// AdminGetDocumentRevision gets a document revision via admin interface (JWT authenticated)
+func (h *DataHandler) AdminGetDocumentRevision(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.GetDocumentRevision(c)
+	}
+}
+
+// AdminDiffDocumentRevisions diffs document revisions via admin interface (JWT authenticated)
+func (h *DataHandler) AdminDiffDocumentRevisions(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.DiffDocumentRevisions(c)
+	}
+}
+
+// AdminRestoreDocumentRevision restores a document revision via admin interface (JWT authenticated)
+func (h *DataHandler) AdminRestoreDocumentRevision(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.RestoreDocumentRevision(c)
+	}
+}
+
+// AdminUpdateCollectionRetention updates revision retention via admin interface (JWT authenticated)
+func (h *DataHandler) AdminUpdateCollectionRetention(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.UpdateCollectionRetention(c)
+	}
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// revisionFixture is a project with one collection, written to through an API key
+type revisionFixture struct {
+	t       *testing.T
+	db      *gorm.DB
+	router  *gin.Engine
+	project models.Project
+}
+
+func newRevisionFixture(t *testing.T, revisionLimit *int, retentionDays int) *revisionFixture {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.Collection{}, &models.Document{}, &models.DocumentRevision{}, &models.File{})
+	// The change feed table takes its xid default from txid_current(), which SQLite cannot parse
+	if err := db.Exec(`CREATE TABLE document_changes (
+		sequence INTEGER PRIMARY KEY AUTOINCREMENT, xid INTEGER NOT NULL DEFAULT 0, created_at DATETIME,
+		project_id INTEGER NOT NULL, collection_name TEXT NOT NULL, document_id VARCHAR(255) NOT NULL,
+		operation TEXT NOT NULL, version INTEGER, author TEXT, data JSONB)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	// The handler is built without NewDataHandler, which listens for changes on Postgres
+	handler := &DataHandler{db: db, cfg: cfg, quotas: services.NewQuotaService(db, cfg)}
+
+	project := models.Project{Name: "app", Slug: "app", UserID: 1, IsActive: true}
+	db.Create(&project)
+	collection := models.Collection{Name: "posts", ProjectID: project.ID, RevisionRetentionDays: retentionDays}
+	db.Create(&collection)
+	// Create skips a nil limit in favour of the column default
+	db.Model(&collection).Update("revision_limit", revisionLimit)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("project", project)
+		c.Set("api_key", models.APIKey{ID: 7, Name: "server", ProjectID: project.ID})
+	})
+	router.POST("/data/:collection", handler.CreateDocument)
+	router.PUT("/data/:collection/:id", handler.UpdateDocument)
+	router.DELETE("/data/:collection/:id", handler.DeleteDocument)
+	router.GET("/data/:collection/:id/revisions/diff", handler.DiffDocumentRevisions)
+	router.POST("/data/:collection/:id/revisions/:version/restore", handler.RestoreDocumentRevision)
+	router.PUT("/collections/:collection/retention", handler.UpdateCollectionRetention)
+	return &revisionFixture{t: t, db: db, router: router, project: project}
+}
+
+// do serves a request and fails the test unless it answers with status
+func (f *revisionFixture) do(method, target, body string, status int) *httptest.ResponseRecorder {
+	f.t.Helper()
+	recorder := serve(f.router, method, target, body)
+	if recorder.Code != status {
+		f.t.Fatalf("%s %s: %d %s, want %d", method, target, recorder.Code, recorder.Body.String(), status)
+	}
+	return recorder
+}
+
+// revisions returns the stored revisions of a document, oldest first
+func (f *revisionFixture) revisions(documentID string) []models.DocumentRevision {
+	var revisions []models.DocumentRevision
+	f.db.Where("document_id = ?", documentID).Order("id").Find(&revisions)
+	return revisions
+}
+
+// addRevisions stores count revisions of a document one day apart, the first created half a
+// day short of daysAgo so that none is on the edge of a retention period
+func (f *revisionFixture) addRevisions(documentID string, count, daysAgo int) {
+	for i := 0; i < count; i++ {
+		createdAt := time.Now().Add(12*time.Hour).AddDate(0, 0, i-daysAgo)
+		f.db.Create(&models.DocumentRevision{CreatedAt: createdAt, ProjectID: f.project.ID,
+			CollectionName: "posts", DocumentID: documentID, Version: i + 1, Operation: revisionUpdate})
+	}
+}
+
+// versions returns the versions of the stored revisions of a document, oldest first
+func (f *revisionFixture) versions(documentID string) []int {
+	versions := []int{}
+	for _, revision := range f.revisions(documentID) {
+		versions = append(versions, revision.Version)
+	}
+	return versions
+}
+
+func TestDocumentRevisionHistory(t *testing.T) {
+	f := newRevisionFixture(t, nil, 0)
+	f.do(http.MethodPost, "/data/posts", `{"id": "first", "title": "Hello", "tags": ["a"]}`, http.StatusCreated)
+	f.do(http.MethodPut, "/data/posts/first", `{"title": "Hello, world", "draft": true}`, http.StatusOK)
+	f.do(http.MethodDelete, "/data/posts/first", "", http.StatusOK)
+
+	revisions := f.revisions("first")
+	want := []struct {
+		version   int
+		operation string
+	}{{1, revisionCreate}, {2, revisionUpdate}, {2, revisionDelete}}
+	if len(revisions) != len(want) {
+		t.Fatalf("%d revisions, want %d", len(revisions), len(want))
+	}
+	for i, revision := range revisions {
+		if revision.Version != want[i].version || revision.Operation != want[i].operation ||
+			revision.Author != "api_key:server" || revision.APIKeyID == nil || *revision.APIKeyID != 7 {
+			t.Errorf("revision %d = version %d, %s by %s", i, revision.Version, revision.Operation, revision.Author)
+		}
+	}
+	if revisions[2].Data["title"] != "Hello, world" {
+		t.Errorf("delete revision data = %v, want the deleted document", revisions[2].Data)
+	}
+	// Every write is also on the change feed
+	var changes int64
+	f.db.Model(&models.DocumentChange{}).Where("document_id = ?", "first").Count(&changes)
+	if changes != 3 {
+		t.Errorf("%d changes recorded, want 3", changes)
+	}
+
+	// The diff defaults to the latest revision
+	var diff struct {
+		From       int                        `json:"from"`
+		To         int                        `json:"to"`
+		Operations []utils.JSONPatchOperation `json:"operations"`
+	}
+	json.Unmarshal(f.do(http.MethodGet, "/data/posts/first/revisions/diff?from=1", "", http.StatusOK).Body.Bytes(), &diff)
+	wantOperations := []utils.JSONPatchOperation{
+		{Op: "add", Path: "/draft", Value: true},
+		{Op: "remove", Path: "/tags"},
+		{Op: "replace", Path: "/title", Value: "Hello, world"},
+	}
+	if diff.From != 1 || diff.To != 2 || !reflect.DeepEqual(diff.Operations, wantOperations) {
+		t.Errorf("diff = %+v, want %+v", diff, wantOperations)
+	}
+	json.Unmarshal(f.do(http.MethodGet, "/data/posts/first/revisions/diff?from=2&to=1", "", http.StatusOK).Body.Bytes(), &diff)
+	if diff.From != 2 || diff.To != 1 || len(diff.Operations) != 3 {
+		t.Errorf("reverse diff = %+v", diff)
+	}
+	f.do(http.MethodGet, "/data/posts/first/revisions/diff", "", http.StatusBadRequest)
+	f.do(http.MethodGet, "/data/posts/first/revisions/diff?from=1&to=first", "", http.StatusBadRequest)
+	f.do(http.MethodGet, "/data/posts/first/revisions/diff?from=9", "", http.StatusNotFound)
+}
+
+func TestRestoreDocumentRevision(t *testing.T) {
+	f := newRevisionFixture(t, nil, 0)
+	f.do(http.MethodPost, "/data/posts", `{"id": "first", "title": "Hello"}`, http.StatusCreated)
+	f.do(http.MethodPut, "/data/posts/first", `{"title": "Goodbye"}`, http.StatusOK)
+	f.do(http.MethodDelete, "/data/posts/first", "", http.StatusOK)
+
+	// Restoring undeletes the document with the data of the revision as a new version
+	recorder := f.do(http.MethodPost, "/data/posts/first/revisions/1/restore", "", http.StatusOK)
+	if etag := recorder.Header().Get("ETag"); etag != documentETag(3) {
+		t.Errorf("ETag = %q, want %q", etag, documentETag(3))
+	}
+	var document models.Document
+	if err := f.db.First(&document, "id = ?", "first").Error; err != nil {
+		t.Fatalf("restored document: %v", err)
+	}
+	if document.Version != 3 || document.Data["title"] != "Hello" {
+		t.Errorf("restored document = version %d, data %v", document.Version, document.Data)
+	}
+	revisions := f.revisions("first")
+	restored := revisions[len(revisions)-1]
+	if restored.Operation != revisionRestore || restored.Version != 3 || restored.RestoredFrom == nil || *restored.RestoredFrom != 1 {
+		t.Errorf("restore revision = %s of version %d from %v", restored.Operation, restored.Version, restored.RestoredFrom)
+	}
+	var collection models.Collection
+	f.db.First(&collection, "name = ?", "posts")
+	if collection.DocumentCount != 1 {
+		t.Errorf("collection counts %d documents, want 1", collection.DocumentCount)
+	}
+	var change models.DocumentChange
+	f.db.Order("sequence DESC").First(&change)
+	if change.Operation != changeInsert || change.Version != 3 {
+		t.Errorf("change feed has %s of version %d, want an insert of version 3", change.Operation, change.Version)
+	}
+
+	// A conditional restore fails once the document has moved on
+	request := httptest.NewRequest(http.MethodPost, "/data/posts/first/revisions/2/restore", nil)
+	request.Header.Set("If-Match", documentETag(2))
+	conflict := httptest.NewRecorder()
+	f.router.ServeHTTP(conflict, request)
+	if conflict.Code != http.StatusPreconditionFailed {
+		t.Errorf("restore with a stale If-Match: %d %s", conflict.Code, conflict.Body.String())
+	}
+	f.do(http.MethodPost, "/data/posts/first/revisions/2/restore?expected_version=3", "", http.StatusOK)
+
+	f.do(http.MethodPost, "/data/posts/first/revisions/9/restore", "", http.StatusNotFound)
+	f.do(http.MethodPost, "/data/posts/first/revisions/0/restore", "", http.StatusBadRequest)
+	f.do(http.MethodPost, "/data/posts/other/revisions/1/restore", "", http.StatusNotFound)
+}
+
+func TestPruneDocumentRevisions(t *testing.T) {
+	limit := 3
+	f := newRevisionFixture(t, &limit, 0)
+
+	// Writes prune the history of the written document only
+	f.addRevisions("first", 5, 12)
+	f.addRevisions("second", 5, 9)
+	if err := recordDocumentRevision(f.db, models.Document{ID: "first", ProjectID: f.project.ID, CollectionName: "posts", Version: 6},
+		revisionUpdate, nil); err != nil {
+		t.Fatalf("record revision: %v", err)
+	}
+	if got := f.versions("first"); !reflect.DeepEqual(got, []int{4, 5, 6}) {
+		t.Errorf("versions after a write = %v, want the last 3", got)
+	}
+	if got := len(f.revisions("second")); got != 5 {
+		t.Errorf("%d revisions of an unwritten document, want 5", got)
+	}
+
+	// Changing the retention prunes the whole collection; the latest revision outlives the period
+	f.do(http.MethodPut, "/collections/posts/retention", `{"revision_limit": 0, "revision_retention_days": 7}`, http.StatusOK)
+	if got := f.versions("first"); !reflect.DeepEqual(got, []int{6}) {
+		t.Errorf("versions of first = %v, want [6]", got)
+	}
+	if got := f.versions("second"); !reflect.DeepEqual(got, []int{3, 4, 5}) {
+		t.Errorf("versions of second = %v, want the ones of the last 7 days", got)
+	}
+	f.addRevisions("old", 2, 30)
+	f.do(http.MethodPut, "/collections/posts/retention", `{"revision_retention_days": 7}`, http.StatusOK)
+	if got := f.versions("old"); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("versions of a document idle past the period = %v, want [2]", got)
+	}
+
+	// Unlimited and forever keeps everything
+	f.do(http.MethodPut, "/collections/posts/retention", `{"revision_retention_days": 0}`, http.StatusOK)
+	f.addRevisions("kept", 60, 400)
+	if err := pruneDocumentRevisions(f.db, f.project.ID, "posts", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(f.revisions("kept")); got != 60 {
+		t.Errorf("%d of 60 revisions kept without limits", got)
+	}
+
+	for _, body := range []string{`{"revision_limit": -1}`, `{"revision_retention_days": -1}`} {
+		f.do(http.MethodPut, "/collections/posts/retention", body, http.StatusBadRequest)
+	}
+	f.do(http.MethodPut, "/collections/missing/retention", `{"revision_limit": 1}`, http.StatusNotFound)
+}
+
+func TestPruneDocumentRevisionsDefaultLimit(t *testing.T) {
+	f := newRevisionFixture(t, nil, 0)
+	f.addRevisions("first", defaultRevisionLimit+5, 0)
+	if err := pruneDocumentRevisions(f.db, f.project.ID, "posts", []string{"first"}); err != nil {
+		t.Fatal(err)
+	}
+	if versions := f.versions("first"); len(versions) != defaultRevisionLimit || versions[0] != 6 {
+		t.Errorf("%d revisions kept from version %d, want the last %d", len(versions), versions[0], defaultRevisionLimit)
+	}
+	// Collections without a record use the default too
+	f.db.Where("name = ?", "posts").Delete(&models.Collection{})
+	f.addRevisions("first", 10, 0)
+	if err := pruneDocumentRevisions(f.db, f.project.ID, "posts", nil); err != nil {
+		t.Fatal(err)
+	}
+	if count := len(f.revisions("first")); count != defaultRevisionLimit {
+		t.Errorf("%d revisions kept without a collection record, want %d", count, defaultRevisionLimit)
+	}
+}
@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gorm.io/gorm"
+)
+
+// Limits for schema dry-runs against existing documents
+const (
+	schemaDryRunBatchSize     = 500
+	schemaDryRunMaxViolations = 100
+)
+
+// collectionSchemaURL is the in-memory resource name collection schemas are compiled under
+const collectionSchemaURL = "mem://cloudbox/collection.json"
+
+// schemaViolation is a single field-level validation failure
+type schemaViolation struct {
+	Index   *int   `json:"index,omitempty"` // Position in a batch request
+	ID      string `json:"id,omitempty"`    // Document ID (schema dry-runs)
+	Path    string `json:"path"`            // JSON pointer into the document data
+	Keyword string `json:"keyword"`         // JSON pointer to the failing schema keyword
+	Message string `json:"message"`
+}
+
+// schemaValidationError is returned when document data does not match its collection schema
+type schemaValidationError struct {
+	Violations []schemaViolation
+}
+
+func (e *schemaValidationError) Error() string {
+	return fmt.Sprintf("document does not match collection schema (%d violations)", len(e.Violations))
+}
+
+// compiledSchema caches the compiled schema of a collection by schema content
+type compiledSchema struct {
+	hash   [32]byte
+	schema *jsonschema.Schema
+}
+
+// collectionSchemas caches compiled schemas per collection ID
+var collectionSchemas sync.Map
+
+// jsonSchemaKeywords are root keywords that make a schema a JSON Schema document even when
+// it would also fit the legacy shape
+var jsonSchemaKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$ref": true, "$defs": true, "definitions": true,
+	"type": true, "properties": true, "patternProperties": true, "additionalProperties": true,
+	"required": true, "items": true, "prefixItems": true, "enum": true, "const": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true, "if": true, "then": true, "else": true,
+	"dependentRequired": true, "dependentSchemas": true, "unevaluatedProperties": true,
+	"minProperties": true, "maxProperties": true, "propertyNames": true,
+}
+
+// isLegacySchema reports whether a stored collection schema is the older field→descriptor map,
+// such as {"title": {"type": "string", "required": true}}, which is informational only. Only
+// that exact shape is legacy: every field maps to an object with a string type and no field
+// is named like a JSON Schema keyword.
+func isLegacySchema(schema map[string]interface{}) bool {
+	if len(schema) == 0 {
+		return false
+	}
+	for field, value := range schema {
+		if jsonSchemaKeywords[field] {
+			return false
+		}
+		descriptor, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := descriptor["type"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isJSONSchema reports whether a stored collection schema is enforced as JSON Schema: any
+// non-empty schema that is not a legacy field map
+func isJSONSchema(schema map[string]interface{}) bool {
+	return len(schema) > 0 && !isLegacySchema(schema)
+}
+
+// compileJSONSchema compiles a collection schema, defaulting to draft 2020-12.
+// External $ref resolution is disabled so schemas cannot read files or URLs.
+func compileJSONSchema(schema map[string]interface{}) (*jsonschema.Schema, error) {
+	raw, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external schema references are not allowed: %s", url)
+	}
+	if err := compiler.AddResource(collectionSchemaURL, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(collectionSchemaURL)
+}
+
+// collectionJSONSchema returns the compiled schema for a collection, or nil when it has none
+func collectionJSONSchema(collection models.Collection) (*jsonschema.Schema, error) {
+	if !isJSONSchema(collection.Schema) {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(collection.Schema)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(raw)
+
+	if cached, ok := collectionSchemas.Load(collection.ID); ok {
+		if entry := cached.(compiledSchema); entry.hash == hash {
+			return entry.schema, nil
+		}
+	}
+
+	schema, err := compileJSONSchema(collection.Schema)
+	if err != nil {
+		return nil, err
+	}
+	collectionSchemas.Store(collection.ID, compiledSchema{hash: hash, schema: schema})
+	return schema, nil
+}
+
+// validateAgainstSchema validates document data and flattens failures into violations
+func validateAgainstSchema(schema *jsonschema.Schema, data map[string]interface{}) ([]schemaViolation, error) {
+	// Round-trip through JSON so Go-typed values (ints, structs) validate like request bodies
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var instance interface{}
+	if err := json.Unmarshal(raw, &instance); err != nil {
+		return nil, err
+	}
+
+	err = schema.Validate(instance)
+	if err == nil {
+		return nil, nil
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return nil, err
+	}
+
+	var violations []schemaViolation
+	var collect func(e *jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			path := e.InstanceLocation
+			if path == "" {
+				path = "/"
+			}
+			violations = append(violations, schemaViolation{
+				Path:    path,
+				Keyword: e.KeywordLocation,
+				Message: e.Message,
+			})
+			return
+		}
+		for _, cause := range e.Causes {
+			collect(cause)
+		}
+	}
+	collect(validationErr)
+	return violations, nil
+}
+
+// validateCollectionDocument validates data against the JSON Schema of its collection, if any.
+// It returns a *schemaValidationError when the data does not match.
+func validateCollectionDocument(db *gorm.DB, projectID uint, collectionName string, data map[string]interface{}) error {
+	var collection models.Collection
+	if err := db.Where("project_id = ? AND name = ?", projectID, collectionName).First(&collection).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	schema, err := collectionJSONSchema(collection)
+	if err != nil || schema == nil {
+		return err
+	}
+
+	violations, err := validateAgainstSchema(schema, data)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &schemaValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// respondDocumentValidation writes the response for a failed document validation.
+// It returns false when err is nil and the write may proceed.
+func respondDocumentValidation(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var validationErr *schemaValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "Document does not match collection schema",
+			"violations": validationErr.Violations,
+		})
+		return true
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate document", "details": err.Error()})
+	return true
+}
+
+// UpdateCollectionSchema replaces the JSON Schema of a collection.
+// With dry_run the new schema is only checked against existing documents; without it
+// the update is refused while documents violate the schema, unless force is set.
+func (h *DataHandler) UpdateCollectionSchema(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+
+	var collection models.Collection
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, collectionName).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	var req struct {
+		Schema map[string]interface{} `json:"schema"`
+		DryRun bool                   `json:"dry_run"`
+		Force  bool                   `json:"force"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// An empty schema removes validation
+	var schema *jsonschema.Schema
+	if len(req.Schema) > 0 {
+		if isLegacySchema(req.Schema) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Legacy field maps are not enforced; use a JSON Schema such as {\"type\": \"object\", \"properties\": {...}}"})
+			return
+		}
+		compiled, err := compileJSONSchema(req.Schema)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Schema", "details": err.Error()})
+			return
+		}
+		schema = compiled
+	}
+
+	// Check existing documents against the new schema
+	var checked, violating int64
+	violations := []schemaViolation{}
+	if schema != nil {
+		var documents []models.Document
+		result := h.db.Where("project_id = ? AND collection_name = ?", project.ID, collectionName).
+			FindInBatches(&documents, schemaDryRunBatchSize, func(tx *gorm.DB, batch int) error {
+				for _, document := range documents {
+					checked++
+					found, err := validateAgainstSchema(schema, document.Data)
+					if err != nil {
+						return err
+					}
+					if len(found) == 0 {
+						continue
+					}
+					violating++
+					for _, violation := range found {
+						if len(violations) >= schemaDryRunMaxViolations {
+							break
+						}
+						violation.ID = document.ID
+						violations = append(violations, violation)
+					}
+				}
+				return nil
+			})
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing documents"})
+			return
+		}
+	}
+
+	report := gin.H{
+		"checked":              checked,
+		"violating":            violating,
+		"violations":           violations,
+		"violations_truncated": len(violations) >= schemaDryRunMaxViolations,
+	}
+
+	if req.DryRun {
+		report["applied"] = false
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	if violating > 0 && !req.Force {
+		report["applied"] = false
+		report["error"] = "Existing documents violate the new schema (use force to apply anyway)"
+		c.JSON(http.StatusConflict, report)
+		return
+	}
+
+	collection.Schema = req.Schema
+	collection.LastModified = time.Now()
+	if err := h.db.Model(&collection).Select("schema", "last_modified").Updates(&collection).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collection schema"})
+		return
+	}
+	collectionSchemas.Delete(collection.ID)
+
+	report["applied"] = true
+	c.JSON(http.StatusOK, report)
+}
+
+// AdminUpdateCollectionSchema updates a collection schema via admin interface (JWT authenticated)
+func (h *DataHandler) AdminUpdateCollectionSchema(c *gin.Context) {
+	projectID := c.Param("id")
+
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+
+	// Call the regular UpdateCollectionSchema method
+	h.UpdateCollectionSchema(c)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIsJSONSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   bool
+	}{
+		{"empty", `{}`, false},
+		{"legacy field map", `{"title": {"type": "string", "required": true}, "priority": {"type": "number", "min": 1}}`, false},
+		{"object schema", `{"type": "object", "properties": {"title": {"type": "string"}}}`, true},
+		{"required only", `{"required": ["title"]}`, true},
+		{"root array", `{"type": "array", "items": {"type": "string"}}`, true},
+		{"$schema only", `{"$schema": "https://json-schema.org/draft/2020-12/schema"}`, true},
+		{"composition", `{"anyOf": [{"required": ["a"]}, {"required": ["b"]}]}`, true},
+		{"field without a type", `{"title": {"maxLength": 10}}`, true},
+		{"field with a string value", `{"title": "string"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			if got := isJSONSchema(schema); got != tt.want {
+				t.Errorf("isJSONSchema() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAgainstSchemaEnforcesNonObjectSchemas(t *testing.T) {
+	schema, err := compileJSONSchema(map[string]interface{}{"required": []interface{}{"title"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := validateAgainstSchema(schema, map[string]interface{}{"body": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) == 0 {
+		t.Error("expected a violation for the missing required field")
+	}
+
+	violations, err = validateAgainstSchema(schema, map[string]interface{}{"title": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Errorf("unexpected violations: %+v", violations)
+	}
+}
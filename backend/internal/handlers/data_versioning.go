@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Patch media types
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	errDocumentNotFound    = errors.New("document not found")
+	errDocumentVersion     = errors.New("document version does not match")
+	errInvalidPrecondition = errors.New("invalid If-Match or expected_version")
+	errUnsupportedPatch    = errors.New("unsupported patch media type (use application/merge-patch+json or application/json-patch+json)")
+)
+
+// documentPatchError wraps failures applying a patch to the current document data
+type documentPatchError struct {
+	err error
+}
+
+func (e *documentPatchError) Error() string {
+	return e.err.Error()
+}
+
+// documentETag returns the entity tag for a document version
+func documentETag(version int) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// etagListMatches reports whether an If-None-Match header matches etag. The header is * or
+// a comma-separated list of entity tags, compared weakly as RFC 9110 requires.
+func etagListMatches(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// documentPrecondition returns the document versions the client expects, from an If-Match
+// header or the expected_version query parameter. nil means no precondition; an empty
+// slice (If-Match: *) only requires the document to exist.
+func documentPrecondition(c *gin.Context) ([]int, error) {
+	if ifMatch := strings.TrimSpace(c.GetHeader("If-Match")); ifMatch != "" {
+		if ifMatch == "*" {
+			return []int{}, nil
+		}
+
+		var versions []int
+		for _, tag := range strings.Split(ifMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			version, err := strconv.Atoi(strings.Trim(tag, "\""))
+			if err != nil {
+				return nil, errInvalidPrecondition
+			}
+			versions = append(versions, version)
+		}
+		return versions, nil
+	}
+
+	if expected := c.Query("expected_version"); expected != "" {
+		version, err := strconv.Atoi(expected)
+		if err != nil {
+			return nil, errInvalidPrecondition
+		}
+		return []int{version}, nil
+	}
+
+	return nil, nil
+}
+
+// lockDocument loads a document with a row lock inside tx and checks the expected versions
+func lockDocument(tx *gorm.DB, projectID uint, collectionName, documentID string, expected []int) (models.Document, error) {
+	var document models.Document
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("project_id = ? AND collection_name = ? AND id = ?", projectID, collectionName, documentID).
+		First(&document).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return document, errDocumentNotFound
+		}
+		return document, err
+	}
+
+	if len(expected) > 0 {
+		for _, version := range expected {
+			if version == document.Version {
+				return document, nil
+			}
+		}
+		return document, errDocumentVersion
+	}
+	return document, nil
+}
+
+// respondDocumentLockError writes the response for a failed lockDocument call
+func respondDocumentLockError(c *gin.Context, document models.Document, err error) {
+	switch {
+	case errors.Is(err, errDocumentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+	case errors.Is(err, errDocumentVersion):
+		c.Header("ETag", documentETag(document.Version))
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"error":           "Document has been modified",
+			"current_version": document.Version,
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load document"})
+	}
+}
+
+// sanitizeDocumentData removes fields that are stored separately or potentially dangerous
+func sanitizeDocumentData(data map[string]interface{}) {
+	delete(data, "id")
+	delete(data, "_sql")
+	delete(data, "__proto__")
+	delete(data, "constructor")
+}
+
+// writeDocumentVersion replaces the data of a document under optimistic concurrency control.
+// mutate receives the current data and returns the new data; the version is bumped by one.
+func (h *DataHandler) writeDocumentVersion(c *gin.Context, projectID uint, collectionName, documentID, author string,
+	mutate func(current map[string]interface{}) (map[string]interface{}, error)) {
+	expected, err := documentPrecondition(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := h.db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			log.Printf("Panic in writeDocumentVersion: %v", r)
+		}
+	}()
+
+	document, err := lockDocument(tx, projectID, collectionName, documentID, expected)
+	if err != nil {
+		tx.Rollback()
+		respondDocumentLockError(c, document, err)
+		return
+	}
+
+	data, err := mutate(document.Data)
+	if err != nil {
+		tx.Rollback()
+		var patchErr *documentPatchError
+		if errors.As(err, &patchErr) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to apply patch", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate document size
+	if len(data) > 100 {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Document too large (max 100 fields)"})
+		return
+	}
+	sanitizeDocumentData(data)
+
+	// Validate against the collection JSON Schema
+	if err := validateCollectionDocument(tx, projectID, collectionName, data); err != nil {
+		tx.Rollback()
+		respondDocumentValidation(c, err)
+		return
+	}
+
+	document.Data = data
+	document.Author = author
+	document.Version++
+	if err := tx.Model(&document).Select("data", "author", "version", "updated_at").Updates(&document).Error; err != nil {
+		tx.Rollback()
+		if respondUniqueIndexViolation(c, h.db, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update document"})
+		return
+	}
+
+	if err := recordDocumentRevision(tx, document, revisionUpdate, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
+
+	// Update collection stats in same transaction
+	if err := h.updateCollectionStatsInTx(tx, projectID, collectionName); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collection stats"})
+		return
+	}
+
+	tx.Commit()
+
+	c.Header("ETag", documentETag(document.Version))
+	c.JSON(http.StatusOK, document)
+}
+
+// readDocumentPatch parses a PATCH body into a mutate function for writeDocumentVersion.
+// application/json-patch+json is an RFC 6902 patch; application/merge-patch+json and plain
+// application/json are RFC 7396 merge patches.
+func readDocumentPatch(c *gin.Context) (func(current map[string]interface{}) (map[string]interface{}, error), error) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body")
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch mediaType {
+	case jsonPatchContentType:
+		var operations []utils.JSONPatchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			return nil, fmt.Errorf("invalid JSON Patch document")
+		}
+		return func(current map[string]interface{}) (map[string]interface{}, error) {
+			patched, err := utils.ApplyJSONPatch(current, operations)
+			if err != nil {
+				return nil, &documentPatchError{err: err}
+			}
+			data, ok := patched.(map[string]interface{})
+			if !ok {
+				return nil, &documentPatchError{err: fmt.Errorf("patched document must be an object")}
+			}
+			return data, nil
+		}, nil
+	case mergePatchContentType, "application/json", "":
+	default:
+		return nil, errUnsupportedPatch
+	}
+
+	var patch map[string]interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return nil, fmt.Errorf("invalid JSON Merge Patch document (must be an object)")
+	}
+	return func(current map[string]interface{}) (map[string]interface{}, error) {
+		return utils.ApplyMergePatch(current, patch).(map[string]interface{}), nil
+	}, nil
+}
+
+// respondDocumentPatchError writes the response for an unreadable PATCH body
+func respondDocumentPatchError(c *gin.Context, err error) {
+	if errors.Is(err, errUnsupportedPatch) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// PatchDocument partially updates a document with a JSON Merge Patch or JSON Patch
+func (h *DataHandler) PatchDocument(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	collectionName := c.Param("collection")
+	documentID := c.Param("id")
+
+	mutate, err := readDocumentPatch(c)
+	if err != nil {
+		respondDocumentPatchError(c, err)
+		return
+	}
+
+	// Get API key info for author
+	apiKey := c.MustGet("api_key").(models.APIKey)
+	author := fmt.Sprintf("api_key:%s", apiKey.Name)
+
+	h.writeDocumentVersion(c, project.ID, collectionName, documentID, author, mutate)
+}
+
+// AdminPatchDocument partially updates a document via admin interface (JWT authenticated)
+func (h *DataHandler) AdminPatchDocument(c *gin.Context) {
+	var project models.Project
+	if err := h.db.Where("id = ?", c.Param("id")).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	mutate, err := readDocumentPatch(c)
+	if err != nil {
+		respondDocumentPatchError(c, err)
+		return
+	}
+
+	// For admin interface, use admin as author
+	h.writeDocumentVersion(c, project.ID, c.Param("collection"), c.Param("document_id"), "admin:jwt", mutate)
+}
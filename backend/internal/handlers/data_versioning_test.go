@@ -0,0 +1,27 @@
+package handlers
+
+import "testing"
+
+func TestETagListMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"12"`, true},
+		{`*`, true},
+		{` "3", "12" `, true},
+		{`W/"12"`, true},
+		{`"1", "2"`, false},
+		{`"112"`, false},
+		{`"12x"`, false},
+		{`12`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := etagListMatches(tt.header, documentETag(12)); got != tt.want {
+				t.Errorf("etagListMatches(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
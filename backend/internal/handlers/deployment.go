@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -20,6 +21,8 @@ type DeploymentHandler struct {
 	db                *gorm.DB
 	cfg               *config.Config
 	deploymentService *services.DeploymentService
+	webhookService    *services.WebhookService
+	jobs              *services.JobQueue
 }
 
 // NewDeploymentHandler creates a new deployment handler
@@ -28,6 +31,8 @@ func NewDeploymentHandler(db *gorm.DB, cfg *config.Config) *DeploymentHandler {
 		db:                db, 
 		cfg:               cfg,
 		deploymentService: services.NewDeploymentService(db, cfg),
+		webhookService:    services.NewWebhookService(db, cfg),
+		jobs:              services.NewJobQueue(db, cfg),
 	}
 }
 
@@ -412,12 +417,18 @@ func (h *DeploymentHandler) Deploy(c *gin.Context) {
 		return
 	}
 
-	// Start real deployment process in background
-	go h.executeRealDeployment(deployment, req.CommitHash, req.Branch)
+	// Queue real deployment process; it runs after earlier deployments of the same target
+	job := services.NewDeploymentJob(deployment, false, req.CommitHash, req.Branch)
+	if err := h.jobs.Enqueue(job); err != nil {
+		h.db.Model(&deployment).Update("status", "failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue deployment"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Deployment started",
 		"status":  "pending",
+		"job":     job,
 	})
 }
 
@@ -562,7 +573,7 @@ func (h *DeploymentHandler) GetStatus(c *gin.Context) {
 		}
 	case "deployed":
 		progress = 100
-	case "failed":
+	case "failed", "cancelled":
 		progress = 100
 	}
 
@@ -578,15 +589,71 @@ func (h *DeploymentHandler) GetStatus(c *gin.Context) {
 	})
 }
 
-// executeRealDeployment performs a real deployment using the deployment service
-func (h *DeploymentHandler) executeRealDeployment(deployment models.Deployment, commitHash, branch string) {
-	// Execute real deployment
-	result := h.deploymentService.ExecuteDeployment(deployment, commitHash, branch)
-	
-	// If deployment failed and we don't have detailed logs, add generic error
-	if !result.Success && result.ErrorLogs == "" {
-		result.ErrorLogs = "Deployment failed with unknown error"
+// CancelDeployment cancels the queued and running jobs of a deployment. Running deployments
+// stop within seconds, their SSH sessions closed
+func (h *DeploymentHandler) CancelDeployment(c *gin.Context) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	deploymentID, err := strconv.ParseUint(c.Param("deployment_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deployment ID"})
+		return
+	}
+
+	var deployment models.Deployment
+	if err := h.db.Where("id = ? AND project_id = ?", uint(deploymentID), uint(projectID)).First(&deployment).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Deployment not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deployment"})
+		}
+		return
+	}
+
+	jobs, err := h.jobs.CancelJobs(deployment.ProjectID, services.DeploymentLockKey(deployment.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel deployment"})
+		return
 	}
+	if len(jobs) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Deployment is not queued or running"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Deployment cancelled",
+		"cancelled": len(jobs),
+	})
+}
+
+// ListDeploymentJobs returns the jobs of a deployment, newest first
+func (h *DeploymentHandler) ListDeploymentJobs(c *gin.Context) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	deploymentID, err := strconv.ParseUint(c.Param("deployment_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deployment ID"})
+		return
+	}
+
+	jobs, err := h.jobs.ListJobs(uint(projectID), services.JobFilter{
+		LockKey: services.DeploymentLockKey(uint(deploymentID)),
+		Status:  c.Query("status"),
+	}, 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deployment jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobs)
 }
 
 // ExecuteCIPDeployment handles CloudBox Install Protocol deployments via API
@@ -637,38 +704,21 @@ func (h *DeploymentHandler) ExecuteCIPDeployment(c *gin.Context) {
 		return
 	}
 
-	// Start CIP deployment in background
-	go h.executeCIPDeployment(deployment, request.CommitHash, request.Branch)
+	// Queue CIP deployment; it runs after earlier deployments of the same target
+	job := services.NewDeploymentJob(deployment, true, request.CommitHash, request.Branch)
+	if err := h.jobs.Enqueue(job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue deployment"})
+		return
+	}
 
 	c.JSON(http.StatusAccepted, gin.H{
 		"message": "CloudBox Install Protocol deployment started",
 		"deployment_id": deployment.ID,
-		"status": "building",
+		"status": job.Status,
+		"job": job,
 	})
 }
 
-// executeCIPDeployment performs a CIP deployment using the remote terminal service
-func (h *DeploymentHandler) executeCIPDeployment(deployment models.Deployment, commitHash, branch string) {
-	// Execute CIP deployment with real-time logging
-	result := h.deploymentService.ExecuteCIPDeployment(deployment, commitHash, branch, func(output, logType string) {
-		// Log to console for debugging
-		fmt.Printf("[CIP:%d] %s: %s\n", deployment.ID, logType, output)
-	})
-	
-	// If deployment failed and we don't have detailed logs, add generic error
-	if !result.Success && result.ErrorLogs == "" {
-		result.ErrorLogs = "CIP deployment failed with unknown error"
-	}
-	
-	// Log deployment result for debugging
-	if result.Success {
-		fmt.Printf("CIP Deployment %d completed successfully in %dms (build: %dms, deploy: %dms)\n",
-			deployment.ID, result.BuildTime+result.DeployTime, result.BuildTime, result.DeployTime)
-	} else {
-		fmt.Printf("CIP Deployment %d failed: %s\n", deployment.ID, result.ErrorLogs)
-	}
-}
-
 // PhotoPortfolio Template Integration Functions
 
 // isPhotoPortfolioRepository checks if a repository is a PhotoPortfolio project
@@ -800,7 +850,8 @@ func containsKeyword(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
 
-// HandleWebhook handles GitHub webhook requests for automatic deployments
+// HandleWebhook handles GitHub webhook requests for automatic deployments. Deliveries must be
+// signed with the secret of the repository; each is logged, and replays are ignored
 func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 	// Get repository ID from URL parameter
 	repoID, err := strconv.ParseUint(c.Param("repo_id"), 10, 32)
@@ -820,26 +871,21 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 		return
 	}
 
+	eventType := c.GetHeader("X-GitHub-Event")
+	deliveryID := c.GetHeader("X-GitHub-Delivery")
+
 	// Log webhook details for debugging
 	fmt.Printf("=== WEBHOOK RECEIVED ===\n")
 	fmt.Printf("Repository ID: %d\n", repoID)
 	fmt.Printf("Repository Name: %s\n", repository.Name)
 	fmt.Printf("Project ID: %d\n", repository.ProjectID)
 	fmt.Printf("Content-Type: %s\n", c.GetHeader("Content-Type"))
-	fmt.Printf("X-GitHub-Event: %s\n", c.GetHeader("X-GitHub-Event"))
-	fmt.Printf("X-Hub-Signature-256: %s\n", c.GetHeader("X-Hub-Signature-256"))
+	fmt.Printf("X-GitHub-Event: %s\n", eventType)
+	fmt.Printf("X-GitHub-Delivery: %s\n", deliveryID)
 	fmt.Printf("User-Agent: %s\n", c.GetHeader("User-Agent"))
 
-	// Check if this is a push or ping event first (before parsing JSON)
-	eventType := c.GetHeader("X-GitHub-Event")
-	if eventType != "push" && eventType != "ping" {
-		// Only handle push and ping events for now
-		fmt.Printf("Event ignored: %s\n", eventType)
-		c.JSON(http.StatusOK, gin.H{"message": "Event ignored", "event": eventType})
-		return
-	}
-
-	// Read raw body for debugging
+	// Read the raw body, which the signature covers
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxWebhookPayloadSize)
 	body, err := c.GetRawData()
 	if err != nil {
 		fmt.Printf("Failed to read webhook body: %v\n", err)
@@ -847,6 +893,58 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 		return
 	}
 
+	// Verify the signature before anything in the payload is trusted
+	secret, err := h.webhookService.Secret(&repository)
+	if err != nil {
+		fmt.Printf("Failed to load webhook secret: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook secret"})
+		return
+	}
+	if err := services.VerifyWebhookSignature(secret, body, c.GetHeader("X-Hub-Signature-256")); err != nil {
+		message := "Missing or invalid webhook signature"
+		if secret == "" {
+			message = "Repository has no webhook secret; generate one and configure it on GitHub"
+		}
+		fmt.Printf("Webhook rejected: %s\n", message)
+		h.webhookService.RejectDelivery(repository, deliveryID, eventType, body, http.StatusUnauthorized, message)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+		return
+	}
+
+	delivery, err := h.webhookService.ReceiveDelivery(repository, deliveryID, eventType, body)
+	if err != nil {
+		if errors.Is(err, services.ErrWebhookDuplicate) {
+			fmt.Printf("Duplicate webhook delivery ignored: %s\n", deliveryID)
+			c.JSON(http.StatusOK, gin.H{"message": "Duplicate delivery ignored", "delivery_id": deliveryID})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log webhook delivery"})
+		return
+	}
+
+	status, code, response := h.processWebhook(repository, eventType, body)
+	h.webhookService.FinishDelivery(delivery, status, code, webhookResponseMessage(response))
+
+	c.JSON(code, response)
+}
+
+// webhookResponseMessage returns the message or error of a webhook response
+func webhookResponseMessage(response gin.H) string {
+	if message, ok := response["message"].(string); ok {
+		return message
+	}
+	message, _ := response["error"].(string)
+	return message
+}
+
+// processWebhook handles a verified delivery, returning its outcome and the response to it
+func (h *DeploymentHandler) processWebhook(repository models.GitHubRepository, eventType string, body []byte) (string, int, gin.H) {
+	// Only handle push and ping events for now
+	if eventType != "push" && eventType != "ping" {
+		fmt.Printf("Event ignored: %s\n", eventType)
+		return services.WebhookDeliveryIgnored, http.StatusOK, gin.H{"message": "Event ignored", "event": eventType}
+	}
+
 	fmt.Printf("Webhook body length: %d bytes\n", len(body))
 	if len(body) > 0 {
 		previewLen := 200
@@ -864,19 +962,10 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 	} else {
 		if err := json.Unmarshal(body, &payload); err != nil {
 			fmt.Printf("Failed to parse webhook JSON: %v\n", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload", "details": err.Error()})
-			return
+			return services.WebhookDeliveryFailed, http.StatusBadRequest, gin.H{"error": "Invalid JSON payload", "details": err.Error()}
 		}
 	}
 
-	// Verify webhook secret if provided
-	webhookSecret := c.GetHeader("X-Hub-Signature-256")
-	if webhookSecret != "" {
-		// In a full implementation, verify the webhook signature here
-		// For now, we'll just acknowledge the webhook
-		fmt.Printf("Webhook signature provided but not verified\n")
-	}
-
 	// Handle ping events specially (for webhook testing)
 	if eventType == "ping" {
 		fmt.Printf("Handling ping event - creating test notification\n")
@@ -888,13 +977,12 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 			fmt.Printf("✅ PING NOTIFICATION SENT SUCCESSFULLY\n")
 		}
 		
-		c.JSON(http.StatusOK, gin.H{
+		return services.WebhookDeliveryProcessed, http.StatusOK, gin.H{
 			"message": "Ping webhook processed successfully",
 			"repository_id": repository.ID,
 			"repository_name": repository.Name,
 			"event_type": "ping",
-		})
-		return
+		}
 	}
 	
 	// Extract commit information from payload with fallbacks (for push events)
@@ -925,12 +1013,11 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 	// Check if the branch matches the repository's configured branch
 	if branch != "" && branch != repository.Branch {
 		fmt.Printf("Branch mismatch: got %s, expected %s\n", branch, repository.Branch)
-		c.JSON(http.StatusOK, gin.H{
+		return services.WebhookDeliveryIgnored, http.StatusOK, gin.H{
 			"message": "Branch ignored", 
 			"branch": branch,
 			"configured_branch": repository.Branch,
-		})
-		return
+		}
 	}
 
 	// Update repository with pending commit information
@@ -942,8 +1029,7 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 	}
 	
 	if err := h.db.Model(&repository).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update repository status"})
-		return
+		return services.WebhookDeliveryFailed, http.StatusInternalServerError, gin.H{"error": "Failed to update repository status"}
 	}
 
 	// Send notification to project owner about available update
@@ -957,7 +1043,7 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 		fmt.Printf("✅ NOTIFICATION SENT SUCCESSFULLY\n")
 	}
 
-	response := gin.H{
+	return services.WebhookDeliveryProcessed, http.StatusOK, gin.H{
 		"message": "Webhook processed successfully",
 		"repository_id": repository.ID,
 		"repository_name": repository.Name,
@@ -966,9 +1052,117 @@ func (h *DeploymentHandler) HandleWebhook(c *gin.Context) {
 		"has_pending_update": true,
 		"event_type": eventType,
 	}
+}
 
-	fmt.Printf("Webhook response: %+v\n", response)
-	c.JSON(http.StatusOK, response)
+// ListWebhookDeliveries returns the latest webhook deliveries of a repository
+func (h *DeploymentHandler) ListWebhookDeliveries(c *gin.Context) {
+	projectID, repoID, _, ok := parseWebhookDeliveryIDs(c, false)
+	if !ok {
+		return
+	}
+
+	limit := 50
+	if value, err := strconv.Atoi(c.Query("limit")); err == nil && value > 0 && value <= 200 {
+		limit = value
+	}
+
+	deliveries, err := h.webhookService.ListDeliveries(projectID, repoID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// GetWebhookDelivery returns a webhook delivery with its payload
+func (h *DeploymentHandler) GetWebhookDelivery(c *gin.Context) {
+	projectID, repoID, deliveryID, ok := parseWebhookDeliveryIDs(c, true)
+	if !ok {
+		return
+	}
+
+	delivery, err := h.webhookService.GetDelivery(projectID, repoID, deliveryID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook delivery not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook delivery"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+// RedeliverWebhook handles a verified webhook delivery again, logging it as a redelivery
+func (h *DeploymentHandler) RedeliverWebhook(c *gin.Context) {
+	projectID, repoID, deliveryID, ok := parseWebhookDeliveryIDs(c, true)
+	if !ok {
+		return
+	}
+
+	var repository models.GitHubRepository
+	if err := h.db.Where("id = ? AND project_id = ?", repoID, projectID).First(&repository).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "GitHub repository not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch GitHub repository"})
+		}
+		return
+	}
+
+	original, err := h.webhookService.GetDelivery(projectID, repoID, deliveryID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook delivery not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook delivery"})
+		}
+		return
+	}
+	// Rejected deliveries were never trusted, so their payloads are not kept
+	if original.Status == services.WebhookDeliveryRejected {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rejected deliveries cannot be redelivered"})
+		return
+	}
+
+	delivery, err := h.webhookService.Redeliver(*original)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log webhook redelivery"})
+		return
+	}
+	status, code, response := h.processWebhook(repository, original.Event, []byte(original.Payload))
+	h.webhookService.FinishDelivery(delivery, status, code, webhookResponseMessage(response))
+
+	c.JSON(http.StatusOK, gin.H{
+		"delivery": delivery,
+		"response": response,
+	})
+}
+
+// parseWebhookDeliveryIDs parses the project and repository IDs of a webhook delivery route,
+// and the delivery ID if withDelivery is set
+func parseWebhookDeliveryIDs(c *gin.Context, withDelivery bool) (uint, uint, uint, bool) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return 0, 0, 0, false
+	}
+	repoID, err := strconv.ParseUint(c.Param("repo_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid repository ID"})
+		return 0, 0, 0, false
+	}
+	if !withDelivery {
+		return uint(projectID), uint(repoID), 0, true
+	}
+	deliveryID, err := strconv.ParseUint(c.Param("delivery_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return 0, 0, 0, false
+	}
+	return uint(projectID), uint(repoID), uint(deliveryID), true
 }
 
 // sendUpdateNotification sends a notification message to the project owner about available updates
@@ -1231,8 +1425,11 @@ func (h *DeploymentHandler) DeployPendingUpdate(c *gin.Context) {
 	// Start deployments for all associated deployments
 	deployedCount := 0
 	for _, deployment := range deployments {
-		// Start deployment in background
-		go h.executeRealDeployment(deployment, repository.PendingCommitHash, repository.PendingCommitBranch)
+		// Queue deployment to run in background
+		if err := h.jobs.Enqueue(services.NewDeploymentJob(deployment, false, repository.PendingCommitHash, repository.PendingCommitBranch)); err != nil {
+			fmt.Printf("Failed to queue deployment %d: %v\n", deployment.ID, err)
+			continue
+		}
 		deployedCount++
 	}
 
@@ -11,7 +11,9 @@ import (
 
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/execution"
+	"github.com/cloudbox/backend/internal/middleware"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -22,6 +24,8 @@ type FunctionHandler struct {
 	db       *gorm.DB
 	cfg      *config.Config
 	executor *execution.ExecutionEngine
+	quotas   *services.QuotaService
+	jobs     *services.JobQueue
 }
 
 // NewFunctionHandler creates a new function handler
@@ -37,6 +41,8 @@ func NewFunctionHandler(db *gorm.DB, cfg *config.Config) *FunctionHandler {
 		db:       db,
 		cfg:      cfg,
 		executor: executor,
+		quotas:   services.NewQuotaService(db, cfg),
+		jobs:     services.NewJobQueue(db, cfg),
 	}
 }
 
@@ -339,18 +345,24 @@ func (h *FunctionHandler) DeployFunction(c *gin.Context) {
 		return
 	}
 
-	// Start deployment asynchronously (in real implementation, this would be a background job)
-	go h.realDeployment(function)
-
 	// Update status to building
 	h.db.Model(&function).Updates(map[string]interface{}{
 		"status": "building",
 		"build_logs": "Starting function deployment...\n",
 	})
 
+	// Queue build; builds of the same function run one after the other
+	job := services.NewFunctionBuildJob(function)
+	if err := h.jobs.Enqueue(job); err != nil {
+		h.db.Model(&function).Update("status", "error")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue function deployment"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Function deployment started",
 		"status":  "building",
+		"job":     job,
 	})
 }
 
@@ -374,6 +386,12 @@ func (h *FunctionHandler) ExecuteFunction(c *gin.Context) {
 		return
 	}
 
+	var project models.Project
+	if err := h.db.Where("id = ?", uint(projectID)).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
 	// Find the function
 	var function models.Function
 	if err := h.db.Where("id = ? AND project_id = ? AND is_active = ?", uint(functionID), uint(projectID), true).First(&function).Error; err != nil {
@@ -390,6 +408,10 @@ func (h *FunctionHandler) ExecuteFunction(c *gin.Context) {
 		return
 	}
 
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaFunctionGBSeconds, 0)) {
+		return
+	}
+
 	// Execute function using real execution engine
 	executionID := uuid.New().String()
 	startTime := time.Now()
@@ -408,6 +430,9 @@ func (h *FunctionHandler) ExecuteFunction(c *gin.Context) {
 	defer cancel()
 
 	result, err := h.executor.Execute(ctx, execReq)
+	if err := h.quotas.RecordFunctionExecution(function.ProjectID, function.Memory, time.Since(startTime)); err != nil {
+		fmt.Printf("Failed to meter execution: %v\n", err)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Execution failed: %v", err)})
 		return
@@ -472,19 +497,14 @@ func (h *FunctionHandler) ExecuteFunction(c *gin.Context) {
 // ExecuteFunctionByName executes a function by name (public API route)
 func (h *FunctionHandler) ExecuteFunctionByName(c *gin.Context) {
 	// Extract project from middleware (set by ProjectAuth middleware)
-	project, exists := c.Get("project")
+	value, exists := c.Get("project")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Project authentication required"})
 		return
 	}
+	project := value.(models.Project)
 
-	projectData, ok := project.(map[string]interface{})
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid project data"})
-		return
-	}
-
-	projectID := uint(projectData["id"].(float64))
+	projectID := project.ID
 	functionName := c.Param("function_name")
 
 	// Parse request body for data (optional)
@@ -554,6 +574,10 @@ func (h *FunctionHandler) ExecuteFunctionByName(c *gin.Context) {
 		return
 	}
 
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaFunctionGBSeconds, 0)) {
+		return
+	}
+
 	// Execute function using real execution engine
 	executionID := uuid.New().String()
 	startTime := time.Now()
@@ -572,6 +596,9 @@ func (h *FunctionHandler) ExecuteFunctionByName(c *gin.Context) {
 	defer cancel()
 
 	result, err := h.executor.Execute(ctx, execReq)
+	if err := h.quotas.RecordFunctionExecution(function.ProjectID, function.Memory, time.Since(startTime)); err != nil {
+		fmt.Printf("Failed to meter execution: %v\n", err)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Execution failed: %v", err)})
 		return
@@ -660,32 +687,4 @@ func (h *FunctionHandler) GetFunctionLogs(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, executions)
-}
-
-// realDeployment implements real function deployment
-func (h *FunctionHandler) realDeployment(function models.Function) {
-	// Update status to building
-	h.db.Model(&function).Updates(map[string]interface{}{
-		"status": "building",
-		"build_logs": "Starting function deployment...\n" +
-			"Installing dependencies...\n" +
-			"Building function package...\n",
-	})
-
-	// For now, we'll simulate the deployment process
-	// In a full implementation, this would:
-	// 1. Install dependencies based on function.Dependencies
-	// 2. Build the function package
-	// 3. Deploy to a container registry or function runtime
-	// 4. Set up networking and scaling rules
-	
-	time.Sleep(3 * time.Second) // Simulate build time
-	
-	now := time.Now()
-	h.db.Model(&function).Updates(map[string]interface{}{
-		"status":            "deployed",
-		"last_deployed_at":  &now,
-		"build_logs":        "Starting function deployment...\nInstalling dependencies...\nBuilding function package...\nBuild completed successfully!\n",
-		"deployment_logs":   "Deploying function...\nFunction deployed and ready to receive requests!\n",
-	})
 }
\ No newline at end of file
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -26,7 +27,8 @@ import (
 type GitHubHandler struct {
 	db            *gorm.DB
 	cfg           *config.Config
-	githubService *services.GitHubService
+	githubService  *services.GitHubService
+	webhookService *services.WebhookService
 }
 
 // NewGitHubHandler creates a new GitHub handler
@@ -34,7 +36,8 @@ func NewGitHubHandler(db *gorm.DB, cfg *config.Config) *GitHubHandler {
 	return &GitHubHandler{
 		db:            db,
 		cfg:           cfg,
-		githubService: services.NewGitHubService(db),
+		githubService:  services.NewGitHubService(db),
+		webhookService: services.NewWebhookService(db, cfg),
 	}
 }
 
@@ -155,13 +158,6 @@ func (h *GitHubHandler) CreateGitHubRepository(c *gin.Context) {
 		req.StartCommand = "npm start"
 	}
 
-	// Generate webhook secret
-	webhookSecret, err := h.generateWebhookSecret()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
-		return
-	}
-
 	// Create GitHub repository record
 	repository := models.GitHubRepository{
 		Name:          req.Name,
@@ -170,7 +166,6 @@ func (h *GitHubHandler) CreateGitHubRepository(c *gin.Context) {
 		Branch:        req.Branch,
 		IsPrivate:     req.IsPrivate,
 		Description:   req.Description,
-		WebhookSecret: webhookSecret,
 		SSHKeyID:      req.SSHKeyID,
 		SDKVersion:    req.SDKVersion,
 		AppPort:       req.AppPort,
@@ -181,6 +176,12 @@ func (h *GitHubHandler) CreateGitHubRepository(c *gin.Context) {
 		IsActive:      true,
 	}
 
+	// Generate webhook secret; without a master key it is generated once one is configured
+	if _, err := h.webhookService.NewSecret(&repository); err != nil && !errors.Is(err, services.ErrWebhookSecretUnavailable) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+		return
+	}
+
 	if err := h.db.Create(&repository).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create GitHub repository"})
 		return
@@ -427,18 +428,78 @@ func (h *GitHubHandler) GetWebhookInfo(c *gin.Context) {
 		return
 	}
 
-	// Generate webhook URL
-	webhookURL := fmt.Sprintf("%s/api/v1/deploy/webhook/%d", h.cfg.BaseURL, repository.ID)
+	// Repositories added without a secret get one now
+	secret, err := h.webhookService.Secret(&repository)
+	if err == nil && secret == "" {
+		if secret, err = h.webhookService.NewSecret(&repository); err == nil {
+			err = h.db.Model(&repository).Update("webhook_secret", repository.WebhookSecret).Error
+		}
+	}
+	if err != nil {
+		if errors.Is(err, services.ErrWebhookSecretUnavailable) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load webhook secret"})
+		}
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"webhook_url":    webhookURL,
-		"webhook_secret": repository.WebhookSecret,
+	c.JSON(http.StatusOK, h.webhookInfo(repository, secret))
+}
+
+// RotateWebhookSecret replaces the webhook secret of a repository; deliveries signed with the
+// old one are rejected from then on, so the webhook on GitHub must be updated
+func (h *GitHubHandler) RotateWebhookSecret(c *gin.Context) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	repoID, err := strconv.ParseUint(c.Param("repo_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid repository ID"})
+		return
+	}
+
+	var repository models.GitHubRepository
+	if err := h.db.Where("id = ? AND project_id = ?", uint(repoID), uint(projectID)).First(&repository).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "GitHub repository not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch GitHub repository"})
+		}
+		return
+	}
+
+	secret, err := h.webhookService.NewSecret(&repository)
+	if err != nil {
+		if errors.Is(err, services.ErrWebhookSecretUnavailable) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+		}
+		return
+	}
+	if err := h.db.Model(&repository).Update("webhook_secret", repository.WebhookSecret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store webhook secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.webhookInfo(repository, secret))
+}
+
+// webhookInfo describes how to configure the webhook of a repository on GitHub
+func (h *GitHubHandler) webhookInfo(repository models.GitHubRepository, secret string) gin.H {
+	return gin.H{
+		"webhook_url":    fmt.Sprintf("%s/api/v1/deploy/webhook/%d", h.cfg.BaseURL, repository.ID),
+		"webhook_secret": secret,
 		"events": []string{
 			"push",
 			"pull_request",
 		},
 		"content_type": "application/json",
-	})
+	}
 }
 
 // ValidateRepository validates if a GitHub repository exists and is accessible
@@ -1184,15 +1245,6 @@ func containsIgnoreCase(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
 
-// generateWebhookSecret generates a random webhook secret
-func (h *GitHubHandler) generateWebhookSecret() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(bytes), nil
-}
-
 // parseGitHubURL extracts owner and repo from GitHub URL
 func (h *GitHubHandler) parseGitHubURL(repoURL string) (owner, repo string, err error) {
 	// Handle various GitHub URL formats:
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// JobHandler handles the background jobs of projects: deployments, backups and function builds
+type JobHandler struct {
+	db   *gorm.DB
+	cfg  *config.Config
+	jobs *services.JobQueue
+}
+
+// NewJobHandler creates a new job handler
+func NewJobHandler(db *gorm.DB, cfg *config.Config) *JobHandler {
+	return &JobHandler{
+		db:   db,
+		cfg:  cfg,
+		jobs: services.NewJobQueue(db, cfg),
+	}
+}
+
+// parseJobIDs parses the project ID and, when asked for, the job ID
+func parseJobIDs(c *gin.Context, withJob bool) (uint, uint, bool) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return 0, 0, false
+	}
+	if !withJob {
+		return uint(projectID), 0, true
+	}
+	jobID, err := strconv.ParseUint(c.Param("job_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return 0, 0, false
+	}
+	return uint(projectID), uint(jobID), true
+}
+
+// ListJobs returns the jobs of a project, newest first, optionally of a type or status
+func (h *JobHandler) ListJobs(c *gin.Context) {
+	projectID, _, ok := parseJobIDs(c, false)
+	if !ok {
+		return
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = parsed
+	}
+
+	jobs, err := h.jobs.ListJobs(projectID, services.JobFilter{
+		Type:   c.Query("type"),
+		Status: c.Query("status"),
+	}, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GetJob returns a job of a project
+func (h *JobHandler) GetJob(c *gin.Context) {
+	projectID, jobID, ok := parseJobIDs(c, true)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.GetJob(projectID, jobID)
+	if err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch job"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// CancelJob cancels a queued or running job of a project. Running jobs stop within seconds
+func (h *JobHandler) CancelJob(c *gin.Context) {
+	projectID, jobID, ok := parseJobIDs(c, true)
+	if !ok {
+		return
+	}
+
+	job, err := h.jobs.CancelJob(projectID, jobID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrJobNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		case errors.Is(err, services.ErrJobFinished):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Job cancelled",
+		"job":     job,
+	})
+}
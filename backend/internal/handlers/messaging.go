@@ -8,6 +8,7 @@ import (
 
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -17,19 +18,22 @@ import (
 type MessagingHandler struct {
 	db  *gorm.DB
 	cfg *config.Config
+	hub *services.MessagingHub
 }
 
 // NewMessagingHandler creates a new messaging handler
 func NewMessagingHandler(db *gorm.DB, cfg *config.Config) *MessagingHandler {
-	return &MessagingHandler{db: db, cfg: cfg}
+	hub := services.NewMessagingHub(db)
+	hub.Start(cfg.DatabaseURL)
+	return &MessagingHandler{db: db, cfg: cfg, hub: hub}
 }
 
 // Channel Management
 
 // ListChannels returns all channels for a project
 func (h *MessagingHandler) ListChannels(c *gin.Context) {
-	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
+	projectID, ok := messagingProjectID(c)
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
 		return
 	}
@@ -201,6 +205,12 @@ func (h *MessagingHandler) CreateChannel(c *gin.Context) {
 		return
 	}
 	
+	if err := services.PublishMessagingEvent(tx, memberEvent(services.MessagingMemberJoined, membership)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish channel event"})
+		return
+	}
+	
 	tx.Commit()
 	c.JSON(http.StatusCreated, channel)
 }
@@ -332,6 +342,17 @@ func (h *MessagingHandler) DeleteChannel(c *gin.Context) {
 		return
 	}
 	
+	err := services.PublishMessagingEvent(tx, services.MessagingEvent{
+		Type:      services.MessagingChannelDeleted,
+		ProjectID: project.ID,
+		ChannelID: channelID,
+	})
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish channel event"})
+		return
+	}
+	
 	tx.Commit()
 	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted successfully"})
 }
@@ -436,6 +457,12 @@ func (h *MessagingHandler) JoinChannel(c *gin.Context) {
 	// Update channel member count
 	tx.Model(&channel).Update("member_count", gorm.Expr("member_count + 1"))
 	
+	if err := services.PublishMessagingEvent(tx, memberEvent(services.MessagingMemberJoined, membership)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish channel event"})
+		return
+	}
+	
 	tx.Commit()
 	c.JSON(http.StatusCreated, membership)
 }
@@ -470,6 +497,18 @@ func (h *MessagingHandler) LeaveChannel(c *gin.Context) {
 		tx.Model(&channel).Update("member_count", gorm.Expr("member_count - 1"))
 	}
 	
+	err := services.PublishMessagingEvent(tx, services.MessagingEvent{
+		Type:      services.MessagingMemberLeft,
+		ProjectID: project.ID,
+		ChannelID: channelID,
+		UserID:    userID,
+	})
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish channel event"})
+		return
+	}
+	
 	tx.Commit()
 	c.JSON(http.StatusOK, gin.H{"message": "Left channel successfully"})
 }
@@ -560,7 +599,7 @@ func (h *MessagingHandler) SendMessage(c *gin.Context) {
 	var req struct {
 		Content  string                 `json:"content" binding:"required"`
 		Type     string                 `json:"type"`
-		UserID   string                 `json:"user_id" binding:"required"`
+		UserID   string                 `json:"user_id"` // Optional; must match the session
 		ParentID *string                `json:"parent_id"`
 		Metadata map[string]interface{} `json:"metadata"`
 	}
@@ -570,6 +609,12 @@ func (h *MessagingHandler) SendMessage(c *gin.Context) {
 		return
 	}
 	
+	// The sender is the user of the session, never a user named by the client
+	user, ok := h.requestUser(c, req.UserID)
+	if !ok {
+		return
+	}
+	
 	// Verify channel exists
 	var channel models.Channel
 	if err := h.db.Where("project_id = ? AND id = ?", project.ID, channelID).First(&channel).Error; err != nil {
@@ -577,8 +622,8 @@ func (h *MessagingHandler) SendMessage(c *gin.Context) {
 		return
 	}
 	
-	// Verify user exists and is channel member
-	if !h.isChannelMember(project.ID, channelID, req.UserID) {
+	// Verify user is channel member
+	if !h.isChannelMember(project.ID, channelID, user.ID) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "User is not a member of this channel"})
 		return
 	}
@@ -615,7 +660,7 @@ func (h *MessagingHandler) SendMessage(c *gin.Context) {
 		Type:      messageType,
 		Metadata:  req.Metadata,
 		ChannelID: channelID,
-		UserID:    req.UserID,
+		UserID:    user.ID,
 		ParentID:  req.ParentID,
 		ThreadID:  threadID,
 		ProjectID: project.ID,
@@ -643,6 +688,12 @@ func (h *MessagingHandler) SendMessage(c *gin.Context) {
 			Update("reply_count", gorm.Expr("reply_count + 1"))
 	}
 	
+	if err := services.PublishMessagingEvent(tx, messageEvent(services.MessagingMessageCreated, message)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish message event"})
+		return
+	}
+	
 	tx.Commit()
 	c.JSON(http.StatusCreated, message)
 }
@@ -699,7 +750,13 @@ func (h *MessagingHandler) UpdateMessage(c *gin.Context) {
 		updates["metadata"] = req.Metadata
 	}
 	
-	if err := h.db.Model(&message).Updates(updates).Error; err != nil {
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&message).Updates(updates).Error; err != nil {
+			return err
+		}
+		return services.PublishMessagingEvent(tx, messageEvent(services.MessagingMessageUpdated, message))
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
 		return
 	}
@@ -711,17 +768,21 @@ func (h *MessagingHandler) UpdateMessage(c *gin.Context) {
 
 // DeleteMessage deletes a message (soft delete)
 func (h *MessagingHandler) DeleteMessage(c *gin.Context) {
-	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
+	projectID, ok := messagingProjectID(c)
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
 		return
 	}
 	
 	messageID := c.Param("message_id")
 	
-	// Find message
+	// Find message, within its channel when the route names one
+	query := h.db.Where("project_id = ? AND id = ?", projectID, messageID)
+	if channelID := c.Param("channel_id"); channelID != "" {
+		query = query.Where("channel_id = ?", channelID)
+	}
 	var message models.Message
-	if err := h.db.Where("project_id = ? AND id = ?", uint(projectID), messageID).First(&message).Error; err != nil {
+	if err := query.First(&message).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
 		return
 	}
@@ -734,7 +795,13 @@ func (h *MessagingHandler) DeleteMessage(c *gin.Context) {
 		"content":    "[Message deleted]",
 	}
 	
-	if err := h.db.Model(&message).Updates(updates).Error; err != nil {
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&message).Updates(updates).Error; err != nil {
+			return err
+		}
+		return services.PublishMessagingEvent(tx, messageEvent(services.MessagingMessageDeleted, message))
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
 		return
 	}
@@ -744,6 +811,41 @@ func (h *MessagingHandler) DeleteMessage(c *gin.Context) {
 
 // Helper functions
 
+// messagingProjectID returns the project of a request: the authenticated project on the
+// project API, the :id parameter on the admin API
+func messagingProjectID(c *gin.Context) (uint, bool) {
+	if project, exists := c.Get("project"); exists {
+		return project.(models.Project).ID, true
+	}
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(projectID), true
+}
+
+// messageEvent builds the realtime event of a message write
+func messageEvent(eventType string, message models.Message) services.MessagingEvent {
+	return services.MessagingEvent{
+		Type:      eventType,
+		ProjectID: message.ProjectID,
+		ChannelID: message.ChannelID,
+		UserID:    message.UserID,
+		MessageID: message.ID,
+	}
+}
+
+// memberEvent builds the realtime event of a membership change
+func memberEvent(eventType string, membership models.ChannelMember) services.MessagingEvent {
+	return services.MessagingEvent{
+		Type:      eventType,
+		ProjectID: membership.ProjectID,
+		ChannelID: membership.ChannelID,
+		UserID:    membership.UserID,
+		Data:      membership,
+	}
+}
+
 // channelExists checks if a channel exists
 func (h *MessagingHandler) channelExists(projectID uint, channelID string) bool {
 	var channel models.Channel
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Messaging gateway tuning
+const (
+	gatewayKeepAlive    = 25 * time.Second
+	gatewayWriteTimeout = 10 * time.Second
+	gatewayReadLimit    = 4096
+	typingInterval      = 2 * time.Second // Minimum delay between typing events per channel
+	typingTimeout       = 5 * time.Second // Clients drop a typing indicator after this long
+)
+
+// gatewayFrame is a WebSocket frame sent by a gateway client
+type gatewayFrame struct {
+	Type      string `json:"type"` // typing
+	ChannelID string `json:"channel_id"`
+	Typing    *bool  `json:"typing"`
+}
+
+// requestUser returns the app user a request acts as: the session of its Session-Token
+// header, or of the realtime ticket a connection was opened with. Clients used to name the
+// user in the request; such a user_id must match the session. Writes the error response.
+func (h *MessagingHandler) requestUser(c *gin.Context, claimed string) (models.AppUser, bool) {
+	project := c.MustGet("project").(models.Project)
+
+	user, err := sessionUser(h.db, project.ID, c.GetHeader("Session-Token"), c.GetString("realtime_session_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+		return user, false
+	}
+	if claimed != "" && claimed != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user_id does not match the session"})
+		return user, false
+	}
+	return user, true
+}
+
+// MessagingGateway upgrades to a WebSocket that delivers the events of every channel the
+// session's user is a member of: messages, reactions, read receipts, membership changes,
+// typing indicators and presence. Browsers authenticate with a ticket issued with their
+// Session-Token. Clients send typing frames; a resync frame tells them events were dropped
+// and channel state must be reloaded.
+func (h *MessagingHandler) MessagingGateway(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	user, ok := h.requestUser(c, "")
+	if !ok {
+		return
+	}
+
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "WebSocket upgrade required"})
+		return
+	}
+
+	var channelIDs []string
+	if err := h.db.Model(&models.ChannelMember{}).
+		Where("project_id = ? AND user_id = ? AND is_active = ?", project.ID, user.ID, true).
+		Pluck("channel_id", &channelIDs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch channels"})
+		return
+	}
+
+	conn, err := realtimeUpgrader(h.cfg, h.db, project.ID).Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade already wrote the error response
+		return
+	}
+	defer conn.Close()
+
+	subscription := h.hub.Subscribe(project.ID, user.ID, channelIDs)
+	defer h.hub.Unsubscribe(subscription)
+
+	// Events and replies to client frames are written from different goroutines
+	var writeMutex sync.Mutex
+	write := func(frame interface{}) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+		return conn.WriteJSON(frame)
+	}
+
+	done := make(chan struct{})
+	conn.SetReadLimit(gatewayReadLimit)
+	conn.SetReadDeadline(time.Now().Add(2 * gatewayKeepAlive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * gatewayKeepAlive))
+	})
+	go func() {
+		defer close(done)
+		lastTyping := make(map[string]time.Time)
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := h.handleGatewayFrame(subscription, raw, lastTyping); err != nil {
+				if write(gin.H{"type": "error", "error": err.Error()}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	err = write(gin.H{
+		"type":     "ready",
+		"user_id":  user.ID,
+		"channels": subscription.ChannelIDs(),
+	})
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(gatewayKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-subscription.Events:
+			err = write(event)
+		case <-subscription.Lagged:
+			err = write(gin.H{"type": "resync"})
+		case <-ticker.C:
+			writeMutex.Lock()
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(gatewayWriteTimeout))
+			writeMutex.Unlock()
+		}
+		if err != nil {
+			if !errors.Is(err, websocket.ErrCloseSent) {
+				log.Printf("Messaging gateway for app user %s ended: %v", user.ID, err)
+			}
+			return
+		}
+	}
+}
+
+// handleGatewayFrame processes a frame sent by a gateway client
+func (h *MessagingHandler) handleGatewayFrame(subscription *services.MessagingSubscription, raw []byte, lastTyping map[string]time.Time) error {
+	var frame gatewayFrame
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		return errors.New("frames must be JSON objects")
+	}
+
+	switch frame.Type {
+	case "typing":
+		if !subscription.IsMember(frame.ChannelID) {
+			return errors.New("not a member of this channel")
+		}
+
+		typing := frame.Typing == nil || *frame.Typing
+		if typing && time.Since(lastTyping[frame.ChannelID]) < typingInterval {
+			return nil
+		}
+		if typing {
+			lastTyping[frame.ChannelID] = time.Now()
+		} else {
+			delete(lastTyping, frame.ChannelID)
+		}
+
+		err := services.PublishMessagingEvent(h.db, services.MessagingEvent{
+			Type:      services.MessagingTyping,
+			ProjectID: subscription.ProjectID,
+			ChannelID: frame.ChannelID,
+			UserID:    subscription.UserID,
+			Data:      gin.H{"typing": typing, "expires_in": int(typingTimeout.Seconds())},
+		})
+		if err != nil {
+			log.Printf("Failed to publish typing indicator: %v", err)
+			return errors.New("failed to publish typing indicator")
+		}
+		return nil
+	default:
+		return errors.New("unsupported frame type")
+	}
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxReactionLength matches the emoji column of message_reactions
+const maxReactionLength = 100
+
+var errReactionExists = errors.New("reaction already exists")
+
+// findChannelMessage loads a message that has not been deleted from a channel
+func (h *MessagingHandler) findChannelMessage(projectID uint, channelID, messageID string) (models.Message, error) {
+	var message models.Message
+	err := h.db.Where("project_id = ? AND channel_id = ? AND id = ? AND is_deleted = ?",
+		projectID, channelID, messageID, false).First(&message).Error
+	return message, err
+}
+
+// ListReactions returns the reactions to a message
+func (h *MessagingHandler) ListReactions(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	message, err := h.findChannelMessage(project.ID, c.Param("channel_id"), c.Param("message_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	var reactions []models.MessageReaction
+	if err := h.db.Where("project_id = ? AND message_id = ?", project.ID, message.ID).
+		Order("created_at").Find(&reactions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reactions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reactions)
+}
+
+// AddReaction adds a user's reaction to a message
+func (h *MessagingHandler) AddReaction(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	channelID := c.Param("channel_id")
+
+	var req struct {
+		UserID string `json:"user_id"` // Optional; must match the session
+		Emoji  string `json:"emoji" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := h.requestUser(c, req.UserID)
+	if !ok {
+		return
+	}
+
+	if utf8.RuneCountInString(req.Emoji) > maxReactionLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reaction is too long"})
+		return
+	}
+
+	message, err := h.findChannelMessage(project.ID, channelID, c.Param("message_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	if !h.isChannelMember(project.ID, channelID, user.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is not a member of this channel"})
+		return
+	}
+
+	reaction := models.MessageReaction{
+		MessageID: message.ID,
+		UserID:    user.ID,
+		Emoji:     req.Emoji,
+		ProjectID: project.ID,
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errReactionExists
+		}
+
+		if err := tx.Model(&message).UpdateColumn("reaction_count", gorm.Expr("reaction_count + 1")).Error; err != nil {
+			return err
+		}
+
+		return services.PublishMessagingEvent(tx, services.MessagingEvent{
+			Type:      services.MessagingReactionAdded,
+			ProjectID: project.ID,
+			ChannelID: channelID,
+			UserID:    user.ID,
+			MessageID: message.ID,
+			Data:      reaction,
+		})
+	})
+	if errors.Is(err, errReactionExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Reaction already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add reaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, reaction)
+}
+
+// RemoveReaction removes a user's reaction from a message
+func (h *MessagingHandler) RemoveReaction(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	channelID := c.Param("channel_id")
+	emoji := c.Param("emoji")
+
+	user, ok := h.requestUser(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+	userID := user.ID
+
+	message, err := h.findChannelMessage(project.ID, channelID, c.Param("message_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// Reactions are unique per user and emoji, soft deleted rows included
+		result := tx.Unscoped().Where("project_id = ? AND message_id = ? AND user_id = ? AND emoji = ?",
+			project.ID, message.ID, userID, emoji).Delete(&models.MessageReaction{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Model(&message).UpdateColumn("reaction_count", gorm.Expr("GREATEST(reaction_count - 1, 0)")).Error; err != nil {
+			return err
+		}
+
+		return services.PublishMessagingEvent(tx, services.MessagingEvent{
+			Type:      services.MessagingReactionRemoved,
+			ProjectID: project.ID,
+			ChannelID: channelID,
+			UserID:    userID,
+			MessageID: message.ID,
+			Data:      gin.H{"emoji": emoji},
+		})
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reaction not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove reaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction removed successfully"})
+}
+
+// MarkChannelRead records that a member has read a channel up to a message
+func (h *MessagingHandler) MarkChannelRead(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	channelID := c.Param("channel_id")
+
+	var req struct {
+		UserID    string `json:"user_id"` // Optional; must match the session
+		MessageID string `json:"message_id" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := h.requestUser(c, req.UserID)
+	if !ok {
+		return
+	}
+
+	message, err := h.findChannelMessage(project.ID, channelID, req.MessageID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	if !h.isChannelMember(project.ID, channelID, user.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is not a member of this channel"})
+		return
+	}
+
+	now := time.Now()
+	receipt := models.MessageRead{
+		MessageID: message.ID,
+		UserID:    user.ID,
+		ReadAt:    now,
+		ProjectID: project.ID,
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"read_at": now, "deleted_at": nil}),
+		}).Create(&receipt).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.ChannelMember{}).
+			Where("project_id = ? AND channel_id = ? AND user_id = ?", project.ID, channelID, user.ID).
+			Update("last_read_at", now).Error; err != nil {
+			return err
+		}
+
+		return services.PublishMessagingEvent(tx, services.MessagingEvent{
+			Type:      services.MessagingRead,
+			ProjectID: project.ID,
+			ChannelID: channelID,
+			UserID:    user.ID,
+			MessageID: message.ID,
+			Data:      gin.H{"read_at": now},
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark channel as read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, receipt)
+}
+
+// ListMessageReads returns the read receipts of a message
+func (h *MessagingHandler) ListMessageReads(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	message, err := h.findChannelMessage(project.ID, c.Param("channel_id"), c.Param("message_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	var receipts []models.MessageRead
+	if err := h.db.Where("project_id = ? AND message_id = ?", project.ID, message.ID).
+		Order("read_at").Find(&receipts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch read receipts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, receipts)
+}
+
+// GetChannelPresence returns the online status of the members of a channel
+func (h *MessagingHandler) GetChannelPresence(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	channelID := c.Param("channel_id")
+
+	if !h.channelExists(project.ID, channelID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	var members []struct {
+		UserID     string
+		LastSeenAt *time.Time
+	}
+	if err := h.db.Model(&models.ChannelMember{}).
+		Select("channel_members.user_id, app_users.last_seen_at").
+		Joins("JOIN app_users ON app_users.id = channel_members.user_id AND app_users.deleted_at IS NULL").
+		Where("channel_members.project_id = ? AND channel_members.channel_id = ? AND channel_members.is_active = ?",
+			project.ID, channelID, true).
+		Scan(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch presence"})
+		return
+	}
+
+	presence := make([]gin.H, len(members))
+	for i, member := range members {
+		status := "offline"
+		if services.IsOnline(member.LastSeenAt) {
+			status = "online"
+		}
+		presence[i] = gin.H{
+			"user_id":      member.UserID,
+			"status":       status,
+			"last_seen_at": member.LastSeenAt,
+		}
+	}
+
+	c.JSON(http.StatusOK, presence)
+}
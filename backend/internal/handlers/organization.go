@@ -17,6 +17,7 @@ type OrganizationHandler struct {
 	db           *gorm.DB
 	cfg          *config.Config
 	auditService *services.AuditService
+	quotas       *services.QuotaService
 }
 
 // NewOrganizationHandler creates a new organization handler
@@ -25,6 +26,7 @@ func NewOrganizationHandler(db *gorm.DB, cfg *config.Config) *OrganizationHandle
 		db:           db,
 		cfg:          cfg,
 		auditService: services.NewAuditService(db),
+		quotas:       services.NewQuotaService(db, cfg),
 	}
 }
 
@@ -163,6 +165,7 @@ func (h *OrganizationHandler) GetOrganization(c *gin.Context) {
 		"created_at":    organization.CreatedAt,
 		"updated_at":    organization.UpdatedAt,
 		"project_count": organization.ProjectCount,
+		"quotas":        organization.Quotas,
 		"owner":         organization.User,
 		"admins":        orgAdmins,
 	}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// keysetKind tells how a cursor value is decoded before it is bound to SQL
+type keysetKind int
+
+const (
+	keysetString keysetKind = iota
+	keysetInt
+	keysetTime
+	keysetJSON
+)
+
+// keysetKey is one column of a keyset sort order
+type keysetKey struct {
+	expr   string     // SQL expression to order and compare on
+	desc   bool       // Descending order
+	kind   keysetKind // Type of the cursor value
+	column string     // Model column the value is read from (empty for data paths)
+	path   []string   // JSON path inside data for keysetJSON keys
+}
+
+// pageCursor is the decoded form of an opaque next_cursor/prev_cursor token
+type pageCursor struct {
+	Direction string            `json:"d"`
+	Sort      string            `json:"s"` // Signature of the sort order the cursor was issued for
+	Values    []json.RawMessage `json:"v"`
+}
+
+// keysetPage applies cursor pagination for a single list request
+type keysetPage struct {
+	keys     []keysetKey
+	limit    int
+	backward bool          // Paging towards the start (prev_cursor)
+	after    []interface{} // Decoded cursor values, nil on the first page
+}
+
+// newKeysetPage decodes cursor (which may be empty) against the given sort keys
+func newKeysetPage(keys []keysetKey, cursor string, limit int) (*keysetPage, error) {
+	page := &keysetPage{keys: keys, limit: limit}
+	if cursor == "" {
+		return page, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	var decoded pageCursor
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	if decoded.Sort != keysetSignature(keys) {
+		return nil, fmt.Errorf("cursor does not match the requested sort order")
+	}
+	if decoded.Direction != "next" && decoded.Direction != "prev" {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	if len(decoded.Values) != len(keys) {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+
+	page.backward = decoded.Direction == "prev"
+	page.after = make([]interface{}, len(keys))
+	for i, key := range keys {
+		value, err := decodeKeysetValue(key.kind, decoded.Values[i])
+		if err != nil {
+			return nil, fmt.Errorf("malformed cursor")
+		}
+		page.after[i] = value
+	}
+	return page, nil
+}
+
+// apply adds the keyset condition, order and lookahead limit to query
+func (p *keysetPage) apply(query *gorm.DB) *gorm.DB {
+	if p.after != nil {
+		sql, args := keysetCondition(p.keys, p.after, p.backward)
+		query = query.Where(sql, args...)
+	}
+	return query.Order(keysetOrder(p.keys, p.backward)).Limit(p.limit + 1)
+}
+
+// window returns how many of the n fetched rows belong to the page and whether more rows follow
+func (p *keysetPage) window(n int) (int, bool) {
+	if n > p.limit {
+		return p.limit, true
+	}
+	return n, false
+}
+
+// cursors builds the next/prev tokens from the first and last row of a page in natural order.
+// resumed reports whether the request started past the beginning (e.g. with an offset).
+func (p *keysetPage) cursors(first, last []interface{}, more, resumed bool) (string, string) {
+	var next, prev string
+	if p.backward {
+		next = encodeCursor(p.keys, "next", last)
+		if more {
+			prev = encodeCursor(p.keys, "prev", first)
+		}
+		return next, prev
+	}
+
+	if more {
+		next = encodeCursor(p.keys, "next", last)
+	}
+	if p.after != nil || resumed {
+		prev = encodeCursor(p.keys, "prev", first)
+	}
+	return next, prev
+}
+
+// keysetOrder builds the ORDER BY clause, reversed when paging backwards
+func keysetOrder(keys []keysetKey, backward bool) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		direction := "ASC"
+		if key.desc != backward {
+			direction = "DESC"
+		}
+		parts[i] = key.expr + " " + direction
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keysetCondition builds the row-after-cursor condition for mixed sort directions:
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+func keysetCondition(keys []keysetKey, values []interface{}, backward bool) (string, []interface{}) {
+	var branches []string
+	var args []interface{}
+
+	for i, key := range keys {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, keys[j].expr+" = "+keysetPlaceholder(keys[j]))
+			args = append(args, values[j])
+		}
+
+		operator := ">"
+		if key.desc != backward {
+			operator = "<"
+		}
+		terms = append(terms, key.expr+" "+operator+" "+keysetPlaceholder(key))
+		args = append(args, values[i])
+
+		branches = append(branches, "("+strings.Join(terms, " AND ")+")")
+	}
+
+	return "(" + strings.Join(branches, " OR ") + ")", args
+}
+
+// keysetPlaceholder returns the bind placeholder for a key
+func keysetPlaceholder(key keysetKey) string {
+	if key.kind == keysetJSON {
+		return "?::jsonb"
+	}
+	return "?"
+}
+
+// keysetSignature identifies a sort order so cursors cannot be replayed against another one
+func keysetSignature(keys []keysetKey) string {
+	sum := sha256.Sum256([]byte(keysetOrder(keys, false)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encodeCursor encodes row values into an opaque cursor token
+func encodeCursor(keys []keysetKey, direction string, values []interface{}) string {
+	cursor := pageCursor{
+		Direction: direction,
+		Sort:      keysetSignature(keys),
+		Values:    make([]json.RawMessage, len(values)),
+	}
+	for i, value := range values {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded = []byte("null")
+		}
+		cursor.Values[i] = encoded
+	}
+
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeKeysetValue converts a cursor value into the Go type bound for its key
+func decodeKeysetValue(kind keysetKind, raw json.RawMessage) (interface{}, error) {
+	switch kind {
+	case keysetString:
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	case keysetInt:
+		var value int64
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	case keysetTime:
+		var value time.Time
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	default:
+		if !json.Valid(raw) {
+			return nil, fmt.Errorf("invalid JSON value")
+		}
+		return string(raw), nil
+	}
+}
+
+// lookupDataPath returns the value at path inside stored document data the way the #> operator
+// does, or nil when it is missing. Numbers stay json.Number so cursors carry them exactly.
+func lookupDataPath(raw []byte, path []string) interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var data map[string]interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil
+	}
+	value, _ := dataPathValue(data, path)
+	return value
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeysetCursorRoundTrip(t *testing.T) {
+	keys := []keysetKey{
+		{expr: "(data #> '{score}')", desc: true, kind: keysetJSON, path: []string{"score"}},
+		documentColumnKey("created_at", false),
+		documentColumnKey("version", false),
+		documentColumnKey("id", false),
+	}
+	created := time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)
+	values := []interface{}{json.Number("9007199254740993"), created, 7, "doc1"}
+
+	tests := []struct {
+		name      string
+		direction string
+		backward  bool
+	}{
+		{"next", "next", false},
+		{"prev", "prev", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := newKeysetPage(keys, encodeCursor(keys, tt.direction, values), 20)
+			if err != nil {
+				t.Fatalf("newKeysetPage() error = %v", err)
+			}
+			if page.backward != tt.backward {
+				t.Errorf("backward = %v, want %v", page.backward, tt.backward)
+			}
+			want := []interface{}{"9007199254740993", created, int64(7), "doc1"}
+			if !reflect.DeepEqual(page.after, want) {
+				t.Errorf("after = %#v, want %#v", page.after, want)
+			}
+		})
+	}
+}
+
+func TestNewKeysetPageRejectsCursors(t *testing.T) {
+	keys := []keysetKey{documentColumnKey("created_at", true), documentColumnKey("id", false)}
+	otherKeys := []keysetKey{documentColumnKey("created_at", false), documentColumnKey("id", false)}
+	values := []interface{}{time.Now(), "doc1"}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "%%%"},
+		{"not JSON", "bm90IGpzb24"},
+		{"other sort order", encodeCursor(otherKeys, "next", values)},
+		{"unknown direction", encodeCursor(keys, "sideways", values)},
+		{"missing values", encodeCursor(keys, "next", values[:1])},
+		{"wrong value type", encodeCursor(keys, "next", []interface{}{"yesterday", "doc1"})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newKeysetPage(keys, tt.cursor, 20); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	keys := []keysetKey{
+		{expr: "(data #> '{score}')", desc: true, kind: keysetJSON},
+		documentColumnKey("id", false),
+	}
+	values := []interface{}{"10", "doc1"}
+
+	tests := []struct {
+		name     string
+		backward bool
+		sql      string
+		order    string
+	}{
+		{
+			name:  "forward",
+			sql:   "(((data #> '{score}') < ?::jsonb) OR ((data #> '{score}') = ?::jsonb AND id > ?))",
+			order: "(data #> '{score}') DESC, id ASC",
+		},
+		{
+			name:     "backward",
+			backward: true,
+			sql:      "(((data #> '{score}') > ?::jsonb) OR ((data #> '{score}') = ?::jsonb AND id < ?))",
+			order:    "(data #> '{score}') ASC, id DESC",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args := keysetCondition(keys, values, tt.backward)
+			if sql != tt.sql {
+				t.Errorf("sql = %s\nwant  %s", sql, tt.sql)
+			}
+			if want := []interface{}{"10", "10", "doc1"}; !reflect.DeepEqual(args, want) {
+				t.Errorf("args = %#v, want %#v", args, want)
+			}
+			if order := keysetOrder(keys, tt.backward); order != tt.order {
+				t.Errorf("order = %s, want %s", order, tt.order)
+			}
+		})
+	}
+}
+
+func TestKeysetPageCursors(t *testing.T) {
+	keys := []keysetKey{documentColumnKey("id", false)}
+	first, last := []interface{}{"a"}, []interface{}{"z"}
+
+	tests := []struct {
+		name     string
+		after    []interface{}
+		backward bool
+		more     bool
+		resumed  bool
+		next     bool
+		prev     bool
+	}{
+		{name: "first page", more: true, next: true},
+		{name: "only page"},
+		{name: "first page after an offset", resumed: true, prev: true},
+		{name: "middle page", after: []interface{}{"0"}, more: true, next: true, prev: true},
+		{name: "last page", after: []interface{}{"0"}, prev: true},
+		{name: "backward with more", after: []interface{}{"0"}, backward: true, more: true, next: true, prev: true},
+		{name: "backward to the start", after: []interface{}{"0"}, backward: true, next: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := &keysetPage{keys: keys, limit: 10, backward: tt.backward, after: tt.after}
+			next, prev := page.cursors(first, last, tt.more, tt.resumed)
+			if (next != "") != tt.next {
+				t.Errorf("next cursor = %q, want present %v", next, tt.next)
+			}
+			if (prev != "") != tt.prev {
+				t.Errorf("prev cursor = %q, want present %v", prev, tt.prev)
+			}
+		})
+	}
+}
+
+func TestLookupDataPath(t *testing.T) {
+	raw := []byte(`{"id": 9007199254740993, "price": 1.50, "tags": ["a", {"name": "b"}], "nested": {"x": null}}`)
+
+	tests := []struct {
+		name string
+		path []string
+		want interface{}
+	}{
+		{"large integer keeps its digits", []string{"id"}, json.Number("9007199254740993")},
+		{"decimal keeps its text", []string{"price"}, json.Number("1.50")},
+		{"array index", []string{"tags", "0"}, "a"},
+		{"negative array index", []string{"tags", "-1", "name"}, "b"},
+		{"array index out of range", []string{"tags", "5"}, nil},
+		{"non-numeric segment on an array", []string{"tags", "name"}, nil},
+		{"missing key", []string{"missing"}, nil},
+		{"JSON null", []string{"nested", "x"}, nil},
+		{"path through a scalar", []string{"price", "x"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lookupDataPath(raw, tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookupDataPath() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
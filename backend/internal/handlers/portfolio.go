@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -243,6 +244,13 @@ func (h *PortfolioHandler) DeleteTranslation(c *gin.Context) {
 		return
 	}
 	
+	translation.Author = requestAuthor(c)
+	if err := recordDocumentRevision(tx, translation, revisionDelete, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
+	
 	if err := tx.Commit().Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit deletion"})
 		return
@@ -345,7 +353,7 @@ func (h *PortfolioHandler) DeleteImage(c *gin.Context) {
 	}
 	
 	// Use utility function for deletion
-	err := h.deleteDocumentWithCascade(projectID, "images", imageID, nil)
+	err := h.deleteDocumentWithCascade(projectID, "images", imageID, requestAuthor(c), nil)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
@@ -390,8 +398,15 @@ func (h *PortfolioHandler) UpdateImage(c *gin.Context) {
 		document.Data[key] = value
 	}
 	document.Version++
+	document.Author = requestAuthor(c)
 
-	if err := h.db.Save(&document).Error; err != nil {
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&document).Error; err != nil {
+			return err
+		}
+		return recordDocumentRevision(tx, document, revisionUpdate, requestAPIKeyID(c))
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update image"})
 		return
 	}
@@ -480,8 +495,11 @@ func (h *PortfolioHandler) CreateAlbum(c *gin.Context) {
 	
 	album, err := h.createDocumentWithValidation(projectID, "albums", albumID, req, "portfolio_admin")
 	if err != nil {
+		var validationErr *schemaValidationError
 		if strings.Contains(err.Error(), "already exists") {
 			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else if errors.As(err, &validationErr) {
+			respondDocumentValidation(c, err)
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create album"})
 		}
@@ -526,10 +544,13 @@ func (h *PortfolioHandler) UpdateAlbum(c *gin.Context) {
 		return
 	}
 	
-	album, err := h.updateDocumentWithValidation(projectID, "albums", albumID, req)
+	album, err := h.updateDocumentWithValidation(projectID, "albums", albumID, req, requestAuthor(c))
 	if err != nil {
+		var validationErr *schemaValidationError
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
+		} else if errors.As(err, &validationErr) {
+			respondDocumentValidation(c, err)
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update album"})
 		}
@@ -569,7 +590,7 @@ func (h *PortfolioHandler) DeleteAlbum(c *gin.Context) {
 	}
 	
 	// Use utility function for deletion
-	err := h.deleteDocumentWithCascade(projectID, "albums", albumID, nil)
+	err := h.deleteDocumentWithCascade(projectID, "albums", albumID, requestAuthor(c), nil)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Album not found"})
@@ -643,6 +664,15 @@ func (h *PortfolioHandler) DeletePage(c *gin.Context) {
 			return
 		}
 		
+		for i := range translations {
+			translations[i].Author = requestAuthor(c)
+		}
+		if err := recordDocumentRevisions(tx, translations, revisionDelete, requestAPIKeyID(c)); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revisions"})
+			return
+		}
+		
 		log.Printf("Deleted %d translations for page %s", result.RowsAffected, pageID)
 	}
 	
@@ -662,6 +692,13 @@ func (h *PortfolioHandler) DeletePage(c *gin.Context) {
 		return
 	}
 	
+	page.Author = requestAuthor(c)
+	if err := recordDocumentRevision(tx, page, revisionDelete, requestAPIKeyID(c)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record document revision"})
+		return
+	}
+	
 	if err := tx.Commit().Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit deletion"})
 		return
@@ -821,7 +858,13 @@ func (h *PortfolioHandler) UpdateSettings(c *gin.Context) {
 			Author:         "portfolio_update",
 		}
 		
-		if err := h.db.Create(&document).Error; err != nil {
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&document).Error; err != nil {
+				return err
+			}
+			return recordDocumentRevision(tx, document, revisionCreate, requestAPIKeyID(c))
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create settings"})
 			return
 		}
@@ -831,8 +874,15 @@ func (h *PortfolioHandler) UpdateSettings(c *gin.Context) {
 			document.Data[key] = value
 		}
 		document.Version++
+		document.Author = requestAuthor(c)
 		
-		if err := h.db.Save(&document).Error; err != nil {
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&document).Error; err != nil {
+				return err
+			}
+			return recordDocumentRevision(tx, document, revisionUpdate, requestAPIKeyID(c))
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
 			return
 		}
@@ -1145,6 +1195,12 @@ func (h *PortfolioHandler) createDocumentWithValidation(projectID uint, collecti
 		return nil, fmt.Errorf("document with ID %s already exists", documentID)
 	}
 	
+	// Validate against the collection JSON Schema
+	if err := validateCollectionDocument(tx, projectID, collectionName, data); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	
 	// Create new document
 	document := models.Document{
 		ID:             documentID,
@@ -1160,6 +1216,11 @@ func (h *PortfolioHandler) createDocumentWithValidation(projectID uint, collecti
 		return nil, err
 	}
 	
+	if err := recordDocumentRevision(tx, document, revisionCreate, nil); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	
 	if err := tx.Commit().Error; err != nil {
 		return nil, err
 	}
@@ -1168,7 +1229,7 @@ func (h *PortfolioHandler) createDocumentWithValidation(projectID uint, collecti
 }
 
 // updateDocumentWithValidation updates a document with proper validation and transaction handling
-func (h *PortfolioHandler) updateDocumentWithValidation(projectID uint, collectionName, documentID string, updates map[string]interface{}) (*models.Document, error) {
+func (h *PortfolioHandler) updateDocumentWithValidation(projectID uint, collectionName, documentID string, updates map[string]interface{}, author string) (*models.Document, error) {
 	// Start transaction
 	tx := h.db.Begin()
 	defer func() {
@@ -1191,12 +1252,24 @@ func (h *PortfolioHandler) updateDocumentWithValidation(projectID uint, collecti
 		document.Data[key] = value
 	}
 	document.Version++
+	document.Author = author
+	
+	// Validate the merged data against the collection JSON Schema
+	if err := validateCollectionDocument(tx, projectID, collectionName, document.Data); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	
 	if err := tx.Save(&document).Error; err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 	
+	if err := recordDocumentRevision(tx, document, revisionUpdate, nil); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	
 	if err := tx.Commit().Error; err != nil {
 		return nil, err
 	}
@@ -1205,7 +1278,7 @@ func (h *PortfolioHandler) updateDocumentWithValidation(projectID uint, collecti
 }
 
 // deleteDocumentWithCascade deletes a document and handles cascade deletion for related entities
-func (h *PortfolioHandler) deleteDocumentWithCascade(projectID uint, collectionName, documentID string, cascadeFunc func(*gorm.DB, uint, string) error) error {
+func (h *PortfolioHandler) deleteDocumentWithCascade(projectID uint, collectionName, documentID, author string, cascadeFunc func(*gorm.DB, uint, string) error) error {
 	// Start transaction
 	tx := h.db.Begin()
 	defer func() {
@@ -1245,5 +1318,11 @@ func (h *PortfolioHandler) deleteDocumentWithCascade(projectID uint, collectionN
 		return gorm.ErrRecordNotFound
 	}
 	
+	document.Author = author
+	if err := recordDocumentRevision(tx, document, revisionDelete, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	
 	return tx.Commit().Error
 }
\ No newline at end of file
@@ -1,21 +1,20 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/middleware"
 	"github.com/cloudbox/backend/internal/models"
 	"github.com/cloudbox/backend/internal/services"
 	"github.com/cloudbox/backend/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -24,6 +23,7 @@ type ProjectHandler struct {
 	db           *gorm.DB
 	cfg          *config.Config
 	auditService *services.AuditService
+	quotas       *services.QuotaService
 }
 
 // NewProjectHandler creates a new project handler
@@ -32,6 +32,7 @@ func NewProjectHandler(db *gorm.DB, cfg *config.Config) *ProjectHandler {
 		db:           db,
 		cfg:          cfg,
 		auditService: services.NewAuditService(db),
+		quotas:       services.NewQuotaService(db, cfg),
 	}
 }
 
@@ -78,22 +79,7 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 	}
 
 	// Generate unique slug from name
-	slug := generateSlug(req.Name)
-	
-	// Ensure slug is unique among non-deleted projects
-	// With our partial unique index, we only need to check active (non-deleted) projects
-	var count int64
-	h.db.Model(&models.Project{}).Where("slug = ? AND deleted_at IS NULL", slug).Count(&count)
-	if count > 0 {
-		// Find the next available slug by checking incrementally
-		originalSlug := slug
-		counter := 1
-		for count > 0 {
-			slug = fmt.Sprintf("%s-%d", originalSlug, counter)
-			h.db.Model(&models.Project{}).Where("slug = ? AND deleted_at IS NULL", slug).Count(&count)
-			counter++
-		}
-	}
+	slug := uniqueProjectSlug(h.db, req.Name)
 
 	// Validate organization (required)
 	var organization models.Organization
@@ -283,15 +269,26 @@ func (h *ProjectHandler) ListAPIKeys(c *gin.Context) {
 	for _, key := range apiKeys {
 		// Since we only store hashed keys for security, show masked placeholder
 		maskedKey := "••••••••••••" // Secure display - no plain text keys stored
+		if key.HashAlgorithm == services.APIKeyHashHMAC && !strings.HasPrefix(key.KeyPrefix, "legacy_") {
+			maskedKey = key.KeyPrefix + "_••••••••••••"
+		}
 		
 		safeKeys = append(safeKeys, gin.H{
 			"id":           key.ID,
 			"name":         key.Name,
 			"key":          maskedKey, // Masked version for display
+			"key_prefix":   key.KeyPrefix,
 			"permissions":  key.Permissions,
+			"is_public":    key.IsPublic,
 			"is_active":    key.IsActive,
 			"last_used_at": key.LastUsedAt,
 			"expires_at":   key.ExpiresAt,
+			"rotated_from_id":     key.RotatedFromID,
+			"rotated_at":          key.RotatedAt,
+			"deactivated_at":      key.DeactivatedAt,
+			"deactivation_reason": key.DeactivationReason,
+			"rate_limit_requests":       key.RateLimitRequests,
+			"rate_limit_window_seconds": key.RateLimitWindowSeconds,
 			"created_at":   key.CreatedAt,
 			"updated_at":   key.UpdatedAt,
 		})
@@ -312,12 +309,18 @@ func (h *ProjectHandler) CreateAPIKey(c *gin.Context) {
 	var req struct {
 		Name        string   `json:"name" binding:"required"`
 		Permissions []string `json:"permissions"`
+		IsPublic    bool     `json:"is_public"` // Read-only key that may be shipped to browsers
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	
+	if err := middleware.ValidatePermissions(req.Permissions, req.IsPublic); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid permissions", "details": err.Error()})
+		return
+	}
 
 	// Verify project ownership
 	var project models.Project
@@ -326,40 +329,43 @@ func (h *ProjectHandler) CreateAPIKey(c *gin.Context) {
 		return
 	}
 
-	// Generate API key (64 characters for better security)
-	keyBytes := make([]byte, 32)
-	if _, err := rand.Read(keyBytes); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
-		return
-	}
-	apiKey := hex.EncodeToString(keyBytes)
-
-	// Hash the API key for secure storage
-	hashedKey, err := bcrypt.GenerateFromPassword([]byte(apiKey), bcrypt.DefaultCost)
+	// Generate API key; only its HMAC is stored, the ID segment is kept for lookup
+	apiKey, prefix, hashedKey, err := services.GenerateAPIKey(h.cfg)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash API key"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
 		return
 	}
 
 	// Create API key record - only store the hashed version for security
 	key := models.APIKey{
-		Name:        req.Name,
-		KeyHash:     string(hashedKey), // Only store hashed version for authentication
-		ProjectID:   uint(projectID),
-		Permissions: pq.StringArray(req.Permissions),
-		IsActive:    true,
+		Name:          req.Name,
+		KeyHash:       hashedKey, // Only store hashed version for authentication
+		KeyPrefix:     prefix,
+		HashAlgorithm: services.APIKeyHashHMAC,
+		ProjectID:     uint(projectID),
+		Permissions:   pq.StringArray(req.Permissions),
+		IsPublic:      req.IsPublic,
+		IsActive:      true,
 	}
 
 	if err := h.db.Create(&key).Error; err != nil {
+		h.auditService.LogAPIKeyEvent(c, models.AuditActionAPIKeyCreate, 0, req.Name, fmt.Sprintf("API key '%s' created", req.Name), false, fmt.Sprintf("Database error: %v", err), nil)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
 		return
 	}
 
+	h.auditService.LogAPIKeyEvent(c, models.AuditActionAPIKeyCreate, key.ID, key.Name, fmt.Sprintf("API key '%s' created", key.Name), true, "", map[string]interface{}{
+		"permissions": key.Permissions,
+		"is_public":   key.IsPublic,
+	})
+
 	c.JSON(http.StatusCreated, gin.H{
 		"id":          key.ID,
 		"name":        key.Name,
 		"key":         apiKey, // Only shown once during creation
+		"key_prefix":  key.KeyPrefix,
 		"permissions": key.Permissions,
+		"is_public":   key.IsPublic,
 		"created_at":  key.CreatedAt,
 		"warning":     "Save this key now - you won't be able to see it again!",
 	})
@@ -387,16 +393,23 @@ func (h *ProjectHandler) DeleteAPIKey(c *gin.Context) {
 		return
 	}
 
-	result := h.db.Where("id = ? AND project_id = ?", uint(keyID), projectID).Delete(&models.APIKey{})
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
+	var key models.APIKey
+	if err := h.db.Where("id = ? AND project_id = ?", uint(keyID), projectID).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
 		return
 	}
 
-	if result.RowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+	if err := h.db.Delete(&key).Error; err != nil {
+		h.auditService.LogAPIKeyEvent(c, models.AuditActionAPIKeyDelete, key.ID, key.Name, fmt.Sprintf("API key '%s' deleted", key.Name), false, fmt.Sprintf("Database error: %v", err), nil)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
 		return
 	}
+	h.auditService.LogAPIKeyEvent(c, models.AuditActionAPIKeyDelete, key.ID, key.Name, fmt.Sprintf("API key '%s' deleted", key.Name), true, "", nil)
+
+	// Drop the key from the authentication caches of every instance
+	if err := services.NotifyAPIKeyChanged(h.db, uint(keyID)); err != nil {
+		log.Printf("Failed to announce deletion of API key %d: %v", keyID, err)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "API key deleted successfully"})
 }
@@ -713,6 +726,11 @@ func (h *ProjectHandler) UpdateProjectNotes(c *gin.Context) {
 
 // canAccessProject checks if user can access a project based on role
 func (h *ProjectHandler) canAccessProject(c *gin.Context, projectID uint) (models.Project, bool) {
+	return accessibleProject(h.db, c, projectID)
+}
+
+// accessibleProject returns a project if the user of a request can access it
+func accessibleProject(db *gorm.DB, c *gin.Context, projectID uint) (models.Project, bool) {
 	userID := c.GetUint("user_id")
 	userRole := c.GetString("user_role")
 	
@@ -721,10 +739,10 @@ func (h *ProjectHandler) canAccessProject(c *gin.Context, projectID uint) (model
 	
 	if userRole == "superadmin" {
 		// Superadmin can access any project
-		query = h.db.Where("id = ?", projectID)
+		query = db.Where("id = ?", projectID)
 	} else {
 		// Regular admin can only access their own projects
-		query = h.db.Where("id = ? AND user_id = ?", projectID, userID)
+		query = db.Where("id = ? AND user_id = ?", projectID, userID)
 	}
 	
 	err := query.First(&project).Error
@@ -735,6 +753,27 @@ func (h *ProjectHandler) canAccessProject(c *gin.Context, projectID uint) (model
 	return project, true
 }
 
+// uniqueProjectSlug generates a slug from a name that no other project has
+func uniqueProjectSlug(db *gorm.DB, name string) string {
+	slug := generateSlug(name)
+	
+	// Ensure slug is unique among non-deleted projects
+	// With our partial unique index, we only need to check active (non-deleted) projects
+	var count int64
+	db.Model(&models.Project{}).Where("slug = ? AND deleted_at IS NULL", slug).Count(&count)
+	if count > 0 {
+		// Find the next available slug by checking incrementally
+		originalSlug := slug
+		counter := 1
+		for count > 0 {
+			slug = fmt.Sprintf("%s-%d", originalSlug, counter)
+			db.Model(&models.Project{}).Where("slug = ? AND deleted_at IS NULL", slug).Count(&count)
+			counter++
+		}
+	}
+	return slug
+}
+
 // generateSlug creates a URL-friendly slug from a name
 func generateSlug(name string) string {
 	slug := strings.ToLower(name)
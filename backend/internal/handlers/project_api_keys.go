@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAPIKeyRotationGrace = 30 * 24 * time.Hour
+	defaultAPIKeyUsageDays = 30
+	maxAPIKeyUsageDays     = 90
+)
+
+var errAPIKeyRotated = errors.New("API key has already been rotated")
+
+// RotateAPIKey issues a successor of an API key with the same name and permissions. The old
+// key keeps working for a grace period so clients can switch over, then it is deactivated.
+func (h *ProjectHandler) RotateAPIKey(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	projectID, err := utils.ParseProjectID(c)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+
+	var req struct {
+		GracePeriod *string `json:"grace_period"` // Duration such as 24h; 0 revokes the old key at once
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	grace := h.cfg.APIKeyRotationGrace
+	if req.GracePeriod != nil {
+		if grace, err = time.ParseDuration(*req.GracePeriod); err != nil || grace < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid grace period", "details": "Use a duration such as 24h or 30m"})
+			return
+		}
+	}
+	if grace > maxAPIKeyRotationGrace {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Grace period is too long", "max_grace_period": maxAPIKeyRotationGrace.String()})
+		return
+	}
+
+	// Verify project ownership
+	var project models.Project
+	if err := h.db.Where("id = ? AND user_id = ?", uint(projectID), userID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	var old models.APIKey
+	if err := h.db.Where("id = ? AND project_id = ?", uint(keyID), projectID).First(&old).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if old.RotatedAt != nil {
+		var successor models.APIKey
+		h.db.Select("id").Where("rotated_from_id = ?", old.ID).First(&successor)
+		c.JSON(http.StatusConflict, gin.H{"error": "API key has already been rotated", "successor_id": successor.ID})
+		return
+	}
+
+	apiKey, prefix, hashedKey, err := services.GenerateAPIKey(h.cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+
+	now := time.Now()
+	oldExpiresAt := now.Add(grace)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(oldExpiresAt) {
+		oldExpiresAt = *old.ExpiresAt
+	}
+
+	key := models.APIKey{
+		Name:          old.Name,
+		KeyHash:       hashedKey,
+		KeyPrefix:     prefix,
+		HashAlgorithm: services.APIKeyHashHMAC,
+		ProjectID:     old.ProjectID,
+		Permissions:   old.Permissions,
+		IsPublic:      old.IsPublic,
+		IsActive:      true,
+		ExpiresAt:     old.ExpiresAt,
+		RotatedFromID: &old.ID,
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{
+			"rotated_at": now,
+			"expires_at": oldExpiresAt,
+		}
+		if grace == 0 {
+			updates["is_active"] = false
+			updates["deactivated_at"] = now
+			updates["deactivation_reason"] = services.APIKeyDeactivatedRotated
+		}
+		result := tx.Model(&models.APIKey{}).Where("id = ? AND rotated_at IS NULL", old.ID).UpdateColumns(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAPIKeyRotated
+		}
+
+		// Cached copies of the old key must pick up its new expiry
+		return services.NotifyAPIKeyChanged(tx, old.ID)
+	})
+	if errors.Is(err, errAPIKeyRotated) {
+		c.JSON(http.StatusConflict, gin.H{"error": "API key has already been rotated"})
+		return
+	}
+	if err != nil {
+		h.auditService.LogAPIKeyEvent(c, models.AuditActionAPIKeyRotate, old.ID, old.Name, fmt.Sprintf("API key '%s' rotated", old.Name), false, fmt.Sprintf("Database error: %v", err), nil)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate API key"})
+		return
+	}
+
+	h.auditService.LogAPIKeyEvent(c, models.AuditActionAPIKeyRotate, old.ID, old.Name, fmt.Sprintf("API key '%s' rotated", old.Name), true, "", map[string]interface{}{
+		"successor_id":   key.ID,
+		"grace_period":   grace.String(),
+		"old_expires_at": oldExpiresAt,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":          key.ID,
+		"name":        key.Name,
+		"key":         apiKey, // Only shown once during creation
+		"key_prefix":  key.KeyPrefix,
+		"permissions": key.Permissions,
+		"is_public":   key.IsPublic,
+		"expires_at":  key.ExpiresAt,
+		"created_at":  key.CreatedAt,
+		"rotated_from": gin.H{
+			"id":         old.ID,
+			"expires_at": oldExpiresAt,
+			"is_active":  grace > 0,
+		},
+		"warning": "Save this key now - you won't be able to see it again!",
+	})
+}
+
+// GetAPIKeyUsage returns request statistics of an API key from the request log
+func (h *ProjectHandler) GetAPIKeyUsage(c *gin.Context) {
+	projectID, err := utils.ParseProjectID(c)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+
+	days := defaultAPIKeyUsageDays
+	if value := c.Query("days"); value != "" {
+		if days, err = strconv.Atoi(value); err != nil || days < 1 || days > maxAPIKeyUsageDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("days must be between 1 and %d", maxAPIKeyUsageDays)})
+			return
+		}
+	}
+
+	// Verify project access
+	if _, canAccess := h.canAccessProject(c, uint(projectID)); !canAccess {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	var key models.APIKey
+	if err := h.db.Where("id = ? AND project_id = ?", uint(keyID), projectID).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	logs := func() *gorm.DB {
+		return h.db.Model(&models.APIRequestLog{}).Where("api_key_id = ? AND created_at >= ?", key.ID, since)
+	}
+
+	var totals struct {
+		Requests        int64
+		Errors          int64
+		AvgResponseTime float64
+	}
+	if err := logs().Select(`COUNT(*) AS requests,
+		COUNT(*) FILTER (WHERE status_code >= 400) AS errors,
+		COALESCE(AVG(response_time_ms), 0) AS avg_response_time`).Scan(&totals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API key usage"})
+		return
+	}
+	var lastRequestAt *time.Time
+	var lastRequests []time.Time
+	logs().Order("created_at DESC").Limit(1).Pluck("created_at", &lastRequests)
+	if len(lastRequests) > 0 {
+		lastRequestAt = &lastRequests[0]
+	}
+
+	type dailyUsage struct {
+		Date     string `json:"date"`
+		Requests int64  `json:"requests"`
+		Errors   int64  `json:"errors"`
+	}
+	var daily []dailyUsage
+	logs().Select(`TO_CHAR(DATE(created_at), 'YYYY-MM-DD') AS date, COUNT(*) AS requests,
+		COUNT(*) FILTER (WHERE status_code >= 400) AS errors`).
+		Group("DATE(created_at)").Order("DATE(created_at) ASC").Scan(&daily)
+
+	type endpointUsage struct {
+		Method   string `json:"method"`
+		Endpoint string `json:"endpoint"`
+		Requests int64  `json:"requests"`
+	}
+	var endpoints []endpointUsage
+	logs().Select("method, endpoint, COUNT(*) AS requests").
+		Group("method, endpoint").Order("requests DESC").Limit(10).Scan(&endpoints)
+
+	type statusUsage struct {
+		StatusCode int   `json:"status_code"`
+		Requests   int64 `json:"requests"`
+	}
+	var statuses []statusUsage
+	logs().Select("status_code, COUNT(*) AS requests").
+		Group("status_code").Order("status_code ASC").Scan(&statuses)
+
+	errorRate := 0.0
+	if totals.Requests > 0 {
+		errorRate = float64(totals.Errors) / float64(totals.Requests) * 100
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":               key.ID,
+		"name":                 key.Name,
+		"is_active":            key.IsActive,
+		"last_used_at":         key.LastUsedAt,
+		"period_days":          days,
+		"total_requests":       totals.Requests,
+		"error_requests":       totals.Errors,
+		"error_rate":           errorRate,
+		"avg_response_time_ms": totals.AvgResponseTime,
+		"last_request_at":      lastRequestAt,
+		"daily":                daily,
+		"top_endpoints":        endpoints,
+		"status_codes":         statuses,
+	})
+}
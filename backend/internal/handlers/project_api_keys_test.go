@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// apiKeyRouter routes the API key endpoints for a user of the given role
+func apiKeyRouter(handler *ProjectHandler, userID uint, role string) *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("user_id", userID)
+		c.Set("user_role", role)
+	})
+	router.POST("/projects/:id/api-keys/:key_id/rotate", handler.RotateAPIKey)
+	router.GET("/projects/:id/api-keys/:key_id/usage", handler.GetAPIKeyUsage)
+	return router
+}
+
+func serve(router *gin.Engine, method, target, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.APIKey{}, &models.AuditLog{})
+	cfg := &config.Config{JWTSecret: "test-secret", APIKeyRotationGrace: 24 * time.Hour}
+	handler := NewProjectHandler(db, cfg)
+
+	project := models.Project{Name: "app", Slug: "app", UserID: 1, IsActive: true}
+	db.Create(&project)
+	newKey := func(name string) models.APIKey {
+		_, prefix, hash, err := services.GenerateAPIKey(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := models.APIKey{Name: name, KeyPrefix: prefix, KeyHash: hash, HashAlgorithm: services.APIKeyHashHMAC,
+			IsActive: true, Permissions: pq.StringArray{"documents:read"}, ProjectID: project.ID}
+		db.Create(&key)
+		return key
+	}
+	rotate := func(router *gin.Engine, key models.APIKey, body string) *httptest.ResponseRecorder {
+		return serve(router, http.MethodPost, fmt.Sprintf("/projects/%d/api-keys/%d/rotate", project.ID, key.ID), body)
+	}
+	owner := apiKeyRouter(handler, 1, "admin")
+
+	// Only the owner of the project rotates its keys
+	key := newKey("server")
+	if recorder := rotate(apiKeyRouter(handler, 2, "admin"), key, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("rotation by another user: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	before := time.Now()
+	recorder := rotate(owner, key, "")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("rotation: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var response struct {
+		ID   uint   `json:"id"`
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+
+	var successor, old models.APIKey
+	db.First(&successor, response.ID)
+	db.First(&old, key.ID)
+	if successor.RotatedFromID == nil || *successor.RotatedFromID != key.ID || successor.Name != "server" ||
+		strings.Join(successor.Permissions, ",") != "documents:read" || !successor.IsActive {
+		t.Errorf("successor = %+v", successor)
+	}
+	if successor.KeyHash != services.HashAPIKey(cfg, response.Key) {
+		t.Error("the returned key does not match the successor")
+	}
+	// The old key keeps working for the default grace period
+	if !old.IsActive || old.RotatedAt == nil || old.ExpiresAt == nil ||
+		old.ExpiresAt.Before(before.Add(24*time.Hour)) || old.ExpiresAt.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("old key = active %t, rotated %v, expires %v", old.IsActive, old.RotatedAt, old.ExpiresAt)
+	}
+
+	// A key is rotated once
+	if recorder := rotate(owner, key, ""); recorder.Code != http.StatusConflict || !strings.Contains(recorder.Body.String(), fmt.Sprintf(`"successor_id":%d`, successor.ID)) {
+		t.Errorf("second rotation: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Without a grace period the old key stops at once
+	key = newKey("worker")
+	if recorder := rotate(owner, key, `{"grace_period": "0s"}`); recorder.Code != http.StatusCreated {
+		t.Fatalf("rotation without grace: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var revoked models.APIKey
+	db.First(&revoked, key.ID)
+	if revoked.IsActive || revoked.DeactivationReason != services.APIKeyDeactivatedRotated {
+		t.Errorf("old key = active %t, reason %q", revoked.IsActive, revoked.DeactivationReason)
+	}
+
+	for _, grace := range []string{`"-1h"`, `"soon"`, `"721h"`} {
+		if recorder := rotate(owner, newKey("bad"), `{"grace_period": `+grace+`}`); recorder.Code != http.StatusBadRequest {
+			t.Errorf("grace period %s: %d %s", grace, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestGetAPIKeyUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.APIKey{}, &models.APIRequestLog{})
+	handler := NewProjectHandler(db, &config.Config{})
+
+	project := models.Project{Name: "app", Slug: "app", UserID: 1, IsActive: true}
+	db.Create(&project)
+	key := models.APIKey{Name: "server", KeyHash: "hash", ProjectID: project.ID, IsActive: true}
+	other := models.APIKey{Name: "other", KeyHash: "other-hash", ProjectID: project.ID, IsActive: true}
+	db.Create(&key)
+	db.Create(&other)
+
+	now := time.Now()
+	for _, entry := range []struct {
+		key    uint
+		status int
+		age    time.Duration
+	}{
+		{key.ID, 200, time.Hour},
+		{key.ID, 200, 2 * time.Hour},
+		{key.ID, 404, 3 * time.Hour},
+		{key.ID, 500, 40 * 24 * time.Hour}, // Outside the default period
+		{other.ID, 500, time.Hour},
+	} {
+		keyID := entry.key
+		db.Create(&models.APIRequestLog{CreatedAt: now.Add(-entry.age), ProjectID: &project.ID, Method: "GET",
+			Endpoint: "/documents", StatusCode: entry.status, ResponseTimeMs: 10, APIKeyID: &keyID})
+	}
+
+	usage := func(router *gin.Engine, query string) *httptest.ResponseRecorder {
+		return serve(router, http.MethodGet, fmt.Sprintf("/projects/%d/api-keys/%d/usage%s", project.ID, key.ID, query), "")
+	}
+	recorder := usage(apiKeyRouter(handler, 1, "admin"), "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("usage: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var response struct {
+		TotalRequests int64      `json:"total_requests"`
+		ErrorRequests int64      `json:"error_requests"`
+		ErrorRate     float64    `json:"error_rate"`
+		LastRequestAt *time.Time `json:"last_request_at"`
+		Daily         []struct {
+			Date     string `json:"date"`
+			Requests int64  `json:"requests"`
+		} `json:"daily"`
+		StatusCodes []struct {
+			StatusCode int   `json:"status_code"`
+			Requests   int64 `json:"requests"`
+		} `json:"status_codes"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.TotalRequests != 3 || response.ErrorRequests != 1 || len(response.StatusCodes) != 2 {
+		t.Errorf("usage = %+v, want 3 requests of which 1 failed", response)
+	}
+	if response.LastRequestAt == nil || now.Add(-time.Hour).Sub(*response.LastRequestAt).Abs() > time.Second {
+		t.Errorf("last request at %v, want an hour ago", response.LastRequestAt)
+	}
+	var daily int64
+	for _, day := range response.Daily {
+		if _, err := time.Parse("2006-01-02", day.Date); err != nil {
+			t.Errorf("day %q: %v", day.Date, err)
+		}
+		daily += day.Requests
+	}
+	if daily != 3 {
+		t.Errorf("daily usage = %+v, want 3 requests", response.Daily)
+	}
+	if recorder := usage(apiKeyRouter(handler, 1, "admin"), "?days=60"); !strings.Contains(recorder.Body.String(), `"total_requests":4`) {
+		t.Errorf("usage over 60 days: %s", recorder.Body.String())
+	}
+	if recorder := usage(apiKeyRouter(handler, 1, "admin"), "?days=91"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("usage over 91 days: %d", recorder.Code)
+	}
+
+	// The usage of a key is visible to the owner of its project and to superadmins
+	if recorder := usage(apiKeyRouter(handler, 2, "admin"), ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("usage for another user: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := usage(apiKeyRouter(handler, 2, "superadmin"), ""); recorder.Code != http.StatusOK {
+		t.Errorf("usage for a superadmin: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
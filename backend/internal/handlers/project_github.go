@@ -500,7 +500,7 @@ func (h *ProjectGitHubHandler) renderOAuthResult(c *gin.Context, success bool, m
             align-items: center;
             min-height: 100vh;
             margin: 0;
-            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
             color: #fff;
         }
         .container {
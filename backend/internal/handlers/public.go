@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"mime"
@@ -13,23 +14,36 @@ import (
 
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 // PublicFileHandler handles public file serving requests
 type PublicFileHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db       *gorm.DB
+	cfg      *config.Config
+	backends *services.StorageBackends
+
+	signedURLs *services.SignedURLService
+	images     *services.ImageService
 }
 
 // NewPublicFileHandler creates a new public file handler
 func NewPublicFileHandler(db *gorm.DB, cfg *config.Config) *PublicFileHandler {
-	return &PublicFileHandler{db: db, cfg: cfg}
+	return &PublicFileHandler{
+		db:         db,
+		cfg:        cfg,
+		backends:   services.NewStorageBackends(cfg),
+		signedURLs: services.NewSignedURLService(db, cfg),
+		images:     services.NewImageService(cfg),
+	}
 }
 
-// ServePublicFile serves public files with security validation
-// GET /public/{project_id}/{bucket_name}/{file_path}
+// ServePublicFile serves public files with security validation, and files of private buckets
+// to requests with a signed URL. Images are transformed with a preset of the bucket
+// (?preset=name) or, where the bucket allows it, with w, h, fit, crop, format and q.
+// GET /public/{project_id}/{bucket_name}/{file_path}[?expires=...&signature=...]
 func (h *PublicFileHandler) ServePublicFile(c *gin.Context) {
 	projectIDStr := c.Param("project_id")
 	bucketName := c.Param("bucket_name")
@@ -60,6 +74,17 @@ func (h *PublicFileHandler) ServePublicFile(c *gin.Context) {
 		return
 	}
 
+	// A signed URL grants access to a file of any bucket
+	var signed *services.SignedURL
+	if c.Query("signature") != "" {
+		access, err := h.signedURLs.Verify(http.MethodGet, uint(projectID), bucketName, filePath, c.Request.URL.Query(), c.ClientIP())
+		if err != nil {
+			respondSignedURLError(c, err)
+			return
+		}
+		signed = &access
+	}
+
 	// 1. Validate project (fail fast)
 	project, err := h.validateActiveProject(uint(projectID))
 	if err != nil {
@@ -68,7 +93,12 @@ func (h *PublicFileHandler) ServePublicFile(c *gin.Context) {
 	}
 
 	// 2. Validate bucket (fail fast)
-	bucket, err := h.validatePublicBucket(project.ID, bucketName)
+	var bucket *models.Bucket
+	if signed != nil {
+		bucket, err = h.validateBucket(project.ID, bucketName)
+	} else {
+		bucket, err = h.validatePublicBucket(project.ID, bucketName)
+	}
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Bucket not found or not public"})
 		return
@@ -81,8 +111,146 @@ func (h *PublicFileHandler) ServePublicFile(c *gin.Context) {
 		return
 	}
 
+	transform, ok := h.resolveImageTransform(c, bucket)
+	if !ok {
+		return
+	}
+
+	// Every request through a URL with a download limit counts, range requests included
+	if signed != nil && signed.Grant != "" {
+		if err := h.signedURLs.UseGrant(signed.Grant, file.ID); err != nil {
+			respondSignedURLError(c, err)
+			return
+		}
+	}
+
 	// 4. Serve file with proper headers
-	h.serveFileWithCache(c, file, bucket)
+	if transform != nil {
+		h.serveImageVariant(c, file, signed, *transform)
+		return
+	}
+	h.serveFileWithCache(c, file, bucket, signed)
+}
+
+// resolveImageTransform returns the image transformation a request asks for, nil for none.
+// Buckets only accept their presets unless they allow any transformation.
+func (h *PublicFileHandler) resolveImageTransform(c *gin.Context, bucket *models.Bucket) (*models.ImageTransform, bool) {
+	if name := c.Query("preset"); name != "" {
+		preset, ok := bucket.ImagePresets[name]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown image preset"})
+			return nil, false
+		}
+		return &preset, true
+	}
+
+	transform, requested, err := services.ParseImageTransform(c.Request.URL.Query())
+	if !requested {
+		return nil, true
+	}
+	if !bucket.AllowImageTransforms {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This bucket only serves its image presets"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &transform, true
+}
+
+// serveImageVariant serves a transformed image, generating it on the first request
+func (h *PublicFileHandler) serveImageVariant(c *gin.Context, file *models.File, signed *services.SignedURL, transform models.ImageTransform) {
+	backend, err := h.backends.Get(file.StorageBackend)
+	if err != nil {
+		log.Printf("File %s: %v", file.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
+	}
+
+	variant, err := h.images.Variant(c.Request.Context(), *file, backend, transform)
+	switch {
+	case errors.Is(err, services.ErrInvalidImageTransform):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrNotAnImage):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "File is not a supported image"})
+		return
+	case errors.Is(err, services.ErrImageTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image too large to transform"})
+		return
+	case errors.Is(err, services.ErrWebPUnavailable):
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "WebP is not available on this server"})
+		return
+	case errors.Is(err, services.ErrObjectNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in storage"})
+		return
+	case err != nil:
+		log.Printf("Failed to transform %s: %v", file.FilePath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transform image"})
+		return
+	}
+
+	variantFile, err := os.Open(variant.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return
+	}
+	defer variantFile.Close()
+
+	c.Header("Content-Type", variant.ContentType)
+	c.Header("Cache-Control", publicCacheControl(signed))
+	c.Header("ETag", fmt.Sprintf(`"%s"`, variant.Key))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("X-Frame-Options", "SAMEORIGIN")
+	if signed != nil && signed.Disposition != "" {
+		fileName := signed.FileName
+		if fileName == "" {
+			fileName = strings.TrimSuffix(file.OriginalName, filepath.Ext(file.OriginalName)) + filepath.Ext(variant.Path)
+		}
+		c.Header("Content-Disposition", mime.FormatMediaType(signed.Disposition, map[string]string{"filename": fileName}))
+	}
+
+	// Variants change only with the original
+	http.ServeContent(c.Writer, c.Request, "", file.UpdatedAt, variantFile)
+}
+
+// activeContentTypes are the types browsers render as documents or run as scripts, which would
+// then act with the origin of the API
+var activeContentTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/xsl",
+	"text/javascript",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"text/ecmascript",
+}
+
+// isActiveContent tells whether content of a type must not be shown inline
+func isActiveContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	return contains(activeContentTypes, mediaType) || strings.HasSuffix(mediaType, "+xml")
+}
+
+// publicCacheControl returns the caching policy of the public file route
+func publicCacheControl(signed *services.SignedURL) string {
+	switch {
+	case signed == nil:
+		return "public, max-age=3600" // 1 hour browser cache
+	case signed.Grant != "":
+		return "no-store"
+	}
+	// Not beyond the expiry of the URL
+	maxAge := min(time.Until(signed.ExpiresAt), time.Hour)
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
 }
 
 // validateActiveProject checks if project exists and is active
@@ -103,13 +271,21 @@ func (h *PublicFileHandler) validatePublicBucket(projectID uint, bucketName stri
 	return &bucket, nil
 }
 
+// validateBucket checks if bucket exists, public or not
+func (h *PublicFileHandler) validateBucket(projectID uint, bucketName string) (*models.Bucket, error) {
+	var bucket models.Bucket
+	if err := h.db.Where("project_id = ? AND name = ?", projectID, bucketName).First(&bucket).Error; err != nil {
+		return nil, err
+	}
+	return &bucket, nil
+}
+
 // validateFile checks if file exists and belongs to project/bucket
 func (h *PublicFileHandler) validateFile(projectID uint, bucketName, filePath string) (*models.File, error) {
 	var file models.File
 	
-	// First try to find the file by filename (extract from file_path)
-	// The filePath parameter contains just the filename, but database stores full path
-	expectedFilePath := fmt.Sprintf("uploads/%d/%s/%s", projectID, bucketName, filePath)
+	// The filePath parameter is the path within the bucket, file_path the full object key
+	expectedFilePath := services.BucketPrefix(projectID, bucketName) + filePath
 	
 	if err := h.db.Where("project_id = ? AND bucket_name = ? AND file_path = ?", projectID, bucketName, expectedFilePath).First(&file).Error; err != nil {
 		return nil, err
@@ -117,23 +293,25 @@ func (h *PublicFileHandler) validateFile(projectID uint, bucketName, filePath st
 	return &file, nil
 }
 
-// serveFileWithCache serves the file with proper caching headers
-func (h *PublicFileHandler) serveFileWithCache(c *gin.Context, file *models.File, bucket *models.Bucket) {
-	// Build full file path - file.FilePath already contains the full path (uploads/project_id/bucket_name/filename)
-	fullPath := filepath.Join(".", file.FilePath)
-
-	// Check if file exists on disk
-	fileInfo, err := os.Stat(fullPath)
+// serveFileWithCache serves the file with proper caching headers; files served through a
+// signed URL are only cached privately and may have their disposition overridden
+func (h *PublicFileHandler) serveFileWithCache(c *gin.Context, file *models.File, bucket *models.Bucket, signed *services.SignedURL) {
+	backend, err := h.backends.Get(file.StorageBackend)
 	if err != nil {
-		log.Printf("File not found on disk: %s - %v", fullPath, err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found on disk"})
+		log.Printf("File %s: %v", file.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
 		return
 	}
 
-	// Open the file
-	fileHandle, err := os.Open(fullPath)
+	// Open the object
+	fileHandle, fileInfo, err := backend.Get(c.Request.Context(), file.FilePath)
+	if errors.Is(err, services.ErrObjectNotFound) {
+		log.Printf("File not found in storage: %s", file.FilePath)
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in storage"})
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to open file: %s - %v", fullPath, err)
+		log.Printf("Failed to open file: %s - %v", file.FilePath, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
 		return
 	}
@@ -147,9 +325,9 @@ func (h *PublicFileHandler) serveFileWithCache(c *gin.Context, file *models.File
 
 	// Set security and caching headers
 	c.Header("Content-Type", contentType)
-	c.Header("Cache-Control", "public, max-age=3600") // 1 hour browser cache
-	c.Header("Last-Modified", fileInfo.ModTime().UTC().Format(http.TimeFormat))
-	c.Header("ETag", fmt.Sprintf(`"%s-%d"`, file.ID, fileInfo.ModTime().Unix()))
+	c.Header("Cache-Control", publicCacheControl(signed))
+	c.Header("Last-Modified", fileInfo.ModTime.UTC().Format(http.TimeFormat))
+	c.Header("ETag", fmt.Sprintf(`"%s-%d"`, file.ID, fileInfo.ModTime.Unix()))
 	
 	// Security headers
 	c.Header("X-Content-Type-Options", "nosniff")
@@ -162,7 +340,7 @@ func (h *PublicFileHandler) serveFileWithCache(c *gin.Context, file *models.File
 
 	// Check if client has cached version (ETag)
 	if match := c.GetHeader("If-None-Match"); match != "" {
-		if match == fmt.Sprintf(`"%s-%d"`, file.ID, fileInfo.ModTime().Unix()) {
+		if match == fmt.Sprintf(`"%s-%d"`, file.ID, fileInfo.ModTime.Unix()) {
 			c.Status(http.StatusNotModified)
 			return
 		}
@@ -171,20 +349,34 @@ func (h *PublicFileHandler) serveFileWithCache(c *gin.Context, file *models.File
 	// Check if client has cached version (Last-Modified)
 	if modSince := c.GetHeader("If-Modified-Since"); modSince != "" {
 		if t, err := time.Parse(http.TimeFormat, modSince); err == nil {
-			if !fileInfo.ModTime().After(t) {
+			if !fileInfo.ModTime.After(t) {
 				c.Status(http.StatusNotModified)
 				return
 			}
 		}
 	}
 
-	// Set filename for downloads (not for images to allow embedding)
-	if !strings.HasPrefix(contentType, "image/") {
+	// Set filename for downloads (not for images to allow embedding). Content a browser would
+	// run is always downloaded, whatever disposition a signed URL asks for
+	disposition := ""
+	if signed != nil {
+		disposition = signed.Disposition
+	}
+	if isActiveContent(contentType) {
+		disposition = "attachment"
+	}
+	if disposition != "" {
+		fileName := file.OriginalName
+		if signed != nil && signed.FileName != "" {
+			fileName = signed.FileName
+		}
+		c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	} else if !strings.HasPrefix(contentType, "image/") {
 		c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, file.OriginalName))
 	}
 
 	// Serve the file content
-	http.ServeContent(c.Writer, c.Request, file.OriginalName, fileInfo.ModTime(), fileHandle)
+	serveObject(c, file.OriginalName, fileHandle, fileInfo)
 }
 
 // Public file access statistics (for future monitoring)
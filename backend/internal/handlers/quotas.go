@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// validateQuotaLimits rejects limits below -1; 0 inherits and -1 removes a limit
+func validateQuotaLimits(limits models.QuotaLimits) error {
+	for name, value := range map[string]float64{
+		services.QuotaStorageBytes:      float64(limits.StorageBytes),
+		services.QuotaDocuments:         float64(limits.Documents),
+		services.QuotaAppUsers:          float64(limits.AppUsers),
+		services.QuotaAPICalls:          float64(limits.APICalls),
+		services.QuotaFunctionGBSeconds: limits.FunctionGBSeconds,
+	} {
+		if value < -1 {
+			return fmt.Errorf("%s must be -1 (unlimited), 0 (inherit) or a positive limit", name)
+		}
+	}
+	return nil
+}
+
+// quotaColumns returns the columns of limits for UpdateColumns
+func quotaColumns(limits models.QuotaLimits) map[string]interface{} {
+	return map[string]interface{}{
+		"quota_storage_bytes":       limits.StorageBytes,
+		"quota_documents":           limits.Documents,
+		"quota_app_users":           limits.AppUsers,
+		"quota_api_calls":           limits.APICalls,
+		"quota_function_gb_seconds": limits.FunctionGBSeconds,
+	}
+}
+
+// usagePeriodParam returns the period query parameter (YYYY-MM), defaulting to this month
+func usagePeriodParam(c *gin.Context) (string, bool) {
+	period := c.DefaultQuery("period", services.UsagePeriod(time.Now()))
+	if _, err := time.Parse("2006-01", period); err != nil {
+		return "", false
+	}
+	return period, true
+}
+
+// exceededQuotas lists the quotas a project has used up
+func exceededQuotas(limits models.QuotaLimits, usage services.QuotaUsage) []string {
+	exceeded := []string{}
+	for _, quota := range []struct {
+		metric      string
+		limit, used float64
+	}{
+		{services.QuotaStorageBytes, float64(limits.StorageBytes), float64(usage.StorageBytes)},
+		{services.QuotaDocuments, float64(limits.Documents), float64(usage.Documents)},
+		{services.QuotaAppUsers, float64(limits.AppUsers), float64(usage.AppUsers)},
+		{services.QuotaAPICalls, float64(limits.APICalls), float64(usage.APICalls)},
+		{services.QuotaFunctionGBSeconds, limits.FunctionGBSeconds, usage.FunctionGBSeconds},
+	} {
+		if quota.limit > 0 && quota.used >= quota.limit {
+			exceeded = append(exceeded, quota.metric)
+		}
+	}
+	return exceeded
+}
+
+// GetUsage returns the usage report of a project for a calendar month: stored totals, metered
+// API calls and function GB-seconds, and the effective quotas
+func (h *ProjectHandler) GetUsage(c *gin.Context) {
+	projectID, err := utils.ParseProjectID(c)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	project, canAccess := h.canAccessProject(c, uint(projectID))
+	if !canAccess {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	period, ok := usagePeriodParam(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY-MM"})
+		return
+	}
+
+	limits, err := h.quotas.Limits(project)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load quotas"})
+		return
+	}
+	usage, err := h.quotas.Usage(project.ID, period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":   period,
+		"usage":    usage,
+		"limits":   limits,
+		"quotas":   project.Quotas,
+		"exceeded": exceededQuotas(limits, usage),
+	})
+}
+
+// UpdateQuotas sets the quotas of a project; limits of 0 inherit those of its organization
+func (h *ProjectHandler) UpdateQuotas(c *gin.Context) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	var req models.QuotaLimits
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateQuotaLimits(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quotas", "details": err.Error()})
+		return
+	}
+
+	result := h.db.Model(&models.Project{}).Where("id = ?", uint(projectID)).UpdateColumns(quotaColumns(req))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quotas"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	var project models.Project
+	if err := h.db.Where("id = ?", uint(projectID)).First(&project).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load project"})
+		return
+	}
+	limits, err := h.quotas.Limits(project)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load quotas"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quotas": project.Quotas, "limits": limits})
+}
+
+// GetUsage returns the usage of every project of an organization for a calendar month
+func (h *OrganizationHandler) GetUsage(c *gin.Context) {
+	orgID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	period, ok := usagePeriodParam(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY-MM"})
+		return
+	}
+
+	var organization models.Organization
+	query := h.db.Where("id = ?", orgID)
+	// Super admins can see any organization, others only their own
+	if c.GetString("user_role") != "superadmin" {
+		query = query.Where("user_id = ?", c.GetUint("user_id"))
+	}
+	if err := query.First(&organization).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	var projects []models.Project
+	if err := h.db.Where("organization_id = ?", organization.ID).Order("id").Find(&projects).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch projects"})
+		return
+	}
+
+	total := services.QuotaUsage{Period: period}
+	reports := make([]gin.H, 0, len(projects))
+	for _, project := range projects {
+		limits, err := h.quotas.Limits(project)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load quotas"})
+			return
+		}
+		usage, err := h.quotas.Usage(project.ID, period)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+			return
+		}
+
+		total.StorageBytes += usage.StorageBytes
+		total.Documents += usage.Documents
+		total.AppUsers += usage.AppUsers
+		total.APICalls += usage.APICalls
+		total.FunctionExecutions += usage.FunctionExecutions
+		total.FunctionGBSeconds += usage.FunctionGBSeconds
+
+		reports = append(reports, gin.H{
+			"project_id":   project.ID,
+			"project_name": project.Name,
+			"usage":        usage,
+			"limits":       limits,
+			"exceeded":     exceededQuotas(limits, usage),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":   period,
+		"quotas":   organization.Quotas,
+		"total":    total,
+		"projects": reports,
+	})
+}
+
+// UpdateQuotas sets the default quotas of the projects of an organization; limits of 0
+// inherit the server defaults
+func (h *OrganizationHandler) UpdateQuotas(c *gin.Context) {
+	orgID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return
+	}
+
+	var req models.QuotaLimits
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateQuotaLimits(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quotas", "details": err.Error()})
+		return
+	}
+
+	result := h.db.Model(&models.Organization{}).Where("id = ?", uint(orgID)).UpdateColumns(quotaColumns(req))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quotas"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	// Projects pick up organization quotas once their cached copy expires
+	c.JSON(http.StatusOK, gin.H{"quotas": req})
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudbox/backend/internal/middleware"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+)
+
+const maxRateLimitWindow = 24 * time.Hour
+
+// RateLimitRequest sets a rate limit; 0 requests removes it
+type RateLimitRequest struct {
+	Requests int    `json:"requests"`
+	Window   string `json:"window"` // Duration such as 1m or 1h
+}
+
+// windowSeconds validates a rate limit and returns its window in seconds
+func (r RateLimitRequest) windowSeconds() (int, error) {
+	if r.Requests < 0 {
+		return 0, fmt.Errorf("requests must not be negative")
+	}
+	if r.Requests == 0 {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(r.Window)
+	if err != nil || window < time.Second || window > maxRateLimitWindow {
+		return 0, fmt.Errorf("window must be a duration between 1s and %s, such as 1m", maxRateLimitWindow)
+	}
+	return int(math.Ceil(window.Seconds())), nil
+}
+
+// rateLimitResponse describes a rate limit and the limit it inherits
+func rateLimitResponse(requests, windowSeconds int, inherited services.RateLimitRule) gin.H {
+	response := gin.H{
+		"requests":  requests,
+		"window":    (time.Duration(windowSeconds) * time.Second).String(),
+		"inherited": gin.H{"requests": inherited.Requests, "window": inherited.Window.String()},
+	}
+	if requests == 0 {
+		response["window"] = ""
+		response["effective"] = response["inherited"]
+	} else {
+		response["effective"] = gin.H{"requests": requests, "window": response["window"]}
+	}
+	return response
+}
+
+// GetRateLimit returns the rate limit of each client of a project
+func (h *ProjectHandler) GetRateLimit(c *gin.Context) {
+	projectID, err := utils.ParseProjectID(c)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	project, canAccess := h.canAccessProject(c, uint(projectID))
+	if !canAccess {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rateLimitResponse(project.RateLimitRequests, project.RateLimitWindowSeconds,
+		middleware.DefaultRateLimitRule(h.cfg)))
+}
+
+// UpdateRateLimit sets the rate limit of each client of a project; API keys may override it
+func (h *ProjectHandler) UpdateRateLimit(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	projectID, err := utils.ParseProjectID(c)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	var req RateLimitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	windowSeconds, err := req.windowSeconds()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rate limit", "details": err.Error()})
+		return
+	}
+
+	result := h.db.Model(&models.Project{}).
+		Where("id = ? AND user_id = ?", uint(projectID), userID).
+		UpdateColumns(map[string]interface{}{
+			"rate_limit_requests":       req.Requests,
+			"rate_limit_window_seconds": windowSeconds,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rate limit"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rateLimitResponse(req.Requests, windowSeconds, middleware.DefaultRateLimitRule(h.cfg)))
+}
+
+// UpdateAPIKeyRateLimit sets the rate limit of an API key, overriding the limit of its project
+func (h *ProjectHandler) UpdateAPIKeyRateLimit(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	projectID, err := utils.ParseProjectID(c)
+	if err != nil {
+		utils.ResponseInvalidProjectID(c)
+		return
+	}
+
+	keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+
+	var req RateLimitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	windowSeconds, err := req.windowSeconds()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rate limit", "details": err.Error()})
+		return
+	}
+
+	// Verify project ownership
+	var project models.Project
+	if err := h.db.Where("id = ? AND user_id = ?", uint(projectID), userID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+
+	result := h.db.Model(&models.APIKey{}).
+		Where("id = ? AND project_id = ?", uint(keyID), project.ID).
+		UpdateColumns(map[string]interface{}{
+			"rate_limit_requests":       req.Requests,
+			"rate_limit_window_seconds": windowSeconds,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rate limit"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	// Cached copies of the key carry its limit
+	if err := services.NotifyAPIKeyChanged(h.db, uint(keyID)); err != nil {
+		log.Printf("Failed to announce rate limit change of API key %d: %v", keyID, err)
+	}
+
+	c.JSON(http.StatusOK, rateLimitResponse(req.Requests, windowSeconds, middleware.RateLimitRuleFor(h.cfg, project, nil)))
+}
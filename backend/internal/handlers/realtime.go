@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/middleware"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// RealtimeHandler issues the tickets browsers open realtime connections with
+type RealtimeHandler struct {
+	db  *gorm.DB
+	cfg *config.Config
+}
+
+// NewRealtimeHandler creates a new realtime handler
+func NewRealtimeHandler(db *gorm.DB, cfg *config.Config) *RealtimeHandler {
+	return &RealtimeHandler{db: db, cfg: cfg}
+}
+
+// CreateTicket issues a short-lived ticket for the credentials of the request, including the
+// app user session of a Session-Token header. Browsers cannot send headers on WebSocket and
+// EventSource connections, so they pass the ticket as the ticket query parameter of the
+// realtime endpoints instead.
+func (h *RealtimeHandler) CreateTicket(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	ticket := services.RealtimeTicket{ProjectID: project.ID}
+	if token := c.GetHeader("Session-Token"); token != "" {
+		session, err := findSession(h.db, project.ID, token, "")
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			return
+		}
+		ticket.SessionID = session.ID
+	}
+
+	if key, ok := c.Get("api_key"); ok {
+		ticket.APIKeyID = key.(models.APIKey).ID
+	} else {
+		ticket.UserID = c.GetUint("user_id")
+		ticket.Email = c.GetString("user_email")
+		ticket.Role = c.GetString("user_role")
+	}
+
+	token, expiresAt, err := services.IssueRealtimeTicket(h.cfg, ticket)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"ticket":     token,
+		"expires_at": expiresAt,
+	})
+}
+
+// findSession loads an active app user session by token, or by ID when sessionID is set
+func findSession(db *gorm.DB, projectID uint, token, sessionID string) (models.AppSession, error) {
+	var session models.AppSession
+	query := db.Where("project_id = ? AND expires_at > ? AND is_active = ?", projectID, time.Now(), true)
+	switch {
+	case sessionID != "":
+		query = query.Where("id = ?", sessionID)
+	case token != "":
+		query = query.Where("token = ?", token)
+	default:
+		return session, errors.New("session token required")
+	}
+	if err := query.First(&session).Error; err != nil {
+		return session, errors.New("invalid or expired session")
+	}
+	return session, nil
+}
+
+// sessionUser resolves the active app user of a session found like findSession
+func sessionUser(db *gorm.DB, projectID uint, token, sessionID string) (models.AppUser, error) {
+	var user models.AppUser
+	session, err := findSession(db, projectID, token, sessionID)
+	if err != nil {
+		return user, err
+	}
+
+	if err := db.Where("project_id = ? AND id = ? AND is_active = ?", projectID, session.UserID, true).
+		First(&user).Error; err != nil {
+		return user, errors.New("user not found")
+	}
+	return user, nil
+}
+
+// realtimeUpgrader accepts WebSocket handshakes from origins the project's CORS settings allow
+func realtimeUpgrader(cfg *config.Config, db *gorm.DB, projectID uint) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		CheckOrigin: func(r *http.Request) bool {
+			return middleware.ProjectOriginAllowed(cfg, db, projectID, r.Header.Get("Origin"))
+		},
+	}
+}
@@ -7,15 +7,18 @@ import (
 	"log"
 	"mime"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/middleware"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -23,13 +26,26 @@ import (
 
 // StorageHandler handles file storage requests
 type StorageHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db       *gorm.DB
+	cfg      *config.Config
+	quotas   *services.QuotaService
+	backends *services.StorageBackends
+	uploads  *services.UploadService
+
+	signedURLs *services.SignedURLService
 }
 
 // NewStorageHandler creates a new storage handler
 func NewStorageHandler(db *gorm.DB, cfg *config.Config) *StorageHandler {
-	return &StorageHandler{db: db, cfg: cfg}
+	return &StorageHandler{
+		db:       db,
+		cfg:      cfg,
+		quotas:   services.NewQuotaService(db, cfg),
+		backends: services.NewStorageBackends(cfg),
+		uploads:  services.NewUploadService(db, cfg),
+
+		signedURLs: services.NewSignedURLService(db, cfg),
+	}
 }
 
 // Bucket Management
@@ -57,6 +73,9 @@ func (h *StorageHandler) CreateBucket(c *gin.Context) {
 		MaxFileSize  *int64   `json:"max_file_size"`
 		AllowedTypes []string `json:"allowed_types"`
 		IsPublic     *bool    `json:"is_public"`
+		StorageBackend string `json:"storage_backend"` // Defaults to the server's storage backend
+		ImagePresets         map[string]models.ImageTransform `json:"image_presets"`
+		AllowImageTransforms bool                             `json:"allow_image_transforms"`
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -64,12 +83,25 @@ func (h *StorageHandler) CreateBucket(c *gin.Context) {
 		return
 	}
 	
+	if req.StorageBackend == "" {
+		req.StorageBackend = h.backends.Default()
+	}
+	if _, err := h.backends.Get(req.StorageBackend); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid storage backend", "available": h.backends.Names()})
+		return
+	}
+	
 	// Validate bucket name
 	if !isValidBucketName(req.Name) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bucket name. Use only letters, numbers, hyphens, and underscores"})
 		return
 	}
 	
+	if err := validateImagePresets(req.ImagePresets); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
 	// Check if bucket already exists
 	var existingBucket models.Bucket
 	if err := h.db.Where("project_id = ? AND name = ?", project.ID, req.Name).First(&existingBucket).Error; err == nil {
@@ -99,6 +131,9 @@ func (h *StorageHandler) CreateBucket(c *gin.Context) {
 		MaxFileSize:  maxFileSize,
 		AllowedTypes: req.AllowedTypes,
 		IsPublic:     isPublic,
+		StorageBackend: req.StorageBackend,
+		ImagePresets:         req.ImagePresets,
+		AllowImageTransforms: req.AllowImageTransforms,
 		ProjectID:    project.ID,
 		FileCount:    0,
 		TotalSize:    0,
@@ -110,15 +145,7 @@ func (h *StorageHandler) CreateBucket(c *gin.Context) {
 		return
 	}
 	
-	// Create bucket directory on filesystem
-	bucketPath := filepath.Join("./uploads", strconv.Itoa(int(project.ID)), req.Name)
-	if err := os.MkdirAll(bucketPath, 0755); err != nil {
-		log.Printf("Failed to create bucket directory '%s': %v", bucketPath, err)
-		// Don't fail the request if directory creation fails - it might already exist
-		// or the filesystem might be read-only in some deployments
-		log.Printf("Warning: Bucket created in database but directory creation failed")
-	}
-	
+	// Backends create the bucket's objects on demand
 	c.JSON(http.StatusCreated, bucket)
 }
 
@@ -146,6 +173,8 @@ func (h *StorageHandler) UpdateBucket(c *gin.Context) {
 		MaxFileSize  *int64   `json:"max_file_size"`
 		AllowedTypes []string `json:"allowed_types"`
 		IsPublic     *bool    `json:"is_public"`
+		ImagePresets         map[string]models.ImageTransform `json:"image_presets"` // Replaces all presets
+		AllowImageTransforms *bool                            `json:"allow_image_transforms"`
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -181,6 +210,18 @@ func (h *StorageHandler) UpdateBucket(c *gin.Context) {
 		bucket.IsPublic = *req.IsPublic
 	}
 	
+	if req.ImagePresets != nil {
+		if err := validateImagePresets(req.ImagePresets); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		bucket.ImagePresets = req.ImagePresets
+	}
+	
+	if req.AllowImageTransforms != nil {
+		bucket.AllowImageTransforms = *req.AllowImageTransforms
+	}
+	
 	// Save the updated bucket
 	if err := h.db.Save(&bucket).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update bucket"})
@@ -197,6 +238,14 @@ func (h *StorageHandler) DeleteBucket(c *gin.Context) {
 	project := c.MustGet("project").(models.Project)
 	bucketName := c.Param("bucket")
 	
+	// Remember where the objects live before the records go
+	var files []models.File
+	h.db.Select("id", "file_path", "storage_backend").
+		Where("project_id = ? AND bucket_name = ?", project.ID, bucketName).Find(&files)
+	var bucketBackend string
+	h.db.Model(&models.Bucket{}).Where("project_id = ? AND name = ?", project.ID, bucketName).
+		Pluck("storage_backend", &bucketBackend)
+	
 	// Start transaction
 	tx := h.db.Begin()
 	defer func() {
@@ -228,9 +277,18 @@ func (h *StorageHandler) DeleteBucket(c *gin.Context) {
 	
 	tx.Commit()
 	
-	// Remove bucket directory from filesystem
-	bucketPath := filepath.Join("./uploads", strconv.Itoa(int(project.ID)), bucketName)
-	os.RemoveAll(bucketPath)
+	// Remove the objects, including folder markers, from every backend holding some
+	ctx := c.Request.Context()
+	for _, file := range files {
+		if backend, err := h.backends.Get(file.StorageBackend); err == nil {
+			backend.Delete(ctx, file.FilePath)
+		}
+	}
+	if backend, err := h.backends.Get(bucketBackend); err == nil {
+		if err := services.DeletePrefix(ctx, backend, services.BucketPrefix(project.ID, bucketName)); err != nil {
+			log.Printf("Failed to delete objects of bucket '%s': %v", bucketName, err)
+		}
+	}
 	
 	c.JSON(http.StatusOK, gin.H{"message": "Bucket deleted successfully"})
 }
@@ -251,7 +309,7 @@ func (h *StorageHandler) ListFiles(c *gin.Context) {
 	// Parse query parameters
 	limit := 25 // Default limit
 	offset := 0
-	orderBy := "created_at DESC"
+	orderColumn, orderDesc := "created_at", true
 	path := c.Query("path") // Optional path parameter for folder filtering
 	
 	if l := c.Query("limit"); l != "" {
@@ -267,9 +325,12 @@ func (h *StorageHandler) ListFiles(c *gin.Context) {
 	}
 	
 	if order := c.Query("orderBy"); order != "" {
-		// Simple validation for order by
-		if strings.Contains(order, "created_at") || strings.Contains(order, "original_name") || strings.Contains(order, "size") {
-			orderBy = order
+		// Strict validation for order by to prevent SQL injection
+		validOrderPattern := regexp.MustCompile(`^(created_at|original_name|size)(\s+(ASC|DESC))?$`)
+		if validOrderPattern.MatchString(strings.TrimSpace(order)) {
+			fields := strings.Fields(order)
+			orderColumn = fields[0]
+			orderDesc = len(fields) == 2 && fields[1] == "DESC"
 		}
 	}
 	
@@ -282,27 +343,91 @@ func (h *StorageHandler) ListFiles(c *gin.Context) {
 		}
 	}
 	
-	var files []models.File
-	query := h.db.Where("project_id = ? AND bucket_name = ? AND folder_path = ?", project.ID, bucketName, path).
-		Limit(limit).
-		Offset(offset).
-		Order(orderBy)
+	sortKeys := []keysetKey{fileColumnKey(orderColumn, orderDesc), fileColumnKey("id", orderDesc)}
+	page, err := newKeysetPage(sortKeys, c.Query("cursor"), limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor", "details": err.Error()})
+		return
+	}
+	
+	query := h.db.Model(&models.File{}).
+		Where("project_id = ? AND bucket_name = ? AND folder_path = ?", project.ID, bucketName, path).
+		Session(&gorm.Session{})
 	
-	if err := query.Find(&files).Error; err != nil {
+	// Offset only applies to the first page; once a cursor is given it takes over
+	pageQuery := page.apply(query)
+	if page.after == nil && offset > 0 {
+		pageQuery = pageQuery.Offset(offset)
+	}
+	
+	var files []models.File
+	if err := pageQuery.Find(&files).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
 		return
 	}
 	
-	// Get total count
-	var total int64
-	h.db.Model(&models.File{}).Where("project_id = ? AND bucket_name = ? AND folder_path = ?", project.ID, bucketName, path).Count(&total)
+	size, more := page.window(len(files))
+	files = files[:size]
+	if page.backward {
+		slices.Reverse(files)
+	}
+	
+	var nextCursor, prevCursor string
+	if len(files) > 0 {
+		first := fileKeyValues(files[0], sortKeys)
+		last := fileKeyValues(files[len(files)-1], sortKeys)
+		nextCursor, prevCursor = page.cursors(first, last, more, page.after == nil && offset > 0)
+	}
 	
-	c.JSON(http.StatusOK, gin.H{
-		"files":  files,
-		"total":  total,
-		"limit":  limit,
-		"offset": offset,
-	})
+	response := gin.H{
+		"files":       files,
+		"limit":       limit,
+		"offset":      offset,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	}
+	
+	// Get total count unless the client opted out
+	if c.Query("skip_total") != "true" {
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count files"})
+			return
+		}
+		response["total"] = total
+	}
+	
+	c.JSON(http.StatusOK, response)
+}
+
+// fileColumnKey returns the keyset sort key for a file column
+func fileColumnKey(column string, desc bool) keysetKey {
+	key := keysetKey{expr: column, desc: desc, kind: keysetString, column: column}
+	switch column {
+	case "created_at":
+		key.kind = keysetTime
+	case "size":
+		key.kind = keysetInt
+	}
+	return key
+}
+
+// fileKeyValues reads the sort key values of a file for building cursors
+func fileKeyValues(file models.File, keys []keysetKey) []interface{} {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		switch key.column {
+		case "created_at":
+			values[i] = file.CreatedAt
+		case "original_name":
+			values[i] = file.OriginalName
+		case "size":
+			values[i] = file.Size
+		default:
+			values[i] = file.ID
+		}
+	}
+	return values
 }
 
 // UploadFile handles file upload to a bucket
@@ -325,15 +450,18 @@ func (h *StorageHandler) UploadFile(c *gin.Context) {
 	}
 	defer file.Close()
 	
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		log.Printf("Bucket '%s' of project %d: %v", bucketName, project.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
+	}
+	
 	// Get optional path parameter for folder uploads
-	uploadPath := c.PostForm("path")
-	if uploadPath != "" {
-		// Clean and validate path
-		uploadPath = filepath.Clean(uploadPath)
-		if strings.Contains(uploadPath, "..") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload path"})
-			return
-		}
+	uploadPath, ok := cleanFolderPath(c.PostForm("path"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload path"})
+		return
 	}
 	
 	// Validate file size
@@ -344,6 +472,10 @@ func (h *StorageHandler) UploadFile(c *gin.Context) {
 		return
 	}
 	
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaStorageBytes, float64(header.Size))) {
+		return
+	}
+	
 	// Validate MIME type with content inspection (not just header)
 	if len(bucket.AllowedTypes) > 0 {
 		// Read first 512 bytes to detect actual content type
@@ -351,37 +483,7 @@ func (h *StorageHandler) UploadFile(c *gin.Context) {
 		n, _ := file.Read(buffer)
 		file.Seek(0, 0) // Reset file position
 		
-		// Detect MIME type from content
-		actualMimeType := http.DetectContentType(buffer[:n])
-		
-		// Also check file extension
-		extension := filepath.Ext(header.Filename)
-		extMimeType := mime.TypeByExtension(extension)
-		
-		// Create list of potential MIME types to check
-		var mimeTypesToCheck []string
-		mimeTypesToCheck = append(mimeTypesToCheck, actualMimeType)
-		if extMimeType != "" {
-			mimeTypesToCheck = append(mimeTypesToCheck, extMimeType)
-		}
-		
-		// Special handling for SVG files - they can be detected as text/xml or image/svg+xml
-		if strings.Contains(strings.ToLower(header.Filename), ".svg") || 
-		   strings.Contains(actualMimeType, "xml") || 
-		   strings.Contains(extMimeType, "svg") {
-			mimeTypesToCheck = append(mimeTypesToCheck, "image/svg+xml", "image/svg", "text/xml")
-		}
-		
-		// Check if any of the MIME types are allowed
-		isAllowed := false
-		for _, mimeType := range mimeTypesToCheck {
-			if contains(bucket.AllowedTypes, mimeType) {
-				isAllowed = true
-				break
-			}
-		}
-		
-		if !isAllowed {
+		if actualMimeType, isAllowed := bucketAllowsType(bucket, header.Filename, buffer[:n]); !isAllowed {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error": fmt.Sprintf("File type not allowed. Detected: %s, Allowed: %v", actualMimeType, bucket.AllowedTypes),
 			})
@@ -391,101 +493,106 @@ func (h *StorageHandler) UploadFile(c *gin.Context) {
 	
 	// Generate secure file info
 	fileID := uuid.New().String()
-	safeOriginalName := sanitizeFileName(header.Filename)
-	
-	// Use only the file ID and extension for storage (prevents any filename attacks)
-	extension := filepath.Ext(safeOriginalName)
-	if extension == "" {
-		// Try to determine extension from MIME type if not present
-		if exts, err := mime.ExtensionsByType(http.DetectContentType(make([]byte, 512))); err == nil && len(exts) > 0 {
-			extension = exts[0]
-		}
-	}
+	fileName := storedFileName(fileID, header.Filename)
 	
-	fileName := fmt.Sprintf("%s%s", fileID, extension)
+	// The object key is derived from validated components only
+	filePath := services.ObjectKey(project.ID, bucketName, uploadPath, fileName)
+	ctx := c.Request.Context()
 	
-	// Secure file path construction with validation
-	baseDir := filepath.Clean("./uploads")
-	projectDir := filepath.Clean(strconv.Itoa(int(project.ID)))
-	bucketDir := filepath.Clean(bucketName)
-	
-	// Prevent directory traversal
-	if strings.Contains(projectDir, "..") || strings.Contains(bucketDir, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path components"})
-		return
-	}
-	
-	// Construct file path with optional upload path (folder)
-	var filePath string
-	if uploadPath != "" {
-		filePath = filepath.Join(baseDir, projectDir, bucketDir, uploadPath, fileName)
-	} else {
-		filePath = filepath.Join(baseDir, projectDir, bucketDir, fileName)
-	}
-	
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
-		return
-	}
-	
-	// Save file to disk
-	dst, err := os.Create(filePath)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file"})
-		return
-	}
-	defer dst.Close()
-	
-	// Copy file with size limit and calculate secure checksum
+	// Store the file, calculating a secure checksum on the way. The backend is told the
+	// declared size and rejects bodies of any other length, oversized ones included.
 	hasher := sha256.New() // Use SHA256 instead of MD5 for better security
-	multiWriter := io.MultiWriter(dst, hasher)
-	
-	// Limit copy size to prevent resource exhaustion
 	limitedReader := io.LimitReader(file, bucket.MaxFileSize+1) // +1 to detect size exceeded
-	
-	bytesWritten, err := io.Copy(multiWriter, limitedReader)
-	if err != nil {
-		os.Remove(filePath) // Cleanup on error
+	if err := backend.Put(ctx, filePath, io.TeeReader(limitedReader, hasher), header.Size, header.Header.Get("Content-Type")); err != nil {
+		log.Printf("Failed to store %s in %s: %v", filePath, backend.Name(), err)
+		backend.Delete(ctx, filePath) // Cleanup on error
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 	
-	// Double-check file size after writing
-	if bytesWritten > bucket.MaxFileSize {
-		os.Remove(filePath) // Cleanup oversized file
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File size exceeded limit during upload"})
-		return
-	}
-	
 	checksum := fmt.Sprintf("%x", hasher.Sum(nil))
 	
-	// Verify file integrity
-	if bytesWritten != header.Size {
-		log.Printf("File size mismatch: expected %d, got %d", header.Size, bytesWritten)
-		os.Remove(filePath)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File upload integrity check failed"})
+	// Create file record
+	fileRecord := newFileRecord(c, project, bucket, uploadPath, fileID, fileName, header.Filename,
+		header.Header.Get("Content-Type"), header.Size, checksum, backend.Name())
+	
+	if err := h.db.Create(&fileRecord).Error; err != nil {
+		backend.Delete(ctx, filePath) // Cleanup on error
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file record"})
 		return
 	}
 	
-	// Get author info - could be from API key or JWT
-	var author string
+	// Update bucket statistics
+	h.updateBucketStats(project.ID, bucketName)
+	
+	c.JSON(http.StatusCreated, fileRecord)
+}
+
+// bucketAllowsType checks a file against the allowed types of a bucket by its name and the
+// type detected from its first 512 bytes, which it returns
+func bucketAllowsType(bucket models.Bucket, fileName string, head []byte) (string, bool) {
+	// Detect MIME type from content
+	actualMimeType := http.DetectContentType(head)
+	
+	// Also check file extension
+	extension := filepath.Ext(fileName)
+	extMimeType := mime.TypeByExtension(extension)
+	
+	// Create list of potential MIME types to check
+	var mimeTypesToCheck []string
+	mimeTypesToCheck = append(mimeTypesToCheck, actualMimeType)
+	if extMimeType != "" {
+		mimeTypesToCheck = append(mimeTypesToCheck, extMimeType)
+	}
+	
+	// Special handling for SVG files - they can be detected as text/xml or image/svg+xml
+	if strings.Contains(strings.ToLower(fileName), ".svg") || 
+	   strings.Contains(actualMimeType, "xml") || 
+	   strings.Contains(extMimeType, "svg") {
+		mimeTypesToCheck = append(mimeTypesToCheck, "image/svg+xml", "image/svg", "text/xml")
+	}
+	
+	// Check if any of the MIME types are allowed
+	for _, mimeType := range mimeTypesToCheck {
+		if contains(bucket.AllowedTypes, mimeType) {
+			return actualMimeType, true
+		}
+	}
+	return actualMimeType, false
+}
+
+// storedFileName returns the name a file is stored under: its ID and extension only, which
+// prevents any filename attacks
+func storedFileName(fileID, originalName string) string {
+	extension := filepath.Ext(sanitizeFileName(originalName))
+	if extension == "" {
+		// Try to determine extension from MIME type if not present
+		if exts, err := mime.ExtensionsByType(http.DetectContentType(make([]byte, 512))); err == nil && len(exts) > 0 {
+			extension = exts[0]
+		}
+	}
+	return fmt.Sprintf("%s%s", fileID, extension)
+}
+
+// uploadAuthor describes who uploads a file - could be from API key or JWT
+func uploadAuthor(c *gin.Context) string {
 	if apiKeyInterface, exists := c.Get("api_key"); exists {
 		if apiKey, ok := apiKeyInterface.(models.APIKey); ok {
-			author = fmt.Sprintf("api_key:%s", apiKey.Name)
-		} else {
-			author = "api_key:unknown"
+			return fmt.Sprintf("api_key:%s", apiKey.Name)
 		}
-	} else if userInterface, exists := c.Get("user"); exists {
+		return "api_key:unknown"
+	}
+	if userInterface, exists := c.Get("user"); exists {
 		if user, ok := userInterface.(models.User); ok {
-			author = fmt.Sprintf("user:%s", user.Email)
-		} else {
-			author = "user:unknown"
+			return fmt.Sprintf("user:%s", user.Email)
 		}
-	} else {
-		author = "unknown"
+		return "user:unknown"
 	}
-	
+	return "unknown"
+}
+
+// newFileRecord describes a file stored in a bucket, with URLs for the host of the request
+func newFileRecord(c *gin.Context, project models.Project, bucket models.Bucket, folder, fileID, fileName, originalName, mimeType string, size int64, checksum, backend string) models.File {
 	// Generate URLs with proper host
 	host := c.Request.Host
 	scheme := "http"
@@ -495,40 +602,29 @@ func (h *StorageHandler) UploadFile(c *gin.Context) {
 	baseURL := fmt.Sprintf("%s://%s", scheme, host)
 	
 	publicURL := ""
-	privateURL := fmt.Sprintf("%s/p/%s/api/storage/%s/files/%s", baseURL, strconv.Itoa(int(project.ID)), bucketName, fileID)
+	privateURL := fmt.Sprintf("%s/p/%s/api/storage/%s/files/%s", baseURL, strconv.Itoa(int(project.ID)), bucket.Name, fileID)
 	
 	if bucket.IsPublic {
-		publicURL = fmt.Sprintf("%s/public/%s/%s/%s", baseURL, strconv.Itoa(int(project.ID)), bucketName, fileName)
+		publicURL = fmt.Sprintf("%s/public/%s/%s/%s", baseURL, strconv.Itoa(int(project.ID)), bucket.Name, path.Join(folder, fileName))
 	}
 	
-	// Create file record
-	fileRecord := models.File{
+	return models.File{
 		ID:           fileID,
-		OriginalName: header.Filename,
+		OriginalName: originalName,
 		FileName:     fileName,
-		FilePath:     filePath,
-		FolderPath:   uploadPath, // Store the folder path within bucket
-		MimeType:     header.Header.Get("Content-Type"),
-		Size:         header.Size,
+		FilePath:     services.ObjectKey(project.ID, bucket.Name, folder, fileName),
+		FolderPath:   folder, // Store the folder path within bucket
+		MimeType:     mimeType,
+		Size:         size,
 		Checksum:     checksum,
-		BucketName:   bucketName,
+		BucketName:   bucket.Name,
 		ProjectID:    project.ID,
+		StorageBackend: backend,
 		IsPublic:     bucket.IsPublic,
-		Author:       author,
+		Author:       uploadAuthor(c),
 		PublicURL:    publicURL,
 		PrivateURL:   privateURL,
 	}
-	
-	if err := h.db.Create(&fileRecord).Error; err != nil {
-		os.Remove(filePath) // Cleanup on error
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file record"})
-		return
-	}
-	
-	// Update bucket statistics
-	h.updateBucketStats(project.ID, bucketName)
-	
-	c.JSON(http.StatusCreated, fileRecord)
 }
 
 // GetFile downloads a file
@@ -544,18 +640,51 @@ func (h *StorageHandler) GetFile(c *gin.Context) {
 		return
 	}
 	
-	// Check if file exists on disk
-	if _, err := os.Stat(file.FilePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found on disk"})
+	body, info, err := h.openFile(c, file)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in storage"})
 		return
 	}
+	defer body.Close()
 	
 	// Set headers for file download
 	c.Header("Content-Type", file.MimeType)
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file.OriginalName))
-	c.Header("Content-Length", fmt.Sprintf("%d", file.Size))
 	
-	c.File(file.FilePath)
+	serveObject(c, file.OriginalName, body, info)
+}
+
+// openFile opens the object of a file in the backend holding it
+func (h *StorageHandler) openFile(c *gin.Context, file models.File) (io.ReadCloser, services.ObjectInfo, error) {
+	backend, err := h.backends.Get(file.StorageBackend)
+	if err != nil {
+		return nil, services.ObjectInfo{}, err
+	}
+	body, info, err := backend.Get(c.Request.Context(), file.FilePath)
+	if err != nil {
+		log.Printf("Failed to open %s in %s: %v", file.FilePath, backend.Name(), err)
+	}
+	return body, info, err
+}
+
+// serveObject writes an opened object; objects that can seek (local files) support range and
+// conditional requests
+func serveObject(c *gin.Context, name string, body io.Reader, info services.ObjectInfo) {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, name, info.ModTime, seeker)
+		return
+	}
+	
+	if !info.ModTime.IsZero() {
+		c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if info.Size >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	c.Status(http.StatusOK)
+	if c.Request.Method != http.MethodHead {
+		io.Copy(c.Writer, body)
+	}
 }
 
 // MoveFile moves a file to a different folder within the same bucket
@@ -574,13 +703,10 @@ func (h *StorageHandler) MoveFile(c *gin.Context) {
 	}
 
 	// Clean and validate the new path
-	newPath := req.NewFolderPath
-	if newPath != "" {
-		newPath = filepath.Clean(newPath)
-		if strings.Contains(newPath, "..") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder path"})
-			return
-		}
+	newPath, ok := cleanFolderPath(req.NewFolderPath)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder path"})
+		return
 	}
 
 	// Find the file
@@ -597,29 +723,19 @@ func (h *StorageHandler) MoveFile(c *gin.Context) {
 		return
 	}
 
-	// Construct the new file path on disk
-	baseDir := filepath.Join("./uploads", strconv.Itoa(int(project.ID)), bucketName)
-	oldFilePath := file.FilePath
-	
-	var newFilePath string
-	if newPath != "" {
-		newFilePath = filepath.Join(baseDir, newPath, file.FileName)
-	} else {
-		newFilePath = filepath.Join(baseDir, file.FileName)
-	}
-
-	// Ensure the new directory exists
-	if newPath != "" {
-		newDirPath := filepath.Join(baseDir, newPath)
-		if err := os.MkdirAll(newDirPath, 0755); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create target directory"})
-			return
-		}
+	backend, err := h.backends.Get(file.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
 	}
 
-	// Move the file on disk
-	if err := os.Rename(oldFilePath, newFilePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file on disk"})
+	// Object stores cannot rename: copy the object to its new key, then drop the old one
+	ctx := c.Request.Context()
+	oldFilePath := file.FilePath
+	newFilePath := services.ObjectKey(project.ID, bucketName, newPath, file.FileName)
+	if _, err := services.CopyObject(ctx, backend, oldFilePath, backend, newFilePath); err != nil {
+		log.Printf("Failed to move %s to %s: %v", oldFilePath, newFilePath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file in storage"})
 		return
 	}
 
@@ -628,11 +744,12 @@ func (h *StorageHandler) MoveFile(c *gin.Context) {
 	file.FilePath = newFilePath
 
 	if err := h.db.Save(&file).Error; err != nil {
-		// Try to move the file back if database update fails
-		os.Rename(newFilePath, oldFilePath)
+		// Drop the copy if database update fails
+		backend.Delete(ctx, newFilePath)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file record"})
 		return
 	}
+	backend.Delete(ctx, oldFilePath)
 
 	c.JSON(http.StatusOK, file)
 }
@@ -656,8 +773,12 @@ func (h *StorageHandler) DeleteFile(c *gin.Context) {
 		return
 	}
 	
-	// Delete file from disk
-	os.Remove(file.FilePath)
+	// Delete file from storage
+	if backend, err := h.backends.Get(file.StorageBackend); err == nil {
+		if err := backend.Delete(c.Request.Context(), file.FilePath); err != nil {
+			log.Printf("Failed to delete %s from %s: %v", file.FilePath, backend.Name(), err)
+		}
+	}
 	
 	// Update bucket statistics
 	h.updateBucketStats(project.ID, bucketName)
@@ -702,45 +823,40 @@ func (h *StorageHandler) CreateFolder(c *gin.Context) {
 	}
 	
 	// Construct folder path
-	basePath := filepath.Join("./uploads", strconv.Itoa(int(project.ID)), bucketName)
-	var folderPath string
-	
-	if req.Path != "" {
-		// Clean and validate parent path
-		parentPath := filepath.Clean(req.Path)
-		if strings.Contains(parentPath, "..") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent path"})
-			return
-		}
-		folderPath = filepath.Join(basePath, parentPath, req.Name)
-	} else {
-		folderPath = filepath.Join(basePath, req.Name)
+	parentPath, ok := cleanFolderPath(req.Path)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent path"})
+		return
+	}
+	relativePath := path.Join(parentPath, req.Name)
+	
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
 	}
 	
 	// Check if folder already exists
-	if _, err := os.Stat(folderPath); err == nil {
+	ctx := c.Request.Context()
+	prefix := folderPrefix(project.ID, bucketName, relativePath)
+	existing, err := backend.List(ctx, prefix)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
+		return
+	}
+	if len(existing) > 0 {
 		c.JSON(http.StatusConflict, gin.H{"error": "Folder already exists"})
 		return
 	}
 	
-	// Create the folder
-	log.Printf("DEBUG: Creating folder at path: '%s'", folderPath)
-	if err := os.MkdirAll(folderPath, 0755); err != nil {
+	// Create the folder; a marker object keeps it listed while empty
+	log.Printf("DEBUG: Creating folder at key: '%s'", prefix)
+	if err := backend.Put(ctx, prefix+services.FolderMarker, strings.NewReader(""), 0, "application/x-directory"); err != nil {
 		log.Printf("DEBUG: Failed to create folder: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
 		return
 	}
 	
-	log.Printf("DEBUG: Folder created successfully at: '%s'", folderPath)
-	
-	// Return success response
-	relativePath := req.Path
-	if relativePath != "" {
-		relativePath = filepath.Join(relativePath, req.Name)
-	} else {
-		relativePath = req.Name
-	}
-	
 	c.JSON(http.StatusCreated, gin.H{
 		"name": req.Name,
 		"path": relativePath,
@@ -752,71 +868,82 @@ func (h *StorageHandler) CreateFolder(c *gin.Context) {
 func (h *StorageHandler) ListFolders(c *gin.Context) {
 	project := c.MustGet("project").(models.Project)
 	bucketName := c.Param("bucket")
-	path := c.Query("path") // Optional path parameter
+	folderPath := c.Query("path") // Optional path parameter
 	
 	// Verify bucket exists
-	if !h.bucketExists(project.ID, bucketName) {
+	var bucket models.Bucket
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, bucketName).First(&bucket).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
 		return
 	}
 	
-	// Construct directory path
-	basePath := filepath.Join("./uploads", strconv.Itoa(int(project.ID)), bucketName)
-	var targetPath string
+	// Clean and validate path
+	cleanPath, ok := cleanFolderPath(folderPath)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
 	
-	if path != "" {
-		// Clean and validate path
-		cleanPath := filepath.Clean(path)
-		if strings.Contains(cleanPath, "..") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
-			return
-		}
-		targetPath = filepath.Join(basePath, cleanPath)
-	} else {
-		targetPath = basePath
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
 	}
 	
-	// Read directory
-	entries, err := os.ReadDir(targetPath)
+	prefix := folderPrefix(project.ID, bucketName, cleanPath)
+	objects, err := backend.List(c.Request.Context(), prefix)
 	if err != nil {
-		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read directory"})
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read directory"})
+		return
+	}
+	if len(objects) == 0 && cleanPath != "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
 		return
 	}
 	
-	var folders []gin.H
-	for _, entry := range entries {
-		if entry.IsDir() {
-			// Get folder info
-			folderPath := filepath.Join(targetPath, entry.Name())
-			info, err := entry.Info()
-			if err != nil {
-				continue
-			}
-			
-			// Count files in folder (recursive)
-			fileCount := countFilesInDirectory(folderPath)
-			
-			relativePath := entry.Name()
-			if path != "" {
-				relativePath = filepath.Join(path, entry.Name())
-			}
-			
-			folders = append(folders, gin.H{
-				"name":         entry.Name(),
-				"path":         relativePath,
-				"created_at":   info.ModTime(),
-				"file_count":   fileCount,
-			})
+	// Folders are the first key segments below the path; their objects are counted recursively
+	type folderInfo struct {
+		createdAt time.Time
+		fileCount int
+	}
+	found := map[string]*folderInfo{}
+	for _, object := range objects {
+		name, rest, nested := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+		if !nested {
+			continue
+		}
+		info, ok := found[name]
+		if !ok {
+			info = &folderInfo{createdAt: object.ModTime}
+			found[name] = info
+		}
+		if object.ModTime.Before(info.createdAt) {
+			info.createdAt = object.ModTime
+		}
+		if path.Base(rest) != services.FolderMarker {
+			info.fileCount++
 		}
 	}
 	
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	
+	var folders []gin.H
+	for _, name := range names {
+		folders = append(folders, gin.H{
+			"name":         name,
+			"path":         path.Join(cleanPath, name),
+			"created_at":   found[name].createdAt,
+			"file_count":   found[name].fileCount,
+		})
+	}
+	
 	c.JSON(http.StatusOK, gin.H{
 		"folders": folders,
-		"path":    path,
+		"path":    folderPath,
 	})
 }
 
@@ -832,38 +959,67 @@ func (h *StorageHandler) DeleteFolder(c *gin.Context) {
 	}
 	
 	// Verify bucket exists
-	if !h.bucketExists(project.ID, bucketName) {
+	var bucket models.Bucket
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, bucketName).First(&bucket).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
 		return
 	}
 	
 	// Clean and validate path
-	cleanPath := filepath.Clean(folderPath)
-	if strings.Contains(cleanPath, "..") {
+	cleanPath, ok := cleanFolderPath(folderPath)
+	if !ok || cleanPath == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder path"})
 		return
 	}
 	
-	// Construct full path
-	basePath := filepath.Join("./uploads", strconv.Itoa(int(project.ID)), bucketName)
-	fullPath := filepath.Join(basePath, cleanPath)
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
+	}
+	
+	// Files of the folder and its subfolders, which may live in another backend while the
+	// bucket is migrated
+	var files []models.File
+	if err := h.db.Where("project_id = ? AND bucket_name = ? AND (folder_path = ? OR folder_path LIKE ?)",
+		project.ID, bucketName, cleanPath, likePrefix(cleanPath+"/")).Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+	
+	ctx := c.Request.Context()
+	prefix := folderPrefix(project.ID, bucketName, cleanPath)
+	objects, err := backend.List(ctx, prefix)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
 	
 	// Check if folder exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	if len(objects) == 0 && len(files) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
 		return
 	}
 	
 	// Delete folder and all contents
-	if err := os.RemoveAll(fullPath); err != nil {
+	for _, file := range files {
+		if fileBackend, err := h.backends.Get(file.StorageBackend); err == nil {
+			fileBackend.Delete(ctx, file.FilePath)
+		}
+	}
+	if err := services.DeletePrefix(ctx, backend, prefix); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
 		return
 	}
 	
 	// Delete file records for files that were in this folder
-	folderPrefix := cleanPath + "/"
-	h.db.Where("project_id = ? AND bucket_name = ? AND file_path LIKE ?", 
-		project.ID, bucketName, "%"+folderPrefix+"%").Delete(&models.File{})
+	if len(files) > 0 {
+		ids := make([]string, len(files))
+		for i, file := range files {
+			ids[i] = file.ID
+		}
+		h.db.Where("id IN ?", ids).Delete(&models.File{})
+	}
 	
 	// Update bucket statistics
 	h.updateBucketStats(project.ID, bucketName)
@@ -892,19 +1048,38 @@ func isValidFolderName(name string) bool {
 	return re.MatchString(name)
 }
 
-// countFilesInDirectory counts files in a directory recursively
-func countFilesInDirectory(dirPath string) int {
-	count := 0
-	filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		if !info.IsDir() {
-			count++
-		}
-		return nil
-	})
-	return count
+// cleanFolderPath cleans a folder path within a bucket into slash-separated form without
+// leading or trailing slashes; "" is the root
+func cleanFolderPath(folder string) (string, bool) {
+	if folder == "" {
+		return "", true
+	}
+	cleaned := strings.Trim(path.Clean(filepath.ToSlash(folder)), "/")
+	if strings.Contains(cleaned, "..") {
+		return "", false
+	}
+	if cleaned == "." {
+		cleaned = ""
+	}
+	return cleaned, true
+}
+
+// folderPrefix returns the key prefix of the objects in a folder of a bucket
+func folderPrefix(projectID uint, bucketName, folder string) string {
+	if folder == "" {
+		return services.BucketPrefix(projectID, bucketName)
+	}
+	return services.BucketPrefix(projectID, bucketName) + folder + "/"
+}
+
+// publicFilePath returns the path of a file below /public/<project>/<bucket>/
+func publicFilePath(file models.File) string {
+	return strings.TrimPrefix(file.FilePath, services.BucketPrefix(file.ProjectID, file.BucketName))
+}
+
+// likePrefix returns a LIKE pattern matching values that start with prefix
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
 }
 
 // bucketExists checks if a bucket exists
@@ -952,6 +1127,22 @@ func isValidBucketName(name string) bool {
 	return re.MatchString(name)
 }
 
+// imagePresetName matches the names of image presets
+var imagePresetName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// validateImagePresets checks the image presets of a bucket
+func validateImagePresets(presets map[string]models.ImageTransform) error {
+	for name, preset := range presets {
+		if !imagePresetName.MatchString(name) {
+			return fmt.Errorf("invalid image preset name %q. Use up to 32 letters, numbers, hyphens, and underscores", name)
+		}
+		if err := services.ValidateImageTransform(preset); err != nil {
+			return fmt.Errorf("image preset %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
 
 // sanitizeFileName removes problematic characters from filename with comprehensive security
 func sanitizeFileName(filename string) string {
@@ -1295,9 +1486,7 @@ func (h *StorageHandler) AdminGetFilePublicURL(c *gin.Context) {
 	// Generate public URL
 	var publicURL string
 	if bucket.IsPublic {
-		// Extract just the filename from the file_path (which contains uploads/project_id/bucket_name/filename)
-		fileName := filepath.Base(file.FilePath)
-		publicURL = fmt.Sprintf("%s/public/%d/%s/%s", h.cfg.BaseURL, project.ID, bucketName, fileName)
+		publicURL = fmt.Sprintf("%s/public/%d/%s/%s", h.cfg.BaseURL, project.ID, bucketName, publicFilePath(file))
 	}
 	
 	c.JSON(http.StatusOK, gin.H{
@@ -1351,9 +1540,7 @@ func (h *StorageHandler) GetFilePublicURL(c *gin.Context) {
 	// Generate public URL
 	var publicURL string
 	if bucket.IsPublic {
-		// Extract just the filename from the file_path (which contains uploads/project_id/bucket_name/filename)
-		fileName := filepath.Base(file.FilePath)
-		publicURL = fmt.Sprintf("%s/public/%d/%s/%s", h.cfg.BaseURL, project.ID, bucketName, fileName)
+		publicURL = fmt.Sprintf("%s/public/%d/%s/%s", h.cfg.BaseURL, project.ID, bucketName, publicFilePath(file))
 	}
 	
 	c.JSON(http.StatusOK, gin.H{
@@ -1397,9 +1584,7 @@ func (h *StorageHandler) GetBatchFilePublicURLs(c *gin.Context) {
 	publicURLs := make(map[string]string)
 	for _, file := range files {
 		if bucket.IsPublic {
-			// Extract just the filename from the file_path (which contains uploads/project_id/bucket_name/filename)
-			fileName := filepath.Base(file.FilePath)
-			publicURLs[file.ID] = fmt.Sprintf("%s/public/%d/%s/%s", h.cfg.BaseURL, project.ID, bucketName, fileName)
+			publicURLs[file.ID] = fmt.Sprintf("%s/public/%d/%s/%s", h.cfg.BaseURL, project.ID, bucketName, publicFilePath(file))
 		} else {
 			publicURLs[file.ID] = "" // Empty string for private buckets
 		}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/middleware"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// signedURLExpiry returns the lifetime requested for a signed URL in seconds, or the default
+func signedURLExpiry(seconds int) (time.Duration, bool) {
+	if seconds == 0 {
+		return services.DefaultSignedURLExpiry, true
+	}
+	expiry := time.Duration(seconds) * time.Second
+	return expiry, seconds > 0 && expiry <= services.MaxSignedURLExpiry
+}
+
+// signedURLIP validates the client IP address a signed URL is bound to
+func signedURLIP(ip string) (string, bool) {
+	if ip == "" {
+		return "", true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+	return parsed.String(), true
+}
+
+// respondSignedURLError rejects a request with a signed URL that is not valid
+func respondSignedURLError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrSignedURLExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Signed URL expired"})
+	case errors.Is(err, services.ErrSignedURLUsedUp):
+		c.JSON(http.StatusGone, gin.H{"error": "Signed URL has been used up"})
+	case errors.Is(err, services.ErrSignedURLIPMismatch):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Signed URL is not valid for this client"})
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+	}
+}
+
+// CreateSignedURL issues a signed, expiring URL to download a file of any bucket through the
+// public file route without an API key. The URL can be bound to a client IP address, override
+// the content disposition and allow a limited number of downloads.
+func (h *StorageHandler) CreateSignedURL(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	bucketName := c.Param("bucket")
+
+	var req struct {
+		ExpiresIn    int    `json:"expires_in"`    // Seconds, an hour by default and 7 days at most
+		IP           string `json:"ip"`            // Only this client may use the URL
+		Disposition  string `json:"disposition"`   // inline or attachment
+		FileName     string `json:"filename"`      // Offered with the disposition instead of the original name
+		MaxDownloads int    `json:"max_downloads"` // Unlimited when 0
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	expiry, ok := signedURLExpiry(req.ExpiresIn)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 1 and %d seconds", int(services.MaxSignedURLExpiry.Seconds()))})
+		return
+	}
+	ip, ok := signedURLIP(req.IP)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+	if req.Disposition != "" && req.Disposition != "inline" && req.Disposition != "attachment" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "disposition must be inline or attachment"})
+		return
+	}
+	if req.FileName != "" && req.Disposition == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filename requires a disposition"})
+		return
+	}
+	if req.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_downloads cannot be negative"})
+		return
+	}
+
+	var file models.File
+	if err := h.db.Where("id = ? AND project_id = ? AND bucket_name = ?", c.Param("file_id"), project.ID, bucketName).First(&file).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	signed := services.SignedURL{
+		Method:      http.MethodGet,
+		ProjectID:   project.ID,
+		Bucket:      bucketName,
+		Path:        publicFilePath(file),
+		ExpiresAt:   time.Now().Add(expiry).Truncate(time.Second),
+		IP:          ip,
+		Disposition: req.Disposition,
+		FileName:    req.FileName,
+	}
+	if req.MaxDownloads > 0 {
+		grant, err := h.signedURLs.CreateGrant(project.ID, file.ID, req.MaxDownloads, signed.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create signed URL"})
+			return
+		}
+		signed.Grant = grant
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":           h.signedURLs.URL(signed),
+		"method":        signed.Method,
+		"expires_at":    signed.ExpiresAt,
+		"max_downloads": req.MaxDownloads,
+		"file":          file,
+	})
+}
+
+// CreateSignedUploadURL issues a signed, expiring URL to upload one file into a bucket with a
+// PUT of its raw content to the public file route, without an API key
+func (h *StorageHandler) CreateSignedUploadURL(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	bucketName := c.Param("bucket")
+
+	var req struct {
+		FileName  string `json:"file_name" binding:"required"`
+		Path      string `json:"path"`       // Folder within the bucket, empty for root
+		ExpiresIn int    `json:"expires_in"` // Seconds, an hour by default and 7 days at most
+		IP        string `json:"ip"`         // Only this client may use the URL
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	expiry, ok := signedURLExpiry(req.ExpiresIn)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 1 and %d seconds", int(services.MaxSignedURLExpiry.Seconds()))})
+		return
+	}
+	ip, ok := signedURLIP(req.IP)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+	folder, ok := cleanFolderPath(req.Path)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload path"})
+		return
+	}
+	if !h.bucketExists(project.ID, bucketName) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+		return
+	}
+
+	// The URL is good for a single upload, which creates the file with the ID fixed now
+	fileID := uuid.New().String()
+	signed := services.SignedURL{
+		Method:    http.MethodPut,
+		ProjectID: project.ID,
+		Bucket:    bucketName,
+		Path:      path.Join(folder, storedFileName(fileID, req.FileName)),
+		ExpiresAt: time.Now().Add(expiry).Truncate(time.Second),
+		IP:        ip,
+		FileName:  req.FileName,
+	}
+	grant, err := h.signedURLs.CreateGrant(project.ID, fileID, 1, signed.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create signed URL"})
+		return
+	}
+	signed.Grant = grant
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":        h.signedURLs.URL(signed),
+		"method":     signed.Method,
+		"expires_at": signed.ExpiresAt,
+		"file_id":    fileID,
+	})
+}
+
+// UploadSignedFile stores the body of a PUT to a signed upload URL as a new file
+// PUT /public/{project_id}/{bucket_name}/{file_path}?expires=...&signature=...
+func (h *StorageHandler) UploadSignedFile(c *gin.Context) {
+	projectID, err := strconv.ParseUint(c.Param("project_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID format"})
+		return
+	}
+	bucketName := c.Param("bucket_name")
+	filePath := strings.TrimPrefix(c.Param("file_path"), "/")
+
+	signed, err := h.signedURLs.Verify(http.MethodPut, uint(projectID), bucketName, filePath, c.Request.URL.Query(), c.ClientIP())
+	if err != nil {
+		respondSignedURLError(c, err)
+		return
+	}
+
+	// The path was signed as folder/<file ID><extension>
+	folder, fileName := path.Split(filePath)
+	folder = strings.TrimSuffix(folder, "/")
+	fileID := strings.TrimSuffix(fileName, path.Ext(fileName))
+	if _, err := uuid.Parse(fileID); err != nil || storedFileName(fileID, signed.FileName) != fileName || signed.Grant == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file path"})
+		return
+	}
+
+	var project models.Project
+	if err := h.db.Where("id = ? AND is_active = ?", projectID, true).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found or inactive"})
+		return
+	}
+	var bucket models.Bucket
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, bucketName).First(&bucket).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+		return
+	}
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
+	}
+
+	size := c.Request.ContentLength
+	if size < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length required"})
+		return
+	}
+	if size == 0 || size > bucket.MaxFileSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Invalid file size. Maximum size: %d bytes", bucket.MaxFileSize),
+		})
+		return
+	}
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaStorageBytes, float64(size))) {
+		return
+	}
+
+	// Validate MIME type with content inspection (not just header)
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(c.Request.Body, head)
+	head = head[:n]
+	if len(bucket.AllowedTypes) > 0 {
+		if actualMimeType, isAllowed := bucketAllowsType(bucket, signed.FileName, head); !isAllowed {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("File type not allowed. Detected: %s, Allowed: %v", actualMimeType, bucket.AllowedTypes),
+			})
+			return
+		}
+	}
+
+	// Claim the URL; a failed upload gives it back
+	if err := h.signedURLs.UseGrant(signed.Grant, fileID); err != nil {
+		respondSignedURLError(c, err)
+		return
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			h.signedURLs.ReleaseGrant(signed.Grant)
+		}
+	}()
+
+	objectKey := services.ObjectKey(project.ID, bucket.Name, folder, fileName)
+	ctx := c.Request.Context()
+	mimeType := uploadedFileType(signed.FileName, head)
+
+	hasher := sha256.New()
+	body := io.MultiReader(bytes.NewReader(head), c.Request.Body)
+	if err := backend.Put(ctx, objectKey, io.TeeReader(body, hasher), size, mimeType); err != nil {
+		log.Printf("Failed to store %s in %s: %v", objectKey, backend.Name(), err)
+		backend.Delete(ctx, objectKey)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	fileRecord := newFileRecord(c, project, bucket, folder, fileID, fileName, signed.FileName,
+		mimeType, size, fmt.Sprintf("%x", hasher.Sum(nil)), backend.Name())
+	fileRecord.Author = "signed_url"
+	if err := h.db.Create(&fileRecord).Error; err != nil {
+		backend.Delete(ctx, objectKey)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file record"})
+		return
+	}
+	stored = true
+
+	h.updateBucketStats(project.ID, bucket.Name)
+
+	c.JSON(http.StatusCreated, fileRecord)
+}
+
+// uploadedFileType works out the type of an uploaded file from the extension of its name, or
+// from its first bytes when the extension is unknown. The type a client declares is not
+// trusted: anyone holding a signed upload URL could declare text/html
+func uploadedFileType(fileName string, head []byte) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); mimeType != "" {
+		return mimeType
+	}
+	return http.DetectContentType(head)
+}
+
+// AdminCreateSignedURL issues a signed download URL via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminCreateSignedURL(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.CreateSignedURL(c)
+	}
+}
+
+// AdminCreateSignedUploadURL issues a signed upload URL via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminCreateSignedUploadURL(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.CreateSignedUploadURL(c)
+	}
+}
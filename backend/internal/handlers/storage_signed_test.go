@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignedUploadOfActiveContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.Bucket{}, &models.File{}, &models.SignedURLGrant{})
+	cfg := &config.Config{UploadPath: t.TempDir(), JWTSecret: "test-secret", StorageBackend: "local"}
+	storage := NewStorageHandler(db, cfg)
+	public := NewPublicFileHandler(db, cfg)
+
+	project := models.Project{Name: "site", Slug: "site", UserID: 1, IsActive: true}
+	db.Create(&project)
+	db.Create(&models.Bucket{Name: "uploads", ProjectID: project.ID, MaxFileSize: 1 << 20, StorageBackend: "local"})
+
+	router := gin.New()
+	withProject := func(c *gin.Context) { c.Set("project", project) }
+	router.POST("/buckets/:bucket/upload-url", withProject, storage.CreateSignedUploadURL)
+	router.POST("/buckets/:bucket/files/:file_id/signed-url", withProject, storage.CreateSignedURL)
+	router.PUT("/public/:project_id/:bucket_name/*file_path", storage.UploadSignedFile)
+	router.GET("/public/:project_id/:bucket_name/*file_path", public.ServePublicFile)
+
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	decode := func(recorder *httptest.ResponseRecorder, into interface{}) {
+		t.Helper()
+		if err := json.Unmarshal(recorder.Body.Bytes(), into); err != nil {
+			t.Fatalf("decode %d %s: %v", recorder.Code, recorder.Body.String(), err)
+		}
+	}
+	// upload stores a page through a signed URL issued for fileName, declaring it HTML
+	upload := func(fileName string) models.File {
+		t.Helper()
+		var issued struct{ URL string }
+		decode(do(http.MethodPost, "/buckets/uploads/upload-url", "application/json", fmt.Sprintf(`{"file_name": %q}`, fileName)), &issued)
+		target, err := url.Parse(issued.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := do(http.MethodPut, target.RequestURI(), "text/html", "<html><script>alert(document.cookie)</script></html>")
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("upload of %s: %d %s", fileName, recorder.Code, recorder.Body.String())
+		}
+		var file models.File
+		decode(recorder, &file)
+		return file
+	}
+
+	// The declared type is ignored in favour of the name the URL was issued for
+	if file := upload("photo.png"); file.MimeType != "image/png" {
+		t.Errorf("type of photo.png = %q, want image/png", file.MimeType)
+	}
+
+	page := upload("page.html")
+	if !strings.HasPrefix(page.MimeType, "text/html") {
+		t.Errorf("type of page.html = %q", page.MimeType)
+	}
+	// Even a URL asking for it inline serves the page as a download
+	var signed struct{ URL string }
+	decode(do(http.MethodPost, fmt.Sprintf("/buckets/uploads/files/%s/signed-url", page.ID), "application/json", `{"disposition": "inline"}`), &signed)
+	target, err := url.Parse(signed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := do(http.MethodGet, target.RequestURI(), "", "")
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("page served with %d, Content-Disposition %q", recorder.Code, recorder.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestIsActiveContent(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"text/html; charset=utf-8":       true,
+		"image/svg+xml":                  true,
+		"text/javascript; charset=utf-8": true,
+		"application/xml":                true,
+		"application/atom+xml":           true,
+		"image/png":                      false,
+		"application/pdf":                false,
+		"text/plain; charset=utf-8":      false,
+		"not a type":                     true,
+	} {
+		if got := isActiveContent(contentType); got != want {
+			t.Errorf("isActiveContent(%q) = %t, want %t", contentType, got, want)
+		}
+	}
+}
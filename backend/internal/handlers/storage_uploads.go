@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cloudbox/backend/internal/middleware"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Connections of part uploads and completions outlive the server's request timeouts
+const (
+	uploadPartTimeout     = 15 * time.Minute
+	uploadCompleteTimeout = 30 * time.Minute
+)
+
+// sha256Hex matches a hex-encoded SHA-256
+var sha256Hex = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// extendDeadlines lets a request read its body and write its response for longer than the
+// server's timeouts allow
+func extendDeadlines(c *gin.Context, timeout time.Duration) {
+	controller := http.NewResponseController(c.Writer)
+	deadline := time.Now().Add(timeout)
+	controller.SetReadDeadline(deadline)
+	controller.SetWriteDeadline(deadline)
+}
+
+// findUpload loads an upload of a bucket that has not expired
+func (h *StorageHandler) findUpload(c *gin.Context, projectID uint) (models.FileUpload, bool) {
+	var upload models.FileUpload
+	if err := h.db.Where("id = ? AND project_id = ? AND bucket_name = ? AND expires_at > ?",
+		c.Param("upload_id"), projectID, c.Param("bucket"), time.Now()).First(&upload).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found or expired"})
+		return upload, false
+	}
+	return upload, true
+}
+
+// missingParts returns the numbers of the parts of an upload that have not been received
+func missingParts(upload models.FileUpload, parts []models.FileUploadPart) []int {
+	received := make(map[int]bool, len(parts))
+	for _, part := range parts {
+		received[part.PartNumber] = true
+	}
+	missing := []int{}
+	for number := 1; number <= upload.PartCount; number++ {
+		if !received[number] {
+			missing = append(missing, number)
+		}
+	}
+	return missing
+}
+
+// InitiateUpload starts a resumable upload of a file sent in parts. The client declares the
+// size of the file and optionally its SHA-256 and a part size, then sends the parts with
+// UploadPart, in any order and retrying as needed, and finishes with CompleteUpload.
+func (h *StorageHandler) InitiateUpload(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	bucketName := c.Param("bucket")
+
+	var req struct {
+		FileName string `json:"file_name" binding:"required"`
+		Size     int64  `json:"size" binding:"required"`
+		MimeType string `json:"mime_type"`
+		Path     string `json:"path"`      // Folder within the bucket, empty for root
+		PartSize int64  `json:"part_size"` // Defaults to 8MB
+		Checksum string `json:"checksum"`  // SHA-256 of the whole file, verified on completion
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var bucket models.Bucket
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, bucketName).First(&bucket).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+		return
+	}
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
+	}
+
+	folder, ok := cleanFolderPath(req.Path)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload path"})
+		return
+	}
+	if req.Size <= 0 || req.Size > bucket.MaxFileSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Invalid file size. Maximum size: %d bytes", bucket.MaxFileSize),
+		})
+		return
+	}
+	if req.Checksum != "" && !sha256Hex.MatchString(req.Checksum) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum must be a hex-encoded SHA-256"})
+		return
+	}
+
+	partSize := req.PartSize
+	if partSize == 0 {
+		partSize = services.DefaultUploadPartSize
+	}
+	if partSize > services.MaxUploadPartSize || (partSize < services.MinUploadPartSize && partSize < req.Size) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Part size must be between %d and %d bytes", services.MinUploadPartSize, services.MaxUploadPartSize),
+		})
+		return
+	}
+	partCount := services.UploadPartCount(req.Size, partSize)
+	if partCount > services.MaxUploadParts {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Too many parts (%d); use parts of at least %d bytes", partCount, (req.Size+services.MaxUploadParts-1)/services.MaxUploadParts),
+		})
+		return
+	}
+
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaStorageBytes, float64(req.Size))) {
+		return
+	}
+
+	upload := models.FileUpload{
+		ID:             uuid.New().String(),
+		ProjectID:      project.ID,
+		BucketName:     bucketName,
+		FolderPath:     folder,
+		OriginalName:   req.FileName,
+		MimeType:       req.MimeType,
+		Size:           req.Size,
+		Checksum:       req.Checksum,
+		PartSize:       partSize,
+		PartCount:      partCount,
+		StorageBackend: backend.Name(),
+		Author:         uploadAuthor(c),
+		Status:         services.UploadStatusUploading,
+		ExpiresAt:      time.Now().Add(h.uploads.Expiry()),
+	}
+	if err := h.db.Create(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, upload)
+}
+
+// ListUploads returns the unfinished uploads of a bucket
+func (h *StorageHandler) ListUploads(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var uploads []models.FileUpload
+	if err := h.db.Where("project_id = ? AND bucket_name = ? AND expires_at > ?", project.ID, c.Param("bucket"), time.Now()).
+		Order("created_at DESC").Find(&uploads).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch uploads"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"uploads": uploads})
+}
+
+// GetUpload returns an upload with its received parts, so a client can resume it by sending
+// the missing ones
+func (h *StorageHandler) GetUpload(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	upload, ok := h.findUpload(c, project.ID)
+	if !ok {
+		return
+	}
+	if err := h.db.Where("upload_id = ?", upload.ID).Order("part_number").Find(&upload.Parts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch parts"})
+		return
+	}
+
+	var received int64
+	for _, part := range upload.Parts {
+		received += part.Size
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"upload":         upload,
+		"received_bytes": received,
+		"missing_parts":  missingParts(upload, upload.Parts),
+	})
+}
+
+// UploadPart stores a part of an upload from the raw request body. The body must have the
+// exact size of the part; an X-Checksum-SHA256 header with the hex SHA-256 of the part is
+// verified when present. Sending a part again replaces it.
+func (h *StorageHandler) UploadPart(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	upload, ok := h.findUpload(c, project.ID)
+	if !ok {
+		return
+	}
+	if upload.Status != services.UploadStatusUploading {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is being completed"})
+		return
+	}
+
+	partNumber, err := strconv.Atoi(c.Param("part_number"))
+	if err != nil || partNumber < 1 || partNumber > upload.PartCount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Part number must be between 1 and %d", upload.PartCount)})
+		return
+	}
+	size := services.UploadPartSize(upload, partNumber)
+	if c.Request.ContentLength != size {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":         fmt.Sprintf("Part %d must be sent with a Content-Length of %d bytes", partNumber, size),
+			"expected_size": size,
+		})
+		return
+	}
+	expected := c.GetHeader("X-Checksum-SHA256")
+	if expected != "" && !sha256Hex.MatchString(expected) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "X-Checksum-SHA256 must be a hex-encoded SHA-256"})
+		return
+	}
+
+	extendDeadlines(c, uploadPartTimeout)
+	part, err := h.uploads.PutPart(c.Request.Context(), upload, partNumber, c.Request.Body, expected)
+	if errors.Is(err, services.ErrPartChecksumMismatch) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "Part checksum mismatch",
+			"checksum": part.Checksum,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store part %d of upload %s: %v", partNumber, upload.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store part"})
+		return
+	}
+
+	c.JSON(http.StatusOK, part)
+}
+
+// CompleteUpload assembles the parts of an upload into a file of the bucket. Each part is
+// verified against its SHA-256, and the file against the checksum declared when the upload
+// was initiated. A failed completion leaves the upload in place to be fixed and retried.
+func (h *StorageHandler) CompleteUpload(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	upload, ok := h.findUpload(c, project.ID)
+	if !ok {
+		return
+	}
+
+	// Only one completion at a time, and no parts meanwhile
+	result := h.db.Model(&models.FileUpload{}).
+		Where("id = ? AND status = ?", upload.ID, services.UploadStatusUploading).
+		Updates(map[string]interface{}{
+			"status":     services.UploadStatusCompleting,
+			"expires_at": time.Now().Add(h.uploads.Expiry()),
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is already being completed"})
+		return
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			h.db.Model(&models.FileUpload{}).Where("id = ?", upload.ID).
+				UpdateColumn("status", services.UploadStatusUploading)
+		}
+	}()
+
+	var parts []models.FileUploadPart
+	if err := h.db.Where("upload_id = ?", upload.ID).Order("part_number").Find(&parts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch parts"})
+		return
+	}
+	if missing := missingParts(upload, parts); len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is missing parts", "missing_parts": missing})
+		return
+	}
+
+	var bucket models.Bucket
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, upload.BucketName).First(&bucket).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+		return
+	}
+	backend, err := h.backends.Get(bucket.StorageBackend)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage backend unavailable"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Validate MIME type with content inspection of the first part
+	if len(bucket.AllowedTypes) > 0 {
+		first, err := h.uploads.OpenPart(ctx, upload, 1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+			return
+		}
+		buffer := make([]byte, 512)
+		n, _ := io.ReadFull(first, buffer)
+		first.Close()
+
+		if actualMimeType, isAllowed := bucketAllowsType(bucket, upload.OriginalName, buffer[:n]); !isAllowed {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("File type not allowed. Detected: %s, Allowed: %v", actualMimeType, bucket.AllowedTypes),
+			})
+			return
+		}
+	}
+
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaStorageBytes, float64(upload.Size))) {
+		return
+	}
+
+	extendDeadlines(c, uploadCompleteTimeout)
+	fileID := uuid.New().String()
+	fileName := storedFileName(fileID, upload.OriginalName)
+	filePath := services.ObjectKey(project.ID, bucket.Name, upload.FolderPath, fileName)
+
+	checksum, err := h.uploads.Assemble(ctx, upload, parts, backend, filePath)
+	if errors.Is(err, services.ErrPartChecksumMismatch) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A stored part is corrupt; upload it again", "details": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to assemble upload %s: %v", upload.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assemble upload"})
+		return
+	}
+	if upload.Checksum != "" && checksum != upload.Checksum {
+		backend.Delete(ctx, filePath)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "File checksum mismatch",
+			"checksum": checksum,
+			"expected": upload.Checksum,
+		})
+		return
+	}
+
+	fileRecord := newFileRecord(c, project, bucket, upload.FolderPath, fileID, fileName, upload.OriginalName,
+		upload.MimeType, upload.Size, checksum, backend.Name())
+	fileRecord.Author = upload.Author
+	if err := h.db.Create(&fileRecord).Error; err != nil {
+		backend.Delete(ctx, filePath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file record"})
+		return
+	}
+	completed = true
+
+	if err := h.uploads.Discard(ctx, upload); err != nil {
+		// The sweeper picks it up once it expires
+		log.Printf("Failed to discard completed upload %s: %v", upload.ID, err)
+	}
+	h.updateBucketStats(project.ID, bucket.Name)
+
+	c.JSON(http.StatusCreated, fileRecord)
+}
+
+// AbortUpload discards an upload and its parts
+func (h *StorageHandler) AbortUpload(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	upload, ok := h.findUpload(c, project.ID)
+	if !ok {
+		return
+	}
+	if upload.Status != services.UploadStatusUploading {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is being completed"})
+		return
+	}
+	if err := h.uploads.Discard(c.Request.Context(), upload); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort upload"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload aborted"})
+}
+
+// Admin methods for resumable uploads (JWT authenticated)
+
+// setAdminProject puts the project of an admin route in the context for the regular handlers
+func (h *StorageHandler) setAdminProject(c *gin.Context) bool {
+	var project models.Project
+	if err := h.db.Where("id = ?", c.Param("id")).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return false
+	}
+	c.Set("project", project)
+	return true
+}
+
+// AdminInitiateUpload starts a resumable upload via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminInitiateUpload(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.InitiateUpload(c)
+	}
+}
+
+// AdminListUploads lists unfinished uploads via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminListUploads(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.ListUploads(c)
+	}
+}
+
+// AdminGetUpload gets an upload via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminGetUpload(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.GetUpload(c)
+	}
+}
+
+// AdminUploadPart stores a part of an upload via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminUploadPart(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.UploadPart(c)
+	}
+}
+
+// AdminCompleteUpload completes an upload via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminCompleteUpload(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.CompleteUpload(c)
+	}
+}
+
+// AdminAbortUpload aborts an upload via admin interface (JWT authenticated)
+func (h *StorageHandler) AdminAbortUpload(c *gin.Context) {
+	if h.setAdminProject(c) {
+		h.AbortUpload(c)
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -213,6 +214,11 @@ func (h *TemplateHandler) setupCollection(projectID uint, template CollectionTem
 			return nil, fmt.Errorf("failed to update collection: %v", err)
 		}
 		
+		// Materialize declared indexes (built in the background)
+		if err := syncCollectionIndexes(h.db, projectID, existingCollection.Name, existingCollection.Indexes); err != nil {
+			log.Printf("Failed to sync indexes for collection %s: %v", existingCollection.Name, err)
+		}
+		
 		// Add seed data if provided
 		if len(template.SeedData) > 0 {
 			h.seedCollectionData(projectID, template.Name, template.SeedData)
@@ -236,6 +242,11 @@ func (h *TemplateHandler) setupCollection(projectID uint, template CollectionTem
 		return nil, fmt.Errorf("failed to create collection: %v", err)
 	}
 
+	// Materialize declared indexes (built in the background)
+	if err := syncCollectionIndexes(h.db, projectID, collection.Name, collection.Indexes); err != nil {
+		log.Printf("Failed to create indexes for collection %s: %v", collection.Name, err)
+	}
+
 	// Add seed data if provided
 	if len(template.SeedData) > 0 {
 		h.seedCollectionData(projectID, template.Name, template.SeedData)
@@ -429,18 +429,17 @@ func (h *TemplateDeploymentHandler) createDeploymentConfig(
 // generateDeploymentAPIKey generates an API key for the deployment
 func (h *TemplateDeploymentHandler) generateDeploymentAPIKey(projectID uint, repoName string) (string, error) {
 	// Generate API key
-	apiKey := fmt.Sprintf("cb_%s_%d", generateTemplateRandomString(32), time.Now().Unix())
-	
-	// Hash the API key
-	hashedKey, err := hashAPIKey(apiKey)
+	apiKey, prefix, hashedKey, err := services.GenerateAPIKey(h.cfg)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash API key: %v", err)
+		return "", fmt.Errorf("failed to generate API key: %v", err)
 	}
 
 	// Create API key record
 	apiKeyRecord := models.APIKey{
 		Name:      fmt.Sprintf("Template Deployment - %s", repoName),
 		KeyHash:   hashedKey,
+		KeyPrefix: prefix,
+		HashAlgorithm: services.APIKeyHashHMAC,
 		ProjectID: projectID,
 		Permissions: []string{"read", "write"},
 		LastUsedAt: nil,
@@ -635,8 +634,3 @@ func generateTemplateRandomString(length int) string {
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)[:length]
 }
-
-func hashAPIKey(key string) (string, error) {
-	// TODO: Implement proper API key hashing (bcrypt)
-	return fmt.Sprintf("hashed_%s", key), nil
-}
\ No newline at end of file
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// bcrypt only hashes the first 72 bytes of a password
+const maxPasswordBytes = 72
+
+// defaultAuthSettings returns the policy of a project without stored settings
+func defaultAuthSettings(projectID uint) models.ProjectAuthSettings {
+	return models.ProjectAuthSettings{
+		ProjectID:         projectID,
+		MaxLoginAttempts:  5,
+		LockoutDuration:   15,
+		SessionDuration:   24,
+		PasswordMinLength: 8,
+	}
+}
+
+// loadAuthSettings returns the stored auth settings of a project, or the defaults
+func loadAuthSettings(db *gorm.DB, projectID uint) (models.ProjectAuthSettings, error) {
+	settings := defaultAuthSettings(projectID)
+	err := db.Where("project_id = ?", projectID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return defaultAuthSettings(projectID), nil
+	}
+	return settings, err
+}
+
+// validatePassword checks a password against the password policy of a project
+func validatePassword(settings models.ProjectAuthSettings, password string) error {
+	if len([]rune(password)) < settings.PasswordMinLength {
+		return fmt.Errorf("password must be at least %d characters", settings.PasswordMinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+
+	var upper, lower, number, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			number = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	var missing []string
+	if settings.PasswordRequireUppercase && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if settings.PasswordRequireLowercase && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if settings.PasswordRequireNumber && !number {
+		missing = append(missing, "a number")
+	}
+	if settings.PasswordRequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("password must contain %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// createAppSession starts a session for a user that lasts the project's session duration
+func createAppSession(db *gorm.DB, c *gin.Context, settings models.ProjectAuthSettings, user models.AppUser) (models.AppSession, error) {
+	token, err := generateSecureToken()
+	if err != nil {
+		return models.AppSession{}, err
+	}
+
+	session := models.AppSession{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Token:     token,
+		ExpiresAt: time.Now().Add(time.Duration(settings.SessionDuration) * time.Hour),
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		ProjectID: user.ProjectID,
+		IsActive:  true,
+	}
+	return session, db.Create(&session).Error
+}
+
+// authSettingsResponse renders stored settings the way the auth settings endpoints return them
+func authSettingsResponse(settings models.ProjectAuthSettings, providers []gin.H) gin.H {
+	return gin.H{
+		"email_verification":         settings.EmailVerification,
+		"password_min_length":        settings.PasswordMinLength,
+		"password_require_uppercase": settings.PasswordRequireUppercase,
+		"password_require_lowercase": settings.PasswordRequireLowercase,
+		"password_require_number":    settings.PasswordRequireNumber,
+		"password_require_symbol":    settings.PasswordRequireSymbol,
+		"session_duration":           settings.SessionDuration,
+		"max_login_attempts":         settings.MaxLoginAttempts,
+		"lockout_duration":           settings.LockoutDuration,
+		"providers":                  providers,
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestValidatePassword(t *testing.T) {
+	strict := models.ProjectAuthSettings{
+		PasswordMinLength:        8,
+		PasswordRequireUppercase: true,
+		PasswordRequireLowercase: true,
+		PasswordRequireNumber:    true,
+		PasswordRequireSymbol:    true,
+	}
+
+	tests := []struct {
+		name     string
+		settings models.ProjectAuthSettings
+		password string
+		err      string
+	}{
+		{"default policy", defaultAuthSettings(1), "password", ""},
+		{"too short", defaultAuthSettings(1), "passwor", "at least 8 characters"},
+		{"length counts characters, not bytes", models.ProjectAuthSettings{PasswordMinLength: 4}, "äöüß", ""},
+		{"bcrypt byte limit", models.ProjectAuthSettings{PasswordMinLength: 8}, strings.Repeat("a", maxPasswordBytes+1), "at most 72 bytes"},
+		{"exactly the byte limit", models.ProjectAuthSettings{PasswordMinLength: 8}, strings.Repeat("a", maxPasswordBytes), ""},
+		{"multi-byte characters over the byte limit", models.ProjectAuthSettings{PasswordMinLength: 8}, strings.Repeat("ä", 37), "at most 72 bytes"},
+		{"all classes", strict, "Passw0rd!", ""},
+		{"space counts as a symbol", strict, "Passw0rd x", ""},
+		{"non-ASCII letters count", strict, "ÄBCdéf1#", ""},
+		{"missing uppercase", strict, "passw0rd!", "an uppercase letter"},
+		{"missing lowercase", strict, "PASSW0RD!", "a lowercase letter"},
+		{"missing number", strict, "Password!", "a number"},
+		{"missing symbol", strict, "Passw0rdx", "a symbol"},
+		{"lists every missing class", strict, "password", "must contain an uppercase letter, a number, a symbol"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePassword(tt.settings, tt.password)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
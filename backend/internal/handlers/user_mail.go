@@ -0,0 +1,748 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// App user email tokens
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 24 * time.Hour
+	emailResendInterval  = time.Minute // A new token is not sent more often than this
+	emailSendTimeout     = time.Minute
+)
+
+// App user email templates
+const (
+	templatePasswordReset     = "password_reset"
+	templateEmailVerification = "email_verification"
+)
+
+// defaultEmailTemplates are sent unless a project overrides them
+var defaultEmailTemplates = map[string]models.EmailTemplate{
+	templatePasswordReset: {
+		Name:    templatePasswordReset,
+		Subject: "Reset your {{.AppName}} password",
+		TextBody: `Hi {{if .Name}}{{.Name}}{{else}}there{{end}},
+
+We received a request to reset the password of your {{.AppName}} account.
+{{if .Link}}
+Choose a new password here: {{.Link}}
+{{else}}
+Your password reset code: {{.Token}}
+{{end}}
+This {{if .Link}}link{{else}}code{{end}} expires in {{.ExpiresIn}} and can be used once. If you did not request a reset, ignore this email.
+`,
+		HTMLBody: `<p>Hi {{if .Name}}{{.Name}}{{else}}there{{end}},</p>
+<p>We received a request to reset the password of your {{.AppName}} account.</p>
+{{if .Link}}<p><a href="{{.Link}}">Choose a new password</a></p>{{else}}<p>Your password reset code: <code>{{.Token}}</code></p>{{end}}
+<p>This {{if .Link}}link{{else}}code{{end}} expires in {{.ExpiresIn}} and can be used once. If you did not request a reset, ignore this email.</p>
+`,
+	},
+	templateEmailVerification: {
+		Name:    templateEmailVerification,
+		Subject: "Verify your email for {{.AppName}}",
+		TextBody: `Hi {{if .Name}}{{.Name}}{{else}}there{{end}},
+
+Confirm that {{.Email}} is your email address: {{.Link}}
+
+This link expires in {{.ExpiresIn}}. If you did not create a {{.AppName}} account, ignore this email.
+`,
+		HTMLBody: `<p>Hi {{if .Name}}{{.Name}}{{else}}there{{end}},</p>
+<p>Confirm that {{.Email}} is your email address:</p>
+<p><a href="{{.Link}}">Verify email address</a></p>
+<p>This link expires in {{.ExpiresIn}}. If you did not create a {{.AppName}} account, ignore this email.</p>
+`,
+	},
+}
+
+// emailTemplateData is available to email templates
+type emailTemplateData struct {
+	AppName   string
+	Name      string
+	Email     string
+	Link      string
+	Token     string
+	ExpiresIn string
+}
+
+// hashEmailToken returns the stored form of an emailed token
+func hashEmailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenLink appends a token to an app page URL
+func tokenLink(base, token string) string {
+	if base == "" {
+		return ""
+	}
+	link, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String()
+}
+
+// loadMailSettings returns the stored mail settings of a project, or empty settings
+func loadMailSettings(db *gorm.DB, projectID uint) (models.ProjectMailSettings, error) {
+	settings := models.ProjectMailSettings{ProjectID: projectID}
+	err := db.Where("project_id = ?", projectID).First(&settings).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.ProjectMailSettings{ProjectID: projectID}, nil
+	}
+	return settings, err
+}
+
+// loadEmailTemplate returns a project's template, or the built-in one
+func loadEmailTemplate(db *gorm.DB, projectID uint, name string) (models.EmailTemplate, error) {
+	var template models.EmailTemplate
+	err := db.Where("project_id = ? AND name = ?", projectID, name).First(&template).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return defaultEmailTemplates[name], nil
+	}
+	return template, err
+}
+
+// renderEmail executes a template; the HTML body is escaped, the subject and text are not
+func renderEmail(template models.EmailTemplate, data emailTemplateData) (subject, text, html string, err error) {
+	render := func(name, source string) (string, error) {
+		parsed, err := texttemplate.New(name).Option("missingkey=error").Parse(source)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		err = parsed.Execute(&buf, data)
+		return buf.String(), err
+	}
+
+	if subject, err = render("subject", template.Subject); err != nil {
+		return
+	}
+	subject = strings.Join(strings.Fields(subject), " ")
+	if text, err = render("text", template.TextBody); err != nil {
+		return
+	}
+	if template.HTMLBody != "" {
+		var parsed *htmltemplate.Template
+		if parsed, err = htmltemplate.New("html").Option("missingkey=error").Parse(template.HTMLBody); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err = parsed.Execute(&buf, data); err != nil {
+			return
+		}
+		html = buf.String()
+	}
+	return
+}
+
+// projectMailer returns the mailer and sender of a project: its own SMTP server when one is
+// configured, otherwise the server's mail driver
+func (h *UserHandler) projectMailer(settings models.ProjectMailSettings) (services.Mailer, mail.Address, error) {
+	from := mail.Address{Name: h.cfg.MailFromName, Address: h.cfg.MailFrom}
+	if settings.FromEmail != "" {
+		from = mail.Address{Name: settings.FromName, Address: settings.FromEmail}
+	}
+
+	mailConfig := services.MailConfig{
+		Driver:   h.cfg.MailDriver,
+		Host:     h.cfg.SMTPHost,
+		Port:     h.cfg.SMTPPort,
+		Username: h.cfg.SMTPUsername,
+		Password: h.cfg.SMTPPassword,
+		Security: h.cfg.SMTPSecurity,
+		Dir:      h.cfg.MailDir,
+	}
+	if settings.SMTPHost != "" {
+		password := ""
+		if settings.SMTPPassword != "" {
+			var err error
+			if password, err = utils.DecryptSecret(settings.SMTPPassword, h.cfg.MasterKey); err != nil {
+				return nil, from, fmt.Errorf("failed to decrypt SMTP password: %w", err)
+			}
+		}
+		mailConfig = services.MailConfig{
+			Driver:   services.MailDriverSMTP,
+			Host:     settings.SMTPHost,
+			Port:     settings.SMTPPort,
+			Username: settings.SMTPUsername,
+			Password: password,
+			Security: settings.SMTPSecurity,
+		}
+	}
+
+	mailer, err := services.NewMailer(mailConfig)
+	return mailer, from, err
+}
+
+// sendUserEmail renders a template for an app user and delivers it
+func (h *UserHandler) sendUserEmail(ctx context.Context, project models.Project, user models.AppUser, name, link, token string, ttl time.Duration) error {
+	settings, err := loadMailSettings(h.db, project.ID)
+	if err != nil {
+		return err
+	}
+	template, err := loadEmailTemplate(h.db, project.ID, name)
+	if err != nil {
+		return err
+	}
+
+	subject, text, html, err := renderEmail(template, emailTemplateData{
+		AppName:   project.Name,
+		Name:      user.Name,
+		Email:     user.Email,
+		Link:      link,
+		Token:     token,
+		ExpiresIn: formatTTL(ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render %s email: %w", name, err)
+	}
+
+	mailer, from, err := h.projectMailer(settings)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, services.MailMessage{
+		From:    from,
+		ReplyTo: settings.ReplyTo,
+		To:      mail.Address{Name: user.Name, Address: user.Email},
+		Subject: subject,
+		Text:    text,
+		HTML:    html,
+	})
+}
+
+// sendUserEmailAsync delivers an email in the background so response times do not reveal
+// whether an account exists
+func (h *UserHandler) sendUserEmailAsync(project models.Project, user models.AppUser, name, link, token string, ttl time.Duration) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailSendTimeout)
+		defer cancel()
+		if err := h.sendUserEmail(ctx, project, user, name, link, token, ttl); err != nil {
+			log.Printf("Failed to send %s email to app user %s of project %d: %v", name, user.ID, project.ID, err)
+		}
+	}()
+}
+
+// formatTTL renders a token lifetime for humans
+func formatTTL(ttl time.Duration) string {
+	if ttl >= time.Hour && ttl%time.Hour == 0 {
+		if hours := int(ttl / time.Hour); hours != 1 {
+			return fmt.Sprintf("%d hours", hours)
+		}
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d minutes", int(ttl/time.Minute))
+}
+
+// recentlyIssued reports whether a token with this expiry was issued within the resend interval
+func recentlyIssued(expires *time.Time, ttl time.Duration) bool {
+	return expires != nil && time.Until(*expires) > ttl-emailResendInterval
+}
+
+// issueEmailVerification stores a new verification token for a user and emails it
+func (h *UserHandler) issueEmailVerification(project models.Project, user models.AppUser) error {
+	if recentlyIssued(user.EmailVerificationExpires, emailVerificationTTL) {
+		return nil
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(emailVerificationTTL)
+	if err := h.db.Model(&user).UpdateColumns(map[string]interface{}{
+		"email_verification_token":   hashEmailToken(token),
+		"email_verification_expires": expires,
+	}).Error; err != nil {
+		return err
+	}
+
+	settings, err := loadMailSettings(h.db, project.ID)
+	if err != nil {
+		return err
+	}
+	link := tokenLink(settings.EmailVerificationURL, token)
+	if link == "" {
+		link = tokenLink(fmt.Sprintf("%s/p/%d/api/users/verify-email", h.cfg.BaseURL, project.ID), token)
+	}
+
+	h.sendUserEmailAsync(project, user, templateEmailVerification, link, token, emailVerificationTTL)
+	return nil
+}
+
+// ForgotPassword emails a single-use password reset token. The response is the same
+// whether or not the account exists.
+func (h *UserHandler) ForgotPassword(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "If an account exists for this email, a password reset email has been sent"}
+
+	var user models.AppUser
+	if err := h.db.Where("project_id = ? AND email = ? AND is_active = ?", project.ID, req.Email, true).
+		First(&user).Error; err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if recentlyIssued(user.PasswordResetExpires, passwordResetTTL) {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	settings, err := loadMailSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mail settings"})
+		return
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate reset token"})
+		return
+	}
+	if err := h.db.Model(&user).UpdateColumns(map[string]interface{}{
+		"password_reset_token":   hashEmailToken(token),
+		"password_reset_expires": time.Now().Add(passwordResetTTL),
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store reset token"})
+		return
+	}
+
+	h.sendUserEmailAsync(project, user, templatePasswordReset, tokenLink(settings.PasswordResetURL, token), token, passwordResetTTL)
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword sets a new password with a password reset token. The token is consumed,
+// the account is unlocked and every session of the user is revoked.
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
+	}
+	if err := validatePassword(settings, req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet requirements", "details": err.Error()})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tokenHash := hashEmailToken(req.Token)
+	var user models.AppUser
+	if err := h.db.Where("project_id = ? AND password_reset_token = ? AND password_reset_expires > ?",
+		project.ID, tokenHash, time.Now()).First(&user).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// The token condition makes concurrent resets with the same token consume it once
+		result := tx.Model(&models.AppUser{}).
+			Where("id = ? AND password_reset_token = ?", user.ID, tokenHash).
+			UpdateColumns(map[string]interface{}{
+				"password_hash":          string(hashedPassword),
+				"password_reset_token":   "",
+				"password_reset_expires": nil,
+				"login_attempts":         0,
+				"locked_until":           nil,
+				"is_email_verified":      true, // Receiving the token proves the address
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("project_id = ? AND user_id = ?", project.ID, user.ID).Delete(&models.AppSession{}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
+
+// SendVerificationEmail emails a new verification token to an unverified account. The
+// response is the same whether or not the account exists.
+func (h *UserHandler) SendVerificationEmail(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.AppUser
+	err := h.db.Where("project_id = ? AND email = ? AND is_active = ? AND is_email_verified = ?",
+		project.ID, req.Email, true, false).First(&user).Error
+	if err == nil {
+		if err := h.issueEmailVerification(project, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an unverified account exists for this email, a verification email has been sent"})
+}
+
+// VerifyEmail marks the email of the user holding a verification token as verified
+func (h *UserHandler) VerifyEmail(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	token := c.Query("token")
+	if token == "" {
+		var req struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+			return
+		}
+		token = req.Token
+	}
+
+	tokenHash := hashEmailToken(token)
+	var user models.AppUser
+	if err := h.db.Where("project_id = ? AND email_verification_token = ? AND email_verification_expires > ?",
+		project.ID, tokenHash, time.Now()).First(&user).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	result := h.db.Model(&models.AppUser{}).
+		Where("id = ? AND email_verification_token = ?", user.ID, tokenHash).
+		UpdateColumns(map[string]interface{}{
+			"is_email_verified":          true,
+			"email_verification_token":   "",
+			"email_verification_expires": nil,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	user.IsEmailVerified = true
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully", "user": user})
+}
+
+// mailSettingsResponse renders mail settings without the SMTP password
+func mailSettingsResponse(settings models.ProjectMailSettings) gin.H {
+	return gin.H{
+		"from_email":             settings.FromEmail,
+		"from_name":              settings.FromName,
+		"reply_to":               settings.ReplyTo,
+		"smtp_host":              settings.SMTPHost,
+		"smtp_port":              settings.SMTPPort,
+		"smtp_username":          settings.SMTPUsername,
+		"has_smtp_password":      settings.SMTPPassword != "",
+		"smtp_security":          settings.SMTPSecurity,
+		"password_reset_url":     settings.PasswordResetURL,
+		"email_verification_url": settings.EmailVerificationURL,
+	}
+}
+
+// GetMailSettings returns the email sender settings of the project
+func (h *UserHandler) GetMailSettings(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	settings, err := loadMailSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mail settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, mailSettingsResponse(settings))
+}
+
+// UpdateMailSettings updates the email sender settings of the project
+func (h *UserHandler) UpdateMailSettings(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var req struct {
+		FromEmail            *string `json:"from_email"`
+		FromName             *string `json:"from_name"`
+		ReplyTo              *string `json:"reply_to"`
+		SMTPHost             *string `json:"smtp_host"`
+		SMTPPort             *int    `json:"smtp_port" binding:"omitempty,min=0,max=65535"`
+		SMTPUsername         *string `json:"smtp_username"`
+		SMTPPassword         *string `json:"smtp_password"`
+		SMTPSecurity         *string `json:"smtp_security" binding:"omitempty,oneof=starttls tls none"`
+		PasswordResetURL     *string `json:"password_reset_url"`
+		EmailVerificationURL *string `json:"email_verification_url"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings, err := loadMailSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load mail settings"})
+		return
+	}
+
+	for _, address := range []*string{req.FromEmail, req.ReplyTo} {
+		if address != nil && *address != "" {
+			if parsed, err := mail.ParseAddress(*address); err != nil || parsed.Address != *address {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid email address %q", *address)})
+				return
+			}
+		}
+	}
+	for field, link := range map[string]*string{"password_reset_url": req.PasswordResetURL, "email_verification_url": req.EmailVerificationURL} {
+		if link != nil && *link != "" {
+			if err := validateProviderURL(field, *link); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	if req.FromEmail != nil {
+		settings.FromEmail = *req.FromEmail
+	}
+	if req.FromName != nil {
+		if strings.ContainsAny(*req.FromName, "\r\n") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from_name must be a single line"})
+			return
+		}
+		settings.FromName = *req.FromName
+	}
+	if req.ReplyTo != nil {
+		settings.ReplyTo = *req.ReplyTo
+	}
+	if req.SMTPHost != nil {
+		settings.SMTPHost = *req.SMTPHost
+	}
+	if req.SMTPPort != nil {
+		settings.SMTPPort = *req.SMTPPort
+	}
+	if req.SMTPUsername != nil {
+		settings.SMTPUsername = *req.SMTPUsername
+	}
+	if req.SMTPSecurity != nil {
+		settings.SMTPSecurity = *req.SMTPSecurity
+	}
+	if req.SMTPPassword != nil {
+		settings.SMTPPassword = ""
+		if *req.SMTPPassword != "" {
+			if h.cfg.MasterKey == "" {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "MASTER_KEY must be configured to store SMTP passwords"})
+				return
+			}
+			encrypted, err := utils.EncryptSecret(*req.SMTPPassword, h.cfg.MasterKey)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt SMTP password"})
+				return
+			}
+			settings.SMTPPassword = encrypted
+		}
+	}
+	if req.PasswordResetURL != nil {
+		settings.PasswordResetURL = *req.PasswordResetURL
+	}
+	if req.EmailVerificationURL != nil {
+		settings.EmailVerificationURL = *req.EmailVerificationURL
+	}
+
+	if err := h.db.Select("*").Omit("created_at").Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mail settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, mailSettingsResponse(settings))
+}
+
+// ListEmailTemplates returns the effective app user email templates of the project
+func (h *UserHandler) ListEmailTemplates(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var custom []models.EmailTemplate
+	if err := h.db.Where("project_id = ?", project.ID).Find(&custom).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch email templates"})
+		return
+	}
+	byName := make(map[string]models.EmailTemplate, len(custom))
+	for _, template := range custom {
+		byName[template.Name] = template
+	}
+
+	templates := make([]gin.H, 0, len(defaultEmailTemplates))
+	for _, name := range []string{templatePasswordReset, templateEmailVerification} {
+		template, isCustom := byName[name]
+		if !isCustom {
+			template = defaultEmailTemplates[name]
+		}
+		templates = append(templates, gin.H{
+			"name":      name,
+			"subject":   template.Subject,
+			"text_body": template.TextBody,
+			"html_body": template.HTMLBody,
+			"custom":    isCustom,
+		})
+	}
+
+	c.JSON(http.StatusOK, templates)
+}
+
+// UpdateEmailTemplate overrides an app user email template of the project
+func (h *UserHandler) UpdateEmailTemplate(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	name := c.Param("template")
+
+	if _, ok := defaultEmailTemplates[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email template not found"})
+		return
+	}
+
+	var req struct {
+		Subject  string `json:"subject" binding:"required,max=255"`
+		TextBody string `json:"text_body" binding:"required"`
+		HTMLBody string `json:"html_body"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	template := models.EmailTemplate{ProjectID: project.ID, Name: name}
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, name).First(&template).Error; err != nil &&
+		!errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch email template"})
+		return
+	}
+	template.Subject = req.Subject
+	template.TextBody = req.TextBody
+	template.HTMLBody = req.HTMLBody
+
+	// Reject templates that fail to render before any user would receive them
+	sample := emailTemplateData{
+		AppName:   project.Name,
+		Name:      "Jane Doe",
+		Email:     "jane@example.com",
+		Link:      "https://example.com/?token=sample",
+		Token:     "sample",
+		ExpiresIn: formatTTL(passwordResetTTL),
+	}
+	if _, _, _, err := renderEmail(template, sample); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email template", "details": err.Error()})
+		return
+	}
+
+	if err := h.db.Save(&template).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save email template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, template)
+}
+
+// DeleteEmailTemplate restores the built-in version of an app user email template
+func (h *UserHandler) DeleteEmailTemplate(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	if err := h.db.Where("project_id = ? AND name = ?", project.ID, c.Param("template")).
+		Delete(&models.EmailTemplate{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete email template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email template reset to default"})
+}
+
+// SendTestEmail delivers a sample email with the project's settings and reports failures
+func (h *UserHandler) SendTestEmail(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	var req struct {
+		To       string `json:"to" binding:"required,email"`
+		Template string `json:"template"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Template == "" {
+		req.Template = templateEmailVerification
+	}
+	if _, ok := defaultEmailTemplates[req.Template]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown email template"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), emailSendTimeout)
+	defer cancel()
+
+	recipient := models.AppUser{Email: req.To}
+	if err := h.sendUserEmail(ctx, project, recipient, req.Template, "https://example.com/?token=test", "test", emailVerificationTTL); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send test email", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Test email sent"})
+}
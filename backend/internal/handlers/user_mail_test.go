@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// mailTokenPattern matches the tokens generateSecureToken issues
+var mailTokenPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// mailedToken waits for the email the file mailer writes to dir and returns the token in it
+func mailedToken(t *testing.T, dir string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+		if len(files) > 0 {
+			message, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Undo the soft line breaks of quoted-printable bodies
+			token := mailTokenPattern.FindString(strings.ReplaceAll(string(message), "=\r\n", ""))
+			if token == "" {
+				t.Fatalf("no token in email:\n%s", message)
+			}
+			return token
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no email was sent")
+	return ""
+}
+
+// userMailFixture is an app user of one of two projects, with a handler mailing to files
+type userMailFixture struct {
+	t        *testing.T
+	db       *gorm.DB
+	cfg      *config.Config
+	router   *gin.Engine
+	projects [2]models.Project
+	user     models.AppUser
+}
+
+func newUserMailFixture(t *testing.T) *userMailFixture {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.AppUser{}, &models.AppSession{},
+		&models.ProjectAuthSettings{}, &models.ProjectMailSettings{}, &models.EmailTemplate{})
+	f := &userMailFixture{t: t, db: db, cfg: &config.Config{MailDriver: "file", MailFrom: "noreply@example.com", BaseURL: "http://localhost"}}
+	for i := range f.projects {
+		f.projects[i] = models.Project{Name: fmt.Sprintf("app-%d", i), Slug: fmt.Sprintf("app-%d", i), UserID: 1, IsActive: true}
+		db.Create(&f.projects[i])
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+	f.user = models.AppUser{ID: uuid.New().String(), Email: "jane@example.com", PasswordHash: string(hash), IsActive: true, ProjectID: f.projects[0].ID}
+	db.Create(&f.user)
+
+	handler := NewUserHandler(db, f.cfg)
+	f.router = gin.New()
+	projects := f.router.Group("/p/:project_id", func(c *gin.Context) {
+		var project models.Project
+		if err := db.First(&project, c.Param("project_id")).Error; err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Set("project", project)
+	})
+	projects.POST("/forgot-password", handler.ForgotPassword)
+	projects.POST("/reset-password", handler.ResetPassword)
+	projects.POST("/send-verification", handler.SendVerificationEmail)
+	projects.POST("/verify-email", handler.VerifyEmail)
+	return f
+}
+
+// post sends a JSON body to a route of a project
+func (f *userMailFixture) post(project models.Project, route, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/p/%d/%s", project.ID, route), strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	f.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// issue asks for an email to the user and returns the token it carries
+func (f *userMailFixture) issue(route string) string {
+	f.t.Helper()
+	f.cfg.MailDir = f.t.TempDir()
+	if recorder := f.post(f.projects[0], route, `{"email": "jane@example.com"}`); recorder.Code != http.StatusOK {
+		f.t.Fatalf("%s: %d %s", route, recorder.Code, recorder.Body.String())
+	}
+	return mailedToken(f.t, f.cfg.MailDir)
+}
+
+// reload returns the stored state of the user
+func (f *userMailFixture) reload() models.AppUser {
+	var user models.AppUser
+	if err := f.db.First(&user, "id = ?", f.user.ID).Error; err != nil {
+		f.t.Fatal(err)
+	}
+	return user
+}
+
+func TestPasswordResetToken(t *testing.T) {
+	f := newUserMailFixture(t)
+	f.db.Create(&models.AppSession{ID: uuid.New().String(), UserID: f.user.ID, Token: "session", ExpiresAt: time.Now().Add(time.Hour), ProjectID: f.projects[0].ID})
+
+	token := f.issue("forgot-password")
+	if stored := f.reload(); stored.PasswordResetToken != hashEmailToken(token) || stored.PasswordResetToken == token {
+		t.Errorf("stored token = %q, want the hash of the emailed one", stored.PasswordResetToken)
+	}
+	reset := func(project models.Project, token string) *httptest.ResponseRecorder {
+		return f.post(project, "reset-password", fmt.Sprintf(`{"token": %q, "password": "new-password"}`, token))
+	}
+
+	// The token is only good in the project of the user
+	if recorder := reset(f.projects[1], token); recorder.Code != http.StatusBadRequest {
+		t.Errorf("reset through another project: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := reset(f.projects[0], token); recorder.Code != http.StatusOK {
+		t.Fatalf("reset: %d %s", recorder.Code, recorder.Body.String())
+	}
+	stored := f.reload()
+	if bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte("new-password")) != nil {
+		t.Error("password was not changed")
+	}
+	if stored.PasswordResetToken != "" || stored.PasswordResetExpires != nil || !stored.IsEmailVerified {
+		t.Errorf("after the reset: token %q, expires %v, verified %t", stored.PasswordResetToken, stored.PasswordResetExpires, stored.IsEmailVerified)
+	}
+	var sessions int64
+	f.db.Model(&models.AppSession{}).Where("user_id = ?", f.user.ID).Count(&sessions)
+	if sessions != 0 {
+		t.Errorf("%d sessions survived the reset", sessions)
+	}
+
+	// Tokens are single use
+	if recorder := reset(f.projects[0], token); recorder.Code != http.StatusBadRequest {
+		t.Errorf("second reset with a token: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// and expire
+	token = f.issue("forgot-password")
+	f.db.Model(&models.AppUser{}).Where("id = ?", f.user.ID).Update("password_reset_expires", time.Now().Add(-time.Second))
+	if recorder := reset(f.projects[0], token); recorder.Code != http.StatusBadRequest {
+		t.Errorf("reset with an expired token: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestForgotPasswordResend(t *testing.T) {
+	f := newUserMailFixture(t)
+	first := f.issue("forgot-password")
+
+	// Asking again within the resend interval keeps the token that was sent
+	f.cfg.MailDir = t.TempDir()
+	if recorder := f.post(f.projects[0], "forgot-password", `{"email": "jane@example.com"}`); recorder.Code != http.StatusOK {
+		t.Fatalf("second request: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if f.reload().PasswordResetToken != hashEmailToken(first) {
+		t.Error("a second request replaced the token")
+	}
+
+	// Unknown addresses get the same answer
+	if recorder := f.post(f.projects[1], "forgot-password", `{"email": "jane@example.com"}`); recorder.Code != http.StatusOK {
+		t.Errorf("request for an unknown account: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestEmailVerificationToken(t *testing.T) {
+	f := newUserMailFixture(t)
+	verify := func(project models.Project, token string) *httptest.ResponseRecorder {
+		return f.post(project, "verify-email", fmt.Sprintf(`{"token": %q}`, token))
+	}
+
+	token := f.issue("send-verification")
+	if recorder := verify(f.projects[1], token); recorder.Code != http.StatusBadRequest {
+		t.Errorf("verification through another project: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if f.reload().IsEmailVerified {
+		t.Fatal("email verified through another project")
+	}
+
+	// Expired tokens are rejected
+	f.db.Model(&models.AppUser{}).Where("id = ?", f.user.ID).Update("email_verification_expires", time.Now().Add(-time.Second))
+	if recorder := verify(f.projects[0], token); recorder.Code != http.StatusBadRequest {
+		t.Errorf("verification with an expired token: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	token = f.issue("send-verification")
+	if recorder := verify(f.projects[0], token); recorder.Code != http.StatusOK {
+		t.Fatalf("verification: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if stored := f.reload(); !stored.IsEmailVerified || stored.EmailVerificationToken != "" {
+		t.Errorf("after verification: verified %t, token %q", stored.IsEmailVerified, stored.EmailVerificationToken)
+	}
+	if recorder := verify(f.projects[0], token); recorder.Code != http.StatusBadRequest {
+		t.Errorf("second verification with a token: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
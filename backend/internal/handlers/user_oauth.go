@@ -0,0 +1,616 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// oauthStateTTL bounds how long a user may take to authorize at the provider
+const oauthStateTTL = 10 * time.Minute
+
+var (
+	customProviderID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,49}$`)
+
+	errOAuthEmailRequired = errors.New("the provider did not return an email address")
+	errOAuthEmailConflict = errors.New("an account with this email already exists; log in and link the provider instead")
+)
+
+// builtinProviderInfo describes the providers listed even before they are configured
+var builtinProviderInfo = []struct {
+	ID   string
+	Name string
+	Icon string
+}{
+	{services.OAuthProviderGoogle, "Google OAuth", "🌐"},
+	{services.OAuthProviderGitHub, "GitHub OAuth", "⚫"},
+	{services.OAuthProviderApple, "Apple ID", "🍎"},
+}
+
+// oauthCallbackURL is the redirect URI registered at the provider
+func (h *UserHandler) oauthCallbackURL(projectID uint, providerID string) string {
+	return fmt.Sprintf("%s/p/%d/api/auth/oauth/%s/callback", h.cfg.BaseURL, projectID, providerID)
+}
+
+// providerEndpoints returns the endpoints of a configured provider
+func providerEndpoints(provider models.AuthProvider) services.OAuthEndpoints {
+	endpoints := services.BuiltinOAuthProviders[provider.Type]
+	endpoints.Scopes = append([]string(nil), endpoints.Scopes...)
+	if provider.IssuerURL != "" {
+		endpoints.Issuer = provider.IssuerURL
+	}
+	if provider.AuthorizationURL != "" {
+		endpoints.AuthorizationURL = provider.AuthorizationURL
+	}
+	if provider.TokenURL != "" {
+		endpoints.TokenURL = provider.TokenURL
+	}
+	if provider.UserInfoURL != "" {
+		endpoints.UserInfoURL = provider.UserInfoURL
+	}
+	if provider.JWKSURL != "" {
+		endpoints.JWKSURL = provider.JWKSURL
+	}
+	if len(provider.Scopes) > 0 {
+		endpoints.Scopes = provider.Scopes
+	}
+	if provider.Type == services.OAuthProviderOIDC && len(endpoints.Scopes) == 0 {
+		endpoints.Scopes = []string{"openid", "email", "profile"}
+	}
+	return endpoints
+}
+
+// authProviderResponse renders a provider without its secret
+func (h *UserHandler) authProviderResponse(provider models.AuthProvider, icon string) gin.H {
+	endpoints := providerEndpoints(provider)
+	return gin.H{
+		"id":                provider.ProviderID,
+		"type":              provider.Type,
+		"name":              provider.Name,
+		"enabled":           provider.Enabled,
+		"icon":              icon,
+		"client_id":         provider.ClientID,
+		"has_client_secret": provider.ClientSecret != "",
+		"issuer_url":        endpoints.Issuer,
+		"authorization_url": endpoints.AuthorizationURL,
+		"token_url":         endpoints.TokenURL,
+		"userinfo_url":      endpoints.UserInfoURL,
+		"jwks_url":          endpoints.JWKSURL,
+		"scopes":            endpoints.Scopes,
+		"redirect_urls":     provider.RedirectURLs,
+		"callback_url":      h.oauthCallbackURL(provider.ProjectID, provider.ProviderID),
+	}
+}
+
+// listAuthProviders returns email/password login, the built-in providers and every custom
+// OIDC provider of a project
+func (h *UserHandler) listAuthProviders(projectID uint) ([]gin.H, error) {
+	var configured []models.AuthProvider
+	if err := h.db.Where("project_id = ?", projectID).Order("provider_id").Find(&configured).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]models.AuthProvider, len(configured))
+	for _, provider := range configured {
+		byID[provider.ProviderID] = provider
+	}
+
+	providers := []gin.H{{"id": "email", "type": "email", "name": "Email/Password", "enabled": true, "icon": "✉️"}}
+	for _, builtin := range builtinProviderInfo {
+		provider, ok := byID[builtin.ID]
+		if !ok {
+			provider = models.AuthProvider{ProjectID: projectID, ProviderID: builtin.ID, Type: builtin.ID, Name: builtin.Name}
+		}
+		providers = append(providers, h.authProviderResponse(provider, builtin.Icon))
+	}
+	for _, provider := range configured {
+		if provider.Type == services.OAuthProviderOIDC {
+			providers = append(providers, h.authProviderResponse(provider, "🔑"))
+		}
+	}
+	return providers, nil
+}
+
+// validateProviderURL accepts absolute http(s) URLs without a fragment
+func validateProviderURL(field, raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Fragment != "" {
+		return fmt.Errorf("%s must be an absolute http(s) URL without a fragment", field)
+	}
+	return nil
+}
+
+// GetAuthProviders returns available authentication providers
+func (h *UserHandler) GetAuthProviders(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	providers, err := h.listAuthProviders(project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch auth providers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, providers)
+}
+
+// UpdateAuthProvider creates or updates the configuration of an OAuth provider. Built-in
+// providers use their own ID; any other ID configures a generic OpenID Connect provider.
+func (h *UserHandler) UpdateAuthProvider(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	providerID := c.Param("provider_id")
+
+	var req struct {
+		Name             *string  `json:"name"`
+		Enabled          *bool    `json:"enabled"`
+		ClientID         *string  `json:"client_id"`
+		ClientSecret     *string  `json:"client_secret"`
+		IssuerURL        *string  `json:"issuer_url"`
+		AuthorizationURL *string  `json:"authorization_url"`
+		TokenURL         *string  `json:"token_url"`
+		UserInfoURL      *string  `json:"userinfo_url"`
+		JWKSURL          *string  `json:"jwks_url"`
+		Scopes           []string `json:"scopes"`
+		RedirectURLs     []string `json:"redirect_urls"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var provider models.AuthProvider
+	err := h.db.Where("project_id = ? AND provider_id = ?", project.ID, providerID).First(&provider).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		providerType := providerID
+		if _, builtin := services.BuiltinOAuthProviders[providerID]; !builtin {
+			if providerID == "email" || !customProviderID.MatchString(providerID) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Provider ID must be lowercase letters, digits and dashes"})
+				return
+			}
+			providerType = services.OAuthProviderOIDC
+		}
+		provider = models.AuthProvider{ProjectID: project.ID, ProviderID: providerID, Type: providerType, Name: providerID}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch auth provider"})
+		return
+	}
+
+	if req.Name != nil {
+		provider.Name = *req.Name
+	}
+	if req.Enabled != nil {
+		provider.Enabled = *req.Enabled
+	}
+	if req.ClientID != nil {
+		provider.ClientID = *req.ClientID
+	}
+	if req.ClientSecret != nil {
+		provider.ClientSecret = ""
+		if *req.ClientSecret != "" {
+			if h.cfg.MasterKey == "" {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "MASTER_KEY must be configured to store client secrets"})
+				return
+			}
+			encrypted, err := utils.EncryptSecret(*req.ClientSecret, h.cfg.MasterKey)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt client secret"})
+				return
+			}
+			provider.ClientSecret = encrypted
+		}
+	}
+
+	urlFields := []struct {
+		name   string
+		value  *string
+		target *string
+	}{
+		{"issuer_url", req.IssuerURL, &provider.IssuerURL},
+		{"authorization_url", req.AuthorizationURL, &provider.AuthorizationURL},
+		{"token_url", req.TokenURL, &provider.TokenURL},
+		{"userinfo_url", req.UserInfoURL, &provider.UserInfoURL},
+		{"jwks_url", req.JWKSURL, &provider.JWKSURL},
+	}
+	for _, field := range urlFields {
+		if field.value == nil {
+			continue
+		}
+		if *field.value != "" {
+			if err := validateProviderURL(field.name, *field.value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		*field.target = *field.value
+	}
+	if req.Scopes != nil {
+		provider.Scopes = pq.StringArray(req.Scopes)
+	}
+	if req.RedirectURLs != nil {
+		for _, redirectURL := range req.RedirectURLs {
+			if err := validateProviderURL("redirect_urls", redirectURL); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		provider.RedirectURLs = pq.StringArray(req.RedirectURLs)
+	}
+
+	// Generic providers are configured by their issuer; fill in what discovery provides
+	if provider.Type == services.OAuthProviderOIDC && provider.IssuerURL != "" &&
+		(provider.AuthorizationURL == "" || provider.TokenURL == "" || provider.JWKSURL == "") {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		discovered, err := h.oauth.Discover(ctx, provider.IssuerURL)
+		cancel()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "OpenID Connect discovery failed", "details": err.Error()})
+			return
+		}
+		if provider.AuthorizationURL == "" {
+			provider.AuthorizationURL = discovered.AuthorizationURL
+		}
+		if provider.TokenURL == "" {
+			provider.TokenURL = discovered.TokenURL
+		}
+		if provider.UserInfoURL == "" {
+			provider.UserInfoURL = discovered.UserInfoURL
+		}
+		if provider.JWKSURL == "" {
+			provider.JWKSURL = discovered.JWKSURL
+		}
+	}
+
+	if provider.Enabled {
+		endpoints := providerEndpoints(provider)
+		switch {
+		case provider.ClientID == "" || provider.ClientSecret == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID and client secret are required to enable a provider"})
+			return
+		case endpoints.AuthorizationURL == "" || endpoints.TokenURL == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Authorization and token URLs are required to enable a provider"})
+			return
+		case provider.Type != services.OAuthProviderGitHub && (endpoints.Issuer == "" || endpoints.JWKSURL == ""):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Issuer and JWKS URLs are required to verify ID tokens"})
+			return
+		}
+	}
+
+	if err := h.db.Select("*").Omit("created_at").Save(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save auth provider"})
+		return
+	}
+
+	icon := "🔑"
+	for _, builtin := range builtinProviderInfo {
+		if builtin.ID == provider.ProviderID {
+			icon = builtin.Icon
+		}
+	}
+	c.JSON(http.StatusOK, h.authProviderResponse(provider, icon))
+}
+
+// DeleteAuthProvider removes the configuration of an OAuth provider; linked identities remain
+// so users can log in again once it is reconfigured
+func (h *UserHandler) DeleteAuthProvider(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+
+	result := h.db.Where("project_id = ? AND provider_id = ?", project.ID, c.Param("provider_id")).Delete(&models.AuthProvider{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete auth provider"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Auth provider not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Auth provider deleted successfully"})
+}
+
+// OAuthAuthorize starts an authorization code flow with PKCE. The user is redirected to the
+// provider, or with mode=json the authorization URL is returned. redirect_url, when given,
+// must be one of the provider's redirect URLs and receives the session after login.
+func (h *UserHandler) OAuthAuthorize(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	providerID := c.Param("provider_id")
+
+	var provider models.AuthProvider
+	if err := h.db.Where("project_id = ? AND provider_id = ? AND enabled = ?", project.ID, providerID, true).
+		First(&provider).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Auth provider not found or disabled"})
+		return
+	}
+
+	redirectURL := c.Query("redirect_url")
+	if redirectURL != "" && !containsString(provider.RedirectURLs, redirectURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_url is not allowed for this provider"})
+		return
+	}
+
+	state, errState := services.RandomToken(32)
+	nonce, errNonce := services.RandomToken(16)
+	verifier, challenge, errPKCE := services.NewPKCE()
+	if errState != nil || errNonce != nil || errPKCE != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start authorization"})
+		return
+	}
+
+	// GitHub issues no ID token to carry a nonce
+	if provider.Type == services.OAuthProviderGitHub {
+		nonce = ""
+	}
+
+	pending := models.OAuthState{
+		State:        state,
+		ExpiresAt:    time.Now().Add(oauthStateTTL),
+		ProjectID:    project.ID,
+		ProviderID:   provider.ProviderID,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		RedirectURL:  redirectURL,
+	}
+	if err := h.db.Create(&pending).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start authorization"})
+		return
+	}
+	h.db.Where("expires_at < ?", time.Now()).Delete(&models.OAuthState{})
+
+	authorizationURL := services.AuthorizationURL(providerEndpoints(provider), provider.ClientID,
+		h.oauthCallbackURL(project.ID, provider.ProviderID), state, challenge, nonce)
+
+	if c.Query("mode") == "json" {
+		c.JSON(http.StatusOK, gin.H{"authorization_url": authorizationURL, "expires_at": pending.ExpiresAt})
+		return
+	}
+	c.Redirect(http.StatusFound, authorizationURL)
+}
+
+// OAuthCallback completes an authorization: it redeems the code, verifies the identity,
+// creates or links the app user and issues a session. The session is passed to the
+// redirect_url of the authorization in the URL fragment, or returned as JSON without one.
+func (h *UserHandler) OAuthCallback(c *gin.Context) {
+	project := c.MustGet("project").(models.Project)
+	providerID := c.Param("provider_id")
+
+	// Providers answer with a redirect (query) or, with response_mode=form_post, a POST
+	param := func(name string) string {
+		if value := c.Query(name); value != "" {
+			return value
+		}
+		return c.PostForm(name)
+	}
+
+	// States are single use: whoever deletes it owns the callback
+	var pending models.OAuthState
+	result := h.db.Where("state = ? AND project_id = ? AND provider_id = ?", param("state"), project.ID, providerID).
+		First(&pending)
+	if result.Error == nil {
+		result = h.db.Where("state = ?", pending.State).Delete(&models.OAuthState{})
+	}
+	if result.Error != nil || result.RowsAffected == 0 || pending.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired OAuth state"})
+		return
+	}
+
+	fail := func(status int, message string) {
+		if pending.RedirectURL != "" {
+			c.Redirect(http.StatusFound, pending.RedirectURL+"#"+url.Values{"error": {message}}.Encode())
+			return
+		}
+		c.JSON(status, gin.H{"error": message})
+	}
+
+	if providerError := param("error"); providerError != "" {
+		fail(http.StatusUnauthorized, "Authorization failed: "+providerError)
+		return
+	}
+	code := param("code")
+	if code == "" {
+		fail(http.StatusBadRequest, "Authorization code required")
+		return
+	}
+
+	var provider models.AuthProvider
+	if err := h.db.Where("project_id = ? AND provider_id = ? AND enabled = ?", project.ID, providerID, true).
+		First(&provider).Error; err != nil {
+		fail(http.StatusNotFound, "Auth provider not found or disabled")
+		return
+	}
+
+	clientSecret, err := utils.DecryptSecret(provider.ClientSecret, h.cfg.MasterKey)
+	if err != nil {
+		log.Printf("Failed to decrypt client secret of auth provider %s: %v", provider.ProviderID, err)
+		fail(http.StatusInternalServerError, "Auth provider is misconfigured")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	endpoints := providerEndpoints(provider)
+	token, err := h.oauth.Exchange(ctx, endpoints, provider.ClientID, clientSecret, code,
+		h.oauthCallbackURL(project.ID, provider.ProviderID), pending.CodeVerifier)
+	if err != nil {
+		log.Printf("OAuth code exchange with %s failed: %v", provider.ProviderID, err)
+		fail(http.StatusUnauthorized, "Failed to exchange authorization code")
+		return
+	}
+
+	var identity services.OAuthIdentity
+	if provider.Type == services.OAuthProviderGitHub {
+		identity, err = h.oauth.GitHubIdentity(ctx, endpoints, token.AccessToken)
+	} else {
+		identity, err = h.oauth.VerifyIDToken(ctx, endpoints, provider.ClientID, token.IDToken, pending.Nonce)
+		if err == nil && identity.Email == "" && endpoints.UserInfoURL != "" {
+			err = h.oauth.UserInfo(ctx, endpoints, token.AccessToken, &identity)
+		}
+	}
+	if err != nil {
+		log.Printf("OAuth identity from %s rejected: %v", provider.ProviderID, err)
+		fail(http.StatusUnauthorized, "Failed to verify identity")
+		return
+	}
+
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		fail(http.StatusInternalServerError, "Failed to load auth settings")
+		return
+	}
+
+	user, err := h.resolveOAuthUser(project, provider.ProviderID, identity)
+	var exceeded *services.QuotaExceededError
+	switch {
+	case errors.Is(err, errOAuthEmailRequired), errors.Is(err, errOAuthEmailConflict):
+		fail(http.StatusConflict, err.Error())
+		return
+	case errors.As(err, &exceeded):
+		fail(exceeded.Status(), "App user quota exceeded")
+		return
+	case err != nil:
+		log.Printf("Failed to resolve app user for %s identity: %v", provider.ProviderID, err)
+		fail(http.StatusInternalServerError, "Failed to resolve user")
+		return
+	}
+
+	switch {
+	case !user.IsActive:
+		fail(http.StatusUnauthorized, "Account is disabled")
+		return
+	case user.LockedUntil != nil && user.LockedUntil.After(time.Now()):
+		fail(http.StatusUnauthorized, "Account is temporarily locked")
+		return
+	case settings.EmailVerification && !user.IsEmailVerified:
+		fail(http.StatusForbidden, "Email address not verified")
+		return
+	}
+
+	now := time.Now()
+	h.db.Model(&user).UpdateColumns(map[string]interface{}{"last_login_at": now, "last_seen_at": now})
+	user.LastLoginAt = &now
+	user.LastSeenAt = &now
+
+	session, err := createAppSession(h.db, c, settings, user)
+	if err != nil {
+		fail(http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+
+	if pending.RedirectURL != "" {
+		fragment := url.Values{
+			"token":      {session.Token},
+			"expires_at": {session.ExpiresAt.UTC().Format(time.RFC3339)},
+			"user_id":    {user.ID},
+		}
+		c.Redirect(http.StatusFound, pending.RedirectURL+"#"+fragment.Encode())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user": user,
+		"session": gin.H{
+			"token":      session.Token,
+			"expires_at": session.ExpiresAt,
+		},
+	})
+}
+
+// resolveOAuthUser returns the app user of a provider identity: the linked user, an existing
+// user with the same verified email (which gets linked), or a new user within the app user quota
+func (h *UserHandler) resolveOAuthUser(project models.Project, providerID string, identity services.OAuthIdentity) (models.AppUser, error) {
+	projectID := project.ID
+	var user models.AppUser
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var linked models.AppUserIdentity
+		err := tx.Where("project_id = ? AND provider_id = ? AND subject = ?", projectID, providerID, identity.Subject).
+			First(&linked).Error
+		if err == nil {
+			if err := tx.Where("project_id = ? AND id = ?", projectID, linked.UserID).First(&user).Error; err != nil {
+				return err
+			}
+			return tx.Model(&linked).Updates(map[string]interface{}{"email": identity.Email, "last_login_at": now}).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if identity.Email == "" {
+			return errOAuthEmailRequired
+		}
+
+		err = tx.Where("project_id = ? AND email = ?", projectID, identity.Email).First(&user).Error
+		switch {
+		case err == nil:
+			// Only a provider that verified the address may take over an existing account
+			if !identity.EmailVerified {
+				return errOAuthEmailConflict
+			}
+			if !user.IsEmailVerified {
+				if err := tx.Model(&user).Update("is_email_verified", true).Error; err != nil {
+					return err
+				}
+				user.IsEmailVerified = true
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := h.quotas.Check(project, services.QuotaAppUsers, 1); err != nil {
+				var exceeded *services.QuotaExceededError
+				if errors.As(err, &exceeded) {
+					return err
+				}
+				log.Printf("Failed to check app user quota: %v", err)
+			}
+
+			// OAuth users have no password until they set one through a reset
+			unusable, err := generateSecureToken()
+			if err != nil {
+				return err
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(unusable), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+
+			user = models.AppUser{
+				ID:              uuid.New().String(),
+				Email:           identity.Email,
+				PasswordHash:    string(hash),
+				Name:            identity.Name,
+				IsActive:        true,
+				IsEmailVerified: identity.EmailVerified,
+				ProjectID:       projectID,
+			}
+			if identity.AvatarURL != "" {
+				user.ProfileData = map[string]interface{}{"avatar_url": identity.AvatarURL}
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		return tx.Create(&models.AppUserIdentity{
+			ProjectID:   projectID,
+			ProviderID:  providerID,
+			Subject:     identity.Subject,
+			Email:       identity.Email,
+			UserID:      user.ID,
+			LastLoginAt: &now,
+		}).Error
+	})
+	return user, err
+}
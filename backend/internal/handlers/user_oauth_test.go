@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/cloudbox/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// fakeOIDCProvider is an OpenID Connect provider that redeems the code "code" when the PKCE
+// verifier matches the challenge it was given
+type fakeOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mutex     sync.Mutex
+	challenge string // Challenge of the authorization being completed
+	nonce     string // Nonce put into issued ID tokens
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys": [{"kid": "test", "kty": "RSA", "n": %q, "e": %q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("code") != "code" || r.PostFormValue("client_secret") != "secret" ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant"}`)
+		return
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            "subject",
+		"aud":            "client",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          p.nonce,
+		"email":          "jane@example.com",
+		"email_verified": true,
+	})
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": signed})
+}
+
+// expect prepares the provider to complete an authorization with the given challenge and nonce
+func (p *fakeOIDCProvider) expect(challenge, nonce string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.challenge, p.nonce = challenge, nonce
+}
+
+// oauthFixture is a project with the fake provider configured as "acme"
+type oauthFixture struct {
+	t        *testing.T
+	db       *gorm.DB
+	router   *gin.Engine
+	provider *fakeOIDCProvider
+}
+
+func newOAuthFixture(t *testing.T) *oauthFixture {
+	gin.SetMode(gin.TestMode)
+	db := openTestDB(t, &models.Project{}, &models.AuthProvider{}, &models.OAuthState{}, &models.AppUser{},
+		&models.AppUserIdentity{}, &models.AppSession{}, &models.ProjectAuthSettings{})
+	cfg := &config.Config{BaseURL: "http://localhost", MasterKey: "test-master-key"}
+	provider := newFakeOIDCProvider(t)
+
+	secret, err := utils.EncryptSecret("secret", cfg.MasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app", "other"} {
+		project := models.Project{Name: name, Slug: name, UserID: 1, IsActive: true}
+		db.Create(&project)
+		db.Create(&models.AuthProvider{ProjectID: project.ID, ProviderID: "acme", Type: services.OAuthProviderOIDC,
+			Enabled: true, ClientID: "client", ClientSecret: secret, IssuerURL: provider.server.URL,
+			AuthorizationURL: provider.server.URL + "/authorize", TokenURL: provider.server.URL + "/token",
+			JWKSURL: provider.server.URL + "/jwks"})
+	}
+
+	handler := NewUserHandler(db, cfg)
+	router := gin.New()
+	projects := router.Group("/p/:project_id", func(c *gin.Context) {
+		var project models.Project
+		if err := db.First(&project, c.Param("project_id")).Error; err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Set("project", project)
+	})
+	projects.GET("/oauth/:provider_id/authorize", handler.OAuthAuthorize)
+	projects.GET("/oauth/:provider_id/callback", handler.OAuthCallback)
+	return &oauthFixture{t: t, db: db, router: router, provider: provider}
+}
+
+// authorize starts an authorization in the first project and returns its query parameters
+func (f *oauthFixture) authorize() url.Values {
+	f.t.Helper()
+	recorder := serve(f.router, http.MethodGet, "/p/1/oauth/acme/authorize?mode=json", "")
+	var response struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		f.t.Fatalf("authorize: %d %s", recorder.Code, recorder.Body.String())
+	}
+	parsed, err := url.Parse(response.AuthorizationURL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return parsed.Query()
+}
+
+// callback returns to the callback of a project with a state and the code "code"
+func (f *oauthFixture) callback(projectID uint, providerID, state string) *httptest.ResponseRecorder {
+	target := fmt.Sprintf("/p/%d/oauth/%s/callback?%s", projectID, providerID, url.Values{"state": {state}, "code": {"code"}}.Encode())
+	return serve(f.router, http.MethodGet, target, "")
+}
+
+func (f *oauthFixture) count(model interface{}) int64 {
+	var count int64
+	f.db.Model(model).Count(&count)
+	return count
+}
+
+func TestOAuthAuthorize(t *testing.T) {
+	f := newOAuthFixture(t)
+	query := f.authorize()
+
+	var pending models.OAuthState
+	if err := f.db.First(&pending, "state = ?", query.Get("state")).Error; err != nil {
+		t.Fatalf("pending authorization for state %q: %v", query.Get("state"), err)
+	}
+	// The verifier stays on the server; the provider only sees its challenge
+	sum := sha256.Sum256([]byte(pending.CodeVerifier))
+	if query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) || query.Get("code_challenge_method") != "S256" {
+		t.Errorf("challenge %q (%s) does not match the stored verifier", query.Get("code_challenge"), query.Get("code_challenge_method"))
+	}
+	if query.Get("nonce") == "" || query.Get("nonce") != pending.Nonce {
+		t.Errorf("nonce = %q, stored %q", query.Get("nonce"), pending.Nonce)
+	}
+	if query.Get("redirect_uri") != "http://localhost/p/1/api/auth/oauth/acme/callback" || query.Get("client_id") != "client" {
+		t.Errorf("authorization query = %v", query)
+	}
+
+	// Every authorization has its own state, verifier and nonce
+	again := f.authorize()
+	for _, name := range []string{"state", "code_challenge", "nonce"} {
+		if again.Get(name) == query.Get(name) {
+			t.Errorf("two authorizations share their %s", name)
+		}
+	}
+
+	if recorder := serve(f.router, http.MethodGet, "/p/1/oauth/acme/authorize?redirect_url=https://evil.example.com", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("authorization for an unlisted redirect URL: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOAuthCallbackState(t *testing.T) {
+	f := newOAuthFixture(t)
+	query := f.authorize()
+	f.provider.expect(query.Get("code_challenge"), query.Get("nonce"))
+
+	// A state is only good for the project and provider it was issued for
+	for _, c := range []struct {
+		name       string
+		projectID  uint
+		providerID string
+		state      string
+	}{
+		{"an unknown state", 1, "acme", "forged"},
+		{"no state", 1, "acme", ""},
+		{"another project", 2, "acme", query.Get("state")},
+		{"another provider", 1, "google", query.Get("state")},
+	} {
+		if recorder := f.callback(c.projectID, c.providerID, c.state); recorder.Code != http.StatusBadRequest {
+			t.Errorf("callback with %s: %d %s", c.name, recorder.Code, recorder.Body.String())
+		}
+	}
+	if n := f.count(&models.OAuthState{}); n != 1 {
+		t.Fatalf("%d pending authorizations after rejected callbacks, want 1", n)
+	}
+
+	recorder := f.callback(1, "acme", query.Get("state"))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var response struct {
+		User    models.AppUser `json:"user"`
+		Session struct {
+			Token string `json:"token"`
+		} `json:"session"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.User.Email != "jane@example.com" || !response.User.IsEmailVerified || response.Session.Token == "" {
+		t.Errorf("callback response = %s", recorder.Body.String())
+	}
+	if n := f.count(&models.AppUserIdentity{}); n != 1 {
+		t.Errorf("%d identities linked, want 1", n)
+	}
+
+	// States are single use
+	if recorder := f.callback(1, "acme", query.Get("state")); recorder.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// and expire
+	query = f.authorize()
+	f.provider.expect(query.Get("code_challenge"), query.Get("nonce"))
+	f.db.Model(&models.OAuthState{}).Where("state = ?", query.Get("state")).Update("expires_at", time.Now().Add(-time.Second))
+	if recorder := f.callback(1, "acme", query.Get("state")); recorder.Code != http.StatusBadRequest {
+		t.Errorf("callback with an expired state: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOAuthCallbackRejectsNonceAndVerifier(t *testing.T) {
+	f := newOAuthFixture(t)
+
+	// An ID token issued for another authorization
+	query := f.authorize()
+	f.provider.expect(query.Get("code_challenge"), "another-nonce")
+	if recorder := f.callback(1, "acme", query.Get("state")); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("callback with an ID token for another nonce: %d %s", recorder.Code, recorder.Body.String())
+	}
+	// The failed callback used up the state
+	f.provider.expect(query.Get("code_challenge"), query.Get("nonce"))
+	if recorder := f.callback(1, "acme", query.Get("state")); recorder.Code != http.StatusBadRequest {
+		t.Errorf("retried callback: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// A code issued for another authorization's challenge
+	first, second := f.authorize(), f.authorize()
+	f.provider.expect(first.Get("code_challenge"), second.Get("nonce"))
+	if recorder := f.callback(1, "acme", second.Get("state")); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("callback with the verifier of another authorization: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if n := f.count(&models.AppUser{}); n != 0 {
+		t.Errorf("%d users created by rejected callbacks", n)
+	}
+	if n := f.count(&models.AppSession{}); n != 0 {
+		t.Errorf("%d sessions issued by rejected callbacks", n)
+	}
+}
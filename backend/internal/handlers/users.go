@@ -1,17 +1,17 @@
 package handlers
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/middleware"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -20,13 +20,15 @@ import (
 
 // UserHandler handles app user management requests
 type UserHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db     *gorm.DB
+	cfg    *config.Config
+	oauth  *services.OAuthClient
+	quotas *services.QuotaService
 }
 
 // NewUserHandler creates a new user handler
 func NewUserHandler(db *gorm.DB, cfg *config.Config) *UserHandler {
-	return &UserHandler{db: db, cfg: cfg}
+	return &UserHandler{db: db, cfg: cfg, oauth: services.NewOAuthClient(), quotas: services.NewQuotaService(db, cfg)}
 }
 
 // User Management
@@ -124,12 +126,13 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 	project := c.MustGet("project").(models.Project)
 	
 	var req struct {
-		Email       string                 `json:"email" binding:"required,email"`
-		Password    string                 `json:"password" binding:"required,min=8"`
-		Name        string                 `json:"name"`
-		Username    string                 `json:"username"`
-		ProfileData map[string]interface{} `json:"profile_data"`
-		IsActive    *bool                  `json:"is_active"`
+		Email           string                 `json:"email" binding:"required,email"`
+		Password        string                 `json:"password" binding:"required"`
+		Name            string                 `json:"name"`
+		Username        string                 `json:"username"`
+		ProfileData     map[string]interface{} `json:"profile_data"`
+		IsActive        *bool                  `json:"is_active"`
+		IsEmailVerified bool                   `json:"is_email_verified"`
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -137,6 +140,16 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		return
 	}
 	
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
+	}
+	if err := validatePassword(settings, req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet requirements", "details": err.Error()})
+		return
+	}
+	
 	// Check if user already exists in this project
 	var existingUser models.AppUser
 	if err := h.db.Where("project_id = ? AND email = ?", project.ID, req.Email).First(&existingUser).Error; err == nil {
@@ -152,6 +165,10 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		}
 	}
 	
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaAppUsers, 1)) {
+		return
+	}
+	
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -175,6 +192,7 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		ProfileData:  req.ProfileData,
 		IsActive:     isActive,
 		ProjectID:    project.ID,
+		IsEmailVerified: req.IsEmailVerified,
 	}
 	
 	if err := h.db.Create(&user).Error; err != nil {
@@ -218,15 +236,6 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 	
-	// Debug logging
-	fmt.Printf("UpdateUser: userID=%s, IsActive=%v, Status=%v\n", userID, req.IsActive, req.Status)
-	if req.IsActive != nil {
-		fmt.Printf("UpdateUser: IsActive value=%t\n", *req.IsActive)
-	}
-	if req.Status != nil {
-		fmt.Printf("UpdateUser: Status value=%s\n", *req.Status)
-	}
-	
 	// Find user
 	var user models.AppUser
 	if err := h.db.Where("project_id = ? AND id = ?", project.ID, userID).First(&user).Error; err != nil {
@@ -317,35 +326,28 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 func (h *UserHandler) LoginUser(c *gin.Context) {
 	project := c.MustGet("project").(models.Project)
 	
-	// Debug: Print raw request body
-	if data, err := c.GetRawData(); err == nil {
-		fmt.Printf("LoginUser: Raw request body: %s\n", string(data))
-		// Reset the body for binding
-		c.Request.Body = io.NopCloser(bytes.NewBuffer(data))
-	}
-	
 	var req struct {
 		Email    string `json:"email" binding:"required,email"`
 		Password string `json:"password" binding:"required"`
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
-		fmt.Printf("LoginUser: JSON binding error: %v\n", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	
-	fmt.Printf("LoginUser: attempting login for email=%s, project=%s\n", req.Email, project.Slug)
-	
 	// Find user
 	var user models.AppUser
 	if err := h.db.Where("project_id = ? AND email = ?", project.ID, req.Email).First(&user).Error; err != nil {
-		fmt.Printf("LoginUser: user not found for email=%s, project_id=%d, error=%v\n", req.Email, project.ID, err)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 	
-	fmt.Printf("LoginUser: found user id=%s, is_active=%t\n", user.ID, user.IsActive)
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
+	}
 	
 	// Check if user is active
 	if !user.IsActive {
@@ -360,14 +362,13 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 	}
 	
 	// Verify password
-	fmt.Printf("LoginUser: Comparing password for user %s\n", user.Email)
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		fmt.Printf("LoginUser: Password verification failed for user %s: %v\n", user.Email, err)
-		// Increment login attempts
+		// Increment login attempts and lock the account once they run out
 		user.LoginAttempts++
-		if user.LoginAttempts >= 5 {
-			lockUntil := time.Now().Add(15 * time.Minute)
+		if settings.MaxLoginAttempts > 0 && user.LoginAttempts >= settings.MaxLoginAttempts {
+			lockUntil := time.Now().Add(time.Duration(settings.LockoutDuration) * time.Minute)
 			user.LockedUntil = &lockUntil
+			user.LoginAttempts = 0
 		}
 		h.db.Save(&user)
 		
@@ -375,7 +376,10 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 		return
 	}
 	
-	fmt.Printf("LoginUser: Password verification successful for user %s\n", user.Email)
+	if settings.EmailVerification && !user.IsEmailVerified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address not verified"})
+		return
+	}
 	
 	// Reset login attempts on successful login
 	user.LoginAttempts = 0
@@ -386,24 +390,8 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 	h.db.Save(&user)
 	
 	// Create session
-	sessionToken, err := generateSecureToken()
+	session, err := createAppSession(h.db, c, settings, user)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate session token"})
-		return
-	}
-	
-	session := models.AppSession{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Token:     sessionToken,
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-		IPAddress: c.ClientIP(),
-		UserAgent: c.GetHeader("User-Agent"),
-		ProjectID: project.ID,
-		IsActive:  true,
-	}
-	
-	if err := h.db.Create(&session).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
@@ -411,7 +399,7 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"user": user,
 		"session": gin.H{
-			"token":      sessionToken,
+			"token":      session.Token,
 			"expires_at": session.ExpiresAt,
 		},
 	})
@@ -478,7 +466,7 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 	
 	var req struct {
 		CurrentPassword string `json:"current_password" binding:"required"`
-		NewPassword     string `json:"new_password" binding:"required,min=8"`
+		NewPassword     string `json:"new_password" binding:"required"`
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -486,6 +474,16 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 	
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
+	}
+	if err := validatePassword(settings, req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet requirements", "details": err.Error()})
+		return
+	}
+	
 	// Find user
 	var user models.AppUser
 	if err := h.db.Where("project_id = ? AND id = ?", project.ID, userID).First(&user).Error; err != nil {
@@ -560,37 +558,37 @@ func (h *UserHandler) RevokeSession(c *gin.Context) {
 
 // GetAuthSettings returns authentication settings for the project
 func (h *UserHandler) GetAuthSettings(c *gin.Context) {
-	_ = c.MustGet("project").(models.Project)
-	
-	// Return default auth settings - in a real implementation, 
-	// these would be stored in the database per project
-	settings := gin.H{
-		"email_verification":   true,
-		"password_min_length":  8,
-		"session_duration":     24,
-		"max_login_attempts":   5,
-		"lockout_duration":     30,
-		"providers": []gin.H{
-			{"id": "email", "name": "Email/Password", "enabled": true, "icon": "✉️"},
-			{"id": "google", "name": "Google OAuth", "enabled": false, "icon": "🌐"},
-			{"id": "github", "name": "GitHub OAuth", "enabled": false, "icon": "⚫"},
-			{"id": "apple", "name": "Apple ID", "enabled": false, "icon": "🍎"},
-		},
+	project := c.MustGet("project").(models.Project)
+	
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
 	}
 	
-	c.JSON(http.StatusOK, settings)
+	providers, err := h.listAuthProviders(project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch auth providers"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, authSettingsResponse(settings, providers))
 }
 
 // UpdateAuthSettings updates authentication settings for the project
 func (h *UserHandler) UpdateAuthSettings(c *gin.Context) {
-	_ = c.MustGet("project").(models.Project)
+	project := c.MustGet("project").(models.Project)
 	
 	var req struct {
-		EmailVerification  bool `json:"email_verification"`
-		PasswordMinLength  int  `json:"password_min_length"`
-		SessionDuration    int  `json:"session_duration"`
-		MaxLoginAttempts   int  `json:"max_login_attempts"`
-		LockoutDuration    int  `json:"lockout_duration"`
+		EmailVerification        *bool `json:"email_verification"`
+		PasswordMinLength        *int  `json:"password_min_length" binding:"omitempty,min=6,max=72"`
+		PasswordRequireUppercase *bool `json:"password_require_uppercase"`
+		PasswordRequireLowercase *bool `json:"password_require_lowercase"`
+		PasswordRequireNumber    *bool `json:"password_require_number"`
+		PasswordRequireSymbol    *bool `json:"password_require_symbol"`
+		SessionDuration          *int  `json:"session_duration" binding:"omitempty,min=1,max=8760"` // Hours
+		MaxLoginAttempts         *int  `json:"max_login_attempts" binding:"omitempty,min=0,max=100"`
+		LockoutDuration          *int  `json:"lockout_duration" binding:"omitempty,min=1,max=10080"` // Minutes
 	}
 	
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -598,46 +596,53 @@ func (h *UserHandler) UpdateAuthSettings(c *gin.Context) {
 		return
 	}
 	
-	// In a real implementation, you would save these settings to the database
-	// For now, we'll just return success
-	c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
-}
-
-// GetAuthProviders returns available authentication providers
-func (h *UserHandler) GetAuthProviders(c *gin.Context) {
-	_ = c.MustGet("project").(models.Project)
-	
-	providers := []gin.H{
-		{"id": "email", "name": "Email/Password", "enabled": true, "icon": "✉️"},
-		{"id": "google", "name": "Google OAuth", "enabled": false, "icon": "🌐"},
-		{"id": "github", "name": "GitHub OAuth", "enabled": false, "icon": "⚫"},
-		{"id": "apple", "name": "Apple ID", "enabled": false, "icon": "🍎"},
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
 	}
 	
-	c.JSON(http.StatusOK, providers)
-}
-
-// UpdateAuthProvider updates an authentication provider's settings
-func (h *UserHandler) UpdateAuthProvider(c *gin.Context) {
-	_ = c.MustGet("project").(models.Project)
-	providerID := c.Param("provider_id")
+	if req.EmailVerification != nil {
+		settings.EmailVerification = *req.EmailVerification
+	}
+	if req.PasswordMinLength != nil {
+		settings.PasswordMinLength = *req.PasswordMinLength
+	}
+	if req.PasswordRequireUppercase != nil {
+		settings.PasswordRequireUppercase = *req.PasswordRequireUppercase
+	}
+	if req.PasswordRequireLowercase != nil {
+		settings.PasswordRequireLowercase = *req.PasswordRequireLowercase
+	}
+	if req.PasswordRequireNumber != nil {
+		settings.PasswordRequireNumber = *req.PasswordRequireNumber
+	}
+	if req.PasswordRequireSymbol != nil {
+		settings.PasswordRequireSymbol = *req.PasswordRequireSymbol
+	}
+	if req.SessionDuration != nil {
+		settings.SessionDuration = *req.SessionDuration
+	}
+	if req.MaxLoginAttempts != nil {
+		settings.MaxLoginAttempts = *req.MaxLoginAttempts
+	}
+	if req.LockoutDuration != nil {
+		settings.LockoutDuration = *req.LockoutDuration
+	}
 	
-	var req struct {
-		Enabled bool `json:"enabled"`
+	// Save inserts the defaults row on first update; Select keeps false and zero values
+	if err := h.db.Select("*").Omit("created_at").Save(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save auth settings"})
+		return
 	}
 	
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	providers, err := h.listAuthProviders(project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch auth providers"})
 		return
 	}
 	
-	// In a real implementation, you would save provider settings to the database
-	// For now, we'll just return success
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Provider settings updated successfully",
-		"provider_id": providerID,
-		"enabled": req.Enabled,
-	})
+	c.JSON(http.StatusOK, authSettingsResponse(settings, providers))
 }
 
 // Admin methods for user management via JWT admin routes
@@ -761,13 +766,166 @@ func (h *UserHandler) AdminUpdateAuthSettings(c *gin.Context) {
 	h.UpdateAuthSettings(c)
 }
 
+// AdminGetAuthProviders lists auth providers via admin interface (JWT authenticated)
+func (h *UserHandler) AdminGetAuthProviders(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular GetAuthProviders method
+	h.GetAuthProviders(c)
+}
+
+// AdminUpdateAuthProvider configures an auth provider via admin interface (JWT authenticated)
+func (h *UserHandler) AdminUpdateAuthProvider(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular UpdateAuthProvider method
+	h.UpdateAuthProvider(c)
+}
+
+// AdminDeleteAuthProvider removes an auth provider via admin interface (JWT authenticated)
+func (h *UserHandler) AdminDeleteAuthProvider(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular DeleteAuthProvider method
+	h.DeleteAuthProvider(c)
+}
+
+// AdminGetMailSettings gets mail settings via admin interface (JWT authenticated)
+func (h *UserHandler) AdminGetMailSettings(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular GetMailSettings method
+	h.GetMailSettings(c)
+}
+
+// AdminUpdateMailSettings updates mail settings via admin interface (JWT authenticated)
+func (h *UserHandler) AdminUpdateMailSettings(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular UpdateMailSettings method
+	h.UpdateMailSettings(c)
+}
+
+// AdminListEmailTemplates lists email templates via admin interface (JWT authenticated)
+func (h *UserHandler) AdminListEmailTemplates(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular ListEmailTemplates method
+	h.ListEmailTemplates(c)
+}
+
+// AdminUpdateEmailTemplate overrides an email template via admin interface (JWT authenticated)
+func (h *UserHandler) AdminUpdateEmailTemplate(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular UpdateEmailTemplate method
+	h.UpdateEmailTemplate(c)
+}
+
+// AdminDeleteEmailTemplate resets an email template via admin interface (JWT authenticated)
+func (h *UserHandler) AdminDeleteEmailTemplate(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular DeleteEmailTemplate method
+	h.DeleteEmailTemplate(c)
+}
+
+// AdminSendTestEmail sends a test email via admin interface (JWT authenticated)
+func (h *UserHandler) AdminSendTestEmail(c *gin.Context) {
+	projectID := c.Param("id")
+	
+	var project models.Project
+	if err := h.db.Where("id = ?", projectID).First(&project).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+		return
+	}
+	
+	// Set the project in context for the regular handler
+	c.Set("project", project)
+	
+	// Call the regular SendTestEmail method
+	h.SendTestEmail(c)
+}
+
 // RegisterUser handles user registration for project applications
 func (h *UserHandler) RegisterUser(c *gin.Context) {
 	project := c.MustGet("project").(models.Project)
 	
 	var req struct {
 		Email    string `json:"email" binding:"required,email"`
-		Password string `json:"password" binding:"required,min=8"`
+		Password string `json:"password" binding:"required"`
 		Name     string `json:"name" binding:"required"`
 	}
 	
@@ -776,6 +934,16 @@ func (h *UserHandler) RegisterUser(c *gin.Context) {
 		return
 	}
 	
+	settings, err := loadAuthSettings(h.db, project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth settings"})
+		return
+	}
+	if err := validatePassword(settings, req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet requirements", "details": err.Error()})
+		return
+	}
+	
 	// Check if user already exists in this project
 	var existingUser models.AppUser
 	if err := h.db.Where("project_id = ? AND email = ?", project.ID, req.Email).First(&existingUser).Error; err == nil {
@@ -783,6 +951,10 @@ func (h *UserHandler) RegisterUser(c *gin.Context) {
 		return
 	}
 	
+	if middleware.RespondQuotaError(c, h.quotas.Check(project, services.QuotaAppUsers, 1)) {
+		return
+	}
+	
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -792,6 +964,7 @@ func (h *UserHandler) RegisterUser(c *gin.Context) {
 	
 	// Create user
 	user := models.AppUser{
+		ID:           uuid.New().String(),
 		ProjectID:    project.ID,
 		Email:        req.Email,
 		PasswordHash: string(hashedPassword),
@@ -804,31 +977,28 @@ func (h *UserHandler) RegisterUser(c *gin.Context) {
 		return
 	}
 	
-	// Create session
-	sessionToken, err := generateSecureToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate session token"})
+	// Users must verify their email before they get a session
+	if settings.EmailVerification {
+		if err := h.issueEmailVerification(project, user); err != nil {
+			fmt.Printf("RegisterUser: Failed to issue verification email for user %s: %v\n", user.ID, err)
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"user": user,
+			"email_verification_required": true,
+		})
 		return
 	}
 	
-	session := models.AppSession{
-		UserID:      user.ID,
-		ProjectID:   project.ID,
-		Token:       sessionToken,
-		ExpiresAt:   time.Now().Add(24 * time.Hour),
-		IPAddress:   c.ClientIP(),
-		UserAgent:   c.GetHeader("User-Agent"),
-		IsActive:    true,
-	}
-	
-	if err := h.db.Create(&session).Error; err != nil {
+	// Create session
+	session, err := createAppSession(h.db, c, settings, user)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
 	
 	c.JSON(http.StatusCreated, gin.H{
 		"user": user,
-		"token": sessionToken,
+		"token": session.Token,
 		"expires_at": session.ExpiresAt,
 	})
 }
@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"time"
 	"net"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -121,6 +122,11 @@ func (w *customResponseWriter) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController (used by streaming responses)
+func (w *customResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // shouldSkipLogging checks if a path should be skipped from logging
 func shouldSkipLogging(path string, skipPaths []string) bool {
 	for _, skipPath := range skipPaths {
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -9,9 +10,9 @@ import (
 
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -72,7 +73,7 @@ func RequireAuth(cfg *config.Config) gin.HandlerFunc {
 }
 
 // ProjectAuth middleware validates project access via API key
-func ProjectAuth(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
+func ProjectAuth(cfg *config.Config, db *gorm.DB, keys *services.APIKeyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		projectIDStr := c.Param("project_id")
 		if projectIDStr == "" {
@@ -106,51 +107,29 @@ func ProjectAuth(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Find API key by project - we need to check hash since keys are not stored in plain text
-		var apiKeys []models.APIKey
-		err = db.Where("project_id = ? AND is_active = true", project.ID).Find(&apiKeys).Error
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		// Look the key up by its prefix and verify its hash
+		key, err := keys.Authenticate(project.ID, apiKey, c.ClientIP())
+		if errors.Is(err, services.ErrAPIKeyExpired) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "API key expired"})
 			c.Abort()
 			return
 		}
-
-		// Check each API key hash
-		var validKey *models.APIKey
-		for _, k := range apiKeys {
-			if err := bcrypt.CompareHashAndPassword([]byte(k.KeyHash), []byte(apiKey)); err == nil {
-				validKey = &k
-				break
-			}
-		}
-
-		if validKey == nil {
+		if errors.Is(err, services.ErrAPIKeyInvalid) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
 			c.Abort()
 			return
 		}
-
-		key := *validKey
-
-		// Check if key is expired
-		if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "API key expired"})
+		if err != nil {
+			log.Printf("API key lookup failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			c.Abort()
 			return
 		}
 
-		// Update last used timestamp in transaction for consistency
-		tx := db.Begin()
-		if err := tx.Model(&key).Update("last_used_at", time.Now()).Error; err != nil {
-			log.Printf("Failed to update API key last_used_at: %v", err)
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-
 		// Store project and key info in context
 		c.Set("project", project)
 		c.Set("api_key", key)
+		c.Set("api_key_id", key.ID)
 
 		c.Next()
 	}
@@ -242,7 +221,7 @@ func ProjectOnly(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
 }
 
 // ProjectAuthOrJWT middleware accepts both JWT tokens and API keys for project access
-func ProjectAuthOrJWT(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
+func ProjectAuthOrJWT(cfg *config.Config, db *gorm.DB, keys *services.APIKeyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		projectIDStr := c.Param("project_id")
 		if projectIDStr == "" {
@@ -271,46 +250,26 @@ func ProjectAuthOrJWT(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
 		// Try API key authentication first
 		apiKey := c.GetHeader("X-API-Key")
 		if apiKey != "" {
-			// Find API key by project - we need to check hash since keys are not stored in plain text
-			var apiKeys []models.APIKey
-			err = db.Where("project_id = ? AND is_active = true", project.ID).Find(&apiKeys).Error
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			// Look the key up by its prefix and verify its hash
+			key, err := keys.Authenticate(project.ID, apiKey, c.ClientIP())
+			if errors.Is(err, services.ErrAPIKeyExpired) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "API key expired"})
 				c.Abort()
 				return
 			}
-
-			// Check each API key hash
-			var validKey *models.APIKey
-			for _, k := range apiKeys {
-				if err := bcrypt.CompareHashAndPassword([]byte(k.KeyHash), []byte(apiKey)); err == nil {
-					validKey = &k
-					break
-				}
+			if err != nil && !errors.Is(err, services.ErrAPIKeyInvalid) {
+				log.Printf("API key lookup failed: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				c.Abort()
+				return
 			}
 
-			if validKey != nil {
-				key := *validKey
-				// Check if key is expired
-				if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
-					c.JSON(http.StatusUnauthorized, gin.H{"error": "API key expired"})
-					c.Abort()
-					return
-				}
-
-				// Update last used timestamp
-				tx := db.Begin()
-				if err := tx.Model(&key).Update("last_used_at", time.Now()).Error; err != nil {
-					log.Printf("Failed to update API key last_used_at: %v", err)
-					tx.Rollback()
-				} else {
-					tx.Commit()
-				}
-
+			if err == nil {
 				// Store project and key info in context
 				c.Set("project", project)
 				c.Set("project_id", project.ID)
 				c.Set("api_key", key)
+				c.Set("api_key_id", key.ID) // Attributes the request log to the key
 				c.Next()
 				return
 			}
@@ -349,8 +308,63 @@ func ProjectAuthOrJWT(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
 			}
 		}
 
+		// Browsers cannot set headers on WebSocket and EventSource connections, so those
+		// may present a short-lived ticket issued to one of the credentials above instead
+		if ticket := c.Query("ticket"); ticket != "" && isRealtimeRequest(c.Request) {
+			if authenticateTicket(c, cfg, keys, project, ticket) {
+				c.Next()
+			}
+			return
+		}
+
 		// Neither authentication method worked
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "API key or valid authorization required"})
 		c.Abort()
 	}
+}
+
+// isRealtimeRequest reports whether a request opens a WebSocket or an event stream
+func isRealtimeRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// authenticateTicket stores the credentials of a realtime ticket in the context, or aborts
+func authenticateTicket(c *gin.Context, cfg *config.Config, keys *services.APIKeyStore, project models.Project, token string) bool {
+	ticket, err := services.ParseRealtimeTicket(cfg, token)
+	if err != nil || ticket.ProjectID != project.ID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired ticket"})
+		c.Abort()
+		return false
+	}
+
+	c.Set("project", project)
+	c.Set("project_id", project.ID)
+	if ticket.SessionID != "" {
+		c.Set("realtime_session_id", ticket.SessionID)
+	}
+
+	if ticket.UserID != 0 {
+		c.Set("user_id", ticket.UserID)
+		c.Set("user_email", ticket.Email)
+		c.Set("user_role", ticket.Role)
+		return true
+	}
+
+	// The key may have been revoked since the ticket was issued
+	key, err := keys.AuthenticateID(project.ID, ticket.APIKeyID)
+	if errors.Is(err, services.ErrAPIKeyExpired) || errors.Is(err, services.ErrAPIKeyInvalid) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired ticket"})
+		c.Abort()
+		return false
+	}
+	if err != nil {
+		log.Printf("API key lookup failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.Abort()
+		return false
+	}
+	c.Set("api_key", key)
+	c.Set("api_key_id", key.ID)
+	return true
 }
\ No newline at end of file
@@ -94,6 +94,7 @@ func SmartCORS(cfg *config.Config) gin.HandlerFunc {
 				allowedHeaders := getUniversalAllowedHeaders(corsConfig)
 				c.Header("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
 				
+				c.Header("Access-Control-Expose-Headers", "ETag")
 				c.Header("Access-Control-Allow-Credentials", "true")
 				c.Header("Access-Control-Max-Age", fmt.Sprintf("%d", corsConfig.MaxAge))
 				
@@ -218,6 +219,7 @@ func getAllPossibleHeaders() []string {
 		// Standard HTTP headers
 		"Accept", "Content-Type", "Content-Length", "Accept-Encoding",
 		"Cache-Control", "X-Requested-With", "User-Agent",
+		"If-Match", "If-None-Match",
 		
 		// Authentication headers (all variations for maximum compatibility)
 		"Authorization", "Bearer",
@@ -253,6 +255,7 @@ func getEssentialHeaders() []string {
 		"Accept", "Content-Type", "Authorization",
 		"Session-Token", "X-API-Key", "X-Session-Token",
 		"X-Project-ID", "X-Requested-With",
+		"If-Match", "If-None-Match",
 	}
 }
 
@@ -416,6 +419,7 @@ func ProjectSmartCORS(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
 				c.Header("Access-Control-Allow-Origin", origin)
 				c.Header("Access-Control-Allow-Methods", strings.Join(ensureRequiredMethods(enhancedProjectConfig.AllowedMethods), ", "))
 				c.Header("Access-Control-Allow-Headers", strings.Join(getUniversalAllowedHeaders(enhancedProjectConfig), ", "))
+				c.Header("Access-Control-Expose-Headers", "ETag")
 				
 				if projectCorsConfig.AllowCredentials {
 					c.Header("Access-Control-Allow-Credentials", "true")
@@ -432,4 +436,28 @@ func ProjectSmartCORS(cfg *config.Config, db *gorm.DB) gin.HandlerFunc {
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+// ProjectOriginAllowed reports whether a browser origin may open realtime connections to a
+// project, using the same CORS settings as ProjectSmartCORS. Requests without an Origin
+// header do not come from a browser page and are allowed.
+func ProjectOriginAllowed(cfg *config.Config, db *gorm.DB, projectID uint, origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	corsConfig := getEnhancedCORSConfig(cfg)
+	var projectCorsConfig models.CORSConfig
+	if err := db.Where("project_id = ?", projectID).First(&projectCorsConfig).Error; err == nil {
+		corsConfig = &EnhancedCORSConfig{
+			Environment:    corsConfig.Environment,
+			AllowedOrigins: projectCorsConfig.AllowedOrigins,
+			AutoDetect:     corsConfig.AutoDetect,
+		}
+	}
+
+	allowed, reason := isOriginAllowedEnhanced(origin, corsConfig)
+	if !allowed {
+		logCORSViolation(origin, "realtime", fmt.Sprintf("project-%d: %s", projectID, reason))
+	}
+	return allowed
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// API key permission actions. Permissions are written resource:action[:scope], for example
+// data:read, data:write:posts or storage:read:avatars. Scopes name a collection, bucket or
+// function and may use * wildcards (data:read:public_*). admin grants every action on a
+// resource and * every resource or action.
+const (
+	PermissionRead    = "read"
+	PermissionWrite   = "write"
+	PermissionDelete  = "delete"
+	PermissionAdmin   = "admin"
+	PermissionInvoke  = "invoke"
+	PermissionSession = "session" // The signed-in app user's own session
+)
+
+// permissionResources lists the actions of each resource and whether it can be scoped
+var permissionResources = map[string]struct {
+	Actions []string
+	Scoped  bool
+}{
+	"data":      {[]string{PermissionRead, PermissionWrite, PermissionDelete, PermissionAdmin}, true},                     // Scope: collection
+	"storage":   {[]string{PermissionRead, PermissionWrite, PermissionDelete, PermissionAdmin}, true},                     // Scope: bucket
+	"functions": {[]string{PermissionInvoke, PermissionAdmin}, true},                                                      // Scope: function name
+	"users":     {[]string{PermissionSession, PermissionRead, PermissionWrite, PermissionDelete, PermissionAdmin}, false}, // App users, sessions and auth settings
+	"messaging": {[]string{PermissionRead, PermissionWrite, PermissionDelete, PermissionAdmin}, false},
+	"project":   {[]string{PermissionRead, PermissionWrite, PermissionAdmin}, false}, // Discovery, templates and site content
+}
+
+// publicPermissions may be granted to public keys, which are shipped to browsers
+var publicPermissions = map[string]bool{
+	"data:read":        true,
+	"storage:read":     true,
+	"functions:invoke": true,
+	"users:session":    true,
+}
+
+// legacyPermissions are the unscoped permissions of keys created before scopes existed;
+// they apply to every resource
+var legacyPermissions = map[string]bool{
+	PermissionRead:   true,
+	PermissionWrite:  true,
+	PermissionDelete: true,
+	PermissionAdmin:  true,
+}
+
+// ValidatePermissions checks permissions against the vocabulary. Public keys may only read
+// data and storage, invoke functions and use the session of a signed-in app user.
+func ValidatePermissions(permissions []string, public bool) error {
+	if public && len(permissions) == 0 {
+		return fmt.Errorf("public keys need explicit permissions")
+	}
+
+	for _, permission := range permissions {
+		if permission == "*" || legacyPermissions[permission] {
+			if public {
+				return fmt.Errorf("permission %q cannot be granted to a public key", permission)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(permission, ":", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("permission %q must be written resource:action[:scope]", permission)
+		}
+		resource, action := parts[0], parts[1]
+
+		if resource == "*" {
+			if public {
+				return fmt.Errorf("permission %q cannot be granted to a public key", permission)
+			}
+			if len(parts) == 3 {
+				return fmt.Errorf("permission %q cannot be scoped", permission)
+			}
+			continue
+		}
+
+		definition, ok := permissionResources[resource]
+		if !ok {
+			return fmt.Errorf("permission %q has unknown resource %q", permission, resource)
+		}
+		if action != "*" && !containsAction(definition.Actions, action) {
+			return fmt.Errorf("permission %q has unknown action %q; %s supports %s",
+				permission, action, resource, strings.Join(definition.Actions, ", "))
+		}
+		if len(parts) == 3 {
+			if !definition.Scoped {
+				return fmt.Errorf("permission %q cannot be scoped", permission)
+			}
+			if _, err := path.Match(parts[2], ""); err != nil || parts[2] == "" {
+				return fmt.Errorf("permission %q has an invalid scope", permission)
+			}
+		}
+		if public && !publicPermissions[resource+":"+action] {
+			return fmt.Errorf("permission %q cannot be granted to a public key", permission)
+		}
+	}
+	return nil
+}
+
+// KeyAllows reports whether an API key grants an action on a resource. scope is the
+// collection, bucket or function of the request, or empty for resource-wide routes, which
+// scoped permissions do not grant. Keys without permissions predate scopes and keep full
+// access.
+func KeyAllows(key models.APIKey, resource, action, scope string) bool {
+	if len(key.Permissions) == 0 && !key.IsPublic {
+		return true
+	}
+
+	for _, permission := range key.Permissions {
+		if permission == "*" || permission == PermissionAdmin || permission == action {
+			return true
+		}
+		if legacyPermissions[permission] && (action == PermissionInvoke || action == PermissionSession) {
+			// Any key could invoke functions and use sessions before scopes existed
+			return true
+		}
+
+		parts := strings.SplitN(permission, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		if parts[0] != "*" && parts[0] != resource {
+			continue
+		}
+		if parts[1] != "*" && parts[1] != action && parts[1] != PermissionAdmin {
+			continue
+		}
+		if len(parts) == 3 {
+			if scope == "" {
+				continue
+			}
+			if matched, _ := path.Match(parts[2], scope); !matched {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// RequirePermission restricts a route to API keys granting resource:action, scoped to the
+// value of scopeParam when it is not empty. Requests authenticated with an admin JWT are
+// not restricted.
+func RequirePermission(resource, action, scopeParam string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("api_key")
+		if !exists {
+			c.Next()
+			return
+		}
+		key := value.(models.APIKey)
+
+		scope := ""
+		required := resource + ":" + action
+		if scopeParam != "" {
+			scope = c.Param(scopeParam)
+			required += ":" + scope
+		}
+
+		if !KeyAllows(key, resource, action, scope) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":               "API key does not have the required permission",
+				"required_permission": required,
+				"permissions":         key.Permissions,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func containsAction(actions []string, action string) bool {
+	for _, candidate := range actions {
+		if candidate == action {
+			return true
+		}
+	}
+	return false
+}
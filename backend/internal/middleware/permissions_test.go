@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+func TestValidatePermissions(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		public      bool
+		err         string
+	}{
+		{name: "empty secret key"},
+		{name: "resource actions", permissions: []string{"data:read", "storage:write", "functions:invoke", "users:session", "messaging:admin", "project:read"}},
+		{name: "scoped with wildcard", permissions: []string{"data:write:posts", "storage:read:public_*", "functions:invoke:send-*"}},
+		{name: "every action of a resource", permissions: []string{"data:*"}},
+		{name: "every resource", permissions: []string{"*", "*:read"}},
+		{name: "legacy permissions", permissions: []string{"read", "write", "delete", "admin"}},
+		{name: "public read", permissions: []string{"data:read:posts", "storage:read", "functions:invoke", "users:session"}, public: true},
+		{name: "public key without permissions", public: true, err: "need explicit permissions"},
+		{name: "public write", permissions: []string{"data:write"}, public: true, err: "cannot be granted to a public key"},
+		{name: "public wildcard action", permissions: []string{"data:*"}, public: true, err: "cannot be granted to a public key"},
+		{name: "public legacy", permissions: []string{"read"}, public: true, err: "cannot be granted to a public key"},
+		{name: "public every resource", permissions: []string{"*:read"}, public: true, err: "cannot be granted to a public key"},
+		{name: "missing action", permissions: []string{"data"}, err: "must be written resource:action[:scope]"},
+		{name: "unknown resource", permissions: []string{"billing:read"}, err: "unknown resource"},
+		{name: "unknown action", permissions: []string{"functions:read"}, err: "unknown action"},
+		{name: "session is not a data action", permissions: []string{"data:session"}, err: "unknown action"},
+		{name: "unscoped resource", permissions: []string{"messaging:read:general"}, err: "cannot be scoped"},
+		{name: "scoped every resource", permissions: []string{"*:read:posts"}, err: "cannot be scoped"},
+		{name: "empty scope", permissions: []string{"data:read:"}, err: "invalid scope"},
+		{name: "malformed scope pattern", permissions: []string{"data:read:[a"}, err: "invalid scope"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePermissions(tt.permissions, tt.public)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestKeyAllows(t *testing.T) {
+	key := func(public bool, permissions ...string) models.APIKey {
+		return models.APIKey{IsPublic: public, Permissions: pq.StringArray(permissions)}
+	}
+
+	tests := []struct {
+		name     string
+		key      models.APIKey
+		resource string
+		action   string
+		scope    string
+		want     bool
+	}{
+		{"key without permissions predates scopes", key(false), "data", PermissionDelete, "posts", true},
+		{"public key without permissions", key(true), "data", PermissionRead, "posts", false},
+		{"exact permission", key(false, "data:read"), "data", PermissionRead, "posts", true},
+		{"other action", key(false, "data:read"), "data", PermissionWrite, "posts", false},
+		{"other resource", key(false, "data:read"), "storage", PermissionRead, "avatars", false},
+		{"resource admin grants every action", key(false, "storage:admin"), "storage", PermissionDelete, "avatars", true},
+		{"wildcard action", key(false, "data:*"), "data", PermissionDelete, "posts", true},
+		{"wildcard resource", key(false, "*:read"), "messaging", PermissionRead, "", true},
+		{"everything", key(false, "*"), "project", PermissionAdmin, "", true},
+		{"scoped to the collection", key(false, "data:write:posts"), "data", PermissionWrite, "posts", true},
+		{"scoped to another collection", key(false, "data:write:posts"), "data", PermissionWrite, "comments", false},
+		{"scope pattern", key(false, "storage:read:public_*"), "storage", PermissionRead, "public_images", true},
+		{"scope pattern does not match", key(false, "storage:read:public_*"), "storage", PermissionRead, "private", false},
+		{"scoped permission on a resource-wide route", key(false, "data:read:posts"), "data", PermissionRead, "", false},
+		{"second permission grants", key(false, "data:read", "functions:invoke:send"), "functions", PermissionInvoke, "send", true},
+		{"legacy action applies to every resource", key(false, "write"), "storage", PermissionWrite, "avatars", true},
+		{"legacy action does not grant others", key(false, "read"), "data", PermissionDelete, "posts", false},
+		{"legacy admin", key(false, "admin"), "users", PermissionAdmin, "", true},
+		{"legacy keys could invoke functions", key(false, "read"), "functions", PermissionInvoke, "send", true},
+		{"legacy keys could use sessions", key(false, "read"), "users", PermissionSession, "", true},
+		{"malformed permission is ignored", key(false, "data"), "data", PermissionRead, "posts", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KeyAllows(tt.key, tt.resource, tt.action, tt.scope); got != tt.want {
+				t.Errorf("KeyAllows(%v, %s:%s:%s) = %v, want %v",
+					tt.key.Permissions, tt.resource, tt.action, tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		key    *models.APIKey
+		status int
+	}{
+		{"admin JWT", nil, http.StatusOK},
+		{"granting key", &models.APIKey{Permissions: pq.StringArray{"data:write:posts"}}, http.StatusOK},
+		{"key scoped elsewhere", &models.APIKey{Permissions: pq.StringArray{"data:write:comments"}}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.POST("/data/:collection", func(c *gin.Context) {
+				if tt.key != nil {
+					c.Set("api_key", *tt.key)
+				}
+			}, RequirePermission("data", PermissionWrite, "collection"), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/data/posts", nil))
+			if recorder.Code != tt.status {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if tt.status == http.StatusForbidden && !strings.Contains(recorder.Body.String(), `"required_permission":"data:write:posts"`) {
+				t.Errorf("body = %s", recorder.Body.String())
+			}
+		})
+	}
+}
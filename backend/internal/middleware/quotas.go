@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// MeterAPICalls counts each request to a project API against the monthly API call quota of
+// the project. It must run after the project middleware.
+func MeterAPICalls(quotas *services.QuotaService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("project")
+		if !exists {
+			c.Next()
+			return
+		}
+
+		if RespondQuotaError(c, quotas.CountAPICall(value.(models.Project))) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// RespondQuotaError aborts a request that would pass a quota of its project with the usage of
+// the project, and reports whether it did. Other errors are logged and the request is let
+// through, as when the rate limit store is unavailable.
+func RespondQuotaError(c *gin.Context, err error) bool {
+	var exceeded *services.QuotaExceededError
+	if errors.As(err, &exceeded) {
+		c.AbortWithStatusJSON(exceeded.Status(), gin.H{
+			"error":  "Quota exceeded",
+			"quota":  exceeded.Metric,
+			"limits": exceeded.Limits,
+			"usage":  exceeded.Usage,
+		})
+		return true
+	}
+	if err != nil {
+		log.Printf("Failed to check quota: %v", err)
+	}
+	return false
+}
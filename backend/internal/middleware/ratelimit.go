@@ -1,74 +1,147 @@
 package middleware
 
 import (
+	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 )
 
-// RateLimit middleware implements basic rate limiting
-func RateLimit(cfg *config.Config) gin.HandlerFunc {
-	// Simple in-memory store for demo purposes
-	// In production, use Redis or another distributed store
-	clients := make(map[string][]time.Time)
+// DefaultRateLimitRule returns the server-wide rate limit of a client of a project
+func DefaultRateLimitRule(cfg *config.Config) services.RateLimitRule {
+	window := time.Hour
+	if cfg.RateLimitWindow != "" {
+		if d, err := time.ParseDuration(cfg.RateLimitWindow); err == nil && d > 0 {
+			window = d
+		}
+	}
+	return services.RateLimitRule{Requests: cfg.RateLimitRequests, Window: window}
+}
 
+// RateLimitRuleFor returns the limit of a client of a project: the limit of its API key,
+// otherwise the limit of the project, otherwise the server default
+func RateLimitRuleFor(cfg *config.Config, project models.Project, key *models.APIKey) services.RateLimitRule {
+	if key != nil && key.RateLimitRequests > 0 && key.RateLimitWindowSeconds > 0 {
+		return services.RateLimitRule{Requests: key.RateLimitRequests, Window: time.Duration(key.RateLimitWindowSeconds) * time.Second}
+	}
+	if project.RateLimitRequests > 0 && project.RateLimitWindowSeconds > 0 {
+		return services.RateLimitRule{Requests: project.RateLimitRequests, Window: time.Duration(project.RateLimitWindowSeconds) * time.Second}
+	}
+	return DefaultRateLimitRule(cfg)
+}
+
+// RateLimitIP limits the requests of each IP address to a project with the server default
+// limit. It runs before authentication, so requests with invalid or guessed API keys are
+// limited too.
+func RateLimitIP(cfg *config.Config, store services.RateLimitStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get client IP
-		clientIP := c.ClientIP()
-
-		// Get current time
-		now := time.Now()
-
-		// Clean old entries (older than window)
-		window := 1 * time.Hour // Default window
-		if cfg.RateLimitWindow != "" {
-			if d, err := time.ParseDuration(cfg.RateLimitWindow); err == nil {
-				window = d
-			}
+		projectID, err := strconv.ParseUint(c.Param("project_id"), 10, 32)
+		rule := DefaultRateLimitRule(cfg)
+		if err != nil || rule.Requests <= 0 {
+			c.Next() // The project middleware rejects the request
+			return
 		}
 
-		// Get or create client request history
-		requests, exists := clients[clientIP]
+		bucket := fmt.Sprintf("cloudbox:ratelimit:project:%d:ip:%s", projectID, c.ClientIP())
+		if !takeRateLimit(c, store, bucket, rule) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// RateLimit limits the requests of each authenticated client of a project: its API key or
+// signed-in admin. Requests without either are only limited by RateLimitIP, unless the
+// project sets its own limit. It must run after the project middleware.
+func RateLimit(cfg *config.Config, store services.RateLimitStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("project")
 		if !exists {
-			requests = []time.Time{}
+			c.Next()
+			return
 		}
+		project := value.(models.Project)
 
-		// Remove old requests outside the window
-		var validRequests []time.Time
-		cutoff := now.Add(-window)
-		for _, reqTime := range requests {
-			if reqTime.After(cutoff) {
-				validRequests = append(validRequests, reqTime)
-			}
+		var key *models.APIKey
+		var client string
+		if value, exists := c.Get("api_key"); exists {
+			apiKey := value.(models.APIKey)
+			key = &apiKey
+			client = fmt.Sprintf("key:%d", apiKey.ID)
+		} else if userID := c.GetUint("user_id"); userID != 0 {
+			client = fmt.Sprintf("user:%d", userID)
+		} else if project.RateLimitRequests > 0 {
+			client = "client-ip:" + c.ClientIP()
+		} else {
+			c.Next()
+			return
 		}
 
-		// Check if client has exceeded rate limit
-		if len(validRequests) >= cfg.RateLimitRequests {
-			c.Header("X-RateLimit-Limit", strconv.Itoa(cfg.RateLimitRequests))
-			c.Header("X-RateLimit-Remaining", "0")
-			c.Header("X-RateLimit-Reset", strconv.FormatInt(now.Add(window).Unix(), 10))
-			
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "Rate limit exceeded",
-				"retry_after": window.Seconds(),
-			})
-			c.Abort()
+		rule := RateLimitRuleFor(cfg, project, key)
+		if rule.Requests <= 0 {
+			c.Next()
 			return
 		}
 
-		// Add current request
-		validRequests = append(validRequests, now)
-		clients[clientIP] = validRequests
+		bucket := fmt.Sprintf("cloudbox:ratelimit:project:%d:%s", project.ID, client)
+		if !takeRateLimit(c, store, bucket, rule) {
+			return
+		}
+		c.Next()
+	}
+}
 
-		// Set rate limit headers
-		remaining := cfg.RateLimitRequests - len(validRequests)
-		c.Header("X-RateLimit-Limit", strconv.Itoa(cfg.RateLimitRequests))
-		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
-		c.Header("X-RateLimit-Reset", strconv.FormatInt(now.Add(window).Unix(), 10))
+// rateLimitState is the most restrictive bucket of a request so far, which the RateLimit-*
+// headers report
+type rateLimitState struct {
+	rule   services.RateLimitRule
+	result services.RateLimitResult
+}
 
-		c.Next()
+// takeRateLimit takes a token for a request and sets the rate limit headers. It aborts the
+// request and returns false when the bucket is empty; when the store is unavailable the
+// request is let through.
+func takeRateLimit(c *gin.Context, store services.RateLimitStore, bucket string, rule services.RateLimitRule) bool {
+	result, err := store.Take(c.Request.Context(), bucket, rule)
+	if err != nil {
+		log.Printf("Rate limit store unavailable: %v", err)
+		return true
 	}
-}
\ No newline at end of file
+
+	state := rateLimitState{rule: rule, result: result}
+	if value, exists := c.Get("rate_limit"); exists {
+		if previous := value.(rateLimitState); previous.result.Remaining < result.Remaining {
+			state = previous
+		}
+	}
+	c.Set("rate_limit", state)
+
+	c.Header("RateLimit-Limit", strconv.Itoa(state.rule.Requests))
+	c.Header("RateLimit-Remaining", strconv.Itoa(state.result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(state.result.Reset)))
+	c.Header("RateLimit-Policy", state.rule.Policy())
+
+	if !result.Allowed {
+		retryAfter := ceilSeconds(result.RetryAfter)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Rate limit exceeded",
+			"retry_after": retryAfter,
+		})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// ceilSeconds rounds a duration up to whole seconds, as rate limit headers require
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -92,6 +92,9 @@ type Organization struct {
 	// Statistics
 	ProjectCount int `json:"project_count" gorm:"default:0"`
 	
+	// Default quotas of the projects of the organization
+	Quotas QuotaLimits `json:"quotas" gorm:"embedded;embeddedPrefix:quota_"`
+	
 	// Organization admins (many-to-many relationship)
 	OrganizationAdmins []OrganizationAdmin `json:"organization_admins,omitempty"`
 }
@@ -137,6 +140,13 @@ type Project struct {
 	Notes       string `json:"notes" gorm:"type:text"` // Project notes
 	IsActive    bool   `json:"is_active" gorm:"default:true"`
 	
+	// Rate limit of each client of the project; 0 uses the server default
+	RateLimitRequests      int `json:"rate_limit_requests" gorm:"default:0"`
+	RateLimitWindowSeconds int `json:"rate_limit_window_seconds" gorm:"default:0"`
+	
+	// Usage quotas; limits of 0 inherit those of the organization
+	Quotas QuotaLimits `json:"quotas" gorm:"embedded;embeddedPrefix:quota_"`
+	
 	// Owner
 	UserID uint `json:"user_id" gorm:"not null"`
 	User   User `json:"user,omitempty"`
@@ -155,6 +165,30 @@ type Project struct {
 	GitHubConfig *ProjectGitHubConfig `json:"github_config,omitempty"`
 }
 
+// QuotaLimits caps the usage of a project. A limit of 0 inherits the next level up (project ->
+// organization -> server) and a negative limit removes it.
+type QuotaLimits struct {
+	StorageBytes      int64   `json:"storage_bytes" gorm:"default:0"`
+	Documents         int64   `json:"documents" gorm:"default:0"`
+	AppUsers          int64   `json:"app_users" gorm:"default:0"`
+	APICalls          int64   `json:"api_calls" gorm:"default:0"`           // Per calendar month
+	FunctionGBSeconds float64 `json:"function_gb_seconds" gorm:"default:0"` // Per calendar month
+}
+
+// ProjectUsage meters the usage of a project in a calendar month (UTC)
+type ProjectUsage struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ProjectID uint   `json:"project_id" gorm:"not null;uniqueIndex:idx_project_usages_period"`
+	Period    string `json:"period" gorm:"not null;size:7;uniqueIndex:idx_project_usages_period"` // YYYY-MM
+
+	APICalls           int64   `json:"api_calls" gorm:"not null;default:0"`
+	FunctionExecutions int64   `json:"function_executions" gorm:"not null;default:0"`
+	FunctionGBSeconds  float64 `json:"function_gb_seconds" gorm:"not null;default:0"` // Memory limit times duration
+}
+
 // ProjectGitHubConfig stores GitHub OAuth settings per project
 type ProjectGitHubConfig struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
@@ -185,14 +219,28 @@ type APIKey struct {
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 	
-	Name        string     `json:"name" gorm:"not null"`
-	KeyHash     string     `json:"-" gorm:"uniqueIndex;not null"` // Only store hashed version
-	IsActive    bool       `json:"is_active" gorm:"default:true"`
-	LastUsedAt  *time.Time `json:"last_used_at"`
-	ExpiresAt   *time.Time `json:"expires_at"`
+	Name          string     `json:"name" gorm:"not null"`
+	KeyPrefix     string     `json:"key_prefix" gorm:"index"`          // Public ID segment of the key, used for lookup
+	KeyHash       string     `json:"-" gorm:"uniqueIndex;not null"`    // Only store hashed version
+	HashAlgorithm string     `json:"-" gorm:"not null;default:bcrypt"` // hmac-sha256, or bcrypt for keys issued before prefixes
+	IsActive      bool       `json:"is_active" gorm:"default:true"`
+	LastUsedAt    *time.Time `json:"last_used_at"`
+	ExpiresAt     *time.Time `json:"expires_at"`
 	
 	// Permissions
-	Permissions pq.StringArray `json:"permissions" gorm:"type:text[]"`
+	Permissions pq.StringArray `json:"permissions" gorm:"type:text[]"` // resource:action[:scope], see middleware.RequirePermission
+	IsPublic    bool           `json:"is_public" gorm:"default:false"` // Read-only key that may be shipped to browsers
+	
+	// Rate limit of the key; 0 uses the limit of the project
+	RateLimitRequests      int `json:"rate_limit_requests" gorm:"default:0"`
+	RateLimitWindowSeconds int `json:"rate_limit_window_seconds" gorm:"default:0"`
+	
+	// Lifecycle
+	RotatedFromID      *uint      `json:"rotated_from_id,omitempty" gorm:"index"` // Key this one succeeded
+	RotatedAt          *time.Time `json:"rotated_at,omitempty"`                   // Set on the old key; it works until ExpiresAt
+	DeactivatedAt      *time.Time `json:"deactivated_at,omitempty"`
+	DeactivationReason string     `json:"deactivation_reason,omitempty"` // inactive or rotated
+	InactivityWarnedAt *time.Time `json:"-"`                             // Last warning that the key will be deactivated
 	
 	// Project relation
 	ProjectID uint    `json:"project_id" gorm:"not null"`
@@ -237,6 +285,10 @@ type Collection struct {
 	// Statistics
 	DocumentCount int64     `json:"document_count" gorm:"default:0"`
 	LastModified  time.Time `json:"last_modified"`
+	
+	// Revision retention
+	RevisionLimit         *int `json:"revision_limit" gorm:"default:50"`        // Revisions kept per document (0 = unlimited, nil = default)
+	RevisionRetentionDays int  `json:"revision_retention_days" gorm:"default:0"` // Age after which revisions are pruned (0 = forever)
 }
 
 // Document represents a document in a collection
@@ -258,6 +310,68 @@ type Document struct {
 	Author  string `json:"author"` // User/API key that created/modified
 }
 
+// DocumentRevision is an immutable snapshot of a document taken on every write
+type DocumentRevision struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Document info
+	ProjectID      uint   `json:"project_id" gorm:"not null;index"`
+	CollectionName string `json:"collection_name" gorm:"not null"`
+	DocumentID     string `json:"document_id" gorm:"not null;type:varchar(255)"`
+	Version        int    `json:"version" gorm:"not null"`
+
+	// Snapshot
+	Operation    string                 `json:"operation" gorm:"not null"` // create, update, delete, restore
+	Data         map[string]interface{} `json:"data" gorm:"type:jsonb;serializer:json"`
+	RestoredFrom *int                   `json:"restored_from,omitempty"` // Version a restore copied its data from
+
+	// Actor
+	Author   string `json:"author"`
+	APIKeyID *uint  `json:"api_key_id,omitempty"`
+}
+
+// DocumentChange is an entry of the realtime change feed, written in the same transaction as the document
+type DocumentChange struct {
+	Sequence  int64     `json:"sequence" gorm:"primaryKey;autoIncrement"`
+	XID       int64     `json:"-" gorm:"column:xid;not null;default:txid_current()"` // Writing transaction; orders the feed with Sequence
+	CreatedAt time.Time `json:"created_at"`
+
+	// Document info
+	ProjectID      uint   `json:"project_id" gorm:"not null;index"`
+	CollectionName string `json:"collection" gorm:"not null"`
+	DocumentID     string `json:"document_id" gorm:"not null;type:varchar(255)"`
+
+	// Change
+	Operation string                 `json:"operation" gorm:"not null"` // insert, update, delete
+	Version   int                    `json:"version"`
+	Author    string                 `json:"author"`
+	Data      map[string]interface{} `json:"data" gorm:"type:jsonb;serializer:json"` // Document data after the change (before it for deletes)
+}
+
+// CollectionIndex is a PostgreSQL expression index materialized from a Collection.Indexes entry
+type CollectionIndex struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Collection info
+	ProjectID      uint   `json:"project_id" gorm:"not null;index"`
+	CollectionName string `json:"collection_name" gorm:"not null"`
+
+	// Index definition
+	Spec      string `json:"spec" gorm:"not null"`                   // Declaration as stored in Collection.Indexes
+	Field     string `json:"field" gorm:"not null"`                  // Dotted path inside document data
+	Method    string `json:"method" gorm:"not null;default:'btree'"` // btree, gin
+	Unique    bool   `json:"unique" gorm:"default:false"`
+	IndexName string `json:"index_name" gorm:"not null;uniqueIndex"` // PostgreSQL index name
+
+	// Build status
+	Status  string     `json:"status" gorm:"not null;default:'pending'"` // pending, building, ready, failed
+	Error   string     `json:"error,omitempty"`
+	BuiltAt *time.Time `json:"built_at,omitempty"`
+}
+
 // GitHubRepository represents a connected GitHub repository
 type GitHubRepository struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
@@ -274,7 +388,7 @@ type GitHubRepository struct {
 
 	// GitHub webhook
 	WebhookID     *int64 `json:"webhook_id"`
-	WebhookSecret string `json:"webhook_secret"`
+	WebhookSecret string `json:"-"` // Encrypted with the master key
 
 	// SSH Key for private repository access (optional)
 	SSHKeyID *uint   `json:"ssh_key_id,omitempty"`
@@ -319,6 +433,31 @@ type GitHubRepository struct {
 	Analysis *RepositoryAnalysis `json:"analysis,omitempty"`
 }
 
+// WebhookDelivery records a GitHub webhook delivery to a repository and how it was handled
+type WebhookDelivery struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Delivery
+	DeliveryID    string `json:"delivery_id" gorm:"index"` // X-GitHub-Delivery
+	Event         string `json:"event"`                    // X-GitHub-Event
+	PayloadSHA256 string `json:"payload_sha256" gorm:"index"`
+	Payload       string `json:"payload,omitempty" gorm:"type:text"` // Kept for verified deliveries only
+
+	// Outcome
+	Status     string `json:"status" gorm:"not null"` // processing, processed, ignored, rejected, failed
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+
+	// Deliveries handled again on request point at the original
+	RedeliveryOfID *uint `json:"redelivery_of_id,omitempty" gorm:"index"`
+
+	// Relations
+	RepositoryID uint `json:"repository_id" gorm:"not null;index"`
+	ProjectID    uint `json:"project_id" gorm:"not null;index"`
+}
+
 // SystemSetting represents a system-wide configuration setting
 type SystemSetting struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
@@ -526,7 +665,7 @@ type Deployment struct {
 	PortConfiguration map[string]int     `json:"port_configuration" gorm:"type:jsonb;serializer:json"` // Port mappings: variable -> port
 	
 	// Deployment status
-	Status        string     `json:"status" gorm:"default:'pending'"` // pending, building, deploying, deployed, failed, stopped
+	Status        string     `json:"status" gorm:"default:'pending'"` // pending, building, deploying, deployed, failed, cancelled, stopped
 	DeployedAt    *time.Time `json:"deployed_at"`
 	BuildLogs     string     `json:"build_logs"`
 	DeployLogs    string     `json:"deploy_logs"`
@@ -568,18 +707,121 @@ type Backup struct {
 	Description string `json:"description"`
 	Type        string `json:"type" gorm:"not null"` // manual, automatic
 	Status      string `json:"status" gorm:"default:pending"` // pending, creating, completed, failed
+	ErrorMessage string `json:"error_message,omitempty"` // Why a backup failed
+	
+	// Full backups hold everything; incremental ones the documents and files changed since their parent
+	Mode          string `json:"mode" gorm:"not null;default:full"` // full, incremental
+	ParentID      *uint  `json:"parent_id,omitempty" gorm:"index"`
+	FormatVersion string `json:"format_version" gorm:"not null;default:'1.0'"` // Archives from 2.0 on hold files and a manifest
 	
 	// Backup metadata
 	Size         int64     `json:"size"`
 	FilePath     string    `json:"file_path"`
-	Checksum     string    `json:"checksum"`
+	Checksum     string    `json:"checksum"` // SHA-256 of the archive
 	CompletedAt  *time.Time `json:"completed_at"`
 	
+	// Where the archive is kept: the local backup directory unless a destination is set
+	DestinationID *uint `json:"destination_id,omitempty" gorm:"index"`
+	Encrypted     bool  `json:"encrypted" gorm:"default:false"` // Encrypted at rest with the master key
+	ScheduleID    *uint `json:"schedule_id,omitempty" gorm:"index"` // Set for backups taken by a schedule
+	
 	// Project relation
 	ProjectID uint    `json:"project_id" gorm:"not null"`
 	Project   Project `json:"project,omitempty"`
 }
 
+// BackupDestination is a place backup archives are stored in off the backup directory
+type BackupDestination struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+
+	Name string `json:"name" gorm:"not null"`
+	Type string `json:"type" gorm:"not null"` // local, sftp, s3
+	Path string `json:"path"`                 // Directory for local and sftp, key prefix for s3
+
+	// SFTP destinations reach a web server of the project with its SSH key
+	WebServerID *uint `json:"web_server_id,omitempty"`
+
+	// S3-compatible destinations
+	S3Endpoint        string `json:"s3_endpoint,omitempty"`
+	S3Region          string `json:"s3_region,omitempty"`
+	S3Bucket          string `json:"s3_bucket,omitempty"`
+	S3AccessKeyID     string `json:"s3_access_key_id,omitempty"`
+	S3SecretAccessKey string `json:"-"` // Encrypted with the master key
+	S3PathStyle       bool   `json:"s3_path_style" gorm:"default:false"`
+
+	// Project relation
+	ProjectID uint    `json:"project_id" gorm:"not null;index"`
+	Project   Project `json:"project,omitempty"`
+}
+
+// BackupSchedule takes backups of a project on a cron schedule and prunes the old ones
+type BackupSchedule struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+
+	Name           string `json:"name" gorm:"not null"`
+	CronExpression string `json:"cron_expression" gorm:"not null"` // Five fields or a macro like @daily
+	Timezone       string `json:"timezone" gorm:"not null;default:UTC"`
+	Enabled        bool   `json:"enabled"`
+
+	// Incremental schedules take a full backup every FullEvery runs
+	Mode      string `json:"mode" gorm:"not null;default:full"` // full, incremental
+	FullEvery int    `json:"full_every"`
+
+	DestinationID *uint `json:"destination_id,omitempty"`
+	Encrypt       bool  `json:"encrypt" gorm:"default:false"`
+
+	// Grandfather-father-son retention: the newest backup of each of the last N days, weeks and
+	// months is kept; zero everywhere keeps every backup
+	KeepDaily   int `json:"keep_daily"`
+	KeepWeekly  int `json:"keep_weekly"`
+	KeepMonthly int `json:"keep_monthly"`
+
+	// Runs
+	NextRunAt    *time.Time `json:"next_run_at" gorm:"index"`
+	LastRunAt    *time.Time `json:"last_run_at"`
+	LastBackupID *uint      `json:"last_backup_id,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+
+	// Project relation
+	ProjectID uint    `json:"project_id" gorm:"not null;index"`
+	Project   Project `json:"project,omitempty"`
+}
+
+// Job is a queued long-running task of a project, such as a deployment, a backup or a function
+// build. Jobs survive restarts and are retried with backoff when they fail
+type Job struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Type    string                 `json:"type" gorm:"not null;index"`     // deployment, cip_deployment, backup, function_build
+	LockKey string                 `json:"lock_key" gorm:"not null;index"` // Jobs with the same key run one at a time, in order
+	Payload map[string]interface{} `json:"payload" gorm:"type:jsonb;serializer:json"`
+
+	// State
+	Status          string     `json:"status" gorm:"not null;default:queued;index"` // queued, running, succeeded, failed, cancelled
+	Attempts        int        `json:"attempts"`
+	MaxAttempts     int        `json:"max_attempts" gorm:"not null;default:3"`
+	RunAfter        time.Time  `json:"run_after" gorm:"index"`
+	CancelRequested bool       `json:"cancel_requested" gorm:"default:false"`
+	LastError       string     `json:"last_error,omitempty"`
+	StartedAt       *time.Time `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+
+	// Running jobs belong to a worker, which proves it is alive by its heartbeats
+	WorkerID    string     `json:"-"`
+	HeartbeatAt *time.Time `json:"-"`
+
+	// Project relation
+	ProjectID uint `json:"project_id" gorm:"not null;index"`
+}
+
 // Bucket represents a file storage bucket
 type Bucket struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
@@ -592,6 +834,11 @@ type Bucket struct {
 	MaxFileSize int64    `json:"max_file_size" gorm:"default:52428800"` // 50MB default
 	AllowedTypes []string `json:"allowed_types" gorm:"type:jsonb;serializer:json"` // MIME types
 	IsPublic    bool     `json:"is_public" gorm:"default:false"`
+	StorageBackend string `json:"storage_backend" gorm:"not null;default:local"` // Backend new files are stored in
+
+	// Image transformations: named presets, and whether other parameters are accepted too
+	ImagePresets         map[string]ImageTransform `json:"image_presets" gorm:"type:jsonb;serializer:json"`
+	AllowImageTransforms bool                      `json:"allow_image_transforms" gorm:"default:false"`
 
 	// Project relation
 	ProjectID uint    `json:"project_id" gorm:"not null"`
@@ -603,6 +850,16 @@ type Bucket struct {
 	LastModified time.Time `json:"last_modified"`
 }
 
+// ImageTransform describes a variant of an image served instead of the original
+type ImageTransform struct {
+	Width   int    `json:"width,omitempty"`   // Pixels; derived from the aspect ratio if only the height is set
+	Height  int    `json:"height,omitempty"`  // Pixels; derived from the aspect ratio if only the width is set
+	Fit     string `json:"fit,omitempty"`     // contain (default), cover or fill
+	Crop    string `json:"crop,omitempty"`    // x,y,width,height in pixels of the original, applied first
+	Format  string `json:"format,omitempty"`  // jpeg, png or webp; the original's by default
+	Quality int    `json:"quality,omitempty"` // 1-100 for jpeg and webp
+}
+
 // File represents an uploaded file
 type File struct {
 	ID        string         `json:"id" gorm:"primaryKey;type:varchar(255)"` // UUID
@@ -613,7 +870,7 @@ type File struct {
 	// File metadata
 	OriginalName string `json:"original_name" gorm:"not null"`
 	FileName     string `json:"file_name" gorm:"not null"` // Stored filename
-	FilePath     string `json:"file_path" gorm:"not null"` // Full path on disk
+	FilePath     string `json:"file_path" gorm:"not null"` // Object key in the storage backend
 	MimeType     string `json:"mime_type" gorm:"not null"`
 	Size         int64  `json:"size" gorm:"not null"`
 	Checksum     string `json:"checksum"` // MD5 or SHA256
@@ -622,6 +879,7 @@ type File struct {
 	BucketName string `json:"bucket_name" gorm:"not null;index"`
 	FolderPath string `json:"folder_path" gorm:"index"` // Path within bucket (empty for root)
 	ProjectID  uint   `json:"project_id" gorm:"not null;index"`
+	StorageBackend string `json:"storage_backend" gorm:"not null;default:local"` // Backend holding the object
 
 	// Access control
 	IsPublic bool   `json:"is_public" gorm:"default:false"`
@@ -632,6 +890,58 @@ type File struct {
 	PrivateURL string `json:"private_url,omitempty"`
 }
 
+// FileUpload is a resumable upload: the file is sent in numbered parts, possibly over several
+// connections, and becomes a File once the upload is completed
+type FileUpload struct {
+	ID        string    `json:"id" gorm:"primaryKey;type:varchar(255)"` // UUID
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ProjectID  uint   `json:"project_id" gorm:"not null;index"`
+	BucketName string `json:"bucket_name" gorm:"not null"`
+	FolderPath string `json:"folder_path"`
+
+	// The file being uploaded
+	OriginalName string `json:"original_name" gorm:"not null"`
+	MimeType     string `json:"mime_type"`
+	Size         int64  `json:"size" gorm:"not null"`
+	Checksum     string `json:"checksum"` // SHA-256 of the whole file declared by the client, if any
+	PartSize     int64  `json:"part_size" gorm:"not null"` // Every part but the last has this size
+	PartCount    int    `json:"part_count" gorm:"not null"`
+
+	StorageBackend string    `json:"storage_backend" gorm:"not null"` // Backend holding the parts
+	Author         string    `json:"author"`
+	Status         string    `json:"status" gorm:"not null;default:uploading"` // uploading or completing
+	ExpiresAt      time.Time `json:"expires_at" gorm:"not null;index"` // Extended by every part
+
+	Parts []FileUploadPart `json:"parts,omitempty" gorm:"foreignKey:UploadID;constraint:OnDelete:CASCADE"`
+}
+
+// FileUploadPart is a received part of a FileUpload
+type FileUploadPart struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	UploadID   string `json:"-" gorm:"not null;type:varchar(255);uniqueIndex:idx_file_upload_parts_number"`
+	PartNumber int    `json:"part_number" gorm:"not null;uniqueIndex:idx_file_upload_parts_number"` // From 1
+	Size       int64  `json:"size" gorm:"not null"`
+	Checksum   string `json:"checksum" gorm:"not null"` // SHA-256 of the part
+}
+
+// SignedURLGrant counts the uses of a signed URL issued with a limit: the downloads of a
+// download URL, or the single upload of an upload URL
+type SignedURLGrant struct {
+	ID        string    `json:"id" gorm:"primaryKey;type:varchar(255)"` // UUID, part of the signed URL
+	CreatedAt time.Time `json:"created_at"`
+
+	ProjectID uint      `json:"project_id" gorm:"not null;index"`
+	FileID    string    `json:"file_id" gorm:"not null;type:varchar(255)"` // Downloaded, or created by the upload
+	MaxUses   int       `json:"max_uses" gorm:"not null"`
+	Uses      int       `json:"uses" gorm:"not null;default:0"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"` // Same as the URL's
+}
+
 // AppUser represents an application user (different from CloudBox admin users)
 type AppUser struct {
 	ID        string         `json:"id" gorm:"primaryKey;type:varchar(255)"` // UUID
@@ -663,9 +973,10 @@ type AppUser struct {
 	// Security
 	LoginAttempts   int        `json:"login_attempts" gorm:"default:0"`
 	LockedUntil     *time.Time `json:"locked_until"`
-	PasswordResetToken string  `json:"-"`
+	PasswordResetToken string  `json:"-"` // SHA-256 of the emailed token
 	PasswordResetExpires *time.Time `json:"-"`
-	EmailVerificationToken string `json:"-"`
+	EmailVerificationToken string `json:"-"` // SHA-256 of the emailed token
+	EmailVerificationExpires *time.Time `json:"-"`
 }
 
 // Function represents a serverless function
@@ -868,6 +1179,136 @@ type AppSession struct {
 	LastActivity *time.Time `json:"last_activity"`
 }
 
+// ProjectAuthSettings stores the app user authentication policy of a project
+type ProjectAuthSettings struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Project relation
+	ProjectID uint `json:"project_id" gorm:"not null;uniqueIndex"`
+
+	// Login policy
+	EmailVerification bool `json:"email_verification" gorm:"default:false"` // Require a verified email to log in
+	MaxLoginAttempts  int  `json:"max_login_attempts"`                      // 0 = no lockout, so no gorm default
+	LockoutDuration   int  `json:"lockout_duration" gorm:"default:15"`      // Minutes
+	SessionDuration   int  `json:"session_duration" gorm:"default:24"`      // Hours
+
+	// Password policy
+	PasswordMinLength        int  `json:"password_min_length" gorm:"default:8"`
+	PasswordRequireUppercase bool `json:"password_require_uppercase" gorm:"default:false"`
+	PasswordRequireLowercase bool `json:"password_require_lowercase" gorm:"default:false"`
+	PasswordRequireNumber    bool `json:"password_require_number" gorm:"default:false"`
+	PasswordRequireSymbol    bool `json:"password_require_symbol" gorm:"default:false"`
+}
+
+// AuthProvider stores the OAuth / OpenID Connect login configuration of a project
+type AuthProvider struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Project relation
+	ProjectID uint `json:"project_id" gorm:"not null;uniqueIndex:idx_auth_providers_project_provider"`
+
+	// Provider info
+	ProviderID string `json:"provider_id" gorm:"not null;uniqueIndex:idx_auth_providers_project_provider"` // google, github, apple or a custom OIDC slug
+	Type       string `json:"type" gorm:"not null"`                                                      // google, github, apple, oidc
+	Name       string `json:"name"`
+	Enabled    bool   `json:"enabled" gorm:"default:false"`
+
+	// Client credentials
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"-" gorm:"type:text"` // Encrypted with the master key
+
+	// Endpoints, resolved from the built-in defaults or OIDC discovery
+	IssuerURL        string `json:"issuer_url"`
+	AuthorizationURL string `json:"authorization_url"`
+	TokenURL         string `json:"token_url"`
+	UserInfoURL      string `json:"userinfo_url"`
+	JWKSURL          string `json:"jwks_url"`
+
+	Scopes       pq.StringArray `json:"scopes" gorm:"type:text[]"`
+	RedirectURLs pq.StringArray `json:"redirect_urls" gorm:"type:text[]"` // App URLs allowed to receive the session after login
+}
+
+// AppUserIdentity links an app user to their account at an OAuth provider
+type AppUserIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Provider account
+	ProjectID  uint   `json:"project_id" gorm:"not null;uniqueIndex:idx_app_user_identities_subject"`
+	ProviderID string `json:"provider_id" gorm:"not null;uniqueIndex:idx_app_user_identities_subject"`
+	Subject    string `json:"subject" gorm:"not null;uniqueIndex:idx_app_user_identities_subject"`
+	Email      string `json:"email"`
+
+	// User relation
+	UserID      string     `json:"user_id" gorm:"not null;index"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// OAuthState is a pending OAuth authorization, consumed by its callback
+type OAuthState struct {
+	State     string    `json:"-" gorm:"primaryKey;type:varchar(64)"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"`
+
+	ProjectID    uint   `json:"project_id" gorm:"not null"`
+	ProviderID   string `json:"provider_id" gorm:"not null"`
+	CodeVerifier string `json:"-" gorm:"not null"` // PKCE verifier
+	Nonce        string `json:"-"`
+	RedirectURL  string `json:"redirect_url"`
+}
+
+// TableName overrides the default table name for OAuthState
+func (OAuthState) TableName() string {
+	return "oauth_states"
+}
+
+// ProjectMailSettings stores the sender and delivery settings of the emails sent to the app
+// users of a project; empty fields fall back to the server's mail configuration
+type ProjectMailSettings struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Project relation
+	ProjectID uint `json:"project_id" gorm:"not null;uniqueIndex"`
+
+	// Sender
+	FromEmail string `json:"from_email"`
+	FromName  string `json:"from_name"`
+	ReplyTo   string `json:"reply_to"`
+
+	// SMTP server of the project
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"-" gorm:"type:text"` // Encrypted with the master key
+	SMTPSecurity string `json:"smtp_security"`      // starttls, tls or none
+
+	// App pages that receive the emailed tokens as ?token=
+	PasswordResetURL     string `json:"password_reset_url"`
+	EmailVerificationURL string `json:"email_verification_url"`
+}
+
+// EmailTemplate overrides a built-in app user email of a project
+type EmailTemplate struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Project relation
+	ProjectID uint `json:"project_id" gorm:"not null;uniqueIndex:idx_email_templates_project_name"`
+
+	Name     string `json:"name" gorm:"not null;uniqueIndex:idx_email_templates_project_name"` // password_reset, email_verification
+	Subject  string `json:"subject" gorm:"not null"`
+	TextBody string `json:"text_body" gorm:"type:text;not null"`
+	HTMLBody string `json:"html_body" gorm:"type:text"`
+}
+
 // Channel represents a messaging channel
 type Channel struct {
 	ID        string         `json:"id" gorm:"primaryKey;type:varchar(255)"` // UUID
@@ -993,6 +1434,11 @@ type MessageRead struct {
 	ProjectID uint `json:"project_id" gorm:"not null;index"`
 }
 
+// TableName overrides the default table name for MessageRead
+func (MessageRead) TableName() string {
+	return "message_read"
+}
+
 // AuditLogAction represents the type of action performed
 type AuditLogAction string
 
@@ -1010,6 +1456,9 @@ const (
 	AuditActionLogout        AuditLogAction = "auth.logout"
 	AuditActionAPIKeyCreate  AuditLogAction = "apikey.create"
 	AuditActionAPIKeyDelete  AuditLogAction = "apikey.delete"
+	AuditActionAPIKeyRotate  AuditLogAction = "apikey.rotate"
+	AuditActionAPIKeyDeactivate AuditLogAction = "apikey.deactivate"
+	AuditActionAPIKeyInactivityWarning AuditLogAction = "apikey.inactivity_warning"
 )
 
 // AuditLog represents an audit trail entry
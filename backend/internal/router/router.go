@@ -1,9 +1,12 @@
 package router
 
 import (
+	"log"
+
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/handlers"
 	"github.com/cloudbox/backend/internal/middleware"
+	"github.com/cloudbox/backend/internal/services"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -44,6 +47,7 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 	storageHandler := handlers.NewStorageHandler(db, cfg)
 	userHandler := handlers.NewUserHandler(db, cfg)
 	messagingHandler := handlers.NewMessagingHandler(db, cfg)
+	realtimeHandler := handlers.NewRealtimeHandler(db, cfg)
 	organizationHandler := handlers.NewOrganizationHandler(db, cfg)
 	deploymentHandler := handlers.NewDeploymentHandler(db, cfg)
 	backupHandler := handlers.NewBackupHandler(db, cfg)
@@ -51,6 +55,7 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 	webServerHandler := handlers.NewWebServerHandler(db, cfg)
 	githubHandler := handlers.NewGitHubHandler(db, cfg)
 	functionHandler := handlers.NewFunctionHandler(db, cfg)
+	jobHandler := handlers.NewJobHandler(db, cfg)
 	adminHandler := handlers.NewAdminHandler(db, cfg)
 	portfolioHandler := handlers.NewPortfolioHandler(db, cfg)
 	templateHandler := handlers.NewTemplateHandler(db, cfg)
@@ -63,6 +68,37 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 	scriptRunnerHandler := handlers.NewScriptRunnerHandler(db, cfg)
 	apiDiscoveryHandler := handlers.NewAPIDiscoveryHandler(db, cfg)
 	apiStatsHandler := handlers.NewAPIStatsHandler(db, cfg)
+	
+	// API keys are verified by prefix lookup and cached; changes are announced over NOTIFY
+	apiKeys := services.NewAPIKeyStore(db, cfg)
+	apiKeys.Start(cfg.DatabaseURL)
+	services.NewAPIKeyLifecycle(db, cfg).Start()
+
+	// Token buckets of project API clients, shared between instances when Redis is configured
+	rateLimits, err := services.NewRateLimitStore(cfg)
+	if err != nil {
+		log.Printf("Using in-memory rate limits: %v", err)
+		rateLimits = services.NewMemoryRateLimitStore()
+	}
+
+	// Monthly API calls of each project, counted against its quota
+	quotas := services.NewQuotaService(db, cfg)
+	quotas.Start()
+
+	// Parts of abandoned resumable uploads
+	services.NewUploadService(db, cfg).Start()
+
+	// Use limits of expired signed URLs
+	services.NewSignedURLService(db, cfg).Start()
+
+	// Image variants that are no longer served
+	services.NewImageService(cfg).Start()
+
+	// Scheduled backups, and pruning of the ones their retention policies drop
+	services.NewBackupScheduler(db, cfg).Start()
+
+	// Deployments, backups and function builds, including those interrupted by a restart
+	services.NewJobQueue(db, cfg).Start()
 
 	// ===========================================
 	// SYSTEM & HEALTH ENDPOINTS
@@ -95,6 +131,7 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 	public := r.Group("/public")
 	{
 		public.GET("/:project_id/:bucket_name/*file_path", publicFileHandler.ServePublicFile)
+		public.PUT("/:project_id/:bucket_name/*file_path", storageHandler.UploadSignedFile)
 	}
 
 	// ===========================================
@@ -174,6 +211,7 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				organizations.PUT("/:id", organizationHandler.UpdateOrganization)
 				organizations.DELETE("/:id", organizationHandler.DeleteOrganization)
 				organizations.GET("/:id/projects", organizationHandler.GetOrganizationProjects)
+				organizations.GET("/:id/usage", organizationHandler.GetUsage)
 			}
 
 			// Projects (accessible by admin and superadmin)
@@ -195,6 +233,12 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				projects.GET("/:id/api-keys", projectHandler.ListAPIKeys)
 				projects.POST("/:id/api-keys", projectHandler.CreateAPIKey)
 				projects.DELETE("/:id/api-keys/:key_id", projectHandler.DeleteAPIKey)
+				projects.POST("/:id/api-keys/:key_id/rotate", projectHandler.RotateAPIKey)
+				projects.GET("/:id/api-keys/:key_id/usage", projectHandler.GetAPIKeyUsage)
+				projects.PUT("/:id/api-keys/:key_id/rate-limit", projectHandler.UpdateAPIKeyRateLimit)
+				projects.GET("/:id/rate-limit", projectHandler.GetRateLimit)
+				projects.PUT("/:id/rate-limit", projectHandler.UpdateRateLimit)
+				projects.GET("/:id/usage", projectHandler.GetUsage)
 				
 				projects.GET("/:id/cors", projectHandler.GetCORSConfig)
 				projects.PUT("/:id/cors", projectHandler.UpdateCORSConfig)
@@ -225,6 +269,10 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				projects.DELETE("/:id/github-repositories/:repo_id", githubHandler.DeleteGitHubRepository)
 				projects.POST("/:id/github-repositories/:repo_id/sync", githubHandler.SyncRepository)
 				projects.GET("/:id/github-repositories/:repo_id/webhook", githubHandler.GetWebhookInfo)
+				projects.POST("/:id/github-repositories/:repo_id/webhook/secret", githubHandler.RotateWebhookSecret)
+				projects.GET("/:id/github-repositories/:repo_id/webhook-deliveries", deploymentHandler.ListWebhookDeliveries)
+				projects.GET("/:id/github-repositories/:repo_id/webhook-deliveries/:delivery_id", deploymentHandler.GetWebhookDelivery)
+				projects.POST("/:id/github-repositories/:repo_id/webhook-deliveries/:delivery_id/redeliver", deploymentHandler.RedeliverWebhook)
 				projects.GET("/:id/github-repositories/:repo_id/branches", githubHandler.GetRepositoryBranches)
 				
 				// Repository analysis endpoints
@@ -250,6 +298,8 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				projects.POST("/:id/deployments/:deployment_id/deploy", deploymentHandler.ExecuteCIPDeployment)
 				projects.GET("/:id/deployments/:deployment_id/logs", deploymentHandler.GetLogs)
 				projects.GET("/:id/deployments/:deployment_id/status", deploymentHandler.GetStatus)
+				projects.POST("/:id/deployments/:deployment_id/cancel", deploymentHandler.CancelDeployment)
+				projects.GET("/:id/deployments/:deployment_id/jobs", deploymentHandler.ListDeploymentJobs)
 				
 				// Port availability checking
 				projects.POST("/:id/deployments/check-ports", deploymentHandler.CheckPortAvailability)
@@ -264,12 +314,37 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				projects.POST("/:id/functions/:function_id/execute", functionHandler.ExecuteFunction)
 				projects.GET("/:id/functions/:function_id/logs", functionHandler.GetFunctionLogs)
 				
+				// Background jobs: deployments, backups and function builds
+				projects.GET("/:id/jobs", jobHandler.ListJobs)
+				projects.GET("/:id/jobs/:job_id", jobHandler.GetJob)
+				projects.POST("/:id/jobs/:job_id/cancel", jobHandler.CancelJob)
+				
 				// Project GitHub configuration
 				projects.GET("/:id/github/config", projectGitHubHandler.GetProjectGitHubConfig)
 				projects.PUT("/:id/github/config", projectGitHubHandler.UpdateProjectGitHubConfig)
 				projects.POST("/:id/github/config/test", projectGitHubHandler.TestProjectGitHubConfig)
 				projects.GET("/:id/github/instructions", projectGitHubHandler.GetProjectGitHubInstructions)
 				
+				// Project backups
+				projects.GET("/:id/backups", backupHandler.ListBackups)
+				projects.POST("/:id/backups", backupHandler.CreateBackup)
+				projects.GET("/:id/backups/:backup_id", backupHandler.GetBackup)
+				projects.DELETE("/:id/backups/:backup_id", backupHandler.DeleteBackup)
+				projects.GET("/:id/backups/:backup_id/manifest", backupHandler.GetManifest)
+				projects.POST("/:id/backups/:backup_id/restore", backupHandler.RestoreBackup)
+				projects.GET("/:id/backup-destinations", backupHandler.ListDestinations)
+				projects.POST("/:id/backup-destinations", backupHandler.CreateDestination)
+				projects.GET("/:id/backup-destinations/:destination_id", backupHandler.GetDestination)
+				projects.PUT("/:id/backup-destinations/:destination_id", backupHandler.UpdateDestination)
+				projects.DELETE("/:id/backup-destinations/:destination_id", backupHandler.DeleteDestination)
+				projects.POST("/:id/backup-destinations/:destination_id/test", backupHandler.TestDestination)
+				projects.GET("/:id/backup-schedules", backupHandler.ListSchedules)
+				projects.POST("/:id/backup-schedules", backupHandler.CreateSchedule)
+				projects.GET("/:id/backup-schedules/:schedule_id", backupHandler.GetSchedule)
+				projects.PUT("/:id/backup-schedules/:schedule_id", backupHandler.UpdateSchedule)
+				projects.DELETE("/:id/backup-schedules/:schedule_id", backupHandler.DeleteSchedule)
+				projects.POST("/:id/backup-schedules/:schedule_id/run", backupHandler.RunSchedule)
+
 				// Admin Storage management endpoints
 				projects.GET("/:id/storage/buckets", storageHandler.AdminListBuckets)
 				projects.POST("/:id/storage/buckets", storageHandler.AdminCreateBucket)
@@ -289,19 +364,43 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				projects.POST("/:id/storage/buckets/:bucket/folders", storageHandler.AdminCreateFolder)
 				projects.DELETE("/:id/storage/buckets/:bucket/folders", storageHandler.AdminDeleteFolder)
 				
+				// Admin resumable upload endpoints
+				projects.GET("/:id/storage/buckets/:bucket/uploads", storageHandler.AdminListUploads)
+				projects.POST("/:id/storage/buckets/:bucket/uploads", storageHandler.AdminInitiateUpload)
+				projects.GET("/:id/storage/buckets/:bucket/uploads/:upload_id", storageHandler.AdminGetUpload)
+				projects.PUT("/:id/storage/buckets/:bucket/uploads/:upload_id/parts/:part_number", storageHandler.AdminUploadPart)
+				projects.POST("/:id/storage/buckets/:bucket/uploads/:upload_id/complete", storageHandler.AdminCompleteUpload)
+				projects.DELETE("/:id/storage/buckets/:bucket/uploads/:upload_id", storageHandler.AdminAbortUpload)
+				
+				// Admin signed URL endpoints
+				projects.POST("/:id/storage/buckets/:bucket/files/:file_id/signed-url", storageHandler.AdminCreateSignedURL)
+				projects.POST("/:id/storage/buckets/:bucket/signed-upload-url", storageHandler.AdminCreateSignedUploadURL)
+				
 				// Admin Collections management endpoints
 				projects.GET("/:id/collections", dataHandler.AdminListCollections)
 				projects.POST("/:id/collections", dataHandler.AdminCreateCollection)
 				projects.GET("/:id/collections/:collection", dataHandler.AdminGetCollection)
 				projects.DELETE("/:id/collections/:collection", dataHandler.AdminDeleteCollection)
+				projects.PUT("/:id/collections/:collection/schema", dataHandler.AdminUpdateCollectionSchema)
+				projects.GET("/:id/collections/:collection/indexes", dataHandler.AdminListCollectionIndexes)
+				projects.POST("/:id/collections/:collection/indexes", dataHandler.AdminCreateCollectionIndex)
+				projects.DELETE("/:id/collections/:collection/indexes/:index_id", dataHandler.AdminDeleteCollectionIndex)
 				
 				// Admin Documents management endpoints
 				projects.GET("/:id/collections/:collection/documents", dataHandler.AdminListDocuments)
 				projects.POST("/:id/collections/:collection/documents", dataHandler.AdminCreateDocument)
 				projects.GET("/:id/collections/:collection/documents/:document_id", dataHandler.AdminGetDocument)
 				projects.PUT("/:id/collections/:collection/documents/:document_id", dataHandler.AdminUpdateDocument)
+				projects.PATCH("/:id/collections/:collection/documents/:document_id", dataHandler.AdminPatchDocument)
 				projects.DELETE("/:id/collections/:collection/documents/:document_id", dataHandler.AdminDeleteDocument)
 				
+				// Admin document revision history endpoints
+				projects.GET("/:id/collections/:collection/documents/:document_id/revisions", dataHandler.AdminListDocumentRevisions)
+				projects.GET("/:id/collections/:collection/documents/:document_id/revisions/diff", dataHandler.AdminDiffDocumentRevisions)
+				projects.GET("/:id/collections/:collection/documents/:document_id/revisions/:version", dataHandler.AdminGetDocumentRevision)
+				projects.POST("/:id/collections/:collection/documents/:document_id/revisions/:version/restore", dataHandler.AdminRestoreDocumentRevision)
+				projects.PUT("/:id/collections/:collection/retention", dataHandler.AdminUpdateCollectionRetention)
+				
 				// Admin bucket visibility management endpoints
 				projects.PUT("/:id/storage/buckets/:bucket/visibility", storageHandler.AdminSetBucketVisibility)
 				projects.GET("/:id/storage/buckets/:bucket/files/:file_id/public-url", storageHandler.AdminGetFilePublicURL)
@@ -322,6 +421,15 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				projects.DELETE("/:id/auth/users/:user_id", userHandler.AdminDeleteUser)
 				projects.GET("/:id/auth/settings", userHandler.AdminGetAuthSettings)
 				projects.PUT("/:id/auth/settings", userHandler.AdminUpdateAuthSettings)
+				projects.GET("/:id/auth/providers", userHandler.AdminGetAuthProviders)
+				projects.PATCH("/:id/auth/providers/:provider_id", userHandler.AdminUpdateAuthProvider)
+				projects.DELETE("/:id/auth/providers/:provider_id", userHandler.AdminDeleteAuthProvider)
+				projects.GET("/:id/auth/mail", userHandler.AdminGetMailSettings)
+				projects.PUT("/:id/auth/mail", userHandler.AdminUpdateMailSettings)
+				projects.POST("/:id/auth/mail/test", userHandler.AdminSendTestEmail)
+				projects.GET("/:id/auth/mail/templates", userHandler.AdminListEmailTemplates)
+				projects.PUT("/:id/auth/mail/templates/:template", userHandler.AdminUpdateEmailTemplate)
+				projects.DELETE("/:id/auth/mail/templates/:template", userHandler.AdminDeleteEmailTemplate)
 				
 				// Project-level plugin management routes
 				projects.GET("/:id/plugins/available", pluginHandler.GetAvailablePlugins)
@@ -405,6 +513,10 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				
 				// Super admin can see all projects (already handled in ListProjects)
 				superAdmin.GET("/projects", projectHandler.ListProjects)
+				
+				// Usage quotas
+				superAdmin.PUT("/projects/:id/quotas", projectHandler.UpdateQuotas)
+				superAdmin.PUT("/organizations/:id/quotas", organizationHandler.UpdateQuotas)
 			}
 
 			// Deployments
@@ -417,15 +529,6 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 				deployments.GET("/:id/logs", deploymentHandler.GetLogs)
 			}
 
-			// Backups
-			backups := protected.Group("/backups")
-			{
-				backups.GET("", backupHandler.ListBackups)
-				backups.POST("", backupHandler.CreateBackup)
-				backups.GET("/:id", backupHandler.GetBackup)
-				backups.DELETE("/:id", backupHandler.DeleteBackup)
-				backups.POST("/:id/restore", backupHandler.RestoreBackup)
-			}
 		}
 		
 		// Note: Collection management moved to project data API routes
@@ -437,87 +540,178 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 	// API Key (X-API-Key) Authentication Required
 	// ===========================================
 	
+	// API key permissions per route: resource:action[:scope], see middleware.RequirePermission
+	var (
+		dataRead        = middleware.RequirePermission("data", middleware.PermissionRead, "collection")
+		dataWrite       = middleware.RequirePermission("data", middleware.PermissionWrite, "collection")
+		dataDelete      = middleware.RequirePermission("data", middleware.PermissionDelete, "collection")
+		dataAdmin       = middleware.RequirePermission("data", middleware.PermissionAdmin, "")
+		collectionAdmin = middleware.RequirePermission("data", middleware.PermissionAdmin, "collection")
+
+		storageRead   = middleware.RequirePermission("storage", middleware.PermissionRead, "bucket")
+		storageWrite  = middleware.RequirePermission("storage", middleware.PermissionWrite, "bucket")
+		storageDelete = middleware.RequirePermission("storage", middleware.PermissionDelete, "bucket")
+		storageAdmin  = middleware.RequirePermission("storage", middleware.PermissionAdmin, "")
+		bucketAdmin   = middleware.RequirePermission("storage", middleware.PermissionAdmin, "bucket")
+
+		functionsInvoke = middleware.RequirePermission("functions", middleware.PermissionInvoke, "function_name")
+
+		usersSession = middleware.RequirePermission("users", middleware.PermissionSession, "")
+		usersRead    = middleware.RequirePermission("users", middleware.PermissionRead, "")
+		usersWrite   = middleware.RequirePermission("users", middleware.PermissionWrite, "")
+		usersDelete  = middleware.RequirePermission("users", middleware.PermissionDelete, "")
+		usersAdmin   = middleware.RequirePermission("users", middleware.PermissionAdmin, "")
+
+		messagingRead   = middleware.RequirePermission("messaging", middleware.PermissionRead, "")
+		messagingWrite  = middleware.RequirePermission("messaging", middleware.PermissionWrite, "")
+		messagingDelete = middleware.RequirePermission("messaging", middleware.PermissionDelete, "")
+		messagingAdmin  = middleware.RequirePermission("messaging", middleware.PermissionAdmin, "")
+
+		projectRead  = middleware.RequirePermission("project", middleware.PermissionRead, "")
+		projectWrite = middleware.RequirePermission("project", middleware.PermissionWrite, "")
+		projectAdmin = middleware.RequirePermission("project", middleware.PermissionAdmin, "")
+	)
+
 	// Protected project routes (API key authentication required)
 	projectAPI := r.Group("/p/:project_id/api")
-	projectAPI.Use(middleware.ProjectAuthOrJWT(cfg, db)) // API key authentication
+	projectAPI.Use(middleware.RateLimitIP(cfg, rateLimits)) // Before authentication, so key guessing is limited
+	projectAPI.Use(middleware.ProjectAuthOrJWT(cfg, db, apiKeys)) // API key authentication
 	projectAPI.Use(middleware.ProjectSmartCORS(cfg, db))
+	projectAPI.Use(middleware.RateLimit(cfg, rateLimits))
+	projectAPI.Use(middleware.MeterAPICalls(quotas))
 	{
 		// API Discovery (Supabase-style)
-		projectAPI.GET("/discovery/routes", apiDiscoveryHandler.GetAPIDiscovery)
-		projectAPI.GET("/discovery/schema", apiDiscoveryHandler.GetAPISchema)
-		projectAPI.POST("/discovery/refresh", apiDiscoveryHandler.RefreshAPIDiscovery)
+		projectAPI.GET("/discovery/routes", projectRead, apiDiscoveryHandler.GetAPIDiscovery)
+		projectAPI.GET("/discovery/schema", projectRead, apiDiscoveryHandler.GetAPISchema)
+		projectAPI.POST("/discovery/refresh", projectWrite, apiDiscoveryHandler.RefreshAPIDiscovery)
 		
 		// Collections management
-		projectAPI.GET("/collections", dataHandler.ListCollections)
-		projectAPI.POST("/collections", dataHandler.CreateCollection)
-		projectAPI.GET("/collections/:collection", dataHandler.GetCollection)
-		projectAPI.DELETE("/collections/:collection", dataHandler.DeleteCollection)
+		projectAPI.GET("/collections", dataAdmin, dataHandler.ListCollections)
+		projectAPI.POST("/collections", dataAdmin, dataHandler.CreateCollection)
+		projectAPI.GET("/collections/:collection", dataRead, dataHandler.GetCollection)
+		projectAPI.DELETE("/collections/:collection", collectionAdmin, dataHandler.DeleteCollection)
+		projectAPI.PUT("/collections/:collection/schema", collectionAdmin, dataHandler.UpdateCollectionSchema)
+		projectAPI.GET("/collections/:collection/indexes", collectionAdmin, dataHandler.ListCollectionIndexes)
+		projectAPI.POST("/collections/:collection/indexes", collectionAdmin, dataHandler.CreateCollectionIndex)
+		projectAPI.DELETE("/collections/:collection/indexes/:index_id", collectionAdmin, dataHandler.DeleteCollectionIndex)
+		projectAPI.PUT("/collections/:collection/retention", collectionAdmin, dataHandler.UpdateCollectionRetention)
 		
 		// Documents management (standardized endpoints)
-		projectAPI.GET("/data/:collection", dataHandler.ListDocuments)
-		projectAPI.POST("/data/:collection", dataHandler.CreateDocument)
-		projectAPI.GET("/data/:collection/:id", dataHandler.GetDocument)
-		projectAPI.PUT("/data/:collection/:id", dataHandler.UpdateDocument)
-		projectAPI.DELETE("/data/:collection/:id", dataHandler.DeleteDocument)
+		projectAPI.GET("/data/:collection", dataRead, dataHandler.ListDocuments)
+		projectAPI.POST("/data/:collection", dataWrite, dataHandler.CreateDocument)
+		projectAPI.GET("/data/:collection/:id", dataRead, dataHandler.GetDocument)
+		projectAPI.PUT("/data/:collection/:id", dataWrite, dataHandler.UpdateDocument)
+		projectAPI.PATCH("/data/:collection/:id", dataWrite, dataHandler.PatchDocument)
+		projectAPI.DELETE("/data/:collection/:id", dataDelete, dataHandler.DeleteDocument)
+		projectAPI.GET("/data/:collection/:id/revisions", dataRead, dataHandler.ListDocumentRevisions)
+		projectAPI.GET("/data/:collection/:id/revisions/diff", dataRead, dataHandler.DiffDocumentRevisions)
+		projectAPI.GET("/data/:collection/:id/revisions/:version", dataRead, dataHandler.GetDocumentRevision)
+		projectAPI.POST("/data/:collection/:id/revisions/:version/restore", dataWrite, dataHandler.RestoreDocumentRevision)
 		
 		// Generic documents endpoints (BaaS standard - alias to /data/{collection})
-		projectAPI.GET("/documents/:collection", dataHandler.ListDocuments)
-		projectAPI.POST("/documents/:collection", dataHandler.CreateDocument)
-		projectAPI.GET("/documents/:collection/:id", dataHandler.GetDocument)
-		projectAPI.PUT("/documents/:collection/:id", dataHandler.UpdateDocument)
-		projectAPI.DELETE("/documents/:collection/:id", dataHandler.DeleteDocument)
+		projectAPI.GET("/documents/:collection", dataRead, dataHandler.ListDocuments)
+		projectAPI.POST("/documents/:collection", dataWrite, dataHandler.CreateDocument)
+		projectAPI.GET("/documents/:collection/:id", dataRead, dataHandler.GetDocument)
+		projectAPI.PUT("/documents/:collection/:id", dataWrite, dataHandler.UpdateDocument)
+		projectAPI.PATCH("/documents/:collection/:id", dataWrite, dataHandler.PatchDocument)
+		projectAPI.DELETE("/documents/:collection/:id", dataDelete, dataHandler.DeleteDocument)
+		projectAPI.GET("/documents/:collection/:id/revisions", dataRead, dataHandler.ListDocumentRevisions)
+		projectAPI.GET("/documents/:collection/:id/revisions/diff", dataRead, dataHandler.DiffDocumentRevisions)
+		projectAPI.GET("/documents/:collection/:id/revisions/:version", dataRead, dataHandler.GetDocumentRevision)
+		projectAPI.POST("/documents/:collection/:id/revisions/:version/restore", dataWrite, dataHandler.RestoreDocumentRevision)
 		
 		// Advanced document operations (BaaS standard)
-		projectAPI.POST("/data/:collection/query", dataHandler.QueryDocuments)
-		projectAPI.GET("/data/:collection/count", dataHandler.CountDocuments)
-		projectAPI.POST("/data/:collection/batch", dataHandler.BatchCreateDocuments)
-		projectAPI.DELETE("/data/:collection/batch", dataHandler.BatchDeleteDocuments)
+		projectAPI.POST("/data/:collection/query", dataRead, dataHandler.QueryDocuments)
+		projectAPI.GET("/data/:collection/count", dataRead, dataHandler.CountDocuments)
+		projectAPI.POST("/data/:collection/batch", dataWrite, dataHandler.BatchCreateDocuments)
+		projectAPI.DELETE("/data/:collection/batch", dataDelete, dataHandler.BatchDeleteDocuments)
 		
 		// Advanced document operations (documents alias)
-		projectAPI.POST("/documents/:collection/query", dataHandler.QueryDocuments)
-		projectAPI.GET("/documents/:collection/count", dataHandler.CountDocuments)
-		projectAPI.POST("/documents/:collection/batch", dataHandler.BatchCreateDocuments)
-		projectAPI.DELETE("/documents/:collection/batch", dataHandler.BatchDeleteDocuments)
+		projectAPI.POST("/documents/:collection/query", dataRead, dataHandler.QueryDocuments)
+		projectAPI.GET("/documents/:collection/count", dataRead, dataHandler.CountDocuments)
+		projectAPI.POST("/documents/:collection/batch", dataWrite, dataHandler.BatchCreateDocuments)
+		projectAPI.DELETE("/documents/:collection/batch", dataDelete, dataHandler.BatchDeleteDocuments)
+		
+		// Realtime change feed (WebSocket or Server-Sent Events)
+		projectAPI.POST("/realtime/tickets", realtimeHandler.CreateTicket) // Authenticates browser connections
+		projectAPI.GET("/realtime/:collection", dataRead, dataHandler.SubscribeCollection)
 		
 		// Storage management
-		projectAPI.GET("/storage/buckets", storageHandler.ListBuckets)
-		projectAPI.POST("/storage/buckets", storageHandler.CreateBucket)
-		projectAPI.GET("/storage/buckets/:bucket", storageHandler.GetBucket)
-		projectAPI.PUT("/storage/buckets/:bucket", storageHandler.UpdateBucket)
-		projectAPI.DELETE("/storage/buckets/:bucket", storageHandler.DeleteBucket)
+		projectAPI.GET("/storage/buckets", storageAdmin, storageHandler.ListBuckets)
+		projectAPI.POST("/storage/buckets", storageAdmin, storageHandler.CreateBucket)
+		projectAPI.GET("/storage/buckets/:bucket", storageRead, storageHandler.GetBucket)
+		projectAPI.PUT("/storage/buckets/:bucket", bucketAdmin, storageHandler.UpdateBucket)
+		projectAPI.DELETE("/storage/buckets/:bucket", bucketAdmin, storageHandler.DeleteBucket)
 		
 		// File management
-		projectAPI.GET("/storage/:bucket/files", storageHandler.ListFiles)
-		projectAPI.POST("/storage/:bucket/files", storageHandler.UploadFile)
-		projectAPI.GET("/storage/:bucket/files/:file_id", storageHandler.GetFile)
-		projectAPI.PUT("/storage/:bucket/files/:file_id/move", storageHandler.MoveFile)
-		projectAPI.DELETE("/storage/:bucket/files/:file_id", storageHandler.DeleteFile)
+		projectAPI.GET("/storage/:bucket/files", storageRead, storageHandler.ListFiles)
+		projectAPI.POST("/storage/:bucket/files", storageWrite, storageHandler.UploadFile)
+		projectAPI.GET("/storage/:bucket/files/:file_id", storageRead, storageHandler.GetFile)
+		projectAPI.PUT("/storage/:bucket/files/:file_id/move", storageWrite, storageHandler.MoveFile)
+		projectAPI.DELETE("/storage/:bucket/files/:file_id", storageDelete, storageHandler.DeleteFile)
 		
 		// Folder management
-		projectAPI.GET("/storage/:bucket/folders", storageHandler.ListFolders)
-		projectAPI.POST("/storage/:bucket/folders", storageHandler.CreateFolder)
-		projectAPI.DELETE("/storage/:bucket/folders", storageHandler.DeleteFolder)
+		projectAPI.GET("/storage/:bucket/folders", storageRead, storageHandler.ListFolders)
+		projectAPI.POST("/storage/:bucket/folders", storageWrite, storageHandler.CreateFolder)
+		projectAPI.DELETE("/storage/:bucket/folders", storageDelete, storageHandler.DeleteFolder)
+		
+		// Resumable uploads of large files
+		projectAPI.GET("/storage/:bucket/uploads", storageWrite, storageHandler.ListUploads)
+		projectAPI.POST("/storage/:bucket/uploads", storageWrite, storageHandler.InitiateUpload)
+		projectAPI.GET("/storage/:bucket/uploads/:upload_id", storageWrite, storageHandler.GetUpload)
+		projectAPI.PUT("/storage/:bucket/uploads/:upload_id/parts/:part_number", storageWrite, storageHandler.UploadPart)
+		projectAPI.POST("/storage/:bucket/uploads/:upload_id/complete", storageWrite, storageHandler.CompleteUpload)
+		projectAPI.DELETE("/storage/:bucket/uploads/:upload_id", storageWrite, storageHandler.AbortUpload)
+		
+		// Signed URLs to private files for clients without an API key
+		projectAPI.POST("/storage/:bucket/files/:file_id/signed-url", storageRead, storageHandler.CreateSignedURL)
+		projectAPI.POST("/storage/:bucket/signed-upload-url", storageWrite, storageHandler.CreateSignedUploadURL)
 		
 		// Public URL generation for connected apps
-		projectAPI.GET("/storage/:bucket/files/:file_id/public-url", storageHandler.GetFilePublicURL)
-		projectAPI.POST("/storage/:bucket/files/batch-public-urls", storageHandler.GetBatchFilePublicURLs)
+		projectAPI.GET("/storage/:bucket/files/:file_id/public-url", storageRead, storageHandler.GetFilePublicURL)
+		projectAPI.POST("/storage/:bucket/files/batch-public-urls", storageRead, storageHandler.GetBatchFilePublicURLs)
 		
 		// User management
-		projectAPI.GET("/users", userHandler.ListUsers)
-		projectAPI.POST("/users", userHandler.CreateUser)
-		projectAPI.GET("/users/:user_id", userHandler.GetUser)
-		projectAPI.PUT("/users/:user_id", userHandler.UpdateUser)
-		projectAPI.DELETE("/users/:user_id", userHandler.DeleteUser)
+		projectAPI.GET("/users", usersRead, userHandler.ListUsers)
+		projectAPI.POST("/users", usersWrite, userHandler.CreateUser)
+		projectAPI.GET("/users/:user_id", usersRead, userHandler.GetUser)
+		projectAPI.PUT("/users/:user_id", usersWrite, userHandler.UpdateUser)
+		projectAPI.DELETE("/users/:user_id", usersDelete, userHandler.DeleteUser)
 		
 		// User authentication and session management
-		projectAPI.POST("/users/logout", userHandler.LogoutUser)
-		projectAPI.GET("/users/me", userHandler.GetCurrentUser)
-		projectAPI.PUT("/users/:user_id/password", userHandler.ChangePassword)
-		projectAPI.GET("/users/:user_id/sessions", userHandler.ListSessions)
-		projectAPI.DELETE("/users/:user_id/sessions/:session_id", userHandler.RevokeSession)
+		projectAPI.POST("/users/logout", usersSession, userHandler.LogoutUser)
+		projectAPI.GET("/users/me", usersSession, userHandler.GetCurrentUser)
+		projectAPI.PUT("/users/:user_id/password", usersWrite, userHandler.ChangePassword)
+		projectAPI.GET("/users/:user_id/sessions", usersRead, userHandler.ListSessions)
+		projectAPI.DELETE("/users/:user_id/sessions/:session_id", usersDelete, userHandler.RevokeSession)
+		
+		// Messaging channels, messages and realtime gateway
+		messaging := projectAPI.Group("/messaging")
+		{
+			messaging.GET("/gateway", messagingRead, messagingHandler.MessagingGateway)
+			messaging.GET("/channels", messagingRead, messagingHandler.ListChannels)
+			messaging.POST("/channels", messagingAdmin, messagingHandler.CreateChannel)
+			messaging.GET("/channels/:channel_id", messagingRead, messagingHandler.GetChannel)
+			messaging.PUT("/channels/:channel_id", messagingAdmin, messagingHandler.UpdateChannel)
+			messaging.DELETE("/channels/:channel_id", messagingAdmin, messagingHandler.DeleteChannel)
+			messaging.GET("/channels/:channel_id/presence", messagingRead, messagingHandler.GetChannelPresence)
+			messaging.POST("/channels/:channel_id/read", messagingWrite, messagingHandler.MarkChannelRead)
+			messaging.GET("/channels/:channel_id/members", messagingRead, messagingHandler.ListChannelMembers)
+			messaging.POST("/channels/:channel_id/members", messagingWrite, messagingHandler.JoinChannel)
+			messaging.DELETE("/channels/:channel_id/members/:user_id", messagingDelete, messagingHandler.LeaveChannel)
+			messaging.GET("/channels/:channel_id/messages", messagingRead, messagingHandler.ListMessages)
+			messaging.POST("/channels/:channel_id/messages", messagingWrite, messagingHandler.SendMessage)
+			messaging.GET("/channels/:channel_id/messages/:message_id", messagingRead, messagingHandler.GetMessage)
+			messaging.PUT("/channels/:channel_id/messages/:message_id", messagingWrite, messagingHandler.UpdateMessage)
+			messaging.DELETE("/channels/:channel_id/messages/:message_id", messagingDelete, messagingHandler.DeleteMessage)
+			messaging.GET("/channels/:channel_id/messages/:message_id/reactions", messagingRead, messagingHandler.ListReactions)
+			messaging.POST("/channels/:channel_id/messages/:message_id/reactions", messagingWrite, messagingHandler.AddReaction)
+			messaging.DELETE("/channels/:channel_id/messages/:message_id/reactions/:emoji", messagingDelete, messagingHandler.RemoveReaction)
+			messaging.GET("/channels/:channel_id/messages/:message_id/reads", messagingRead, messagingHandler.ListMessageReads)
+		}
 		
 		// Auth management for project admin interface
-		auth := projectAPI.Group("/auth")
+		auth := projectAPI.Group("/auth", usersAdmin)
 		{
 			// Auth settings
 			auth.GET("/settings", userHandler.GetAuthSettings)
@@ -532,69 +726,78 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 			// Auth providers
 			auth.GET("/providers", userHandler.GetAuthProviders)
 			auth.PATCH("/providers/:provider_id", userHandler.UpdateAuthProvider)
+			auth.DELETE("/providers/:provider_id", userHandler.DeleteAuthProvider)
+			
+			// Email sender settings and templates
+			auth.GET("/mail", userHandler.GetMailSettings)
+			auth.PUT("/mail", userHandler.UpdateMailSettings)
+			auth.POST("/mail/test", userHandler.SendTestEmail)
+			auth.GET("/mail/templates", userHandler.ListEmailTemplates)
+			auth.PUT("/mail/templates/:template", userHandler.UpdateEmailTemplate)
+			auth.DELETE("/mail/templates/:template", userHandler.DeleteEmailTemplate)
 		}
 		
 		
 		// Functions execution (public access for deployed functions)
-		projectAPI.POST("/functions/:function_name", functionHandler.ExecuteFunctionByName)
-		projectAPI.GET("/functions/:function_name", functionHandler.ExecuteFunctionByName)
-		projectAPI.PUT("/functions/:function_name", functionHandler.ExecuteFunctionByName)
-		projectAPI.DELETE("/functions/:function_name", functionHandler.ExecuteFunctionByName)
+		projectAPI.POST("/functions/:function_name", functionsInvoke, functionHandler.ExecuteFunctionByName)
+		projectAPI.GET("/functions/:function_name", functionsInvoke, functionHandler.ExecuteFunctionByName)
+		projectAPI.PUT("/functions/:function_name", functionsInvoke, functionHandler.ExecuteFunctionByName)
+		projectAPI.DELETE("/functions/:function_name", functionsInvoke, functionHandler.ExecuteFunctionByName)
 		
 		// Portfolio-specific API endpoints
 		portfolio := projectAPI.Group("/")
 		{
 			// Translations
-			portfolio.GET("/translations/languages", portfolioHandler.GetLanguages)
-			portfolio.PUT("/translations/languages", portfolioHandler.SetLanguages)
-			portfolio.POST("/translations/translate/:pageId", portfolioHandler.TranslatePage)
-			portfolio.GET("/translations/page/:pageId", portfolioHandler.GetPageTranslations)
-			portfolio.DELETE("/translations/:translationId", portfolioHandler.DeleteTranslation)
+			portfolio.GET("/translations/languages", projectRead, portfolioHandler.GetLanguages)
+			portfolio.PUT("/translations/languages", projectWrite, portfolioHandler.SetLanguages)
+			portfolio.POST("/translations/translate/:pageId", projectWrite, portfolioHandler.TranslatePage)
+			portfolio.GET("/translations/page/:pageId", projectRead, portfolioHandler.GetPageTranslations)
+			portfolio.DELETE("/translations/:translationId", projectWrite, portfolioHandler.DeleteTranslation)
 			
 			// Analytics
-			portfolio.GET("/analytics", portfolioHandler.GetAnalytics)
+			portfolio.GET("/analytics", projectRead, portfolioHandler.GetAnalytics)
 			
 			// Images
-			portfolio.GET("/images", portfolioHandler.GetImages)
-			portfolio.PUT("/images/:id", portfolioHandler.UpdateImage)
+			portfolio.GET("/images", projectRead, portfolioHandler.GetImages)
+			portfolio.PUT("/images/:id", projectWrite, portfolioHandler.UpdateImage)
 			
 			// Albums
-			portfolio.GET("/albums", portfolioHandler.GetAlbums)
+			portfolio.GET("/albums", projectRead, portfolioHandler.GetAlbums)
 			
 			// Pages
-			portfolio.GET("/pages", portfolioHandler.GetPages)
+			portfolio.GET("/pages", projectRead, portfolioHandler.GetPages)
 			
 			// Settings
-			portfolio.GET("/settings", portfolioHandler.GetSettings)
-			portfolio.PUT("/settings", portfolioHandler.UpdateSettings)
+			portfolio.GET("/settings", projectRead, portfolioHandler.GetSettings)
+			portfolio.PUT("/settings", projectWrite, portfolioHandler.UpdateSettings)
 			
 			// Branding
-			portfolio.GET("/branding", portfolioHandler.GetBranding)
+			portfolio.GET("/branding", projectRead, portfolioHandler.GetBranding)
 			
 			// Portfolio Users
-			portfolio.GET("/portfolio/users", portfolioHandler.GetPortfolioUsers)
+			portfolio.GET("/portfolio/users", projectRead, portfolioHandler.GetPortfolioUsers)
 		}
 		
 		// Project Templates - Setup and management
 		templates := projectAPI.Group("/templates")
 		{
-			templates.GET("", templateHandler.ListTemplates)
-			templates.GET("/:template", templateHandler.GetTemplate)
-			templates.POST("/:template/setup", templateHandler.SetupPhotoPortfolio)
+			templates.GET("", projectRead, templateHandler.ListTemplates)
+			templates.GET("/:template", projectRead, templateHandler.GetTemplate)
+			templates.POST("/:template/setup", projectAdmin, templateHandler.SetupPhotoPortfolio)
 		}
 
 		// Template deployment routes
 		templateDeployments := projectAPI.Group("/template-deployments")
 		{
-			templateDeployments.GET("", templateDeploymentHandler.ListTemplateDeployments)
-			templateDeployments.POST("", templateDeploymentHandler.CreateTemplateDeployment)
+			templateDeployments.GET("", projectRead, templateDeploymentHandler.ListTemplateDeployments)
+			templateDeployments.POST("", projectAdmin, templateDeploymentHandler.CreateTemplateDeployment)
 		}
 
 		// Repository compatibility routes
 		compatibility := projectAPI.Group("/compatibility")
 		{
-			compatibility.POST("/check", compatibilityHandler.CheckRepositoryCompatibility)
-			compatibility.GET("/repositories/:id", compatibilityHandler.CheckGitHubRepositoryCompatibility)
+			compatibility.POST("/check", projectWrite, compatibilityHandler.CheckRepositoryCompatibility)
+			compatibility.GET("/repositories/:id", projectRead, compatibilityHandler.CheckGitHubRepositoryCompatibility)
 		}
 	}
 
@@ -605,12 +808,25 @@ func Initialize(cfg *config.Config, db *gorm.DB) *gin.Engine {
 	
 	// Public project routes (no authentication required) - registered AFTER protected routes
 	projectPublic := r.Group("/p/:project_id/api")
+	projectPublic.Use(middleware.RateLimitIP(cfg, rateLimits))
 	projectPublic.Use(middleware.ProjectOnly(cfg, db)) // Only validate project exists
 	projectPublic.Use(middleware.ProjectSmartCORS(cfg, db)) // Apply project-specific CORS
+	projectPublic.Use(middleware.RateLimit(cfg, rateLimits))
+	projectPublic.Use(middleware.MeterAPICalls(quotas))
 	{
 		// User authentication (public endpoints)
 		projectPublic.POST("/users/register", userHandler.RegisterUser)
 		projectPublic.POST("/users/login", userHandler.LoginUser)
+		projectPublic.POST("/users/forgot-password", userHandler.ForgotPassword)
+		projectPublic.POST("/users/reset-password", userHandler.ResetPassword)
+		projectPublic.POST("/users/send-verification", userHandler.SendVerificationEmail)
+		projectPublic.GET("/users/verify-email", userHandler.VerifyEmail)
+		projectPublic.POST("/users/verify-email", userHandler.VerifyEmail)
+
+		// OAuth/OIDC social login
+		projectPublic.GET("/auth/oauth/:provider_id/authorize", userHandler.OAuthAuthorize)
+		projectPublic.GET("/auth/oauth/:provider_id/callback", userHandler.OAuthCallback)
+		projectPublic.POST("/auth/oauth/:provider_id/callback", userHandler.OAuthCallback)
 	}
 
 	// ===========================================
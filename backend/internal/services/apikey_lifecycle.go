@@ -0,0 +1,236 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// API key deactivation reasons
+const (
+	APIKeyDeactivatedInactive = "inactive"
+	APIKeyDeactivatedRotated  = "rotated"
+)
+
+const apiKeySweepInterval = time.Hour
+
+// apiKeyActivity is the last sign of life of a key
+const apiKeyActivity = "COALESCE(api_keys.last_used_at, api_keys.created_at)"
+
+// APIKeyLifecycle retires rotated keys after their grace period and deactivates keys that
+// have not been used for a while, warning the project owner first
+type APIKeyLifecycle struct {
+	db    *gorm.DB
+	cfg   *config.Config
+	audit *AuditService
+	once  sync.Once
+}
+
+// NewAPIKeyLifecycle creates a new API key lifecycle service
+func NewAPIKeyLifecycle(db *gorm.DB, cfg *config.Config) *APIKeyLifecycle {
+	return &APIKeyLifecycle{db: db, cfg: cfg, audit: NewAuditService(db)}
+}
+
+// Start sweeps the keys periodically in the background. Every instance may sweep; each
+// change is made by a conditional update, so it is applied and audited once.
+func (l *APIKeyLifecycle) Start() {
+	l.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(apiKeySweepInterval)
+			defer ticker.Stop()
+			for {
+				if err := l.Sweep(context.Background()); err != nil {
+					log.Printf("API key sweep failed: %v", err)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// Sweep retires rotated keys, warns about keys that are about to be deactivated and
+// deactivates inactive keys
+func (l *APIKeyLifecycle) Sweep(ctx context.Context) error {
+	if err := l.retireRotated(); err != nil {
+		return err
+	}
+	if l.cfg.APIKeyInactiveDays <= 0 {
+		return nil
+	}
+	if err := l.warnInactive(ctx); err != nil {
+		return err
+	}
+	return l.deactivateInactive(ctx)
+}
+
+// retireRotated deactivates rotated keys whose grace period has ended
+func (l *APIKeyLifecycle) retireRotated() error {
+	var keys []models.APIKey
+	if err := l.db.Where("is_active = ? AND rotated_at IS NOT NULL AND expires_at < ?", true, time.Now()).
+		Find(&keys).Error; err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !l.deactivate(key, APIKeyDeactivatedRotated) {
+			continue
+		}
+		l.logSystem(key, models.AuditActionAPIKeyDeactivate,
+			fmt.Sprintf("API key '%s' deactivated after its rotation grace period", key.Name),
+			map[string]interface{}{"reason": APIKeyDeactivatedRotated})
+	}
+	return nil
+}
+
+// warnInactive emails the owners of keys that will be deactivated within the warning period.
+// A key is warned again only after it has been used since the last warning.
+func (l *APIKeyLifecycle) warnInactive(ctx context.Context) error {
+	if l.cfg.APIKeyWarningDays <= 0 {
+		return nil
+	}
+	warnBefore := time.Now().AddDate(0, 0, l.cfg.APIKeyWarningDays-l.cfg.APIKeyInactiveDays)
+
+	var keys []models.APIKey
+	if err := l.db.Where("is_active = ? AND rotated_at IS NULL", true).
+		Where(apiKeyActivity+" < ?", warnBefore).
+		Where("inactivity_warned_at IS NULL OR inactivity_warned_at < " + apiKeyActivity).
+		Find(&keys).Error; err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		now := time.Now()
+		result := l.db.Model(&models.APIKey{}).
+			Where("id = ? AND (inactivity_warned_at IS NULL OR inactivity_warned_at < "+apiKeyActivity+")", key.ID).
+			UpdateColumn("inactivity_warned_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue // Another instance warned first
+		}
+
+		deactivateAt := l.lastActivity(key).AddDate(0, 0, l.cfg.APIKeyInactiveDays)
+		if deactivateAt.Before(now.AddDate(0, 0, l.cfg.APIKeyWarningDays)) {
+			deactivateAt = now.AddDate(0, 0, l.cfg.APIKeyWarningDays)
+		}
+
+		l.logSystem(key, models.AuditActionAPIKeyInactivityWarning,
+			fmt.Sprintf("API key '%s' will be deactivated on %s unless it is used", key.Name, deactivateAt.Format("2006-01-02")),
+			map[string]interface{}{"deactivate_at": deactivateAt})
+		l.notifyOwner(ctx, key,
+			fmt.Sprintf("API key '%s' will be deactivated", key.Name),
+			fmt.Sprintf("The API key '%s' has not been used for %d days. It will be deactivated on %s unless it is used before then.\n\nIf the key is no longer needed, you can delete it now.",
+				key.Name, int(now.Sub(l.lastActivity(key)).Hours()/24), deactivateAt.Format("January 2, 2006")))
+	}
+	return nil
+}
+
+// deactivateInactive deactivates keys that have not been used for APIKeyInactiveDays. When
+// warnings are enabled, a key is only deactivated once its owner has been warned in time.
+func (l *APIKeyLifecycle) deactivateInactive(ctx context.Context) error {
+	now := time.Now()
+	query := l.db.Where("is_active = ? AND rotated_at IS NULL", true).
+		Where(apiKeyActivity+" < ?", now.AddDate(0, 0, -l.cfg.APIKeyInactiveDays))
+	if l.cfg.APIKeyWarningDays > 0 {
+		query = query.Where("inactivity_warned_at >= "+apiKeyActivity+" AND inactivity_warned_at <= ?",
+			now.AddDate(0, 0, -l.cfg.APIKeyWarningDays))
+	}
+
+	var keys []models.APIKey
+	if err := query.Find(&keys).Error; err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !l.deactivate(key, APIKeyDeactivatedInactive) {
+			continue
+		}
+		l.logSystem(key, models.AuditActionAPIKeyDeactivate,
+			fmt.Sprintf("API key '%s' deactivated after %d days without use", key.Name, l.cfg.APIKeyInactiveDays),
+			map[string]interface{}{"reason": APIKeyDeactivatedInactive, "last_used_at": key.LastUsedAt})
+		l.notifyOwner(ctx, key,
+			fmt.Sprintf("API key '%s' was deactivated", key.Name),
+			fmt.Sprintf("The API key '%s' was deactivated because it has not been used for %d days. Requests made with it are now rejected.\n\nRotate the key to issue a replacement if it is still needed.",
+				key.Name, l.cfg.APIKeyInactiveDays))
+	}
+	return nil
+}
+
+// deactivate switches a key off unless it changed since it was loaded, and drops it from
+// the authentication caches
+func (l *APIKeyLifecycle) deactivate(key models.APIKey, reason string) bool {
+	var deactivated bool
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.APIKey{}).Where("id = ? AND is_active = ?", key.ID, true).
+			UpdateColumns(map[string]interface{}{
+				"is_active":           false,
+				"deactivated_at":      time.Now(),
+				"deactivation_reason": reason,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if deactivated = result.RowsAffected > 0; !deactivated {
+			return nil
+		}
+		return NotifyAPIKeyChanged(tx, key.ID)
+	})
+	if err != nil {
+		log.Printf("Failed to deactivate API key %d: %v", key.ID, err)
+		return false
+	}
+	return deactivated
+}
+
+func (l *APIKeyLifecycle) lastActivity(key models.APIKey) time.Time {
+	if key.LastUsedAt != nil {
+		return *key.LastUsedAt
+	}
+	return key.CreatedAt
+}
+
+func (l *APIKeyLifecycle) logSystem(key models.APIKey, action models.AuditLogAction, description string, metadata map[string]interface{}) {
+	metadata["key_name"] = key.Name
+	projectID := key.ProjectID
+	if err := l.audit.LogSystemAction(action, "api_key", strconv.FormatUint(uint64(key.ID), 10), description, &projectID, metadata); err != nil {
+		log.Printf("Failed to audit API key %d: %v", key.ID, err)
+	}
+}
+
+// notifyOwner emails the owner of the project of a key through the server's mail driver
+func (l *APIKeyLifecycle) notifyOwner(ctx context.Context, key models.APIKey, subject, text string) {
+	var project models.Project
+	if err := l.db.Preload("User").First(&project, key.ProjectID).Error; err != nil || project.User.Email == "" {
+		return
+	}
+
+	mailer, err := NewMailer(MailConfig{
+		Driver:   l.cfg.MailDriver,
+		Host:     l.cfg.SMTPHost,
+		Port:     l.cfg.SMTPPort,
+		Username: l.cfg.SMTPUsername,
+		Password: l.cfg.SMTPPassword,
+		Security: l.cfg.SMTPSecurity,
+		Dir:      l.cfg.MailDir,
+	})
+	if err != nil {
+		log.Printf("Failed to create mailer for API key alerts: %v", err)
+		return
+	}
+
+	err = mailer.Send(ctx, MailMessage{
+		From:    mail.Address{Name: l.cfg.MailFromName, Address: l.cfg.MailFrom},
+		To:      mail.Address{Name: project.User.Name, Address: project.User.Email},
+		Subject: fmt.Sprintf("[%s] %s", project.Name, subject),
+		Text:    text + "\n\nThe keys of a project are managed in its API key settings.\n",
+	})
+	if err != nil {
+		log.Printf("Failed to send API key alert for key %d: %v", key.ID, err)
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// lifecycleFixture is a project whose owner receives key alerts as files
+type lifecycleFixture struct {
+	t         *testing.T
+	db        *gorm.DB
+	cfg       *config.Config
+	lifecycle *APIKeyLifecycle
+	project   models.Project
+}
+
+func newLifecycleFixture(t *testing.T, inactiveDays, warningDays int) *lifecycleFixture {
+	db := openTestDB(t, &models.User{}, &models.Project{}, &models.APIKey{}, &models.AuditLog{})
+	cfg := &config.Config{
+		APIKeyInactiveDays: inactiveDays,
+		APIKeyWarningDays:  warningDays,
+		MailDriver:         MailDriverFile,
+		MailDir:            t.TempDir(),
+		MailFrom:           "noreply@example.com",
+	}
+	owner := models.User{Email: "owner@example.com", PasswordHash: "hash", Name: "Owner"}
+	db.Create(&owner)
+	project := models.Project{Name: "app", Slug: "app", UserID: owner.ID, IsActive: true}
+	db.Create(&project)
+	return &lifecycleFixture{t: t, db: db, cfg: cfg, lifecycle: NewAPIKeyLifecycle(db, cfg), project: project}
+}
+
+// key creates an active key last used daysAgo, never when negative
+func (f *lifecycleFixture) key(name string, daysAgo int, change func(*models.APIKey)) models.APIKey {
+	f.t.Helper()
+	key := models.APIKey{Name: name, KeyHash: name, HashAlgorithm: APIKeyHashHMAC, IsActive: true, ProjectID: f.project.ID,
+		CreatedAt: time.Now().AddDate(-1, 0, 0)}
+	if daysAgo >= 0 {
+		lastUsed := time.Now().AddDate(0, 0, -daysAgo)
+		key.LastUsedAt = &lastUsed
+	}
+	if change != nil {
+		change(&key)
+	}
+	if err := f.db.Create(&key).Error; err != nil {
+		f.t.Fatal(err)
+	}
+	return key
+}
+
+func (f *lifecycleFixture) sweep() {
+	f.t.Helper()
+	if err := f.lifecycle.Sweep(context.Background()); err != nil {
+		f.t.Fatalf("Sweep: %v", err)
+	}
+}
+
+func (f *lifecycleFixture) reload(key models.APIKey) models.APIKey {
+	var stored models.APIKey
+	f.db.First(&stored, key.ID)
+	return stored
+}
+
+func (f *lifecycleFixture) mails() int {
+	files, _ := filepath.Glob(filepath.Join(f.cfg.MailDir, "*.eml"))
+	return len(files)
+}
+
+func (f *lifecycleFixture) audited(action models.AuditLogAction, key models.APIKey) int64 {
+	var count int64
+	f.db.Model(&models.AuditLog{}).Where("action = ? AND resource_id = ?", action, fmt.Sprint(key.ID)).Count(&count)
+	return count
+}
+
+func TestAPIKeyLifecycleRetiresRotatedKeys(t *testing.T) {
+	f := newLifecycleFixture(t, 0, 0)
+	rotatedAt := time.Now().Add(-2 * time.Hour)
+	rotated := func(expiresIn time.Duration) func(*models.APIKey) {
+		return func(key *models.APIKey) {
+			expiresAt := time.Now().Add(expiresIn)
+			key.RotatedAt = &rotatedAt
+			key.ExpiresAt = &expiresAt
+		}
+	}
+	expired := f.key("expired", 0, rotated(-time.Minute))
+	inGrace := f.key("in-grace", 0, rotated(time.Hour))
+
+	f.sweep()
+	if stored := f.reload(expired); stored.IsActive || stored.DeactivationReason != APIKeyDeactivatedRotated || stored.DeactivatedAt == nil {
+		t.Errorf("key past its grace period: active %t, reason %q", stored.IsActive, stored.DeactivationReason)
+	}
+	if !f.reload(inGrace).IsActive {
+		t.Error("key within its grace period was deactivated")
+	}
+
+	// Another sweep finds nothing to do
+	f.sweep()
+	if n := f.audited(models.AuditActionAPIKeyDeactivate, expired); n != 1 {
+		t.Errorf("deactivation audited %d times", n)
+	}
+}
+
+func TestAPIKeyLifecycleInactiveKeys(t *testing.T) {
+	f := newLifecycleFixture(t, 90, 7)
+	recent := f.key("recent", 10, nil)
+	soon := f.key("soon", 85, nil)        // Within the warning period
+	overdue := f.key("overdue", 100, nil) // Past the limit, but never warned
+	warnedAt := time.Now().AddDate(0, 0, -8)
+	warned := f.key("warned", 100, func(key *models.APIKey) { key.InactivityWarnedAt = &warnedAt })
+	rotatedAt := time.Now()
+	rotated := f.key("rotated", 100, func(key *models.APIKey) { key.RotatedAt = &rotatedAt })
+
+	f.sweep()
+	for _, key := range []models.APIKey{soon, overdue} {
+		stored := f.reload(key)
+		if !stored.IsActive || stored.InactivityWarnedAt == nil {
+			t.Errorf("%s: active %t, warned %v; want a warning first", key.Name, stored.IsActive, stored.InactivityWarnedAt)
+		}
+	}
+	if stored := f.reload(warned); stored.IsActive || stored.DeactivationReason != APIKeyDeactivatedInactive {
+		t.Errorf("warned key: active %t, reason %q", stored.IsActive, stored.DeactivationReason)
+	}
+	for _, key := range []models.APIKey{recent, rotated} {
+		if stored := f.reload(key); !stored.IsActive || stored.InactivityWarnedAt != nil {
+			t.Errorf("%s: active %t, warned %v", key.Name, stored.IsActive, stored.InactivityWarnedAt)
+		}
+	}
+	// Two warnings and one deactivation
+	if n := f.mails(); n != 3 {
+		t.Errorf("%d emails sent, want 3", n)
+	}
+
+	// Keys are warned once
+	f.sweep()
+	if n := f.mails(); n != 3 {
+		t.Errorf("%d emails after another sweep, want 3", n)
+	}
+	if n := f.audited(models.AuditActionAPIKeyInactivityWarning, soon); n != 1 {
+		t.Errorf("warning audited %d times", n)
+	}
+
+	// until they are used after the warning and fall idle again
+	f.db.Model(&models.APIKey{}).Where("id = ?", soon.ID).UpdateColumns(map[string]interface{}{
+		"inactivity_warned_at": time.Now().AddDate(0, 0, -100),
+		"last_used_at":         time.Now().AddDate(0, 0, -85),
+	})
+	f.sweep()
+	if n := f.audited(models.AuditActionAPIKeyInactivityWarning, soon); n != 2 {
+		t.Errorf("key used after its warning was warned %d times, want 2", n)
+	}
+}
+
+func TestAPIKeyLifecycleWithoutWarnings(t *testing.T) {
+	f := newLifecycleFixture(t, 90, 0)
+	neverUsed := f.key("never-used", -1, nil)
+	recent := f.key("recent", 89, nil)
+
+	f.sweep()
+	if stored := f.reload(neverUsed); stored.IsActive || stored.DeactivationReason != APIKeyDeactivatedInactive {
+		t.Errorf("key unused since its creation a year ago: active %t, reason %q", stored.IsActive, stored.DeactivationReason)
+	}
+	if !f.reload(recent).IsActive {
+		t.Error("key used 89 days ago was deactivated")
+	}
+}
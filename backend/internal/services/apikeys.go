@@ -0,0 +1,412 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// API key hash algorithms
+const (
+	APIKeyHashHMAC   = "hmac-sha256"
+	APIKeyHashBcrypt = "bcrypt" // Keys issued before prefixes; upgraded to HMAC on first use
+)
+
+const (
+	// APIKeyEventsChannel carries the IDs of changed keys so every instance drops them from its cache
+	APIKeyEventsChannel = "cloudbox_api_key_events"
+
+	apiKeyPrefix         = "cb_"
+	apiKeyIDLength       = 12 // Hex characters of the public lookup segment
+	apiKeyCacheTTL       = time.Minute
+	apiKeyTouchInterval  = 30 * time.Second
+	legacyKeyPrefixChars = 16
+	legacyKeyLength      = 64 // Hex characters of the keys issued before prefixes
+	legacyFailureTTL     = 10 * time.Minute
+	legacyFailureLimit   = 10000 // Failed legacy prefixes remembered
+	legacyScanBudget     = 20    // bcrypt scans per client IP and minute
+	legacyClientLimit    = 10000 // Client IPs whose scans are counted
+)
+
+// API key authentication errors
+var (
+	ErrAPIKeyInvalid = errors.New("invalid API key")
+	ErrAPIKeyExpired = errors.New("API key expired")
+)
+
+// apiKeySecret returns the HMAC key API keys are hashed with
+func apiKeySecret(cfg *config.Config) []byte {
+	if cfg.APIKeySecret != "" {
+		return []byte(cfg.APIKeySecret)
+	}
+	return []byte(cfg.JWTSecret)
+}
+
+// GenerateAPIKey creates a key of the form cb_<id>_<secret>. The ID segment is public and
+// stored as the key prefix for lookup; only an HMAC of the whole key is stored.
+func GenerateAPIKey(cfg *config.Config) (key, prefix, hash string, err error) {
+	id := make([]byte, apiKeyIDLength/2)
+	secret := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+
+	prefix = apiKeyPrefix + hex.EncodeToString(id)
+	key = prefix + "_" + hex.EncodeToString(secret)
+	hash = HashAPIKey(cfg, key)
+	return
+}
+
+// HashAPIKey returns the HMAC-SHA256 of a key
+func HashAPIKey(cfg *config.Config, key string) string {
+	return hashAPIKeyWith(apiKeySecret(cfg), key)
+}
+
+func hashAPIKeyWith(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apiKeyLookupPrefix returns the stored prefix of a presented key. Legacy keys have no ID
+// segment, so they are found by their leading characters once upgraded.
+func apiKeyLookupPrefix(key string) string {
+	if strings.HasPrefix(key, apiKeyPrefix) {
+		if end := strings.IndexByte(key[len(apiKeyPrefix):], '_'); end > 0 {
+			return key[:len(apiKeyPrefix)+end]
+		}
+		return ""
+	}
+	if !isLegacyKey(key) {
+		return ""
+	}
+	return "legacy_" + key[:legacyKeyPrefixChars]
+}
+
+// isLegacyKey reports whether a key has the shape of the keys issued before prefixes:
+// 32 random bytes, hex encoded
+func isLegacyKey(key string) bool {
+	if len(key) != legacyKeyLength {
+		return false
+	}
+	for _, r := range key {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type legacyScanWindow struct {
+	start time.Time
+	scans int
+}
+
+// legacyGuard bounds the bcrypt work unauthenticated callers can cause with legacy keys,
+// which cannot be looked up by prefix: a prefix that matched no key is rejected without
+// comparing for legacyFailureTTL, and each client IP compares at most legacyScanBudget keys
+// per minute. The budget is not shared, so a client using up its own does not lock the keys
+// of a project out for everyone else
+type legacyGuard struct {
+	mutex   sync.Mutex
+	failed  map[string]time.Time        // By project and legacy prefix
+	windows map[string]legacyScanWindow // By client IP
+}
+
+func newLegacyGuard() *legacyGuard {
+	return &legacyGuard{
+		failed:  make(map[string]time.Time),
+		windows: make(map[string]legacyScanWindow),
+	}
+}
+
+// allow reports whether a client may compare a legacy key against the bcrypt hashes of a project
+func (g *legacyGuard) allow(projectID uint, prefix, clientIP string, now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if failedAt, ok := g.failed[legacyFailureKey(projectID, prefix)]; ok && now.Sub(failedAt) < legacyFailureTTL {
+		return false
+	}
+
+	window, ok := g.windows[clientIP]
+	if !ok && len(g.windows) >= legacyClientLimit {
+		for client, counted := range g.windows {
+			if now.Sub(counted.start) >= time.Minute {
+				delete(g.windows, client)
+			}
+		}
+		if len(g.windows) >= legacyClientLimit {
+			return false
+		}
+	}
+	if now.Sub(window.start) >= time.Minute {
+		window = legacyScanWindow{start: now}
+	}
+	if window.scans >= legacyScanBudget {
+		return false
+	}
+	window.scans++
+	g.windows[clientIP] = window
+	return true
+}
+
+// fail remembers a legacy prefix that matched no key of a project
+func (g *legacyGuard) fail(projectID uint, prefix string, now time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if len(g.failed) >= legacyFailureLimit {
+		for key, failedAt := range g.failed {
+			if now.Sub(failedAt) >= legacyFailureTTL {
+				delete(g.failed, key)
+			}
+		}
+		if len(g.failed) >= legacyFailureLimit {
+			g.failed = make(map[string]time.Time)
+		}
+	}
+	g.failed[legacyFailureKey(projectID, prefix)] = now
+}
+
+func legacyFailureKey(projectID uint, prefix string) string {
+	return strconv.FormatUint(uint64(projectID), 10) + ":" + prefix
+}
+
+// NotifyAPIKeyChanged tells every instance to stop using its cached copy of a key. Call it
+// after revoking or changing a key, inside the transaction when there is one.
+func NotifyAPIKeyChanged(db *gorm.DB, keyID uint) error {
+	return db.Exec("SELECT pg_notify(?, ?)", APIKeyEventsChannel, strconv.FormatUint(uint64(keyID), 10)).Error
+}
+
+type cachedAPIKey struct {
+	key      models.APIKey
+	cachedAt time.Time
+}
+
+// APIKeyStore authenticates API keys by prefix lookup and HMAC comparison, caches verified
+// keys and records their use in batches
+type APIKeyStore struct {
+	db     *gorm.DB
+	secret []byte
+
+	mutex sync.RWMutex
+	cache map[string]cachedAPIKey // By key hash
+
+	usedMutex sync.Mutex
+	used      map[uint]time.Time // Pending last_used_at updates
+
+	legacy *legacyGuard
+
+	once sync.Once
+}
+
+// NewAPIKeyStore creates a new API key store
+func NewAPIKeyStore(db *gorm.DB, cfg *config.Config) *APIKeyStore {
+	return &APIKeyStore{
+		db:     db,
+		secret: apiKeySecret(cfg),
+		cache:  make(map[string]cachedAPIKey),
+		used:   make(map[uint]time.Time),
+		legacy: newLegacyGuard(),
+	}
+}
+
+// Start listens for key changes and flushes usage timestamps in the background
+func (s *APIKeyStore) Start(databaseURL string) {
+	s.once.Do(func() {
+		if databaseURL != "" {
+			listenChannel(databaseURL, APIKeyEventsChannel, s.clear, s.invalidate)
+		}
+		go func() {
+			ticker := time.NewTicker(apiKeyTouchInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := s.Flush(); err != nil {
+					log.Printf("Failed to record API key usage: %v", err)
+				}
+			}
+		}()
+	})
+}
+
+// Authenticate returns the active key of a project matching a key presented by a client
+func (s *APIKeyStore) Authenticate(projectID uint, presented, clientIP string) (models.APIKey, error) {
+	hash := hashAPIKeyWith(s.secret, presented)
+
+	s.mutex.RLock()
+	cached, ok := s.cache[hash]
+	s.mutex.RUnlock()
+
+	key := cached.key
+	if !ok || time.Since(cached.cachedAt) > apiKeyCacheTTL {
+		var err error
+		if key, err = s.lookup(projectID, presented, hash, clientIP); err != nil {
+			return key, err
+		}
+		s.mutex.Lock()
+		s.cache[hash] = cachedAPIKey{key: key, cachedAt: time.Now()}
+		s.mutex.Unlock()
+	}
+
+	if key.ProjectID != projectID {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return key, ErrAPIKeyExpired
+	}
+
+	s.touch(key.ID)
+	return key, nil
+}
+
+// AuthenticateID returns an active key of a project by ID, for credentials such as realtime
+// tickets that were derived from an authenticated key and must stop working when it is revoked
+func (s *APIKeyStore) AuthenticateID(projectID, keyID uint) (models.APIKey, error) {
+	var key models.APIKey
+	err := s.db.Where("id = ? AND project_id = ? AND is_active = ?", keyID, projectID, true).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return key, err
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return key, ErrAPIKeyExpired
+	}
+
+	s.touch(key.ID)
+	return key, nil
+}
+
+// lookup finds a key by its prefix and verifies its HMAC; legacy bcrypt keys are verified
+// by comparison and upgraded
+func (s *APIKeyStore) lookup(projectID uint, presented, hash, clientIP string) (models.APIKey, error) {
+	prefix := apiKeyLookupPrefix(presented)
+	if prefix == "" {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+
+	var candidates []models.APIKey
+	if err := s.db.Where("project_id = ? AND key_prefix = ? AND hash_algorithm = ? AND is_active = ?",
+		projectID, prefix, APIKeyHashHMAC, true).Find(&candidates).Error; err != nil {
+		return models.APIKey{}, err
+	}
+	for _, candidate := range candidates {
+		if hmac.Equal([]byte(candidate.KeyHash), []byte(hash)) {
+			return candidate, nil
+		}
+	}
+
+	if strings.HasPrefix(presented, apiKeyPrefix) {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+	return s.upgradeLegacy(projectID, presented, prefix, hash, clientIP)
+}
+
+// upgradeLegacy verifies a key issued before prefixes against the remaining bcrypt hashes of
+// the project and stores its HMAC, so later requests take the indexed path
+func (s *APIKeyStore) upgradeLegacy(projectID uint, presented, prefix, hash, clientIP string) (models.APIKey, error) {
+	if !s.legacy.allow(projectID, prefix, clientIP, time.Now()) {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+
+	var legacy []models.APIKey
+	if err := s.db.Where("project_id = ? AND hash_algorithm = ? AND is_active = ?",
+		projectID, APIKeyHashBcrypt, true).Find(&legacy).Error; err != nil {
+		return models.APIKey{}, err
+	}
+
+	for _, candidate := range legacy {
+		if bcrypt.CompareHashAndPassword([]byte(candidate.KeyHash), []byte(presented)) != nil {
+			continue
+		}
+
+		err := s.db.Model(&candidate).UpdateColumns(map[string]interface{}{
+			"key_hash":       hash,
+			"key_prefix":     prefix,
+			"hash_algorithm": APIKeyHashHMAC,
+		}).Error
+		if err != nil {
+			log.Printf("Failed to upgrade hash of API key %d: %v", candidate.ID, err)
+		} else {
+			candidate.KeyHash = hash
+			candidate.KeyPrefix = prefix
+			candidate.HashAlgorithm = APIKeyHashHMAC
+		}
+		return candidate, nil
+	}
+
+	s.legacy.fail(projectID, prefix, time.Now())
+	return models.APIKey{}, ErrAPIKeyInvalid
+}
+
+// touch records that a key was used; Flush writes it
+func (s *APIKeyStore) touch(keyID uint) {
+	s.usedMutex.Lock()
+	s.used[keyID] = time.Now()
+	s.usedMutex.Unlock()
+}
+
+// Flush writes the pending last_used_at timestamps in one statement
+func (s *APIKeyStore) Flush() error {
+	s.usedMutex.Lock()
+	used := s.used
+	s.used = make(map[uint]time.Time)
+	s.usedMutex.Unlock()
+
+	if len(used) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(used))
+	args := make([]interface{}, 0, 2*len(used))
+	for id, at := range used {
+		values = append(values, "(?::bigint, ?::timestamptz)")
+		args = append(args, id, at)
+	}
+
+	return s.db.Exec(fmt.Sprintf(`UPDATE api_keys SET last_used_at = used.at
+		FROM (VALUES %s) AS used(id, at)
+		WHERE api_keys.id = used.id AND (api_keys.last_used_at IS NULL OR api_keys.last_used_at < used.at)`,
+		strings.Join(values, ", ")), args...).Error
+}
+
+// invalidate drops a changed key from the cache
+func (s *APIKeyStore) invalidate(payload string) {
+	id, err := strconv.ParseUint(payload, 10, 64)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hash, cached := range s.cache {
+		if uint64(cached.key.ID) == id {
+			delete(s.cache, hash)
+		}
+	}
+}
+
+// clear drops every cached key; changes may have been missed while not listening
+func (s *APIKeyStore) clear() {
+	s.mutex.Lock()
+	s.cache = make(map[string]cachedAPIKey)
+	s.mutex.Unlock()
+}
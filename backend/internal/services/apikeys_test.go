@@ -0,0 +1,153 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAPIKeyLookupPrefix(t *testing.T) {
+	legacy := strings.Repeat("0123456789abcdef", 4)
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"prefixed", "cb_a1b2c3d4_secret", "cb_a1b2c3d4"},
+		{"prefixed secret with underscore", "cb_a1b2_sec_ret", "cb_a1b2"},
+		{"empty id", "cb__secret", ""},
+		{"no secret", "cb_a1b2c3d4", ""},
+		{"legacy", legacy, "legacy_0123456789abcdef"},
+		{"legacy too short", legacy[:63], ""},
+		{"legacy too long", legacy + "0", ""},
+		{"legacy uppercase", strings.ToUpper(legacy), ""},
+		{"legacy not hex", legacy[:63] + "g", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := apiKeyLookupPrefix(tt.key); got != tt.want {
+				t.Errorf("apiKeyLookupPrefix(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyGuardRejectsFailedPrefix(t *testing.T) {
+	guard := newLegacyGuard()
+	now := time.Now()
+
+	if !guard.allow(1, "legacy_a", "10.0.0.1", now) {
+		t.Fatal("first scan was rejected")
+	}
+	guard.fail(1, "legacy_a", now)
+
+	if guard.allow(1, "legacy_a", "10.0.0.2", now.Add(time.Minute)) {
+		t.Error("failed prefix was scanned again")
+	}
+	if !guard.allow(2, "legacy_a", "10.0.0.1", now.Add(time.Minute)) {
+		t.Error("failed prefix of another project was rejected")
+	}
+	if !guard.allow(1, "legacy_a", "10.0.0.1", now.Add(legacyFailureTTL)) {
+		t.Error("failed prefix was still rejected after legacyFailureTTL")
+	}
+}
+
+func TestLegacyGuardBudget(t *testing.T) {
+	guard := newLegacyGuard()
+	now := time.Now()
+
+	// A client guessing keys uses up its own budget only
+	for i := 0; i < legacyScanBudget; i++ {
+		if !guard.allow(1, "legacy_"+string(rune('a'+i)), "10.0.0.1", now) {
+			t.Fatalf("scan %d was rejected within the budget", i+1)
+		}
+	}
+	if guard.allow(1, "legacy_z", "10.0.0.1", now.Add(30*time.Second)) {
+		t.Error("scan beyond the budget was allowed")
+	}
+	if guard.allow(2, "legacy_z", "10.0.0.1", now.Add(30*time.Second)) {
+		t.Error("budget was reset by switching projects")
+	}
+	if !guard.allow(1, "legacy_z", "10.0.0.2", now.Add(30*time.Second)) {
+		t.Error("another client of the project was locked out")
+	}
+	if !guard.allow(1, "legacy_z", "10.0.0.1", now.Add(time.Minute)) {
+		t.Error("budget did not reset after a minute")
+	}
+}
+
+func TestLegacyGuardBoundsClients(t *testing.T) {
+	guard := newLegacyGuard()
+	now := time.Now()
+
+	for i := 0; i < legacyClientLimit; i++ {
+		guard.allow(1, "legacy_a", strconv.Itoa(i), now)
+	}
+	if guard.allow(1, "legacy_a", "10.0.0.1", now) {
+		t.Error("scan of a new client was allowed beyond legacyClientLimit")
+	}
+	if !guard.allow(1, "legacy_a", "10.0.0.1", now.Add(time.Minute)) {
+		t.Error("windows that ended were not dropped for new clients")
+	}
+	if len(guard.windows) > legacyClientLimit {
+		t.Errorf("counted %d clients, want at most %d", len(guard.windows), legacyClientLimit)
+	}
+}
+
+func TestLegacyGuardBoundsFailures(t *testing.T) {
+	guard := newLegacyGuard()
+	now := time.Now()
+
+	for i := 0; i < legacyFailureLimit+1; i++ {
+		guard.fail(uint(i), "legacy_a", now)
+	}
+	if len(guard.failed) > legacyFailureLimit {
+		t.Errorf("remembered %d failed prefixes, want at most %d", len(guard.failed), legacyFailureLimit)
+	}
+}
+
+func TestAuthenticateLegacyKeyDuringFlood(t *testing.T) {
+	db := openTestDB(t, &models.APIKey{})
+	store := NewAPIKeyStore(db, &config.Config{APIKeySecret: "test"})
+
+	legacy := strings.Repeat("0123456789abcdef", 4)
+	hash, err := bcrypt.GenerateFromPassword([]byte(legacy), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := models.APIKey{Name: "legacy", KeyHash: string(hash), HashAlgorithm: APIKeyHashBcrypt, IsActive: true, ProjectID: 1}
+	if err := db.Create(&key).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Random keys from one client use up its budget
+	for i := 0; i <= legacyScanBudget; i++ {
+		guess := fmt.Sprintf("%064x", i+1)
+		if _, err := store.Authenticate(1, guess, "203.0.113.7"); !errors.Is(err, ErrAPIKeyInvalid) {
+			t.Fatalf("guess %d: err = %v, want ErrAPIKeyInvalid", i, err)
+		}
+	}
+
+	// The real key still works from everywhere else, and is upgraded to HMAC
+	found, err := store.Authenticate(1, legacy, "198.51.100.1")
+	if err != nil || found.ID != key.ID {
+		t.Fatalf("Authenticate = %v, %v", found.ID, err)
+	}
+	db.First(&key, key.ID)
+	if key.HashAlgorithm != APIKeyHashHMAC || key.KeyPrefix != "legacy_0123456789abcdef" {
+		t.Errorf("key was not upgraded: %s %s", key.HashAlgorithm, key.KeyPrefix)
+	}
+	if _, err := store.Authenticate(2, legacy, "198.51.100.1"); !errors.Is(err, ErrAPIKeyInvalid) {
+		t.Errorf("key authenticated for another project: err = %v", err)
+	}
+}
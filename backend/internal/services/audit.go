@@ -184,6 +184,49 @@ func (s *AuditService) LogOrganizationDeletion(c *gin.Context, orgID uint, orgNa
 	)
 }
 
+// LogAPIKeyEvent logs a lifecycle event of an API key
+func (s *AuditService) LogAPIKeyEvent(c *gin.Context, action models.AuditLogAction, keyID uint, keyName, description string, success bool, errorMsg string, metadata map[string]interface{}) error {
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["key_name"] = keyName
+
+	return s.LogAction(
+		c,
+		action,
+		"api_key",
+		fmt.Sprintf("%d", keyID),
+		description,
+		success,
+		errorMsg,
+		metadata,
+	)
+}
+
+// LogSystemAction logs an action the server performed on its own, such as a scheduled job
+func (s *AuditService) LogSystemAction(action models.AuditLogAction, resource, resourceID, description string, projectID *uint, metadata interface{}) error {
+	var metadataJSON string
+	if metadata != nil {
+		if jsonBytes, err := json.Marshal(metadata); err == nil {
+			metadataJSON = string(jsonBytes)
+		}
+	}
+
+	auditLog := models.AuditLog{
+		Action:      action,
+		Resource:    resource,
+		ResourceID:  resourceID,
+		Description: description,
+		ActorName:   "system",
+		ActorRole:   "system",
+		Metadata:    metadataJSON,
+		ProjectID:   projectID,
+		Success:     true,
+	}
+
+	return s.db.Create(&auditLog).Error
+}
+
 // GetAuditLogs retrieves audit logs with filtering
 func (s *AuditService) GetAuditLogs(action string, resource string, actorID uint, limit int, offset int) ([]models.AuditLog, int64, error) {
 	var logs []models.AuditLog
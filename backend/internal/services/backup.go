@@ -3,92 +3,348 @@ package services
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/utils"
 	"gorm.io/gorm"
 )
 
+// Backup modes
+const (
+	BackupModeFull        = "full"
+	BackupModeIncremental = "incremental" // Only the documents and files changed since a parent backup
+)
+
+// maxBackupChain bounds the incremental backups restored on top of a full backup
+const maxBackupChain = 100
+
+var (
+	// ErrInvalidBackupParent is returned for incremental backups without a completed parent backup
+	ErrInvalidBackupParent = errors.New("no completed backup to base an incremental backup on")
+	// ErrBackupInUse is returned when deleting a backup incremental backups build on
+	ErrBackupInUse = errors.New("incremental backups build on this backup")
+	// ErrBackupEncryptionUnavailable is returned for encrypted backups without a master key
+	ErrBackupEncryptionUnavailable = errors.New("encrypted backups need a master key")
+	// ErrBackupNotFound is returned for backups the project does not have
+	ErrBackupNotFound = errors.New("backup not found")
+)
+
 // BackupService handles backup and restore operations
 type BackupService struct {
 	db        *gorm.DB
+	cfg       *config.Config
+	backends  *StorageBackends
+	jobs      *JobQueue
 	backupDir string
 }
 
 // NewBackupService creates a new backup service
-func NewBackupService(db *gorm.DB, backupDir string) *BackupService {
+func NewBackupService(db *gorm.DB, cfg *config.Config) *BackupService {
+	backupDir := cfg.BackupDir
+	if backupDir == "" {
+		backupDir = "/var/lib/cloudbox/backups"
+	}
 	// Ensure backup directory exists
 	os.MkdirAll(backupDir, 0755)
-	
+
 	return &BackupService{
 		db:        db,
+		cfg:       cfg,
+		backends:  NewStorageBackends(cfg),
+		jobs:      NewJobQueue(db, cfg),
 		backupDir: backupDir,
 	}
 }
 
+// BackupOptions describes a backup to create
+type BackupOptions struct {
+	Name        string
+	Description string
+	Type        string // manual, automatic
+	Mode        string // full (default) or incremental
+	ParentID    uint   // Backup an incremental backup builds on; the latest completed one by default
+
+	DestinationID uint // Destination the archive is stored in; the backup directory by default
+	Encrypt       bool // Encrypt the archive with the master key
+	ScheduleID    uint // Schedule taking the backup
+}
+
 // BackupData represents the structure of backup data
 type BackupData struct {
-	Metadata         BackupMetadata             `json:"metadata"`
-	Collections      []models.Collection        `json:"collections"`
-	Documents        []models.Document          `json:"documents"`
-	Files            []models.File              `json:"files"`
-	Functions        []models.Function          `json:"functions"`
-	Deployments      []models.Deployment        `json:"deployments"`
-	GitHubRepos      []models.GitHubRepository  `json:"github_repositories"`
-	WebServers       []models.WebServer         `json:"web_servers"`
-	SSHKeys          []models.SSHKey            `json:"ssh_keys"`
-	APIKeys          []models.APIKey            `json:"api_keys"`
-	CORSConfigs      []models.CORSConfig        `json:"cors_configs"`
-	FunctionDomains  []models.FunctionDomain    `json:"function_domains"`
-	AuditLogs        []models.AuditLog          `json:"audit_logs"`
-	BackupVersion    string                     `json:"backup_version"`
+	Metadata            BackupMetadata               `json:"metadata"`
+	Collections         []models.Collection          `json:"collections"`
+	Documents           []models.Document            `json:"documents"`
+	DocumentIDs         []string                     `json:"document_ids,omitempty"` // Every document, in incremental backups
+	DocumentRevisions   []models.DocumentRevision    `json:"document_revisions,omitempty"`
+	Buckets             []models.Bucket              `json:"buckets,omitempty"`
+	Files               []models.File                `json:"files"`
+	FileIDs             []string                     `json:"file_ids,omitempty"` // Every file, in incremental backups
+	Functions           []models.Function            `json:"functions"`
+	Deployments         []models.Deployment          `json:"deployments"`
+	GitHubRepos         []BackupGitHubRepository     `json:"github_repositories"`
+	WebServers          []models.WebServer           `json:"web_servers"`
+	SSHKeys             []BackupSSHKey               `json:"ssh_keys"`
+	APIKeys             []BackupAPIKey               `json:"api_keys"`
+	CORSConfigs         []models.CORSConfig          `json:"cors_configs"`
+	FunctionDomains     []models.FunctionDomain      `json:"function_domains"`
+	AppUsers            []BackupAppUser              `json:"app_users,omitempty"`
+	AppSessions         []BackupAppSession           `json:"app_sessions,omitempty"`
+	AppUserIdentities   []models.AppUserIdentity     `json:"app_user_identities,omitempty"`
+	AuthSettings        []models.ProjectAuthSettings `json:"auth_settings,omitempty"`
+	AuthProviders       []BackupAuthProvider         `json:"auth_providers,omitempty"`
+	MailSettings        []BackupMailSettings         `json:"mail_settings,omitempty"`
+	EmailTemplates      []models.EmailTemplate       `json:"email_templates,omitempty"`
+	Channels            []models.Channel             `json:"channels,omitempty"`
+	ChannelMembers      []models.ChannelMember       `json:"channel_members,omitempty"`
+	Messages            []models.Message             `json:"messages,omitempty"`
+	MessageReactions    []models.MessageReaction     `json:"message_reactions,omitempty"`
+	MessageReads        []models.MessageRead         `json:"message_reads,omitempty"`
+	PluginInstallations []models.PluginInstallation  `json:"plugin_installations,omitempty"`
+	AuditLogs           []models.AuditLog            `json:"audit_logs"`
+	BackupVersion       string                       `json:"backup_version"`
+}
+
+// The rows of tables with columns their models keep out of JSON; the backup carries those
+// columns so restored keys, passwords and secrets keep working
+
+// BackupGitHubRepository is a GitHub repository with its OAuth tokens and encrypted webhook secret
+type BackupGitHubRepository struct {
+	models.GitHubRepository
+	AccessToken   string `json:"access_token,omitempty"`
+	RefreshToken  string `json:"refresh_token,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+}
+
+// TableName keeps the table of the embedded model
+func (BackupGitHubRepository) TableName() string { return "git_hub_repositories" }
+
+// BackupSSHKey is an SSH key with its encrypted private key
+type BackupSSHKey struct {
+	models.SSHKey
+	PrivateKey string `json:"private_key"`
+}
+
+// TableName keeps the table of the embedded model
+func (BackupSSHKey) TableName() string { return "ssh_keys" }
+
+// BackupAPIKey is an API key with its hash
+type BackupAPIKey struct {
+	models.APIKey
+	KeyHash       string `json:"key_hash"`
+	HashAlgorithm string `json:"hash_algorithm"`
+}
+
+// TableName keeps the table of the embedded model
+func (BackupAPIKey) TableName() string { return "api_keys" }
+
+// BackupAppUser is an app user with its password hash
+type BackupAppUser struct {
+	models.AppUser
+	PasswordHash string `json:"password_hash"`
+}
+
+// TableName keeps the table of the embedded model
+func (BackupAppUser) TableName() string { return "app_users" }
+
+// BackupAppSession is an app session with its token
+type BackupAppSession struct {
+	models.AppSession
+	Token string `json:"token"`
+}
+
+// TableName keeps the table of the embedded model
+func (BackupAppSession) TableName() string { return "app_sessions" }
+
+// BackupAuthProvider is an auth provider with its encrypted client secret
+type BackupAuthProvider struct {
+	models.AuthProvider
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// TableName keeps the table of the embedded model
+func (BackupAuthProvider) TableName() string { return "auth_providers" }
+
+// BackupMailSettings are mail settings with the encrypted SMTP password
+type BackupMailSettings struct {
+	models.ProjectMailSettings
+	SMTPPassword string `json:"smtp_password,omitempty"`
 }
 
+// TableName keeps the table of the embedded model
+func (BackupMailSettings) TableName() string { return "project_mail_settings" }
+
 // BackupMetadata contains metadata about the backup
 type BackupMetadata struct {
-	ProjectID    uint      `json:"project_id"`
-	ProjectName  string    `json:"project_name"`
-	CreatedAt    time.Time `json:"created_at"`
-	BackupType   string    `json:"backup_type"`
-	CloudBoxVersion string `json:"cloudbox_version"`
+	ProjectID       uint      `json:"project_id"`
+	ProjectName     string    `json:"project_name"`
+	CreatedAt       time.Time `json:"created_at"`
+	BackupType      string    `json:"backup_type"`
+	CloudBoxVersion string    `json:"cloudbox_version"`
+
+	FormatVersion  string     `json:"format_version,omitempty"`
+	Mode           string     `json:"mode,omitempty"`
+	ParentBackupID uint       `json:"parent_backup_id,omitempty"` // Incremental backups
+	ParentChecksum string     `json:"parent_checksum,omitempty"`
+	Since          *time.Time `json:"since,omitempty"` // Documents and files changed from then on are included
 }
 
-// CreateBackup creates a full backup of a project
-func (s *BackupService) CreateBackup(projectID uint, backupType string) (*models.Backup, error) {
+// CreateBackup creates a backup of a project
+func (s *BackupService) CreateBackup(projectID uint, options BackupOptions) (*models.Backup, error) {
 	// Get project information
 	var project models.Project
 	if err := s.db.First(&project, projectID).Error; err != nil {
 		return nil, fmt.Errorf("project not found: %w", err)
 	}
 
+	if options.Mode == "" {
+		options.Mode = BackupModeFull
+	}
+	var parent *models.Backup
+	if options.Mode == BackupModeIncremental {
+		var err error
+		if parent, err = s.backupParent(projectID, options.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	if options.DestinationID != 0 {
+		if _, err := s.GetDestination(projectID, options.DestinationID); err != nil {
+			return nil, err
+		}
+	}
+	if options.Encrypt && s.cfg.MasterKey == "" {
+		return nil, ErrBackupEncryptionUnavailable
+	}
+
+	if options.Name == "" {
+		options.Name = fmt.Sprintf("%s-backup-%s", project.Name, time.Now().Format("2006-01-02-15-04-05"))
+	}
+	if options.Description == "" {
+		options.Description = fmt.Sprintf("Full backup of project %s", project.Name)
+		if parent != nil {
+			options.Description = fmt.Sprintf("Incremental backup of project %s since %s", project.Name, parent.Name)
+		}
+	}
+
 	// Create backup record
 	backup := models.Backup{
-		Name:        fmt.Sprintf("%s-backup-%s", project.Name, time.Now().Format("2006-01-02-15-04-05")),
-		Description: fmt.Sprintf("Full backup of project %s", project.Name),
-		Type:        backupType,
-		Status:      "creating",
-		ProjectID:   projectID,
+		Name:          options.Name,
+		Description:   options.Description,
+		Type:          options.Type,
+		Mode:          options.Mode,
+		FormatVersion: BackupFormatVersion,
+		Status:        "creating",
+		Encrypted:     options.Encrypt,
+		ProjectID:     projectID,
+	}
+	if parent != nil {
+		backup.ParentID = &parent.ID
+	}
+	if options.DestinationID != 0 {
+		backup.DestinationID = &options.DestinationID
+	}
+	if options.ScheduleID != 0 {
+		backup.ScheduleID = &options.ScheduleID
 	}
 
 	if err := s.db.Create(&backup).Error; err != nil {
 		return nil, fmt.Errorf("failed to create backup record: %w", err)
 	}
 
-	// Perform backup asynchronously
-	go s.performBackup(&backup, project)
+	// Perform backup in the background
+	if err := s.jobs.Enqueue(NewBackupJob(backup)); err != nil {
+		s.updateBackupStatus(backup.ID, "failed", err.Error())
+		return nil, err
+	}
 
 	return &backup, nil
 }
 
+// backupParent returns the backup an incremental backup of a project builds on: the one asked
+// for, or the latest one. Parents are completed and have a manifest
+func (s *BackupService) backupParent(projectID, parentID uint) (*models.Backup, error) {
+	query := s.db.Where("project_id = ? AND status = ? AND format_version <> ?", projectID, "completed", "1.0")
+	if parentID != 0 {
+		query = query.Where("id = ?", parentID)
+	}
+
+	var parent models.Backup
+	if err := query.Order("created_at DESC").First(&parent).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidBackupParent
+		}
+		return nil, err
+	}
+	// Archives kept elsewhere are checked when restoring
+	if parent.DestinationID == nil {
+		if _, err := os.Stat(parent.FilePath); err != nil {
+			return nil, ErrInvalidBackupParent
+		}
+	}
+	return &parent, nil
+}
+
+// runBackupJob creates the archive of a queued backup. Backups that fail are retried
+func (s *BackupService) runBackupJob(ctx context.Context, job *models.Job) error {
+	var payload backupJobPayload
+	if err := decodeJobPayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+	var backup models.Backup
+	if err := s.db.First(&backup, payload.BackupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return PermanentJobError(fmt.Errorf("backup %d no longer exists", payload.BackupID))
+		}
+		return err
+	}
+	var project models.Project
+	if err := s.db.First(&project, backup.ProjectID).Error; err != nil {
+		return PermanentJobError(fmt.Errorf("project not found: %w", err))
+	}
+	var parent *models.Backup
+	if backup.ParentID != nil {
+		parent = &models.Backup{}
+		if err := s.db.First(parent, *backup.ParentID).Error; err != nil {
+			s.updateBackupStatus(backup.ID, "failed", "The backup it builds on no longer exists")
+			return PermanentJobError(ErrInvalidBackupParent)
+		}
+	}
+
+	// Retries start over
+	if backup.Status != "creating" {
+		s.updateBackupStatus(backup.ID, "creating", "")
+	}
+	return s.performBackup(ctx, &backup, project, parent)
+}
+
+// abortBackupJob marks the backup of a job that will not run again as failed
+func (s *BackupService) abortBackupJob(job models.Job, status, reason string) {
+	var payload backupJobPayload
+	if decodeJobPayload(&job, &payload) != nil {
+		return
+	}
+	s.db.Model(&models.Backup{}).
+		Where("id = ? AND status = ?", payload.BackupID, "creating").
+		Updates(map[string]interface{}{
+			"status":        "failed",
+			"error_message": reason,
+		})
+}
+
 // performBackup performs the actual backup operation
-func (s *BackupService) performBackup(backup *models.Backup, project models.Project) {
+func (s *BackupService) performBackup(ctx context.Context, backup *models.Backup, project models.Project, parent *models.Backup) error {
 	// Create backup data structure
 	backupData := BackupData{
 		Metadata: BackupMetadata{
@@ -97,49 +353,107 @@ func (s *BackupService) performBackup(backup *models.Backup, project models.Proj
 			CreatedAt:       time.Now(),
 			BackupType:      backup.Type,
 			CloudBoxVersion: "1.0.0", // Should come from config
+			FormatVersion:   BackupFormatVersion,
+			Mode:            backup.Mode,
 		},
-		BackupVersion: "1.0",
+		BackupVersion: BackupFormatVersion,
+	}
+
+	// Rows changed while the parent was made may be in both backups; none are missed
+	var since *time.Time
+	if parent != nil {
+		since = &parent.CreatedAt
+		backupData.Metadata.ParentBackupID = parent.ID
+		backupData.Metadata.ParentChecksum = parent.Checksum
+		backupData.Metadata.Since = since
 	}
 
 	// Collect all project data
-	if err := s.collectProjectData(project.ID, &backupData); err != nil {
+	if err := s.collectProjectData(project.ID, &backupData, since); err != nil {
 		s.updateBackupStatus(backup.ID, "failed", fmt.Sprintf("Failed to collect data: %v", err))
-		return
+		return err
+	}
+	objects, err := s.collectProjectObjects(ctx, project.ID, &backupData)
+	if err != nil {
+		s.updateBackupStatus(backup.ID, "failed", fmt.Sprintf("Failed to collect files: %v", err))
+		return err
 	}
 
 	// Create backup file
-	backupFilePath := filepath.Join(s.backupDir, fmt.Sprintf("backup-%d-%d.tar.gz", project.ID, backup.ID))
-	size, checksum, err := s.createBackupArchive(backupData, backupFilePath)
+	encryption := ""
+	if backup.Encrypted {
+		encryption = backupEncryptionContext(*backup)
+	}
+	backupFilePath := filepath.Join(s.backupDir, backupArchiveName(*backup))
+	size, checksum, err := s.createBackupArchive(ctx, &backupData, objects, backupFilePath, encryption)
 	if err != nil {
 		s.updateBackupStatus(backup.ID, "failed", fmt.Sprintf("Failed to create archive: %v", err))
-		return
+		return err
+	}
+
+	// Move it to its destination
+	if backup.DestinationID != nil {
+		key, err := s.storeArchive(ctx, *backup, backupFilePath)
+		os.Remove(backupFilePath)
+		if err != nil {
+			s.updateBackupStatus(backup.ID, "failed", fmt.Sprintf("Failed to store archive: %v", err))
+			return err
+		}
+		backupFilePath = key
 	}
 
 	// Update backup record with completion info
 	now := time.Now()
-	s.db.Model(backup).Updates(map[string]interface{}{
+	return s.db.Model(backup).Updates(map[string]interface{}{
 		"status":       "completed",
 		"size":         size,
 		"file_path":    backupFilePath,
 		"checksum":     checksum,
 		"completed_at": &now,
-	})
+	}).Error
 }
 
-// collectProjectData collects all data for a project
-func (s *BackupService) collectProjectData(projectID uint, backupData *BackupData) error {
+// collectProjectData collects all data for a project. Given a time, only the documents and files
+// changed since are collected, along with the IDs of all of them
+func (s *BackupService) collectProjectData(projectID uint, backupData *BackupData, since *time.Time) error {
 	// Collect collections
 	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.Collections).Error; err != nil {
 		return fmt.Errorf("failed to collect collections: %w", err)
 	}
 
 	// Collect documents
-	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.Documents).Error; err != nil {
+	documents := s.db.Where("project_id = ?", projectID)
+	if since != nil {
+		documents = documents.Where("updated_at >= ?", *since)
+		backupData.DocumentIDs = []string{}
+		if err := s.db.Model(&models.Document{}).Where("project_id = ?", projectID).Pluck("id", &backupData.DocumentIDs).Error; err != nil {
+			return fmt.Errorf("failed to collect document ids: %w", err)
+		}
+	}
+	if err := documents.Find(&backupData.Documents).Error; err != nil {
 		return fmt.Errorf("failed to collect documents: %w", err)
 	}
 
+	// Collect document revisions
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.DocumentRevisions).Error; err != nil {
+		return fmt.Errorf("failed to collect document revisions: %w", err)
+	}
+
+	// Collect buckets
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.Buckets).Error; err != nil {
+		return fmt.Errorf("failed to collect buckets: %w", err)
+	}
+
 	// Collect files
-	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.Files).Error; err != nil {
+	files := s.db.Where("project_id = ?", projectID)
+	if since != nil {
+		files = files.Where("updated_at >= ?", *since)
+		backupData.FileIDs = []string{}
+		if err := s.db.Model(&models.File{}).Where("project_id = ?", projectID).Pluck("id", &backupData.FileIDs).Error; err != nil {
+			return fmt.Errorf("failed to collect file ids: %w", err)
+		}
+	}
+	if err := files.Find(&backupData.Files).Error; err != nil {
 		return fmt.Errorf("failed to collect files: %w", err)
 	}
 
@@ -183,151 +497,320 @@ func (s *BackupService) collectProjectData(projectID uint, backupData *BackupDat
 		return fmt.Errorf("failed to collect function domains: %w", err)
 	}
 
+	// Collect app users, their sessions and social logins
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.AppUsers).Error; err != nil {
+		return fmt.Errorf("failed to collect app users: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.AppSessions).Error; err != nil {
+		return fmt.Errorf("failed to collect app sessions: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.AppUserIdentities).Error; err != nil {
+		return fmt.Errorf("failed to collect app user identities: %w", err)
+	}
+
+	// Collect auth and mail settings
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.AuthSettings).Error; err != nil {
+		return fmt.Errorf("failed to collect auth settings: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.AuthProviders).Error; err != nil {
+		return fmt.Errorf("failed to collect auth providers: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.MailSettings).Error; err != nil {
+		return fmt.Errorf("failed to collect mail settings: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.EmailTemplates).Error; err != nil {
+		return fmt.Errorf("failed to collect email templates: %w", err)
+	}
+
+	// Collect channels and messages
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.Channels).Error; err != nil {
+		return fmt.Errorf("failed to collect channels: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.ChannelMembers).Error; err != nil {
+		return fmt.Errorf("failed to collect channel members: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.Messages).Error; err != nil {
+		return fmt.Errorf("failed to collect messages: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.MessageReactions).Error; err != nil {
+		return fmt.Errorf("failed to collect message reactions: %w", err)
+	}
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.MessageReads).Error; err != nil {
+		return fmt.Errorf("failed to collect message reads: %w", err)
+	}
+
+	// Collect plugin installations
+	if err := s.db.Where("project_id = ?", projectID).Find(&backupData.PluginInstallations).Error; err != nil {
+		return fmt.Errorf("failed to collect plugin installations: %w", err)
+	}
+
 	// Collect audit logs (recent ones only to avoid huge backups)
-	since := time.Now().AddDate(0, -3, 0) // Last 3 months
-	if err := s.db.Where("project_id = ? AND created_at > ?", projectID, since).Find(&backupData.AuditLogs).Error; err != nil {
+	auditSince := time.Now().AddDate(0, -3, 0) // Last 3 months
+	if err := s.db.Where("project_id = ? AND created_at > ?", projectID, auditSince).Find(&backupData.AuditLogs).Error; err != nil {
 		return fmt.Errorf("failed to collect audit logs: %w", err)
 	}
 
 	return nil
 }
 
-// createBackupArchive creates a compressed tar archive of the backup data
-func (s *BackupService) createBackupArchive(backupData BackupData, filePath string) (int64, string, error) {
-	// Create file
-	file, err := os.Create(filePath)
-	if err != nil {
-		return 0, "", fmt.Errorf("failed to create backup file: %w", err)
+// collectProjectObjects returns the stored objects to archive: the content of the collected files,
+// and the markers of every folder
+func (s *BackupService) collectProjectObjects(ctx context.Context, projectID uint, backupData *BackupData) ([]backupObject, error) {
+	var objects []backupObject
+	for _, file := range backupData.Files {
+		backend, err := s.backends.Get(file.StorageBackend)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, backupObject{path: backupBlobPrefix + file.ID, backend: backend, key: file.FilePath})
 	}
-	defer file.Close()
 
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
-
-	// Create tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	for _, bucket := range backupData.Buckets {
+		backend, err := s.backends.Get(bucket.StorageBackend)
+		if err != nil {
+			return nil, err
+		}
+		prefix := BucketPrefix(projectID, bucket.Name)
+		stored, err := backend.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %w", bucket.Name, err)
+		}
+		for _, object := range stored {
+			if path.Base(object.Key) == FolderMarker {
+				objects = append(objects, backupObject{path: backupFolderPrefix + bucket.Name + "/" + strings.TrimPrefix(object.Key, prefix)})
+			}
+		}
+	}
+	return objects, nil
+}
 
-	// Convert backup data to JSON
-	jsonData, err := json.MarshalIndent(backupData, "", "  ")
-	if err != nil {
-		return 0, "", fmt.Errorf("failed to marshal backup data: %w", err)
+// backupArchiveName returns the file name of the archive of a backup
+func backupArchiveName(backup models.Backup) string {
+	name := fmt.Sprintf("backup-%d-%d.tar.gz", backup.ProjectID, backup.ID)
+	if backup.Encrypted {
+		name += ".enc"
 	}
+	return name
+}
+
+// backupEncryptionContext binds the encrypted archive of a backup to it, so archives cannot be
+// swapped between backups
+func backupEncryptionContext(backup models.Backup) string {
+	return fmt.Sprintf("cloudbox-backup:%d:%d", backup.ProjectID, backup.ID)
+}
 
-	// Add backup data to archive
-	header := &tar.Header{
-		Name: "backup.json",
-		Mode: 0644,
-		Size: int64(len(jsonData)),
+// createBackupArchive creates a compressed tar archive of the backup data and objects, encrypted
+// with the master key in the given context unless it is empty
+func (s *BackupService) createBackupArchive(ctx context.Context, backupData *BackupData, objects []backupObject, filePath string, encryption string) (int64, string, error) {
+	// Create file; it gets its name once complete
+	partial := filePath + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create backup file: %w", err)
 	}
+	defer os.Remove(partial)
+	defer file.Close()
 
-	if err := tarWriter.WriteHeader(header); err != nil {
-		return 0, "", fmt.Errorf("failed to write tar header: %w", err)
+	// Hash the archive as it is written
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(file, hash)}
+	var sealed io.Writer = counter
+	var encrypter io.WriteCloser
+	if encryption != "" {
+		if encrypter, err = utils.NewEncryptingWriter(counter, s.cfg.MasterKey, encryption); err != nil {
+			return 0, "", fmt.Errorf("failed to encrypt archive: %w", err)
+		}
+		sealed = encrypter
 	}
+	gzipWriter := gzip.NewWriter(sealed)
+	tarWriter := tar.NewWriter(gzipWriter)
 
-	if _, err := tarWriter.Write(jsonData); err != nil {
-		return 0, "", fmt.Errorf("failed to write backup data: %w", err)
+	if _, err := writeBackupArchive(ctx, tarWriter, backupData, objects); err != nil {
+		return 0, "", err
 	}
 
 	// Close writers to ensure all data is written
-	tarWriter.Close()
-	gzipWriter.Close()
-
-	// Get file info
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return 0, "", fmt.Errorf("failed to get file info: %w", err)
+	if err := tarWriter.Close(); err != nil {
+		return 0, "", fmt.Errorf("failed to finish archive: %w", err)
 	}
-
-	// Calculate checksum
-	file.Seek(0, 0)
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return 0, "", fmt.Errorf("failed to calculate checksum: %w", err)
+	if err := gzipWriter.Close(); err != nil {
+		return 0, "", fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return 0, "", fmt.Errorf("failed to encrypt archive: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return 0, "", fmt.Errorf("failed to write backup file: %w", err)
+	}
+	if err := os.Rename(partial, filePath); err != nil {
+		return 0, "", fmt.Errorf("failed to write backup file: %w", err)
 	}
 
-	checksum := hex.EncodeToString(hash.Sum(nil))
-	return fileInfo.Size(), checksum, nil
+	return counter.n, hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// RestoreBackup restores a project from a backup
-func (s *BackupService) RestoreBackup(backupID uint, targetProjectID uint) error {
-	// Get backup record
-	var backup models.Backup
-	if err := s.db.First(&backup, backupID).Error; err != nil {
-		return fmt.Errorf("backup not found: %w", err)
-	}
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	if backup.Status != "completed" {
-		return fmt.Errorf("backup is not completed, cannot restore")
-	}
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
 
-	// Extract and parse backup data
-	backupData, err := s.extractBackupData(backup.FilePath)
-	if err != nil {
-		return fmt.Errorf("failed to extract backup data: %w", err)
+// storedObjectID identifies the object of a file across backends
+func storedObjectID(file models.File) string {
+	if file.StorageBackend == "" {
+		return StorageBackendLocal + "/" + file.FilePath
 	}
+	return file.StorageBackend + "/" + file.FilePath
+}
 
-	// Begin transaction for atomic restore
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		// Clear existing project data (if replacing)
-		if err := s.clearProjectData(tx, targetProjectID); err != nil {
-			return fmt.Errorf("failed to clear existing data: %w", err)
+// backupChain returns the backups to restore for a backup, from the full backup it builds on to
+// the backup itself
+func (s *BackupService) backupChain(backup models.Backup) ([]models.Backup, error) {
+	chain := []models.Backup{backup}
+	for chain[0].ParentID != nil {
+		if len(chain) > maxBackupChain {
+			return nil, fmt.Errorf("backup %d builds on more than %d backups", backup.ID, maxBackupChain)
 		}
-
-		// Restore data
-		if err := s.restoreProjectData(tx, targetProjectID, backupData); err != nil {
-			return fmt.Errorf("failed to restore data: %w", err)
+		var parent models.Backup
+		if err := s.db.First(&parent, *chain[0].ParentID).Error; err != nil {
+			return nil, fmt.Errorf("parent backup %d of backup %d not found: %w", *chain[0].ParentID, chain[0].ID, err)
 		}
-
-		return nil
-	})
+		if parent.Status != "completed" {
+			return nil, fmt.Errorf("parent backup %d is not completed, cannot restore", parent.ID)
+		}
+		chain = append([]models.Backup{parent}, chain...)
+	}
+	return chain, nil
 }
 
-// extractBackupData extracts and parses backup data from archive
-func (s *BackupService) extractBackupData(filePath string) (*BackupData, error) {
-	file, err := os.Open(filePath)
+// verifyBackupFile checks the archive of a backup against the checksum recorded when it was made
+func verifyBackupFile(backup models.Backup) error {
+	if backup.Checksum == "" {
+		return nil
+	}
+	file, err := os.Open(backup.FilePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open backup file: %w", err)
+		return fmt.Errorf("failed to open backup file: %w", err)
 	}
 	defer file.Close()
 
-	gzipReader, err := gzip.NewReader(file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return fmt.Errorf("failed to calculate checksum: %w", err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != backup.Checksum {
+		return fmt.Errorf("%w: checksum of backup %d does not match", ErrBackupCorrupt, backup.ID)
+	}
+	return nil
+}
+
+// restoreObjects stores the files and folder markers of the archives of a backup chain in the
+// target project, pointing the files of the backup data at their new keys
+func (s *BackupService) restoreObjects(ctx context.Context, archives []string, backupData *BackupData, sources map[string]int, projectID uint) error {
+	// Objects go to the backend of their bucket, or the default one if it is not configured here
+	bucketBackends := map[string]string{}
+	for i, bucket := range backupData.Buckets {
+		if _, err := s.backends.Get(bucket.StorageBackend); err != nil {
+			backupData.Buckets[i].StorageBackend = s.backends.Default()
+		}
+		bucketBackends[bucket.Name] = backupData.Buckets[i].StorageBackend
 	}
-	defer gzipReader.Close()
 
-	tarReader := tar.NewReader(gzipReader)
+	files := make(map[string]*models.File, len(backupData.Files))
+	for i := range backupData.Files {
+		file := &backupData.Files[i]
+		if name, ok := bucketBackends[file.BucketName]; ok {
+			file.StorageBackend = name
+		} else if _, err := s.backends.Get(file.StorageBackend); err != nil {
+			file.StorageBackend = s.backends.Default()
+		}
+		file.FilePath = ObjectKey(projectID, file.BucketName, file.FolderPath, file.FileName)
+		files[file.ID] = file
+	}
 
-	// Find backup.json file
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
+	for i, archive := range archives {
+		last := i == len(archives)-1
+		needed := last
+		for id, source := range sources {
+			if source == i && files[id] != nil {
+				needed = true
+				break
+			}
 		}
-		if err != nil {
-			return nil, fmt.Errorf("error reading tar: %w", err)
+		if !needed {
+			continue
 		}
 
-		if header.Name == "backup.json" {
-			var backupData BackupData
-			if err := json.NewDecoder(tarReader).Decode(&backupData); err != nil {
-				return nil, fmt.Errorf("failed to decode backup data: %w", err)
+		_, _, err := s.extractBackupData(archive, func(name string, body io.Reader, size int64) error {
+			if id := strings.TrimPrefix(name, backupBlobPrefix); id != name {
+				file := files[id]
+				if file == nil || sources[id] != i {
+					return nil
+				}
+				backend, err := s.backends.Get(file.StorageBackend)
+				if err != nil {
+					return err
+				}
+				return backend.Put(ctx, file.FilePath, body, size, file.MimeType)
 			}
-			return &backupData, nil
+
+			// Folders are complete in every backup
+			bucket, marker, _ := strings.Cut(strings.TrimPrefix(name, backupFolderPrefix), "/")
+			backendName, ok := bucketBackends[bucket]
+			if !last || !ok {
+				return nil
+			}
+			backend, err := s.backends.Get(backendName)
+			if err != nil {
+				return err
+			}
+			return backend.Put(ctx, BucketPrefix(projectID, bucket)+marker, body, size, "")
+		})
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return nil, fmt.Errorf("backup.json not found in archive")
+// extractBackupData extracts and parses backup data from archive, passing stored objects to object
+func (s *BackupService) extractBackupData(filePath string, object func(name string, body io.Reader, size int64) error) (*BackupData, *BackupManifest, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer file.Close()
+
+	return readBackupArchive(file, object)
 }
 
-// clearProjectData removes existing project data (for full restore)
+// clearProjectData removes existing project data (for full restore); soft deleted rows go too, as
+// restored rows keep their IDs
 func (s *BackupService) clearProjectData(tx *gorm.DB, projectID uint) error {
 	// Clear in reverse dependency order
 	models := []interface{}{
 		&models.AuditLog{},
+		&models.PluginInstallation{},
+		&models.MessageRead{},
+		&models.MessageReaction{},
+		&models.Message{},
+		&models.ChannelMember{},
+		&models.Channel{},
+		&models.EmailTemplate{},
+		&models.ProjectMailSettings{},
+		&models.AuthProvider{},
+		&models.ProjectAuthSettings{},
+		&models.AppUserIdentity{},
+		&models.AppSession{},
+		&models.AppUser{},
 		&models.FunctionDomain{},
 		&models.CORSConfig{},
 		&models.APIKey{},
@@ -337,12 +820,14 @@ func (s *BackupService) clearProjectData(tx *gorm.DB, projectID uint) error {
 		&models.Deployment{},
 		&models.Function{},
 		&models.File{},
+		&models.Bucket{},
+		&models.DocumentRevision{},
 		&models.Document{},
 		&models.Collection{},
 	}
 
 	for _, model := range models {
-		if err := tx.Where("project_id = ?", projectID).Delete(model).Error; err != nil {
+		if err := tx.Unscoped().Where("project_id = ?", projectID).Delete(model).Error; err != nil {
 			return fmt.Errorf("failed to clear %T: %w", model, err)
 		}
 	}
@@ -350,144 +835,151 @@ func (s *BackupService) clearProjectData(tx *gorm.DB, projectID uint) error {
 	return nil
 }
 
-// restoreProjectData restores data to target project
-func (s *BackupService) restoreProjectData(tx *gorm.DB, projectID uint, backupData *BackupData) error {
-	// Update project IDs in backup data
-	s.updateProjectIDs(backupData, projectID)
-
-	// Restore in dependency order
-	if len(backupData.Collections) > 0 {
-		if err := tx.Create(&backupData.Collections).Error; err != nil {
-			return fmt.Errorf("failed to restore collections: %w", err)
-		}
-	}
-
-	if len(backupData.Documents) > 0 {
-		if err := tx.Create(&backupData.Documents).Error; err != nil {
-			return fmt.Errorf("failed to restore documents: %w", err)
+// restoreProjectData restores data to target project, in the order of BackupData.tables;
+// function domains are pointed at the new IDs of the functions named by domainFunctions
+func (s *BackupService) restoreProjectData(tx *gorm.DB, projectID uint, backupData *BackupData, domainFunctions []string) error {
+	for _, table := range backupData.tables() {
+		if table.name == "document_ids" || table.name == "file_ids" {
+			continue
 		}
-	}
-
-	if len(backupData.Files) > 0 {
-		if err := tx.Create(&backupData.Files).Error; err != nil {
-			return fmt.Errorf("failed to restore files: %w", err)
+		if table.name == "function_domains" {
+			relinkFunctionDomains(backupData, domainFunctions)
 		}
-	}
-
-	if len(backupData.Functions) > 0 {
-		if err := tx.Create(&backupData.Functions).Error; err != nil {
-			return fmt.Errorf("failed to restore functions: %w", err)
-		}
-	}
-
-	if len(backupData.Deployments) > 0 {
-		if err := tx.Create(&backupData.Deployments).Error; err != nil {
-			return fmt.Errorf("failed to restore deployments: %w", err)
-		}
-	}
-
-	if len(backupData.GitHubRepos) > 0 {
-		if err := tx.Create(&backupData.GitHubRepos).Error; err != nil {
-			return fmt.Errorf("failed to restore github repos: %w", err)
-		}
-	}
-
-	if len(backupData.WebServers) > 0 {
-		if err := tx.Create(&backupData.WebServers).Error; err != nil {
-			return fmt.Errorf("failed to restore web servers: %w", err)
-		}
-	}
-
-	if len(backupData.SSHKeys) > 0 {
-		if err := tx.Create(&backupData.SSHKeys).Error; err != nil {
-			return fmt.Errorf("failed to restore ssh keys: %w", err)
-		}
-	}
-
-	if len(backupData.APIKeys) > 0 {
-		if err := tx.Create(&backupData.APIKeys).Error; err != nil {
-			return fmt.Errorf("failed to restore api keys: %w", err)
-		}
-	}
-
-	if len(backupData.CORSConfigs) > 0 {
-		if err := tx.Create(&backupData.CORSConfigs).Error; err != nil {
-			return fmt.Errorf("failed to restore cors configs: %w", err)
-		}
-	}
-
-	if len(backupData.FunctionDomains) > 0 {
-		if err := tx.Create(&backupData.FunctionDomains).Error; err != nil {
-			return fmt.Errorf("failed to restore function domains: %w", err)
-		}
-	}
-
-	if len(backupData.AuditLogs) > 0 {
-		if err := tx.Create(&backupData.AuditLogs).Error; err != nil {
-			return fmt.Errorf("failed to restore audit logs: %w", err)
+		if err := tx.CreateInBatches(table.rows, 500).Error; err != nil {
+			return fmt.Errorf("failed to restore %s: %w", strings.ReplaceAll(table.name, "_", " "), err)
 		}
 	}
 
 	return nil
 }
 
-// updateProjectIDs updates all project IDs in backup data
+// updateProjectIDs updates all project IDs in backup data. Rows with numeric IDs get new ones;
+// documents, files, app users, sessions, channels and messages keep theirs, as other rows refer to them
 func (s *BackupService) updateProjectIDs(backupData *BackupData, newProjectID uint) {
 	for i := range backupData.Collections {
 		backupData.Collections[i].ProjectID = newProjectID
 		backupData.Collections[i].ID = 0 // Reset ID for new creation
 	}
-	
+
 	for i := range backupData.Documents {
 		backupData.Documents[i].ProjectID = newProjectID
-		backupData.Documents[i].ID = ""
 	}
-	
+
+	for i := range backupData.DocumentRevisions {
+		backupData.DocumentRevisions[i].ProjectID = newProjectID
+		backupData.DocumentRevisions[i].ID = 0
+	}
+
+	for i := range backupData.Buckets {
+		backupData.Buckets[i].ProjectID = newProjectID
+		backupData.Buckets[i].ID = 0
+	}
+
 	for i := range backupData.Files {
 		backupData.Files[i].ProjectID = newProjectID
-		backupData.Files[i].ID = ""
 	}
-	
+
 	for i := range backupData.Functions {
 		backupData.Functions[i].ProjectID = newProjectID
 		backupData.Functions[i].ID = 0
 	}
-	
+
 	for i := range backupData.Deployments {
 		backupData.Deployments[i].ProjectID = newProjectID
 		backupData.Deployments[i].ID = 0
 	}
-	
+
 	for i := range backupData.GitHubRepos {
 		backupData.GitHubRepos[i].ProjectID = newProjectID
 		backupData.GitHubRepos[i].ID = 0
 	}
-	
+
 	for i := range backupData.WebServers {
 		backupData.WebServers[i].ProjectID = newProjectID
 		backupData.WebServers[i].ID = 0
 	}
-	
+
 	for i := range backupData.SSHKeys {
 		backupData.SSHKeys[i].ProjectID = newProjectID
 		backupData.SSHKeys[i].ID = 0
 	}
-	
+
 	for i := range backupData.APIKeys {
 		backupData.APIKeys[i].ProjectID = newProjectID
 		backupData.APIKeys[i].ID = 0
 	}
-	
+
 	for i := range backupData.CORSConfigs {
 		backupData.CORSConfigs[i].ProjectID = newProjectID
 		backupData.CORSConfigs[i].ID = 0
 	}
-	
+
 	for i := range backupData.FunctionDomains {
 		backupData.FunctionDomains[i].ProjectID = newProjectID
 		backupData.FunctionDomains[i].ID = 0
 	}
-	
+
+	for i := range backupData.AppUsers {
+		backupData.AppUsers[i].ProjectID = newProjectID
+	}
+
+	for i := range backupData.AppSessions {
+		backupData.AppSessions[i].ProjectID = newProjectID
+	}
+
+	for i := range backupData.AppUserIdentities {
+		backupData.AppUserIdentities[i].ProjectID = newProjectID
+		backupData.AppUserIdentities[i].ID = 0
+	}
+
+	for i := range backupData.AuthSettings {
+		backupData.AuthSettings[i].ProjectID = newProjectID
+		backupData.AuthSettings[i].ID = 0
+	}
+
+	for i := range backupData.AuthProviders {
+		backupData.AuthProviders[i].ProjectID = newProjectID
+		backupData.AuthProviders[i].ID = 0
+	}
+
+	for i := range backupData.MailSettings {
+		backupData.MailSettings[i].ProjectID = newProjectID
+		backupData.MailSettings[i].ID = 0
+	}
+
+	for i := range backupData.EmailTemplates {
+		backupData.EmailTemplates[i].ProjectID = newProjectID
+		backupData.EmailTemplates[i].ID = 0
+	}
+
+	for i := range backupData.Channels {
+		backupData.Channels[i].ProjectID = newProjectID
+	}
+
+	for i := range backupData.ChannelMembers {
+		backupData.ChannelMembers[i].ProjectID = newProjectID
+		backupData.ChannelMembers[i].ID = 0
+	}
+
+	for i := range backupData.Messages {
+		backupData.Messages[i].ProjectID = newProjectID
+	}
+
+	for i := range backupData.MessageReactions {
+		backupData.MessageReactions[i].ProjectID = newProjectID
+		backupData.MessageReactions[i].ID = 0
+	}
+
+	for i := range backupData.MessageReads {
+		backupData.MessageReads[i].ProjectID = newProjectID
+		backupData.MessageReads[i].ID = 0
+	}
+
+	for i := range backupData.PluginInstallations {
+		backupData.PluginInstallations[i].ProjectID = newProjectID
+		backupData.PluginInstallations[i].ID = 0
+	}
+
 	for i := range backupData.AuditLogs {
 		backupData.AuditLogs[i].ProjectID = &newProjectID
 		backupData.AuditLogs[i].ID = 0
@@ -497,7 +989,8 @@ func (s *BackupService) updateProjectIDs(backupData *BackupData, newProjectID ui
 // updateBackupStatus updates backup status with error message
 func (s *BackupService) updateBackupStatus(backupID uint, status string, message string) {
 	s.db.Model(&models.Backup{}).Where("id = ?", backupID).Updates(map[string]interface{}{
-		"status": status,
+		"status":        status,
+		"error_message": message,
 	})
 }
 
@@ -508,31 +1001,77 @@ func (s *BackupService) ListBackups(projectID uint) ([]models.Backup, error) {
 	return backups, err
 }
 
-// GetBackup returns a specific backup
-func (s *BackupService) GetBackup(backupID uint) (*models.Backup, error) {
+// projectBackup returns a backup of a project
+func (s *BackupService) projectBackup(db *gorm.DB, projectID, backupID uint) (*models.Backup, error) {
 	var backup models.Backup
-	err := s.db.Preload("Project").First(&backup, backupID).Error
-	if err != nil {
+	if err := db.Where("id = ? AND project_id = ?", backupID, projectID).First(&backup).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrBackupNotFound
+		}
 		return nil, err
 	}
 	return &backup, nil
 }
 
-// DeleteBackup deletes a backup and its file
-func (s *BackupService) DeleteBackup(backupID uint) error {
-	var backup models.Backup
-	if err := s.db.First(&backup, backupID).Error; err != nil {
-		return fmt.Errorf("backup not found: %w", err)
+// GetBackup returns a backup of a project
+func (s *BackupService) GetBackup(projectID, backupID uint) (*models.Backup, error) {
+	return s.projectBackup(s.db.Preload("Project"), projectID, backupID)
+}
+
+// GetManifest reads the manifest of a backup, checking the archive against it; archives before
+// format 2.0 have none
+func (s *BackupService) GetManifest(projectID, backupID uint) (*BackupManifest, error) {
+	backup, err := s.projectBackup(s.db, projectID, backupID)
+	if err != nil {
+		return nil, err
+	}
+	if backup.Status != "completed" {
+		return nil, fmt.Errorf("backup is not completed")
+	}
+
+	archive, done, err := s.openArchive(context.Background(), *backup)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	_, manifest, err := s.extractBackupData(archive, nil)
+	return manifest, err
+}
+
+// DeleteBackup deletes a backup of a project and its file
+func (s *BackupService) DeleteBackup(projectID, backupID uint) error {
+	backup, err := s.projectBackup(s.db, projectID, backupID)
+	if err != nil {
+		return err
+	}
+
+	// Incremental backups cannot be restored without it
+	var children int64
+	if err := s.db.Model(&models.Backup{}).Where("parent_id = ?", backup.ID).Count(&children).Error; err != nil {
+		return err
+	}
+	if children > 0 {
+		return ErrBackupInUse
 	}
 
 	// Delete backup file if it exists
-	if backup.FilePath != "" {
+	if backup.FilePath != "" && backup.DestinationID != nil {
+		if err := s.deleteStoredArchive(context.Background(), *backup); err != nil {
+			log.Printf("Warning: failed to delete backup archive %s: %v", backup.FilePath, err)
+		}
+	} else if backup.FilePath != "" {
 		if err := os.Remove(backup.FilePath); err != nil && !os.IsNotExist(err) {
 			// Log error but don't fail the operation
 			fmt.Printf("Warning: failed to delete backup file %s: %v\n", backup.FilePath, err)
 		}
 	}
 
+	// A backup still being created stops
+	if _, err := s.jobs.CancelJobs(backup.ProjectID, backupLockKey(backup.ID)); err != nil {
+		log.Printf("Warning: failed to cancel creating backup %d: %v", backup.ID, err)
+	}
+
 	// Delete backup record
-	return s.db.Delete(&backup).Error
-}
\ No newline at end of file
+	return s.db.Delete(backup).Error
+}
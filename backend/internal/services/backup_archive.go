@@ -0,0 +1,428 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+// BackupFormatVersion is the version of the archives CreateBackup writes. Version 1.0 archives
+// hold the rows of the project in a single backup.json and no files; from 2.0 on every table and
+// stored object is an entry of its own, listed with its checksum in a manifest
+const BackupFormatVersion = "2.0"
+
+// Names of the entries of a backup archive
+const (
+	backupManifestName = "manifest.json"
+	backupLegacyName   = "backup.json"
+	backupTablePrefix  = "tables/"
+	backupBlobPrefix   = "blobs/"   // Followed by the ID of the file
+	backupFolderPrefix = "folders/" // Followed by the bucket and the key of a folder marker within it
+)
+
+var (
+	// ErrBackupCorrupt is returned for archives whose entries do not match their manifest
+	ErrBackupCorrupt = errors.New("backup archive is corrupt")
+	// ErrBackupFormatUnsupported is returned for archives written by a newer CloudBox
+	ErrBackupFormatUnsupported = errors.New("backup format is not supported by this version")
+)
+
+// BackupManifest lists the entries of a backup archive; it is the last entry of the archive
+type BackupManifest struct {
+	Metadata BackupMetadata        `json:"metadata"`
+	Entries  []BackupManifestEntry `json:"entries"`
+}
+
+// BackupManifestEntry describes an entry of a backup archive
+type BackupManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Rows   int    `json:"rows,omitempty"` // Rows of a table
+}
+
+// backupTable is a table of BackupData; rows points to the slice holding its rows. key names the
+// columns identifying a row within a project when restoring into one that has data: none for
+// tables with a row per project, and nil for the ID lists and the append-only audit log
+type backupTable struct {
+	name string
+	rows interface{}
+	key  []string
+}
+
+// tables returns the tables of the backup in the order they are restored in
+func (d *BackupData) tables() []backupTable {
+	return []backupTable{
+		{"collections", &d.Collections, []string{"name"}},
+		{"documents", &d.Documents, []string{"id"}},
+		{"document_ids", &d.DocumentIDs, nil},
+		{"document_revisions", &d.DocumentRevisions, []string{"document_id", "version"}},
+		{"buckets", &d.Buckets, []string{"name"}},
+		{"files", &d.Files, []string{"id"}},
+		{"file_ids", &d.FileIDs, nil},
+		{"functions", &d.Functions, []string{"name"}},
+		{"deployments", &d.Deployments, []string{"name"}},
+		{"github_repositories", &d.GitHubRepos, []string{"full_name"}},
+		{"web_servers", &d.WebServers, []string{"name"}},
+		{"ssh_keys", &d.SSHKeys, []string{"name"}},
+		{"api_keys", &d.APIKeys, []string{"key_hash"}},
+		{"cors_configs", &d.CORSConfigs, []string{}},
+		{"function_domains", &d.FunctionDomains, []string{"domain"}},
+		{"app_users", &d.AppUsers, []string{"id"}},
+		{"app_sessions", &d.AppSessions, []string{"id"}},
+		{"app_user_identities", &d.AppUserIdentities, []string{"provider_id", "subject"}},
+		{"auth_settings", &d.AuthSettings, []string{}},
+		{"auth_providers", &d.AuthProviders, []string{"provider_id"}},
+		{"mail_settings", &d.MailSettings, []string{}},
+		{"email_templates", &d.EmailTemplates, []string{"name"}},
+		{"channels", &d.Channels, []string{"id"}},
+		{"channel_members", &d.ChannelMembers, []string{"channel_id", "user_id"}},
+		{"messages", &d.Messages, []string{"id"}},
+		{"message_reactions", &d.MessageReactions, []string{"message_id", "user_id", "emoji"}},
+		{"message_reads", &d.MessageReads, []string{"message_id", "user_id"}},
+		{"plugin_installations", &d.PluginInstallations, []string{"plugin_name"}},
+		{"audit_logs", &d.AuditLogs, nil},
+	}
+}
+
+// backupObject is a stored object to archive under path
+type backupObject struct {
+	path    string
+	backend StorageBackend
+	key     string
+}
+
+// writeBackupArchive writes the tables of data, the objects and the manifest to an archive. Tables
+// that were not collected, like the ID lists of full backups, are left out; objects that are gone
+// by the time they are read are skipped
+func writeBackupArchive(ctx context.Context, tw *tar.Writer, data *BackupData, objects []backupObject) (*BackupManifest, error) {
+	manifest := &BackupManifest{Metadata: data.Metadata, Entries: []BackupManifestEntry{}}
+
+	for _, table := range data.tables() {
+		rows := reflect.ValueOf(table.rows).Elem()
+		if rows.IsNil() {
+			continue
+		}
+		encoded, err := json.Marshal(table.rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", table.name, err)
+		}
+		entry, err := writeBackupEntry(tw, backupTablePrefix+table.name+".json", bytes.NewReader(encoded), int64(len(encoded)))
+		if err != nil {
+			return nil, err
+		}
+		entry.Rows = rows.Len()
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	for _, object := range objects {
+		if object.backend == nil {
+			// Folder markers have no content
+			entry, err := writeBackupEntry(tw, object.path, strings.NewReader(""), 0)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			continue
+		}
+
+		body, info, err := object.backend.Get(ctx, object.key)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", object.key, err)
+		}
+		entry, err := writeBackupEntry(tw, object.path, body, info.Size)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if _, err := writeBackupEntry(tw, backupManifestName, bytes.NewReader(encoded), int64(len(encoded))); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// writeBackupEntry streams size bytes of body into an archive entry
+func writeBackupEntry(tw *tar.Writer, name string, body io.Reader, size int64) (BackupManifestEntry, error) {
+	header := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: size,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return BackupManifestEntry{}, fmt.Errorf("failed to write tar header: %w", err)
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), body, size); err != nil {
+		return BackupManifestEntry{}, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return BackupManifestEntry{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// readBackupArchive reads the tables of an archive and checks every entry against the manifest.
+// Object entries are passed to object, when set, as they are read; their checksums are only known
+// to match once readBackupArchive returns. Version 1.0 archives have no manifest
+func readBackupArchive(r io.Reader, object func(name string, body io.Reader, size int64) error) (*BackupData, *BackupManifest, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	data := &BackupData{}
+	tables := map[string]interface{}{}
+	for _, table := range data.tables() {
+		tables[backupTablePrefix+table.name+".json"] = table.rows
+	}
+
+	read := map[string]BackupManifestEntry{}
+	var manifest *BackupManifest
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading tar: %w", err)
+		}
+
+		if header.Name == backupLegacyName {
+			if err := json.NewDecoder(tarReader).Decode(data); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode backup data: %w", err)
+			}
+			if err := migrateBackupData(data); err != nil {
+				return nil, nil, err
+			}
+			return data, nil, nil
+		}
+		if manifest != nil {
+			return nil, nil, fmt.Errorf("%w: %s follows the manifest", ErrBackupCorrupt, header.Name)
+		}
+		if header.Name == backupManifestName {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(tarReader).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode manifest: %w", err)
+			}
+			continue
+		}
+
+		hash := sha256.New()
+		body := io.TeeReader(tarReader, hash)
+		if rows, ok := tables[header.Name]; ok {
+			if err := json.NewDecoder(body).Decode(rows); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode %s: %w", header.Name, err)
+			}
+		} else if object != nil && (strings.HasPrefix(header.Name, backupBlobPrefix) || strings.HasPrefix(header.Name, backupFolderPrefix)) {
+			if err := object(header.Name, body, header.Size); err != nil {
+				return nil, nil, err
+			}
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %w", header.Name, err)
+		}
+		read[header.Name] = BackupManifestEntry{Path: header.Name, Size: header.Size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%w: no manifest", ErrBackupCorrupt)
+	}
+	if len(manifest.Entries) != len(read) {
+		return nil, nil, fmt.Errorf("%w: %d entries, the manifest lists %d", ErrBackupCorrupt, len(read), len(manifest.Entries))
+	}
+	for _, want := range manifest.Entries {
+		got, ok := read[want.Path]
+		if !ok || got.Size != want.Size || got.SHA256 != want.SHA256 {
+			return nil, nil, fmt.Errorf("%w: %s does not match the manifest", ErrBackupCorrupt, want.Path)
+		}
+	}
+	data.Metadata = manifest.Metadata
+	data.BackupVersion = manifest.Metadata.FormatVersion
+	if err := migrateBackupData(data); err != nil {
+		return nil, nil, err
+	}
+	return data, manifest, nil
+}
+
+// backupMigrations upgrade the data of archives of a format to the format that followed it
+var backupMigrations = map[string]func(data *BackupData) string{
+	"1.0": migrateBackupData1,
+}
+
+// compareBackupFormats compares two format versions, returning whether the major versions
+// differ as well
+func compareBackupFormats(a, b string) (cmp int, major bool) {
+	parse := func(version string) [2]int {
+		var parts [2]int
+		for i, part := range strings.SplitN(version, ".", 2) {
+			parts[i], _ = strconv.Atoi(part)
+		}
+		return parts
+	}
+	x, y := parse(a), parse(b)
+	for i := range x {
+		if x[i] != y[i] {
+			if x[i] < y[i] {
+				return -1, i == 0
+			}
+			return 1, i == 0
+		}
+	}
+	return 0, false
+}
+
+// checkBackupFormat checks archives of a format can be read: any older format, and newer minor
+// versions of the current one, whose additions are left out
+func checkBackupFormat(version string) error {
+	if cmp, major := compareBackupFormats(version, BackupFormatVersion); cmp > 0 && major {
+		return fmt.Errorf("%w: archive format %s, this version reads up to %s", ErrBackupFormatUnsupported, version, BackupFormatVersion)
+	}
+	return nil
+}
+
+// migrateBackupData upgrades the data of an archive of an older format to the current one
+func migrateBackupData(data *BackupData) error {
+	version := data.BackupVersion
+	if version == "" {
+		version = "1.0"
+	}
+	if err := checkBackupFormat(version); err != nil {
+		return err
+	}
+	for {
+		if cmp, _ := compareBackupFormats(version, BackupFormatVersion); cmp >= 0 {
+			break
+		}
+		migrate, ok := backupMigrations[version]
+		if !ok {
+			return fmt.Errorf("%w: no migration from format %s", ErrBackupFormatUnsupported, version)
+		}
+		version = migrate(data)
+	}
+	data.BackupVersion = version
+	data.Metadata.FormatVersion = version
+	return nil
+}
+
+// migrateBackupData1 upgrades 1.0 data: those archives had no buckets, no storage backends and no
+// API key hashes, so buckets are recreated for the files, and keys that cannot work are dropped
+func migrateBackupData1(data *BackupData) string {
+	buckets := map[string]bool{}
+	for _, bucket := range data.Buckets {
+		buckets[bucket.Name] = true
+	}
+	for i := range data.Files {
+		file := &data.Files[i]
+		if file.StorageBackend == "" {
+			file.StorageBackend = StorageBackendLocal
+		}
+		if !buckets[file.BucketName] {
+			buckets[file.BucketName] = true
+			data.Buckets = append(data.Buckets, models.Bucket{
+				Name:           file.BucketName,
+				ProjectID:      file.ProjectID,
+				MaxFileSize:    52428800,
+				StorageBackend: StorageBackendLocal,
+			})
+		}
+	}
+
+	for i := range data.Documents {
+		if data.Documents[i].Version == 0 {
+			data.Documents[i].Version = 1
+		}
+	}
+
+	apiKeys := data.APIKeys[:0]
+	for _, key := range data.APIKeys {
+		if key.KeyHash != "" {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	data.APIKeys = apiKeys
+
+	if data.Metadata.Mode == "" {
+		data.Metadata.Mode = BackupModeFull
+	}
+	return "2.0"
+}
+
+// mergeIncrementalBackup applies an incremental backup to the data of the backups it builds on:
+// its documents and files replace those with the same ID, those missing from its ID lists were
+// deleted, and every other table is complete in it
+func mergeIncrementalBackup(base, next *BackupData) {
+	documents := make(map[string]int, len(base.Documents))
+	for i, document := range base.Documents {
+		documents[document.ID] = i
+	}
+	for _, document := range next.Documents {
+		if i, ok := documents[document.ID]; ok {
+			base.Documents[i] = document
+		} else {
+			documents[document.ID] = len(base.Documents)
+			base.Documents = append(base.Documents, document)
+		}
+	}
+	live := make(map[string]bool, len(next.DocumentIDs))
+	for _, id := range next.DocumentIDs {
+		live[id] = true
+	}
+	kept := base.Documents[:0]
+	for _, document := range base.Documents {
+		if live[document.ID] {
+			kept = append(kept, document)
+		}
+	}
+
+	files := make(map[string]int, len(base.Files))
+	for i, file := range base.Files {
+		files[file.ID] = i
+	}
+	for _, file := range next.Files {
+		if i, ok := files[file.ID]; ok {
+			base.Files[i] = file
+		} else {
+			files[file.ID] = len(base.Files)
+			base.Files = append(base.Files, file)
+		}
+	}
+	live = make(map[string]bool, len(next.FileIDs))
+	for _, id := range next.FileIDs {
+		live[id] = true
+	}
+	keptFiles := base.Files[:0]
+	for _, file := range base.Files {
+		if live[file.ID] {
+			keptFiles = append(keptFiles, file)
+		}
+	}
+
+	merged := *next
+	merged.Documents = kept
+	merged.Files = keptFiles
+	merged.DocumentIDs = nil
+	merged.FileIDs = nil
+	*base = merged
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/utils"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// Backup destination types
+const (
+	BackupDestinationLocal = "local" // A directory of this host, such as a mounted network share
+	BackupDestinationSFTP  = "sftp"  // A directory of a web server of the project
+	BackupDestinationS3    = "s3"    // A bucket of AWS S3 or an S3-compatible server
+)
+
+var (
+	// ErrBackupDestinationNotFound is returned for destinations the project does not have
+	ErrBackupDestinationNotFound = errors.New("backup destination not found")
+	// ErrInvalidBackupDestination is returned for destinations missing what their type needs
+	ErrInvalidBackupDestination = errors.New("invalid backup destination")
+	// ErrBackupDestinationInUse is returned when deleting a destination holding backups
+	ErrBackupDestinationInUse = errors.New("backups or schedules use this destination")
+)
+
+// ListDestinations returns the backup destinations of a project
+func (s *BackupService) ListDestinations(projectID uint) ([]models.BackupDestination, error) {
+	var destinations []models.BackupDestination
+	err := s.db.Where("project_id = ?", projectID).Order("name").Find(&destinations).Error
+	return destinations, err
+}
+
+// GetDestination returns a backup destination of a project
+func (s *BackupService) GetDestination(projectID, destinationID uint) (*models.BackupDestination, error) {
+	var destination models.BackupDestination
+	if err := s.db.Where("id = ? AND project_id = ?", destinationID, projectID).First(&destination).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrBackupDestinationNotFound
+		}
+		return nil, err
+	}
+	return &destination, nil
+}
+
+// SaveDestination validates and stores a backup destination; a non-empty secret access key
+// replaces the stored one
+func (s *BackupService) SaveDestination(destination *models.BackupDestination, secretAccessKey string) error {
+	if secretAccessKey != "" {
+		if s.cfg.MasterKey == "" {
+			return ErrBackupEncryptionUnavailable
+		}
+		encrypted, err := utils.EncryptSecret(secretAccessKey, s.cfg.MasterKey)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt secret access key: %w", err)
+		}
+		destination.S3SecretAccessKey = encrypted
+	}
+	if err := s.validateDestination(destination); err != nil {
+		return err
+	}
+	return s.db.Save(destination).Error
+}
+
+// validateDestination checks a destination has what its type needs
+func (s *BackupService) validateDestination(destination *models.BackupDestination) error {
+	destination.Name = strings.TrimSpace(destination.Name)
+	if destination.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidBackupDestination)
+	}
+
+	switch destination.Type {
+	case BackupDestinationLocal:
+		if !filepath.IsAbs(destination.Path) {
+			return fmt.Errorf("%w: local destinations need an absolute path", ErrInvalidBackupDestination)
+		}
+		destination.WebServerID = nil
+	case BackupDestinationSFTP:
+		if destination.WebServerID == nil {
+			return fmt.Errorf("%w: SFTP destinations need a web server", ErrInvalidBackupDestination)
+		}
+		var count int64
+		s.db.Model(&models.WebServer{}).Where("id = ? AND project_id = ?", *destination.WebServerID, destination.ProjectID).Count(&count)
+		if count == 0 {
+			return fmt.Errorf("%w: web server not found", ErrInvalidBackupDestination)
+		}
+	case BackupDestinationS3:
+		if destination.S3Bucket == "" {
+			return fmt.Errorf("%w: S3 destinations need a bucket", ErrInvalidBackupDestination)
+		}
+		if strings.Contains(destination.Path, "..") {
+			return fmt.Errorf("%w: invalid key prefix", ErrInvalidBackupDestination)
+		}
+		destination.WebServerID = nil
+	default:
+		return fmt.Errorf("%w: type must be local, sftp or s3", ErrInvalidBackupDestination)
+	}
+	return nil
+}
+
+// DeleteDestination deletes a backup destination no backup or schedule uses
+func (s *BackupService) DeleteDestination(projectID, destinationID uint) error {
+	destination, err := s.GetDestination(projectID, destinationID)
+	if err != nil {
+		return err
+	}
+
+	var backups, schedules int64
+	s.db.Model(&models.Backup{}).Where("destination_id = ?", destination.ID).Count(&backups)
+	s.db.Model(&models.BackupSchedule{}).Where("destination_id = ?", destination.ID).Count(&schedules)
+	if backups > 0 || schedules > 0 {
+		return ErrBackupDestinationInUse
+	}
+	return s.db.Delete(destination).Error
+}
+
+// TestDestination checks a destination can be written to, read from and deleted from
+func (s *BackupService) TestDestination(ctx context.Context, destination models.BackupDestination) error {
+	backend, err := s.destinationBackend(destination)
+	if err != nil {
+		return err
+	}
+
+	key := destinationKey(destination, fmt.Sprintf("project-%d/.cloudbox-test-%d", destination.ProjectID, time.Now().UnixNano()))
+	probe := "cloudbox backup destination test"
+	if err := backend.Put(ctx, key, strings.NewReader(probe), int64(len(probe)), "text/plain"); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	defer backend.Delete(ctx, key)
+
+	info, err := backend.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	if info.Size != int64(len(probe)) {
+		return fmt.Errorf("read %d bytes back, wrote %d", info.Size, len(probe))
+	}
+	if err := backend.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
+
+// destinationBackend returns the storage backend writing to a destination
+func (s *BackupService) destinationBackend(destination models.BackupDestination) (StorageBackend, error) {
+	switch destination.Type {
+	case BackupDestinationLocal:
+		return NewLocalStorage(destination.Path), nil
+
+	case BackupDestinationSFTP:
+		if destination.WebServerID == nil {
+			return nil, fmt.Errorf("%w: SFTP destinations need a web server", ErrInvalidBackupDestination)
+		}
+		var webServer models.WebServer
+		if err := s.db.Where("id = ? AND project_id = ?", *destination.WebServerID, destination.ProjectID).First(&webServer).Error; err != nil {
+			return nil, fmt.Errorf("failed to load web server: %w", err)
+		}
+		root := destination.Path
+		if root == "" {
+			root = webServer.BackupPath
+		}
+		return NewSFTPStorage(s.dialWebServer(webServer), root), nil
+
+	case BackupDestinationS3:
+		secret := ""
+		if destination.S3SecretAccessKey != "" {
+			var err error
+			if secret, err = utils.DecryptSecret(destination.S3SecretAccessKey, s.cfg.MasterKey); err != nil {
+				return nil, fmt.Errorf("failed to decrypt secret access key: %w", err)
+			}
+		}
+		return NewS3Storage(S3Config{
+			Endpoint:        destination.S3Endpoint,
+			Region:          destination.S3Region,
+			Bucket:          destination.S3Bucket,
+			AccessKeyID:     destination.S3AccessKeyID,
+			SecretAccessKey: secret,
+			PathStyle:       destination.S3PathStyle,
+		})
+	}
+	return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidBackupDestination, destination.Type)
+}
+
+// destinationKey returns the key of an object in a destination; S3 destinations keep their
+// objects under their path, the others in their path
+func destinationKey(destination models.BackupDestination, key string) string {
+	if prefix := strings.Trim(destination.Path, "/"); destination.Type == BackupDestinationS3 && prefix != "" {
+		return prefix + "/" + key
+	}
+	return key
+}
+
+// dialWebServer returns a function connecting to a web server with its SSH key. Its host key is
+// checked against the ones recorded for the project, recording it on the first connection. The
+// connection is closed once the context of the operation is done
+func (s *BackupService) dialWebServer(webServer models.WebServer) func(ctx context.Context) (*ssh.Client, error) {
+	return func(ctx context.Context) (*ssh.Client, error) {
+		var sshKey models.SSHKey
+		if err := s.db.First(&sshKey, webServer.SSHKeyID).Error; err != nil {
+			return nil, fmt.Errorf("failed to load SSH key: %w", err)
+		}
+		deployments := NewDeploymentService(s.db, s.cfg)
+		privateKey, err := deployments.decryptSSHPrivateKey(sshKey.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt SSH private key: %w", err)
+		}
+		signer, err := deployments.parseSSHPrivateKey(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH private key: %w", err)
+		}
+
+		port := webServer.Port
+		if port == 0 {
+			port = 22
+		}
+		config := &ssh.ClientConfig{
+			User:            webServer.Username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: utils.NewHostKeyManager(s.db).CreateHostKeyCallback(webServer.ProjectID, true),
+			Timeout:         30 * time.Second,
+		}
+		address := fmt.Sprintf("%s:%d", webServer.Hostname, port)
+		client, err := dialSSH(ctx, address, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+		}
+		return client, nil
+	}
+}
+
+// backupBackend returns the backend of the destination of a backup
+func (s *BackupService) backupBackend(backup models.Backup) (StorageBackend, error) {
+	destination, err := s.GetDestination(backup.ProjectID, *backup.DestinationID)
+	if err != nil {
+		return nil, err
+	}
+	return s.destinationBackend(*destination)
+}
+
+// storeArchive uploads the archive of a backup to its destination and returns its key there
+func (s *BackupService) storeArchive(ctx context.Context, backup models.Backup, filePath string) (string, error) {
+	destination, err := s.GetDestination(backup.ProjectID, *backup.DestinationID)
+	if err != nil {
+		return "", err
+	}
+	backend, err := s.destinationBackend(*destination)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key := destinationKey(*destination, fmt.Sprintf("project-%d/%s", backup.ProjectID, backupArchiveName(backup)))
+	contentType := "application/gzip"
+	if backup.Encrypted {
+		contentType = "application/octet-stream"
+	}
+	if err := backend.Put(ctx, key, file, info.Size(), contentType); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// deleteStoredArchive deletes the archive of a backup from its destination
+func (s *BackupService) deleteStoredArchive(ctx context.Context, backup models.Backup) error {
+	backend, err := s.backupBackend(backup)
+	if err != nil {
+		return err
+	}
+	return backend.Delete(ctx, backup.FilePath)
+}
+
+// openArchive returns the path of the plain archive of a backup, checked against its checksum.
+// Archives kept elsewhere or encrypted are copied to a temporary file, which done removes
+func (s *BackupService) openArchive(ctx context.Context, backup models.Backup) (archive string, done func(), err error) {
+	if backup.DestinationID == nil && !backup.Encrypted {
+		if err := verifyBackupFile(backup); err != nil {
+			return "", nil, err
+		}
+		return backup.FilePath, func() {}, nil
+	}
+
+	var body io.ReadCloser
+	if backup.DestinationID == nil {
+		if body, err = os.Open(backup.FilePath); err != nil {
+			return "", nil, fmt.Errorf("failed to open backup file: %w", err)
+		}
+	} else {
+		backend, err := s.backupBackend(backup)
+		if err != nil {
+			return "", nil, err
+		}
+		if body, _, err = backend.Get(ctx, backup.FilePath); err != nil {
+			return "", nil, fmt.Errorf("failed to fetch backup archive: %w", err)
+		}
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	var plain io.Reader = io.TeeReader(body, hash)
+	if backup.Encrypted {
+		if plain, err = utils.NewDecryptingReader(plain, s.cfg.MasterKey, backupEncryptionContext(backup)); err != nil {
+			if errors.Is(err, utils.ErrStreamCorrupt) {
+				return "", nil, fmt.Errorf("%w: backup %d cannot be decrypted", ErrBackupCorrupt, backup.ID)
+			}
+			return "", nil, err
+		}
+	}
+
+	file, err := os.CreateTemp(s.backupDir, fmt.Sprintf("restore-%d-*.tar.gz", backup.ID))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	done = func() { os.Remove(file.Name()) }
+	_, err = io.Copy(file, plain)
+	if err == nil {
+		// Anything after the encrypted stream counts towards the checksum too
+		_, err = io.Copy(hash, body)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		done()
+		if errors.Is(err, utils.ErrStreamCorrupt) {
+			return "", nil, fmt.Errorf("%w: backup %d cannot be decrypted", ErrBackupCorrupt, backup.ID)
+		}
+		return "", nil, fmt.Errorf("failed to fetch backup archive: %w", err)
+	}
+	if backup.Checksum != "" && hex.EncodeToString(hash.Sum(nil)) != backup.Checksum {
+		done()
+		return "", nil, fmt.Errorf("%w: checksum of backup %d does not match", ErrBackupCorrupt, backup.ID)
+	}
+	return file.Name(), done, nil
+}
@@ -0,0 +1,739 @@
+package services
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Restore modes
+const (
+	RestoreModeReplace = "replace" // Rows the backup does not have are deleted
+	RestoreModeMerge   = "merge"   // Rows the backup does not have are kept
+)
+
+// restoreDiffKeyLimit caps the keys a diff lists per table and change
+const restoreDiffKeyLimit = 100
+
+// ErrInvalidRestore is returned for restore options that cannot be carried out
+var ErrInvalidRestore = errors.New("invalid restore options")
+
+// RestoreOptions represents options for restoring a backup
+type RestoreOptions struct {
+	TargetProjectID uint   // Project restored into; the project of the backup by default
+	NewProject      bool   // The target was created for the restore; dry runs need no target then
+	Mode            string // replace (default) or merge
+	// Names of the collections, buckets and functions to restore, with their documents, files and
+	// domains; everything when all are empty
+	Collections []string
+	Buckets     []string
+	Functions   []string
+	DryRun      bool // Only work out what the restore would change
+}
+
+// selective returns whether the restore covers chosen collections, buckets or functions only
+func (o RestoreOptions) selective() bool {
+	return len(o.Collections) > 0 || len(o.Buckets) > 0 || len(o.Functions) > 0
+}
+
+// scopes returns the condition on the rows of each table a selective restore covers; tables
+// without one are left alone
+func (o RestoreOptions) scopes(projectID uint) map[string]func(db *gorm.DB) *gorm.DB {
+	where := func(query string, args ...interface{}) func(db *gorm.DB) *gorm.DB {
+		return func(db *gorm.DB) *gorm.DB { return db.Where(query, args...) }
+	}
+	scopes := map[string]func(db *gorm.DB) *gorm.DB{}
+	if len(o.Collections) > 0 {
+		scopes["collections"] = where("name IN ?", o.Collections)
+		scopes["documents"] = where("collection_name IN ?", o.Collections)
+		scopes["document_revisions"] = where("collection_name IN ?", o.Collections)
+	}
+	if len(o.Buckets) > 0 {
+		scopes["buckets"] = where("name IN ?", o.Buckets)
+		scopes["files"] = where("bucket_name IN ?", o.Buckets)
+	}
+	if len(o.Functions) > 0 {
+		scopes["functions"] = where("name IN ?", o.Functions)
+		scopes["function_domains"] = where("function_id IN (SELECT id FROM functions WHERE project_id = ? AND name IN ?)", projectID, o.Functions)
+	}
+	return scopes
+}
+
+// RestoreTableDiff counts the rows of a table a restore creates, updates and deletes, listing the
+// keys of the first ones
+type RestoreTableDiff struct {
+	Create    int      `json:"create"`
+	Update    int      `json:"update"`
+	Delete    int      `json:"delete"`
+	Unchanged int      `json:"unchanged"`
+	Created   []string `json:"created,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Deleted   []string `json:"deleted,omitempty"`
+}
+
+// countRestoreRow counts a row, listing its key while there are few
+func countRestoreRow(count *int, keys *[]string, key string) {
+	*count++
+	if len(*keys) < restoreDiffKeyLimit {
+		*keys = append(*keys, key)
+	}
+}
+
+// RestoreResult describes a restore, or what it would do in a dry run
+type RestoreResult struct {
+	BackupID        uint                         `json:"backup_id"`
+	TargetProjectID uint                         `json:"target_project_id,omitempty"`
+	Mode            string                       `json:"mode"`
+	DryRun          bool                         `json:"dry_run"`
+	FormatVersion   string                       `json:"format_version"` // Format of the archive
+	Migrated        bool                         `json:"migrated"`       // Upgraded from an older format
+	Tables          map[string]*RestoreTableDiff `json:"tables"`
+	Skipped         []string                     `json:"skipped,omitempty"` // Tables whose rows cannot exist twice, left out restoring into another project
+}
+
+// RestoreBackup restores a project from a backup; incremental backups are restored along with
+// the backups they build on. Full replacing restores clear the project first; the others match
+// the rows of the backup with those of the project by their natural keys
+func (s *BackupService) RestoreBackup(projectID, backupID uint, options RestoreOptions) (*RestoreResult, error) {
+	ctx := context.Background()
+
+	if options.Mode == "" {
+		options.Mode = RestoreModeReplace
+	}
+	if options.Mode != RestoreModeReplace && options.Mode != RestoreModeMerge {
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidRestore, options.Mode)
+	}
+
+	// Get backup record
+	backup, err := s.projectBackup(s.db, projectID, backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if backup.Status != "completed" {
+		return nil, fmt.Errorf("backup is not completed, cannot restore")
+	}
+
+	formatVersion := backup.FormatVersion
+	if formatVersion == "" {
+		formatVersion = "1.0"
+	}
+	if err := checkBackupFormat(formatVersion); err != nil {
+		return nil, err
+	}
+
+	targetProjectID := options.TargetProjectID
+	if targetProjectID == 0 && !options.NewProject {
+		targetProjectID = backup.ProjectID
+	}
+	if targetProjectID == 0 && !options.DryRun {
+		return nil, fmt.Errorf("%w: no target project", ErrInvalidRestore)
+	}
+
+	chain, err := s.backupChain(*backup)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the archives, checked and decrypted
+	archives := make([]string, len(chain))
+	for i, link := range chain {
+		archive, done, err := s.openArchive(ctx, link)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		archives[i] = archive
+	}
+
+	// Extract and parse backup data, noting which archive holds the newest content of each file
+	var backupData *BackupData
+	sources := map[string]int{}
+	for i := range chain {
+		data, manifest, err := s.extractBackupData(archives[i], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract backup data: %w", err)
+		}
+		if i == 0 {
+			backupData = data
+		} else {
+			mergeIncrementalBackup(backupData, data)
+		}
+		if manifest != nil {
+			for _, entry := range manifest.Entries {
+				if strings.HasPrefix(entry.Path, backupBlobPrefix) {
+					sources[strings.TrimPrefix(entry.Path, backupBlobPrefix)] = i
+				}
+			}
+		}
+	}
+	// Archives before format 2.0 hold no files; their rows keep pointing at the stored objects
+	withObjects := backup.FormatVersion != "" && backup.FormatVersion != "1.0"
+
+	cmp, _ := compareBackupFormats(formatVersion, BackupFormatVersion)
+	migrated := cmp < 0
+	result := &RestoreResult{
+		BackupID:        backup.ID,
+		TargetProjectID: targetProjectID,
+		Mode:            options.Mode,
+		DryRun:          options.DryRun,
+		FormatVersion:   formatVersion,
+		Migrated:        migrated,
+		Tables:          map[string]*RestoreTableDiff{},
+	}
+
+	if err := selectBackupData(backupData, options); err != nil {
+		return nil, err
+	}
+	// Keys, sessions and domains are unique across projects, so they stay with the project they belong to
+	otherProject := targetProjectID != backup.ProjectID
+	if otherProject {
+		result.Skipped = []string{"api_keys", "app_sessions", "function_domains"}
+		backupData.APIKeys = nil
+		backupData.AppSessions = nil
+		backupData.FunctionDomains = nil
+	}
+	domainFunctions := functionDomainTargets(backupData)
+
+	// Update project IDs in backup data
+	s.updateProjectIDs(backupData, targetProjectID)
+
+	replaceAll := options.Mode == RestoreModeReplace && !options.selective()
+	scopes := options.scopes(targetProjectID)
+
+	if options.DryRun {
+		if otherProject {
+			remapBackupIDs(backupData)
+		}
+		for _, table := range backupData.tables() {
+			scope, ok := scopes[table.name]
+			if !restoreCovers(table, options, ok) {
+				continue
+			}
+			if table.name == "function_domains" {
+				relinkFunctionDomains(backupData, domainFunctions)
+			}
+			plan, err := planRestoreTable(s.db, table, targetProjectID, scope, options.Mode, true)
+			if err != nil {
+				return nil, err
+			}
+			result.addTable(table.name, plan.diff)
+		}
+		return result, nil
+	}
+
+	var previous []models.File
+	if withObjects {
+		if options.Mode == RestoreModeReplace {
+			query := s.db.Unscoped().Where("project_id = ?", targetProjectID)
+			if scope, ok := scopes["files"]; ok {
+				query = scope(query)
+			} else if options.selective() {
+				query = query.Where("1 = 0")
+			}
+			if err := query.Find(&previous).Error; err != nil {
+				return nil, fmt.Errorf("failed to list existing files: %w", err)
+			}
+		}
+		if err := s.restoreObjects(ctx, archives, backupData, sources, targetProjectID); err != nil {
+			return nil, fmt.Errorf("failed to restore files: %w", err)
+		}
+	}
+	// Stored objects are named by the IDs in the archive, so those change once they are restored
+	if otherProject {
+		remapBackupIDs(backupData)
+	}
+
+	// Begin transaction for atomic restore
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if replaceAll {
+			for _, table := range backupData.tables() {
+				if !restoreCovers(table, options, false) {
+					continue
+				}
+				plan, err := planRestoreTable(tx, table, targetProjectID, nil, options.Mode, false)
+				if err != nil {
+					return err
+				}
+				result.addTable(table.name, plan.diff)
+			}
+
+			// Clear existing project data
+			if err := s.clearProjectData(tx, targetProjectID); err != nil {
+				return fmt.Errorf("failed to clear existing data: %w", err)
+			}
+
+			// Restore data
+			if err := s.restoreProjectData(tx, targetProjectID, backupData, domainFunctions); err != nil {
+				return fmt.Errorf("failed to restore data: %w", err)
+			}
+			return nil
+		}
+
+		tables := backupData.tables()
+		plans := make([]*restorePlan, len(tables))
+		for i, table := range tables {
+			scope, ok := scopes[table.name]
+			if !restoreCovers(table, options, ok) {
+				continue
+			}
+			if table.name == "function_domains" {
+				relinkFunctionDomains(backupData, domainFunctions)
+			}
+			plan, err := planRestoreTable(tx, table, targetProjectID, scope, options.Mode, true)
+			if err != nil {
+				return err
+			}
+			plans[i] = plan
+			result.addTable(table.name, plan.diff)
+		}
+
+		// Rows go before the rows they are referred by, and come back after them
+		for i := len(tables) - 1; i >= 0; i-- {
+			if plans[i] != nil {
+				if err := plans[i].delete(tx, tables[i]); err != nil {
+					return err
+				}
+			}
+		}
+		for i, table := range tables {
+			if plans[i] == nil {
+				continue
+			}
+			if table.name == "function_domains" {
+				relinkFunctionDomains(backupData, domainFunctions)
+			}
+			if err := plans[i].apply(tx, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the objects of files the backup does not have
+	restored := make(map[string]bool, len(backupData.Files))
+	for _, file := range backupData.Files {
+		restored[storedObjectID(file)] = true
+	}
+	for _, file := range previous {
+		if restored[storedObjectID(file)] {
+			continue
+		}
+		if backend, err := s.backends.Get(file.StorageBackend); err == nil {
+			if err := backend.Delete(ctx, file.FilePath); err != nil {
+				log.Printf("Failed to delete %s after restoring backup %d: %v", file.FilePath, backupID, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// addTable records the diff of a table, leaving out tables neither side has rows in
+func (r *RestoreResult) addTable(name string, diff *RestoreTableDiff) {
+	if diff.Create+diff.Update+diff.Delete+diff.Unchanged > 0 {
+		r.Tables[name] = diff
+	}
+}
+
+// restoreCovers returns whether a restore touches a table; scoped tells whether a selective
+// restore has a scope for it. The audit log only grows, so merges leave it alone
+func restoreCovers(table backupTable, options RestoreOptions, scoped bool) bool {
+	switch {
+	case table.name == "document_ids" || table.name == "file_ids":
+		return false
+	case options.selective():
+		return scoped
+	case table.key == nil:
+		return options.Mode == RestoreModeReplace
+	}
+	return true
+}
+
+// selectBackupData keeps the chosen collections, buckets and functions of the backup, with their
+// documents, revisions, files and domains, when the restore is selective
+func selectBackupData(data *BackupData, options RestoreOptions) error {
+	if !options.selective() {
+		return nil
+	}
+
+	collections, err := restoreSelection("collection", options.Collections, data.Collections, func(c models.Collection) string { return c.Name })
+	if err != nil {
+		return err
+	}
+	buckets, err := restoreSelection("bucket", options.Buckets, data.Buckets, func(b models.Bucket) string { return b.Name })
+	if err != nil {
+		return err
+	}
+	functions, err := restoreSelection("function", options.Functions, data.Functions, func(f models.Function) string { return f.Name })
+	if err != nil {
+		return err
+	}
+
+	functionIDs := map[uint]bool{}
+	for _, function := range data.Functions {
+		if functions[function.Name] {
+			functionIDs[function.ID] = true
+		}
+	}
+
+	selected := &BackupData{
+		Metadata:          data.Metadata,
+		BackupVersion:     data.BackupVersion,
+		Collections:       filterRows(data.Collections, func(c models.Collection) bool { return collections[c.Name] }),
+		Documents:         filterRows(data.Documents, func(d models.Document) bool { return collections[d.CollectionName] }),
+		DocumentRevisions: filterRows(data.DocumentRevisions, func(r models.DocumentRevision) bool { return collections[r.CollectionName] }),
+		Buckets:           filterRows(data.Buckets, func(b models.Bucket) bool { return buckets[b.Name] }),
+		Files:             filterRows(data.Files, func(f models.File) bool { return buckets[f.BucketName] }),
+		Functions:         filterRows(data.Functions, func(f models.Function) bool { return functions[f.Name] }),
+		FunctionDomains:   filterRows(data.FunctionDomains, func(d models.FunctionDomain) bool { return functionIDs[d.FunctionID] }),
+	}
+	*data = *selected
+	return nil
+}
+
+// restoreSelection returns the set of chosen names, checking the backup has each
+func restoreSelection[T any](kind string, names []string, rows []T, name func(T) string) (map[string]bool, error) {
+	present := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		present[name(row)] = true
+	}
+	selection := make(map[string]bool, len(names))
+	for _, n := range names {
+		if !present[n] {
+			return nil, fmt.Errorf("%w: the backup has no %s %q", ErrInvalidRestore, kind, n)
+		}
+		selection[n] = true
+	}
+	return selection, nil
+}
+
+func filterRows[T any](rows []T, keep func(T) bool) []T {
+	var kept []T
+	for _, row := range rows {
+		if keep(row) {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+// functionDomainTargets returns the name of the function each function domain of the backup maps
+// to, as function IDs change on restore; domains of functions the backup does not have are dropped
+func functionDomainTargets(data *BackupData) []string {
+	names := make(map[uint]string, len(data.Functions))
+	for _, function := range data.Functions {
+		names[function.ID] = function.Name
+	}
+	domains := data.FunctionDomains[:0]
+	var targets []string
+	for _, domain := range data.FunctionDomains {
+		if name, ok := names[domain.FunctionID]; ok {
+			domains = append(domains, domain)
+			targets = append(targets, name)
+		}
+	}
+	data.FunctionDomains = domains
+	return targets
+}
+
+// relinkFunctionDomains points the function domains of the backup at the current IDs of their
+// functions
+func relinkFunctionDomains(data *BackupData, targets []string) {
+	ids := make(map[string]uint, len(data.Functions))
+	for _, function := range data.Functions {
+		ids[function.Name] = function.ID
+	}
+	for i := range data.FunctionDomains {
+		data.FunctionDomains[i].FunctionID = ids[targets[i]]
+	}
+}
+
+// remapBackupIDs gives documents, files, app users, sessions, channels and messages new IDs for
+// restores into another project, as theirs are unique across projects; rows referring to them
+// follow. Documents with custom IDs get generated ones too
+func remapBackupIDs(data *BackupData) {
+	newIDs := func(ids []*string) map[string]string {
+		mapping := make(map[string]string, len(ids))
+		for _, id := range ids {
+			next := uuid.New().String()
+			mapping[*id] = next
+			*id = next
+		}
+		return mapping
+	}
+	remap := func(mapping map[string]string, id *string) {
+		if id == nil {
+			return
+		}
+		if next, ok := mapping[*id]; ok {
+			*id = next
+		}
+	}
+
+	var ids []*string
+	for i := range data.Documents {
+		ids = append(ids, &data.Documents[i].ID)
+	}
+	documents := newIDs(ids)
+	for i := range data.DocumentRevisions {
+		remap(documents, &data.DocumentRevisions[i].DocumentID)
+	}
+
+	ids = nil
+	for i := range data.Files {
+		ids = append(ids, &data.Files[i].ID)
+	}
+	newIDs(ids)
+
+	ids = nil
+	for i := range data.AppSessions {
+		ids = append(ids, &data.AppSessions[i].ID)
+	}
+	newIDs(ids)
+
+	ids = nil
+	for i := range data.AppUsers {
+		ids = append(ids, &data.AppUsers[i].ID)
+	}
+	users := newIDs(ids)
+
+	ids = nil
+	for i := range data.Channels {
+		ids = append(ids, &data.Channels[i].ID)
+	}
+	channels := newIDs(ids)
+
+	ids = nil
+	for i := range data.Messages {
+		ids = append(ids, &data.Messages[i].ID)
+	}
+	messages := newIDs(ids)
+
+	for i := range data.AppSessions {
+		remap(users, &data.AppSessions[i].UserID)
+	}
+	for i := range data.AppUserIdentities {
+		remap(users, &data.AppUserIdentities[i].UserID)
+	}
+	for i := range data.Channels {
+		remap(users, &data.Channels[i].CreatedBy)
+	}
+	for i := range data.ChannelMembers {
+		remap(channels, &data.ChannelMembers[i].ChannelID)
+		remap(users, &data.ChannelMembers[i].UserID)
+	}
+	for i := range data.Messages {
+		message := &data.Messages[i]
+		remap(channels, &message.ChannelID)
+		remap(users, &message.UserID)
+		remap(messages, message.ParentID)
+		remap(messages, message.ThreadID)
+	}
+	for i := range data.MessageReactions {
+		remap(messages, &data.MessageReactions[i].MessageID)
+		remap(users, &data.MessageReactions[i].UserID)
+	}
+	for i := range data.MessageReads {
+		remap(messages, &data.MessageReads[i].MessageID)
+		remap(users, &data.MessageReads[i].UserID)
+	}
+}
+
+// restorePlan is what restoring a table does to the rows of the target project
+type restorePlan struct {
+	schema  *schema.Schema
+	create  []int         // Backup rows without a counterpart
+	update  []int         // Backup rows replacing the row they share their key with
+	deletes []interface{} // Primary keys of the rows that go
+	diff    *RestoreTableDiff
+}
+
+// restoreIgnoredColumns are left out comparing rows
+var restoreIgnoredColumns = map[string]bool{"created_at": true, "updated_at": true, "deleted_at": true, "project_id": true}
+
+// planRestoreTable matches the backup rows of a table with the rows of the project by the natural
+// key of the table. Replacing restores delete the rows without a match; assign gives matched
+// backup rows the primary key of their counterparts. Project 0 stands for a new, empty one
+func planRestoreTable(db *gorm.DB, table backupTable, projectID uint, scope func(db *gorm.DB) *gorm.DB, mode string, assign bool) (*restorePlan, error) {
+	rows := reflect.ValueOf(table.rows).Elem()
+	rowSchema, err := parseRowSchema(db, rows.Type().Elem())
+	if err != nil {
+		return nil, err
+	}
+	plan := &restorePlan{schema: rowSchema, diff: &RestoreTableDiff{}}
+	label := strings.ReplaceAll(table.name, "_", " ")
+
+	existing := reflect.New(rows.Type())
+	if projectID != 0 {
+		query := db.Unscoped().Where("project_id = ?", projectID)
+		if scope != nil {
+			query = scope(query)
+		}
+		if err := query.Find(existing.Interface()).Error; err != nil {
+			return nil, fmt.Errorf("failed to list existing %s: %w", label, err)
+		}
+	}
+	existing = existing.Elem()
+
+	ctx := context.Background()
+	primary := rowSchema.PrioritizedPrimaryField
+	// Of rows sharing a key, the first is matched
+	byKey := map[string]int{}
+	if table.key != nil {
+		for i := existing.Len() - 1; i >= 0; i-- {
+			byKey[rowKey(rowSchema, existing.Index(i), table.key)] = i
+		}
+	}
+
+	matched := map[string]bool{}
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		key := rowKey(rowSchema, row, table.key)
+		index, ok := byKey[key]
+		if !ok || matched[key] {
+			plan.create = append(plan.create, i)
+			countRestoreRow(&plan.diff.Create, &plan.diff.Created, key)
+			continue
+		}
+		matched[key] = true
+		counterpart := existing.Index(index)
+		if assign {
+			id, _ := primary.ValueOf(ctx, counterpart)
+			if err := primary.Set(ctx, row, id); err != nil {
+				return nil, fmt.Errorf("failed to match %s: %w", label, err)
+			}
+		}
+		if rowDeleted(rowSchema, counterpart) || rowFingerprint(rowSchema, row) != rowFingerprint(rowSchema, counterpart) {
+			plan.update = append(plan.update, i)
+			countRestoreRow(&plan.diff.Update, &plan.diff.Updated, key)
+		} else {
+			plan.diff.Unchanged++
+		}
+	}
+
+	if mode == RestoreModeReplace {
+		for i := 0; i < existing.Len(); i++ {
+			row := existing.Index(i)
+			key := rowKey(rowSchema, row, table.key)
+			if index, ok := byKey[key]; ok && matched[key] && index == i {
+				continue
+			}
+			id, _ := primary.ValueOf(ctx, row)
+			plan.deletes = append(plan.deletes, id)
+			countRestoreRow(&plan.diff.Delete, &plan.diff.Deleted, key)
+		}
+	}
+	return plan, nil
+}
+
+// delete removes the rows of the project the plan drops
+func (p *restorePlan) delete(tx *gorm.DB, table backupTable) error {
+	if len(p.deletes) == 0 {
+		return nil
+	}
+	model := reflect.New(p.schema.ModelType).Interface()
+	column := p.schema.PrioritizedPrimaryField.DBName
+	if err := tx.Unscoped().Where(column+" IN ?", p.deletes).Delete(model).Error; err != nil {
+		return fmt.Errorf("failed to delete %s: %w", strings.ReplaceAll(table.name, "_", " "), err)
+	}
+	return nil
+}
+
+// apply writes the backup rows the plan updates and creates
+func (p *restorePlan) apply(tx *gorm.DB, table backupTable) error {
+	rows := reflect.ValueOf(table.rows).Elem()
+	label := strings.ReplaceAll(table.name, "_", " ")
+	for _, i := range p.update {
+		if err := tx.Unscoped().Save(rows.Index(i).Addr().Interface()).Error; err != nil {
+			return fmt.Errorf("failed to restore %s: %w", label, err)
+		}
+	}
+	if len(p.create) == 0 {
+		return nil
+	}
+	// Pointers, so created rows get their IDs
+	created := reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(rows.Type().Elem())), 0, len(p.create))
+	for _, i := range p.create {
+		created = reflect.Append(created, rows.Index(i).Addr())
+	}
+	if err := tx.CreateInBatches(created.Interface(), 500).Error; err != nil {
+		return fmt.Errorf("failed to restore %s: %w", label, err)
+	}
+	return nil
+}
+
+// parseRowSchema returns the schema of a backup row type
+func parseRowSchema(db *gorm.DB, rowType reflect.Type) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(reflect.New(rowType).Interface()); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", rowType.Name(), err)
+	}
+	return stmt.Schema, nil
+}
+
+// rowKey returns the natural key of a row, joined by slashes
+func rowKey(rowSchema *schema.Schema, row reflect.Value, key []string) string {
+	parts := make([]string, len(key))
+	for i, column := range key {
+		if field := rowSchema.LookUpField(column); field != nil {
+			value, _ := field.ValueOf(context.Background(), row)
+			parts[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// rowDeleted returns whether a row is soft deleted
+func rowDeleted(rowSchema *schema.Schema, row reflect.Value) bool {
+	field := rowSchema.LookUpField("deleted_at")
+	if field == nil {
+		return false
+	}
+	value, _ := field.ValueOf(context.Background(), row)
+	deletedAt, ok := value.(gorm.DeletedAt)
+	return ok && deletedAt.Valid
+}
+
+// rowFingerprint encodes the columns of a row that a restore compares, with times as the
+// database keeps them
+func rowFingerprint(rowSchema *schema.Schema, row reflect.Value) string {
+	values := make(map[string]interface{}, len(rowSchema.DBNames))
+	for _, column := range rowSchema.DBNames {
+		field := rowSchema.FieldsByDBName[column]
+		if field.PrimaryKey || restoreIgnoredColumns[column] {
+			continue
+		}
+		value, _ := field.ValueOf(context.Background(), row)
+		switch v := value.(type) {
+		case time.Time:
+			value = v.UTC().Truncate(time.Microsecond)
+		case *time.Time:
+			if v != nil {
+				value = v.UTC().Truncate(time.Microsecond)
+			}
+		case driver.Valuer:
+			// Serialized and array columns compare as stored
+			value, _ = v.Value()
+		}
+		values[column] = value
+	}
+	fingerprint, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Sprint(values)
+	}
+	return string(fingerprint)
+}
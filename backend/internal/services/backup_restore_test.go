@@ -0,0 +1,207 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm/schema"
+)
+
+func TestCheckBackupFormat(t *testing.T) {
+	for version, supported := range map[string]bool{"1.0": true, "2.0": true, "2.7": true, "3.0": false, "10.1": false} {
+		err := checkBackupFormat(version)
+		if supported && err != nil {
+			t.Errorf("format %s: %v", version, err)
+		}
+		if !supported && !errors.Is(err, ErrBackupFormatUnsupported) {
+			t.Errorf("format %s = %v, want ErrBackupFormatUnsupported", version, err)
+		}
+	}
+}
+
+func TestMigrateLegacyBackup(t *testing.T) {
+	// A 1.0 archive: a single backup.json without buckets or key hashes
+	legacy := `{
+		"metadata": {"project_id": 4, "project_name": "shop"},
+		"documents": [{"id": "d1", "collection_name": "orders", "project_id": 4}],
+		"files": [
+			{"id": "f1", "bucket_name": "images", "file_path": "4/images/a.png", "project_id": 4},
+			{"id": "f2", "bucket_name": "images", "file_path": "4/images/b.png", "project_id": 4}
+		],
+		"api_keys": [{"name": "server", "project_id": 4}],
+		"backup_version": "1.0"
+	}`
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	writeBackupEntry(tarWriter, "backup.json", strings.NewReader(legacy), int64(len(legacy)))
+	tarWriter.Close()
+	gzipWriter.Close()
+
+	data, manifest, err := readBackupArchive(bytes.NewReader(buffer.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("readBackupArchive: %v", err)
+	}
+	if manifest != nil || data.BackupVersion != BackupFormatVersion || data.Metadata.Mode != BackupModeFull {
+		t.Errorf("read version %s, mode %s, want the current format", data.BackupVersion, data.Metadata.Mode)
+	}
+	if len(data.Buckets) != 1 || data.Buckets[0].Name != "images" || data.Buckets[0].ProjectID != 4 {
+		t.Errorf("buckets = %+v, want images recreated", data.Buckets)
+	}
+	if data.Files[0].StorageBackend != StorageBackendLocal || data.Documents[0].Version != 1 {
+		t.Errorf("file backend %q, document version %d", data.Files[0].StorageBackend, data.Documents[0].Version)
+	}
+	if len(data.APIKeys) != 0 {
+		t.Errorf("API keys = %+v, want those without hashes dropped", data.APIKeys)
+	}
+
+	// Newer major formats are refused
+	if err := migrateBackupData(&BackupData{BackupVersion: "3.0"}); !errors.Is(err, ErrBackupFormatUnsupported) {
+		t.Errorf("migrateBackupData of 3.0 = %v, want ErrBackupFormatUnsupported", err)
+	}
+}
+
+func TestSelectBackupData(t *testing.T) {
+	backup := func() *BackupData {
+		return &BackupData{
+			Collections:       []models.Collection{{Name: "orders"}, {Name: "users"}},
+			Documents:         []models.Document{{ID: "d1", CollectionName: "orders"}, {ID: "d2", CollectionName: "users"}},
+			DocumentRevisions: []models.DocumentRevision{{DocumentID: "d1", CollectionName: "orders"}, {DocumentID: "d2", CollectionName: "users"}},
+			Buckets:           []models.Bucket{{Name: "images"}},
+			Files:             []models.File{{ID: "f1", BucketName: "images"}},
+			Functions:         []models.Function{{ID: 1, Name: "checkout"}, {ID: 2, Name: "mailer"}},
+			FunctionDomains:   []models.FunctionDomain{{Domain: "pay.example.com", FunctionID: 1}, {Domain: "mail.example.com", FunctionID: 2}},
+			AuditLogs:         []models.AuditLog{{Action: "login"}},
+		}
+	}
+
+	data := backup()
+	if err := selectBackupData(data, RestoreOptions{Collections: []string{"orders"}, Functions: []string{"checkout"}}); err != nil {
+		t.Fatalf("selectBackupData: %v", err)
+	}
+	if len(data.Collections) != 1 || len(data.Documents) != 1 || data.Documents[0].ID != "d1" || len(data.DocumentRevisions) != 1 {
+		t.Errorf("collections %+v, documents %+v, want orders only", data.Collections, data.Documents)
+	}
+	if len(data.Functions) != 1 || len(data.FunctionDomains) != 1 || data.FunctionDomains[0].Domain != "pay.example.com" {
+		t.Errorf("functions %+v, domains %+v, want checkout only", data.Functions, data.FunctionDomains)
+	}
+	if len(data.Buckets) != 0 || len(data.Files) != 0 || len(data.AuditLogs) != 0 {
+		t.Error("selective restore keeps tables it was not asked for")
+	}
+
+	if err := selectBackupData(backup(), RestoreOptions{Buckets: []string{"videos"}}); !errors.Is(err, ErrInvalidRestore) {
+		t.Errorf("selecting a missing bucket = %v, want ErrInvalidRestore", err)
+	}
+
+	data = backup()
+	if err := selectBackupData(data, RestoreOptions{}); err != nil || len(data.AuditLogs) != 1 || len(data.Documents) != 2 {
+		t.Errorf("full restore selected %+v, %v", data, err)
+	}
+}
+
+func TestRelinkFunctionDomains(t *testing.T) {
+	data := &BackupData{
+		Functions:       []models.Function{{ID: 7, Name: "checkout"}},
+		FunctionDomains: []models.FunctionDomain{{Domain: "pay.example.com", FunctionID: 7}, {Domain: "old.example.com", FunctionID: 9}},
+	}
+	targets := functionDomainTargets(data)
+	if len(data.FunctionDomains) != 1 {
+		t.Fatalf("domains = %+v, want the one of a backed up function", data.FunctionDomains)
+	}
+
+	data.Functions[0].ID = 42 // As created in the target project
+	relinkFunctionDomains(data, targets)
+	if data.FunctionDomains[0].FunctionID != 42 {
+		t.Errorf("domain points at function %d, want 42", data.FunctionDomains[0].FunctionID)
+	}
+}
+
+func TestRemapBackupIDs(t *testing.T) {
+	parent := "m1"
+	data := &BackupData{
+		Documents:         []models.Document{{ID: "settings"}},
+		DocumentRevisions: []models.DocumentRevision{{DocumentID: "settings"}, {DocumentID: "deleted"}},
+		AppUsers:          []BackupAppUser{{AppUser: models.AppUser{ID: "u1"}}},
+		AppUserIdentities: []models.AppUserIdentity{{UserID: "u1"}},
+		Channels:          []models.Channel{{ID: "c1", CreatedBy: "u1"}},
+		ChannelMembers:    []models.ChannelMember{{ChannelID: "c1", UserID: "u1"}},
+		Messages:          []models.Message{{ID: "m1", ChannelID: "c1", UserID: "u1"}, {ID: "m2", ChannelID: "c1", UserID: "u1", ParentID: &parent}},
+		MessageReactions:  []models.MessageReaction{{MessageID: "m2", UserID: "u1"}},
+		MessageReads:      []models.MessageRead{{MessageID: "m1", UserID: "u1"}},
+	}
+	remapBackupIDs(data)
+
+	document, user, channel := data.Documents[0].ID, data.AppUsers[0].ID, data.Channels[0].ID
+	if document == "settings" || user == "u1" || channel == "c1" || data.Messages[0].ID == "m1" {
+		t.Fatal("IDs were kept")
+	}
+	if data.DocumentRevisions[0].DocumentID != document || data.DocumentRevisions[1].DocumentID != "deleted" {
+		t.Errorf("revisions point at %s and %s", data.DocumentRevisions[0].DocumentID, data.DocumentRevisions[1].DocumentID)
+	}
+	if data.AppUserIdentities[0].UserID != user || data.Channels[0].CreatedBy != user {
+		t.Error("identities and channels do not follow their user")
+	}
+	if member := data.ChannelMembers[0]; member.ChannelID != channel || member.UserID != user {
+		t.Errorf("member = %+v", member)
+	}
+	if message := data.Messages[1]; message.ChannelID != channel || message.UserID != user || *message.ParentID != data.Messages[0].ID {
+		t.Errorf("reply = %+v", message)
+	}
+	if data.MessageReactions[0].MessageID != data.Messages[1].ID || data.MessageReads[0].MessageID != data.Messages[0].ID {
+		t.Error("reactions and reads do not follow their message")
+	}
+}
+
+func TestBackupTableKeys(t *testing.T) {
+	// Restores match rows by the key columns of their tables
+	cache := &sync.Map{}
+	for _, table := range (&BackupData{}).tables() {
+		if len(table.key) == 0 {
+			continue
+		}
+		rowType := reflect.TypeOf(table.rows).Elem().Elem()
+		rowSchema, err := schema.Parse(reflect.New(rowType).Interface(), cache, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range table.key {
+			if rowSchema.LookUpField(column) == nil {
+				t.Errorf("%s has no key column %s", table.name, column)
+			}
+		}
+	}
+}
+
+func TestRowFingerprint(t *testing.T) {
+	rowSchema, err := schema.Parse(&models.Collection{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.FixedZone("CEST", 2*3600))
+	backedUp := models.Collection{ID: 0, Name: "orders", ProjectID: 9, LastModified: modified, CreatedAt: modified}
+	// As read back from the database: microseconds, another ID, project and creation time
+	existing := models.Collection{ID: 3, Name: "orders", ProjectID: 4, LastModified: modified.UTC().Truncate(time.Microsecond)}
+
+	fingerprint := func(c models.Collection) string { return rowFingerprint(rowSchema, reflect.ValueOf(c)) }
+	if fingerprint(backedUp) != fingerprint(existing) {
+		t.Errorf("fingerprints differ:\n%s\n%s", fingerprint(backedUp), fingerprint(existing))
+	}
+	existing.Description = "changed"
+	if fingerprint(backedUp) == fingerprint(existing) {
+		t.Error("fingerprints of differing rows match")
+	}
+
+	revision, _ := schema.Parse(&models.DocumentRevision{}, &sync.Map{}, schema.NamingStrategy{})
+	key := rowKey(revision, reflect.ValueOf(models.DocumentRevision{DocumentID: "d1", Version: 3}), []string{"document_id", "version"})
+	if key != "d1/3" {
+		t.Errorf("key = %q, want d1/3", key)
+	}
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// backupSchedulerInterval is how often due schedules are looked for
+	backupSchedulerInterval = time.Minute
+	// backupPruneInterval is how often old scheduled backups are pruned
+	backupPruneInterval = time.Hour
+	// backupStaleAfter is how long a backup may be creating before a schedule runs regardless
+	backupStaleAfter = 24 * time.Hour
+)
+
+var (
+	// ErrBackupScheduleNotFound is returned for schedules the project does not have
+	ErrBackupScheduleNotFound = errors.New("backup schedule not found")
+	// ErrInvalidBackupSchedule is returned for schedules with invalid settings
+	ErrInvalidBackupSchedule = errors.New("invalid backup schedule")
+	// ErrBackupScheduleBusy is returned when a schedule's previous backup is still being created
+	ErrBackupScheduleBusy = errors.New("the previous backup of this schedule is still being created")
+)
+
+// ListSchedules returns the backup schedules of a project
+func (s *BackupService) ListSchedules(projectID uint) ([]models.BackupSchedule, error) {
+	var schedules []models.BackupSchedule
+	err := s.db.Where("project_id = ?", projectID).Order("name").Find(&schedules).Error
+	return schedules, err
+}
+
+// GetSchedule returns a backup schedule of a project
+func (s *BackupService) GetSchedule(projectID, scheduleID uint) (*models.BackupSchedule, error) {
+	var schedule models.BackupSchedule
+	if err := s.db.Where("id = ? AND project_id = ?", scheduleID, projectID).First(&schedule).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrBackupScheduleNotFound
+		}
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// SaveSchedule validates and stores a backup schedule, planning its next run
+func (s *BackupService) SaveSchedule(schedule *models.BackupSchedule) error {
+	schedule.Name = strings.TrimSpace(schedule.Name)
+	if schedule.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidBackupSchedule)
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	if schedule.Mode == "" {
+		schedule.Mode = BackupModeFull
+	}
+	if schedule.Mode != BackupModeFull && schedule.Mode != BackupModeIncremental {
+		return fmt.Errorf("%w: mode must be full or incremental", ErrInvalidBackupSchedule)
+	}
+	if schedule.FullEvery < 1 {
+		schedule.FullEvery = 1
+	}
+	if schedule.KeepDaily < 0 || schedule.KeepWeekly < 0 || schedule.KeepMonthly < 0 {
+		return fmt.Errorf("%w: retention counts cannot be negative", ErrInvalidBackupSchedule)
+	}
+	if schedule.DestinationID != nil {
+		if _, err := s.GetDestination(schedule.ProjectID, *schedule.DestinationID); err != nil {
+			return err
+		}
+	}
+	if schedule.Encrypt && s.cfg.MasterKey == "" {
+		return ErrBackupEncryptionUnavailable
+	}
+
+	next, err := nextScheduledRun(*schedule, time.Now())
+	if err != nil {
+		return err
+	}
+	schedule.NextRunAt = nil
+	if schedule.Enabled {
+		schedule.NextRunAt = &next
+	}
+	return s.db.Save(schedule).Error
+}
+
+// nextScheduledRun returns when a schedule runs next after the given time, in its time zone
+func nextScheduledRun(schedule models.BackupSchedule, after time.Time) (time.Time, error) {
+	cron, err := ParseCronSchedule(schedule.CronExpression)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidBackupSchedule, err)
+	}
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: unknown time zone %q", ErrInvalidBackupSchedule, schedule.Timezone)
+	}
+	next := cron.Next(after.In(location))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("%w: %q never runs", ErrInvalidBackupSchedule, schedule.CronExpression)
+	}
+	return next, nil
+}
+
+// DeleteSchedule deletes a backup schedule; the backups it took are kept
+func (s *BackupService) DeleteSchedule(projectID, scheduleID uint) error {
+	schedule, err := s.GetSchedule(projectID, scheduleID)
+	if err != nil {
+		return err
+	}
+	return s.db.Delete(schedule).Error
+}
+
+// RunSchedule takes a backup for a schedule. Incremental schedules take a full backup every
+// FullEvery runs, and whenever they have no completed backup to build on
+func (s *BackupService) RunSchedule(schedule models.BackupSchedule) (*models.Backup, error) {
+	var creating int64
+	s.db.Model(&models.Backup{}).
+		Where("schedule_id = ? AND status = ? AND created_at > ?", schedule.ID, "creating", time.Now().Add(-backupStaleAfter)).
+		Count(&creating)
+	if creating > 0 {
+		return nil, ErrBackupScheduleBusy
+	}
+
+	options := BackupOptions{
+		Name:        fmt.Sprintf("%s-%s", schedule.Name, time.Now().UTC().Format("2006-01-02-15-04-05")),
+		Description: fmt.Sprintf("Scheduled backup %s", schedule.Name),
+		Type:        "automatic",
+		Mode:        BackupModeFull,
+		Encrypt:     schedule.Encrypt,
+		ScheduleID:  schedule.ID,
+	}
+	if schedule.DestinationID != nil {
+		options.DestinationID = *schedule.DestinationID
+	}
+	if schedule.Mode == BackupModeIncremental {
+		if parent := s.scheduleParent(schedule); parent != 0 {
+			options.Mode = BackupModeIncremental
+			options.ParentID = parent
+		}
+	}
+
+	backup, err := s.CreateBackup(schedule.ProjectID, options)
+	updates := map[string]interface{}{"last_run_at": time.Now(), "last_error": ""}
+	if err != nil {
+		updates["last_error"] = err.Error()
+	} else {
+		updates["last_backup_id"] = backup.ID
+	}
+	s.db.Model(&models.BackupSchedule{}).Where("id = ?", schedule.ID).Updates(updates)
+	return backup, err
+}
+
+// scheduleParent returns the backup the next incremental backup of a schedule builds on, or zero
+// when a full backup is due
+func (s *BackupService) scheduleParent(schedule models.BackupSchedule) uint {
+	var recent []models.Backup
+	s.db.Where("schedule_id = ? AND status = ? AND format_version <> ?", schedule.ID, "completed", "1.0").
+		Order("created_at DESC").Limit(schedule.FullEvery).Find(&recent)
+
+	for i, backup := range recent {
+		if backup.Mode == BackupModeFull {
+			if i+1 < schedule.FullEvery {
+				return recent[0].ID
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// gfsRetain returns the backups a grandfather-father-son policy keeps: the newest backup of each
+// of the last daily days, weekly ISO weeks and monthly months that have backups, in a location.
+// The newest backup and the backups kept ones build on are always kept; with no limits at all,
+// every backup is. Backups are ordered newest first
+func gfsRetain(backups []models.Backup, daily, weekly, monthly int, location *time.Location) map[uint]bool {
+	kept := make(map[uint]bool, len(backups))
+	if len(backups) == 0 {
+		return kept
+	}
+	if daily == 0 && weekly == 0 && monthly == 0 {
+		for _, backup := range backups {
+			kept[backup.ID] = true
+		}
+		return kept
+	}
+
+	kept[backups[0].ID] = true
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	months := map[string]bool{}
+	for _, backup := range backups {
+		at := backup.CreatedAt.In(location)
+		day := at.Format("2006-01-02")
+		year, week := at.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		month := at.Format("2006-01")
+
+		if !days[day] && len(days) < daily {
+			days[day] = true
+			kept[backup.ID] = true
+		}
+		if !weeks[weekKey] && len(weeks) < weekly {
+			weeks[weekKey] = true
+			kept[backup.ID] = true
+		}
+		if !months[month] && len(months) < monthly {
+			months[month] = true
+			kept[backup.ID] = true
+		}
+	}
+
+	// Incremental backups cannot be restored without their parents
+	byID := make(map[uint]models.Backup, len(backups))
+	for _, backup := range backups {
+		byID[backup.ID] = backup
+	}
+	for _, backup := range backups {
+		if !kept[backup.ID] {
+			continue
+		}
+		for parent := backup.ParentID; parent != nil; {
+			ancestor, ok := byID[*parent]
+			if !ok || kept[ancestor.ID] {
+				break
+			}
+			kept[ancestor.ID] = true
+			parent = ancestor.ParentID
+		}
+	}
+	return kept
+}
+
+// BackupScheduler runs due backup schedules and prunes the backups their retention policies no
+// longer keep
+type BackupScheduler struct {
+	db      *gorm.DB
+	backups *BackupService
+	once    sync.Once
+}
+
+// NewBackupScheduler creates a new backup scheduler
+func NewBackupScheduler(db *gorm.DB, cfg *config.Config) *BackupScheduler {
+	return &BackupScheduler{db: db, backups: NewBackupService(db, cfg)}
+}
+
+// Start runs due schedules every minute and prunes every hour in the background
+func (s *BackupScheduler) Start() {
+	s.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(backupSchedulerInterval)
+			defer ticker.Stop()
+			var pruned time.Time
+			for {
+				if err := s.RunDue(time.Now()); err != nil {
+					log.Printf("Backup scheduler failed: %v", err)
+				}
+				if time.Since(pruned) >= backupPruneInterval {
+					if err := s.Prune(context.Background()); err != nil {
+						log.Printf("Backup pruning failed: %v", err)
+					}
+					pruned = time.Now()
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// RunDue runs the enabled schedules due at the given time. Each run is claimed by moving the
+// schedule's next run forward first, so several instances never run a schedule twice
+func (s *BackupScheduler) RunDue(now time.Time) error {
+	var schedules []models.BackupSchedule
+	if err := s.db.Where("enabled = ? AND next_run_at <= ?", true, now).Order("next_run_at").Limit(100).Find(&schedules).Error; err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		updates := map[string]interface{}{}
+		next, err := nextScheduledRun(schedule, now)
+		if err != nil {
+			// The schedule cannot run anymore, say after its time zone went away
+			updates["enabled"] = false
+			updates["next_run_at"] = nil
+			updates["last_error"] = err.Error()
+		} else {
+			updates["next_run_at"] = next
+		}
+		claim := s.db.Model(&models.BackupSchedule{}).
+			Where("id = ? AND next_run_at = ?", schedule.ID, schedule.NextRunAt).
+			Updates(updates)
+		if claim.Error != nil {
+			log.Printf("Failed to claim backup schedule %d: %v", schedule.ID, claim.Error)
+			continue
+		}
+		if claim.RowsAffected == 0 || err != nil {
+			continue
+		}
+
+		if _, err := s.backups.RunSchedule(schedule); err != nil {
+			log.Printf("Backup schedule %d did not run: %v", schedule.ID, err)
+		}
+	}
+	return nil
+}
+
+// Prune deletes the completed backups of each schedule its retention policy does not keep,
+// newest first so incremental backups go before the ones they build on
+func (s *BackupScheduler) Prune(ctx context.Context) error {
+	var schedules []models.BackupSchedule
+	if err := s.db.Where("keep_daily > 0 OR keep_weekly > 0 OR keep_monthly > 0").Find(&schedules).Error; err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		location, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			location = time.UTC
+		}
+		var backups []models.Backup
+		if err := s.db.Where("schedule_id = ? AND status = ?", schedule.ID, "completed").Order("created_at DESC").Find(&backups).Error; err != nil {
+			return err
+		}
+
+		kept := gfsRetain(backups, schedule.KeepDaily, schedule.KeepWeekly, schedule.KeepMonthly, location)
+		for _, backup := range backups {
+			if kept[backup.ID] {
+				continue
+			}
+			if err := s.backups.DeleteBackup(backup.ProjectID, backup.ID); err != nil && !errors.Is(err, ErrBackupInUse) {
+				log.Printf("Failed to prune backup %d of schedule %d: %v", backup.ID, schedule.ID, err)
+			}
+		}
+	}
+	return nil
+}
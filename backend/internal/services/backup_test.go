@@ -0,0 +1,363 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// testSQLiteDriver is SQLite with stand-ins for the Postgres functions queries call
+const testSQLiteDriver = "sqlite3_postgres_functions"
+
+func init() {
+	sql.Register(testSQLiteDriver, &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		// Notifications have no listeners in tests
+		return conn.RegisterFunc("pg_notify", func(channel, payload string) string { return "" }, false)
+	}})
+}
+
+// openTestDB opens an in-memory database with the tables of the given models
+func openTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Dialector{DriverName: testSQLiteDriver, DSN: "file::memory:"}, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	return db
+}
+
+// archive writes a backup archive to memory
+func archive(t *testing.T, data *BackupData, objects []backupObject) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	if _, err := writeBackupArchive(context.Background(), tarWriter, data, objects); err != nil {
+		t.Fatalf("writeBackupArchive: %v", err)
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return buffer.Bytes()
+}
+
+func TestBackupArchive(t *testing.T) {
+	ctx := context.Background()
+	backend := NewLocalStorage(t.TempDir())
+	backend.Put(ctx, "1/docs/a.txt", strings.NewReader("hello"), 5, "text/plain")
+
+	data := &BackupData{
+		Metadata:  BackupMetadata{ProjectID: 1, FormatVersion: BackupFormatVersion, Mode: BackupModeFull},
+		Documents: []models.Document{{ID: "d1", Data: map[string]interface{}{"title": "first"}}},
+		Files:     []models.File{{ID: "f1", FilePath: "1/docs/a.txt"}, {ID: "f2", FilePath: "1/docs/gone.txt"}},
+		APIKeys:   []BackupAPIKey{{APIKey: models.APIKey{Name: "server"}, KeyHash: "hash", HashAlgorithm: "hmac-sha256"}},
+	}
+	encoded := archive(t, data, []backupObject{
+		{path: backupBlobPrefix + "f1", backend: backend, key: "1/docs/a.txt"},
+		{path: backupBlobPrefix + "f2", backend: backend, key: "1/docs/gone.txt"}, // Deleted meanwhile
+		{path: backupFolderPrefix + "docs/drafts/" + FolderMarker},
+	})
+
+	objects := map[string]string{}
+	read, manifest, err := readBackupArchive(bytes.NewReader(encoded), func(name string, body io.Reader, size int64) error {
+		content, err := io.ReadAll(body)
+		objects[name] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("readBackupArchive: %v", err)
+	}
+
+	if len(read.Documents) != 1 || read.Documents[0].Data["title"] != "first" || len(read.Files) != 2 {
+		t.Errorf("read %+v and %+v, want the written rows", read.Documents, read.Files)
+	}
+	if read.APIKeys[0].KeyHash != "hash" || read.APIKeys[0].HashAlgorithm != "hmac-sha256" {
+		t.Errorf("API key read as %+v, want its hash kept", read.APIKeys[0])
+	}
+	if read.Metadata.Mode != BackupModeFull || read.BackupVersion != BackupFormatVersion {
+		t.Errorf("metadata = %+v, version %s", read.Metadata, read.BackupVersion)
+	}
+	if len(objects) != 2 || objects[backupBlobPrefix+"f1"] != "hello" || objects[backupFolderPrefix+"docs/drafts/"+FolderMarker] != "" {
+		t.Errorf("objects = %v, want the file and the folder marker", objects)
+	}
+
+	entries := map[string]BackupManifestEntry{}
+	for _, entry := range manifest.Entries {
+		entries[entry.Path] = entry
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	if blob := entries[backupBlobPrefix+"f1"]; blob.Size != 5 || blob.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("manifest entry of the file = %+v", blob)
+	}
+	if entries[backupTablePrefix+"files.json"].Rows != 2 {
+		t.Errorf("manifest entry of files = %+v, want 2 rows", entries[backupTablePrefix+"files.json"])
+	}
+	if _, ok := entries[backupTablePrefix+"document_ids.json"]; ok {
+		t.Error("full backup lists document IDs")
+	}
+	if _, ok := entries[backupBlobPrefix+"f2"]; ok {
+		t.Error("manifest lists a file that was gone")
+	}
+}
+
+func TestBackupArchiveCorrupt(t *testing.T) {
+	// An archive whose entry does not match the manifest
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	writeBackupEntry(tarWriter, backupBlobPrefix+"f1", strings.NewReader("tampered"), 8)
+	manifest := `{"metadata":{},"entries":[{"path":"blobs/f1","size":8,"sha256":"00"}]}`
+	writeBackupEntry(tarWriter, backupManifestName, strings.NewReader(manifest), int64(len(manifest)))
+	tarWriter.Close()
+	gzipWriter.Close()
+
+	if _, _, err := readBackupArchive(bytes.NewReader(buffer.Bytes()), nil); !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("readBackupArchive = %v, want ErrBackupCorrupt", err)
+	}
+
+	// And one cut short before its manifest
+	encoded := archive(t, &BackupData{Documents: []models.Document{{ID: "d1"}}}, nil)
+	var truncated bytes.Buffer
+	gzipReader, _ := gzip.NewReader(bytes.NewReader(encoded))
+	tarReader := tar.NewReader(gzipReader)
+	gzipWriter = gzip.NewWriter(&truncated)
+	tarWriter = tar.NewWriter(gzipWriter)
+	for {
+		header, err := tarReader.Next()
+		if err != nil || header.Name == backupManifestName {
+			break
+		}
+		writeBackupEntry(tarWriter, header.Name, tarReader, header.Size)
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+
+	if _, _, err := readBackupArchive(bytes.NewReader(truncated.Bytes()), nil); !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("readBackupArchive without manifest = %v, want ErrBackupCorrupt", err)
+	}
+}
+
+func TestMergeIncrementalBackup(t *testing.T) {
+	base := &BackupData{
+		Documents: []models.Document{{ID: "kept"}, {ID: "changed", Version: 1}, {ID: "deleted"}},
+		Files:     []models.File{{ID: "f1"}, {ID: "f2"}},
+		Buckets:   []models.Bucket{{Name: "old"}},
+	}
+	next := &BackupData{
+		Metadata:    BackupMetadata{Mode: BackupModeIncremental},
+		Documents:   []models.Document{{ID: "changed", Version: 2}, {ID: "added"}},
+		DocumentIDs: []string{"kept", "changed", "added"},
+		Files:       []models.File{},
+		FileIDs:     []string{"f2"},
+		Buckets:     []models.Bucket{{Name: "new"}},
+	}
+	mergeIncrementalBackup(base, next)
+
+	var documents []string
+	for _, document := range base.Documents {
+		documents = append(documents, document.ID)
+		if document.ID == "changed" && document.Version != 2 {
+			t.Errorf("changed document has version %d, want 2", document.Version)
+		}
+	}
+	if strings.Join(documents, ",") != "kept,changed,added" {
+		t.Errorf("documents = %v, want kept, changed and added", documents)
+	}
+	if len(base.Files) != 1 || base.Files[0].ID != "f2" {
+		t.Errorf("files = %+v, want f2", base.Files)
+	}
+	if len(base.Buckets) != 1 || base.Buckets[0].Name != "new" || base.Metadata.Mode != BackupModeIncremental {
+		t.Errorf("buckets = %+v, want those of the incremental backup", base.Buckets)
+	}
+	if base.DocumentIDs != nil || base.FileIDs != nil {
+		t.Error("merged backup keeps ID lists")
+	}
+}
+
+func TestBackupRowTables(t *testing.T) {
+	// The rows carrying hidden columns map to the tables of their models
+	cache := &sync.Map{}
+	for _, pair := range [][2]interface{}{
+		{&BackupGitHubRepository{}, &models.GitHubRepository{}},
+		{&BackupSSHKey{}, &models.SSHKey{}},
+		{&BackupAPIKey{}, &models.APIKey{}},
+		{&BackupAppUser{}, &models.AppUser{}},
+		{&BackupAppSession{}, &models.AppSession{}},
+		{&BackupAuthProvider{}, &models.AuthProvider{}},
+		{&BackupMailSettings{}, &models.ProjectMailSettings{}},
+	} {
+		row, err := schema.Parse(pair[0], cache, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		model, err := schema.Parse(pair[1], cache, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.Table != model.Table || len(row.DBNames) != len(model.DBNames) {
+			t.Errorf("%s maps to %s with %d columns, want %s with %d", row.Name, row.Table, len(row.DBNames), model.Table, len(model.DBNames))
+		}
+	}
+}
+
+func TestGFSRetain(t *testing.T) {
+	// Daily backups from Wednesday 2024-03-20 back to 2024-01-01, newest first, with an
+	// incremental one on the newest day building on a full one
+	var backups []models.Backup
+	id := uint(1000)
+	for day := time.Date(2024, 3, 20, 2, 0, 0, 0, time.UTC); !day.Before(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); day = day.AddDate(0, 0, -1) {
+		backups = append(backups, models.Backup{ID: id, CreatedAt: day})
+		id--
+	}
+	parent := uint(999)
+	latest := models.Backup{ID: 1001, CreatedAt: time.Date(2024, 3, 20, 14, 0, 0, 0, time.UTC), ParentID: &parent}
+	backups = append([]models.Backup{latest}, backups...)
+
+	kept := gfsRetain(backups, 3, 2, 3, time.UTC)
+	var got []string
+	for _, backup := range backups {
+		if kept[backup.ID] {
+			got = append(got, backup.CreatedAt.Format("01-02T15"))
+		}
+	}
+	// Three days, this week and the last one (ending Sunday the 17th), and three months; the
+	// morning backup of the 20th is no day's newest, but the latest builds on the 19th's
+	want := "03-20T14,03-19T02,03-18T02,03-17T02,02-29T02,01-31T02"
+	if strings.Join(got, ",") != want {
+		t.Errorf("kept %s, want %s", strings.Join(got, ","), want)
+	}
+
+	if kept := gfsRetain(backups, 0, 0, 0, time.UTC); len(kept) != len(backups) {
+		t.Errorf("no limits kept %d of %d backups", len(kept), len(backups))
+	}
+
+	// Days end at midnight of the location
+	tokyo := time.FixedZone("JST", 9*3600)
+	pair := []models.Backup{
+		{ID: 2, CreatedAt: time.Date(2024, 3, 20, 16, 0, 0, 0, time.UTC)}, // The 21st in Tokyo
+		{ID: 1, CreatedAt: time.Date(2024, 3, 20, 14, 0, 0, 0, time.UTC)},
+	}
+	if kept := gfsRetain(pair, 2, 0, 0, tokyo); !kept[1] || !kept[2] {
+		t.Errorf("kept %v in Tokyo, want both days", kept)
+	}
+	if kept := gfsRetain(pair, 2, 0, 0, time.UTC); kept[1] {
+		t.Errorf("kept %v in UTC, want one backup of the 20th", kept)
+	}
+}
+
+func TestEncryptedBackupArchive(t *testing.T) {
+	dir := t.TempDir()
+	service := &BackupService{cfg: &config.Config{MasterKey: "master"}, backupDir: dir}
+	backup := models.Backup{ID: 7, ProjectID: 3, Encrypted: true}
+	data := &BackupData{Documents: []models.Document{{ID: "d1"}}}
+
+	filePath := filepath.Join(dir, backupArchiveName(backup))
+	_, checksum, err := service.createBackupArchive(context.Background(), data, nil, filePath, backupEncryptionContext(backup))
+	if err != nil {
+		t.Fatalf("createBackupArchive: %v", err)
+	}
+	if encrypted, _ := os.ReadFile(filePath); bytes.Contains(encrypted, []byte("d1")) || bytes.HasPrefix(encrypted, []byte{0x1f, 0x8b}) {
+		t.Fatal("archive is not encrypted")
+	}
+	backup.FilePath = filePath
+	backup.Checksum = checksum
+
+	archive, done, err := service.openArchive(context.Background(), backup)
+	if err != nil {
+		t.Fatalf("openArchive: %v", err)
+	}
+	read, _, err := service.extractBackupData(archive, nil)
+	done()
+	if err != nil || len(read.Documents) != 1 || read.Documents[0].ID != "d1" {
+		t.Errorf("read %+v, %v", read, err)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Error("decrypted copy is left behind")
+	}
+
+	// Another backup's archive does not decrypt
+	other := backup
+	other.ID = 8
+	if _, _, err := service.openArchive(context.Background(), other); !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("openArchive of a swapped archive = %v, want ErrBackupCorrupt", err)
+	}
+}
+
+func TestBackupsOfOtherProjects(t *testing.T) {
+	db := openTestDB(t, &models.Project{}, &models.Backup{}, &models.Job{})
+	service := NewBackupService(db, &config.Config{BackupDir: t.TempDir()})
+
+	owner := models.Project{Name: "owner", Slug: "owner"}
+	other := models.Project{Name: "other", Slug: "other"}
+	db.Create(&owner)
+	db.Create(&other)
+	backup := models.Backup{Name: "nightly", ProjectID: owner.ID, Status: "completed"}
+	if err := db.Create(&backup).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.GetBackup(other.ID, backup.ID); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("GetBackup from another project: err = %v, want ErrBackupNotFound", err)
+	}
+	if _, err := service.GetManifest(other.ID, backup.ID); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("GetManifest from another project: err = %v, want ErrBackupNotFound", err)
+	}
+	if _, err := service.RestoreBackup(other.ID, backup.ID, RestoreOptions{TargetProjectID: other.ID, DryRun: true}); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("RestoreBackup from another project: err = %v, want ErrBackupNotFound", err)
+	}
+	if err := service.DeleteBackup(other.ID, backup.ID); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("DeleteBackup from another project: err = %v, want ErrBackupNotFound", err)
+	}
+
+	found, err := service.GetBackup(owner.ID, backup.ID)
+	if err != nil || found.ID != backup.ID {
+		t.Fatalf("GetBackup = %v, %v", found, err)
+	}
+	if err := service.DeleteBackup(owner.ID, backup.ID); err != nil {
+		t.Fatalf("DeleteBackup: %v", err)
+	}
+	if _, err := service.GetBackup(owner.ID, backup.ID); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("GetBackup after deleting: err = %v, want ErrBackupNotFound", err)
+	}
+}
+
+func TestSFTPDestinationCancel(t *testing.T) {
+	db := openTestDB(t, &models.SSHKey{})
+	cfg := &config.Config{MasterKey: "test-master-key", BackupDir: t.TempDir()}
+	service := NewBackupService(db, cfg)
+
+	sshKey := models.SSHKey{Name: "backups", PrivateKey: encryptedSSHKey(t, cfg.MasterKey), ProjectID: 1}
+	db.Create(&sshKey)
+	host, port, _ := strings.Cut(silentSSHServer(t), ":")
+	webServer := models.WebServer{Name: "storage", Hostname: host, Username: "backup", SSHKeyID: sshKey.ID, ProjectID: 1}
+	fmt.Sscan(port, &webServer.Port)
+
+	// A backup job cancelled while storing on a stuck server stops
+	backend := NewSFTPStorage(service.dialWebServer(webServer), "backups")
+	cancelledWithin(t, func(ctx context.Context) error {
+		return backend.Put(ctx, "project-1/backup.tar.gz", strings.NewReader("archive"), 7, "application/gzip")
+	})
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// ChangeFeedChannel is the PostgreSQL NOTIFY channel committed document writes are announced on
+const ChangeFeedChannel = "cloudbox_document_changes"
+
+// Change feed tuning
+const (
+	changeFeedNotifyBatch   = 500 // Sequences per NOTIFY payload (payloads are limited to 8000 bytes)
+	changeFeedBuffer        = 256 // Events buffered per subscriber before it is marked lagged
+	changeFeedScanBatch     = 500
+	changeFeedRetryDelay    = 250 * time.Millisecond // Rescan delay while earlier transactions are running
+	changeFeedRetention     = 7 * 24 * time.Hour
+	changeFeedPruneInterval = time.Hour
+)
+
+// ChangeNotification is the NOTIFY payload of a document write
+type ChangeNotification struct {
+	ProjectID  uint    `json:"p"`
+	Collection string  `json:"c"`
+	Sequences  []int64 `json:"s"`
+}
+
+// ChangePosition orders the change feed by writing transaction, then sequence. Sequences
+// are taken before commit, so a change can become visible after one with a higher
+// sequence; the feed only hands out changes whose transaction started before every
+// transaction still running, so no later commit can precede a position already passed.
+type ChangePosition struct {
+	XID      int64
+	Sequence int64
+}
+
+// ChangePositionOf returns the feed position of a change
+func ChangePositionOf(change models.DocumentChange) ChangePosition {
+	return ChangePosition{XID: change.XID, Sequence: change.Sequence}
+}
+
+// After reports whether p comes after other in the feed
+func (p ChangePosition) After(other ChangePosition) bool {
+	return p.XID > other.XID || (p.XID == other.XID && p.Sequence > other.Sequence)
+}
+
+// String encodes the position as the resume token handed to clients
+func (p ChangePosition) String() string {
+	return fmt.Sprintf("%d.%d", p.XID, p.Sequence)
+}
+
+// ParseChangePosition decodes a resume token
+func ParseChangePosition(token string) (ChangePosition, error) {
+	xid, sequence, ok := strings.Cut(token, ".")
+	if !ok {
+		return ChangePosition{}, fmt.Errorf("invalid change position %q", token)
+	}
+	var position ChangePosition
+	var err error
+	if position.XID, err = strconv.ParseInt(xid, 10, 64); err != nil || position.XID < 0 {
+		return ChangePosition{}, fmt.Errorf("invalid change position %q", token)
+	}
+	if position.Sequence, err = strconv.ParseInt(sequence, 10, 64); err != nil || position.Sequence < 0 {
+		return ChangePosition{}, fmt.Errorf("invalid change position %q", token)
+	}
+	return position, nil
+}
+
+// changeHorizon returns the oldest transaction still running. Transactions below it have
+// finished, and any change committed from now on belongs to a transaction at or above it.
+func changeHorizon(db *gorm.DB) (int64, error) {
+	var horizon int64
+	err := db.Raw("SELECT txid_snapshot_xmin(txid_current_snapshot())").Scan(&horizon).Error
+	return horizon, err
+}
+
+// ReadStableChanges returns up to limit changes of a collection after a position, in feed
+// order, stopping at the first change a running transaction could still precede. pending
+// reports that such later changes exist; they become readable once those transactions end.
+func ReadStableChanges(db *gorm.DB, projectID uint, collection string, after ChangePosition, limit int) ([]models.DocumentChange, bool, error) {
+	// Read the horizon first: a change visible to the later query with an older transaction
+	// was committed before every transaction that can still commit
+	horizon, err := changeHorizon(db)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var changes []models.DocumentChange
+	err = db.Where("project_id = ? AND collection_name = ? AND (xid, sequence) > (?, ?)",
+		projectID, collection, after.XID, after.Sequence).
+		Order("xid, sequence").Limit(limit).Find(&changes).Error
+	if err != nil {
+		return nil, false, err
+	}
+	for i, change := range changes {
+		if change.XID >= horizon {
+			return changes[:i], true, nil
+		}
+	}
+	return changes, false, nil
+}
+
+// ChangeSubscription receives the committed changes of one collection in feed order
+type ChangeSubscription struct {
+	ProjectID  uint
+	Collection string
+	Start      ChangePosition // Events follow this position
+	Events     chan models.DocumentChange
+	// Lagged is signalled when events were dropped (slow consumer); no further events are
+	// sent until the subscriber calls Recover and catches up from the document_changes table
+	Lagged chan struct{}
+	lagged atomic.Bool
+}
+
+// Recover resumes event delivery after Lagged; call it before catching up, then skip
+// events at or before the caught up position
+func (s *ChangeSubscription) Recover() {
+	s.lagged.Store(false)
+}
+
+type changeFeedKey struct {
+	projectID  uint
+	collection string
+}
+
+// ChangeFeed fans committed document changes out to the realtime subscribers of this process.
+// Writers announce changes with NotifyDocumentChanges inside their transaction; PostgreSQL only
+// delivers the notification on commit, to every instance listening. A notification makes the
+// feed read the collection from its last position with ReadStableChanges, so subscribers get
+// changes in feed order even when transactions commit out of sequence order.
+type ChangeFeed struct {
+	db          *gorm.DB
+	mutex       sync.RWMutex
+	subscribers map[changeFeedKey]map[*ChangeSubscription]struct{}
+
+	scanMutex sync.Mutex                       // Serializes reads of the feed; taken before mutex
+	heads     map[changeFeedKey]ChangePosition // Last published position of subscribed collections
+	retries   map[changeFeedKey]bool           // Collections with a pending rescan
+
+	once sync.Once
+}
+
+// NewChangeFeed creates a new change feed
+func NewChangeFeed(db *gorm.DB) *ChangeFeed {
+	return &ChangeFeed{
+		db:          db,
+		subscribers: make(map[changeFeedKey]map[*ChangeSubscription]struct{}),
+		heads:       make(map[changeFeedKey]ChangePosition),
+		retries:     make(map[changeFeedKey]bool),
+	}
+}
+
+// NotifyDocumentChanges announces recorded changes on the change feed channel.
+// Call it inside the writing transaction so subscribers are only notified on commit.
+func NotifyDocumentChanges(tx *gorm.DB, projectID uint, collection string, sequences []int64) error {
+	for start := 0; start < len(sequences); start += changeFeedNotifyBatch {
+		end := min(start+changeFeedNotifyBatch, len(sequences))
+		payload, err := json.Marshal(ChangeNotification{
+			ProjectID:  projectID,
+			Collection: collection,
+			Sequences:  sequences[start:end],
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec("SELECT pg_notify(?, ?)", ChangeFeedChannel, string(payload)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start listens for change notifications on the shared listener connection and prunes old
+// changes. It only starts once per feed.
+func (f *ChangeFeed) Start(databaseURL string) {
+	f.once.Do(func() {
+		// Changes committed while no connection was listening are only in the table
+		listenChannel(databaseURL, ChangeFeedChannel, f.scanAll, f.dispatch)
+		go f.prune()
+	})
+}
+
+// Subscribe registers a subscription for the changes of a collection after its current
+// position, which is returned as Start
+func (f *ChangeFeed) Subscribe(projectID uint, collection string) (*ChangeSubscription, error) {
+	key := changeFeedKey{projectID, collection}
+	f.scanMutex.Lock()
+	defer f.scanMutex.Unlock()
+
+	head, ok := f.heads[key]
+	if !ok {
+		// Every change of a transaction below the horizon is readable now and every later
+		// one sorts after it
+		horizon, err := changeHorizon(f.db)
+		if err != nil {
+			return nil, err
+		}
+		head = ChangePosition{XID: horizon}
+		f.heads[key] = head
+	}
+
+	subscription := &ChangeSubscription{
+		ProjectID:  projectID,
+		Collection: collection,
+		Start:      head,
+		Events:     make(chan models.DocumentChange, changeFeedBuffer),
+		Lagged:     make(chan struct{}, 1),
+	}
+
+	f.mutex.Lock()
+	if f.subscribers[key] == nil {
+		f.subscribers[key] = make(map[*ChangeSubscription]struct{})
+	}
+	f.subscribers[key][subscription] = struct{}{}
+	f.mutex.Unlock()
+
+	return subscription, nil
+}
+
+// Unsubscribe removes a subscription
+func (f *ChangeFeed) Unsubscribe(subscription *ChangeSubscription) {
+	key := changeFeedKey{subscription.ProjectID, subscription.Collection}
+	f.scanMutex.Lock()
+	defer f.scanMutex.Unlock()
+
+	f.mutex.Lock()
+	delete(f.subscribers[key], subscription)
+	if len(f.subscribers[key]) == 0 {
+		delete(f.subscribers, key)
+		delete(f.heads, key)
+	}
+	f.mutex.Unlock()
+}
+
+// publish delivers changes of one collection to its subscribers without blocking
+func (f *ChangeFeed) publish(key changeFeedKey, changes []models.DocumentChange) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	for subscription := range f.subscribers[key] {
+		for _, change := range changes {
+			if subscription.lagged.Load() {
+				break
+			}
+			select {
+			case subscription.Events <- change:
+			default:
+				subscription.lagged.Store(true)
+				signalLagged(subscription)
+			}
+		}
+	}
+}
+
+func signalLagged(subscription *ChangeSubscription) {
+	select {
+	case subscription.Lagged <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch publishes the changes of a collection a notification announced
+func (f *ChangeFeed) dispatch(payload string) {
+	var notification ChangeNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		log.Printf("Invalid change feed notification: %v", err)
+		return
+	}
+	if len(notification.Sequences) == 0 {
+		return
+	}
+
+	f.scanMutex.Lock()
+	defer f.scanMutex.Unlock()
+	f.scan(changeFeedKey{notification.ProjectID, notification.Collection})
+}
+
+// scanAll publishes the changes of every subscribed collection, e.g. after notifications may
+// have been missed
+func (f *ChangeFeed) scanAll() {
+	f.scanMutex.Lock()
+	defer f.scanMutex.Unlock()
+
+	for key := range f.heads {
+		f.scan(key)
+	}
+}
+
+// scan publishes the readable changes of a subscribed collection after its head and schedules
+// a rescan while running transactions hold later changes back. Callers hold scanMutex.
+func (f *ChangeFeed) scan(key changeFeedKey) {
+	head, ok := f.heads[key]
+	if !ok {
+		return
+	}
+
+	for {
+		changes, pending, err := ReadStableChanges(f.db, key.projectID, key.collection, head, changeFeedScanBatch)
+		if err != nil {
+			log.Printf("Failed to load document changes: %v", err)
+			f.retry(key)
+			return
+		}
+		if len(changes) > 0 {
+			f.publish(key, changes)
+			head = ChangePositionOf(changes[len(changes)-1])
+			f.heads[key] = head
+		}
+		if pending {
+			f.retry(key)
+		}
+		if pending || len(changes) < changeFeedScanBatch {
+			return
+		}
+	}
+}
+
+// retry rescans a collection shortly. Callers hold scanMutex.
+func (f *ChangeFeed) retry(key changeFeedKey) {
+	if f.retries[key] {
+		return
+	}
+	f.retries[key] = true
+
+	time.AfterFunc(changeFeedRetryDelay, func() {
+		f.scanMutex.Lock()
+		defer f.scanMutex.Unlock()
+		delete(f.retries, key)
+		f.scan(key)
+	})
+}
+
+// prune periodically removes changes older than the resume window
+func (f *ChangeFeed) prune() {
+	ticker := time.NewTicker(changeFeedPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-changeFeedRetention)
+		if err := f.db.Where("created_at < ?", cutoff).Delete(&models.DocumentChange{}).Error; err != nil {
+			log.Printf("Failed to prune document changes: %v", err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package services
+
+import "testing"
+
+func TestChangePositionOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     ChangePosition
+		other ChangePosition
+		after bool
+	}{
+		{"later transaction with a lower sequence", ChangePosition{XID: 101, Sequence: 10}, ChangePosition{XID: 100, Sequence: 11}, true},
+		{"same transaction, higher sequence", ChangePosition{XID: 100, Sequence: 12}, ChangePosition{XID: 100, Sequence: 11}, true},
+		{"equal", ChangePosition{XID: 100, Sequence: 11}, ChangePosition{XID: 100, Sequence: 11}, false},
+		{"earlier transaction with a higher sequence", ChangePosition{XID: 99, Sequence: 50}, ChangePosition{XID: 100, Sequence: 11}, false},
+		{"subscription start precedes the horizon transaction", ChangePosition{XID: 100, Sequence: 1}, ChangePosition{XID: 100}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.After(tt.other); got != tt.after {
+				t.Errorf("%v.After(%v) = %v, want %v", tt.p, tt.other, got, tt.after)
+			}
+		})
+	}
+}
+
+func TestParseChangePosition(t *testing.T) {
+	position, err := ParseChangePosition(ChangePosition{XID: 4294967396, Sequence: 42}.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != (ChangePosition{XID: 4294967396, Sequence: 42}) {
+		t.Errorf("round trip = %v", position)
+	}
+
+	for _, token := range []string{"", "42", "1.", ".1", "-1.2", "1.-2", "a.b", "1.2.3"} {
+		if _, err := ParseChangePosition(token); err == nil {
+			t.Errorf("ParseChangePosition(%q) should fail", token)
+		}
+	}
+}
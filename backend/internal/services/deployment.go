@@ -2,8 +2,10 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -15,6 +17,7 @@ import (
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/models"
 	"github.com/cloudbox/backend/internal/utils"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/ssh"
 	"gorm.io/gorm"
 )
@@ -72,20 +75,22 @@ type DeploymentResult struct {
 	DeployTime  int64
 	FileCount   int64
 	TotalSize   int64
+	Retryable   bool // Failed on the connection to the server, so running it again may succeed
 }
 
-// ExecuteDeployment performs a real deployment
-func (s *DeploymentService) ExecuteDeployment(deployment models.Deployment, commitHash, branch string) *DeploymentResult {
+// ExecuteDeployment performs a real deployment; cancelling the context stops it, closing its SSH
+// connection
+func (s *DeploymentService) ExecuteDeployment(ctx context.Context, deployment models.Deployment, commitHash, branch string) *DeploymentResult {
 	result := &DeploymentResult{}
 
 	// Update status to building
 	s.updateDeploymentStatus(deployment, "building", "Starting deployment process...\n", "", "")
 
 	// Step 1: Clone repository
-	repoDir, err := s.cloneRepository(deployment, commitHash, branch, result)
+	repoDir, err := s.cloneRepository(ctx, deployment, commitHash, branch, result)
 	if err != nil {
 		result.ErrorLogs = fmt.Sprintf("Failed to clone repository: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, "", result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, "", result.ErrorLogs)
 		return result
 	}
 	defer os.RemoveAll(repoDir) // Cleanup
@@ -93,15 +98,15 @@ func (s *DeploymentService) ExecuteDeployment(deployment models.Deployment, comm
 	// Step 2: Prepare deployment environment
 	if err := s.prepareDeploymentEnvironment(deployment, repoDir, result); err != nil {
 		result.ErrorLogs = fmt.Sprintf("Environment preparation failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, "", result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, "", result.ErrorLogs)
 		return result
 	}
 
 	// Step 3: Build application
 	buildTime := time.Now()
-	if err := s.buildApplication(deployment, repoDir, result); err != nil {
+	if err := s.buildApplication(ctx, deployment, repoDir, result); err != nil {
 		result.ErrorLogs = fmt.Sprintf("Build failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, "", result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, "", result.ErrorLogs)
 		return result
 	}
 	result.BuildTime = time.Since(buildTime).Milliseconds()
@@ -110,9 +115,10 @@ func (s *DeploymentService) ExecuteDeployment(deployment models.Deployment, comm
 	s.updateDeploymentStatus(deployment, "deploying", result.BuildLogs, "Connecting to deployment server...\n", "")
 	
 	deployTime := time.Now()
-	if err := s.deployToServer(deployment, repoDir, result); err != nil {
+	if err := s.deployToServer(ctx, deployment, repoDir, result); err != nil {
 		result.ErrorLogs = fmt.Sprintf("Deployment failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, result.DeployLogs, result.ErrorLogs)
+		result.Retryable = isConnectionError(err)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, result.DeployLogs, result.ErrorLogs)
 		return result
 	}
 	result.DeployTime = time.Since(deployTime).Milliseconds()
@@ -140,8 +146,9 @@ func (s *DeploymentService) ExecuteDeployment(deployment models.Deployment, comm
 	return result
 }
 
-// ExecuteCIPDeployment performs a CloudBox Install Protocol deployment via remote terminal
-func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, commitHash, branch string, outputCallback func(string, string)) *DeploymentResult {
+// ExecuteCIPDeployment performs a CloudBox Install Protocol deployment via remote terminal;
+// cancelling the context stops it, closing its terminal session
+func (s *DeploymentService) ExecuteCIPDeployment(ctx context.Context, deployment models.Deployment, commitHash, branch string, outputCallback func(string, string)) *DeploymentResult {
 	result := &DeploymentResult{}
 	
 	// Update status to building
@@ -151,7 +158,7 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 	var webServer models.WebServer
 	if err := s.db.Preload("SSHKey").First(&webServer, deployment.WebServerID).Error; err != nil {
 		result.ErrorLogs = fmt.Sprintf("Failed to load web server: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, "", result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, "", result.ErrorLogs)
 		return result
 	}
 	
@@ -178,7 +185,7 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 		decryptedPrivateKey, err = s.decryptSSHPrivateKey(privateKeyData)
 		if err != nil {
 			result.ErrorLogs = fmt.Sprintf("Failed to decrypt SSH private key: %v", err)
-			s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, "", result.ErrorLogs)
+			s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, "", result.ErrorLogs)
 			return result
 		}
 		log.Printf("[DEBUG SERVICE] SSH key decrypted successfully, length: %d", len(decryptedPrivateKey))
@@ -189,11 +196,12 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 
 	// Create terminal session
 	log.Printf("[DEBUG SERVICE] About to call CreateSession with WebServer ID: %d, SSH Key ID: %d", webServer.ID, webServer.SSHKeyID)
-	session, err := s.terminalService.CreateSession(webServer, deployment)
+	session, err := s.terminalService.CreateSession(ctx, webServer, deployment)
 	if err != nil {
 		log.Printf("[DEBUG SERVICE] CreateSession failed: %v", err)
 		result.ErrorLogs = fmt.Sprintf("Failed to create terminal session: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, "", result.ErrorLogs)
+		result.Retryable = isConnectionError(err)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, "", result.ErrorLogs)
 		return result
 	}
 	log.Printf("[DEBUG SERVICE] CreateSession succeeded")
@@ -215,15 +223,15 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 			outputCallback(output, logType)
 		}
 		
-		// Update database with latest logs
-		s.updateDeploymentStatus(deployment, "building", result.BuildLogs, result.DeployLogs, result.ErrorLogs)
+		// Update database with latest logs; the status is left to the deployment steps
+		s.updateDeploymentLogs(deployment, result.BuildLogs, result.DeployLogs, result.ErrorLogs)
 	}
 
 	// Step 1: Clone repository on remote server
 	buildTime := time.Now()
 	if err := s.remoteCIPClone(session, deployment, commitHash, branch); err != nil {
 		result.ErrorLogs += fmt.Sprintf("Remote clone failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, result.DeployLogs, result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, result.DeployLogs, result.ErrorLogs)
 		return result
 	}
 
@@ -233,7 +241,7 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 	deployTime := time.Now()
 	if err := s.terminalService.ExecuteCIPScript(session, "install", s.getDeploymentPath(deployment)); err != nil {
 		result.ErrorLogs += fmt.Sprintf("CIP install script failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, result.DeployLogs, result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, result.DeployLogs, result.ErrorLogs)
 		return result
 	}
 	result.BuildTime = time.Since(buildTime).Milliseconds()
@@ -241,7 +249,7 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 	// Step 3: Start application using CIP start script
 	if err := s.terminalService.ExecuteCIPScript(session, "start", s.getDeploymentPath(deployment)); err != nil {
 		result.ErrorLogs += fmt.Sprintf("CIP start script failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, result.DeployLogs, result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, result.DeployLogs, result.ErrorLogs)
 		return result
 	}
 	result.DeployTime = time.Since(deployTime).Milliseconds()
@@ -249,7 +257,7 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 	// Step 4: Health check using CIP health script
 	if err := s.verifyCIPDeployment(session, s.getDeploymentPath(deployment)); err != nil {
 		result.ErrorLogs += fmt.Sprintf("CIP health check failed: %v", err)
-		s.updateDeploymentStatus(deployment, "failed", result.BuildLogs, result.DeployLogs, result.ErrorLogs)
+		s.updateDeploymentStatus(deployment, failedStatus(ctx), result.BuildLogs, result.DeployLogs, result.ErrorLogs)
 		return result
 	}
 
@@ -272,6 +280,80 @@ func (s *DeploymentService) ExecuteCIPDeployment(deployment models.Deployment, c
 	return result
 }
 
+// runDeploymentJob runs a queued deployment. Deployments that fail are retried
+func (s *DeploymentService) runDeploymentJob(ctx context.Context, job *models.Job) error {
+	var payload deploymentJobPayload
+	if err := decodeJobPayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+	var deployment models.Deployment
+	if err := s.db.Preload("GitHubRepository").
+		Preload("WebServer").
+		Preload("WebServer.SSHKey").
+		First(&deployment, payload.DeploymentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return PermanentJobError(fmt.Errorf("deployment %d no longer exists", payload.DeploymentID))
+		}
+		return err
+	}
+
+	var result *DeploymentResult
+	if job.Type == JobTypeCIPDeployment {
+		result = s.ExecuteCIPDeployment(ctx, deployment, payload.CommitHash, payload.Branch, func(output, logType string) {
+			// Log to console for debugging
+			fmt.Printf("[CIP:%d] %s: %s\n", deployment.ID, logType, output)
+		})
+	} else {
+		result = s.ExecuteDeployment(ctx, deployment, payload.CommitHash, payload.Branch)
+	}
+
+	if result.Success {
+		log.Printf("Deployment %d completed in %dms (build: %dms, deploy: %dms)",
+			deployment.ID, result.BuildTime+result.DeployTime, result.BuildTime, result.DeployTime)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err := errors.New("deployment failed with unknown error")
+	if logs := strings.TrimSpace(result.ErrorLogs); logs != "" {
+		err = errors.New(logs)
+	}
+	// Clone, build and script failures would fail the same way again, after touching the server
+	// again; only deployments that lost their connection to it are retried
+	if !result.Retryable {
+		return PermanentJobError(err)
+	}
+	return err
+}
+
+// abortDeploymentJob marks the deployment of a job that will not run again as failed or
+// cancelled, unless other jobs of the deployment are still to report on it
+func (s *DeploymentService) abortDeploymentJob(job models.Job, status, reason string) {
+	var payload deploymentJobPayload
+	if decodeJobPayload(&job, &payload) != nil {
+		return
+	}
+	var pending int64
+	s.db.Model(&models.Job{}).
+		Where("lock_key = ? AND id <> ? AND status IN ?", job.LockKey, job.ID, []string{JobQueued, JobRunning}).
+		Count(&pending)
+	if pending > 0 {
+		return
+	}
+
+	deploymentStatus := "failed"
+	if status == JobCancelled {
+		deploymentStatus = "cancelled"
+	}
+	s.db.Model(&models.Deployment{}).
+		Where("id = ? AND status IN ?", payload.DeploymentID, []string{"pending", "building", "deploying"}).
+		Updates(map[string]interface{}{
+			"status":     deploymentStatus,
+			"error_logs": reason,
+		})
+}
+
 // remoteCIPClone clones repository directly on the remote server
 func (s *DeploymentService) remoteCIPClone(session *TerminalSession, deployment models.Deployment, commitHash, branch string) error {
 	deploymentPath := s.getDeploymentPath(deployment)
@@ -384,7 +466,7 @@ func (s *DeploymentService) runRemoteCommand(session *TerminalSession, command s
 }
 
 // cloneRepository clones the GitHub repository
-func (s *DeploymentService) cloneRepository(deployment models.Deployment, commitHash, branch string, result *DeploymentResult) (string, error) {
+func (s *DeploymentService) cloneRepository(ctx context.Context, deployment models.Deployment, commitHash, branch string, result *DeploymentResult) (string, error) {
 	result.BuildLogs += fmt.Sprintf("Cloning repository: %s (branch: %s)\n", deployment.GitHubRepository.Name, branch)
 	
 	// Create temporary directory
@@ -418,7 +500,7 @@ func (s *DeploymentService) cloneRepository(deployment models.Deployment, commit
 	}
 
 	// Clone repository
-	cloneCmd := exec.Command("git", "clone", "--depth", "1", "-b", branch, cloneURL, tempDir)
+	cloneCmd := exec.CommandContext(ctx, "git", "clone", "--depth", "1", "-b", branch, cloneURL, tempDir)
 	
 	// Set Git environment variables for Docker containers
 	cloneCmd.Env = append(os.Environ(),
@@ -441,7 +523,7 @@ func (s *DeploymentService) cloneRepository(deployment models.Deployment, commit
 	
 	// Checkout specific commit if provided and not "latest"
 	if commitHash != "" && commitHash != "latest" {
-		checkoutCmd := exec.Command("git", "checkout", commitHash)
+		checkoutCmd := exec.CommandContext(ctx, "git", "checkout", commitHash)
 		checkoutCmd.Dir = tempDir
 		checkoutCmd.Stdout = &stdout
 		checkoutCmd.Stderr = &stderr
@@ -460,14 +542,14 @@ func (s *DeploymentService) cloneRepository(deployment models.Deployment, commit
 }
 
 // buildApplication builds the application using the specified build command
-func (s *DeploymentService) buildApplication(deployment models.Deployment, repoDir string, result *DeploymentResult) error {
+func (s *DeploymentService) buildApplication(ctx context.Context, deployment models.Deployment, repoDir string, result *DeploymentResult) error {
 	if deployment.BuildCommand == "" {
 		result.BuildLogs += "No build command specified, skipping build step\n"
 		return nil
 	}
 
 	// Step 1: Install dependencies based on project type
-	if err := s.installDependencies(repoDir, result); err != nil {
+	if err := s.installDependencies(ctx, repoDir, result); err != nil {
 		result.BuildLogs += fmt.Sprintf("Dependency installation failed: %v\n", err)
 		return fmt.Errorf("failed to install dependencies: %w", err)
 	}
@@ -484,7 +566,7 @@ func (s *DeploymentService) buildApplication(deployment models.Deployment, repoD
 	result.BuildLogs += fmt.Sprintf("Running build command: %s\n", deployment.BuildCommand)
 
 	// Parse and execute build command (handle bash scripts properly)
-	cmd := s.createCommand(deployment.BuildCommand)
+	cmd := s.createCommand(ctx, deployment.BuildCommand)
 	cmd.Dir = repoDir
 	
 	// Set environment variables
@@ -519,9 +601,9 @@ func (s *DeploymentService) buildApplication(deployment models.Deployment, repoD
 }
 
 // deployToServer deploys the built application to the target server
-func (s *DeploymentService) deployToServer(deployment models.Deployment, repoDir string, result *DeploymentResult) error {
+func (s *DeploymentService) deployToServer(ctx context.Context, deployment models.Deployment, repoDir string, result *DeploymentResult) error {
 	// Create SSH client
-	client, err := s.createSSHClient(deployment)
+	client, err := s.createSSHClient(ctx, deployment)
 	if err != nil {
 		return fmt.Errorf("failed to create SSH connection: %w", err)
 	}
@@ -552,7 +634,7 @@ func (s *DeploymentService) deployToServer(deployment models.Deployment, repoDir
 
 	// Upload files using SCP
 	result.DeployLogs += "Uploading files to server...\n"
-	if err := s.uploadFiles(client, repoDir, absoluteDeployPath, result); err != nil {
+	if err := s.uploadFiles(ctx, client, repoDir, absoluteDeployPath, result); err != nil {
 		return fmt.Errorf("failed to upload files: %w", err)
 	}
 
@@ -594,7 +676,7 @@ func (s *DeploymentService) deployToServer(deployment models.Deployment, repoDir
 }
 
 // createSSHClient creates an SSH client connection
-func (s *DeploymentService) createSSHClient(deployment models.Deployment) (*ssh.Client, error) {
+func (s *DeploymentService) createSSHClient(ctx context.Context, deployment models.Deployment) (*ssh.Client, error) {
 	// First, decrypt the private key (SSH keys are stored encrypted)
 	decryptedPrivateKey, err := s.decryptSSHPrivateKey(deployment.WebServer.SSHKey.PrivateKey)
 	if err != nil {
@@ -623,7 +705,7 @@ func (s *DeploymentService) createSSHClient(deployment models.Deployment) (*ssh.
 	}
 
 	address := fmt.Sprintf("%s:%d", deployment.WebServer.Hostname, deployment.WebServer.Port)
-	client, err := ssh.Dial("tcp", address, config)
+	client, err := dialSSH(ctx, address, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
 	}
@@ -635,7 +717,7 @@ func (s *DeploymentService) createSSHClient(deployment models.Deployment) (*ssh.
 func (s *DeploymentService) executeSSHCommand(client *ssh.Client, command string) error {
 	session, err := client.NewSession()
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		return fmt.Errorf("failed to create session: %w", connectionError{err: err})
 	}
 	defer session.Close()
 
@@ -644,7 +726,7 @@ func (s *DeploymentService) executeSSHCommand(client *ssh.Client, command string
 	session.Stderr = &stderr
 
 	if err := session.Run(command); err != nil {
-		return fmt.Errorf("command failed: %s, stderr: %s", err, stderr.String())
+		return fmt.Errorf("command failed: %w, stderr: %s", sshCommandError(err), stderr.String())
 	}
 
 	return nil
@@ -654,7 +736,7 @@ func (s *DeploymentService) executeSSHCommand(client *ssh.Client, command string
 func (s *DeploymentService) executeSSHCommandWithOutput(client *ssh.Client, command string, output *string) error {
 	session, err := client.NewSession()
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		return fmt.Errorf("failed to create session: %w", connectionError{err: err})
 	}
 	defer session.Close()
 
@@ -663,7 +745,7 @@ func (s *DeploymentService) executeSSHCommandWithOutput(client *ssh.Client, comm
 	session.Stderr = &stderr
 
 	if err := session.Run(command); err != nil {
-		return fmt.Errorf("command failed: %s, stderr: %s", err, stderr.String())
+		return fmt.Errorf("command failed: %w, stderr: %s", sshCommandError(err), stderr.String())
 	}
 
 	*output = stdout.String()
@@ -671,19 +753,25 @@ func (s *DeploymentService) executeSSHCommandWithOutput(client *ssh.Client, comm
 }
 
 // uploadFiles uploads the built application files to the server
-func (s *DeploymentService) uploadFiles(client *ssh.Client, localPath, remotePath string, result *DeploymentResult) error {
+func (s *DeploymentService) uploadFiles(ctx context.Context, client *ssh.Client, localPath, remotePath string, result *DeploymentResult) error {
 	// This is a simplified file upload - in production, you'd want to use SCP or SFTP
 	// For now, we'll use tar and SSH to transfer files
 	
-	// Create tar archive
-	tarCmd := exec.Command("tar", "-czf", "/tmp/deploy.tar.gz", "-C", localPath, ".")
+	// Create tar archive; deployments run side by side, so each has its own
+	archive, err := os.CreateTemp("", "cloudbox-deploy-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create tar file: %w", err)
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	tarCmd := exec.CommandContext(ctx, "tar", "-czf", archive.Name(), "-C", localPath, ".")
 	if err := tarCmd.Run(); err != nil {
 		return fmt.Errorf("failed to create tar archive: %w", err)
 	}
-	defer os.Remove("/tmp/deploy.tar.gz")
 
 	// Read tar file
-	tarData, err := os.ReadFile("/tmp/deploy.tar.gz")
+	tarData, err := os.ReadFile(archive.Name())
 	if err != nil {
 		return fmt.Errorf("failed to read tar file: %w", err)
 	}
@@ -691,30 +779,31 @@ func (s *DeploymentService) uploadFiles(client *ssh.Client, localPath, remotePat
 	// Create SFTP client
 	sftpClient, err := client.NewSession()
 	if err != nil {
-		return fmt.Errorf("failed to create SFTP session: %w", err)
+		return fmt.Errorf("failed to create SFTP session: %w", connectionError{err: err})
 	}
 	defer sftpClient.Close()
 
 	// Upload and extract
-	uploadCmd := fmt.Sprintf("cat > /tmp/deploy.tar.gz && cd %s && tar -xzf /tmp/deploy.tar.gz && rm /tmp/deploy.tar.gz", remotePath)
+	remoteArchive := fmt.Sprintf("/tmp/cloudbox-deploy-%s.tar.gz", uuid.NewString())
+	uploadCmd := fmt.Sprintf("cat > %[1]s && cd %[2]s && tar -xzf %[1]s; status=$?; rm -f %[1]s; exit $status", remoteArchive, remotePath)
 	
 	stdin, err := sftpClient.StdinPipe()
 	if err != nil {
-		return fmt.Errorf("failed to get stdin pipe: %w", err)
+		return fmt.Errorf("failed to get stdin pipe: %w", connectionError{err: err})
 	}
 
 	if err := sftpClient.Start(uploadCmd); err != nil {
-		return fmt.Errorf("failed to start upload command: %w", err)
+		return fmt.Errorf("failed to start upload command: %w", connectionError{err: err})
 	}
 
 	// Write tar data to stdin
 	if _, err := stdin.Write(tarData); err != nil {
-		return fmt.Errorf("failed to write tar data: %w", err)
+		return fmt.Errorf("failed to write tar data: %w", connectionError{err: err})
 	}
 	stdin.Close()
 
 	if err := sftpClient.Wait(); err != nil {
-		return fmt.Errorf("upload command failed: %w", err)
+		return fmt.Errorf("upload command failed: %w", sshCommandError(err))
 	}
 
 	result.DeployLogs += fmt.Sprintf("Uploaded %d bytes to %s\n", len(tarData), remotePath)
@@ -789,8 +878,33 @@ func (s *DeploymentService) updateDeploymentStatus(deployment models.Deployment,
 	s.db.Model(&deployment).Updates(updates)
 }
 
+// updateDeploymentLogs updates the logs of a deployment in database, leaving its status
+func (s *DeploymentService) updateDeploymentLogs(deployment models.Deployment, buildLogs, deployLogs, errorLogs string) {
+	updates := map[string]interface{}{}
+	if buildLogs != "" {
+		updates["build_logs"] = buildLogs
+	}
+	if deployLogs != "" {
+		updates["deploy_logs"] = deployLogs
+	}
+	if errorLogs != "" {
+		updates["error_logs"] = errorLogs
+	}
+	if len(updates) > 0 {
+		s.db.Model(&deployment).Updates(updates)
+	}
+}
+
+// failedStatus is the status of a deployment whose step failed: cancelled when its context was
+func failedStatus(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	return "failed"
+}
+
 // installDependencies automatically installs dependencies based on project type
-func (s *DeploymentService) installDependencies(repoDir string, result *DeploymentResult) error {
+func (s *DeploymentService) installDependencies(ctx context.Context, repoDir string, result *DeploymentResult) error {
 	result.BuildLogs += "Installing project dependencies...\n"
 	
 	// Check for Node.js projects (package.json)
@@ -798,7 +912,7 @@ func (s *DeploymentService) installDependencies(repoDir string, result *Deployme
 		result.BuildLogs += "Detected Node.js project (package.json found)\n"
 		
 		// Run npm install
-		installCmd := exec.Command("npm", "install")
+		installCmd := exec.CommandContext(ctx, "npm", "install")
 		installCmd.Dir = repoDir
 		
 		var stdout, stderr bytes.Buffer
@@ -825,7 +939,7 @@ func (s *DeploymentService) installDependencies(repoDir string, result *Deployme
 		result.BuildLogs += "Detected Python project (requirements.txt found)\n"
 		
 		// Run pip install
-		installCmd := exec.Command("pip3", "install", "-r", "requirements.txt")
+		installCmd := exec.CommandContext(ctx, "pip3", "install", "-r", "requirements.txt")
 		installCmd.Dir = repoDir
 		
 		var stdout, stderr bytes.Buffer
@@ -852,7 +966,7 @@ func (s *DeploymentService) installDependencies(repoDir string, result *Deployme
 		result.BuildLogs += "Detected Python project (pyproject.toml found)\n"
 		
 		// Run pip install with current directory
-		installCmd := exec.Command("pip3", "install", ".")
+		installCmd := exec.CommandContext(ctx, "pip3", "install", ".")
 		installCmd.Dir = repoDir
 		
 		var stdout, stderr bytes.Buffer
@@ -879,7 +993,7 @@ func (s *DeploymentService) installDependencies(repoDir string, result *Deployme
 		result.BuildLogs += "Detected Go project (go.mod found)\n"
 		
 		// Run go mod download
-		installCmd := exec.Command("go", "mod", "download")
+		installCmd := exec.CommandContext(ctx, "go", "mod", "download")
 		installCmd.Dir = repoDir
 		
 		var stdout, stderr bytes.Buffer
@@ -1071,29 +1185,29 @@ func (s *DeploymentService) shellEscape(str string) string {
 }
 
 // createCommand creates a properly configured command for execution
-func (s *DeploymentService) createCommand(commandStr string) *exec.Cmd {
+func (s *DeploymentService) createCommand(ctx context.Context, commandStr string) *exec.Cmd {
 	// Handle bash scripts and complex commands
 	if strings.HasPrefix(commandStr, "bash ") || strings.Contains(commandStr, "&&") || strings.Contains(commandStr, "||") || strings.Contains(commandStr, "|") {
 		// Use bash for complex commands or explicit bash commands
-		return exec.Command("bash", "-c", commandStr)
+		return exec.CommandContext(ctx, "bash", "-c", commandStr)
 	}
 	
 	// Handle sh scripts
 	if strings.HasPrefix(commandStr, "sh ") {
-		return exec.Command("sh", "-c", commandStr)
+		return exec.CommandContext(ctx, "sh", "-c", commandStr)
 	}
 	
 	// For simple commands, parse arguments normally
 	cmdParts := strings.Fields(commandStr)
 	if len(cmdParts) == 0 {
-		return exec.Command("sh", "-c", "echo 'Empty command'")
+		return exec.CommandContext(ctx, "sh", "-c", "echo 'Empty command'")
 	}
 	
 	if len(cmdParts) == 1 {
-		return exec.Command(cmdParts[0])
+		return exec.CommandContext(ctx, cmdParts[0])
 	}
 	
-	return exec.Command(cmdParts[0], cmdParts[1:]...)
+	return exec.CommandContext(ctx, cmdParts[0], cmdParts[1:]...)
 }
 
 // CheckPortAvailability checks if ports are available on the target server
@@ -294,8 +294,9 @@ func (s *GitHubService) SearchRepositories(query, accessToken string, limit int)
 	return searchResult.Items, nil
 }
 
-// CreateWebhook creates a webhook for a repository
-func (s *GitHubService) CreateWebhook(repository *models.GitHubRepository, webhookURL, accessToken string) error {
+// CreateWebhook creates a webhook for a repository, signing deliveries with the decrypted
+// webhook secret of the repository
+func (s *GitHubService) CreateWebhook(repository *models.GitHubRepository, webhookURL, secret, accessToken string) error {
 	parts := strings.Split(repository.FullName, "/")
 	if len(parts) != 2 {
 		return fmt.Errorf("invalid repository full name format: %s", repository.FullName)
@@ -309,7 +310,7 @@ func (s *GitHubService) CreateWebhook(repository *models.GitHubRepository, webho
 		"config": map[string]interface{}{
 			"url":          webhookURL,
 			"content_type": "json",
-			"secret":       repository.WebhookSecret,
+			"secret":       secret,
 			"insecure_ssl": "0",
 		},
 	}
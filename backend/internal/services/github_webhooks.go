@@ -0,0 +1,289 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/utils"
+	"gorm.io/gorm"
+)
+
+// Outcomes of webhook deliveries
+const (
+	WebhookDeliveryProcessing = "processing"
+	WebhookDeliveryProcessed  = "processed"
+	WebhookDeliveryIgnored    = "ignored"
+	WebhookDeliveryRejected   = "rejected"
+	WebhookDeliveryFailed     = "failed"
+)
+
+const (
+	// MaxWebhookPayloadSize is the largest payload GitHub delivers
+	MaxWebhookPayloadSize = 25 << 20
+	// webhookDeliveryRetention is how long deliveries are logged, well past the days GitHub
+	// redelivers within
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+	// webhookRejectLogBudget is how many rejected deliveries of a repository are logged a minute
+	webhookRejectLogBudget = 10
+	// webhookRejectedKept is how many rejected deliveries of a repository are kept
+	webhookRejectedKept = 100
+)
+
+var (
+	// ErrWebhookSecretUnavailable is returned storing webhook secrets without a master key
+	ErrWebhookSecretUnavailable = errors.New("MASTER_KEY must be configured to store webhook secrets")
+	// ErrWebhookSignature is returned for payloads without a valid X-Hub-Signature-256
+	ErrWebhookSignature = errors.New("missing or invalid webhook signature")
+	// ErrWebhookDuplicate is returned for deliveries received before
+	ErrWebhookDuplicate = errors.New("webhook delivery was already received")
+)
+
+// legacyWebhookSecret matches the secrets stored in the clear before they were encrypted
+var legacyWebhookSecret = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type webhookRejectWindow struct {
+	start  time.Time
+	logged int
+}
+
+// WebhookService handles the secrets and deliveries of GitHub webhooks
+type WebhookService struct {
+	db  *gorm.DB
+	cfg *config.Config
+
+	mutex      sync.Mutex
+	rejections map[uint]webhookRejectWindow // By repository
+}
+
+// NewWebhookService creates a new webhook service
+func NewWebhookService(db *gorm.DB, cfg *config.Config) *WebhookService {
+	return &WebhookService{db: db, cfg: cfg, rejections: make(map[uint]webhookRejectWindow)}
+}
+
+// NewSecret generates a webhook secret for a repository, setting it encrypted on the repository,
+// and returns it for configuring the webhook on GitHub
+func (s *WebhookService) NewSecret(repository *models.GitHubRepository) (string, error) {
+	if s.cfg.MasterKey == "" {
+		return "", ErrWebhookSecretUnavailable
+	}
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(bytes)
+
+	encrypted, err := utils.EncryptSecret(secret, s.cfg.MasterKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt webhook secret: %w", err)
+	}
+	repository.WebhookSecret = encrypted
+	return secret, nil
+}
+
+// Secret returns the webhook secret of a repository, empty if it has none. Secrets stored in the
+// clear are encrypted on the way
+func (s *WebhookService) Secret(repository *models.GitHubRepository) (string, error) {
+	if repository.WebhookSecret == "" {
+		return "", nil
+	}
+	if s.cfg.MasterKey == "" {
+		return "", ErrWebhookSecretUnavailable
+	}
+	secret, err := utils.DecryptSecret(repository.WebhookSecret, s.cfg.MasterKey)
+	if err == nil {
+		return secret, nil
+	}
+	if !legacyWebhookSecret.MatchString(repository.WebhookSecret) {
+		return "", fmt.Errorf("failed to decrypt webhook secret: %w", err)
+	}
+
+	secret = repository.WebhookSecret
+	encrypted, err := utils.EncryptSecret(secret, s.cfg.MasterKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt webhook secret: %w", err)
+	}
+	if err := s.db.Model(repository).Update("webhook_secret", encrypted).Error; err != nil {
+		return "", fmt.Errorf("failed to store webhook secret: %w", err)
+	}
+	return secret, nil
+}
+
+// VerifyWebhookSignature checks the X-Hub-Signature-256 header of a delivery against the
+// HMAC-SHA256 of its payload; there is nothing to check against without a secret
+func VerifyWebhookSignature(secret string, payload []byte, header string) error {
+	if secret == "" {
+		return ErrWebhookSignature
+	}
+	signature, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return ErrWebhookSignature
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+// ReceiveDelivery logs a verified delivery as processing. Deliveries with the ID or the payload
+// of one accepted before are replays, and fail with ErrWebhookDuplicate
+func (s *WebhookService) ReceiveDelivery(repository models.GitHubRepository, deliveryID, event string, payload []byte) (*models.WebhookDelivery, error) {
+	sum := sha256.Sum256(payload)
+	delivery := &models.WebhookDelivery{
+		DeliveryID:    deliveryID,
+		Event:         event,
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+		Payload:       string(payload),
+		Status:        WebhookDeliveryProcessing,
+		RepositoryID:  repository.ID,
+		ProjectID:     repository.ProjectID,
+	}
+
+	accepted := s.db.Model(&models.WebhookDelivery{}).
+		Where("repository_id = ? AND status <> ? AND redelivery_of_id IS NULL", repository.ID, WebhookDeliveryRejected)
+	if deliveryID != "" {
+		accepted = accepted.Where("delivery_id = ? OR payload_sha256 = ?", deliveryID, delivery.PayloadSHA256)
+	} else {
+		accepted = accepted.Where("payload_sha256 = ?", delivery.PayloadSHA256)
+	}
+	var count int64
+	if err := accepted.Count(&count).Error; err != nil {
+		return nil, fmt.Errorf("failed to check webhook delivery: %w", err)
+	}
+	if count > 0 {
+		return nil, ErrWebhookDuplicate
+	}
+
+	if err := s.db.Create(delivery).Error; err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return nil, ErrWebhookDuplicate
+		}
+		return nil, fmt.Errorf("failed to log webhook delivery: %w", err)
+	}
+
+	s.pruneDeliveries(repository.ID)
+	return delivery, nil
+}
+
+// RejectDelivery logs a delivery refused for its signature; its payload is not kept. Anyone who
+// knows the webhook URL can send these, so at most webhookRejectLogBudget are logged per
+// repository and minute, and only the newest webhookRejectedKept are kept
+func (s *WebhookService) RejectDelivery(repository models.GitHubRepository, deliveryID, event string, payload []byte, statusCode int, message string) {
+	if !s.logRejection(repository.ID, time.Now()) {
+		return
+	}
+
+	sum := sha256.Sum256(payload)
+	s.db.Create(&models.WebhookDelivery{
+		DeliveryID:    deliveryID,
+		Event:         event,
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+		Status:        WebhookDeliveryRejected,
+		StatusCode:    statusCode,
+		Message:       message,
+		RepositoryID:  repository.ID,
+		ProjectID:     repository.ProjectID,
+	})
+	s.pruneRejected(repository.ID)
+}
+
+// logRejection reports whether a rejected delivery of a repository is within the budget of
+// the current minute
+func (s *WebhookService) logRejection(repositoryID uint, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	window := s.rejections[repositoryID]
+	if now.Sub(window.start) >= time.Minute {
+		window = webhookRejectWindow{start: now}
+	}
+	if window.logged >= webhookRejectLogBudget {
+		return false
+	}
+	window.logged++
+	s.rejections[repositoryID] = window
+	return true
+}
+
+// Redeliver logs a redelivery of a verified delivery as processing, to be handled again
+func (s *WebhookService) Redeliver(original models.WebhookDelivery) (*models.WebhookDelivery, error) {
+	delivery := &models.WebhookDelivery{
+		DeliveryID:     original.DeliveryID,
+		Event:          original.Event,
+		PayloadSHA256:  original.PayloadSHA256,
+		Payload:        original.Payload,
+		Status:         WebhookDeliveryProcessing,
+		RedeliveryOfID: &original.ID,
+		RepositoryID:   original.RepositoryID,
+		ProjectID:      original.ProjectID,
+	}
+	if err := s.db.Create(delivery).Error; err != nil {
+		return nil, fmt.Errorf("failed to log webhook redelivery: %w", err)
+	}
+	return delivery, nil
+}
+
+// FinishDelivery records how a delivery was handled
+func (s *WebhookService) FinishDelivery(delivery *models.WebhookDelivery, status string, statusCode int, message string) {
+	delivery.Status = status
+	delivery.StatusCode = statusCode
+	delivery.Message = message
+	s.db.Model(delivery).Updates(map[string]interface{}{
+		"status":      status,
+		"status_code": statusCode,
+		"message":     message,
+	})
+}
+
+// ListDeliveries returns the logged deliveries of a repository, newest first, without payloads
+func (s *WebhookService) ListDeliveries(projectID, repositoryID uint, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	err := s.db.Omit("payload").
+		Where("project_id = ? AND repository_id = ?", projectID, repositoryID).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&deliveries).Error
+	return deliveries, err
+}
+
+// GetDelivery returns a logged delivery of a repository with its payload
+func (s *WebhookService) GetDelivery(projectID, repositoryID, deliveryID uint) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	if err := s.db.Where("id = ? AND project_id = ? AND repository_id = ?", deliveryID, projectID, repositoryID).First(&delivery).Error; err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// pruneDeliveries drops the deliveries of a repository logged longer than the retention ago
+func (s *WebhookService) pruneDeliveries(repositoryID uint) {
+	s.db.Where("repository_id = ? AND created_at < ?", repositoryID, time.Now().Add(-webhookDeliveryRetention)).
+		Delete(&models.WebhookDelivery{})
+}
+
+// pruneRejected drops old deliveries of a repository and all but the newest rejected ones
+func (s *WebhookService) pruneRejected(repositoryID uint) {
+	s.pruneDeliveries(repositoryID)
+
+	newest := s.db.Model(&models.WebhookDelivery{}).Select("id").
+		Where("repository_id = ? AND status = ?", repositoryID, WebhookDeliveryRejected).
+		Order("id DESC").Limit(webhookRejectedKept)
+	s.db.Where("repository_id = ? AND status = ? AND id NOT IN (?)", repositoryID, WebhookDeliveryRejected, newest).
+		Delete(&models.WebhookDelivery{})
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	payload := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(payload)
+	valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if err := VerifyWebhookSignature("secret", payload, valid); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	for name, check := range map[string]struct {
+		secret, header string
+		payload        []byte
+	}{
+		"unsigned":       {"secret", "", payload},
+		"sha1":           {"secret", "sha1=" + valid[7:], payload},
+		"not hex":        {"secret", "sha256=zz", payload},
+		"other secret":   {"other", valid, payload},
+		"tampered":       {"secret", valid, []byte(`{"ref":"refs/heads/evil"}`)},
+		"no secret":      {"", valid, payload},
+		"truncated hmac": {"secret", valid[:len(valid)-2], payload},
+	} {
+		if err := VerifyWebhookSignature(check.secret, check.payload, check.header); !errors.Is(err, ErrWebhookSignature) {
+			t.Errorf("%s: %v, want ErrWebhookSignature", name, err)
+		}
+	}
+}
+
+func TestWebhookSecret(t *testing.T) {
+	service := NewWebhookService(nil, &config.Config{MasterKey: "master"})
+	var repository models.GitHubRepository
+	secret, err := service.NewSecret(&repository)
+	if err != nil {
+		t.Fatalf("NewSecret: %v", err)
+	}
+	if len(secret) != 64 || repository.WebhookSecret == "" || repository.WebhookSecret == secret {
+		t.Fatalf("secret %q stored as %q, want it encrypted", secret, repository.WebhookSecret)
+	}
+	if stored, err := service.Secret(&repository); err != nil || stored != secret {
+		t.Errorf("Secret = %q, %v, want %q", stored, err, secret)
+	}
+
+	if stored, err := service.Secret(&models.GitHubRepository{}); err != nil || stored != "" {
+		t.Errorf("Secret of a repository without one = %q, %v", stored, err)
+	}
+	if _, err := service.Secret(&models.GitHubRepository{WebhookSecret: "garbage"}); err == nil {
+		t.Error("Secret of an undecryptable value succeeded")
+	}
+
+	unconfigured := NewWebhookService(nil, &config.Config{})
+	if _, err := unconfigured.NewSecret(&repository); !errors.Is(err, ErrWebhookSecretUnavailable) {
+		t.Errorf("NewSecret without a master key = %v, want ErrWebhookSecretUnavailable", err)
+	}
+}
+
+func TestRejectDeliveryIsBounded(t *testing.T) {
+	db := openTestDB(t, &models.WebhookDelivery{})
+	service := NewWebhookService(db, &config.Config{})
+	repository := models.GitHubRepository{ID: 4, ProjectID: 2}
+
+	count := func(status string) int64 {
+		var n int64
+		db.Model(&models.WebhookDelivery{}).Where("repository_id = ? AND status = ?", repository.ID, status).Count(&n)
+		return n
+	}
+
+	// A flood of unsigned requests is sampled
+	for i := 0; i < 3*webhookRejectLogBudget; i++ {
+		service.RejectDelivery(repository, "", "push", []byte("{}"), 401, "Missing or invalid webhook signature")
+	}
+	if got := count(WebhookDeliveryRejected); got != webhookRejectLogBudget {
+		t.Errorf("logged %d rejected deliveries within a minute, want %d", got, webhookRejectLogBudget)
+	}
+	if service.logRejection(repository.ID, time.Now()) {
+		t.Error("budget of the minute was not used up")
+	}
+	if !service.logRejection(repository.ID, time.Now().Add(time.Minute)) {
+		t.Error("budget did not reset after a minute")
+	}
+
+	// Rejected deliveries beyond the newest are pruned, the others are kept
+	for i := 0; i < 2*webhookRejectedKept; i++ {
+		db.Create(&models.WebhookDelivery{Status: WebhookDeliveryRejected, RepositoryID: repository.ID, ProjectID: 2})
+	}
+	db.Create(&models.WebhookDelivery{Status: WebhookDeliveryProcessed, RepositoryID: repository.ID, ProjectID: 2})
+	db.Create(&models.WebhookDelivery{Status: WebhookDeliveryRejected, RepositoryID: 5, ProjectID: 2})
+	newest := models.WebhookDelivery{Status: WebhookDeliveryRejected, RepositoryID: repository.ID, ProjectID: 2}
+	db.Create(&newest)
+
+	service.pruneRejected(repository.ID)
+	if got := count(WebhookDeliveryRejected); got != webhookRejectedKept {
+		t.Errorf("kept %d rejected deliveries, want %d", got, webhookRejectedKept)
+	}
+	if got := count(WebhookDeliveryProcessed); got != 1 {
+		t.Errorf("kept %d processed deliveries, want 1", got)
+	}
+	if err := db.First(&models.WebhookDelivery{}, newest.ID).Error; err != nil {
+		t.Errorf("newest rejected delivery was pruned: %v", err)
+	}
+	var others int64
+	db.Model(&models.WebhookDelivery{}).Where("repository_id = ?", 5).Count(&others)
+	if others != 1 {
+		t.Errorf("deliveries of another repository were pruned")
+	}
+}
@@ -0,0 +1,525 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Originals may be GIFs; the first frame is transformed
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+)
+
+// Image transformation limits
+const (
+	MaxImageDimension   = 4096       // Width and height of variants
+	maxImagePixels      = 40_000_000 // Of originals, against decompression bombs
+	maxImageBytes       = 64 << 20   // Of originals
+	defaultImageQuality = 82
+
+	imageCacheSweepInterval = 6 * time.Hour
+)
+
+// Image transformation errors
+var (
+	ErrInvalidImageTransform = errors.New("invalid image transformation")
+	ErrNotAnImage            = errors.New("file is not a supported image")
+	ErrImageTooLarge         = errors.New("image too large to transform")
+	ErrWebPUnavailable       = errors.New("WebP is not available on this server")
+)
+
+// imageFormats maps the formats of variants to their MIME types
+var imageFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// ImageVariant is a transformed image in the cache
+type ImageVariant struct {
+	Path        string
+	ContentType string
+	Key         string // Changes with the original and the transformation
+}
+
+// ParseImageTransform reads the transformation parameters of an image URL: w, h, fit, crop,
+// format and q. It reports false when there are none.
+func ParseImageTransform(query url.Values) (models.ImageTransform, bool, error) {
+	var transform models.ImageTransform
+	present := false
+	for _, name := range []string{"w", "h", "fit", "crop", "format", "q"} {
+		present = present || query.Has(name)
+	}
+	if !present {
+		return transform, false, nil
+	}
+
+	for name, value := range map[string]*int{"w": &transform.Width, "h": &transform.Height, "q": &transform.Quality} {
+		if raw := query.Get(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return transform, true, fmt.Errorf("%w: %s must be a number", ErrInvalidImageTransform, name)
+			}
+			*value = n
+		}
+	}
+	transform.Fit = query.Get("fit")
+	transform.Crop = query.Get("crop")
+	transform.Format = strings.ToLower(query.Get("format"))
+	if transform.Format == "jpg" {
+		transform.Format = "jpeg"
+	}
+	return transform, true, ValidateImageTransform(transform)
+}
+
+// ValidateImageTransform checks the parameters of a transformation
+func ValidateImageTransform(transform models.ImageTransform) error {
+	if transform.Width < 0 || transform.Width > MaxImageDimension || transform.Height < 0 || transform.Height > MaxImageDimension {
+		return fmt.Errorf("%w: width and height must be between 1 and %d", ErrInvalidImageTransform, MaxImageDimension)
+	}
+	switch transform.Fit {
+	case "", "contain", "cover", "fill":
+	default:
+		return fmt.Errorf("%w: fit must be contain, cover or fill", ErrInvalidImageTransform)
+	}
+	if transform.Crop != "" {
+		if _, err := parseImageCrop(transform.Crop); err != nil {
+			return err
+		}
+	}
+	if _, ok := imageFormats[transform.Format]; !ok && transform.Format != "" {
+		return fmt.Errorf("%w: format must be jpeg, png or webp", ErrInvalidImageTransform)
+	}
+	if transform.Quality < 0 || transform.Quality > 100 {
+		return fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidImageTransform)
+	}
+	return nil
+}
+
+// parseImageCrop parses a crop rectangle given as x,y,width,height
+func parseImageCrop(crop string) (image.Rectangle, error) {
+	fields := strings.Split(crop, ",")
+	values := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 0 {
+			values = nil
+			break
+		}
+		values[i] = n
+	}
+	if len(values) != 4 || values[2] == 0 || values[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("%w: crop must be x,y,width,height", ErrInvalidImageTransform)
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// ImageService generates variants of images and caches them on disk, keyed by the checksum
+// of the original and the transformation
+type ImageService struct {
+	cfg   *config.Config
+	root  string
+	slots chan struct{} // Limits concurrent transformations to the number of CPUs
+	once  sync.Once
+}
+
+// NewImageService creates a new image service
+func NewImageService(cfg *config.Config) *ImageService {
+	root := cfg.ImageCachePath
+	if root == "" {
+		root = "./cache/images"
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return &ImageService{cfg: cfg, root: root, slots: make(chan struct{}, runtime.NumCPU())}
+}
+
+// Start deletes variants that were not served for a while periodically in the background
+func (s *ImageService) Start() {
+	s.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(imageCacheSweepInterval)
+			defer ticker.Stop()
+			for {
+				if err := s.Sweep(); err != nil {
+					log.Printf("Image cache sweep failed: %v", err)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// Sweep deletes the variants that were not served within the cache TTL. Serving a variant
+// touches its modification time.
+func (s *ImageService) Sweep() error {
+	ttl := s.cfg.ImageCacheTTL
+	if ttl <= 0 {
+		ttl = 30 * 24 * time.Hour
+	}
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > ttl {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// variantFormat returns the format of a variant: the requested one, or the original's
+func variantFormat(transform models.ImageTransform, file models.File) string {
+	if transform.Format != "" {
+		return transform.Format
+	}
+	mimeType := file.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(file.OriginalName))
+	}
+	switch strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0])) {
+	case "image/png", "image/gif":
+		return "png"
+	case "image/webp":
+		return "webp"
+	}
+	return "jpeg"
+}
+
+// Variant returns a transformed image of a file, generating it unless it is cached
+func (s *ImageService) Variant(ctx context.Context, file models.File, backend StorageBackend, transform models.ImageTransform) (ImageVariant, error) {
+	if err := ValidateImageTransform(transform); err != nil {
+		return ImageVariant{}, err
+	}
+
+	// Normalize, so equivalent transformations share a variant
+	transform.Format = variantFormat(transform, file)
+	if transform.Fit == "" {
+		transform.Fit = "contain"
+	}
+	if transform.Format == "png" {
+		transform.Quality = 0
+	} else if transform.Quality == 0 {
+		transform.Quality = defaultImageQuality
+	}
+	source := file.Checksum
+	if source == "" {
+		source = fmt.Sprintf("%s@%d", file.ID, file.UpdatedAt.UnixNano())
+	}
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s\nw=%d\nh=%d\nfit=%s\ncrop=%s\nformat=%s\nq=%d", source,
+		transform.Width, transform.Height, transform.Fit, transform.Crop, transform.Format, transform.Quality))))
+	extension := map[string]string{"jpeg": ".jpg", "png": ".png", "webp": ".webp"}[transform.Format]
+	variant := ImageVariant{
+		Path:        filepath.Join(s.root, key[:2], key+extension),
+		ContentType: imageFormats[transform.Format],
+		Key:         key,
+	}
+
+	if _, err := os.Stat(variant.Path); err == nil {
+		now := time.Now()
+		os.Chtimes(variant.Path, now, now)
+		return variant, nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return ImageVariant{}, ctx.Err()
+	}
+
+	body, _, err := backend.Get(ctx, file.FilePath)
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxImageBytes+1))
+	body.Close()
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	if len(data) > maxImageBytes {
+		return ImageVariant{}, ErrImageTooLarge
+	}
+
+	img, err := decodeImage(ctx, data)
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	img = orientImage(img, jpegOrientation(data))
+	if img, err = transformImage(img, transform); err != nil {
+		return ImageVariant{}, err
+	}
+
+	// Re-encoding drops all metadata of the original, EXIF included
+	encoded, err := encodeImage(ctx, img, transform.Format, transform.Quality)
+	if err != nil {
+		return ImageVariant{}, err
+	}
+	if err := writeFileAtomic(variant.Path, encoded); err != nil {
+		return ImageVariant{}, err
+	}
+	return variant, nil
+}
+
+// writeFileAtomic writes a file through a temporary file, so readers never see it partially
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".variant-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// decodeImage decodes a JPEG, PNG, GIF or WebP image into RGBA
+func decodeImage(ctx context.Context, data []byte) (*image.RGBA, error) {
+	switch http.DetectContentType(data) {
+	case "image/jpeg", "image/png", "image/gif":
+	case "image/webp":
+		decoded, err := runWebPTool(ctx, "dwebp", data, ".webp", ".png")
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	default:
+		return nil, ErrNotAnImage
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAnImage, err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAnImage, err)
+	}
+	return toRGBA(img), nil
+}
+
+// encodeImage encodes an image in a variant format
+func encodeImage(ctx context.Context, img *image.RGBA, format string, quality int) ([]byte, error) {
+	var buffer bytes.Buffer
+	switch format {
+	case "jpeg":
+		// JPEG has no transparency; flatten onto white
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err := jpeg.Encode(&buffer, flat, &jpeg.Options{Quality: quality})
+		return buffer.Bytes(), err
+	case "png":
+		err := png.Encode(&buffer, img)
+		return buffer.Bytes(), err
+	case "webp":
+		if err := png.Encode(&buffer, img); err != nil {
+			return nil, err
+		}
+		return runWebPTool(ctx, "cwebp", buffer.Bytes(), ".png", ".webp", "-q", strconv.Itoa(quality), "-metadata", "none")
+	}
+	return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidImageTransform, format)
+}
+
+// runWebPTool converts an image with cwebp or dwebp of libwebp
+func runWebPTool(ctx context.Context, tool string, input []byte, inputExtension, outputExtension string, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, ErrWebPUnavailable
+	}
+	dir, err := os.MkdirTemp("", "cloudbox-webp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	inputPath := filepath.Join(dir, "input"+inputExtension)
+	outputPath := filepath.Join(dir, "output"+outputExtension)
+	if err := os.WriteFile(inputPath, input, 0600); err != nil {
+		return nil, err
+	}
+	args = append(append([]string{"-quiet"}, args...), inputPath, "-o", outputPath)
+	if output, err := exec.CommandContext(ctx, path, args...).CombinedOutput(); err != nil {
+		if tool == "dwebp" {
+			return nil, fmt.Errorf("%w: %s", ErrNotAnImage, strings.TrimSpace(string(output)))
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", tool, err, strings.TrimSpace(string(output)))
+	}
+	return os.ReadFile(outputPath)
+}
+
+// toRGBA copies an image into RGBA with its origin at 0,0
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// transformImage crops and resizes an image as a transformation says
+func transformImage(img *image.RGBA, transform models.ImageTransform) (*image.RGBA, error) {
+	if transform.Crop != "" {
+		crop, err := parseImageCrop(transform.Crop)
+		if err != nil {
+			return nil, err
+		}
+		crop = crop.Intersect(img.Bounds())
+		if crop.Empty() {
+			return nil, fmt.Errorf("%w: crop is outside the image", ErrInvalidImageTransform)
+		}
+		img = toRGBA(img.SubImage(crop))
+	}
+
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	width, height := transform.Width, transform.Height
+	switch {
+	case width == 0 && height == 0:
+		return img, nil
+	case height == 0:
+		height = scaleDimension(sh, float64(width)/float64(sw))
+	case width == 0:
+		width = scaleDimension(sw, float64(height)/float64(sh))
+	case transform.Fit == "cover":
+		// Crop the middle of the image to the aspect ratio of the box, which it then fills
+		cw, ch := sw, sh
+		if sw*height > sh*width {
+			cw = scaleDimension(sh, float64(width)/float64(height))
+		} else {
+			ch = scaleDimension(sw, float64(height)/float64(width))
+		}
+		x, y := (sw-cw)/2, (sh-ch)/2
+		img = toRGBA(img.SubImage(image.Rect(x, y, x+cw, y+ch)))
+	case transform.Fit == "fill":
+	default:
+		// contain: the largest size within the box
+		scale := math.Min(float64(width)/float64(sw), float64(height)/float64(sh))
+		width, height = scaleDimension(sw, scale), scaleDimension(sh, scale)
+	}
+
+	if width > MaxImageDimension || height > MaxImageDimension {
+		return nil, fmt.Errorf("%w: the variant would exceed %d pixels", ErrInvalidImageTransform, MaxImageDimension)
+	}
+	return resampleImage(img, width, height), nil
+}
+
+// scaleDimension scales a dimension, to at least a pixel
+func scaleDimension(n int, scale float64) int {
+	return max(1, int(math.Round(float64(n)*scale)))
+}
+
+// resampleImage resizes an image with a triangle filter that widens when scaling down, so
+// every source pixel contributes
+func resampleImage(src *image.RGBA, width, height int) *image.RGBA {
+	if src.Bounds().Dx() == width && src.Bounds().Dy() == height {
+		return src
+	}
+	horizontal := resampleAxis(src, width, src.Bounds().Dy(), true)
+	return resampleAxis(horizontal, width, height, false)
+}
+
+// resampleTap is the weight of a source pixel in a destination pixel
+type resampleTap struct {
+	index  int
+	weight float64
+}
+
+// resampleWeights returns the taps of each destination pixel along an axis
+func resampleWeights(srcLength, dstLength int) [][]resampleTap {
+	scale := float64(srcLength) / float64(dstLength)
+	support := math.Max(scale, 1)
+	weights := make([][]resampleTap, dstLength)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		var taps []resampleTap
+		var total float64
+		for j := int(math.Floor(center - support)); j <= int(math.Ceil(center+support)); j++ {
+			weight := 1 - math.Abs(float64(j)-center)/support
+			if weight <= 0 {
+				continue
+			}
+			index := min(max(j, 0), srcLength-1)
+			taps = append(taps, resampleTap{index, weight})
+			total += weight
+		}
+		for k := range taps {
+			taps[k].weight /= total
+		}
+		weights[i] = taps
+	}
+	return weights
+}
+
+// resampleAxis resizes an image along one axis to width x height
+func resampleAxis(src *image.RGBA, width, height int, horizontal bool) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	var weights [][]resampleTap
+	if horizontal {
+		weights = resampleWeights(src.Bounds().Dx(), width)
+	} else {
+		weights = resampleWeights(src.Bounds().Dy(), height)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var taps []resampleTap
+			if horizontal {
+				taps = weights[x]
+			} else {
+				taps = weights[y]
+			}
+			var sum [4]float64
+			for _, tap := range taps {
+				offset := src.PixOffset(tap.index, y)
+				if !horizontal {
+					offset = src.PixOffset(x, tap.index)
+				}
+				for c := 0; c < 4; c++ {
+					sum[c] += float64(src.Pix[offset+c]) * tap.weight
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[offset+c] = uint8(min(max(math.Round(sum[c]), 0), 255))
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestParseImageTransform(t *testing.T) {
+	if _, requested, _ := ParseImageTransform(url.Values{"signature": {"x"}}); requested {
+		t.Error("a URL without transformation parameters requests a transformation")
+	}
+
+	transform, requested, err := ParseImageTransform(url.Values{"w": {"320"}, "fit": {"cover"}, "format": {"JPG"}, "q": {"70"}, "crop": {"10,20,300,200"}})
+	want := models.ImageTransform{Width: 320, Fit: "cover", Format: "jpeg", Quality: 70, Crop: "10,20,300,200"}
+	if !requested || err != nil || transform != want {
+		t.Errorf("ParseImageTransform = %+v, %v, %v; want %+v", transform, requested, err, want)
+	}
+
+	for _, query := range []url.Values{
+		{"w": {"wide"}},
+		{"w": {"5000"}},
+		{"h": {"-1"}},
+		{"fit": {"stretch"}},
+		{"format": {"bmp"}},
+		{"q": {"101"}},
+		{"crop": {"1,2,3"}},
+		{"crop": {"0,0,0,10"}},
+	} {
+		if _, _, err := ParseImageTransform(query); !errors.Is(err, ErrInvalidImageTransform) {
+			t.Errorf("ParseImageTransform(%v) = %v, want ErrInvalidImageTransform", query, err)
+		}
+	}
+}
+
+// withEXIFOrientation inserts an EXIF segment with an orientation into a JPEG image
+func withEXIFOrientation(jpegData []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // Entries
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1) // Count
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // Padding and next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	return append(append(append([]byte{}, jpegData[:2]...), segment...), jpegData[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	var buffer bytes.Buffer
+	jpeg.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 2)), nil)
+
+	if got := jpegOrientation(buffer.Bytes()); got != 1 {
+		t.Errorf("orientation without EXIF = %d, want 1", got)
+	}
+	if got := jpegOrientation(withEXIFOrientation(buffer.Bytes(), 6)); got != 6 {
+		t.Errorf("orientation = %d, want 6", got)
+	}
+	if got := jpegOrientation([]byte("not a jpeg")); got != 1 {
+		t.Errorf("orientation of garbage = %d, want 1", got)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// A 2x1 image: red, then blue
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		first       color.RGBA // Top left pixel
+	}{
+		{1, image.Pt(2, 1), red},
+		{2, image.Pt(2, 1), blue},
+		{3, image.Pt(2, 1), blue},
+		{6, image.Pt(1, 2), red},  // Turned clockwise, red ends on top
+		{8, image.Pt(1, 2), blue}, // Turned counterclockwise, blue ends on top
+	}
+	for _, tt := range tests {
+		got := orientImage(src, tt.orientation)
+		if got.Bounds().Size() != tt.size || got.RGBAAt(0, 0) != tt.first {
+			t.Errorf("orientation %d: %v with %v on top left, want %v with %v", tt.orientation, got.Bounds().Size(), got.RGBAAt(0, 0), tt.size, tt.first)
+		}
+	}
+}
+
+func TestTransformImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	tests := []struct {
+		transform models.ImageTransform
+		want      image.Point
+	}{
+		{models.ImageTransform{}, image.Pt(400, 200)},
+		{models.ImageTransform{Width: 100}, image.Pt(100, 50)},
+		{models.ImageTransform{Height: 50}, image.Pt(100, 50)},
+		{models.ImageTransform{Width: 100, Height: 100}, image.Pt(100, 50)},
+		{models.ImageTransform{Width: 100, Height: 100, Fit: "cover"}, image.Pt(100, 100)},
+		{models.ImageTransform{Width: 100, Height: 100, Fit: "fill"}, image.Pt(100, 100)},
+		{models.ImageTransform{Crop: "100,0,100,100"}, image.Pt(100, 100)},
+		{models.ImageTransform{Crop: "350,150,100,100"}, image.Pt(50, 50)},
+	}
+	for _, tt := range tests {
+		got, err := transformImage(src, tt.transform)
+		if err != nil || got.Bounds().Size() != tt.want {
+			t.Errorf("transformImage(%+v) = %v, %v; want %v", tt.transform, got.Bounds().Size(), err, tt.want)
+		}
+	}
+
+	if _, err := transformImage(src, models.ImageTransform{Crop: "500,0,10,10"}); !errors.Is(err, ErrInvalidImageTransform) {
+		t.Errorf("crop outside the image = %v, want ErrInvalidImageTransform", err)
+	}
+	if _, err := transformImage(src, models.ImageTransform{Height: 4000}); !errors.Is(err, ErrInvalidImageTransform) {
+		t.Errorf("variant wider than the maximum = %v, want ErrInvalidImageTransform", err)
+	}
+}
+
+func TestResampleImageAverages(t *testing.T) {
+	// Alternating black and white columns average to grey
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+	got := resampleImage(src, 2, 2)
+	left, right := got.RGBAAt(0, 1), got.RGBAAt(1, 1)
+	if mean := (int(left.R) + int(right.R)) / 2; mean < 120 || mean > 135 || left.A != 255 {
+		t.Errorf("downscaled pixels = %v, %v; want grey on average", left, right)
+	}
+}
+
+func TestImageVariant(t *testing.T) {
+	ctx := context.Background()
+	backend := NewLocalStorage(t.TempDir())
+	service := NewImageService(&config.Config{ImageCachePath: t.TempDir()})
+
+	original := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			original.Set(x, y, color.RGBA{200, 0, 0, 255})
+		}
+	}
+	var buffer bytes.Buffer
+	png.Encode(&buffer, original)
+	if err := backend.Put(ctx, "1/photos/a.png", bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	file := models.File{ID: "a", FilePath: "1/photos/a.png", MimeType: "image/png", OriginalName: "a.png", Checksum: "abc"}
+
+	variant, err := service.Variant(ctx, file, backend, models.ImageTransform{Width: 10, Format: "jpeg"})
+	if err != nil {
+		t.Fatalf("Variant: %v", err)
+	}
+	if variant.ContentType != "image/jpeg" {
+		t.Errorf("content type = %s, want image/jpeg", variant.ContentType)
+	}
+	data, err := os.ReadFile(variant.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil || decoded.Bounds().Size() != image.Pt(10, 5) {
+		t.Fatalf("variant is %v (%v), want a 10x5 JPEG", decoded.Bounds().Size(), err)
+	}
+
+	// Served from the cache once generated, even without the original
+	backend.Delete(ctx, file.FilePath)
+	cached, err := service.Variant(ctx, file, backend, models.ImageTransform{Width: 10, Format: "jpeg", Fit: "contain", Quality: defaultImageQuality})
+	if err != nil || cached != variant {
+		t.Errorf("equivalent transformation = %+v, %v; want the cached %+v", cached, err, variant)
+	}
+
+	// Another version of the file has another checksum
+	file.Checksum = "def"
+	if _, err := service.Variant(ctx, file, backend, models.ImageTransform{Width: 10, Format: "jpeg"}); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("variant of a missing original = %v, want ErrObjectNotFound", err)
+	}
+
+	if err := backend.Put(ctx, "1/photos/b.txt", bytes.NewReader([]byte("hello")), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	text := models.File{ID: "b", FilePath: "1/photos/b.txt", Checksum: "ghi"}
+	if _, err := service.Variant(ctx, text, backend, models.ImageTransform{Width: 10}); !errors.Is(err, ErrNotAnImage) {
+		t.Errorf("variant of a text file = %v, want ErrNotAnImage", err)
+	}
+}
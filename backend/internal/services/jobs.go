@@ -0,0 +1,648 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Types of jobs
+const (
+	JobTypeDeployment    = "deployment"
+	JobTypeCIPDeployment = "cip_deployment"
+	JobTypeBackup        = "backup"
+	JobTypeFunctionBuild = "function_build"
+)
+
+// States of jobs
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+const (
+	// jobPollInterval is how often due jobs are looked for
+	jobPollInterval = 2 * time.Second
+	// jobHeartbeatInterval is how often running jobs are confirmed alive and checked for
+	// cancellation
+	jobHeartbeatInterval = 5 * time.Second
+	// jobStaleAfter is how long a running job may go without a heartbeat before it is taken to
+	// be interrupted
+	jobStaleAfter = time.Minute
+	// jobPruneInterval is how often finished jobs are pruned
+	jobPruneInterval = time.Hour
+	// jobRetention is how long finished jobs are kept
+	jobRetention = 30 * 24 * time.Hour
+	// defaultJobWorkers is how many jobs an instance runs at once unless configured
+	defaultJobWorkers = 4
+	// defaultJobMaxAttempts is how often a job runs before it fails for good
+	defaultJobMaxAttempts = 3
+	// jobBackoffBase and jobBackoffMax bound the wait before a failed job runs again
+	jobBackoffBase = 30 * time.Second
+	jobBackoffMax  = 30 * time.Minute
+)
+
+var (
+	// ErrJobNotFound is returned for jobs the project does not have
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished is returned cancelling jobs that are no longer queued or running
+	ErrJobFinished = errors.New("job has already finished")
+)
+
+// permanentJobError is the error of a job that would fail the same way if it ran again
+type permanentJobError struct {
+	err error
+}
+
+func (e permanentJobError) Error() string { return e.err.Error() }
+func (e permanentJobError) Unwrap() error { return e.err }
+
+// PermanentJobError marks the error of a job as one retrying does not help with
+func PermanentJobError(err error) error {
+	return permanentJobError{err: err}
+}
+
+// jobRunner runs the jobs of a type. Abort settles what a job was about when it ends without
+// running to its end: cancelled while queued, or given up on after it was interrupted
+type jobRunner struct {
+	run   func(ctx context.Context, job *models.Job) error
+	abort func(job models.Job, status, reason string)
+}
+
+// JobQueue keeps long-running tasks in the database and runs them in the background. Jobs with
+// the same lock key run one at a time in the order they were queued, failed jobs are retried
+// with backoff, and the jobs of an instance that went away are taken over by the others
+type JobQueue struct {
+	db       *gorm.DB
+	cfg      *config.Config
+	workerID string
+	once     sync.Once
+
+	runnersOnce sync.Once
+	runners     map[string]jobRunner
+
+	mutex   sync.Mutex
+	running int
+}
+
+// NewJobQueue creates a new job queue
+func NewJobQueue(db *gorm.DB, cfg *config.Config) *JobQueue {
+	return &JobQueue{db: db, cfg: cfg, workerID: uuid.NewString()}
+}
+
+// DeploymentLockKey is the lock key of the jobs of a deployment
+func DeploymentLockKey(deploymentID uint) string {
+	return fmt.Sprintf("deployment:%d", deploymentID)
+}
+
+// backupLockKey is the lock key of the job creating a backup
+func backupLockKey(backupID uint) string {
+	return fmt.Sprintf("backup:%d", backupID)
+}
+
+// deploymentJobPayload is what a deployment job deploys
+type deploymentJobPayload struct {
+	DeploymentID uint   `json:"deployment_id"`
+	CommitHash   string `json:"commit_hash"`
+	Branch       string `json:"branch"`
+}
+
+// backupJobPayload is the backup a backup job creates
+type backupJobPayload struct {
+	BackupID uint `json:"backup_id"`
+}
+
+// functionBuildJobPayload is the function a function build job builds
+type functionBuildJobPayload struct {
+	FunctionID uint `json:"function_id"`
+}
+
+// NewDeploymentJob returns a job deploying a commit of a branch, through the CloudBox Install
+// Protocol when cip is set
+func NewDeploymentJob(deployment models.Deployment, cip bool, commitHash, branch string) *models.Job {
+	jobType := JobTypeDeployment
+	if cip {
+		jobType = JobTypeCIPDeployment
+	}
+	return &models.Job{
+		Type:      jobType,
+		LockKey:   DeploymentLockKey(deployment.ID),
+		Payload:   jobPayload(deploymentJobPayload{DeploymentID: deployment.ID, CommitHash: commitHash, Branch: branch}),
+		ProjectID: deployment.ProjectID,
+	}
+}
+
+// NewBackupJob returns a job creating the archive of a backup
+func NewBackupJob(backup models.Backup) *models.Job {
+	return &models.Job{
+		Type:      JobTypeBackup,
+		LockKey:   backupLockKey(backup.ID),
+		Payload:   jobPayload(backupJobPayload{BackupID: backup.ID}),
+		ProjectID: backup.ProjectID,
+	}
+}
+
+// NewFunctionBuildJob returns a job building and deploying a function
+func NewFunctionBuildJob(function models.Function) *models.Job {
+	return &models.Job{
+		Type:      JobTypeFunctionBuild,
+		LockKey:   fmt.Sprintf("function:%d", function.ID),
+		Payload:   jobPayload(functionBuildJobPayload{FunctionID: function.ID}),
+		ProjectID: function.ProjectID,
+	}
+}
+
+// jobPayload converts a payload struct to the JSON object stored with a job
+func jobPayload(payload interface{}) map[string]interface{} {
+	data, _ := json.Marshal(payload)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// decodeJobPayload reads the payload of a job into a payload struct
+func decodeJobPayload(job *models.Job, payload interface{}) error {
+	data, err := json.Marshal(job.Payload)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, payload); err != nil {
+		return fmt.Errorf("invalid payload of job %d: %w", job.ID, err)
+	}
+	return nil
+}
+
+// Enqueue queues a job to run once a worker is free and the jobs of its lock key queued before
+// it have finished
+func (q *JobQueue) Enqueue(job *models.Job) error {
+	job.Status = JobQueued
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = defaultJobMaxAttempts
+	}
+	if job.RunAfter.IsZero() {
+		job.RunAfter = time.Now()
+	}
+	if err := q.db.Create(job).Error; err != nil {
+		return fmt.Errorf("failed to queue job: %w", err)
+	}
+	return nil
+}
+
+// JobFilter narrows the jobs listed; empty fields match every job
+type JobFilter struct {
+	Type    string
+	Status  string
+	LockKey string
+}
+
+// ListJobs returns the jobs of a project, newest first
+func (q *JobQueue) ListJobs(projectID uint, filter JobFilter, limit int) ([]models.Job, error) {
+	query := q.db.Where("project_id = ?", projectID)
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.LockKey != "" {
+		query = query.Where("lock_key = ?", filter.LockKey)
+	}
+
+	var jobs []models.Job
+	err := query.Order("created_at DESC, id DESC").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+// GetJob returns a job of a project
+func (q *JobQueue) GetJob(projectID, jobID uint) (*models.Job, error) {
+	var job models.Job
+	if err := q.db.Where("id = ? AND project_id = ?", jobID, projectID).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelJob cancels a job of a project. Queued jobs are cancelled right away; running ones stop
+// once their worker notices, within a heartbeat
+func (q *JobQueue) CancelJob(projectID, jobID uint) (*models.Job, error) {
+	job, err := q.GetJob(projectID, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.cancel(*job); err != nil {
+		return nil, err
+	}
+	return q.GetJob(projectID, jobID)
+}
+
+// CancelJobs cancels the queued and running jobs of a project with a lock key, returning them
+func (q *JobQueue) CancelJobs(projectID uint, lockKey string) ([]models.Job, error) {
+	var jobs []models.Job
+	if err := q.db.Where("project_id = ? AND lock_key = ? AND status IN ?", projectID, lockKey, []string{JobQueued, JobRunning}).
+		Order("id").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	var cancelled []models.Job
+	for _, job := range jobs {
+		if err := q.cancel(job); err != nil {
+			if errors.Is(err, ErrJobFinished) {
+				continue
+			}
+			return cancelled, err
+		}
+		cancelled = append(cancelled, job)
+	}
+	return cancelled, nil
+}
+
+// cancel cancels a queued job, or asks the worker of a running one to stop it
+func (q *JobQueue) cancel(job models.Job) error {
+	now := time.Now()
+	queued := q.db.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, JobQueued).
+		Updates(map[string]interface{}{
+			"status":           JobCancelled,
+			"cancel_requested": true,
+			"finished_at":      &now,
+		})
+	if queued.Error != nil {
+		return queued.Error
+	}
+	if queued.RowsAffected > 0 {
+		q.abort(job, JobCancelled, "Cancelled before it ran")
+		return nil
+	}
+
+	running := q.db.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, JobRunning).
+		Update("cancel_requested", true)
+	if running.Error != nil {
+		return running.Error
+	}
+	if running.RowsAffected == 0 {
+		return ErrJobFinished
+	}
+	return nil
+}
+
+// Start runs due jobs in the background, taking over interrupted ones every minute and pruning
+// finished ones every hour
+func (q *JobQueue) Start() {
+	q.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(jobPollInterval)
+			defer ticker.Stop()
+			var recovered, pruned time.Time
+			for {
+				if time.Since(recovered) >= jobStaleAfter {
+					if err := q.Recover(time.Now()); err != nil {
+						log.Printf("Job recovery failed: %v", err)
+					}
+					recovered = time.Now()
+				}
+				if time.Since(pruned) >= jobPruneInterval {
+					if err := q.Prune(time.Now()); err != nil {
+						log.Printf("Job pruning failed: %v", err)
+					}
+					pruned = time.Now()
+				}
+				if err := q.RunDue(time.Now()); err != nil {
+					log.Printf("Job queue failed: %v", err)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// RunDue claims the jobs due at the given time while workers are free and runs them in the
+// background. A job is due once its time has come, unless a job of its lock key runs or waits
+// before it
+func (q *JobQueue) RunDue(now time.Time) error {
+	free := q.workers() - q.active()
+	if free <= 0 {
+		return nil
+	}
+
+	var jobs []models.Job
+	if err := q.db.Where("status = ? AND run_after <= ?", JobQueued, now).
+		Where("NOT EXISTS (SELECT 1 FROM jobs AS other WHERE other.lock_key = jobs.lock_key AND (other.status = ? OR (other.status = ? AND other.id < jobs.id)))", JobRunning, JobQueued).
+		Order("run_after, id").
+		Limit(free).
+		Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if !q.claim(&job, now) {
+			continue
+		}
+		q.mutex.Lock()
+		q.running++
+		q.mutex.Unlock()
+		go q.run(job)
+	}
+	return nil
+}
+
+// claim marks a queued job as running on this worker. Instances racing for jobs of the same
+// lock key are kept apart by the unique index on the keys of running jobs
+func (q *JobQueue) claim(job *models.Job, now time.Time) bool {
+	claim := q.db.Model(&models.Job{}).
+		Where("id = ? AND status = ?", job.ID, JobQueued).
+		Updates(map[string]interface{}{
+			"status":       JobRunning,
+			"attempts":     gorm.Expr("attempts + 1"),
+			"started_at":   &now,
+			"finished_at":  nil,
+			"worker_id":    q.workerID,
+			"heartbeat_at": &now,
+		})
+	if claim.Error != nil {
+		if !strings.Contains(claim.Error.Error(), "duplicate key") {
+			log.Printf("Failed to claim job %d: %v", job.ID, claim.Error)
+		}
+		return false
+	}
+	if claim.RowsAffected == 0 {
+		return false
+	}
+
+	job.Status = JobRunning
+	job.Attempts++
+	job.StartedAt = &now
+	job.WorkerID = q.workerID
+	return true
+}
+
+// run runs a claimed job and records how it ended
+func (q *JobQueue) run(job models.Job) {
+	defer func() {
+		q.mutex.Lock()
+		q.running--
+		q.mutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.heartbeat(ctx, job.ID, cancel)
+
+	err := q.execute(ctx, &job)
+	q.finish(job, err)
+}
+
+// execute runs a job with the runner of its type; panics fail the job
+func (q *JobQueue) execute(ctx context.Context, job *models.Job) (err error) {
+	runner, ok := q.runner(job.Type)
+	if !ok {
+		return PermanentJobError(fmt.Errorf("unknown job type %q", job.Type))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %d panicked: %v", job.ID, r)
+			err = PermanentJobError(fmt.Errorf("job panicked: %v", r))
+		}
+	}()
+	return runner.run(ctx, job)
+}
+
+// heartbeat keeps a running job claimed, and cancels it once cancellation is requested or the
+// job is no longer this worker's
+func (q *JobQueue) heartbeat(ctx context.Context, jobID uint, cancel context.CancelFunc) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		beat := q.db.Model(&models.Job{}).
+			Where("id = ? AND status = ? AND worker_id = ? AND cancel_requested = ?", jobID, JobRunning, q.workerID, false).
+			Update("heartbeat_at", time.Now())
+		if beat.Error != nil {
+			log.Printf("Failed to record heartbeat of job %d: %v", jobID, beat.Error)
+			continue
+		}
+		if beat.RowsAffected == 0 {
+			cancel()
+			return
+		}
+	}
+}
+
+// finish records the outcome of a job run by this worker. Failed jobs with attempts left go back
+// in the queue after a backoff
+func (q *JobQueue) finish(job models.Job, err error) {
+	now := time.Now()
+	updates := map[string]interface{}{"finished_at": &now}
+
+	var cancelRequested []bool
+	q.db.Model(&models.Job{}).Where("id = ?", job.ID).Pluck("cancel_requested", &cancelRequested)
+
+	switch {
+	case err == nil:
+		updates["status"] = JobSucceeded
+	case len(cancelRequested) > 0 && cancelRequested[0]:
+		updates["status"] = JobCancelled
+		updates["last_error"] = err.Error()
+	case job.Attempts < job.MaxAttempts && !errors.As(err, &permanentJobError{}):
+		updates["status"] = JobQueued
+		updates["run_after"] = now.Add(jobBackoff(job.Attempts))
+		updates["finished_at"] = nil
+		updates["last_error"] = err.Error()
+	default:
+		updates["status"] = JobFailed
+		updates["last_error"] = err.Error()
+	}
+
+	result := q.db.Model(&models.Job{}).
+		Where("id = ? AND status = ? AND worker_id = ?", job.ID, JobRunning, q.workerID).
+		Updates(updates)
+	if result.Error != nil {
+		log.Printf("Failed to record the outcome of job %d: %v", job.ID, result.Error)
+	}
+}
+
+// jobBackoff is the wait before a job that failed its attempt runs again: doubling from the
+// base with every attempt, up to the maximum
+func jobBackoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	backoff := jobBackoffBase
+	for i := 1; i < attempt && backoff < jobBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > jobBackoffMax {
+		return jobBackoffMax
+	}
+	return backoff
+}
+
+// Recover takes over the running jobs whose worker stopped sending heartbeats, as when the
+// backend restarted while they ran. They are queued to run again, unless they were being
+// cancelled or have no attempts left. Each is taken over by a conditional update, so a job is
+// taken over once even when several instances recover at the same time
+func (q *JobQueue) Recover(now time.Time) error {
+	var jobs []models.Job
+	if err := q.db.Where("status = ? AND heartbeat_at < ?", JobRunning, now.Add(-jobStaleAfter)).
+		Order("id").Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		status, reason := JobQueued, "Interrupted: the worker running it stopped"
+		updates := map[string]interface{}{
+			"status":     JobQueued,
+			"run_after":  now,
+			"last_error": reason,
+		}
+		if job.CancelRequested {
+			status, reason = JobCancelled, "Cancelled while it was interrupted"
+		} else if job.Attempts >= job.MaxAttempts {
+			status = JobFailed
+		}
+		if status != JobQueued {
+			updates["status"] = status
+			updates["last_error"] = reason
+			updates["finished_at"] = &now
+		}
+
+		claim := q.db.Model(&models.Job{}).
+			Where("id = ? AND status = ? AND heartbeat_at = ?", job.ID, JobRunning, job.HeartbeatAt).
+			Updates(updates)
+		if claim.Error != nil {
+			log.Printf("Failed to recover job %d: %v", job.ID, claim.Error)
+			continue
+		}
+		if claim.RowsAffected > 0 && status != JobQueued {
+			q.abort(job, status, reason)
+		}
+	}
+	return nil
+}
+
+// Prune deletes the jobs that finished longer than the retention ago
+func (q *JobQueue) Prune(now time.Time) error {
+	return q.db.Where("status IN ? AND finished_at < ?", []string{JobSucceeded, JobFailed, JobCancelled}, now.Add(-jobRetention)).
+		Delete(&models.Job{}).Error
+}
+
+// abort lets the runner of a job that will not run again settle what it was about
+func (q *JobQueue) abort(job models.Job, status, reason string) {
+	if runner, ok := q.runner(job.Type); ok && runner.abort != nil {
+		runner.abort(job, status, reason)
+	}
+}
+
+// workers is how many jobs this instance runs at once
+func (q *JobQueue) workers() int {
+	if q.cfg.JobWorkers > 0 {
+		return q.cfg.JobWorkers
+	}
+	return defaultJobWorkers
+}
+
+// active is how many jobs this instance runs
+func (q *JobQueue) active() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.running
+}
+
+// runner returns the runner of a job type. The services running jobs queue jobs themselves, so
+// they are only created when first needed
+func (q *JobQueue) runner(jobType string) (jobRunner, bool) {
+	q.runnersOnce.Do(func() {
+		deployments := NewDeploymentService(q.db, q.cfg)
+		backups := NewBackupService(q.db, q.cfg)
+		q.runners = map[string]jobRunner{
+			JobTypeDeployment:    {run: deployments.runDeploymentJob, abort: deployments.abortDeploymentJob},
+			JobTypeCIPDeployment: {run: deployments.runDeploymentJob, abort: deployments.abortDeploymentJob},
+			JobTypeBackup:        {run: backups.runBackupJob, abort: backups.abortBackupJob},
+			JobTypeFunctionBuild: {run: q.buildFunction, abort: q.abortFunctionBuild},
+		}
+	})
+	runner, ok := q.runners[jobType]
+	return runner, ok
+}
+
+// buildFunction builds and deploys a function
+func (q *JobQueue) buildFunction(ctx context.Context, job *models.Job) error {
+	var payload functionBuildJobPayload
+	if err := decodeJobPayload(job, &payload); err != nil {
+		return PermanentJobError(err)
+	}
+	var function models.Function
+	if err := q.db.First(&function, payload.FunctionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return PermanentJobError(fmt.Errorf("function %d no longer exists", payload.FunctionID))
+		}
+		return err
+	}
+
+	q.db.Model(&function).Updates(map[string]interface{}{
+		"status": "building",
+		"build_logs": "Starting function deployment...\n" +
+			"Installing dependencies...\n" +
+			"Building function package...\n",
+	})
+
+	// For now, we'll simulate the deployment process
+	// In a full implementation, this would:
+	// 1. Install dependencies based on function.Dependencies
+	// 2. Build the function package
+	// 3. Deploy to a container registry or function runtime
+	// 4. Set up networking and scaling rules
+	select {
+	case <-ctx.Done():
+		q.db.Model(&function).Updates(map[string]interface{}{
+			"status":     "error",
+			"build_logs": "Starting function deployment...\nInstalling dependencies...\nBuilding function package...\nBuild cancelled\n",
+		})
+		return ctx.Err()
+	case <-time.After(3 * time.Second): // Simulate build time
+	}
+
+	now := time.Now()
+	q.db.Model(&function).Updates(map[string]interface{}{
+		"status":           "deployed",
+		"last_deployed_at": &now,
+		"build_logs":       "Starting function deployment...\nInstalling dependencies...\nBuilding function package...\nBuild completed successfully!\n",
+		"deployment_logs":  "Deploying function...\nFunction deployed and ready to receive requests!\n",
+	})
+	return nil
+}
+
+// abortFunctionBuild marks the function of a build that will not run as failed
+func (q *JobQueue) abortFunctionBuild(job models.Job, status, reason string) {
+	var payload functionBuildJobPayload
+	if decodeJobPayload(&job, &payload) != nil {
+		return
+	}
+	q.db.Model(&models.Function{}).
+		Where("id = ? AND status = ?", payload.FunctionID, "building").
+		Updates(map[string]interface{}{
+			"status":     "error",
+			"build_logs": reason + "\n",
+		})
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/cloudbox/backend/internal/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestJobBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		0:  30 * time.Second,
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		6:  16 * time.Minute,
+		7:  30 * time.Minute,
+		50: 30 * time.Minute,
+	} {
+		if got := jobBackoff(attempt); got != want {
+			t.Errorf("backoff after attempt %d = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+func TestDeploymentJob(t *testing.T) {
+	deployment := models.Deployment{ID: 7, ProjectID: 3}
+	job := NewDeploymentJob(deployment, true, "abc123", "main")
+	if job.Type != JobTypeCIPDeployment || job.LockKey != "deployment:7" || job.ProjectID != 3 {
+		t.Errorf("job = %+v", job)
+	}
+	// Both kinds of deployment of a target share its lock
+	if other := NewDeploymentJob(deployment, false, "def456", "main"); other.Type != JobTypeDeployment || other.LockKey != job.LockKey {
+		t.Errorf("job = %+v, want a deployment locked like %s", other, job.LockKey)
+	}
+
+	var payload deploymentJobPayload
+	if err := decodeJobPayload(job, &payload); err != nil {
+		t.Fatalf("decodeJobPayload: %v", err)
+	}
+	if payload != (deploymentJobPayload{DeploymentID: 7, CommitHash: "abc123", Branch: "main"}) {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	if err := decodeJobPayload(&models.Job{Payload: map[string]interface{}{"deployment_id": "seven"}}, &payload); err == nil {
+		t.Error("decoding an invalid payload succeeded")
+	}
+}
+
+func TestPermanentJobError(t *testing.T) {
+	cause := errors.New("deployment 7 no longer exists")
+	err := PermanentJobError(cause)
+	if !errors.Is(err, cause) || err.Error() != cause.Error() {
+		t.Errorf("PermanentJobError(%v) = %v", cause, err)
+	}
+	if !errors.As(err, &permanentJobError{}) || errors.As(cause, &permanentJobError{}) {
+		t.Error("permanent errors are not told apart")
+	}
+}
+
+func TestFailedStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if status := failedStatus(ctx); status != "failed" {
+		t.Errorf("status = %s, want failed", status)
+	}
+	cancel()
+	if status := failedStatus(ctx); status != "cancelled" {
+		t.Errorf("status of a cancelled deployment = %s, want cancelled", status)
+	}
+}
+
+// silentSSHServer returns the address of a server that accepts connections but never answers
+// the SSH handshake
+func silentSSHServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// encryptedSSHKey returns a private key encrypted like stored SSH keys
+func encryptedSSHKey(t *testing.T, masterKey string) string {
+	t.Helper()
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := utils.EncryptPrivateKey(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+// cancelledWithin cancels an operation shortly after it started and fails unless it returns an
+// error soon after
+func cancelledWithin(t *testing.T, operation func(ctx context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- operation(ctx) }()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("operation succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation kept waiting for the handshake after its context was cancelled")
+	}
+}
+
+func TestDialSSHCancel(t *testing.T) {
+	address := silentSSHServer(t)
+	cancelledWithin(t, func(ctx context.Context) error {
+		_, err := dialSSH(ctx, address, &ssh.ClientConfig{
+			User:            "deploy",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         time.Minute,
+		})
+		return err
+	})
+}
+
+// gitRepository creates a repository with one commit on main, returning its URL
+func gitRepository(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>hello</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		if output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v: %s", args, err, output)
+		}
+	}
+	return "file://" + dir
+}
+
+func TestDeploymentJobRetriesConnectionFailuresOnly(t *testing.T) {
+	db := openTestDB(t, &models.Deployment{}, &models.GitHubRepository{}, &models.WebServer{}, &models.SSHKey{}, &models.Job{})
+	cfg := &config.Config{MasterKey: "test-master-key"}
+	service := NewDeploymentService(db, cfg)
+
+	// A server that is not listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	sshKey := models.SSHKey{Name: "deploy", PrivateKey: encryptedSSHKey(t, cfg.MasterKey), ProjectID: 1}
+	db.Create(&sshKey)
+	server := models.WebServer{Name: "web", Hostname: "127.0.0.1", Port: port, Username: "deploy", SSHKeyID: sshKey.ID, ProjectID: 1}
+	db.Create(&server)
+	repository := models.GitHubRepository{Name: "site", CloneURL: gitRepository(t), ProjectID: 1}
+	db.Create(&repository)
+
+	run := func(buildCommand string) error {
+		deployment := models.Deployment{Name: "site", BuildCommand: buildCommand, Status: "pending",
+			GitHubRepositoryID: repository.ID, WebServerID: server.ID, ProjectID: 1}
+		if err := db.Create(&deployment).Error; err != nil {
+			t.Fatal(err)
+		}
+		return service.runDeploymentJob(context.Background(), NewDeploymentJob(deployment, false, "", "main"))
+	}
+
+	// A failing build would fail the same way again
+	err = run("false")
+	if err == nil || !errors.As(err, &permanentJobError{}) {
+		t.Errorf("failed build: err = %v, want a permanent error", err)
+	}
+
+	// An unreachable server may be back for the next attempt
+	err = run("")
+	if err == nil || errors.As(err, &permanentJobError{}) {
+		t.Errorf("unreachable server: err = %v, want a retryable error", err)
+	}
+}
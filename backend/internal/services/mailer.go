@@ -0,0 +1,286 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mail drivers
+const (
+	MailDriverSMTP = "smtp"
+	MailDriverFile = "file" // Writes .eml files to a directory, for development and tests
+	MailDriverLog  = "log"  // Logs messages instead of delivering them
+)
+
+// SMTP connection security
+const (
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls" // Implicit TLS, usually port 465
+	SMTPSecurityNone     = "none"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// MailMessage is an email with a plain text and an optional HTML body
+type MailMessage struct {
+	From    mail.Address
+	ReplyTo string
+	To      mail.Address
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers email
+type Mailer interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+// SMTPMailer delivers email through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security string
+}
+
+// FileMailer writes every message to a file in Dir
+type FileMailer struct {
+	Dir string
+}
+
+// LogMailer logs messages without delivering them
+type LogMailer struct{}
+
+// MailConfig selects and configures a mail driver
+type MailConfig struct {
+	Driver   string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security string
+	Dir      string
+}
+
+// NewMailer creates the mailer of a configuration
+func NewMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case MailDriverSMTP:
+		if cfg.Host == "" {
+			return nil, errors.New("SMTP host is not configured")
+		}
+		security := cfg.Security
+		if security == "" {
+			security = SMTPSecurityStartTLS
+		}
+		port := cfg.Port
+		if port == 0 {
+			port = 587
+			if security == SMTPSecurityTLS {
+				port = 465
+			}
+		}
+		return &SMTPMailer{Host: cfg.Host, Port: port, Username: cfg.Username, Password: cfg.Password, Security: security}, nil
+	case MailDriverFile:
+		if cfg.Dir == "" {
+			return nil, errors.New("mail directory is not configured")
+		}
+		return &FileMailer{Dir: cfg.Dir}, nil
+	case MailDriverLog, "":
+		return LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
+
+// Send delivers a message through the SMTP server
+func (m *SMTPMailer) Send(ctx context.Context, msg MailMessage) error {
+	body, err := BuildMailMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsConfig := &tls.Config{ServerName: m.Host, MinVersion: tls.VersionTLS12}
+
+	var conn net.Conn
+	if m.Security == SMTPSecurityTLS {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP handshake failed: %w", err)
+	}
+	defer client.Close()
+
+	if m.Security == SMTPSecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(msg.From.Address); err != nil {
+		return fmt.Errorf("SMTP server rejected sender: %w", err)
+	}
+	if err := client.Rcpt(msg.To.Address); err != nil {
+		return fmt.Errorf("SMTP server rejected recipient: %w", err)
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(body); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("SMTP server rejected message: %w", err)
+	}
+	return client.Quit()
+}
+
+// Send writes the message to a new .eml file
+func (m *FileMailer) Send(ctx context.Context, msg MailMessage) error {
+	body, err := BuildMailMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0750); err != nil {
+		return err
+	}
+
+	suffix, err := RandomToken(6)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), suffix)
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0640)
+}
+
+// Send logs the recipient and subject of the message
+func (LogMailer) Send(ctx context.Context, msg MailMessage) error {
+	if _, err := BuildMailMessage(msg); err != nil {
+		return err
+	}
+	log.Printf("Mail (not delivered, log driver): to=%s subject=%q", msg.To.Address, msg.Subject)
+	return nil
+}
+
+// BuildMailMessage renders a message in RFC 5322 format, as multipart/alternative when it
+// has an HTML body
+func BuildMailMessage(msg MailMessage) ([]byte, error) {
+	if _, err := mail.ParseAddress(msg.From.Address); err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	if _, err := mail.ParseAddress(msg.To.Address); err != nil {
+		return nil, fmt.Errorf("invalid recipient address: %w", err)
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") || strings.ContainsAny(msg.ReplyTo, "\r\n") {
+		return nil, errors.New("mail headers must not contain line breaks")
+	}
+
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+
+	domain := msg.From.Address[strings.LastIndex(msg.From.Address, "@")+1:]
+	id, err := RandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	header("From", msg.From.String())
+	header("To", msg.To.String())
+	if msg.ReplyTo != "" {
+		header("Reply-To", msg.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", id, domain))
+	header("MIME-Version", "1.0")
+
+	if msg.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(writer, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	encoder := quotedprintable.NewWriter(w)
+	if _, err := encoder.Write([]byte(body)); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
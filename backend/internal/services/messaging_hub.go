@@ -0,0 +1,399 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// MessagingEventsChannel is the PostgreSQL NOTIFY channel messaging events are announced on
+const MessagingEventsChannel = "cloudbox_messaging_events"
+
+// Messaging event types
+const (
+	MessagingMessageCreated  = "message.created"
+	MessagingMessageUpdated  = "message.updated"
+	MessagingMessageDeleted  = "message.deleted"
+	MessagingReactionAdded   = "reaction.added"
+	MessagingReactionRemoved = "reaction.removed"
+	MessagingRead            = "read"
+	MessagingTyping          = "typing"
+	MessagingPresence        = "presence"
+	MessagingMemberJoined    = "member.joined"
+	MessagingMemberLeft      = "member.left"
+	MessagingChannelDeleted  = "channel.deleted"
+)
+
+// Presence: connected users refresh LastSeenAt every PresenceHeartbeat and count as online
+// while it is more recent than PresenceTimeout
+const (
+	PresenceHeartbeat = 20 * time.Second
+	PresenceTimeout   = 45 * time.Second
+)
+
+const (
+	messagingBuffer     = 256  // Events buffered per subscriber before it is marked lagged
+	messagingMaxPayload = 7900 // NOTIFY payloads are limited to 8000 bytes
+)
+
+// MessagingEvent is a realtime event of a messaging channel
+type MessagingEvent struct {
+	Type      string      `json:"type"`
+	ProjectID uint        `json:"project_id"`
+	ChannelID string      `json:"channel_id,omitempty"`
+	UserID    string      `json:"user_id,omitempty"`
+	MessageID string      `json:"message_id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	At        time.Time   `json:"at"`
+}
+
+// MessagingSubscription receives the events of the channels an app user is a member of
+type MessagingSubscription struct {
+	ProjectID uint
+	UserID    string
+	Events    chan MessagingEvent
+	// Lagged is signalled when events were dropped (slow consumer, listener reconnect);
+	// the client must then reload channel state over the REST API
+	Lagged chan struct{}
+
+	mutex    sync.RWMutex
+	channels map[string]bool
+}
+
+// IsMember reports whether the subscribed user is a member of a channel
+func (s *MessagingSubscription) IsMember(channelID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.channels[channelID]
+}
+
+// ChannelIDs returns the channels the subscribed user is a member of
+func (s *MessagingSubscription) ChannelIDs() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := make([]string, 0, len(s.channels))
+	for id := range s.channels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *MessagingSubscription) setMember(channelID string, member bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if member {
+		s.channels[channelID] = true
+	} else {
+		delete(s.channels, channelID)
+	}
+}
+
+// IsOnline reports whether a user with the given LastSeenAt counts as online
+func IsOnline(lastSeenAt *time.Time) bool {
+	return lastSeenAt != nil && time.Since(*lastSeenAt) < PresenceTimeout
+}
+
+// MessagingHub fans messaging events out to the gateway connections of this process.
+// Writers announce events with PublishMessagingEvent; inside a transaction PostgreSQL only
+// delivers them on commit, to every instance listening.
+type MessagingHub struct {
+	db          *gorm.DB
+	mutex       sync.RWMutex
+	subscribers map[uint]map[*MessagingSubscription]struct{}
+	once        sync.Once
+}
+
+// NewMessagingHub creates a new messaging hub
+func NewMessagingHub(db *gorm.DB) *MessagingHub {
+	return &MessagingHub{
+		db:          db,
+		subscribers: make(map[uint]map[*MessagingSubscription]struct{}),
+	}
+}
+
+// PublishMessagingEvent announces an event on the messaging channel. Message events carry no
+// data; listeners load the message when dispatching them.
+func PublishMessagingEvent(db *gorm.DB, event MessagingEvent) error {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(payload) > messagingMaxPayload {
+		return fmt.Errorf("messaging event %s too large (%d bytes)", event.Type, len(payload))
+	}
+	return db.Exec("SELECT pg_notify(?, ?)", MessagingEventsChannel, string(payload)).Error
+}
+
+// Start listens for messaging events on the shared listener connection and keeps the
+// LastSeenAt of connected users fresh. It only starts once per hub.
+func (hub *MessagingHub) Start(databaseURL string) {
+	hub.once.Do(func() {
+		listenChannel(databaseURL, MessagingEventsChannel, hub.lagAll, hub.dispatch)
+		go hub.heartbeat()
+	})
+}
+
+// Subscribe registers a gateway connection of an app user. The first connection of a user
+// on this instance announces them online.
+func (hub *MessagingHub) Subscribe(projectID uint, userID string, channelIDs []string) *MessagingSubscription {
+	subscription := &MessagingSubscription{
+		ProjectID: projectID,
+		UserID:    userID,
+		Events:    make(chan MessagingEvent, messagingBuffer),
+		Lagged:    make(chan struct{}, 1),
+		channels:  make(map[string]bool, len(channelIDs)),
+	}
+	for _, id := range channelIDs {
+		subscription.channels[id] = true
+	}
+
+	hub.mutex.Lock()
+	first := !hub.connectedLocked(projectID, userID)
+	if hub.subscribers[projectID] == nil {
+		hub.subscribers[projectID] = make(map[*MessagingSubscription]struct{})
+	}
+	hub.subscribers[projectID][subscription] = struct{}{}
+	hub.mutex.Unlock()
+
+	if first {
+		hub.announcePresence(projectID, userID, "online")
+	}
+	return subscription
+}
+
+// Unsubscribe removes a gateway connection. The last connection of a user on this instance
+// announces them offline.
+func (hub *MessagingHub) Unsubscribe(subscription *MessagingSubscription) {
+	hub.mutex.Lock()
+	delete(hub.subscribers[subscription.ProjectID], subscription)
+	if len(hub.subscribers[subscription.ProjectID]) == 0 {
+		delete(hub.subscribers, subscription.ProjectID)
+	}
+	last := !hub.connectedLocked(subscription.ProjectID, subscription.UserID)
+	hub.mutex.Unlock()
+
+	if last {
+		hub.announcePresence(subscription.ProjectID, subscription.UserID, "offline")
+	}
+}
+
+// connectedLocked reports whether a user has a connection on this instance
+func (hub *MessagingHub) connectedLocked(projectID uint, userID string) bool {
+	for subscription := range hub.subscribers[projectID] {
+		if subscription.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (hub *MessagingHub) connected(projectID uint, userID string) bool {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	return hub.connectedLocked(projectID, userID)
+}
+
+// announcePresence records a user as seen now and publishes their presence
+func (hub *MessagingHub) announcePresence(projectID uint, userID, status string) {
+	now := time.Now()
+	if err := hub.db.Model(&models.AppUser{}).Where("project_id = ? AND id = ?", projectID, userID).
+		UpdateColumn("last_seen_at", now).Error; err != nil {
+		log.Printf("Failed to update last seen of app user %s: %v", userID, err)
+	}
+
+	err := PublishMessagingEvent(hub.db, MessagingEvent{
+		Type:      MessagingPresence,
+		ProjectID: projectID,
+		UserID:    userID,
+		Data:      map[string]interface{}{"status": status, "last_seen_at": now},
+		At:        now,
+	})
+	if err != nil {
+		log.Printf("Failed to publish presence of app user %s: %v", userID, err)
+	}
+}
+
+// heartbeat refreshes LastSeenAt of all users connected to this instance
+func (hub *MessagingHub) heartbeat() {
+	ticker := time.NewTicker(PresenceHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hub.mutex.RLock()
+		seen := make(map[string]bool)
+		var userIDs []string
+		for _, subscriptions := range hub.subscribers {
+			for subscription := range subscriptions {
+				if !seen[subscription.UserID] {
+					seen[subscription.UserID] = true
+					userIDs = append(userIDs, subscription.UserID)
+				}
+			}
+		}
+		hub.mutex.RUnlock()
+
+		if len(userIDs) == 0 {
+			continue
+		}
+		if err := hub.db.Model(&models.AppUser{}).Where("id IN ?", userIDs).
+			UpdateColumn("last_seen_at", time.Now()).Error; err != nil {
+			log.Printf("Failed to refresh last seen of connected app users: %v", err)
+		}
+	}
+}
+
+// lagAll makes every subscriber resynchronise, e.g. after events may have been missed
+func (hub *MessagingHub) lagAll() {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for _, subscriptions := range hub.subscribers {
+		for subscription := range subscriptions {
+			signalMessagingLagged(subscription)
+		}
+	}
+}
+
+func (hub *MessagingHub) hasSubscribers(projectID uint) bool {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	return len(hub.subscribers[projectID]) > 0
+}
+
+func signalMessagingLagged(subscription *MessagingSubscription) {
+	select {
+	case subscription.Lagged <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch resolves an event and delivers it to the subscribers that may see it
+func (hub *MessagingHub) dispatch(payload string) {
+	var event MessagingEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		log.Printf("Invalid messaging event: %v", err)
+		return
+	}
+	if !hub.hasSubscribers(event.ProjectID) {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(event.Type, "message."):
+		var message models.Message
+		if err := hub.db.Unscoped().Where("project_id = ? AND id = ?", event.ProjectID, event.MessageID).
+			First(&message).Error; err != nil {
+			log.Printf("Failed to load message %s for messaging event: %v", event.MessageID, err)
+			return
+		}
+		event.ChannelID = message.ChannelID
+		event.Data = message
+		hub.deliverToChannel(event, "")
+
+	case event.Type == MessagingPresence:
+		hub.dispatchPresence(event)
+
+	case event.Type == MessagingMemberJoined:
+		hub.updateMembership(event, true)
+		hub.deliverToChannel(event, "")
+
+	case event.Type == MessagingMemberLeft:
+		hub.deliverToChannel(event, "")
+		hub.updateMembership(event, false)
+
+	case event.Type == MessagingChannelDeleted:
+		hub.deliverToChannel(event, "")
+		hub.updateMembership(event, false)
+
+	case event.Type == MessagingTyping:
+		hub.deliverToChannel(event, event.UserID)
+
+	default:
+		hub.deliverToChannel(event, "")
+	}
+}
+
+// dispatchPresence delivers a presence change to users sharing a channel with the user
+func (hub *MessagingHub) dispatchPresence(event MessagingEvent) {
+	// Another instance saw the user leave while they are still connected here
+	if status, _ := presenceStatus(event); status == "offline" && hub.connected(event.ProjectID, event.UserID) {
+		hub.announcePresence(event.ProjectID, event.UserID, "online")
+		return
+	}
+
+	var channelIDs []string
+	if err := hub.db.Model(&models.ChannelMember{}).
+		Where("project_id = ? AND user_id = ? AND is_active = ?", event.ProjectID, event.UserID, true).
+		Pluck("channel_id", &channelIDs).Error; err != nil {
+		log.Printf("Failed to load channels of app user %s: %v", event.UserID, err)
+		return
+	}
+
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	for subscription := range hub.subscribers[event.ProjectID] {
+		if subscription.UserID == event.UserID {
+			continue
+		}
+		for _, channelID := range channelIDs {
+			if subscription.IsMember(channelID) {
+				deliverMessagingEvent(subscription, event)
+				break
+			}
+		}
+	}
+}
+
+func presenceStatus(event MessagingEvent) (string, bool) {
+	data, ok := event.Data.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	status, ok := data["status"].(string)
+	return status, ok
+}
+
+// updateMembership tracks channel joins and leaves in the affected subscriptions; an event
+// without a user (a deleted channel) affects everyone
+func (hub *MessagingHub) updateMembership(event MessagingEvent, member bool) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for subscription := range hub.subscribers[event.ProjectID] {
+		if event.UserID == "" || subscription.UserID == event.UserID {
+			subscription.setMember(event.ChannelID, member)
+		}
+	}
+}
+
+// deliverToChannel delivers an event to the members of its channel, except skipUser
+func (hub *MessagingHub) deliverToChannel(event MessagingEvent, skipUser string) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for subscription := range hub.subscribers[event.ProjectID] {
+		if skipUser != "" && subscription.UserID == skipUser {
+			continue
+		}
+		if subscription.IsMember(event.ChannelID) {
+			deliverMessagingEvent(subscription, event)
+		}
+	}
+}
+
+func deliverMessagingEvent(subscription *MessagingSubscription, event MessagingEvent) {
+	select {
+	case subscription.Events <- event:
+	default:
+		signalMessagingLagged(subscription)
+	}
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// newTestMessagingHub returns a hub over the messaging tables; it is not started, so tests
+// hand it events as the listener would
+func newTestMessagingHub(t *testing.T) (*MessagingHub, *gorm.DB) {
+	db := openTestDB(t, &models.AppUser{}, &models.ChannelMember{}, &models.Message{})
+	return NewMessagingHub(db), db
+}
+
+// notify hands an event to the hub as a notification payload
+func notify(t *testing.T, hub *MessagingHub, event MessagingEvent) {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.dispatch(string(payload))
+}
+
+// received drains the events delivered to a subscription as "type channel" strings
+func received(subscription *MessagingSubscription) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-subscription.Events:
+			events = append(events, event.Type+" "+event.ChannelID)
+		default:
+			return events
+		}
+	}
+}
+
+func TestMessagingHubFanOut(t *testing.T) {
+	hub, db := newTestMessagingHub(t)
+	alice := hub.Subscribe(1, "alice", []string{"general"})
+	bob := hub.Subscribe(1, "bob", []string{"general", "random"})
+	bobAgain := hub.Subscribe(1, "bob", []string{"general", "random"}) // A second tab
+	outsider := hub.Subscribe(2, "carol", []string{"general"})         // Same channel ID in another project
+
+	message := func(id, channelID string) {
+		db.Create(&models.Message{ID: id, Content: "hi", ChannelID: channelID, UserID: "alice", ProjectID: 1})
+		notify(t, hub, MessagingEvent{Type: MessagingMessageCreated, ProjectID: 1, MessageID: id})
+	}
+	message("m1", "general")
+	message("m2", "random")
+	// Deleted messages are still announced
+	db.Delete(&models.Message{ID: "m1"})
+	notify(t, hub, MessagingEvent{Type: MessagingMessageDeleted, ProjectID: 1, MessageID: "m1"})
+	// Typing users do not see their own indicator
+	notify(t, hub, MessagingEvent{Type: MessagingTyping, ProjectID: 1, ChannelID: "general", UserID: "alice"})
+
+	for _, c := range []struct {
+		name         string
+		subscription *MessagingSubscription
+		want         []string
+	}{
+		{"alice", alice, []string{"message.created general", "message.deleted general"}},
+		{"bob", bob, []string{"message.created general", "message.created random", "message.deleted general", "typing general"}},
+		{"bob's second connection", bobAgain, []string{"message.created general", "message.created random", "message.deleted general", "typing general"}},
+		{"another project", outsider, []string{}},
+	} {
+		if got := received(c.subscription); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s received %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// Message events carry the message as loaded on dispatch
+	message("m3", "general")
+	select {
+	case event := <-alice.Events:
+		if message, ok := event.Data.(models.Message); !ok || message.ID != "m3" || message.ChannelID != "general" {
+			t.Errorf("event data = %+v, want message m3", event.Data)
+		}
+	default:
+		t.Error("message m3 was not delivered")
+	}
+}
+
+func TestMessagingHubMembership(t *testing.T) {
+	hub, _ := newTestMessagingHub(t)
+	alice := hub.Subscribe(1, "alice", []string{"general"})
+	bob := hub.Subscribe(1, "bob", []string{"general", "random"})
+	event := func(eventType, channelID, userID string) {
+		notify(t, hub, MessagingEvent{Type: eventType, ProjectID: 1, ChannelID: channelID, UserID: userID})
+	}
+
+	// A new member receives their own join and what follows
+	event(MessagingMemberJoined, "random", "alice")
+	event(MessagingRead, "random", "bob")
+	if got, want := received(alice), []string{"member.joined random", "read random"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice received %v after joining, want %v", got, want)
+	}
+	if !alice.IsMember("random") {
+		t.Error("alice is not a member of the joined channel")
+	}
+
+	// A leaving member receives their own leave and nothing after it
+	event(MessagingMemberLeft, "random", "bob")
+	event(MessagingReactionAdded, "random", "alice")
+	if got, want := received(bob), []string{"member.joined random", "read random", "member.left random"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bob received %v around leaving, want %v", got, want)
+	}
+	if got, want := received(alice), []string{"member.left random", "reaction.added random"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice received %v, want %v", got, want)
+	}
+
+	// Deleting a channel removes everyone from it
+	event(MessagingChannelDeleted, "general", "")
+	event(MessagingReactionAdded, "general", "alice")
+	for name, subscription := range map[string]*MessagingSubscription{"alice": alice, "bob": bob} {
+		if got, want := received(subscription), []string{"channel.deleted general"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s received %v, want %v", name, got, want)
+		}
+		if subscription.IsMember("general") {
+			t.Errorf("%s is still a member of the deleted channel", name)
+		}
+	}
+	if got := bob.ChannelIDs(); len(got) != 0 {
+		t.Errorf("bob is a member of %v", got)
+	}
+}
+
+func TestMessagingHubPresence(t *testing.T) {
+	hub, db := newTestMessagingHub(t)
+	db.Create(&models.AppUser{ID: "dave", Email: "dave@example.com", PasswordHash: "hash", ProjectID: 1})
+	db.Create(&models.ChannelMember{ChannelID: "random", UserID: "dave", ProjectID: 1, IsActive: true})
+	alice := hub.Subscribe(1, "alice", []string{"general"})
+	bob := hub.Subscribe(1, "bob", []string{"general", "random"})
+
+	// Presence reaches the users sharing a channel with dave
+	dave := hub.Subscribe(1, "dave", []string{"random"})
+	var user models.AppUser
+	db.First(&user, "id = ?", "dave")
+	if !IsOnline(user.LastSeenAt) {
+		t.Errorf("last seen at %v after connecting, want now", user.LastSeenAt)
+	}
+	notify(t, hub, MessagingEvent{Type: MessagingPresence, ProjectID: 1, UserID: "dave",
+		Data: map[string]interface{}{"status": "online"}})
+	if got, want := received(bob), []string{"presence "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bob received %v, want %v", got, want)
+	}
+	for name, subscription := range map[string]*MessagingSubscription{"alice": alice, "dave": dave} {
+		if got := received(subscription); len(got) != 0 {
+			t.Errorf("%s received %v", name, got)
+		}
+	}
+
+	hub.Unsubscribe(dave)
+	if hub.connected(1, "dave") {
+		t.Error("dave is still connected")
+	}
+}
+
+func TestMessagingHubLaggedSubscriber(t *testing.T) {
+	hub, _ := newTestMessagingHub(t)
+	slow := hub.Subscribe(1, "alice", []string{"general"})
+	for i := 0; i <= messagingBuffer; i++ {
+		notify(t, hub, MessagingEvent{Type: MessagingTyping, ProjectID: 1, ChannelID: "general", UserID: "bob"})
+	}
+	select {
+	case <-slow.Lagged:
+	case <-time.After(time.Second):
+		t.Fatal("a full subscriber was not marked lagged")
+	}
+	if len(slow.Events) != messagingBuffer {
+		t.Errorf("%d events buffered, want %d", len(slow.Events), messagingBuffer)
+	}
+
+	// Missed notifications make every subscriber reload
+	other := hub.Subscribe(2, "carol", nil)
+	hub.lagAll()
+	select {
+	case <-other.Lagged:
+	default:
+		t.Error("lagAll did not reach a subscriber of another project")
+	}
+}
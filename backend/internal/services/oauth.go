@@ -0,0 +1,478 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OAuth provider types
+const (
+	OAuthProviderGoogle = "google"
+	OAuthProviderGitHub = "github"
+	OAuthProviderApple  = "apple"
+	OAuthProviderOIDC   = "oidc" // Any OpenID Connect provider, configured by issuer discovery
+)
+
+const (
+	oauthTimeout     = 10 * time.Second
+	oauthMaxResponse = 1 << 20
+	jwksCacheTTL     = 10 * time.Minute
+	jwksMinRefetch   = time.Minute // Tokens with unknown key IDs cannot force more fetches
+)
+
+// OAuthEndpoints describes where a provider authorizes users and how their identity is verified
+type OAuthEndpoints struct {
+	Issuer           string   `json:"issuer"`
+	AuthorizationURL string   `json:"authorization_endpoint"`
+	TokenURL         string   `json:"token_endpoint"`
+	UserInfoURL      string   `json:"userinfo_endpoint"`
+	JWKSURL          string   `json:"jwks_uri"`
+	Scopes           []string `json:"-"`
+	ResponseMode     string   `json:"-"` // form_post when the provider posts back the callback
+}
+
+// BuiltinOAuthProviders are the endpoints of the well-known providers
+var BuiltinOAuthProviders = map[string]OAuthEndpoints{
+	OAuthProviderGoogle: {
+		Issuer:           "https://accounts.google.com",
+		AuthorizationURL: "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:         "https://oauth2.googleapis.com/token",
+		UserInfoURL:      "https://openidconnect.googleapis.com/v1/userinfo",
+		JWKSURL:          "https://www.googleapis.com/oauth2/v3/certs",
+		Scopes:           []string{"openid", "email", "profile"},
+	},
+	OAuthProviderGitHub: {
+		AuthorizationURL: "https://github.com/login/oauth/authorize",
+		TokenURL:         "https://github.com/login/oauth/access_token",
+		UserInfoURL:      "https://api.github.com/user",
+		Scopes:           []string{"read:user", "user:email"},
+	},
+	OAuthProviderApple: {
+		Issuer:           "https://appleid.apple.com",
+		AuthorizationURL: "https://appleid.apple.com/auth/authorize",
+		TokenURL:         "https://appleid.apple.com/auth/token",
+		JWKSURL:          "https://appleid.apple.com/auth/keys",
+		Scopes:           []string{"openid", "email", "name"},
+		// Apple only returns requested scopes to a form_post callback
+		ResponseMode: "form_post",
+	},
+}
+
+// OAuthToken is the response of a token endpoint
+type OAuthToken struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	IDToken          string `json:"id_token"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// OAuthIdentity is the verified identity of a user at a provider
+type OAuthIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	AvatarURL     string
+}
+
+type cachedJWKS struct {
+	keys      map[string]interface{}
+	fetched   time.Time
+	attempted time.Time // Last fetch, successful or not
+}
+
+// OAuthClient talks to OAuth 2.0 and OpenID Connect providers
+type OAuthClient struct {
+	http  *http.Client
+	mutex sync.Mutex
+	jwks  map[string]cachedJWKS
+}
+
+// NewOAuthClient creates a new OAuth client
+func NewOAuthClient() *OAuthClient {
+	return &OAuthClient{
+		http: &http.Client{Timeout: oauthTimeout},
+		jwks: make(map[string]cachedJWKS),
+	}
+}
+
+// RandomToken returns n random bytes, base64url encoded
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 challenge (RFC 7636)
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// AuthorizationURL builds the URL users are sent to for an authorization code with PKCE
+func AuthorizationURL(endpoints OAuthEndpoints, clientID, redirectURI, state, challenge, nonce string) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"state":                 {state},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	if len(endpoints.Scopes) > 0 {
+		query.Set("scope", strings.Join(endpoints.Scopes, " "))
+	}
+	if nonce != "" {
+		query.Set("nonce", nonce)
+	}
+	if endpoints.ResponseMode != "" {
+		query.Set("response_mode", endpoints.ResponseMode)
+	}
+
+	separator := "?"
+	if strings.Contains(endpoints.AuthorizationURL, "?") {
+		separator = "&"
+	}
+	return endpoints.AuthorizationURL + separator + query.Encode()
+}
+
+// Discover reads the OpenID Connect configuration of an issuer
+func (c *OAuthClient) Discover(ctx context.Context, issuer string) (OAuthEndpoints, error) {
+	var endpoints OAuthEndpoints
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := c.getJSON(ctx, discoveryURL, "", &endpoints); err != nil {
+		return endpoints, fmt.Errorf("discovery failed: %w", err)
+	}
+	if endpoints.Issuer != strings.TrimSuffix(issuer, "/") && endpoints.Issuer != issuer {
+		return endpoints, fmt.Errorf("discovery returned issuer %q, expected %q", endpoints.Issuer, issuer)
+	}
+	if endpoints.AuthorizationURL == "" || endpoints.TokenURL == "" || endpoints.JWKSURL == "" {
+		return endpoints, errors.New("discovery document lacks authorization, token or jwks endpoints")
+	}
+	return endpoints, nil
+}
+
+// Exchange redeems an authorization code together with its PKCE verifier
+func (c *OAuthClient) Exchange(ctx context.Context, endpoints OAuthEndpoints, clientID, clientSecret, code, redirectURI, verifier string) (*OAuthToken, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var token OAuthToken
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oauthMaxResponse)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid token response (status %d)", resp.StatusCode)
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("token endpoint error: %s %s", token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	return &token, nil
+}
+
+// idTokenClaims are the OpenID Connect claims used to identify a user
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"` // Apple sends "true" as a string
+	Name          string      `json:"name"`
+	Picture       string      `json:"picture"`
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (c *OAuthClient) VerifyIDToken(ctx context.Context, endpoints OAuthEndpoints, clientID, rawIDToken, nonce string) (OAuthIdentity, error) {
+	var identity OAuthIdentity
+	if rawIDToken == "" {
+		return identity, errors.New("token response has no id_token")
+	}
+
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.signingKey(ctx, endpoints.JWKSURL, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(endpoints.Issuer),
+		jwt.WithAudience(clientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return identity, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return identity, errors.New("invalid id_token: no expiry")
+	}
+	if nonce != "" && claims.Nonce != nonce {
+		return identity, errors.New("invalid id_token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return identity, errors.New("invalid id_token: no subject")
+	}
+
+	identity = OAuthIdentity{
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Name:      claims.Name,
+		AvatarURL: claims.Picture,
+	}
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified, _ = strconv.ParseBool(verified)
+	}
+	return identity, nil
+}
+
+// UserInfo completes an identity with the claims of the userinfo endpoint
+func (c *OAuthClient) UserInfo(ctx context.Context, endpoints OAuthEndpoints, accessToken string, identity *OAuthIdentity) error {
+	var info struct {
+		Subject       string      `json:"sub"`
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+		Name          string      `json:"name"`
+		Picture       string      `json:"picture"`
+	}
+	if err := c.getJSON(ctx, endpoints.UserInfoURL, accessToken, &info); err != nil {
+		return err
+	}
+	// Userinfo claims must describe the user of the ID token (OIDC Core 5.3.2)
+	if info.Subject != identity.Subject {
+		return errors.New("userinfo subject does not match id_token")
+	}
+
+	if identity.Email == "" {
+		identity.Email = info.Email
+		switch verified := info.EmailVerified.(type) {
+		case bool:
+			identity.EmailVerified = verified
+		case string:
+			identity.EmailVerified, _ = strconv.ParseBool(verified)
+		}
+	}
+	if identity.Name == "" {
+		identity.Name = info.Name
+	}
+	if identity.AvatarURL == "" {
+		identity.AvatarURL = info.Picture
+	}
+	return nil
+}
+
+// GitHubIdentity reads the GitHub user of an access token and their primary verified email
+func (c *OAuthClient) GitHubIdentity(ctx context.Context, endpoints OAuthEndpoints, accessToken string) (OAuthIdentity, error) {
+	var identity OAuthIdentity
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := c.getJSON(ctx, endpoints.UserInfoURL, accessToken, &user); err != nil {
+		return identity, err
+	}
+	if user.ID == 0 {
+		return identity, errors.New("GitHub user has no id")
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := c.getJSON(ctx, strings.TrimSuffix(endpoints.UserInfoURL, "/")+"/emails", accessToken, &emails); err != nil {
+		return identity, err
+	}
+
+	identity = OAuthIdentity{
+		Subject:   strconv.FormatInt(user.ID, 10),
+		Name:      user.Name,
+		AvatarURL: user.AvatarURL,
+	}
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+			break
+		}
+	}
+	return identity, nil
+}
+
+// getJSON fetches a JSON document, optionally with a bearer token
+func (c *OAuthClient) getJSON(ctx context.Context, target, accessToken string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oauthMaxResponse)).Decode(out)
+}
+
+// signingKey returns the JWKS key with the given ID, refetching the set for unknown IDs so
+// provider key rotation is picked up. A set is fetched at most once per jwksMinRefetch, so
+// unauthenticated callers cannot make every request fetch it.
+func (c *OAuthClient) signingKey(ctx context.Context, jwksURL, kid string) (interface{}, error) {
+	if jwksURL == "" {
+		return nil, errors.New("provider has no jwks_uri")
+	}
+
+	c.mutex.Lock()
+	cached, ok := c.jwks[jwksURL]
+	refetch := (!ok || time.Since(cached.fetched) > jwksCacheTTL || cached.keys[kid] == nil) &&
+		time.Since(cached.attempted) >= jwksMinRefetch
+	if refetch {
+		// Claim the fetch so concurrent callers use the cached set meanwhile
+		cached.attempted = time.Now()
+		c.jwks[jwksURL] = cached
+	}
+	c.mutex.Unlock()
+
+	if refetch {
+		keys, err := c.fetchJWKS(ctx, jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		cached = cachedJWKS{keys: keys, fetched: time.Now(), attempted: cached.attempted}
+		c.mutex.Lock()
+		c.jwks[jwksURL] = cached
+		c.mutex.Unlock()
+	}
+
+	if key := cached.keys[kid]; key != nil {
+		return key, nil
+	}
+	// Tokens without a kid are accepted when the set holds a single key
+	if kid == "" && len(cached.keys) == 1 {
+		for _, key := range cached.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing key %q not found", kid)
+}
+
+// fetchJWKS loads the RSA and EC signature keys of a JSON Web Key Set, by key ID
+func (c *OAuthClient) fetchJWKS(ctx context.Context, jwksURL string) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := c.getJSON(ctx, jwksURL, "", &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[key.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[key.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNewPKCE(t *testing.T) {
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 7636 verifiers are 43 to 128 unreserved characters
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Errorf("verifier of %d characters", len(verifier))
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(verifier); err != nil {
+		t.Errorf("verifier %q is not base64url: %v", verifier, err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if want := base64.RawURLEncoding.EncodeToString(sum[:]); challenge != want {
+		t.Errorf("challenge = %q, want the S256 challenge %q", challenge, want)
+	}
+
+	if again, _, _ := NewPKCE(); again == verifier {
+		t.Error("two verifiers are the same")
+	}
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	endpoints := OAuthEndpoints{AuthorizationURL: "https://id.example.com/authorize?tenant=acme", Scopes: []string{"openid", "email"}}
+	raw := AuthorizationURL(endpoints, "client", "https://app.example.com/callback", "the-state", "the-challenge", "the-nonce")
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	for name, want := range map[string]string{
+		"tenant":                "acme",
+		"response_type":         "code",
+		"client_id":             "client",
+		"redirect_uri":          "https://app.example.com/callback",
+		"state":                 "the-state",
+		"code_challenge":        "the-challenge",
+		"code_challenge_method": "S256",
+		"nonce":                 "the-nonce",
+		"scope":                 "openid email",
+	} {
+		if got := query.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if query.Has("response_mode") {
+		t.Error("response_mode set for a provider redirecting back")
+	}
+
+	// Apple posts the callback and issues no nonce here
+	parsed, _ = url.Parse(AuthorizationURL(BuiltinOAuthProviders[OAuthProviderApple], "client", "https://app.example.com/callback", "s", "c", ""))
+	if query = parsed.Query(); query.Get("response_mode") != "form_post" || query.Has("nonce") {
+		t.Errorf("Apple authorization query = %v", query)
+	}
+}
+
+// testIDTokenIssuer serves a JWKS with one RSA key and signs ID tokens with it
+type testIDTokenIssuer struct {
+	key    *rsa.PrivateKey
+	server *httptest.Server
+}
+
+func newTestIDTokenIssuer(t *testing.T) *testIDTokenIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIDTokenIssuer{key: key}
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys": [{"kid": "test", "kty": "RSA", "use": "sig", "n": %q, "e": %q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	}))
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testIDTokenIssuer) endpoints() OAuthEndpoints {
+	return OAuthEndpoints{Issuer: i.server.URL, JWKSURL: i.server.URL}
+}
+
+// sign issues an ID token for client with the given nonce
+func (i *testIDTokenIssuer) sign(t *testing.T, client, nonce string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.server.URL,
+			Subject:   "subject",
+			Audience:  jwt.ClaimStrings{client},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Nonce:         nonce,
+		Email:         "jane@example.com",
+		EmailVerified: "true",
+	})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newTestIDTokenIssuer(t)
+	client := NewOAuthClient()
+	ctx := context.Background()
+
+	identity, err := client.VerifyIDToken(ctx, issuer.endpoints(), "client", issuer.sign(t, "client", "the-nonce"), "the-nonce")
+	if err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if identity.Subject != "subject" || identity.Email != "jane@example.com" || !identity.EmailVerified {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	for name, token := range map[string]string{
+		"another nonce":  issuer.sign(t, "client", "replayed-nonce"),
+		"no nonce":       issuer.sign(t, "client", ""),
+		"another client": issuer.sign(t, "other-client", "the-nonce"),
+		"tampered":       issuer.sign(t, "client", "the-nonce") + "x",
+	} {
+		if _, err := client.VerifyIDToken(ctx, issuer.endpoints(), "client", token, "the-nonce"); err == nil {
+			t.Errorf("token with %s accepted", name)
+		}
+	}
+}
+
+func TestSigningKeyLimitsRefetches(t *testing.T) {
+	var fetches atomic.Int32
+	var rotated atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if rotated.Load() {
+			fmt.Fprint(w, `{"keys": [{"kid": "a", "kty": "RSA", "n": "AQAB", "e": "AQAB"}, {"kid": "b", "kty": "RSA", "use": "sig", "n": "AQAB", "e": "AQAB"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"keys": [{"kid": "a", "kty": "RSA", "n": "AQAB", "e": "AQAB"}]}`)
+	}))
+	defer server.Close()
+
+	client := NewOAuthClient()
+	ctx := context.Background()
+
+	if _, err := client.signingKey(ctx, server.URL, "a"); err != nil {
+		t.Fatalf("known key: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := client.signingKey(ctx, server.URL, "unknown"); err == nil {
+			t.Fatal("expected an error for an unknown key ID")
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetches after unknown key IDs = %d, want 1", got)
+	}
+
+	// A rotated key is picked up once the refetch interval has passed
+	rotated.Store(true)
+	client.mutex.Lock()
+	cached := client.jwks[server.URL]
+	cached.attempted = cached.attempted.Add(-jwksMinRefetch)
+	client.jwks[server.URL] = cached
+	client.mutex.Unlock()
+
+	if _, err := client.signingKey(ctx, server.URL, "b"); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if _, err := client.signingKey(ctx, server.URL, "a"); err != nil {
+		t.Fatalf("known key after rotation: %v", err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("fetches after rotation = %d, want 2", got)
+	}
+}
+
+func TestSigningKeyKeepsKeysWhenRefetchFails(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"keys": [{"kid": "a", "kty": "RSA", "n": "AQAB", "e": "AQAB"}]}`)
+	}))
+	defer server.Close()
+
+	client := NewOAuthClient()
+	ctx := context.Background()
+	if _, err := client.signingKey(ctx, server.URL, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached set expires and the provider is down: one fetch fails, later calls use the set
+	failing.Store(true)
+	client.mutex.Lock()
+	cached := client.jwks[server.URL]
+	cached.fetched = time.Now().Add(-2 * jwksCacheTTL)
+	cached.attempted = cached.fetched
+	client.jwks[server.URL] = cached
+	client.mutex.Unlock()
+
+	if _, err := client.signingKey(ctx, server.URL, "a"); err == nil {
+		t.Error("expected the failed fetch to be reported")
+	}
+	if _, err := client.signingKey(ctx, server.URL, "a"); err != nil {
+		t.Errorf("cached key after a failed refetch: %v", err)
+	}
+}
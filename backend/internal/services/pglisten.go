@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// listenMaxBackoff caps the delay between reconnects of a notification listener
+const listenMaxBackoff = 30 * time.Second
+
+// channelHandler receives the notifications of one channel
+type channelHandler struct {
+	connected func()
+	handle    func(payload string)
+}
+
+// notificationListener shares one LISTEN connection among every NOTIFY channel of a database
+type notificationListener struct {
+	databaseURL string
+
+	mutex    sync.Mutex
+	channels map[string]channelHandler
+	restart  context.CancelFunc // Drops the current connection so added channels are listened on
+}
+
+var (
+	listenersMutex sync.Mutex
+	listeners      = make(map[string]*notificationListener) // By database URL
+)
+
+// listenChannel registers handlers for a PostgreSQL NOTIFY channel on the shared listener of a
+// database, which reconnects with backoff. Notifications sent while no connection was listening
+// are lost, so connected is called after every (re)connect; handle receives each payload on the
+// listener goroutine and must not block for long.
+func listenChannel(databaseURL, channel string, connected func(), handle func(payload string)) {
+	listenersMutex.Lock()
+	listener, ok := listeners[databaseURL]
+	if !ok {
+		listener = &notificationListener{
+			databaseURL: databaseURL,
+			channels:    make(map[string]channelHandler),
+		}
+		listeners[databaseURL] = listener
+	}
+	listenersMutex.Unlock()
+
+	listener.mutex.Lock()
+	listener.channels[channel] = channelHandler{connected: connected, handle: handle}
+	if listener.restart != nil {
+		listener.restart()
+	}
+	listener.mutex.Unlock()
+
+	if !ok {
+		go listener.run()
+	}
+}
+
+// run keeps the listener connected
+func (l *notificationListener) run() {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		l.mutex.Lock()
+		l.restart = cancel
+		channels := make(map[string]channelHandler, len(l.channels))
+		for channel, handler := range l.channels {
+			channels[channel] = handler
+		}
+		l.mutex.Unlock()
+
+		started := time.Now()
+		err := listenOnce(ctx, l.databaseURL, channels)
+		restarted := ctx.Err() != nil
+		cancel()
+		if restarted {
+			// A channel was added; reconnect right away to listen on it too
+			continue
+		}
+		log.Printf("Notification listener stopped: %v", err)
+
+		if time.Since(started) > listenMaxBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, listenMaxBackoff)
+	}
+}
+
+func listenOnce(ctx context.Context, databaseURL string, channels map[string]channelHandler) error {
+	conn, err := pgx.Connect(ctx, databaseURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	for channel := range channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+	}
+	for _, handler := range channels {
+		handler.connected()
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if handler, ok := channels[notification.Channel]; ok {
+			handler.handle(notification.Payload)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// Quota metrics
+const (
+	QuotaStorageBytes      = "storage_bytes"
+	QuotaDocuments         = "documents"
+	QuotaAppUsers          = "app_users"
+	QuotaAPICalls          = "api_calls"           // Per calendar month
+	QuotaFunctionGBSeconds = "function_gb_seconds" // Per calendar month
+)
+
+const (
+	quotaLimitsTTL       = time.Minute // How long organization limits are cached
+	apiCallFlushInterval = 10 * time.Second
+)
+
+// UsagePeriod returns the calendar month (UTC) usage at t is metered in
+func UsagePeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// DefaultQuotaLimits returns the server-wide quotas of each project
+func DefaultQuotaLimits(cfg *config.Config) models.QuotaLimits {
+	return models.QuotaLimits{
+		StorageBytes:      cfg.QuotaStorageBytes,
+		Documents:         cfg.QuotaDocuments,
+		AppUsers:          cfg.QuotaAppUsers,
+		APICalls:          cfg.QuotaAPICalls,
+		FunctionGBSeconds: cfg.QuotaFunctionGBSeconds,
+	}
+}
+
+// EffectiveQuotaLimits resolves each limit of a project: its own, otherwise its organization's,
+// otherwise the server default. In the result 0 is unlimited.
+func EffectiveQuotaLimits(server, organization, project models.QuotaLimits) models.QuotaLimits {
+	pick := func(values ...float64) float64 {
+		for _, value := range values {
+			if value != 0 {
+				return max(value, 0)
+			}
+		}
+		return 0
+	}
+	return models.QuotaLimits{
+		StorageBytes:      int64(pick(float64(project.StorageBytes), float64(organization.StorageBytes), float64(server.StorageBytes))),
+		Documents:         int64(pick(float64(project.Documents), float64(organization.Documents), float64(server.Documents))),
+		AppUsers:          int64(pick(float64(project.AppUsers), float64(organization.AppUsers), float64(server.AppUsers))),
+		APICalls:          int64(pick(float64(project.APICalls), float64(organization.APICalls), float64(server.APICalls))),
+		FunctionGBSeconds: pick(project.FunctionGBSeconds, organization.FunctionGBSeconds, server.FunctionGBSeconds),
+	}
+}
+
+// quotaLimit returns the limit of a metric; 0 is unlimited
+func quotaLimit(limits models.QuotaLimits, metric string) float64 {
+	switch metric {
+	case QuotaStorageBytes:
+		return float64(limits.StorageBytes)
+	case QuotaDocuments:
+		return float64(limits.Documents)
+	case QuotaAppUsers:
+		return float64(limits.AppUsers)
+	case QuotaAPICalls:
+		return float64(limits.APICalls)
+	case QuotaFunctionGBSeconds:
+		return limits.FunctionGBSeconds
+	}
+	return 0
+}
+
+// quotaExceeded reports whether adding amount to used passes a limit. An amount of 0 checks
+// that a metered quota is not used up yet.
+func quotaExceeded(limit, used, amount float64) bool {
+	if limit <= 0 {
+		return false
+	}
+	if amount == 0 {
+		return used >= limit
+	}
+	return used+amount > limit
+}
+
+// QuotaUsage is the usage of a project: current totals of stored resources, and the metered
+// usage of a calendar month
+type QuotaUsage struct {
+	Period             string  `json:"period"`
+	StorageBytes       int64   `json:"storage_bytes"`
+	Documents          int64   `json:"documents"`
+	AppUsers           int64   `json:"app_users"`
+	APICalls           int64   `json:"api_calls"`
+	FunctionExecutions int64   `json:"function_executions"`
+	FunctionGBSeconds  float64 `json:"function_gb_seconds"`
+}
+
+// QuotaExceededError is returned when a request would pass a quota of its project
+type QuotaExceededError struct {
+	Metric string
+	Limits models.QuotaLimits
+	Usage  QuotaUsage
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", e.Metric)
+}
+
+// Status is 429 for the monthly API call quota, which resets, and 402 for the others
+func (e *QuotaExceededError) Status() int {
+	if e.Metric == QuotaAPICalls {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusPaymentRequired
+}
+
+type cachedQuotaLimits struct {
+	limits    models.QuotaLimits
+	expiresAt time.Time
+}
+
+type usageKey struct {
+	projectID uint
+	period    string
+}
+
+// apiCallCount is the API call count of a project in a period
+type apiCallCount struct {
+	stored  int64 // In the database when last read or flushed
+	pending int64 // Not flushed yet
+}
+
+// QuotaService checks the usage quotas of projects and meters their API calls and function
+// executions. API calls are counted in memory and flushed periodically, so the instances of a
+// deployment may together pass the quota by the calls of one flush interval.
+type QuotaService struct {
+	db  *gorm.DB
+	cfg *config.Config
+
+	mutex         sync.Mutex
+	organizations map[uint]cachedQuotaLimits // By organization ID
+	calls         map[usageKey]*apiCallCount
+
+	once sync.Once
+}
+
+// NewQuotaService creates a quota service
+func NewQuotaService(db *gorm.DB, cfg *config.Config) *QuotaService {
+	return &QuotaService{
+		db:            db,
+		cfg:           cfg,
+		organizations: make(map[uint]cachedQuotaLimits),
+		calls:         make(map[usageKey]*apiCallCount),
+	}
+}
+
+// Start flushes counted API calls in the background
+func (s *QuotaService) Start() {
+	s.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(apiCallFlushInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := s.Flush(); err != nil {
+					log.Printf("Failed to record API calls: %v", err)
+				}
+			}
+		}()
+	})
+}
+
+// Limits returns the effective quotas of a project
+func (s *QuotaService) Limits(project models.Project) (models.QuotaLimits, error) {
+	organization, err := s.organizationLimits(project.OrganizationID)
+	if err != nil {
+		return models.QuotaLimits{}, err
+	}
+	return EffectiveQuotaLimits(DefaultQuotaLimits(s.cfg), organization, project.Quotas), nil
+}
+
+func (s *QuotaService) organizationLimits(organizationID uint) (models.QuotaLimits, error) {
+	if organizationID == 0 {
+		return models.QuotaLimits{}, nil
+	}
+
+	s.mutex.Lock()
+	cached, ok := s.organizations[organizationID]
+	s.mutex.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.limits, nil
+	}
+
+	var organization models.Organization
+	if err := s.db.Select("id", "quota_storage_bytes", "quota_documents", "quota_app_users",
+		"quota_api_calls", "quota_function_gb_seconds").
+		Where("id = ?", organizationID).First(&organization).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return models.QuotaLimits{}, nil
+		}
+		return models.QuotaLimits{}, err
+	}
+
+	s.mutex.Lock()
+	s.organizations[organizationID] = cachedQuotaLimits{limits: organization.Quotas, expiresAt: time.Now().Add(quotaLimitsTTL)}
+	s.mutex.Unlock()
+	return organization.Quotas, nil
+}
+
+// Check returns a *QuotaExceededError when adding amount to a metric would pass the quota of
+// the project. An amount of 0 checks that a metered quota is not used up yet.
+func (s *QuotaService) Check(project models.Project, metric string, amount float64) error {
+	limits, err := s.Limits(project)
+	if err != nil {
+		return err
+	}
+	limit := quotaLimit(limits, metric)
+	if limit <= 0 {
+		return nil
+	}
+
+	used, err := s.used(project.ID, metric)
+	if err != nil {
+		return err
+	}
+	if !quotaExceeded(limit, used, amount) {
+		return nil
+	}
+	return s.exceeded(project.ID, metric, limits)
+}
+
+// used returns the current usage of one metric of a project
+func (s *QuotaService) used(projectID uint, metric string) (float64, error) {
+	switch metric {
+	case QuotaStorageBytes:
+		var bytes int64
+		err := s.db.Model(&models.File{}).Where("project_id = ?", projectID).
+			Select("COALESCE(SUM(size), 0)").Scan(&bytes).Error
+		return float64(bytes), err
+	case QuotaDocuments:
+		var count int64
+		err := s.db.Model(&models.Document{}).Where("project_id = ?", projectID).Count(&count).Error
+		return float64(count), err
+	case QuotaAppUsers:
+		var count int64
+		err := s.db.Model(&models.AppUser{}).Where("project_id = ?", projectID).Count(&count).Error
+		return float64(count), err
+	case QuotaAPICalls:
+		calls, err := s.apiCalls(usageKey{projectID, UsagePeriod(time.Now())})
+		return float64(calls), err
+	case QuotaFunctionGBSeconds:
+		usage, err := s.metered(projectID, UsagePeriod(time.Now()))
+		return usage.FunctionGBSeconds, err
+	}
+	return 0, fmt.Errorf("unknown quota %q", metric)
+}
+
+// exceeded builds the error of a passed quota with the usage of the project
+func (s *QuotaService) exceeded(projectID uint, metric string, limits models.QuotaLimits) error {
+	usage, err := s.Usage(projectID, UsagePeriod(time.Now()))
+	if err != nil {
+		return err
+	}
+	return &QuotaExceededError{Metric: metric, Limits: limits, Usage: usage}
+}
+
+// Usage returns the usage of a project with the metered usage of a period (YYYY-MM)
+func (s *QuotaService) Usage(projectID uint, period string) (QuotaUsage, error) {
+	usage, err := s.metered(projectID, period)
+	if err != nil {
+		return usage, err
+	}
+
+	s.mutex.Lock()
+	if count, ok := s.calls[usageKey{projectID, period}]; ok {
+		usage.APICalls += count.pending
+	}
+	s.mutex.Unlock()
+
+	for metric, total := range map[string]*int64{
+		QuotaStorageBytes: &usage.StorageBytes,
+		QuotaDocuments:    &usage.Documents,
+		QuotaAppUsers:     &usage.AppUsers,
+	} {
+		used, err := s.used(projectID, metric)
+		if err != nil {
+			return usage, err
+		}
+		*total = int64(used)
+	}
+	return usage, nil
+}
+
+// metered returns the metered usage of a project in a period as stored
+func (s *QuotaService) metered(projectID uint, period string) (QuotaUsage, error) {
+	var record models.ProjectUsage
+	err := s.db.Where("project_id = ? AND period = ?", projectID, period).Limit(1).Find(&record).Error
+	return QuotaUsage{
+		Period:             period,
+		APICalls:           record.APICalls,
+		FunctionExecutions: record.FunctionExecutions,
+		FunctionGBSeconds:  record.FunctionGBSeconds,
+	}, err
+}
+
+// apiCalls returns the API calls of a project in a period, including calls not flushed yet
+func (s *QuotaService) apiCalls(key usageKey) (int64, error) {
+	count, err := s.apiCallCount(key)
+	if err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return count.stored + count.pending, nil
+}
+
+func (s *QuotaService) apiCallCount(key usageKey) (*apiCallCount, error) {
+	s.mutex.Lock()
+	count, ok := s.calls[key]
+	s.mutex.Unlock()
+	if ok {
+		return count, nil
+	}
+
+	usage, err := s.metered(key.projectID, key.period)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if count, ok := s.calls[key]; ok {
+		return count, nil
+	}
+	count = &apiCallCount{stored: usage.APICalls}
+	s.calls[key] = count
+	return count, nil
+}
+
+// CountAPICall counts an API call of a project, or returns a *QuotaExceededError without
+// counting it when the monthly quota is used up
+func (s *QuotaService) CountAPICall(project models.Project) error {
+	limits, err := s.Limits(project)
+	if err != nil {
+		return err
+	}
+	count, err := s.apiCallCount(usageKey{project.ID, UsagePeriod(time.Now())})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	exceeded := quotaExceeded(float64(limits.APICalls), float64(count.stored+count.pending), 0)
+	if !exceeded {
+		count.pending++
+	}
+	s.mutex.Unlock()
+
+	if exceeded {
+		return s.exceeded(project.ID, QuotaAPICalls, limits)
+	}
+	return nil
+}
+
+// Flush writes counted API calls to the database
+func (s *QuotaService) Flush() error {
+	s.mutex.Lock()
+	pending := make(map[usageKey]int64)
+	current := UsagePeriod(time.Now())
+	for key, count := range s.calls {
+		if count.pending > 0 {
+			pending[key] = count.pending
+		} else if key.period != current {
+			delete(s.calls, key)
+		}
+	}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for key, calls := range pending {
+		var total int64
+		err := s.db.Raw(`INSERT INTO project_usages (project_id, period, api_calls, created_at, updated_at)
+			VALUES (?, ?, ?, NOW(), NOW())
+			ON CONFLICT (project_id, period) DO UPDATE
+			SET api_calls = project_usages.api_calls + EXCLUDED.api_calls, updated_at = NOW()
+			RETURNING api_calls`, key.projectID, key.period, calls).Scan(&total).Error
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		s.mutex.Lock()
+		if count, ok := s.calls[key]; ok {
+			count.pending -= calls
+			count.stored = total // Includes the calls other instances flushed
+		}
+		s.mutex.Unlock()
+	}
+	return firstErr
+}
+
+// RecordFunctionExecution meters a function execution as its memory limit in GB times its
+// duration in seconds
+func (s *QuotaService) RecordFunctionExecution(projectID uint, memoryMB int, duration time.Duration) error {
+	gbSeconds := float64(memoryMB) / 1024 * duration.Seconds()
+	return s.db.Exec(`INSERT INTO project_usages (project_id, period, function_executions, function_gb_seconds, created_at, updated_at)
+		VALUES (?, ?, 1, ?, NOW(), NOW())
+		ON CONFLICT (project_id, period) DO UPDATE
+		SET function_executions = project_usages.function_executions + 1,
+			function_gb_seconds = project_usages.function_gb_seconds + EXCLUDED.function_gb_seconds,
+			updated_at = NOW()`, projectID, UsagePeriod(time.Now()), gbSeconds).Error
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestEffectiveQuotaLimits(t *testing.T) {
+	server := models.QuotaLimits{StorageBytes: 1000, Documents: 100, AppUsers: 10, APICalls: 5000, FunctionGBSeconds: 50}
+	organization := models.QuotaLimits{Documents: 200, AppUsers: -1, FunctionGBSeconds: 75.5}
+	project := models.QuotaLimits{StorageBytes: 2000, Documents: -1}
+
+	got := EffectiveQuotaLimits(server, organization, project)
+	want := models.QuotaLimits{
+		StorageBytes:      2000, // Project
+		Documents:         0,    // Removed by the project
+		AppUsers:          0,    // Removed by the organization
+		APICalls:          5000, // Server
+		FunctionGBSeconds: 75.5, // Organization
+	}
+	if got != want {
+		t.Errorf("EffectiveQuotaLimits() = %+v, want %+v", got, want)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name               string
+		limit, used, added float64
+		want               bool
+	}{
+		{"unlimited", 0, 1e9, 1, false},
+		{"within", 10, 5, 5, false},
+		{"passes", 10, 5, 6, true},
+		{"metered below", 10, 9.5, 0, false},
+		{"metered used up", 10, 10, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotaExceeded(tt.limit, tt.used, tt.added); got != tt.want {
+				t.Errorf("quotaExceeded(%v, %v, %v) = %v, want %v", tt.limit, tt.used, tt.added, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsagePeriod(t *testing.T) {
+	// Late on the last day of the month in UTC-5 is already the next month in UTC
+	at := time.Date(2026, 9, 30, 22, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	if got := UsagePeriod(at); got != "2026-10" {
+		t.Errorf("UsagePeriod() = %q, want 2026-10", got)
+	}
+}
+
+func TestQuotaExceededErrorStatus(t *testing.T) {
+	if got := (&QuotaExceededError{Metric: QuotaAPICalls}).Status(); got != http.StatusTooManyRequests {
+		t.Errorf("api_calls status = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if got := (&QuotaExceededError{Metric: QuotaStorageBytes}).Status(); got != http.StatusPaymentRequired {
+		t.Errorf("storage_bytes status = %d, want %d", got, http.StatusPaymentRequired)
+	}
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate limit stores
+const (
+	RateLimitStoreMemory = "memory" // Buckets of this instance only
+	RateLimitStoreRedis  = "redis"  // Buckets shared by every instance
+)
+
+const rateLimitEvictInterval = time.Minute
+
+// RateLimitRule allows Requests per Window. Buckets hold up to Requests tokens, so a client
+// may burst up to the full limit, and refill steadily over the window.
+type RateLimitRule struct {
+	Requests int
+	Window   time.Duration
+}
+
+// rate returns the refill rate in tokens per second
+func (r RateLimitRule) rate() float64 {
+	return float64(r.Requests) / r.Window.Seconds()
+}
+
+// Policy returns the rule in the RateLimit-Policy header format
+func (r RateLimitRule) Policy() string {
+	return fmt.Sprintf("%d;w=%d", r.Requests, int(math.Ceil(r.Window.Seconds())))
+}
+
+// RateLimitResult is the state of a bucket after taking a token
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // Until the bucket is full again
+	RetryAfter time.Duration // Until the next token when the request was denied
+}
+
+func newRateLimitResult(rule RateLimitRule, allowed bool, tokens float64) RateLimitResult {
+	rate := rule.rate()
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(rule.Requests) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return result
+}
+
+// RateLimitStore takes tokens from named token buckets
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error)
+}
+
+// NewRateLimitStore creates the rate limit store of the configuration
+func NewRateLimitStore(cfg *config.Config) (RateLimitStore, error) {
+	switch cfg.RateLimitStore {
+	case RateLimitStoreRedis:
+		options, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis URL: %w", err)
+		}
+		return NewRedisRateLimitStore(redis.NewClient(options)), nil
+	case RateLimitStoreMemory, "":
+		return NewMemoryRateLimitStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.RateLimitStore)
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket refills completely; it can be dropped after that
+}
+
+// MemoryRateLimitStore keeps token buckets in memory, for single-node deployments
+type MemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewMemoryRateLimitStore creates an in-memory rate limit store and starts evicting buckets
+// that have refilled completely
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	go func() {
+		ticker := time.NewTicker(rateLimitEvictInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.evict(time.Now())
+		}
+	}()
+	return s
+}
+
+// Take takes a token from a bucket
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	return s.take(key, rule, time.Now()), nil
+}
+
+func (s *MemoryRateLimitStore) take(key string, rule RateLimitRule, now time.Time) RateLimitResult {
+	capacity := float64(rule.Requests)
+	rate := rule.rate()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		s.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	bucket.full = now.Add(time.Duration((capacity - bucket.tokens) / rate * float64(time.Second)))
+
+	return newRateLimitResult(rule, allowed, bucket.tokens)
+}
+
+// evict drops buckets that are full, which behave like new ones
+func (s *MemoryRateLimitStore) evict(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, bucket := range s.buckets {
+		if !bucket.full.After(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// takeTokenScript refills and takes from a bucket stored as a hash of tokens and the time
+// of the last update. Redis time is used so instances with skewed clocks share buckets
+// correctly; buckets expire once they would be full.
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = capacity
+	updated = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimitStore keeps token buckets in Redis, so every instance enforces the same limits
+type RedisRateLimitStore struct {
+	client *redis.Client
+}
+
+// NewRedisRateLimitStore creates a Redis rate limit store
+func NewRedisRateLimitStore(client *redis.Client) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client}
+}
+
+// Take takes a token from a bucket
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	values, err := takeTokenScript.Run(ctx, s.client, []string{key}, rule.Requests, rule.rate()).Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(values) != 2 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+	tokensValue, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensValue, 64)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("unexpected token count %q", tokensValue)
+	}
+
+	return newRateLimitResult(rule, allowed == 1, tokens), nil
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	rule := RateLimitRule{Requests: 3, Window: 3 * time.Second} // One token per second
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name       string
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{"first request uses the full bucket", 0, true, 2, 0},
+		{"burst", 0, true, 1, 0},
+		{"burst up to the limit", 0, true, 0, 0},
+		{"empty bucket", 0, false, 0, time.Second},
+		{"partial refill", 500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		{"one token refilled", time.Second, true, 0, 0},
+		{"refill is capped at the limit", time.Hour, true, 2, 0},
+	}
+
+	store := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	for _, step := range steps {
+		result := store.take("bucket", rule, start.Add(step.at))
+		if result.Allowed != step.allowed || result.Remaining != step.remaining || result.RetryAfter != step.retryAfter {
+			t.Errorf("%s: got allowed=%v remaining=%d retry_after=%s, want allowed=%v remaining=%d retry_after=%s",
+				step.name, result.Allowed, result.Remaining, result.RetryAfter, step.allowed, step.remaining, step.retryAfter)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreBucketsAreIndependent(t *testing.T) {
+	rule := RateLimitRule{Requests: 1, Window: time.Minute}
+	now := time.Now()
+	store := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+
+	if !store.take("a", rule, now).Allowed {
+		t.Fatal("first request of a was denied")
+	}
+	if store.take("a", rule, now).Allowed {
+		t.Fatal("second request of a was allowed")
+	}
+	if !store.take("b", rule, now).Allowed {
+		t.Fatal("bucket b was limited by requests of a")
+	}
+}
+
+func TestMemoryRateLimitStoreEvict(t *testing.T) {
+	rule := RateLimitRule{Requests: 2, Window: 2 * time.Second}
+	now := time.Now()
+	store := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	store.take("bucket", rule, now)
+
+	tests := []struct {
+		name string
+		at   time.Duration
+		kept bool
+	}{
+		{"refilling bucket is kept", 500 * time.Millisecond, true},
+		{"full bucket is dropped", time.Second, false},
+	}
+	for _, tt := range tests {
+		store.evict(now.Add(tt.at))
+		if _, kept := store.buckets["bucket"]; kept != tt.kept {
+			t.Errorf("%s: kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+func TestRateLimitRulePolicy(t *testing.T) {
+	tests := []struct {
+		rule RateLimitRule
+		want string
+	}{
+		{RateLimitRule{Requests: 600, Window: time.Minute}, "600;w=60"},
+		{RateLimitRule{Requests: 10, Window: 1500 * time.Millisecond}, "10;w=2"},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Policy(); got != tt.want {
+			t.Errorf("Policy() of %+v = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
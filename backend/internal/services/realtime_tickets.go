@@ -0,0 +1,78 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+)
+
+// RealtimeTicketTTL bounds how long a ticket can open realtime connections
+const RealtimeTicketTTL = time.Minute
+
+// ErrRealtimeTicketInvalid is returned for forged, malformed or expired tickets
+var ErrRealtimeTicketInvalid = errors.New("invalid realtime ticket")
+
+// RealtimeTicket carries the credentials of an authenticated request to a WebSocket or
+// EventSource connection, which browsers open without custom headers. Exactly one of
+// APIKeyID and UserID is set.
+type RealtimeTicket struct {
+	ProjectID uint   `json:"p"`
+	APIKeyID  uint   `json:"k,omitempty"`
+	UserID    uint   `json:"u,omitempty"` // Admin user of a JWT
+	Email     string `json:"m,omitempty"`
+	Role      string `json:"r,omitempty"`
+	SessionID string `json:"s,omitempty"` // App user session the request carried
+	ExpiresAt int64  `json:"e"`
+}
+
+// realtimeTicketSecret derives the ticket signing key, so tickets never verify as API key
+// hashes or JWTs
+func realtimeTicketSecret(cfg *config.Config) []byte {
+	mac := hmac.New(sha256.New, apiKeySecret(cfg))
+	mac.Write([]byte("cloudbox realtime ticket"))
+	return mac.Sum(nil)
+}
+
+// IssueRealtimeTicket signs a ticket valid for RealtimeTicketTTL
+func IssueRealtimeTicket(cfg *config.Config, ticket RealtimeTicket) (string, time.Time, error) {
+	expiresAt := time.Now().Add(RealtimeTicketTTL)
+	ticket.ExpiresAt = expiresAt.Unix()
+
+	payload, err := json.Marshal(ticket)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signRealtimeTicket(cfg, encoded), expiresAt, nil
+}
+
+// ParseRealtimeTicket verifies the signature and expiry of a ticket
+func ParseRealtimeTicket(cfg *config.Config, token string) (RealtimeTicket, error) {
+	var ticket RealtimeTicket
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signRealtimeTicket(cfg, encoded))) {
+		return ticket, ErrRealtimeTicketInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &ticket) != nil {
+		return ticket, ErrRealtimeTicketInvalid
+	}
+	if ticket.ProjectID == 0 || (ticket.APIKeyID == 0) == (ticket.UserID == 0) ||
+		time.Now().Unix() >= ticket.ExpiresAt {
+		return RealtimeTicket{}, ErrRealtimeTicketInvalid
+	}
+	return ticket, nil
+}
+
+func signRealtimeTicket(cfg *config.Config, encoded string) string {
+	mac := hmac.New(sha256.New, realtimeTicketSecret(cfg))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
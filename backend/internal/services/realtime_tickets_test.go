@@ -0,0 +1,66 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+)
+
+func TestRealtimeTicketRoundTrip(t *testing.T) {
+	cfg := &config.Config{JWTSecret: "secret"}
+	token, expiresAt, err := IssueRealtimeTicket(cfg, RealtimeTicket{ProjectID: 7, APIKeyID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(expiresAt); until <= 0 || until > RealtimeTicketTTL {
+		t.Errorf("expires in %s, want within %s", until, RealtimeTicketTTL)
+	}
+
+	ticket, err := ParseRealtimeTicket(cfg, token)
+	if err != nil {
+		t.Fatalf("ParseRealtimeTicket() error = %v", err)
+	}
+	if ticket.ProjectID != 7 || ticket.APIKeyID != 3 || ticket.UserID != 0 {
+		t.Errorf("ticket = %+v", ticket)
+	}
+}
+
+func TestParseRealtimeTicketRejects(t *testing.T) {
+	cfg := &config.Config{JWTSecret: "secret"}
+	valid, _, err := IssueRealtimeTicket(cfg, RealtimeTicket{ProjectID: 7, APIKeyID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, signature, _ := strings.Cut(valid, ".")
+
+	sign := func(ticket RealtimeTicket) string {
+		token, _, err := IssueRealtimeTicket(cfg, ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name  string
+		cfg   *config.Config
+		token string
+	}{
+		{"other secret", &config.Config{JWTSecret: "other"}, valid},
+		{"tampered payload", cfg, encoded + "x." + signature},
+		{"missing signature", cfg, encoded},
+		{"no credentials", cfg, sign(RealtimeTicket{ProjectID: 7})},
+		{"key and user", cfg, sign(RealtimeTicket{ProjectID: 7, APIKeyID: 3, UserID: 1})},
+		{"no project", cfg, sign(RealtimeTicket{APIKeyID: 3})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseRealtimeTicket(tt.cfg, tt.token); err != ErrRealtimeTicketInvalid {
+				t.Errorf("error = %v, want %v", err, ErrRealtimeTicketInvalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A client for version 3 of the SSH file transfer protocol, with just the requests the SFTP storage
+// backend makes. Servers may answer requests in any order, so replies are matched to their
+// requests by ID
+
+// SFTP packet types
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpProtocol = 3
+)
+
+// SFTP open flags, status codes and attribute flags
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+	sftpModeDir         = 0o040000
+	sftpModeTypeMask    = 0o170000
+)
+
+const (
+	sftpChunkSize   = 32 * 1024 // Data per read or write request; every server accepts this much
+	sftpMaxInFlight = 64        // Write requests sent ahead of their replies
+	sftpMaxPacket   = 256 * 1024
+)
+
+// sftpStatusError is a failed request
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.message, e.code)
+}
+
+// sftpIsNotExist tells whether an error reports a missing file
+func sftpIsNotExist(err error) bool {
+	var status *sftpStatusError
+	return errors.As(err, &status) && status.code == sftpNoSuchFile
+}
+
+// sftpFileInfo describes a remote file
+type sftpFileInfo struct {
+	name    string
+	size    int64
+	mode    uint32
+	modTime time.Time
+}
+
+func (f sftpFileInfo) isDir() bool {
+	return f.mode&sftpModeTypeMask == sftpModeDir
+}
+
+// sftpReply is the reply to a request, without the request ID
+type sftpReply struct {
+	kind    byte
+	payload []byte
+	err     error
+}
+
+// sftpClient speaks SFTP over a channel. Requests may be sent from several goroutines; a reader
+// hands every reply to the request with its ID
+type sftpClient struct {
+	r io.Reader
+
+	writeMu sync.Mutex // Guards w
+	w       io.WriteCloser
+
+	mu      sync.Mutex // Guards the fields below
+	nextID  uint32
+	pending map[uint32]chan sftpReply
+	err     error // Why the connection ended, once it did
+}
+
+// newSFTPClient negotiates the protocol version over the streams of an SFTP subsystem
+func newSFTPClient(r io.Reader, w io.WriteCloser) (*sftpClient, error) {
+	c := &sftpClient{r: r, w: w, pending: map[uint32]chan sftpReply{}}
+	if err := c.send(sftpInit, binary.BigEndian.AppendUint32(nil, sftpProtocol)); err != nil {
+		return nil, err
+	}
+	kind, payload, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if kind != sftpVersion || len(payload) < 4 {
+		return nil, fmt.Errorf("sftp: unexpected packet %d during version negotiation", kind)
+	}
+	if version := binary.BigEndian.Uint32(payload); version < sftpProtocol {
+		return nil, fmt.Errorf("sftp: server speaks version %d", version)
+	}
+	go c.readReplies()
+	return c, nil
+}
+
+// readReplies hands replies to the requests waiting for them until the connection ends, then
+// fails the requests still waiting
+func (c *sftpClient) readReplies() {
+	var err error
+	for {
+		var kind byte
+		var payload []byte
+		if kind, payload, err = c.receive(); err != nil {
+			break
+		}
+		if len(payload) < 4 {
+			err = fmt.Errorf("sftp: reply without a request ID")
+			break
+		}
+		id := binary.BigEndian.Uint32(payload)
+		c.mu.Lock()
+		reply, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !ok {
+			err = fmt.Errorf("sftp: reply to unknown request %d", id)
+			break
+		}
+		reply <- sftpReply{kind: kind, payload: payload[4:]}
+	}
+
+	if err == io.EOF {
+		err = fmt.Errorf("sftp: connection closed")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for id, reply := range c.pending {
+		reply <- sftpReply{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// Close ends the session
+func (c *sftpClient) Close() error {
+	return c.w.Close()
+}
+
+// send writes a packet
+func (c *sftpClient) send(kind byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	packet := make([]byte, 0, 5+len(payload))
+	packet = binary.BigEndian.AppendUint32(packet, uint32(1+len(payload)))
+	packet = append(packet, kind)
+	packet = append(packet, payload...)
+	_, err := c.w.Write(packet)
+	return err
+}
+
+// receive reads a packet
+func (c *sftpClient) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > sftpMaxPacket+1024 {
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// request sends a request and waits for its reply
+func (c *sftpClient) request(kind byte, fields []byte) (byte, []byte, error) {
+	reply, err := c.start(kind, fields)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.wait(reply)
+}
+
+// start sends a request, returning where its reply arrives
+func (c *sftpClient) start(kind byte, fields []byte) (<-chan sftpReply, error) {
+	reply := make(chan sftpReply, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	if err := c.send(kind, append(binary.BigEndian.AppendUint32(nil, id), fields...)); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// wait waits for the reply to a request, returning the error of a failed status
+func (c *sftpClient) wait(reply <-chan sftpReply) (byte, []byte, error) {
+	r := <-reply
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if r.kind == sftpStatus {
+		return r.kind, r.payload, sftpStatusFrom(r.payload)
+	}
+	return r.kind, r.payload, nil
+}
+
+// sftpStatusFrom returns the error of a status reply, nil for OK
+func sftpStatusFrom(payload []byte) error {
+	if len(payload) < 4 {
+		return fmt.Errorf("sftp: short status")
+	}
+	code := binary.BigEndian.Uint32(payload)
+	if code == sftpOK {
+		return nil
+	}
+	message, _, _ := sftpString(payload[4:])
+	if message == "" {
+		message = "request failed"
+	}
+	return &sftpStatusError{code: code, message: message}
+}
+
+// sftpAppendString appends a length-prefixed string
+func sftpAppendString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+// sftpString reads a length-prefixed string
+func sftpString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("sftp: short string")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil, fmt.Errorf("sftp: short string")
+	}
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
+
+// sftpParseAttrs reads file attributes
+func sftpParseAttrs(b []byte) (sftpFileInfo, []byte, error) {
+	var info sftpFileInfo
+	short := fmt.Errorf("sftp: short attributes")
+	if len(b) < 4 {
+		return info, nil, short
+	}
+	flags := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if flags&sftpAttrSize != 0 {
+		if len(b) < 8 {
+			return info, nil, short
+		}
+		info.size = int64(binary.BigEndian.Uint64(b))
+		b = b[8:]
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		if len(b) < 8 {
+			return info, nil, short
+		}
+		b = b[8:]
+	}
+	if flags&sftpAttrPermissions != 0 {
+		if len(b) < 4 {
+			return info, nil, short
+		}
+		info.mode = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+	if flags&sftpAttrACModTime != 0 {
+		if len(b) < 8 {
+			return info, nil, short
+		}
+		info.modTime = time.Unix(int64(binary.BigEndian.Uint32(b[4:])), 0)
+		b = b[8:]
+	}
+	if flags&sftpAttrExtended != 0 {
+		if len(b) < 4 {
+			return info, nil, short
+		}
+		count := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		for i := uint32(0); i < 2*count; i++ {
+			var err error
+			if _, b, err = sftpString(b); err != nil {
+				return info, nil, err
+			}
+		}
+	}
+	return info, b, nil
+}
+
+// sftpNoAttrs are empty file attributes
+var sftpNoAttrs = []byte{0, 0, 0, 0}
+
+// handle sends a request answered with a handle
+func (c *sftpClient) handle(kind byte, fields []byte) (string, error) {
+	reply, payload, err := c.request(kind, fields)
+	if err != nil {
+		return "", err
+	}
+	if reply != sftpHandle {
+		return "", fmt.Errorf("sftp: unexpected reply %d", reply)
+	}
+	handle, _, err := sftpString(payload)
+	return handle, err
+}
+
+// status sends a request answered with a status
+func (c *sftpClient) status(kind byte, fields []byte) error {
+	reply, _, err := c.request(kind, fields)
+	if err == nil && reply != sftpStatus {
+		err = fmt.Errorf("sftp: unexpected reply %d", reply)
+	}
+	return err
+}
+
+// open opens a remote file with the given flags
+func (c *sftpClient) open(name string, flags uint32) (string, error) {
+	fields := sftpAppendString(nil, name)
+	fields = binary.BigEndian.AppendUint32(fields, flags)
+	return c.handle(sftpOpen, append(fields, sftpNoAttrs...))
+}
+
+// close closes a handle
+func (c *sftpClient) close(handle string) error {
+	return c.status(sftpClose, sftpAppendString(nil, handle))
+}
+
+// Stat describes a remote file
+func (c *sftpClient) Stat(name string) (sftpFileInfo, error) {
+	reply, payload, err := c.request(sftpStat, sftpAppendString(nil, name))
+	if err != nil {
+		return sftpFileInfo{}, err
+	}
+	if reply != sftpAttrs {
+		return sftpFileInfo{}, fmt.Errorf("sftp: unexpected reply %d", reply)
+	}
+	info, _, err := sftpParseAttrs(payload)
+	info.name = name
+	return info, err
+}
+
+// Remove deletes a remote file
+func (c *sftpClient) Remove(name string) error {
+	return c.status(sftpRemove, sftpAppendString(nil, name))
+}
+
+// Rename moves a remote file; most servers refuse to replace an existing file
+func (c *sftpClient) Rename(from, to string) error {
+	return c.status(sftpRename, sftpAppendString(sftpAppendString(nil, from), to))
+}
+
+// Mkdir creates a remote directory
+func (c *sftpClient) Mkdir(name string) error {
+	return c.status(sftpMkdir, append(sftpAppendString(nil, name), sftpNoAttrs...))
+}
+
+// ReadDir lists a remote directory, without . and ..
+func (c *sftpClient) ReadDir(name string) ([]sftpFileInfo, error) {
+	handle, err := c.handle(sftpOpendir, sftpAppendString(nil, name))
+	if err != nil {
+		return nil, err
+	}
+	defer c.close(handle)
+
+	var entries []sftpFileInfo
+	for {
+		reply, payload, err := c.request(sftpReaddir, sftpAppendString(nil, handle))
+		var status *sftpStatusError
+		if errors.As(err, &status) && status.code == sftpEOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if reply != sftpName || len(payload) < 4 {
+			return nil, fmt.Errorf("sftp: unexpected reply %d", reply)
+		}
+		count := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		for i := uint32(0); i < count; i++ {
+			var entry sftpFileInfo
+			if entry.name, payload, err = sftpString(payload); err != nil {
+				return nil, err
+			}
+			if _, payload, err = sftpString(payload); err != nil { // Long name
+				return nil, err
+			}
+			name := entry.name
+			if entry, payload, err = sftpParseAttrs(payload); err != nil {
+				return nil, err
+			}
+			entry.name = name
+			if name != "." && name != ".." {
+				entries = append(entries, entry)
+			}
+		}
+	}
+}
+
+// WriteFile creates or truncates a remote file and writes size bytes of body to it, sending
+// several writes ahead of their replies
+func (c *sftpClient) WriteFile(name string, body io.Reader, size int64) error {
+	handle, err := c.open(name, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		var pending []<-chan sftpReply
+		// Writes already sent are waited for even after a failure, so none lands after the
+		// handle is closed
+		defer func() {
+			for _, reply := range pending {
+				<-reply
+			}
+		}()
+
+		var offset int64
+		buffer := make([]byte, sftpChunkSize)
+		for {
+			n, readErr := io.ReadFull(body, buffer)
+			if n > 0 {
+				fields := sftpAppendString(nil, handle)
+				fields = binary.BigEndian.AppendUint64(fields, uint64(offset))
+				fields = binary.BigEndian.AppendUint32(fields, uint32(n))
+				reply, err := c.start(sftpWrite, append(fields, buffer[:n]...))
+				if err != nil {
+					return err
+				}
+				pending = append(pending, reply)
+				offset += int64(n)
+			}
+			for len(pending) >= sftpMaxInFlight || (len(pending) > 0 && readErr != nil) {
+				reply := pending[0]
+				pending = pending[1:]
+				if _, _, err := c.wait(reply); err != nil {
+					return err
+				}
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+		if size >= 0 && offset != size {
+			return fmt.Errorf("wrote %d bytes of %s, expected %d", offset, name, size)
+		}
+		return nil
+	}()
+	if closeErr := c.close(handle); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// OpenFile opens a remote file for reading
+func (c *sftpClient) OpenFile(name string) (*sftpFile, error) {
+	handle, err := c.open(name, sftpFlagRead)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{client: c, handle: handle}, nil
+}
+
+// sftpFile reads a remote file from start to end
+type sftpFile struct {
+	client *sftpClient
+	handle string
+	offset int64
+	buffer []byte
+	eof    bool
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	for len(f.buffer) == 0 {
+		if f.eof {
+			return 0, io.EOF
+		}
+		fields := sftpAppendString(nil, f.handle)
+		fields = binary.BigEndian.AppendUint64(fields, uint64(f.offset))
+		fields = binary.BigEndian.AppendUint32(fields, sftpChunkSize)
+		reply, payload, err := f.client.request(sftpRead, fields)
+		var status *sftpStatusError
+		if errors.As(err, &status) && status.code == sftpEOF {
+			f.eof = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if reply != sftpData {
+			return 0, fmt.Errorf("sftp: unexpected reply %d", reply)
+		}
+		data, _, err := sftpString(payload)
+		if err != nil {
+			return 0, err
+		}
+		f.buffer = []byte(data)
+		f.offset += int64(len(data))
+	}
+	n := copy(p, f.buffer)
+	f.buffer = f.buffer[n:]
+	return n, nil
+}
+
+// Close closes the remote file
+func (f *sftpFile) Close() error {
+	return f.client.close(f.handle)
+}
+
+// sftpNotExist maps missing files to the error the storage backends use
+func sftpNotExist(err error) error {
+	if sftpIsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
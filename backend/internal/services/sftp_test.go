@@ -0,0 +1,352 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSFTPServer answers the requests the client makes from an in-memory file tree
+type fakeSFTPServer struct {
+	files   map[string][]byte
+	dirs    map[string]bool
+	handles map[string]string
+	listed  map[string]bool
+	next    int
+	reorder bool // Answer every second write before the one sent ahead of it
+}
+
+// serve answers requests read from r on w until r is closed
+func (s *fakeSFTPServer) serve(r io.Reader, w io.Writer) {
+	client := &sftpClient{r: r}
+	var held []byte // A write reply kept back to be sent after the next one
+	for {
+		kind, payload, err := client.receive()
+		if err != nil {
+			return
+		}
+		if kind == sftpInit {
+			s.send(w, sftpVersion, binary.BigEndian.AppendUint32(nil, sftpProtocol))
+			continue
+		}
+		id := payload[:4]
+		reply, fields := s.handle(kind, payload[4:])
+		fields = append(append([]byte{}, id...), fields...)
+		if s.reorder && kind == sftpWrite && held == nil {
+			held = fields
+			continue
+		}
+		s.send(w, reply, fields)
+		if held != nil {
+			s.send(w, sftpStatus, held)
+			held = nil
+		}
+	}
+}
+
+func (s *fakeSFTPServer) send(w io.Writer, kind byte, payload []byte) {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	w.Write(append(append(packet, kind), payload...))
+}
+
+func sftpStatusReply(code uint32, message string) (byte, []byte) {
+	return sftpStatus, sftpAppendString(sftpAppendString(binary.BigEndian.AppendUint32(nil, code), message), "")
+}
+
+func (s *fakeSFTPServer) attrs(name string) []byte {
+	if s.dirs[name] {
+		fields := binary.BigEndian.AppendUint32(nil, sftpAttrPermissions)
+		return binary.BigEndian.AppendUint32(fields, sftpModeDir|0o755)
+	}
+	fields := binary.BigEndian.AppendUint32(nil, sftpAttrSize|sftpAttrPermissions)
+	fields = binary.BigEndian.AppendUint64(fields, uint64(len(s.files[name])))
+	return binary.BigEndian.AppendUint32(fields, 0o100644)
+}
+
+func (s *fakeSFTPServer) handle(kind byte, fields []byte) (byte, []byte) {
+	name, rest, _ := sftpString(fields)
+	clean := path.Clean(name)
+	_, isFile := s.files[clean]
+	missing := !isFile && !s.dirs[clean]
+
+	switch kind {
+	case sftpOpen:
+		flags := binary.BigEndian.Uint32(rest)
+		if flags&sftpFlagCreat != 0 {
+			if !s.dirs[path.Dir(clean)] {
+				return sftpStatusReply(sftpNoSuchFile, "no such directory")
+			}
+			s.files[clean] = nil
+		} else if !isFile {
+			return sftpStatusReply(sftpNoSuchFile, "no such file")
+		}
+		return s.newHandle(clean)
+	case sftpOpendir:
+		if !s.dirs[clean] {
+			return sftpStatusReply(sftpNoSuchFile, "no such directory")
+		}
+		return s.newHandle(clean)
+	case sftpClose:
+		delete(s.handles, name)
+		return sftpStatusReply(sftpOK, "")
+	case sftpRead:
+		data := s.files[s.handles[name]]
+		offset := binary.BigEndian.Uint64(rest)
+		length := uint64(binary.BigEndian.Uint32(rest[8:]))
+		if offset >= uint64(len(data)) {
+			return sftpStatusReply(sftpEOF, "")
+		}
+		end := min(offset+length, uint64(len(data)))
+		return sftpData, sftpAppendString(nil, string(data[offset:end]))
+	case sftpWrite:
+		file := s.handles[name]
+		offset := binary.BigEndian.Uint64(rest)
+		data, _, _ := sftpString(rest[8:])
+		content := s.files[file]
+		for uint64(len(content)) < offset+uint64(len(data)) {
+			content = append(content, 0)
+		}
+		copy(content[offset:], data)
+		s.files[file] = content
+		return sftpStatusReply(sftpOK, "")
+	case sftpReaddir:
+		dir := s.handles[name]
+		if s.listed[name] {
+			return sftpStatusReply(sftpEOF, "")
+		}
+		s.listed[name] = true
+		var names []string
+		for entry := range s.files {
+			if path.Dir(entry) == dir {
+				names = append(names, entry)
+			}
+		}
+		for entry := range s.dirs {
+			if entry != dir && path.Dir(entry) == dir {
+				names = append(names, entry)
+			}
+		}
+		reply := binary.BigEndian.AppendUint32(nil, uint32(len(names)+2))
+		reply = append(sftpAppendString(sftpAppendString(reply, "."), ""), sftpNoAttrs...)
+		reply = append(sftpAppendString(sftpAppendString(reply, ".."), ""), sftpNoAttrs...)
+		for _, entry := range names {
+			reply = sftpAppendString(sftpAppendString(reply, path.Base(entry)), "")
+			reply = append(reply, s.attrs(entry)...)
+		}
+		return sftpName, reply
+	case sftpRemove:
+		if !isFile {
+			return sftpStatusReply(sftpNoSuchFile, "no such file")
+		}
+		delete(s.files, clean)
+		return sftpStatusReply(sftpOK, "")
+	case sftpMkdir:
+		if !missing || !s.dirs[path.Dir(clean)] {
+			return sftpStatusReply(4, "failure")
+		}
+		s.dirs[clean] = true
+		return sftpStatusReply(sftpOK, "")
+	case sftpStat:
+		if missing {
+			return sftpStatusReply(sftpNoSuchFile, "no such file")
+		}
+		return sftpAttrs, s.attrs(clean)
+	case sftpRename:
+		target, _, _ := sftpString(rest)
+		target = path.Clean(target)
+		if _, exists := s.files[target]; exists || !isFile {
+			return sftpStatusReply(4, "failure")
+		}
+		s.files[target] = s.files[clean]
+		delete(s.files, clean)
+		return sftpStatusReply(sftpOK, "")
+	}
+	return sftpStatusReply(8, "unsupported")
+}
+
+func (s *fakeSFTPServer) newHandle(name string) (byte, []byte) {
+	s.next++
+	handle := fmt.Sprintf("h%d", s.next)
+	s.handles[handle] = name
+	return sftpHandle, sftpAppendString(nil, handle)
+}
+
+// queueWriter queues what is written to it
+type queueWriter chan []byte
+
+func (q queueWriter) Write(p []byte) (int, error) {
+	q <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+// connectFakeSFTP returns a client of a fake server with an empty home directory
+func connectFakeSFTP(t *testing.T, reorder bool) (*sftpClient, *fakeSFTPServer) {
+	t.Helper()
+	server := &fakeSFTPServer{
+		files:   map[string][]byte{},
+		dirs:    map[string]bool{".": true, "/": true},
+		handles: map[string]string{},
+		listed:  map[string]bool{},
+		reorder: reorder,
+	}
+	// Replies are queued like an SSH channel buffers them, so pipelined requests do not deadlock
+	requests, requestWriter := io.Pipe()
+	replyReader, replies := io.Pipe()
+	queue := make(chan []byte, 4*sftpMaxInFlight)
+	go func() {
+		for packet := range queue {
+			replies.Write(packet)
+		}
+	}()
+	go func() {
+		server.serve(requests, queueWriter(queue))
+		close(queue)
+	}()
+
+	client, err := newSFTPClient(replyReader, requestWriter)
+	if err != nil {
+		t.Fatalf("newSFTPClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, server
+}
+
+func TestSFTPClient(t *testing.T) {
+	client, server := connectFakeSFTP(t, false)
+
+	if err := sftpMkdirAll(client, "backups/project-1"); err != nil {
+		t.Fatalf("sftpMkdirAll: %v", err)
+	}
+	// Enough to keep writes in flight
+	content := bytes.Repeat([]byte("0123456789abcdef"), sftpChunkSize*sftpMaxInFlight/8+3)
+	if err := client.WriteFile("backups/project-1/a.tar.gz", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if !bytes.Equal(server.files["backups/project-1/a.tar.gz"], content) {
+		t.Fatalf("server holds %d bytes, want %d", len(server.files["backups/project-1/a.tar.gz"]), len(content))
+	}
+
+	info, err := client.Stat("backups/project-1/a.tar.gz")
+	if err != nil || info.size != int64(len(content)) || info.isDir() {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	if info, err := client.Stat("backups"); err != nil || !info.isDir() {
+		t.Errorf("Stat of a directory = %+v, %v", info, err)
+	}
+
+	file, err := client.OpenFile("backups/project-1/a.tar.gz")
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	read, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("read %d bytes back, %v", len(read), err)
+	}
+
+	if err := client.Rename("backups/project-1/a.tar.gz", "backups/project-1/b.tar.gz"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	client.WriteFile("backups/project-1/c.tar.gz", strings.NewReader("c"), 1)
+	entries, err := client.ReadDir("backups/project-1")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "b.tar.gz,c.tar.gz" {
+		t.Errorf("ReadDir = %v, want b.tar.gz and c.tar.gz", names)
+	}
+
+	if err := client.Remove("backups/project-1/b.tar.gz"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := client.Stat("backups/project-1/b.tar.gz"); !sftpIsNotExist(err) {
+		t.Errorf("Stat of a removed file = %v, want no such file", err)
+	}
+	if _, err := client.OpenFile("missing"); !errors.Is(sftpNotExist(err), ErrObjectNotFound) {
+		t.Errorf("OpenFile of a missing file = %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestSFTPWriteFileShort(t *testing.T) {
+	client, _ := connectFakeSFTP(t, false)
+	if err := client.WriteFile("short", strings.NewReader("abc"), 10); err == nil {
+		t.Error("WriteFile of a body shorter than its size succeeded")
+	}
+}
+
+func TestSFTPRepliesOutOfOrder(t *testing.T) {
+	client, server := connectFakeSFTP(t, true)
+
+	// More chunks than are kept in flight, and an even number so the next write releases every
+	// reply held back
+	content := bytes.Repeat([]byte("0123456789abcdef"), sftpChunkSize*(sftpMaxInFlight+2)/16)
+	if err := client.WriteFile("reordered", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if !bytes.Equal(server.files["reordered"], content) {
+		t.Errorf("server holds %d bytes, want %d", len(server.files["reordered"]), len(content))
+	}
+
+	// Requests of several goroutines share the connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if info, err := client.Stat("reordered"); err != nil || info.size != int64(len(content)) {
+				errs <- fmt.Errorf("Stat = %+v, %v", info, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSFTPConnectionClosed(t *testing.T) {
+	requests, requestWriter := io.Pipe()
+	replyReader, replies := io.Pipe()
+	go func() {
+		// Negotiate the version, then hang up on the first request
+		server := &sftpClient{r: requests}
+		server.receive()
+		(&fakeSFTPServer{}).send(replies, sftpVersion, binary.BigEndian.AppendUint32(nil, sftpProtocol))
+		server.receive()
+		replies.Close()
+	}()
+
+	client, err := newSFTPClient(replyReader, requestWriter)
+	if err != nil {
+		t.Fatalf("newSFTPClient: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Stat("file"); err == nil {
+		t.Error("Stat over a closed connection succeeded")
+	}
+	if _, err := client.Stat("file"); err == nil {
+		t.Error("Stat after the connection closed succeeded")
+	}
+}
+
+func TestNewSFTPStorageRoot(t *testing.T) {
+	for root, want := range map[string]string{"": ".", "~": ".", "~/backups": "backups", "/var/backups": "/var/backups", "backups/": "backups/"} {
+		if got := NewSFTPStorage(nil, root).root; got != want {
+			t.Errorf("root %q = %q, want %q", root, got, want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Lifetimes of signed URLs
+const (
+	DefaultSignedURLExpiry = time.Hour
+	MaxSignedURLExpiry     = 7 * 24 * time.Hour
+)
+
+const signedURLSweepInterval = time.Hour
+
+// Signed URL errors
+var (
+	ErrSignedURLInvalid    = errors.New("invalid signature")
+	ErrSignedURLExpired    = errors.New("signed URL expired")
+	ErrSignedURLIPMismatch = errors.New("signed URL is bound to another IP address")
+	ErrSignedURLUsedUp     = errors.New("signed URL use limit reached")
+)
+
+// SignedURL is access to a path of a bucket granted by a signed URL. Every field is covered
+// by the signature.
+type SignedURL struct {
+	Method      string // GET to download, PUT to upload
+	ProjectID   uint
+	Bucket      string
+	Path        string // Within the bucket
+	ExpiresAt   time.Time
+	IP          string // Only this client may use the URL, if set
+	Disposition string // inline or attachment, overriding the default, if set
+	FileName    string // Downloads: file name of the disposition; uploads: original name of the file
+	Grant       string // ID of the SignedURLGrant limiting its uses, if any
+}
+
+// SignedURLService signs and verifies URLs that give access to files of private buckets
+// without an API key
+type SignedURLService struct {
+	db   *gorm.DB
+	cfg  *config.Config
+	once sync.Once
+}
+
+// NewSignedURLService creates a new signed URL service
+func NewSignedURLService(db *gorm.DB, cfg *config.Config) *SignedURLService {
+	return &SignedURLService{db: db, cfg: cfg}
+}
+
+// key returns the HMAC key URLs are signed with
+func (s *SignedURLService) key() []byte {
+	if s.cfg.SignedURLSecret != "" {
+		return []byte(s.cfg.SignedURLSecret)
+	}
+	return []byte(s.cfg.JWTSecret)
+}
+
+// signature returns the HMAC-SHA256 of a signed URL
+func (s *SignedURLService) signature(u SignedURL) string {
+	mac := hmac.New(sha256.New, s.key())
+	mac.Write([]byte(strings.Join([]string{
+		u.Method,
+		strconv.FormatUint(uint64(u.ProjectID), 10),
+		u.Bucket,
+		u.Path,
+		strconv.FormatInt(u.ExpiresAt.Unix(), 10),
+		u.IP,
+		u.Disposition,
+		u.FileName,
+		u.Grant,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Query returns the query parameters carrying a signed URL
+func (s *SignedURLService) Query(u SignedURL) url.Values {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(u.ExpiresAt.Unix(), 10))
+	for name, value := range map[string]string{
+		"ip":          u.IP,
+		"disposition": u.Disposition,
+		"filename":    u.FileName,
+		"grant":       u.Grant,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	query.Set("signature", s.signature(u))
+	return query
+}
+
+// URL returns the signed URL of the public file route
+func (s *SignedURLService) URL(u SignedURL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s/public/%d/%s/%s?%s", strings.TrimSuffix(s.cfg.BaseURL, "/"), u.ProjectID,
+		url.PathEscape(u.Bucket), strings.Join(segments, "/"), s.Query(u).Encode())
+}
+
+// Verify checks the signed query of a request for a path of a bucket, and that the URL is
+// still valid for the client
+func (s *SignedURLService) Verify(method string, projectID uint, bucket, path string, query url.Values, clientIP string) (SignedURL, error) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return SignedURL{}, ErrSignedURLInvalid
+	}
+	u := SignedURL{
+		Method:      method,
+		ProjectID:   projectID,
+		Bucket:      bucket,
+		Path:        path,
+		ExpiresAt:   time.Unix(expires, 0),
+		IP:          query.Get("ip"),
+		Disposition: query.Get("disposition"),
+		FileName:    query.Get("filename"),
+		Grant:       query.Get("grant"),
+	}
+
+	want, _ := hex.DecodeString(s.signature(u))
+	got, err := hex.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(got, want) {
+		return SignedURL{}, ErrSignedURLInvalid
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return SignedURL{}, ErrSignedURLExpired
+	}
+	if u.IP != "" && !net.ParseIP(u.IP).Equal(net.ParseIP(clientIP)) {
+		return SignedURL{}, ErrSignedURLIPMismatch
+	}
+	return u, nil
+}
+
+// CreateGrant records a use limit for a signed URL of a file and returns its ID
+func (s *SignedURLService) CreateGrant(projectID uint, fileID string, maxUses int, expiresAt time.Time) (string, error) {
+	grant := models.SignedURLGrant{
+		ID:        uuid.New().String(),
+		ProjectID: projectID,
+		FileID:    fileID,
+		MaxUses:   maxUses,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.db.Create(&grant).Error; err != nil {
+		return "", err
+	}
+	return grant.ID, nil
+}
+
+// UseGrant counts a use against the limit of a signed URL
+func (s *SignedURLService) UseGrant(grantID string, fileID string) error {
+	result := s.db.Model(&models.SignedURLGrant{}).
+		Where("id = ? AND file_id = ? AND uses < max_uses", grantID, fileID).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSignedURLUsedUp
+	}
+	return nil
+}
+
+// ReleaseGrant takes back a use of a signed URL that failed
+func (s *SignedURLService) ReleaseGrant(grantID string) error {
+	return s.db.Model(&models.SignedURLGrant{}).Where("id = ? AND uses > 0", grantID).
+		UpdateColumn("uses", gorm.Expr("uses - 1")).Error
+}
+
+// Start deletes the grants of expired URLs periodically in the background
+func (s *SignedURLService) Start() {
+	s.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(signedURLSweepInterval)
+			defer ticker.Stop()
+			for {
+				if err := s.Sweep(context.Background()); err != nil {
+					log.Printf("Signed URL sweep failed: %v", err)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// Sweep deletes the grants of expired URLs
+func (s *SignedURLService) Sweep(ctx context.Context) error {
+	return s.db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&models.SignedURLGrant{}).Error
+}
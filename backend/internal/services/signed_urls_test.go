@@ -0,0 +1,82 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+)
+
+func TestSignedURLVerify(t *testing.T) {
+	service := NewSignedURLService(nil, &config.Config{BaseURL: "https://cloud.example.com/", SignedURLSecret: "secret"})
+	signed := SignedURL{
+		Method:      http.MethodGet,
+		ProjectID:   7,
+		Bucket:      "photos",
+		Path:        "2024/my trip/a.png",
+		ExpiresAt:   time.Now().Add(time.Hour).Truncate(time.Second),
+		IP:          "203.0.113.9",
+		Disposition: "attachment",
+	}
+
+	raw := service.URL(signed)
+	if !strings.HasPrefix(raw, "https://cloud.example.com/public/7/photos/2024/my%20trip/a.png?") {
+		t.Fatalf("URL = %s", raw)
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+
+	got, err := service.Verify(http.MethodGet, 7, "photos", "2024/my trip/a.png", query, "203.0.113.9")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got != signed {
+		t.Errorf("Verify = %+v, want %+v", got, signed)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		ip     string
+		tamper func(url.Values)
+		want   error
+	}{
+		{"other path", http.MethodGet, "2024/my trip/b.png", "203.0.113.9", nil, ErrSignedURLInvalid},
+		{"upload with a download URL", http.MethodPut, "2024/my trip/a.png", "203.0.113.9", nil, ErrSignedURLInvalid},
+		{"other client", http.MethodGet, "2024/my trip/a.png", "198.51.100.1", nil, ErrSignedURLIPMismatch},
+		{"longer expiry", http.MethodGet, "2024/my trip/a.png", "203.0.113.9", func(q url.Values) { q.Set("expires", "9999999999") }, ErrSignedURLInvalid},
+		{"dropped IP binding", http.MethodGet, "2024/my trip/a.png", "198.51.100.1", func(q url.Values) { q.Del("ip") }, ErrSignedURLInvalid},
+		{"changed disposition", http.MethodGet, "2024/my trip/a.png", "203.0.113.9", func(q url.Values) { q.Set("disposition", "inline") }, ErrSignedURLInvalid},
+		{"no signature", http.MethodGet, "2024/my trip/a.png", "203.0.113.9", func(q url.Values) { q.Del("signature") }, ErrSignedURLInvalid},
+	}
+	for _, tt := range tests {
+		q := url.Values{}
+		for name, values := range query {
+			q[name] = append([]string(nil), values...)
+		}
+		if tt.tamper != nil {
+			tt.tamper(q)
+		}
+		if _, err := service.Verify(tt.method, 7, "photos", tt.path, q, tt.ip); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	signed.ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err := service.Verify(http.MethodGet, 7, "photos", signed.Path, service.Query(signed), "203.0.113.9"); !errors.Is(err, ErrSignedURLExpired) {
+		t.Errorf("expired: Verify = %v, want ErrSignedURLExpired", err)
+	}
+
+	other := NewSignedURLService(nil, &config.Config{SignedURLSecret: "another secret"})
+	if _, err := other.Verify(http.MethodGet, 7, "photos", "2024/my trip/a.png", query, "203.0.113.9"); !errors.Is(err, ErrSignedURLInvalid) {
+		t.Errorf("other key: Verify = %v, want ErrSignedURLInvalid", err)
+	}
+}
@@ -0,0 +1,492 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+)
+
+// Storage backends files can be stored in
+const (
+	StorageBackendLocal = "local"
+	StorageBackendS3    = "s3"
+)
+
+// FolderMarker is the object that keeps a folder listed while it holds no files; object stores
+// have no directories
+const FolderMarker = ".folder"
+
+var (
+	// ErrObjectNotFound is returned for keys a backend holds no object under
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrPresignUnsupported is returned by backends that cannot hand out direct URLs
+	ErrPresignUnsupported = errors.New("storage backend does not support presigned URLs")
+	// ErrInvalidObjectKey is returned for empty, absolute or traversing keys
+	ErrInvalidObjectKey = errors.New("invalid object key")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	ContentType string    `json:"content_type,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+}
+
+// StorageBackend stores the objects of file buckets under slash-separated keys
+type StorageBackend interface {
+	// Name returns the name buckets and files refer to the backend by
+	Name() string
+	// Put stores size bytes of body under key, replacing any object there
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get opens the object under key; the caller closes the reader
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Stat describes the object under key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes the object under key; deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+	// List describes every object whose key starts with prefix, ordered by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Presign returns a URL clients can use with method on key until expires has passed
+	Presign(method, key string, expires time.Duration) (string, error)
+}
+
+// StorageBackends holds the configured storage backends by name
+type StorageBackends struct {
+	backends map[string]StorageBackend
+	fallback string
+}
+
+// NewStorageBackends creates the local backend rooted at the upload path, and the S3 backend
+// when a bucket is configured for it
+func NewStorageBackends(cfg *config.Config) *StorageBackends {
+	backends := &StorageBackends{
+		backends: map[string]StorageBackend{StorageBackendLocal: NewLocalStorage(cfg.UploadPath)},
+		fallback: cfg.StorageBackend,
+	}
+	if cfg.S3Bucket != "" {
+		s3, err := NewS3Storage(S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			PathStyle:       cfg.S3PathStyle,
+		})
+		if err != nil {
+			log.Printf("S3 storage backend disabled: %v", err)
+		} else {
+			backends.backends[StorageBackendS3] = s3
+		}
+	}
+	if _, ok := backends.backends[backends.fallback]; !ok {
+		backends.fallback = StorageBackendLocal
+	}
+	return backends
+}
+
+// Get returns the backend called name; an empty name is the local backend files had before
+// backends were configurable
+func (s *StorageBackends) Get(name string) (StorageBackend, error) {
+	if name == "" {
+		name = StorageBackendLocal
+	}
+	backend, ok := s.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q is not configured", name)
+	}
+	return backend, nil
+}
+
+// Default returns the name of the backend new buckets are created in
+func (s *StorageBackends) Default() string {
+	return s.fallback
+}
+
+// Names returns the names of the configured backends
+func (s *StorageBackends) Names() []string {
+	names := make([]string, 0, len(s.backends))
+	for name := range s.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BucketPrefix returns the key prefix of the objects of a bucket
+func BucketPrefix(projectID uint, bucketName string) string {
+	return strconv.FormatUint(uint64(projectID), 10) + "/" + bucketName + "/"
+}
+
+// ObjectKey returns the key of an object in a folder of a bucket; an empty folder is the root
+func ObjectKey(projectID uint, bucketName, folder, name string) string {
+	return BucketPrefix(projectID, bucketName) + strings.TrimPrefix(path.Join(filepath.ToSlash(folder), name), "/")
+}
+
+// validateObjectKey rejects keys that are empty, absolute or contain "." or ".." segments
+func validateObjectKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidObjectKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidObjectKey
+		}
+	}
+	return nil
+}
+
+// CopyObject copies an object between (or within) backends and checks the copy has the size of
+// the original
+func CopyObject(ctx context.Context, src StorageBackend, srcKey string, dst StorageBackend, dstKey string) (ObjectInfo, error) {
+	body, info, err := src.Get(ctx, srcKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer body.Close()
+
+	if err := dst.Put(ctx, dstKey, body, info.Size, info.ContentType); err != nil {
+		return ObjectInfo{}, err
+	}
+	copied, err := dst.Stat(ctx, dstKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if copied.Size != info.Size {
+		dst.Delete(ctx, dstKey)
+		return ObjectInfo{}, fmt.Errorf("copy of %s has %d bytes, expected %d", srcKey, copied.Size, info.Size)
+	}
+	return copied, nil
+}
+
+// ObjectChecksum returns the hex SHA-256 of an object, as stored in File.Checksum
+func ObjectChecksum(ctx context.Context, backend StorageBackend, key string) (string, error) {
+	body, _, err := backend.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// DeletePrefix deletes every object whose key starts with prefix
+func DeletePrefix(ctx context.Context, backend StorageBackend, prefix string) error {
+	objects, err := backend.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := backend.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateBucket moves the objects of a bucket to another backend. New uploads go to the target
+// from the start; each file is copied, verified against its checksum and switched over before
+// its source object is deleted, so the bucket stays readable throughout and an interrupted
+// migration can be run again. It returns the number of files moved.
+func MigrateBucket(ctx context.Context, db *gorm.DB, backends *StorageBackends, projectID uint, bucketName, target string) (int, error) {
+	var bucket models.Bucket
+	if err := db.Where("project_id = ? AND name = ?", projectID, bucketName).First(&bucket).Error; err != nil {
+		return 0, fmt.Errorf("bucket %s of project %d not found: %w", bucketName, projectID, err)
+	}
+	dst, err := backends.Get(target)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := db.Model(&bucket).UpdateColumn("storage_backend", target).Error; err != nil {
+		return 0, fmt.Errorf("failed to switch bucket to %s: %w", target, err)
+	}
+
+	moved := 0
+	for {
+		var files []models.File
+		if err := db.Where("project_id = ? AND bucket_name = ? AND storage_backend <> ?", projectID, bucketName, target).
+			Order("created_at").Limit(100).Find(&files).Error; err != nil {
+			return moved, fmt.Errorf("failed to load files: %w", err)
+		}
+		if len(files) == 0 {
+			break
+		}
+
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+			if err := migrateFile(ctx, db, backends, file, dst); err != nil {
+				return moved, fmt.Errorf("failed to migrate file %s (%s): %w", file.ID, file.FilePath, err)
+			}
+			moved++
+		}
+	}
+
+	// Folder markers have no file records
+	prefix := BucketPrefix(projectID, bucketName)
+	for _, name := range backends.Names() {
+		if name == target {
+			continue
+		}
+		src, _ := backends.Get(name)
+		objects, err := src.List(ctx, prefix)
+		if err != nil {
+			return moved, fmt.Errorf("failed to list %s objects: %w", name, err)
+		}
+		for _, object := range objects {
+			if path.Base(object.Key) != FolderMarker {
+				continue
+			}
+			if _, err := CopyObject(ctx, src, object.Key, dst, object.Key); err != nil {
+				return moved, fmt.Errorf("failed to copy folder %s: %w", path.Dir(object.Key), err)
+			}
+			src.Delete(ctx, object.Key)
+		}
+	}
+
+	return moved, nil
+}
+
+// migrateFile moves the object of a file to dst and points the file record at it
+func migrateFile(ctx context.Context, db *gorm.DB, backends *StorageBackends, file models.File, dst StorageBackend) error {
+	src, err := backends.Get(file.StorageBackend)
+	if err != nil {
+		return err
+	}
+
+	if _, err := CopyObject(ctx, src, file.FilePath, dst, file.FilePath); err != nil {
+		return err
+	}
+	if file.Checksum != "" {
+		checksum, err := ObjectChecksum(ctx, dst, file.FilePath)
+		if err != nil {
+			return err
+		}
+		if checksum != file.Checksum {
+			dst.Delete(ctx, file.FilePath)
+			return fmt.Errorf("checksum mismatch: copied %s, expected %s", checksum, file.Checksum)
+		}
+	}
+
+	// A file moved or deleted meanwhile keeps its record; its copy is orphaned, not lost
+	result := db.Model(&models.File{}).
+		Where("id = ? AND storage_backend = ? AND file_path = ?", file.ID, file.StorageBackend, file.FilePath).
+		UpdateColumn("storage_backend", dst.Name())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		dst.Delete(ctx, file.FilePath)
+		return nil
+	}
+
+	if err := src.Delete(ctx, file.FilePath); err != nil {
+		log.Printf("Failed to delete migrated object %s from %s: %v", file.FilePath, src.Name(), err)
+	}
+	return nil
+}
+
+// LocalStorage stores objects as files below a directory
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage creates a local backend rooted at dir
+func NewLocalStorage(dir string) *LocalStorage {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		root = filepath.Clean(dir)
+	}
+	return &LocalStorage{root: root}
+}
+
+// Name implements StorageBackend
+func (s *LocalStorage) Name() string {
+	return StorageBackendLocal
+}
+
+// path returns the file an object key is stored in
+func (s *LocalStorage) path(key string) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put implements StorageBackend; the object is written to a temporary file first so readers
+// never see a partial object
+func (s *LocalStorage) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("wrote %d bytes of %s, expected %d", written, key, size)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Get implements StorageBackend; the reader is an *os.File and so also an io.ReadSeeker
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, ObjectInfo{}, localStorageError(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	return file, localObjectInfo(key, stat), nil
+}
+
+// Stat implements StorageBackend
+func (s *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		return ObjectInfo{}, localStorageError(err)
+	}
+	if stat.IsDir() {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	return localObjectInfo(key, stat), nil
+}
+
+// Delete implements StorageBackend; directories left empty are removed as well
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(name); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// List implements StorageBackend
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory the prefix names
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		var err error
+		if dir, err = s.path(prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, localObjectInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Presign implements StorageBackend; local objects are only served through the API
+func (s *LocalStorage) Presign(method, key string, expires time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+// localObjectInfo describes a stored file
+func localObjectInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ETag:        fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
+
+// localStorageError maps missing files to ErrObjectNotFound
+func localStorageError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// StorageBackendSFTP stores objects on a server reached over SSH
+const StorageBackendSFTP = "sftp"
+
+// SFTPStorage stores objects in a directory of a server reached over SSH, connecting for every
+// operation
+type SFTPStorage struct {
+	dial func(ctx context.Context) (*ssh.Client, error)
+	root string // Relative to the home directory unless absolute
+}
+
+// NewSFTPStorage creates an SFTP backend storing objects under root; a leading ~/ is the home
+// directory of the user. Connections dial makes should end with its context
+func NewSFTPStorage(dial func(ctx context.Context) (*ssh.Client, error), root string) *SFTPStorage {
+	if root == "~" || root == "" {
+		root = "."
+	} else if strings.HasPrefix(root, "~/") {
+		root = path.Join(".", root[2:])
+	}
+	return &SFTPStorage{dial: dial, root: root}
+}
+
+// connect opens an SFTP session for an operation; close ends it along with the connection
+func (s *SFTPStorage) connect(ctx context.Context) (client *sftpClient, close func(), err error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	close = func() {
+		session.Close()
+		conn.Close()
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		close()
+		return nil, nil, fmt.Errorf("failed to start sftp: %w", err)
+	}
+	if client, err = newSFTPClient(stdout, stdin); err != nil {
+		close()
+		return nil, nil, err
+	}
+	return client, close, nil
+}
+
+// path returns the remote path of a key
+func (s *SFTPStorage) path(key string) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return path.Join(s.root, key), nil
+}
+
+// Name implements StorageBackend
+func (s *SFTPStorage) Name() string {
+	return StorageBackendSFTP
+}
+
+// Put implements StorageBackend, writing to a temporary file moved into place once complete
+func (s *SFTPStorage) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	client, close, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer close()
+
+	if err := sftpMkdirAll(client, path.Dir(name)); err != nil {
+		return err
+	}
+	partial := name + ".partial"
+	if err := client.WriteFile(partial, body, size); err != nil {
+		client.Remove(partial)
+		return err
+	}
+	if err := client.Remove(name); err != nil && !sftpIsNotExist(err) {
+		client.Remove(partial)
+		return err
+	}
+	return client.Rename(partial, name)
+}
+
+// sftpMkdirAll creates a remote directory and its parents
+func sftpMkdirAll(client *sftpClient, dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	info, err := client.Stat(dir)
+	if err == nil {
+		if !info.isDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if !sftpIsNotExist(err) {
+		return err
+	}
+	if err := sftpMkdirAll(client, path.Dir(dir)); err != nil {
+		return err
+	}
+	return client.Mkdir(dir)
+}
+
+// Get implements StorageBackend
+func (s *SFTPStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	client, close, err := s.connect(ctx)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	info, err := client.Stat(name)
+	if err != nil {
+		close()
+		return nil, ObjectInfo{}, sftpNotExist(err)
+	}
+	file, err := client.OpenFile(name)
+	if err != nil {
+		close()
+		return nil, ObjectInfo{}, sftpNotExist(err)
+	}
+	return &sftpObject{sftpFile: file, close: close}, sftpObjectInfo(key, info), nil
+}
+
+// sftpObject reads an object and ends its session once closed
+type sftpObject struct {
+	*sftpFile
+	close func()
+}
+
+func (o *sftpObject) Close() error {
+	err := o.sftpFile.Close()
+	o.close()
+	return err
+}
+
+// Stat implements StorageBackend
+func (s *SFTPStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	client, close, err := s.connect(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer close()
+
+	info, err := client.Stat(name)
+	if err != nil {
+		return ObjectInfo{}, sftpNotExist(err)
+	}
+	return sftpObjectInfo(key, info), nil
+}
+
+// Delete implements StorageBackend
+func (s *SFTPStorage) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	client, close, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer close()
+
+	if err := client.Remove(name); err != nil && !sftpIsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List implements StorageBackend, walking the deepest directory the prefix names
+func (s *SFTPStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	client, close, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		dir = prefix[:i]
+	}
+	objects := []ObjectInfo{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := client.ReadDir(path.Join(s.root, dir))
+		if sftpIsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			key := strings.TrimPrefix(path.Join(dir, entry.name), "/")
+			if entry.isDir() {
+				if strings.HasPrefix(key+"/", prefix) || strings.HasPrefix(prefix, key+"/") {
+					if err := walk(key); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".partial") {
+				objects = append(objects, sftpObjectInfo(key, entry))
+			}
+		}
+		return nil
+	}
+	if err := walk(dir); err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Presign implements StorageBackend; SFTP servers have no URLs to hand out
+func (s *SFTPStorage) Presign(method, key string, expires time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+// sftpObjectInfo describes an object from its remote file
+func sftpObjectInfo(key string, info sftpFileInfo) ObjectInfo {
+	return ObjectInfo{Key: key, Size: info.size, ModTime: info.modTime}
+}
@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"context"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -55,8 +57,9 @@ func (rts *RemoteTerminalService) getDeploymentPath(deployment models.Deployment
 	return fmt.Sprintf("/home/%s/deploys/%s", webServer.Username, deployment.Name)
 }
 
-// CreateSession establishes SSH connection and creates interactive session
-func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, deployment models.Deployment) (*TerminalSession, error) {
+// CreateSession establishes SSH connection and creates interactive session. The session ends
+// when the context is cancelled
+func (rts *RemoteTerminalService) CreateSession(parent context.Context, webServer models.WebServer, deployment models.Deployment) (*TerminalSession, error) {
 	// Create SSH client configuration
 	config := &ssh.ClientConfig{
 		User:            webServer.Username,
@@ -83,9 +86,13 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 			webServer.Name, webServer.SSHKeyID, webServer.SSHKey.Name)
 	}
 
+	// Create context for session management; the connection is closed with it
+	ctx, cancel := context.WithCancel(parent)
+
 	// Establish SSH connection
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", webServer.Hostname, webServer.Port), config)
+	client, err := dialSSH(ctx, fmt.Sprintf("%s:%d", webServer.Hostname, webServer.Port), config)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to establish SSH connection: %w", err)
 	}
 
@@ -93,7 +100,8 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 	session, err := client.NewSession()
 	if err != nil {
 		client.Close()
-		return nil, fmt.Errorf("failed to create SSH session: %w", err)
+		cancel()
+		return nil, fmt.Errorf("failed to create SSH session: %w", connectionError{err: err})
 	}
 
 	// Set up pseudo-terminal for interactive support
@@ -106,6 +114,7 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 	if err := session.RequestPty("xterm", 80, 24, modes); err != nil {
 		session.Close()
 		client.Close()
+		cancel()
 		return nil, fmt.Errorf("failed to request pseudo terminal: %w", err)
 	}
 
@@ -114,6 +123,7 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 	if err != nil {
 		session.Close()
 		client.Close()
+		cancel()
 		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 
@@ -122,6 +132,7 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 		stdinPipe.Close()
 		session.Close()
 		client.Close()
+		cancel()
 		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
@@ -130,12 +141,10 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 		stdinPipe.Close()
 		session.Close()
 		client.Close()
+		cancel()
 		return nil, fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
 
-	// Create context for session management
-	ctx, cancel := context.WithCancel(context.Background())
-
 	// Generate CloudBox environment variables with calculated deployment path
 	deploymentPath := rts.getDeploymentPath(deployment, webServer)
 	environment := rts.generateCloudBoxEnvironment(deployment, webServer, deploymentPath)
@@ -154,6 +163,50 @@ func (rts *RemoteTerminalService) CreateSession(webServer models.WebServer, depl
 	}, nil
 }
 
+// connectionError is the error of reaching a server over SSH, or of losing the connection to it.
+// Unlike a command failing on the server, the same step may pass when run again
+type connectionError struct {
+	err error
+}
+
+func (e connectionError) Error() string { return e.err.Error() }
+func (e connectionError) Unwrap() error { return e.err }
+
+// isConnectionError reports whether an error is, or wraps, a connection error
+func isConnectionError(err error) bool {
+	return errors.As(err, &connectionError{})
+}
+
+// sshCommandError returns the error of running a command over SSH: as it is when the command
+// exited with an error, as a connection error when the connection failed it
+func sshCommandError(err error) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return err
+	}
+	return connectionError{err: err}
+}
+
+// dialSSH connects to an SSH server like ssh.Dial, giving up when the context is done. The
+// connection is closed once the context is, failing the sessions running on it. Failing to
+// connect is a connection error
+func dialSSH(ctx context.Context, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, connectionError{err: err}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, connectionError{err: err}
+	}
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
 // ExecuteCIPScript executes a CloudBox Install Protocol script with full environment injection
 func (rts *RemoteTerminalService) ExecuteCIPScript(session *TerminalSession, scriptType string, appPath string) error {
 	// Validate CIP compliance first
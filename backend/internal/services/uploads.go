@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cloudbox/backend/internal/config"
+	"github.com/cloudbox/backend/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Resumable upload states
+const (
+	UploadStatusUploading  = "uploading"
+	UploadStatusCompleting = "completing"
+)
+
+// Part sizes of resumable uploads; only the last part may be smaller than the minimum
+const (
+	MinUploadPartSize     = 1 << 20
+	MaxUploadPartSize     = 256 << 20
+	DefaultUploadPartSize = 8 << 20
+	MaxUploadParts        = 10000
+)
+
+const uploadSweepInterval = 15 * time.Minute
+
+// ErrPartChecksumMismatch is returned when the content of a part does not match its SHA-256
+var ErrPartChecksumMismatch = errors.New("part checksum mismatch")
+
+// UploadPartCount returns the number of parts a file of size bytes is sent in
+func UploadPartCount(size, partSize int64) int {
+	return int((size + partSize - 1) / partSize)
+}
+
+// UploadPartSize returns the size of a part of an upload; every part but the last has the
+// part size of the upload
+func UploadPartSize(upload models.FileUpload, partNumber int) int64 {
+	if partNumber < upload.PartCount {
+		return upload.PartSize
+	}
+	return upload.Size - upload.PartSize*int64(upload.PartCount-1)
+}
+
+// uploadPrefix returns the key prefix of the parts of an upload. Bucket names cannot start
+// with a dot, so parts never show up in a bucket.
+func uploadPrefix(projectID uint, uploadID string) string {
+	return fmt.Sprintf("%d/.uploads/%s/", projectID, uploadID)
+}
+
+// UploadPartKey returns the key a part of an upload is stored under
+func UploadPartKey(projectID uint, uploadID string, partNumber int) string {
+	return fmt.Sprintf("%s%05d", uploadPrefix(projectID, uploadID), partNumber)
+}
+
+// UploadService stores the parts of resumable uploads, assembles them into files and discards
+// uploads that were abandoned
+type UploadService struct {
+	db       *gorm.DB
+	cfg      *config.Config
+	backends *StorageBackends
+	once     sync.Once
+}
+
+// NewUploadService creates a new upload service
+func NewUploadService(db *gorm.DB, cfg *config.Config) *UploadService {
+	return &UploadService{db: db, cfg: cfg, backends: NewStorageBackends(cfg)}
+}
+
+// Expiry returns how long an upload is kept after its last part
+func (s *UploadService) Expiry() time.Duration {
+	if s.cfg.UploadExpiry <= 0 {
+		return 24 * time.Hour
+	}
+	return s.cfg.UploadExpiry
+}
+
+// Start discards expired uploads periodically in the background
+func (s *UploadService) Start() {
+	s.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(uploadSweepInterval)
+			defer ticker.Stop()
+			for {
+				if err := s.Sweep(context.Background()); err != nil {
+					log.Printf("Upload sweep failed: %v", err)
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// Sweep discards the uploads that expired. Completing an upload extends its expiry, so
+// assembly is not cut short.
+func (s *UploadService) Sweep(ctx context.Context) error {
+	for {
+		var uploads []models.FileUpload
+		if err := s.db.Where("expires_at < ?", time.Now()).Limit(100).Find(&uploads).Error; err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			if err := s.Discard(ctx, upload); err != nil {
+				return fmt.Errorf("failed to discard upload %s: %w", upload.ID, err)
+			}
+		}
+		if len(uploads) < 100 {
+			return nil
+		}
+	}
+}
+
+// Discard deletes the stored parts of an upload and its records
+func (s *UploadService) Discard(ctx context.Context, upload models.FileUpload) error {
+	if backend, err := s.backends.Get(upload.StorageBackend); err == nil {
+		if err := DeletePrefix(ctx, backend, uploadPrefix(upload.ProjectID, upload.ID)); err != nil {
+			return err
+		}
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", upload.ID).Delete(&models.FileUploadPart{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", upload.ID).Delete(&models.FileUpload{}).Error
+	})
+}
+
+// PutPart stores and records a part of an upload, replacing an earlier copy. A part whose
+// SHA-256 differs from the expected one (when given) is not kept.
+func (s *UploadService) PutPart(ctx context.Context, upload models.FileUpload, partNumber int, body io.Reader, expected string) (models.FileUploadPart, error) {
+	backend, err := s.backends.Get(upload.StorageBackend)
+	if err != nil {
+		return models.FileUploadPart{}, err
+	}
+
+	size := UploadPartSize(upload, partNumber)
+	key := UploadPartKey(upload.ProjectID, upload.ID, partNumber)
+	hasher := sha256.New()
+	if err := backend.Put(ctx, key, io.TeeReader(io.LimitReader(body, size), hasher), size, "application/octet-stream"); err != nil {
+		return models.FileUploadPart{}, err
+	}
+
+	part := models.FileUploadPart{
+		UploadID:   upload.ID,
+		PartNumber: partNumber,
+		Size:       size,
+		Checksum:   fmt.Sprintf("%x", hasher.Sum(nil)),
+	}
+	if expected != "" && expected != part.Checksum {
+		// The replaced copy is gone as well
+		backend.Delete(ctx, key)
+		s.db.Where("upload_id = ? AND part_number = ?", upload.ID, partNumber).Delete(&models.FileUploadPart{})
+		return part, ErrPartChecksumMismatch
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "upload_id"}, {Name: "part_number"}},
+			DoUpdates: clause.AssignmentColumns([]string{"size", "checksum", "updated_at"}),
+		}).Create(&part).Error; err != nil {
+			return err
+		}
+		// Uploads stay alive while parts keep arriving
+		return tx.Model(&models.FileUpload{}).Where("id = ?", upload.ID).
+			UpdateColumn("expires_at", time.Now().Add(s.Expiry())).Error
+	})
+	return part, err
+}
+
+// Assemble concatenates the parts of an upload, ordered by number, into an object of dst.
+// Every part is checked against its recorded SHA-256 on the way; the SHA-256 of the whole
+// file is returned.
+func (s *UploadService) Assemble(ctx context.Context, upload models.FileUpload, parts []models.FileUploadPart, dst StorageBackend, key string) (string, error) {
+	src, err := s.backends.Get(upload.StorageBackend)
+	if err != nil {
+		return "", err
+	}
+
+	reader := &uploadPartsReader{ctx: ctx, backend: src, upload: upload, parts: parts}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	err = dst.Put(ctx, key, io.TeeReader(reader, hasher), upload.Size, upload.MimeType)
+	if reader.err != nil {
+		err = reader.err
+	}
+	if err != nil {
+		dst.Delete(ctx, key)
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// OpenPart opens a stored part of an upload
+func (s *UploadService) OpenPart(ctx context.Context, upload models.FileUpload, partNumber int) (io.ReadCloser, error) {
+	backend, err := s.backends.Get(upload.StorageBackend)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := backend.Get(ctx, UploadPartKey(upload.ProjectID, upload.ID, partNumber))
+	return body, err
+}
+
+// uploadPartsReader reads the parts of an upload one after another, verifying each
+type uploadPartsReader struct {
+	ctx     context.Context
+	backend StorageBackend
+	upload  models.FileUpload
+	parts   []models.FileUploadPart
+
+	current io.ReadCloser
+	hasher  hash.Hash
+	read    int64
+	next    int
+	err     error // Why reading stopped early
+}
+
+func (r *uploadPartsReader) Read(p []byte) (int, error) {
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.current == nil {
+			if r.next == len(r.parts) {
+				return 0, io.EOF
+			}
+			body, _, err := r.backend.Get(r.ctx, UploadPartKey(r.upload.ProjectID, r.upload.ID, r.parts[r.next].PartNumber))
+			if err != nil {
+				r.err = fmt.Errorf("part %d: %w", r.parts[r.next].PartNumber, err)
+				return 0, r.err
+			}
+			r.current, r.hasher, r.read = body, sha256.New(), 0
+		}
+
+		n, err := r.current.Read(p)
+		r.hasher.Write(p[:n])
+		r.read += int64(n)
+		if err == io.EOF {
+			part := r.parts[r.next]
+			r.current.Close()
+			r.current = nil
+			r.next++
+			if r.read != part.Size || fmt.Sprintf("%x", r.hasher.Sum(nil)) != part.Checksum {
+				r.err = fmt.Errorf("%w: part %d", ErrPartChecksumMismatch, part.PartNumber)
+				return 0, r.err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		if err != nil {
+			r.err = err
+		}
+		return n, err
+	}
+}
+
+func (r *uploadPartsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
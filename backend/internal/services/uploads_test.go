@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cloudbox/backend/internal/models"
+)
+
+func TestUploadPartSize(t *testing.T) {
+	upload := models.FileUpload{Size: 25, PartSize: 10}
+	upload.PartCount = UploadPartCount(upload.Size, upload.PartSize)
+	if upload.PartCount != 3 {
+		t.Fatalf("UploadPartCount = %d, want 3", upload.PartCount)
+	}
+	for number, want := range map[int]int64{1: 10, 2: 10, 3: 5} {
+		if got := UploadPartSize(upload, number); got != want {
+			t.Errorf("UploadPartSize(%d) = %d, want %d", number, got, want)
+		}
+	}
+
+	if got := UploadPartCount(20, 10); got != 2 {
+		t.Errorf("UploadPartCount(20, 10) = %d, want 2", got)
+	}
+	if got := UploadPartCount(3, DefaultUploadPartSize); got != 1 {
+		t.Errorf("UploadPartCount(3, default) = %d, want 1", got)
+	}
+}
+
+func TestUploadPartsReader(t *testing.T) {
+	ctx := context.Background()
+	backend := NewLocalStorage(t.TempDir())
+	upload := models.FileUpload{ID: "abc", ProjectID: 4, Size: 11, PartSize: 4, PartCount: 3}
+
+	var parts []models.FileUploadPart
+	for i, body := range []string{"hell", "o wo", "rld"} {
+		number := i + 1
+		if err := backend.Put(ctx, UploadPartKey(upload.ProjectID, upload.ID, number), strings.NewReader(body), int64(len(body)), ""); err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, models.FileUploadPart{
+			PartNumber: number,
+			Size:       int64(len(body)),
+			Checksum:   fmt.Sprintf("%x", sha256.Sum256([]byte(body))),
+		})
+	}
+
+	reader := &uploadPartsReader{ctx: ctx, backend: backend, upload: upload, parts: parts}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("read %q, %v; want hello world", data, err)
+	}
+
+	// A part changed after it was received is caught
+	if err := backend.Put(ctx, UploadPartKey(upload.ProjectID, upload.ID, 2), strings.NewReader("o WO"), 4, ""); err != nil {
+		t.Fatal(err)
+	}
+	reader = &uploadPartsReader{ctx: ctx, backend: backend, upload: upload, parts: parts}
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if !errors.Is(err, ErrPartChecksumMismatch) || !strings.Contains(err.Error(), "part 2") {
+		t.Errorf("read of corrupt part = %v, want ErrPartChecksumMismatch for part 2", err)
+	}
+}
@@ -118,6 +118,16 @@ func DecryptPrivateKey(encryptedKey string, masterPassword string) (string, erro
 	return string(plaintext), nil
 }
 
+// EncryptSecret encrypts a stored credential, such as an OAuth client secret, with the master key
+func EncryptSecret(secret string, masterKey string) (string, error) {
+	return EncryptPrivateKey(secret, masterKey)
+}
+
+// DecryptSecret decrypts a credential encrypted with EncryptSecret
+func DecryptSecret(encryptedSecret string, masterKey string) (string, error) {
+	return DecryptPrivateKey(encryptedSecret, masterKey)
+}
+
 // GenerateMasterKey generates a secure master key for encryption
 func GenerateMasterKey() (string, error) {
 	key := make([]byte, 32)
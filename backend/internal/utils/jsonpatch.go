@@ -0,0 +1,355 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSONPatchOperation is a single RFC 6902 JSON Patch operation
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MarshalJSON always emits value for add, replace and test, where null is a valid value
+func (o JSONPatchOperation) MarshalJSON() ([]byte, error) {
+	type operation JSONPatchOperation
+	if o.Op != "add" && o.Op != "replace" && o.Op != "test" {
+		return json.Marshal(operation(o))
+	}
+	return json.Marshal(struct {
+		operation
+		Value interface{} `json:"value"`
+	}{operation(o), o.Value})
+}
+
+// ApplyMergePatch applies an RFC 7396 JSON Merge Patch to target and returns the result.
+// null values in the patch remove the corresponding member.
+func ApplyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	result := make(map[string]interface{}, len(targetObject))
+	for key, value := range targetObject {
+		result[key] = value
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+		result[key] = ApplyMergePatch(result[key], value)
+	}
+	return result
+}
+
+// ApplyJSONPatch applies RFC 6902 operations to a deep copy of document.
+// Operations are applied in order and the patch fails as a whole on the first error.
+func ApplyJSONPatch(document interface{}, operations []JSONPatchOperation) (interface{}, error) {
+	current, err := deepCopyJSON(document)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, operation := range operations {
+		current, err = applyJSONPatchOperation(current, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %v", i, operation.Op, operation.Path, err)
+		}
+	}
+	return current, nil
+}
+
+// DiffJSON returns RFC 6902 operations that turn from into to.
+// Objects are compared member by member; arrays and scalars that differ are replaced whole.
+func DiffJSON(from, to interface{}) []JSONPatchOperation {
+	operations := []JSONPatchOperation{}
+	diffJSONValue("", from, to, &operations)
+	return operations
+}
+
+func diffJSONValue(pointer string, from, to interface{}, operations *[]JSONPatchOperation) {
+	fromObject, fromIsObject := from.(map[string]interface{})
+	toObject, toIsObject := to.(map[string]interface{})
+	if !fromIsObject || !toIsObject {
+		if !reflect.DeepEqual(from, to) {
+			*operations = append(*operations, JSONPatchOperation{Op: "replace", Path: pointer, Value: to})
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(fromObject)+len(toObject))
+	for key := range fromObject {
+		keys = append(keys, key)
+	}
+	for key := range toObject {
+		if _, ok := fromObject[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := pointer + "/" + escapeJSONPointerToken(key)
+		fromValue, inFrom := fromObject[key]
+		toValue, inTo := toObject[key]
+		switch {
+		case !inTo:
+			*operations = append(*operations, JSONPatchOperation{Op: "remove", Path: path})
+		case !inFrom:
+			*operations = append(*operations, JSONPatchOperation{Op: "add", Path: path, Value: toValue})
+		default:
+			diffJSONValue(path, fromValue, toValue, operations)
+		}
+	}
+}
+
+// escapeJSONPointerToken escapes a reference token for use in an RFC 6901 JSON Pointer
+func escapeJSONPointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func applyJSONPatchOperation(document interface{}, operation JSONPatchOperation) (interface{}, error) {
+	path, err := parseJSONPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add":
+		return jsonPointerAdd(document, path, operation.Value)
+	case "remove":
+		updated, _, err := jsonPointerRemove(document, path)
+		return updated, err
+	case "replace":
+		if len(path) == 0 {
+			// Replacing the root swaps the whole document (RFC 6902 section 4.3)
+			return deepCopyJSON(operation.Value)
+		}
+		updated, _, err := jsonPointerRemove(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(updated, path, operation.Value)
+	case "move":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, fmt.Errorf("cannot move a value into one of its children")
+		}
+		updated, value, err := jsonPointerRemove(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(updated, path, value)
+	case "copy":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonPointerGet(document, from)
+		if err != nil {
+			return nil, err
+		}
+		value, err = deepCopyJSON(value)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(document, path, value)
+	case "test":
+		value, err := jsonPointerGet(document, path)
+		if err != nil {
+			return nil, err
+		}
+		expected, err := deepCopyJSON(operation.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, expected) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return document, nil
+	default:
+		return nil, fmt.Errorf("unsupported operation %q", operation.Op)
+	}
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// jsonPointerGet returns the value at path
+func jsonPointerGet(document interface{}, path []string) (interface{}, error) {
+	current := document
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found")
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("path not found")
+		}
+	}
+	return current, nil
+}
+
+// jsonPointerAdd sets value at path, inserting into arrays, and returns the updated document
+func jsonPointerAdd(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := jsonPointerGet(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return document, nil
+	case []interface{}:
+		index := len(node)
+		if token != "-" {
+			index, err = arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		updated := make([]interface{}, 0, len(node)+1)
+		updated = append(updated, node[:index]...)
+		updated = append(updated, value)
+		updated = append(updated, node[index:]...)
+		return replaceAt(document, path[:len(path)-1], updated)
+	default:
+		return nil, fmt.Errorf("path not found")
+	}
+}
+
+// jsonPointerRemove removes the value at path and returns the updated document and removed value
+func jsonPointerRemove(document interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the document root")
+	}
+
+	parent, err := jsonPointerGet(document, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	token := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("path not found")
+		}
+		delete(node, token)
+		return document, value, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		updated := make([]interface{}, 0, len(node)-1)
+		updated = append(updated, node[:index]...)
+		updated = append(updated, node[index+1:]...)
+		result, err := replaceAt(document, path[:len(path)-1], updated)
+		return result, value, err
+	default:
+		return nil, nil, fmt.Errorf("path not found")
+	}
+}
+
+// replaceAt swaps the value at path for value (used when an array is reallocated)
+func replaceAt(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := jsonPointerGet(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	default:
+		return nil, fmt.Errorf("path not found")
+	}
+	return document, nil
+}
+
+// arrayIndex parses an array reference token; inclusive allows index == length for add
+func arrayIndex(token string, length int, inclusive bool) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (!inclusive && index == length) {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+// deepCopyJSON copies a JSON value by round-tripping it, normalizing Go types to JSON types
+func deepCopyJSON(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	if err := json.Unmarshal(raw, &copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, raw string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", raw, err)
+	}
+	return value
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		patch    string
+		want     string
+		err      string
+	}{
+		{
+			name:     "add member",
+			document: `{"a": 1}`,
+			patch:    `[{"op": "add", "path": "/b", "value": [1, 2]}]`,
+			want:     `{"a": 1, "b": [1, 2]}`,
+		},
+		{
+			name:     "add into array",
+			document: `{"a": [1, 3]}`,
+			patch:    `[{"op": "add", "path": "/a/1", "value": 2}, {"op": "add", "path": "/a/-", "value": 4}]`,
+			want:     `{"a": [1, 2, 3, 4]}`,
+		},
+		{
+			name:     "remove array element",
+			document: `{"a": [1, 2, 3]}`,
+			patch:    `[{"op": "remove", "path": "/a/0"}]`,
+			want:     `{"a": [2, 3]}`,
+		},
+		{
+			name:     "replace member with null",
+			document: `{"a": 1}`,
+			patch:    `[{"op": "replace", "path": "/a", "value": null}]`,
+			want:     `{"a": null}`,
+		},
+		{
+			name:     "replace root",
+			document: `{"a": 1, "b": 2}`,
+			patch:    `[{"op": "replace", "path": "", "value": {"c": 3}}, {"op": "add", "path": "/d", "value": 4}]`,
+			want:     `{"c": 3, "d": 4}`,
+		},
+		{
+			name:     "move",
+			document: `{"a": {"b": 1}, "c": {}}`,
+			patch:    `[{"op": "move", "from": "/a/b", "path": "/c/b"}]`,
+			want:     `{"a": {}, "c": {"b": 1}}`,
+		},
+		{
+			name:     "move into own child",
+			document: `{"a": {"b": {}}}`,
+			patch:    `[{"op": "move", "from": "/a", "path": "/a/b/c"}]`,
+			err:      "cannot move a value into one of its children",
+		},
+		{
+			name:     "copy is independent",
+			document: `{"a": {"x": 1}}`,
+			patch:    `[{"op": "copy", "from": "/a", "path": "/b"}, {"op": "replace", "path": "/b/x", "value": 2}]`,
+			want:     `{"a": {"x": 1}, "b": {"x": 2}}`,
+		},
+		{
+			name:     "escaped pointer tokens",
+			document: `{"a/b": 1, "m~n": 2}`,
+			patch:    `[{"op": "remove", "path": "/a~1b"}, {"op": "replace", "path": "/m~0n", "value": 3}]`,
+			want:     `{"m~n": 3}`,
+		},
+		{
+			name:     "test passes",
+			document: `{"a": [1, {"b": true}]}`,
+			patch:    `[{"op": "test", "path": "/a", "value": [1, {"b": true}]}]`,
+			want:     `{"a": [1, {"b": true}]}`,
+		},
+		{
+			name:     "test fails the whole patch",
+			document: `{"a": 1}`,
+			patch:    `[{"op": "add", "path": "/b", "value": 2}, {"op": "test", "path": "/a", "value": 2}]`,
+			err:      "operation 1 (test /a): test failed",
+		},
+		{
+			name:     "remove missing member",
+			document: `{"a": 1}`,
+			patch:    `[{"op": "remove", "path": "/b"}]`,
+			err:      "path not found",
+		},
+		{
+			name:     "remove root",
+			document: `{"a": 1}`,
+			patch:    `[{"op": "remove", "path": ""}]`,
+			err:      "cannot remove the document root",
+		},
+		{
+			name:     "leading zero index",
+			document: `{"a": [1, 2]}`,
+			patch:    `[{"op": "remove", "path": "/a/01"}]`,
+			err:      "invalid array index",
+		},
+		{
+			name:     "index past the end",
+			document: `{"a": [1]}`,
+			patch:    `[{"op": "add", "path": "/a/2", "value": 0}]`,
+			err:      "out of range",
+		},
+		{
+			name:     "pointer without a slash",
+			document: `{"a": 1}`,
+			patch:    `[{"op": "remove", "path": "a"}]`,
+			err:      "invalid JSON pointer",
+		},
+		{
+			name:     "unknown operation",
+			document: `{}`,
+			patch:    `[{"op": "merge", "path": "/a"}]`,
+			err:      "unsupported operation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document := decodeJSON(t, tt.document)
+			var operations []JSONPatchOperation
+			if err := json.Unmarshal([]byte(tt.patch), &operations); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ApplyJSONPatch(document, operations)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				if !reflect.DeepEqual(document, decodeJSON(t, tt.document)) {
+					t.Errorf("a failed patch modified the input: %v", document)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("ApplyJSONPatch() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		// Examples from RFC 7396 appendix A
+		{"replace member", `{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{"add member", `{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{"remove member", `{"a": "b"}`, `{"a": null}`, `{}`},
+		{"remove one of two", `{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{"replace array", `{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{"array replaces scalar", `{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{"nested", `{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{"arrays are not merged", `{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{"scalar target", `["a", "b"]`, `{"a": "b"}`, `{"a": "b"}`},
+		{"null removes nested nulls", `{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+		{"non-object patch replaces", `{"a": "foo"}`, `"bar"`, `"bar"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := decodeJSON(t, tt.target)
+			got := ApplyMergePatch(target, decodeJSON(t, tt.patch))
+			if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("ApplyMergePatch() = %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(target, decodeJSON(t, tt.target)) {
+				t.Errorf("ApplyMergePatch modified the target: %v", target)
+			}
+		})
+	}
+}
+
+func TestDiffJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"equal", `{"a": 1}`, `{"a": 1}`},
+		{"changed members", `{"a": 1, "b": {"c": [1]}, "d": true}`, `{"a": 2, "b": {"c": [1, 2]}, "e": null}`},
+		{"escaped keys", `{"a/b": 1}`, `{"a/b": 2, "c~d": 3}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := decodeJSON(t, tt.from), decodeJSON(t, tt.to)
+			patched, err := ApplyJSONPatch(from, DiffJSON(from, to))
+			if err != nil {
+				t.Fatalf("applying the diff failed: %v", err)
+			}
+			if !reflect.DeepEqual(patched, to) {
+				t.Errorf("diff applied to %v = %v, want %v", from, patched, to)
+			}
+		})
+	}
+}
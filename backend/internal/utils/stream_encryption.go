@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Streams too large to encrypt in one piece, like backup archives, are split into chunks sealed
+// with AES-256-GCM. The key is derived from the master key and a random salt like EncryptPrivateKey
+// does; every chunk's nonce holds its number and whether it is the last one, so chunks cannot be
+// reordered or dropped, and the context is authenticated with each chunk
+
+const (
+	streamMagic     = "CBXENC01"
+	streamChunkSize = 64 * 1024
+	streamTagSize   = 16
+)
+
+// ErrStreamCorrupt is returned for encrypted streams that were altered, cut short, or encrypted
+// with another key or context
+var ErrStreamCorrupt = errors.New("encrypted stream is corrupt or the key is wrong")
+
+// streamCipher derives the cipher of a stream
+func streamCipher(masterKey string, salt []byte) (cipher.AEAD, error) {
+	if masterKey == "" {
+		return nil, errors.New("master key cannot be empty")
+	}
+	key := pbkdf2.Key([]byte(masterKey), salt, iterations, keySize, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// streamNonce returns the nonce of a chunk
+func streamNonce(chunk uint64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], chunk)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// streamWriter encrypts what is written to it
+type streamWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	context []byte
+	buffer  []byte
+	chunk   uint64
+	closed  bool
+}
+
+// NewEncryptingWriter returns a writer encrypting to w with a key derived from the master key;
+// closing it writes the last chunk but does not close w. The same context is needed to decrypt
+func NewEncryptingWriter(w io.Writer, masterKey, context string) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	gcm, err := streamCipher(masterKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(streamMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &streamWriter{w: w, gcm: gcm, context: []byte(context), buffer: make([]byte, 0, streamChunkSize)}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed encrypting writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more follows, as the last chunk is marked
+		if len(s.buffer) == streamChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buffer[len(s.buffer):streamChunkSize], p)
+		s.buffer = s.buffer[:len(s.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// seal writes the buffered chunk
+func (s *streamWriter) seal(last bool) error {
+	sealed := s.gcm.Seal(nil, streamNonce(s.chunk, last), s.buffer, s.context)
+	s.chunk++
+	s.buffer = s.buffer[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+// streamReader decrypts a stream
+type streamReader struct {
+	r       io.Reader
+	gcm     cipher.AEAD
+	context []byte
+	sealed  []byte // A chunk, and the first byte of the next one if there is one
+	plain   []byte
+	chunk   uint64
+	done    bool
+}
+
+// NewDecryptingReader returns a reader decrypting a stream written by NewEncryptingWriter. Reads
+// fail with ErrStreamCorrupt once a chunk does not authenticate or the stream ends early
+func NewDecryptingReader(r io.Reader, masterKey, context string) (io.Reader, error) {
+	header := make([]byte, len(streamMagic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrStreamCorrupt
+	}
+	gcm, err := streamCipher(masterKey, header[len(streamMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{r: r, gcm: gcm, context: []byte(context), sealed: make([]byte, 0, streamChunkSize+streamTagSize+1)}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk; reading one byte beyond it tells whether it is the last
+func (s *streamReader) open() error {
+	full := streamChunkSize + streamTagSize
+	n, err := io.ReadFull(s.r, s.sealed[len(s.sealed):full+1])
+	s.sealed = s.sealed[:len(s.sealed)+n]
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+	if last && len(s.sealed) < streamTagSize {
+		return ErrStreamCorrupt
+	}
+
+	chunk := s.sealed
+	if !last {
+		chunk = s.sealed[:full]
+	}
+	plain, err := s.gcm.Open(nil, streamNonce(s.chunk, last), chunk, s.context)
+	if err != nil {
+		return ErrStreamCorrupt
+	}
+	s.chunk++
+	s.plain = plain
+	if last {
+		s.done = true
+		s.sealed = s.sealed[:0]
+	} else {
+		s.sealed = append(s.sealed[:0], s.sealed[full])
+	}
+	return nil
+}
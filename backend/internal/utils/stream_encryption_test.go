@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encryptStream(t *testing.T, plain []byte, context string) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewEncryptingWriter(&sealed, "master", context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written in uneven pieces
+	for len(plain) > 0 {
+		n := min(len(plain), 10000)
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func decryptStream(sealed []byte, masterKey, context string) ([]byte, error) {
+	r, err := NewDecryptingReader(bytes.NewReader(sealed), masterKey, context)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestStreamEncryption(t *testing.T) {
+	for _, size := range []int{0, 1, streamChunkSize, 2*streamChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encryptStream(t, plain, "backup:project:1")
+
+		got, err := decryptStream(sealed, "master", "backup:project:1")
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted %d bytes, %v", size, len(got), err)
+		}
+		if _, err := decryptStream(sealed, "other", "backup:project:1"); !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("%d bytes with another key: %v, want ErrStreamCorrupt", size, err)
+		}
+		if _, err := decryptStream(sealed, "master", "backup:project:2"); !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("%d bytes in another context: %v, want ErrStreamCorrupt", size, err)
+		}
+	}
+}
+
+func TestStreamEncryptionTampering(t *testing.T) {
+	plain := make([]byte, 3*streamChunkSize)
+	sealed := encryptStream(t, plain, "ctx")
+	header := len(streamMagic) + saltSize
+	chunk := streamChunkSize + streamTagSize
+
+	flipped := append([]byte{}, sealed...)
+	flipped[header+chunk+100] ^= 1
+	// The last chunk cut off
+	truncated := sealed[:header+2*chunk]
+	// Two chunks swapped
+	swapped := append(append(append([]byte{}, sealed[:header]...), sealed[header+chunk:header+2*chunk]...), sealed[header:header+chunk]...)
+	swapped = append(swapped, sealed[header+2*chunk:]...)
+
+	for name, data := range map[string][]byte{"flipped": flipped, "truncated": truncated, "swapped": swapped} {
+		if _, err := decryptStream(data, "master", "ctx"); !errors.Is(err, ErrStreamCorrupt) {
+			t.Errorf("%s stream: %v, want ErrStreamCorrupt", name, err)
+		}
+	}
+}
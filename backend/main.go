@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/cloudbox/backend/internal/config"
 	"github.com/cloudbox/backend/internal/database"
@@ -23,6 +24,14 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Maintenance commands such as migrate-bucket run instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, db, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Auto-migrate database schemas - TEMPORARY SKIP DUE TO GORM ISSUE
 	log.Println("Skipping AutoMigrate due to GORM issue - database tables exist from SQL migrations")
 	// if err := database.Migrate(db); err != nil {
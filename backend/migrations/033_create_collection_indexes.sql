@@ -0,0 +1,37 @@
+-- Track PostgreSQL expression indexes materialized from collections.indexes
+
+CREATE TABLE IF NOT EXISTS collection_indexes (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Collection info
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    collection_name VARCHAR(255) NOT NULL,
+
+    -- Index definition
+    spec VARCHAR(255) NOT NULL, -- Declaration as stored in collections.indexes
+    field VARCHAR(255) NOT NULL, -- Dotted path inside document data
+    method VARCHAR(20) NOT NULL DEFAULT 'btree', -- btree, gin
+    "unique" BOOLEAN DEFAULT false,
+    index_name VARCHAR(63) NOT NULL,
+
+    -- Build status
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, building, ready, failed
+    error TEXT,
+    built_at TIMESTAMP WITH TIME ZONE,
+
+    CONSTRAINT uq_collection_indexes_index_name UNIQUE (index_name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_collection_indexes_project_id ON collection_indexes(project_id);
+CREATE INDEX IF NOT EXISTS idx_collection_indexes_collection ON collection_indexes(project_id, collection_name);
+
+CREATE TRIGGER update_collection_indexes_updated_at
+    BEFORE UPDATE ON collection_indexes
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE collection_indexes IS 'Partial expression indexes on documents declared through collections.indexes';
+COMMENT ON COLUMN collection_indexes.spec IS 'Index declaration: field, unique:field or gin:field';
+COMMENT ON COLUMN collection_indexes.status IS 'Build status: pending, building, ready, failed';
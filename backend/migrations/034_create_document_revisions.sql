@@ -0,0 +1,32 @@
+-- Revision history for documents and per-collection retention settings
+
+ALTER TABLE collections ADD COLUMN IF NOT EXISTS revision_limit INTEGER DEFAULT 50;
+ALTER TABLE collections ADD COLUMN IF NOT EXISTS revision_retention_days INTEGER DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS document_revisions (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Document info
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    collection_name VARCHAR(255) NOT NULL,
+    document_id VARCHAR(255) NOT NULL,
+    version INTEGER NOT NULL,
+
+    -- Snapshot
+    operation VARCHAR(20) NOT NULL, -- create, update, delete, restore
+    data JSONB,
+    restored_from INTEGER,
+
+    -- Actor
+    author VARCHAR(255),
+    api_key_id INTEGER REFERENCES api_keys(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_document_revisions_project_id ON document_revisions(project_id);
+CREATE INDEX IF NOT EXISTS idx_document_revisions_document ON document_revisions(project_id, collection_name, document_id, id DESC);
+
+COMMENT ON TABLE document_revisions IS 'Immutable snapshots of documents written on every create, update, delete and restore';
+COMMENT ON COLUMN document_revisions.operation IS 'Write that produced the revision: create, update, delete, restore';
+COMMENT ON COLUMN collections.revision_limit IS 'Revisions kept per document (0 = unlimited)';
+COMMENT ON COLUMN collections.revision_retention_days IS 'Days after which revisions are pruned (0 = keep forever)';
@@ -0,0 +1,25 @@
+-- Change feed for realtime collection subscriptions
+
+CREATE TABLE IF NOT EXISTS document_changes (
+    sequence BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Document info
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    collection_name VARCHAR(255) NOT NULL,
+    document_id VARCHAR(255) NOT NULL,
+
+    -- Change
+    operation VARCHAR(20) NOT NULL, -- insert, update, delete
+    version INTEGER,
+    author VARCHAR(255),
+    data JSONB
+);
+
+CREATE INDEX IF NOT EXISTS idx_document_changes_project_id ON document_changes(project_id);
+CREATE INDEX IF NOT EXISTS idx_document_changes_feed ON document_changes(project_id, collection_name, sequence);
+CREATE INDEX IF NOT EXISTS idx_document_changes_created_at ON document_changes(created_at);
+
+COMMENT ON TABLE document_changes IS 'Realtime change feed; sequence is the resume token handed to subscribers';
+COMMENT ON COLUMN document_changes.operation IS 'Change type: insert, update, delete';
+COMMENT ON COLUMN document_changes.data IS 'Document data after the change, or before it for deletes';
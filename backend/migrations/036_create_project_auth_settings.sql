@@ -0,0 +1,32 @@
+-- Persist the app user authentication policy of each project
+
+CREATE TABLE IF NOT EXISTS project_auth_settings (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Project relation
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+
+    -- Login policy
+    email_verification BOOLEAN DEFAULT false,
+    max_login_attempts INTEGER DEFAULT 5, -- 0 = no lockout
+    lockout_duration INTEGER DEFAULT 15, -- Minutes
+    session_duration INTEGER DEFAULT 24, -- Hours
+
+    -- Password policy
+    password_min_length INTEGER DEFAULT 8,
+    password_require_uppercase BOOLEAN DEFAULT false,
+    password_require_lowercase BOOLEAN DEFAULT false,
+    password_require_number BOOLEAN DEFAULT false,
+    password_require_symbol BOOLEAN DEFAULT false,
+
+    CONSTRAINT uq_project_auth_settings_project_id UNIQUE (project_id)
+);
+
+CREATE TRIGGER update_project_auth_settings_updated_at
+    BEFORE UPDATE ON project_auth_settings
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE project_auth_settings IS 'App user authentication policy per project; projects without a row use the defaults';
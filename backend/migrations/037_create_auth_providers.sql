@@ -0,0 +1,79 @@
+-- OAuth / OpenID Connect login for app users
+
+CREATE TABLE IF NOT EXISTS auth_providers (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Project relation
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+
+    -- Provider info
+    provider_id VARCHAR(50) NOT NULL, -- google, github, apple or a custom OIDC slug
+    type VARCHAR(20) NOT NULL, -- google, github, apple, oidc
+    name VARCHAR(255),
+    enabled BOOLEAN DEFAULT false,
+
+    -- Client credentials
+    client_id VARCHAR(255),
+    client_secret TEXT, -- Encrypted with the master key
+
+    -- Endpoints
+    issuer_url TEXT,
+    authorization_url TEXT,
+    token_url TEXT,
+    userinfo_url TEXT,
+    jwks_url TEXT,
+
+    scopes TEXT[],
+    redirect_urls TEXT[], -- App URLs allowed to receive the session after login
+
+    CONSTRAINT uq_auth_providers_project_provider UNIQUE (project_id, provider_id)
+);
+
+CREATE TABLE IF NOT EXISTS app_user_identities (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Provider account
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    provider_id VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+
+    -- User relation
+    user_id VARCHAR(255) NOT NULL REFERENCES app_users(id) ON DELETE CASCADE,
+    last_login_at TIMESTAMP WITH TIME ZONE,
+
+    CONSTRAINT uq_app_user_identities_subject UNIQUE (project_id, provider_id, subject)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state VARCHAR(64) PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    provider_id VARCHAR(50) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL, -- PKCE verifier
+    nonce VARCHAR(128),
+    redirect_url TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_app_user_identities_user_id ON app_user_identities(user_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_states_expires_at ON oauth_states(expires_at);
+
+CREATE TRIGGER update_auth_providers_updated_at
+    BEFORE UPDATE ON auth_providers
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TRIGGER update_app_user_identities_updated_at
+    BEFORE UPDATE ON app_user_identities
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE auth_providers IS 'OAuth / OpenID Connect providers app users can log in with';
+COMMENT ON TABLE app_user_identities IS 'Provider accounts linked to app users';
+COMMENT ON TABLE oauth_states IS 'Pending OAuth authorizations (state, PKCE verifier, nonce)';
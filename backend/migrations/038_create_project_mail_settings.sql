@@ -0,0 +1,63 @@
+-- Email delivery for app user password resets and email verification
+
+CREATE TABLE IF NOT EXISTS project_mail_settings (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Project relation
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+
+    -- Sender
+    from_email VARCHAR(255),
+    from_name VARCHAR(255),
+    reply_to VARCHAR(255),
+
+    -- SMTP server of the project
+    smtp_host VARCHAR(255),
+    smtp_port INTEGER,
+    smtp_username VARCHAR(255),
+    smtp_password TEXT, -- Encrypted with the master key
+    smtp_security VARCHAR(20), -- starttls, tls, none
+
+    -- App pages that receive the emailed tokens
+    password_reset_url TEXT,
+    email_verification_url TEXT,
+
+    CONSTRAINT uq_project_mail_settings_project_id UNIQUE (project_id)
+);
+
+CREATE TABLE IF NOT EXISTS email_templates (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- Project relation
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+
+    name VARCHAR(50) NOT NULL, -- password_reset, email_verification
+    subject VARCHAR(255) NOT NULL,
+    text_body TEXT NOT NULL,
+    html_body TEXT,
+
+    CONSTRAINT uq_email_templates_project_name UNIQUE (project_id, name)
+);
+
+-- Emailed tokens are stored as SHA-256 hashes and expire
+ALTER TABLE app_users ADD COLUMN IF NOT EXISTS email_verification_expires TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_app_users_password_reset_token ON app_users(password_reset_token) WHERE password_reset_token <> '';
+CREATE INDEX IF NOT EXISTS idx_app_users_email_verification_token ON app_users(email_verification_token) WHERE email_verification_token <> '';
+
+CREATE TRIGGER update_project_mail_settings_updated_at
+    BEFORE UPDATE ON project_mail_settings
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TRIGGER update_email_templates_updated_at
+    BEFORE UPDATE ON email_templates
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE project_mail_settings IS 'Sender and SMTP settings of app user emails; empty fields use the server configuration';
+COMMENT ON TABLE email_templates IS 'Project overrides of the built-in app user emails';
@@ -0,0 +1,6 @@
+-- Scoped API key permissions and read-only public keys
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS is_public BOOLEAN DEFAULT false;
+
+COMMENT ON COLUMN api_keys.permissions IS 'resource:action[:scope] permissions such as data:read or storage:write:avatars; empty grants full access to keys created before scopes';
+COMMENT ON COLUMN api_keys.is_public IS 'Public keys only read data and storage and invoke functions, so they can be shipped to browsers';
@@ -0,0 +1,10 @@
+-- Prefix lookup and HMAC hashes for API keys, so authentication no longer compares every
+-- bcrypt hash of a project
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS key_prefix VARCHAR(32);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS hash_algorithm VARCHAR(20) NOT NULL DEFAULT 'bcrypt';
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_project_prefix ON api_keys(project_id, key_prefix);
+
+COMMENT ON COLUMN api_keys.key_prefix IS 'Public ID segment of the key (cb_<id>); keys issued before prefixes get legacy_<first characters> on their first use';
+COMMENT ON COLUMN api_keys.hash_algorithm IS 'hmac-sha256, or bcrypt for keys not yet upgraded on first use';
@@ -0,0 +1,15 @@
+-- API key rotation with a grace period and deactivation of unused keys
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rotated_from_id INTEGER REFERENCES api_keys(id) ON DELETE SET NULL;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS deactivation_reason VARCHAR(20);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS inactivity_warned_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_rotated_from_id ON api_keys(rotated_from_id);
+
+-- Per-key usage statistics read the request log by key and time
+CREATE INDEX IF NOT EXISTS idx_api_logs_api_key_created ON api_request_logs(api_key_id, created_at) WHERE api_key_id IS NOT NULL;
+
+COMMENT ON COLUMN api_keys.rotated_at IS 'Set on a rotated key; it keeps working until expires_at and is then deactivated';
+COMMENT ON COLUMN api_keys.deactivation_reason IS 'inactive (unused for API_KEY_INACTIVE_DAYS) or rotated';
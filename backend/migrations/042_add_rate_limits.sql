@@ -0,0 +1,10 @@
+-- Rate limits per project and per API key; 0 inherits the next level up (key -> project -> server)
+
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS rate_limit_requests INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS rate_limit_window_seconds INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit_requests INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit_window_seconds INTEGER NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN projects.rate_limit_requests IS 'Requests per window of each client of the project; 0 uses RATE_LIMIT_REQUESTS';
+COMMENT ON COLUMN api_keys.rate_limit_requests IS 'Requests per window of the key; 0 uses the limit of the project';
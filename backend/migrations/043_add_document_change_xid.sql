@@ -0,0 +1,10 @@
+-- Commit-safe change feed positions. Sequences are taken before commit, so a change can
+-- become visible after one with a higher sequence; recording the writing transaction lets
+-- readers only hand out positions no running transaction can still precede.
+
+ALTER TABLE document_changes ADD COLUMN IF NOT EXISTS xid BIGINT NOT NULL DEFAULT txid_current();
+
+CREATE INDEX IF NOT EXISTS idx_document_changes_position ON document_changes(project_id, collection_name, xid, sequence);
+
+COMMENT ON COLUMN document_changes.xid IS 'Writing transaction; the resume position is (xid, sequence)';
+COMMENT ON TABLE document_changes IS 'Realtime change feed; (xid, sequence) is the resume position handed to subscribers';
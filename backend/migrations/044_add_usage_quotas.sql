@@ -0,0 +1,34 @@
+-- Usage quotas per project and organization; 0 inherits the next level up (project -> organization -> server)
+-- and a negative limit removes it
+
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS quota_storage_bytes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS quota_documents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS quota_app_users BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS quota_api_calls BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS quota_function_gb_seconds DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS quota_storage_bytes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS quota_documents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS quota_app_users BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS quota_api_calls BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS quota_function_gb_seconds DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+-- Metered usage per calendar month (UTC)
+CREATE TABLE IF NOT EXISTS project_usages (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    period VARCHAR(7) NOT NULL,
+
+    api_calls BIGINT NOT NULL DEFAULT 0,
+    function_executions BIGINT NOT NULL DEFAULT 0,
+    function_gb_seconds DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_project_usages_period ON project_usages(project_id, period);
+
+COMMENT ON COLUMN projects.quota_api_calls IS 'Project API calls per calendar month; 0 uses the limit of the organization';
+COMMENT ON COLUMN project_usages.period IS 'Calendar month in UTC, YYYY-MM';
+COMMENT ON COLUMN project_usages.function_gb_seconds IS 'Memory limit of each function execution in GB times its duration in seconds';
@@ -0,0 +1,12 @@
+-- Pluggable storage backends: buckets choose where new files are stored and files remember the
+-- backend holding their object. file_path becomes the object key within that backend.
+
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS storage_backend VARCHAR(20) NOT NULL DEFAULT 'local';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS storage_backend VARCHAR(20) NOT NULL DEFAULT 'local';
+
+-- Files were stored below ./uploads on local disk; the local backend is rooted there
+UPDATE files SET file_path = regexp_replace(file_path, '^(\./)?uploads/', '')
+WHERE file_path ~ '^(\./)?uploads/';
+
+-- Public files are looked up by object key
+CREATE INDEX IF NOT EXISTS idx_files_file_path ON files(project_id, file_path);
@@ -0,0 +1,39 @@
+-- Resumable uploads: files sent in numbered parts and assembled when the upload is completed
+
+CREATE TABLE IF NOT EXISTS file_uploads (
+    id VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    bucket_name VARCHAR(255) NOT NULL,
+    folder_path VARCHAR(255) NOT NULL DEFAULT '',
+
+    original_name VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(255) NOT NULL DEFAULT '',
+    size BIGINT NOT NULL,
+    checksum VARCHAR(64) NOT NULL DEFAULT '',
+    part_size BIGINT NOT NULL,
+    part_count INTEGER NOT NULL,
+
+    storage_backend VARCHAR(20) NOT NULL,
+    author VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'uploading',
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_uploads_project_id ON file_uploads(project_id);
+CREATE INDEX IF NOT EXISTS idx_file_uploads_expires_at ON file_uploads(expires_at);
+
+CREATE TABLE IF NOT EXISTS file_upload_parts (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    upload_id VARCHAR(255) NOT NULL REFERENCES file_uploads(id) ON DELETE CASCADE,
+    part_number INTEGER NOT NULL,
+    size BIGINT NOT NULL,
+    checksum VARCHAR(64) NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_file_upload_parts_number ON file_upload_parts(upload_id, part_number);
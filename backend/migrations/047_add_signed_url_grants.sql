@@ -0,0 +1,16 @@
+-- Use limits of signed file URLs: downloads, or the single upload of an upload URL.
+-- Download URLs without a limit are stateless and have no row.
+
+CREATE TABLE IF NOT EXISTS signed_url_grants (
+    id VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    file_id VARCHAR(255) NOT NULL,
+    max_uses INTEGER NOT NULL,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_signed_url_grants_project_id ON signed_url_grants(project_id);
+CREATE INDEX IF NOT EXISTS idx_signed_url_grants_expires_at ON signed_url_grants(expires_at);
@@ -0,0 +1,4 @@
+-- Image transformations: per-bucket presets, and whether arbitrary parameters are accepted
+
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS image_presets JSONB;
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS allow_image_transforms BOOLEAN DEFAULT FALSE;
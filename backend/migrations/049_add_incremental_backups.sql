@@ -0,0 +1,8 @@
+-- Backups hold stored files and a manifest from format 2.0 on, and may be incremental on top of a parent
+
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS error_message TEXT;
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS mode VARCHAR(20) NOT NULL DEFAULT 'full';
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES backups(id);
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS format_version VARCHAR(16) NOT NULL DEFAULT '1.0';
+
+CREATE INDEX IF NOT EXISTS idx_backups_parent_id ON backups(parent_id);
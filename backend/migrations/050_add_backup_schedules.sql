@@ -0,0 +1,64 @@
+-- Scheduled backups with grandfather-father-son retention, stored in off-host destinations and
+-- optionally encrypted at rest
+
+CREATE TABLE IF NOT EXISTS backup_destinations (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    deleted_at TIMESTAMP WITH TIME ZONE,
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    path VARCHAR(1024) NOT NULL DEFAULT '',
+
+    web_server_id INTEGER REFERENCES web_servers(id),
+
+    s3_endpoint VARCHAR(255) NOT NULL DEFAULT '',
+    s3_region VARCHAR(64) NOT NULL DEFAULT '',
+    s3_bucket VARCHAR(255) NOT NULL DEFAULT '',
+    s3_access_key_id VARCHAR(255) NOT NULL DEFAULT '',
+    s3_secret_access_key TEXT NOT NULL DEFAULT '',
+    s3_path_style BOOLEAN DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_backup_destinations_project_id ON backup_destinations(project_id);
+CREATE INDEX IF NOT EXISTS idx_backup_destinations_deleted_at ON backup_destinations(deleted_at);
+
+CREATE TABLE IF NOT EXISTS backup_schedules (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    deleted_at TIMESTAMP WITH TIME ZONE,
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    cron_expression VARCHAR(255) NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+
+    mode VARCHAR(20) NOT NULL DEFAULT 'full',
+    full_every INTEGER NOT NULL DEFAULT 1,
+    destination_id INTEGER REFERENCES backup_destinations(id),
+    encrypt BOOLEAN DEFAULT FALSE,
+
+    keep_daily INTEGER NOT NULL DEFAULT 0,
+    keep_weekly INTEGER NOT NULL DEFAULT 0,
+    keep_monthly INTEGER NOT NULL DEFAULT 0,
+
+    next_run_at TIMESTAMP WITH TIME ZONE,
+    last_run_at TIMESTAMP WITH TIME ZONE,
+    last_backup_id INTEGER REFERENCES backups(id) ON DELETE SET NULL,
+    last_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_backup_schedules_project_id ON backup_schedules(project_id);
+CREATE INDEX IF NOT EXISTS idx_backup_schedules_next_run_at ON backup_schedules(next_run_at);
+CREATE INDEX IF NOT EXISTS idx_backup_schedules_deleted_at ON backup_schedules(deleted_at);
+
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS destination_id INTEGER REFERENCES backup_destinations(id);
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS encrypted BOOLEAN DEFAULT FALSE;
+ALTER TABLE backups ADD COLUMN IF NOT EXISTS schedule_id INTEGER REFERENCES backup_schedules(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_backups_destination_id ON backups(destination_id);
+CREATE INDEX IF NOT EXISTS idx_backups_schedule_id ON backups(schedule_id);
@@ -0,0 +1,37 @@
+-- Signed GitHub webhooks: per-repository secrets are stored encrypted with the master key, and
+-- every delivery is logged so replays can be ignored and deliveries handled again on request
+
+-- Encrypted secrets outgrow the old column
+ALTER TABLE git_hub_repositories ALTER COLUMN webhook_secret TYPE TEXT;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    delivery_id VARCHAR(255) NOT NULL DEFAULT '',
+    event VARCHAR(100) NOT NULL DEFAULT '',
+    payload_sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    payload TEXT NOT NULL DEFAULT '',
+
+    status VARCHAR(20) NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    message TEXT NOT NULL DEFAULT '',
+
+    redelivery_of_id INTEGER REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+
+    repository_id INTEGER NOT NULL REFERENCES git_hub_repositories(id) ON DELETE CASCADE,
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_created_at ON webhook_deliveries(created_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_delivery_id ON webhook_deliveries(delivery_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_payload_sha256 ON webhook_deliveries(payload_sha256);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_redelivery_of_id ON webhook_deliveries(redelivery_of_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_repository_id ON webhook_deliveries(repository_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_project_id ON webhook_deliveries(project_id);
+
+-- A delivery is accepted once; concurrent copies fail on this index
+CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_deliveries_accepted
+    ON webhook_deliveries(repository_id, delivery_id)
+    WHERE delivery_id <> '' AND status <> 'rejected' AND redelivery_of_id IS NULL;
@@ -0,0 +1,35 @@
+-- Persistent queue of long-running tasks: deployments, backups and function builds survive
+-- restarts, are retried with backoff and can be cancelled
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    type VARCHAR(50) NOT NULL,
+    lock_key VARCHAR(255) NOT NULL,
+    payload JSONB,
+
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 3,
+    run_after TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+    last_error TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+
+    worker_id VARCHAR(64) NOT NULL DEFAULT '',
+    heartbeat_at TIMESTAMP WITH TIME ZONE,
+
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_type ON jobs(type);
+CREATE INDEX IF NOT EXISTS idx_jobs_lock_key ON jobs(lock_key);
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
+CREATE INDEX IF NOT EXISTS idx_jobs_run_after ON jobs(run_after);
+CREATE INDEX IF NOT EXISTS idx_jobs_project_id ON jobs(project_id);
+
+-- One job of a key runs at a time, whichever instance claims it
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_running_lock_key ON jobs(lock_key) WHERE status = 'running';